@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/pglsn"
+)
+
+func TestReplaceHBABlock(t *testing.T) {
+	local := "local\tall\tpostgres\tpeer\n"
+	entries := []guest.HBAEntry{
+		{Type: "hostssl", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "scram-sha-256"},
+	}
+	block := hbaBegin + "\nhostssl\tall\tall\t10.0.0.0/8\tscram-sha-256\n" + hbaEnd + "\n"
+
+	tests := []struct {
+		name    string
+		conf    string
+		entries []guest.HBAEntry
+		want    string
+	}{
+		{"appends the block", local, entries, local + block},
+		{"adds a missing newline", strings.TrimSuffix(local, "\n"), entries, local + block},
+		{"replaces the block", local + hbaBegin + "\nhost\tall\tall\t0.0.0.0/0\ttrust\n" + hbaEnd + "\n# after\n", entries, local + block + "# after\n"},
+		{"empties the block", local + block, nil, local + hbaBegin + "\n" + hbaEnd + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replaceHBABlock(tt.conf, tt.entries); got != tt.want {
+				t.Errorf("replaceHBABlock() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckHBAEntry(t *testing.T) {
+	valid := guest.HBAEntry{Type: "hostssl", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "scram-sha-256"}
+	if err := checkHBAEntry(valid); err != nil {
+		t.Errorf("checkHBAEntry(%+v) = %v", valid, err)
+	}
+	for _, e := range []guest.HBAEntry{
+		{Type: "local", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "trust"},
+		{Type: "host", Database: "all", User: "all", Address: "10.0.0.1", Method: "trust"},
+		{Type: "host", Database: "all", User: "all\nlocal all all trust", Address: "10.0.0.0/8", Method: "trust"},
+		{Type: "host", Database: "all", User: "all", Address: "10.0.0.0/8", Method: ""},
+	} {
+		if err := checkHBAEntry(e); err == nil {
+			t.Errorf("checkHBAEntry(%+v) accepted an invalid entry", e)
+		}
+	}
+}
+
+func TestSegmentStart(t *testing.T) {
+	for _, lsn := range []pglsn.LSN{
+		pglsn.MustParse("0/1000028"),
+		pglsn.MustParse("16/B374D848"),
+		pglsn.MustParse("FF/FF000000"),
+	} {
+		start, err := segmentStart(lsn.SegmentName())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := lsn / pglsn.SegmentSize * pglsn.SegmentSize; start != want {
+			t.Errorf("segmentStart(%s) = %s, want %s", lsn.SegmentName(), start, want)
+		}
+	}
+	if _, err := segmentStart("../postgresql.conf"); err == nil {
+		t.Error("segmentStart accepted an invalid name")
+	}
+}
+
+func TestParseWaldump(t *testing.T) {
+	out := `rmgr: Heap        len (rec/tot):     59/    59, tx:        735, lsn: 0/01000028, prev 0/00FFFF60, desc: INSERT off 2 flags 0x00, blkref #0: rel 1663/5/16384 blk 0
+rmgr: Transaction len (rec/tot):     34/    34, tx:        735, lsn: 0/01000068, prev 0/01000028, desc: COMMIT 2024-05-01 12:30:00.123456 UTC
+rmgr: Standby     len (rec/tot):     50/    50, tx:          0, lsn: 0/01000090, prev 0/01000068, desc: RUNNING_XACTS nextXid 736
+rmgr: XLOG        len (rec/tot):     24/    24, tx:          0, lsn: 0/010000C8, prev 0/01000090, desc: SWITCH
+pg_waldump: error: error in WAL record at 0/10000C8: invalid record length
+`
+	last, commit, ok := parseWaldump(out)
+	if !ok {
+		t.Fatal("parseWaldump found no records")
+	}
+	if want := pglsn.MustParse("0/10000C8"); last != want {
+		t.Errorf("last = %s, want %s", last, want)
+	}
+	if want := time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC); !commit.Equal(want) {
+		t.Errorf("commit = %s, want %s", commit, want)
+	}
+
+	if _, commit, ok := parseWaldump(strings.SplitAfter(out, "\n")[0]); !ok || !commit.IsZero() {
+		t.Errorf("parseWaldump of a segment without commits = %s, %v", commit, ok)
+	}
+	if _, _, ok := parseWaldump("pg_waldump: error: could not find a valid record\n"); ok {
+		t.Error("parseWaldump found records in an error")
+	}
+}
+
+func TestRecoverySettings(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		target guest.RecoveryTarget
+		want   string
+	}{
+		{guest.RecoveryTarget{}, "recovery_target = 'immediate'"},
+		{guest.RecoveryTarget{LSN: "0/10000C8"}, "recovery_target_lsn = '0/10000C8'"},
+		{guest.RecoveryTarget{Time: &at}, "recovery_target_time = '2024-05-01 12:30:00Z'"},
+	}
+	for _, tt := range tests {
+		got := recoverySettings("/var/lib/dbx-agent/restore-wal", tt.target)
+		for _, line := range []string{tt.want, "restore_command = 'cp ''/var/lib/dbx-agent/restore-wal/%f'' ''%p'''", "recovery_target_action = 'promote'"} {
+			if !strings.Contains(got, line+"\n") {
+				t.Errorf("recoverySettings(%+v) =\n%s\nwant a line %s", tt.target, got, line)
+			}
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	archive := func(name string) *tar.Reader {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: 3, Typeflag: tar.TypeReg})
+		tw.Write([]byte("16\n"))
+		tw.Close()
+		return tar.NewReader(&buf)
+	}
+
+	dir := t.TempDir()
+	if err := extract(archive("global/PG_VERSION"), dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "global", "PG_VERSION")); err != nil || string(data) != "16\n" {
+		t.Errorf("extracted %q, %v", data, err)
+	}
+	if err := extract(archive("../escaped"), dir); err == nil {
+		t.Error("extract wrote outside the directory")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	a := &agent{opts: options{token: "secret"}, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"no token", http.MethodGet, "/v1/status", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/v1/status", "other", http.StatusUnauthorized},
+		{"unknown route", http.MethodGet, "/v1/nothing", "secret", http.StatusNotFound},
+		{"wrong method", http.MethodPost, "/v1/status", "secret", http.StatusNotFound},
+		{"invalid segment name", http.MethodGet, "/v1/wal/..%2Fpg_hba.conf", "secret", http.StatusBadRequest},
+		{"invalid publication name", http.MethodDelete, "/v1/publications/Robert'); DROP TABLE students;--", "secret", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.URL.Path = tt.path
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			a.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d %s, want %d", tt.method, tt.path, rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
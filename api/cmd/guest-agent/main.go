@@ -0,0 +1,252 @@
+// Command guest-agent is the reference implementation of the guest agent,
+// whose contract is openapi/guest-agent.yaml. Instance templates run it
+// next to Postgres, as the postgres user, so the worker can reach what the
+// Proxmox API can't: it connects to Postgres over its Unix socket and runs
+// the Postgres client tools for backups, schema copies and restores.
+//
+// The agent serves one database, the one instances are created with. It
+// keeps completed WAL segments, the pending TLS key and the replication
+// password under its state directory. Restoring a backup stops and starts
+// Postgres with pg_ctl, so the template must not also supervise it.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/logging"
+	_ "github.com/lib/pq"
+)
+
+type options struct {
+	listen    string
+	token     string
+	database  string
+	port      int
+	advertise string
+	dataDir   string
+	binDir    string
+	socketDir string
+	stateDir  string
+}
+
+// agent serves the contract for the Postgres of one container.
+type agent struct {
+	opts   options
+	db     *sql.DB
+	logger *slog.Logger
+
+	// mu serializes the operations that rewrite files of Postgres or the
+	// agent, or stop and start Postgres.
+	mu sync.Mutex
+	// segments caches what pg_waldump reports of completed WAL segments,
+	// which don't change, by name.
+	segments map[string]guest.WALSegment
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.listen, "listen", env("DBX_AGENT_LISTEN", ":7433"), "address to serve the agent on")
+	flag.StringVar(&opts.token, "token", env("DBX_GUEST_TOKEN", ""), "token the control plane authenticates with")
+	flag.StringVar(&opts.database, "database", env("DBX_AGENT_DATABASE", "postgres"), "database of the instance")
+	flag.IntVar(&opts.port, "port", 5432, "port Postgres listens on")
+	flag.StringVar(&opts.advertise, "advertise", env("DBX_AGENT_ADVERTISE", ""), "address subscribers reach Postgres at (default: first non-loopback address)")
+	flag.StringVar(&opts.dataDir, "data-dir", env("PGDATA", "/var/lib/postgresql/data"), "data directory of Postgres")
+	flag.StringVar(&opts.binDir, "bin-dir", env("DBX_AGENT_BIN_DIR", "/usr/lib/postgresql/bin"), "directory of pg_ctl, pg_dump and the other Postgres tools")
+	flag.StringVar(&opts.socketDir, "socket-dir", env("DBX_AGENT_SOCKET_DIR", "/var/run/postgresql"), "directory of the Unix socket of Postgres")
+	flag.StringVar(&opts.stateDir, "state-dir", env("DBX_AGENT_STATE_DIR", "/var/lib/dbx-agent"), "directory the agent keeps WAL and keys in")
+	flag.Parse()
+
+	logger := logging.New(config.LogConfig{Level: env("DBX_LOG_LEVEL", "info"), Format: env("DBX_LOG_FORMAT", "json")})
+	if err := run(opts, logger); err != nil {
+		logger.Error("Guest agent failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options, logger *slog.Logger) error {
+	if opts.token == "" {
+		return errors.New("a token is required")
+	}
+	if opts.advertise == "" {
+		addr, err := defaultAddress()
+		if err != nil {
+			return err
+		}
+		opts.advertise = addr
+	}
+	for _, dir := range []string{walDir(opts), restoreDir(opts)} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=postgres dbname=%s sslmode=disable", opts.socketDir, opts.port, opts.database))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	a := &agent{opts: opts, db: db, logger: logger, segments: make(map[string]guest.WALSegment)}
+	srv := &http.Server{Addr: opts.listen, Handler: a, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	logger.Info("Guest agent listening", "address", opts.listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func walDir(opts options) string     { return filepath.Join(opts.stateDir, "wal") }
+func restoreDir(opts options) string { return filepath.Join(opts.stateDir, "restore-wal") }
+
+// bin returns the path of the Postgres tool name.
+func (a *agent) bin(name string) string {
+	return filepath.Join(a.opts.binDir, name)
+}
+
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(a *agent, r *http.Request, args []string) (interface{}, error)
+}
+
+var routes = []route{
+	{http.MethodGet, regexp.MustCompile(`^/v1/status$`), (*agent).status},
+	{http.MethodPost, regexp.MustCompile(`^/v1/publications$`), (*agent).createPublication},
+	{http.MethodDelete, regexp.MustCompile(`^/v1/publications/([^/]+)$`), (*agent).dropPublication},
+	{http.MethodPost, regexp.MustCompile(`^/v1/subscriptions$`), (*agent).createSubscription},
+	{http.MethodGet, regexp.MustCompile(`^/v1/subscriptions/([^/]+)$`), (*agent).getSubscription},
+	{http.MethodPost, regexp.MustCompile(`^/v1/subscriptions/([^/]+)/finish$`), (*agent).finishSubscription},
+	{http.MethodPut, regexp.MustCompile(`^/v1/read-only$`), (*agent).setReadOnly},
+	{http.MethodPut, regexp.MustCompile(`^/v1/pg-hba$`), (*agent).setHBA},
+	{http.MethodPut, regexp.MustCompile(`^/v1/settings$`), (*agent).setSettings},
+	{http.MethodPost, regexp.MustCompile(`^/v1/tls/csr$`), (*agent).createCSR},
+	{http.MethodPut, regexp.MustCompile(`^/v1/tls/certificate$`), (*agent).installCertificate},
+	{http.MethodGet, regexp.MustCompile(`^/v1/checksums$`), (*agent).checksums},
+	{http.MethodGet, regexp.MustCompile(`^/v1/base-backup$`), (*agent).baseBackup},
+	{http.MethodPut, regexp.MustCompile(`^/v1/wal-archiving$`), (*agent).setWALArchiving},
+	{http.MethodPost, regexp.MustCompile(`^/v1/wal/switch$`), (*agent).switchWAL},
+	{http.MethodGet, regexp.MustCompile(`^/v1/wal/([^/]+)$`), (*agent).getWALSegment},
+	{http.MethodDelete, regexp.MustCompile(`^/v1/wal/([^/]+)$`), (*agent).deleteWALSegment},
+	{http.MethodPut, regexp.MustCompile(`^/v1/restore/base-backup$`), (*agent).restoreBaseBackup},
+	{http.MethodPut, regexp.MustCompile(`^/v1/restore/wal/([^/]+)$`), (*agent).restoreWALSegment},
+	{http.MethodPost, regexp.MustCompile(`^/v1/restore$`), (*agent).recover},
+}
+
+// stream is a response that isn't JSON. ServeHTTP closes it.
+type stream struct {
+	contentType string
+	body        io.ReadCloser
+}
+
+func (a *agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.opts.token)) != 1 {
+		writeError(w, fail(http.StatusUnauthorized, "invalid token"))
+		return
+	}
+	for _, rt := range routes {
+		m := rt.pattern.FindStringSubmatch(r.URL.Path)
+		if m == nil || rt.method != r.Method {
+			continue
+		}
+		data, err := rt.handle(a, r, m[1:])
+		if err != nil {
+			if _, ok := err.(*httpError); !ok {
+				a.logger.Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+			writeError(w, err)
+			return
+		}
+		if s, ok := data.(stream); ok {
+			defer s.body.Close()
+			w.Header().Set("Content-Type", s.contentType)
+			if _, err := io.Copy(w, s.body); err != nil {
+				a.logger.Error("Streaming response failed", "path", r.URL.Path, "error", err)
+			}
+			return
+		}
+		if data == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	writeError(w, fail(http.StatusNotFound, "no route %s %s", r.Method, r.URL.Path))
+}
+
+// httpError is an error with the status to respond with. Other errors are
+// responded to with 500.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func fail(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if he, ok := err.(*httpError); ok {
+		status = he.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fail(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+// identifier matches the names of publications and subscriptions the
+// agent accepts, which it uses as SQL identifiers.
+var identifier = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+func checkName(name string) error {
+	if !identifier.MatchString(name) {
+		return fail(http.StatusBadRequest, "invalid name %q: must be a lowercase SQL identifier", name)
+	}
+	return nil
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/pglsn"
+	"github.com/lib/pq"
+)
+
+// replicationUser is the role subscribers connect to publications as.
+const replicationUser = "dbx_replication"
+
+// defaultAddress returns the first non-loopback IPv4 address of the
+// container.
+func defaultAddress() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.New("no address to advertise; set -advertise")
+}
+
+func (a *agent) status(r *http.Request, _ []string) (interface{}, error) {
+	var st guest.Status
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(a.opts.dataDir, &fs); err != nil {
+		return nil, err
+	}
+	st.DiskUsedBytes = int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize)
+
+	err := a.db.QueryRowContext(r.Context(), `
+		SELECT current_setting('server_version_num')::int / 10000,
+		       current_setting('default_transaction_read_only')::bool,
+		       CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_insert_lsn() END::text`,
+	).Scan(&st.PgVersion, &st.ReadOnly, &st.WALLSN)
+	if err == nil {
+		st.Ready = true
+		return st, nil
+	}
+
+	// Postgres is down or still recovering: report the version of the
+	// data directory
+	version, verr := os.ReadFile(filepath.Join(a.opts.dataDir, "PG_VERSION"))
+	if verr != nil {
+		return nil, fmt.Errorf("Postgres is unreachable (%v) and has no data directory: %w", err, verr)
+	}
+	fmt.Sscan(string(version), &st.PgVersion)
+	st.WALLSN = pglsn.LSN(0).String()
+	return st, nil
+}
+
+// setReadOnly changes the default of new transactions and ends the
+// sessions of clients, so none keeps writing with the old default.
+func (a *agent) setReadOnly(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	ctx := r.Context()
+	value := "off"
+	if req.ReadOnly {
+		value = "on"
+	}
+	if _, err := a.db.ExecContext(ctx, "ALTER SYSTEM SET default_transaction_read_only = "+value); err != nil {
+		return nil, err
+	}
+	if _, err := a.db.ExecContext(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return nil, err
+	}
+	if req.ReadOnly {
+		_, err := a.db.ExecContext(ctx, `
+			SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+			WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()
+			  AND usename NOT IN ('postgres', $1)`, replicationUser)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// setSettings sets the settings the plan sizes and reloads Postgres, then
+// restarts it if max_connections or shared_buffers differ from the values
+// it runs with. Comparing with those rather than the ones set before also
+// restarts Postgres when an earlier request failed to.
+func (a *agent) setSettings(r *http.Request, _ []string) (interface{}, error) {
+	var req guest.Settings
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if req.MaxConnections < 1 || req.SharedBuffersMB < 1 || req.EffectiveCacheSizeMB < 1 || req.MaintenanceWorkMemMB < 1 {
+		return nil, fail(http.StatusBadRequest, "settings must be positive")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	var maxConnections int
+	var sharedBuffers int64
+	err := a.db.QueryRowContext(ctx, "SELECT current_setting('max_connections')::int, pg_size_bytes(current_setting('shared_buffers'))").
+		Scan(&maxConnections, &sharedBuffers)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range []string{
+		fmt.Sprintf("ALTER SYSTEM SET max_connections = %d", req.MaxConnections),
+		fmt.Sprintf("ALTER SYSTEM SET shared_buffers = '%dMB'", req.SharedBuffersMB),
+		fmt.Sprintf("ALTER SYSTEM SET effective_cache_size = '%dMB'", req.EffectiveCacheSizeMB),
+		fmt.Sprintf("ALTER SYSTEM SET maintenance_work_mem = '%dMB'", req.MaintenanceWorkMemMB),
+	} {
+		if _, err := a.db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	if maxConnections != req.MaxConnections || sharedBuffers != int64(req.SharedBuffersMB)<<20 {
+		a.logger.Info("Restarting Postgres for new settings", "max_connections", req.MaxConnections, "shared_buffers_mb", req.SharedBuffersMB)
+		return nil, a.pgCtl(ctx, "restart", "--mode", "fast")
+	}
+	_, err = a.db.ExecContext(ctx, "SELECT pg_reload_conf()")
+	return nil, err
+}
+
+// Markers of the block of pg_hba.conf the control plane manages
+const (
+	hbaBegin = "# BEGIN dbx managed entries"
+	hbaEnd   = "# END dbx managed entries"
+)
+
+// setHBA rewrites the managed block of pg_hba.conf and reloads Postgres.
+// It puts the file back if Postgres reports errors in it.
+func (a *agent) setHBA(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Entries []guest.HBAEntry `json:"entries"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	for _, e := range req.Entries {
+		if err := checkHBAEntry(e); err != nil {
+			return nil, err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	var path string
+	if err := a.db.QueryRowContext(ctx, "SHOW hba_file").Scan(&path); err != nil {
+		return nil, err
+	}
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, []byte(replaceHBABlock(string(old), req.Entries)), 0o600); err != nil {
+		return nil, err
+	}
+
+	var line int
+	var msg string
+	err = a.db.QueryRowContext(ctx, "SELECT line_number, error FROM pg_hba_file_rules WHERE error IS NOT NULL LIMIT 1").Scan(&line, &msg)
+	if err == nil {
+		if werr := writeFile(path, old, 0o600); werr != nil {
+			return nil, werr
+		}
+		return nil, fail(http.StatusBadRequest, "invalid pg_hba.conf entry on line %d: %s", line, msg)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	_, err = a.db.ExecContext(ctx, "SELECT pg_reload_conf()")
+	return nil, err
+}
+
+func checkHBAEntry(e guest.HBAEntry) error {
+	switch e.Type {
+	case "host", "hostssl", "hostnossl":
+	default:
+		return fail(http.StatusBadRequest, "invalid connection type %q", e.Type)
+	}
+	if _, err := netip.ParsePrefix(e.Address); err != nil {
+		return fail(http.StatusBadRequest, "invalid address %q", e.Address)
+	}
+	for _, field := range []string{e.Database, e.User, e.Method} {
+		if field == "" || strings.ContainsAny(field, " \t\n#\"") {
+			return fail(http.StatusBadRequest, "invalid pg_hba.conf field %q", field)
+		}
+	}
+	return nil
+}
+
+// replaceHBABlock returns conf with the managed block holding entries,
+// appending the block if conf has none.
+func replaceHBABlock(conf string, entries []guest.HBAEntry) string {
+	var block strings.Builder
+	block.WriteString(hbaBegin + "\n")
+	for _, e := range entries {
+		fmt.Fprintf(&block, "%s\t%s\t%s\t%s\t%s\n", e.Type, e.Database, e.User, e.Address, e.Method)
+	}
+	block.WriteString(hbaEnd + "\n")
+
+	start := strings.Index(conf, hbaBegin+"\n")
+	end := strings.Index(conf, hbaEnd+"\n")
+	if start < 0 || end < start {
+		if conf != "" && !strings.HasSuffix(conf, "\n") {
+			conf += "\n"
+		}
+		return conf + block.String()
+	}
+	return conf[:start] + block.String() + conf[end+len(hbaEnd)+1:]
+}
+
+// checksums summarizes every table by its row count and an MD5 of the MD5s
+// of its rows in order, which doesn't depend on where rows are stored.
+func (a *agent) checksums(r *http.Request, _ []string) (interface{}, error) {
+	ctx := r.Context()
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT schemaname, tablename FROM pg_tables
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+		ORDER BY 1, 2`)
+	if err != nil {
+		return nil, err
+	}
+	var names [][2]string
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, [2]string{schema, table})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]guest.TableChecksum, len(names))
+	for _, n := range names {
+		var sum guest.TableChecksum
+		query := fmt.Sprintf(`SELECT count(*), coalesce(md5(string_agg(md5(t::text), '' ORDER BY md5(t::text))), '') FROM %s.%s t`,
+			pq.QuoteIdentifier(n[0]), pq.QuoteIdentifier(n[1]))
+		if err := a.db.QueryRowContext(ctx, query).Scan(&sum.Rows, &sum.Checksum); err != nil {
+			return nil, fmt.Errorf("failed to checksum %s.%s: %w", n[0], n[1], err)
+		}
+		tables[n[0]+"."+n[1]] = sum
+	}
+	return map[string]interface{}{"tables": tables}, nil
+}
+
+// createPublication publishes every table and lets the replication role,
+// which may read every table for the initial copy, log in with the
+// password kept in the state directory.
+func (a *agent) createPublication(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if err := checkName(req.Name); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	password, err := a.replicationPassword()
+	if err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err := a.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_roles WHERE rolname = $1)", replicationUser).Scan(&exists); err != nil {
+		return nil, err
+	}
+	verb := "ALTER"
+	if !exists {
+		verb = "CREATE"
+	}
+	stmts := []string{
+		fmt.Sprintf("%s ROLE %s WITH LOGIN REPLICATION PASSWORD %s", verb, replicationUser, pq.QuoteLiteral(password)),
+		fmt.Sprintf("GRANT pg_read_all_data TO %s", replicationUser),
+	}
+	if err := a.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_publication WHERE pubname = $1)", req.Name).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		stmts = append(stmts, fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", pq.QuoteIdentifier(req.Name)))
+	}
+	for _, stmt := range stmts {
+		if _, err := a.db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	return guest.Publication{Name: req.Name, Host: a.opts.advertise, Port: a.opts.port, User: replicationUser, Password: password}, nil
+}
+
+// replicationPassword returns the password of the replication role,
+// generating it the first time.
+func (a *agent) replicationPassword() (string, error) {
+	path := filepath.Join(a.opts.stateDir, "replication-password")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(buf)
+	return password, writeFile(path, []byte(password+"\n"), 0o600)
+}
+
+func (a *agent) dropPublication(r *http.Request, args []string) (interface{}, error) {
+	if err := checkName(args[0]); err != nil {
+		return nil, err
+	}
+	_, err := a.db.ExecContext(r.Context(), "DROP PUBLICATION IF EXISTS "+pq.QuoteIdentifier(args[0]))
+	return nil, err
+}
+
+// createSubscription copies the schema of the publisher with pg_dump, as
+// logical replication copies rows only, and subscribes to it.
+func (a *agent) createSubscription(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Name   string            `json:"name"`
+		Source guest.Publication `json:"source"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if err := checkName(req.Name); err != nil {
+		return nil, err
+	}
+	if err := checkName(req.Source.Name); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	var exists bool
+	if err := a.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_subscription WHERE subname = $1)", req.Name).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, nil
+	}
+
+	if err := a.copySchema(ctx, req.Source); err != nil {
+		return nil, fail(http.StatusBadRequest, "failed to copy the schema of the publisher: %v", err)
+	}
+	stmt := fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s",
+		pq.QuoteIdentifier(req.Name), pq.QuoteLiteral(a.conninfo(req.Source)), pq.QuoteIdentifier(req.Source.Name))
+	if _, err := a.db.ExecContext(ctx, stmt); err != nil {
+		return nil, fail(http.StatusBadRequest, "failed to subscribe: %v", err)
+	}
+	return nil, nil
+}
+
+// conninfo returns the libpq connection string of the database of the
+// publisher pub.
+func (a *agent) conninfo(pub guest.Publication) string {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s",
+		quote(pub.Host), pub.Port, quote(pub.User), quote(pub.Password), quote(a.opts.database))
+}
+
+// copySchema pipes pg_dump of the publisher's schema into psql.
+func (a *agent) copySchema(ctx context.Context, pub guest.Publication) error {
+	dump := exec.CommandContext(ctx, a.bin("pg_dump"), "--schema-only", "--no-publications", "--no-subscriptions", "--dbname", a.conninfo(pub))
+	restore := exec.CommandContext(ctx, a.bin("psql"), "--quiet", "--set", "ON_ERROR_STOP=1",
+		"--host", a.opts.socketDir, "--port", fmt.Sprint(a.opts.port), "--dbname", a.opts.database)
+	var dumpErr, restoreErr strings.Builder
+	dump.Stderr, restore.Stderr = &dumpErr, &restoreErr
+
+	pipe, err := dump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	restore.Stdin = pipe
+	if err := dump.Start(); err != nil {
+		return err
+	}
+	if err := restore.Run(); err != nil {
+		dump.Wait()
+		return fmt.Errorf("psql: %v: %s", err, strings.TrimSpace(restoreErr.String()))
+	}
+	if err := dump.Wait(); err != nil {
+		return fmt.Errorf("pg_dump: %v: %s", err, strings.TrimSpace(dumpErr.String()))
+	}
+	return nil
+}
+
+// getSubscription reports the tables copied from pg_subscription_rel and
+// the lag as how far the publisher's WAL is ahead of what the subscription
+// confirmed.
+func (a *agent) getSubscription(r *http.Request, args []string) (interface{}, error) {
+	ctx := r.Context()
+	sub := guest.Subscription{Name: args[0]}
+	var conninfo, confirmed sql.NullString
+	err := a.db.QueryRowContext(ctx, `
+		SELECT s.subconninfo, st.latest_end_lsn::text
+		FROM pg_subscription s LEFT JOIN pg_stat_subscription st ON st.subid = s.oid AND st.relid IS NULL
+		WHERE s.subname = $1`, args[0]).Scan(&conninfo, &confirmed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fail(http.StatusNotFound, "subscription %q does not exist", args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = a.db.QueryRowContext(ctx, `
+		SELECT count(*), count(*) FILTER (WHERE srsubstate IN ('r', 's'))
+		FROM pg_subscription_rel sr JOIN pg_subscription s ON s.oid = sr.srsubid
+		WHERE s.subname = $1`, args[0]).Scan(&sub.TablesTotal, &sub.TablesCopied)
+	if err != nil {
+		return nil, err
+	}
+	sub.State = guest.SubscriptionCopying
+	if sub.TablesCopied < sub.TablesTotal {
+		return sub, nil
+	}
+	sub.State = guest.SubscriptionStreaming
+
+	publisher, err := sql.Open("postgres", conninfo.String)
+	if err != nil {
+		return nil, err
+	}
+	defer publisher.Close()
+	var current string
+	if err := publisher.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&current); err != nil {
+		return nil, fail(http.StatusBadGateway, "could not connect to the publisher: %v", err)
+	}
+	if confirmed.Valid {
+		sub.LagBytes = int64(pglsn.MustParse(current)) - int64(pglsn.MustParse(confirmed.String))
+		if sub.LagBytes < 0 {
+			sub.LagBytes = 0
+		}
+	} else {
+		sub.LagBytes = int64(pglsn.MustParse(current))
+	}
+	return sub, nil
+}
+
+// finishSubscription copies the values of the publisher's sequences and
+// drops the subscription, with its replication slot on the publisher.
+func (a *agent) finishSubscription(r *http.Request, args []string) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	var conninfo string
+	err := a.db.QueryRowContext(ctx, "SELECT subconninfo FROM pg_subscription WHERE subname = $1", args[0]).Scan(&conninfo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fail(http.StatusNotFound, "subscription %q does not exist", args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	publisher, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		return nil, err
+	}
+	defer publisher.Close()
+	rows, err := publisher.QueryContext(ctx, "SELECT schemaname, sequencename, last_value FROM pg_sequences WHERE last_value IS NOT NULL")
+	if err != nil {
+		return nil, fail(http.StatusBadGateway, "could not read the sequences of the publisher: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var schema, name string
+		var value int64
+		if err := rows.Scan(&schema, &name, &value); err != nil {
+			return nil, err
+		}
+		seq := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+		if _, err := a.db.ExecContext(ctx, "SELECT setval($1::regclass, $2)", seq, value); err != nil {
+			return nil, fmt.Errorf("failed to set sequence %s: %w", seq, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = a.db.ExecContext(ctx, "DROP SUBSCRIPTION "+pq.QuoteIdentifier(args[0]))
+	return nil, err
+}
+
+// writeFile replaces the file at path with data, through a temporary file
+// so a crash leaves either version.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/lib/pq"
+)
+
+// pgCtl runs pg_ctl on the data directory, waiting for it to finish.
+func (a *agent) pgCtl(ctx context.Context, args ...string) error {
+	args = append([]string{"--pgdata", a.opts.dataDir, "--wait", "--timeout", "86400",
+		"--log", filepath.Join(a.opts.stateDir, "postgres.log")}, args...)
+	out, err := exec.CommandContext(ctx, a.bin("pg_ctl"), args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pg_ctl %s failed: %v: %s", args[len(args)-1], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// restoreBaseBackup stops Postgres, empties its data directory and
+// extracts the backup into it. Staged WAL is dropped.
+func (a *agent) restoreBaseBackup(r *http.Request, _ []string) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+
+	if _, err := os.Stat(filepath.Join(a.opts.dataDir, "postmaster.pid")); err == nil {
+		if err := a.pgCtl(ctx, "stop", "--mode", "fast"); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range []string{a.opts.dataDir, restoreDir(a.opts)} {
+		if err := emptyDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+	}
+	if err := extract(tar.NewReader(gz), a.opts.dataDir); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(a.opts.dataDir, "backup_label")); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: no backup_label")
+	}
+	return nil, nil
+}
+
+// emptyDir removes what dir holds, keeping dir itself, which may be a
+// mount point.
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract writes the directories and regular files of tr under dir,
+// refusing entries that would land outside it.
+func extract(tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, hdr.Name)
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("entry %q is outside the data directory", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *agent) restoreWALSegment(r *http.Request, args []string) (interface{}, error) {
+	if err := checkSegmentName(args[0]); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(a.opts.dataDir, "backup_label")); err != nil {
+		return nil, fail(http.StatusConflict, "no base backup is restored")
+	}
+
+	path := filepath.Join(restoreDir(a.opts), args[0])
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, os.Rename(path+".tmp", path)
+}
+
+// recover starts Postgres in targeted recovery from the staged WAL, waits
+// for it to promote itself and reports where it stopped.
+func (a *agent) recover(r *http.Request, _ []string) (interface{}, error) {
+	var target guest.RecoveryTarget
+	if err := decode(r, &target); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	if _, err := os.Stat(filepath.Join(a.opts.dataDir, "backup_label")); err != nil {
+		return nil, fail(http.StatusConflict, "no base backup is restored")
+	}
+
+	settings := recoverySettings(restoreDir(a.opts), target)
+	f, err := os.OpenFile(filepath.Join(a.opts.dataDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(settings)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(a.opts.dataDir, "recovery.signal"), nil, 0o600); err != nil {
+		return nil, err
+	}
+	if err := a.pgCtl(ctx, "start"); err != nil {
+		return nil, fail(http.StatusBadRequest, "recovery failed: %v", err)
+	}
+
+	// pg_ctl returns once Postgres accepts read-only connections, before
+	// it reaches the target
+	for {
+		var recovering bool
+		if err := a.db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&recovering); err != nil {
+			return nil, err
+		}
+		if !recovering {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	var point guest.RecoveryPoint
+	var replayed sql.NullTime
+	if err := a.db.QueryRowContext(ctx, "SELECT pg_last_wal_replay_lsn()::text, pg_last_xact_replay_timestamp()").Scan(&point.LSN, &replayed); err != nil {
+		return nil, err
+	}
+	if replayed.Valid {
+		t := replayed.Time.UTC()
+		point.Time = &t
+	}
+	for _, name := range []string{"restore_command", "recovery_target", "recovery_target_time", "recovery_target_lsn", "recovery_target_inclusive", "recovery_target_action"} {
+		if _, err := a.db.ExecContext(ctx, "ALTER SYSTEM RESET "+name); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := a.db.ExecContext(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return nil, err
+	}
+	return point, emptyDir(restoreDir(a.opts))
+}
+
+// recoverySettings returns the lines of postgresql.conf that replay the
+// WAL staged in dir up to target, including the transactions committed
+// there, or to the end of the base backup if target is empty, and
+// promote.
+func recoverySettings(dir string, target guest.RecoveryTarget) string {
+	lines := []string{
+		"restore_command = " + pq.QuoteLiteral(fmt.Sprintf("cp '%s/%%f' '%%p'", dir)),
+		"recovery_target_action = 'promote'",
+	}
+	switch {
+	case target.LSN != "":
+		lines = append(lines, "recovery_target_lsn = "+pq.QuoteLiteral(target.LSN), "recovery_target_inclusive = on")
+	case target.Time != nil:
+		lines = append(lines, "recovery_target_time = "+pq.QuoteLiteral(target.Time.UTC().Format("2006-01-02 15:04:05.999999Z07:00")), "recovery_target_inclusive = on")
+	default:
+		lines = append(lines, "recovery_target = 'immediate'")
+	}
+	return "\n# dbx restore\n" + strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// pendingKeyPath is where the key of the last certificate request waits
+// for its certificate.
+func (a *agent) pendingKeyPath() string {
+	return filepath.Join(a.opts.stateDir, "tls-pending.key")
+}
+
+func (a *agent) createCSR(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		DNSNames []string `json:"dns_names"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.DNSNames) == 0 {
+		return nil, fail(http.StatusBadRequest, "dns_names is required")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: req.DNSNames[0]},
+		DNSNames: req.DNSNames,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := writeFile(a.pendingKeyPath(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return map[string][]byte{"csr": csr}, nil
+}
+
+// installCertificate makes Postgres serve the chain with the pending key,
+// from server.crt and server.key in its data directory, the defaults of
+// ssl_cert_file and ssl_key_file.
+func (a *agent) installCertificate(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(req.Certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fail(http.StatusBadRequest, "certificate must be PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid certificate: %v", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keyPEM, err := os.ReadFile(a.pendingKeyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fail(http.StatusBadRequest, "certificate is not for the pending key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("pending key is not PEM")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, fail(http.StatusBadRequest, "certificate is not for the pending key")
+	}
+
+	if err := writeFile(filepath.Join(a.opts.dataDir, "server.key"), keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(a.opts.dataDir, "server.crt"), []byte(req.Certificate), 0o644); err != nil {
+		return nil, err
+	}
+	ctx := r.Context()
+	if _, err := a.db.ExecContext(ctx, "ALTER SYSTEM SET ssl = on"); err != nil {
+		return nil, err
+	}
+	if _, err := a.db.ExecContext(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return nil, err
+	}
+	return nil, os.Remove(a.pendingKeyPath())
+}
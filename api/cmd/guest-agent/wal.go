@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/pglsn"
+	"github.com/lib/pq"
+)
+
+// segmentName matches the file names of WAL segments.
+var segmentName = regexp.MustCompile(`^[0-9A-F]{24}$`)
+
+func checkSegmentName(name string) error {
+	if !segmentName.MatchString(name) {
+		return fail(http.StatusBadRequest, "invalid WAL segment name %q", name)
+	}
+	return nil
+}
+
+// segmentStart returns the LSN a WAL segment starts at, from its name: a
+// timeline, then the high 32 bits of the LSN and the segment within them.
+func segmentStart(name string) (pglsn.LSN, error) {
+	if !segmentName.MatchString(name) {
+		return 0, fmt.Errorf("invalid WAL segment name %q", name)
+	}
+	hi, _ := strconv.ParseUint(name[8:16], 16, 32)
+	seg, _ := strconv.ParseUint(name[16:24], 16, 32)
+	return pglsn.LSN(hi<<32 + seg*pglsn.SegmentSize), nil
+}
+
+// baseBackup streams pg_basebackup of the whole cluster as one gzipped
+// tar, with the WAL needed to make it consistent fetched into it.
+func (a *agent) baseBackup(r *http.Request, _ []string) (interface{}, error) {
+	cmd := exec.CommandContext(r.Context(), a.bin("pg_basebackup"),
+		"--host", a.opts.socketDir, "--port", strconv.Itoa(a.opts.port), "--username", "postgres",
+		"--pgdata", "-", "--format", "tar", "--gzip", "--wal-method", "fetch", "--checkpoint", "fast")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// Report a failure to start the backup as an error, rather than an
+	// empty archive
+	out := bufio.NewReader(stdout)
+	if _, err := out.Peek(1); err != nil {
+		cmd.Wait()
+		return nil, fmt.Errorf("pg_basebackup failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return stream{contentType: "application/gzip", body: &command{Reader: out, cmd: cmd, stderr: &stderr, agent: a}}, nil
+}
+
+// command is the output of a running command. Closing it waits for the
+// command and logs how it failed.
+type command struct {
+	io.Reader
+	cmd    *exec.Cmd
+	stderr *strings.Builder
+	agent  *agent
+}
+
+func (c *command) Close() error {
+	err := c.cmd.Wait()
+	if err != nil {
+		c.agent.logger.Error("Command failed", "command", c.cmd.Path, "error", err, "stderr", c.stderr.String())
+	}
+	return err
+}
+
+// setWALArchiving points archive_command at the WAL directory of the agent,
+// or at true, which discards segments, and drops the segments kept. Turning
+// archive_mode on restarts Postgres, so templates should ship with it on.
+func (a *agent) setWALArchiving(r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Enabled        bool `json:"enabled"`
+		TimeoutSeconds int  `json:"archive_timeout_seconds"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if req.TimeoutSeconds < 0 {
+		return nil, fail(http.StatusBadRequest, "archive_timeout_seconds must not be negative")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx := r.Context()
+	command := "true"
+	if req.Enabled {
+		command = archiveCommand(walDir(a.opts))
+	}
+	stmts := []string{
+		"ALTER SYSTEM SET archive_command = " + pq.QuoteLiteral(command),
+		fmt.Sprintf("ALTER SYSTEM SET archive_timeout = %d", req.TimeoutSeconds),
+	}
+	var mode string
+	if err := a.db.QueryRowContext(ctx, "SHOW archive_mode").Scan(&mode); err != nil {
+		return nil, err
+	}
+	restart := req.Enabled && mode == "off"
+	if restart {
+		stmts = append(stmts, "ALTER SYSTEM SET archive_mode = on")
+	}
+	for _, stmt := range stmts {
+		if _, err := a.db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	if restart {
+		if err := a.pgCtl(ctx, "restart", "--mode", "fast"); err != nil {
+			return nil, err
+		}
+	} else if _, err := a.db.ExecContext(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return nil, err
+	}
+
+	if !req.Enabled {
+		names, err := a.segmentNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(walDir(a.opts), name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			delete(a.segments, name)
+		}
+	}
+	return nil, nil
+}
+
+// archiveCommand copies a segment into dir, through a temporary file so
+// the agent never lists a partial one.
+func archiveCommand(dir string) string {
+	q := "'" + strings.ReplaceAll(dir, "'", `'\''`) + "'"
+	return fmt.Sprintf("test ! -f %[1]s/%%f && cp %%p %[1]s/%%f.tmp && mv %[1]s/%%f.tmp %[1]s/%%f", q)
+}
+
+// archiveWait bounds how long switchWAL waits for the archiver to copy the
+// segment it closed.
+const archiveWait = 10 * time.Second
+
+// switchWAL closes the current segment, if anything was written to it,
+// waits for the archiver to hand it over and lists the kept segments.
+func (a *agent) switchWAL(r *http.Request, _ []string) (interface{}, error) {
+	ctx := r.Context()
+	var command string
+	if err := a.db.QueryRowContext(ctx, "SELECT current_setting('archive_command')").Scan(&command); err != nil {
+		return nil, err
+	}
+	if command == archiveCommand(walDir(a.opts)) {
+		var switched, name string
+		err := a.db.QueryRowContext(ctx, "SELECT lsn::text, pg_walfile_name(lsn) FROM pg_switch_wal() AS lsn").Scan(&switched, &name)
+		if err != nil {
+			return nil, err
+		}
+		// pg_switch_wal returns the start of the current segment when
+		// there was nothing to switch
+		if pglsn.MustParse(switched)%pglsn.SegmentSize != 0 {
+			a.waitArchived(ctx, name)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names, err := a.segmentNames()
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]guest.WALSegment, 0, len(names))
+	for _, name := range names {
+		seg, err := a.describeSegment(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return map[string]interface{}{"segments": segments}, nil
+}
+
+// waitArchived waits up to archiveWait for the segment name to be
+// archived. A segment archived late is listed by a later switch.
+func (a *agent) waitArchived(ctx context.Context, name string) {
+	deadline := time.Now().Add(archiveWait)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join(walDir(a.opts), name)); err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	a.logger.Warn("WAL segment not archived yet", "segment", name)
+}
+
+// segmentNames lists the segments kept, oldest first.
+func (a *agent) segmentNames() ([]string, error) {
+	entries, err := os.ReadDir(walDir(a.opts))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if segmentName.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// describeSegment reads the last record and commit of a segment with
+// pg_waldump. A segment with no commits ends at the time it was archived.
+func (a *agent) describeSegment(ctx context.Context, name string) (guest.WALSegment, error) {
+	if seg, ok := a.segments[name]; ok {
+		return seg, nil
+	}
+	path := filepath.Join(walDir(a.opts), name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return guest.WALSegment{}, err
+	}
+	start, err := segmentStart(name)
+	if err != nil {
+		return guest.WALSegment{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, a.bin("pg_waldump"), path)
+	cmd.Env = append(os.Environ(), "TZ=UTC")
+	// pg_waldump fails on a record continuing into the next segment,
+	// after printing the ones before it
+	out, _ := cmd.Output()
+	last, commit, ok := parseWaldump(string(out))
+	if !ok {
+		return guest.WALSegment{}, fmt.Errorf("pg_waldump found no records in %s", name)
+	}
+	seg := guest.WALSegment{
+		Name:      name,
+		StartLSN:  start.String(),
+		EndLSN:    last.String(),
+		EndTime:   info.ModTime().UTC(),
+		SizeBytes: info.Size(),
+	}
+	if !commit.IsZero() {
+		seg.EndTime = commit
+	}
+	a.segments[name] = seg
+	return seg, nil
+}
+
+var (
+	waldumpLSN    = regexp.MustCompile(`\blsn: ([0-9A-F]+/[0-9A-F]+),`)
+	waldumpCommit = regexp.MustCompile(`desc: COMMIT (\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?:\.\d+)? UTC)`)
+)
+
+// parseWaldump returns the LSN of the last record pg_waldump printed and
+// the time of the last commit, if any. ok is false if it printed no
+// records.
+func parseWaldump(out string) (last pglsn.LSN, commit time.Time, ok bool) {
+	for _, line := range strings.Split(out, "\n") {
+		m := waldumpLSN.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		lsn, err := pglsn.Parse(m[1])
+		if err != nil {
+			continue
+		}
+		last, ok = lsn, true
+		if c := waldumpCommit.FindStringSubmatch(line); c != nil {
+			if t, err := time.Parse("2006-01-02 15:04:05.999999 MST", c[1]); err == nil {
+				commit = t.UTC()
+			}
+		}
+	}
+	return last, commit, ok
+}
+
+func (a *agent) getWALSegment(r *http.Request, args []string) (interface{}, error) {
+	if err := checkSegmentName(args[0]); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(walDir(a.opts), args[0]))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fail(http.StatusNotFound, "WAL segment %s does not exist", args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream{contentType: "application/octet-stream", body: f}, nil
+}
+
+func (a *agent) deleteWALSegment(r *http.Request, args []string) (interface{}, error) {
+	if err := checkSegmentName(args[0]); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := os.Remove(filepath.Join(walDir(a.opts), args[0]))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fail(http.StatusNotFound, "WAL segment %s does not exist", args[0])
+	}
+	delete(a.segments, args[0])
+	return nil, err
+}
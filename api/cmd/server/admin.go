@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// serveAdmin serves operational endpoints on the admin port until ctx is
+// cancelled. It returns immediately when the admin listener is disabled.
+// standIn is the stand-in name server under --dev, if any, whose records of
+// other zones can then be set.
+func serveAdmin(ctx context.Context, cfg config.AdminConfig, st store.Store, dnsCfg config.DNSConfig, standIn *dns.Server) {
+	if cfg.Port == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/dns/zone", zoneHandler(st, dnsCfg))
+	if standIn != nil {
+		mux.Handle("/dns/stand-in", standInHandler(standIn))
+	}
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("admin server starting", "port", cfg.Port)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("admin server failed", "error", err)
+	}
+}
+
+// zoneHandler serves the instance zone as the control plane holds it, as a
+// zone file, so ops can compare it with what the name servers answer or
+// load it into a local one.
+func zoneHandler(st store.Store, cfg config.DNSConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		records, err := st.DNSRecords().List(r.Context())
+		if err != nil {
+			slog.Error("failed to list DNS records", "error", err)
+			http.Error(w, "failed to list DNS records", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/dns; charset=utf-8")
+		dns.NewSnapshot(cfg, records, time.Now()).WriteTo(w)
+	})
+}
+
+// standInRecords sets the records of a type at a name on the stand-in name
+// server. No values removes them; a CNAME takes one.
+type standInRecords struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Values []string `json:"values"`
+}
+
+// standInHandler sets records on the stand-in name server, as the owner of
+// a custom domain would publish them, so domains can be verified and
+// certified under --dev:
+//
+//	curl -X PUT localhost:9090/dns/stand-in \
+//	  -d '{"name":"_dbx-challenge.db.example.com","type":"TXT","values":["dbx-verification=..."]}'
+func standInHandler(srv *dns.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", "PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req standInRecords
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "expected a JSON object with a name, a type and values", http.StatusBadRequest)
+			return
+		}
+		switch req.Type {
+		case "TXT":
+			srv.SetTXT(req.Name, req.Values...)
+		case "CNAME":
+			if len(req.Values) > 1 {
+				http.Error(w, "a CNAME takes one value", http.StatusBadRequest)
+				return
+			}
+			var target string
+			if len(req.Values) == 1 {
+				target = req.Values[0]
+			}
+			if err := srv.SetCNAME(req.Name, target); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "type must be TXT or CNAME", http.StatusBadRequest)
+			return
+		}
+		slog.Info("set stand-in records", "name", req.Name, "type", req.Type, "values", req.Values)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
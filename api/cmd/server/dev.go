@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/pki"
+	"github.com/zallarak/db/api/internal/pki/acmetest"
+	"github.com/zallarak/db/api/internal/proxmox/fake"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/wireguard"
+)
+
+// Demo account seeded by --dev, so the CLI and console work right away.
+const (
+	demoEmail    = "demo@db.xyz"
+	demoPassword = "demo-password"
+	demoOrg      = "Demo"
+	demoProject  = "demo"
+)
+
+// devTemplates are the templates of the fake cluster by Postgres version,
+// unless proxmox.templates is configured.
+var devTemplates = map[int]int{14: 9014, 15: 9015, 16: 9016, 17: 9017}
+
+// startFakeProxmox serves a fake Proxmox cluster, with the guest agents of
+// its containers and a WireGuard gateway, on a loopback port and points cfg
+// at it. The returned function stops it.
+func startFakeProxmox(cfg *config.Config) (func(), error) {
+	tokenSecret, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	guestToken, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	gatewayToken, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	tokenID := "dbx@pve!dev"
+	if len(cfg.Proxmox.Templates) == 0 {
+		cfg.Proxmox.Templates = devTemplates
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the fake proxmox cluster: %w", err)
+	}
+	srv := &http.Server{
+		Handler: fake.New(fake.Options{
+			Template:     cfg.Proxmox.Template,
+			Templates:    cfg.Proxmox.Templates,
+			TokenID:      tokenID,
+			TokenSecret:  tokenSecret,
+			GuestToken:   guestToken,
+			GatewayToken: gatewayToken,
+		}),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("fake proxmox cluster failed", "error", err)
+		}
+	}()
+
+	cfg.Proxmox.Endpoints = []config.ProxmoxEndpoint{{
+		Name:        "fake",
+		URL:         "http://" + ln.Addr().String(),
+		TokenID:     tokenID,
+		TokenSecret: tokenSecret,
+	}}
+	cfg.Guest = config.GuestConfig{
+		URL:   "http://" + ln.Addr().String() + "/guest/{vmid}",
+		Token: guestToken,
+	}
+	// The fake gateway sets up no tunnels, so the endpoint only has to
+	// look right in peer configs
+	if cfg.Network.WireGuard.Endpoint == "" {
+		key, err := wireguard.GeneratePrivateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Network.WireGuard = config.WireGuardConfig{
+			Endpoint:   "127.0.0.1:51820",
+			PublicKey:  key.PublicKey().String(),
+			GatewayURL: "http://" + ln.Addr().String() + "/wireguard",
+			Token:      gatewayToken,
+		}
+	}
+	slog.Info("fake proxmox cluster started", "url", cfg.Proxmox.Endpoints[0].URL)
+	return func() { srv.Close() }, nil
+}
+
+// startStandInDNS serves the instance zone from a stand-in name server on
+// a loopback port and points the rfc2136 provider at it, and domain
+// ownership checks unless they have a resolver. Close stops it.
+func startStandInDNS(cfg *config.Config) (*dns.Server, error) {
+	srv, err := dns.NewServer(cfg.DNS.Zone)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		return nil, fmt.Errorf("failed to listen for the stand-in name server: %w", err)
+	}
+	cfg.DNS.RFC2136.Server = srv.Addr()
+	if cfg.Domains.Resolver == "" {
+		cfg.Domains.Resolver = srv.Addr()
+	}
+	slog.Info("stand-in name server started", "addr", srv.Addr(), "zone", cfg.DNS.Zone)
+	return srv, nil
+}
+
+// startDevCA generates a throwaway CA for the internal issuer into a
+// temporary directory and points cfg at it. The returned function removes
+// it.
+func startDevCA(cfg *config.Config) (func(), error) {
+	certPEM, keyPEM, err := pki.GenerateCA("db.xyz dev CA")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "dbx-ca-")
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLS.CA.CertFile = filepath.Join(dir, "ca.pem")
+	cfg.TLS.CA.KeyFile = filepath.Join(dir, "ca-key.pem")
+	if err := os.WriteFile(cfg.TLS.CA.CertFile, certPEM, 0o644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := os.WriteFile(cfg.TLS.CA.KeyFile, keyPEM, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	slog.Info("generated a throwaway CA", "cert_file", cfg.TLS.CA.CertFile)
+	return func() { os.RemoveAll(dir) }, nil
+}
+
+// startStandInACME serves a stand-in ACME CA on a loopback port and points
+// the acme issuer at it. It checks challenges through the rfc2136 server,
+// where the provider publishes them. The returned function stops it.
+func startStandInACME(cfg *config.Config) (func(), error) {
+	var resolver string
+	if cfg.DNS.Provider == "rfc2136" {
+		resolver = cfg.DNS.RFC2136.Server
+	}
+	srv, err := acmetest.NewServer(resolver)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := os.CreateTemp("", "dbx-acme-roots-*.pem")
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	stop := func() {
+		srv.Close()
+		os.Remove(roots.Name())
+	}
+	_, err = roots.Write(srv.Roots())
+	if cerr := roots.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	cfg.TLS.ACME.DirectoryURL = srv.DirectoryURL()
+	cfg.TLS.ACME.RootsFile = roots.Name()
+	slog.Info("stand-in ACME server started", "directory_url", srv.DirectoryURL())
+	return stop, nil
+}
+
+func randomHex() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// seedDev creates the demo user with an org and a project, unless the user
+// already exists.
+func seedDev(ctx context.Context, st store.Store, authService *auth.Service) error {
+	_, err := st.Users().GetByEmail(ctx, demoEmail)
+	if err == nil {
+		slog.Info("demo user exists", "email", demoEmail)
+		return nil
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+
+	user, err := authService.Register(ctx, demoEmail, demoPassword)
+	if err != nil {
+		return fmt.Errorf("failed to create demo user: %w", err)
+	}
+	err = st.InTx(ctx, func(tx store.Store) error {
+		org := models.Org{Name: demoOrg}
+		if err := tx.Orgs().Create(ctx, &org); err != nil {
+			return err
+		}
+		err := tx.Memberships().Create(ctx, &models.Membership{
+			UserID: user.ID,
+			OrgID:  org.ID,
+			Role:   models.RoleOwner,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Projects().Create(ctx, &models.Project{OrgID: org.ID, Name: demoProject})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create demo org: %w", err)
+	}
+
+	// The password is well known, and the logger would redact it as a field
+	slog.Info("created demo user, log in with password "+demoPassword, "email", demoEmail)
+	return nil
+}
@@ -1,87 +1,259 @@
 package main
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/zallarak/db/api/internal/apispec"
 	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/config"
 	"github.com/zallarak/db/api/internal/db"
-	"github.com/zallarak/db/api/internal/handlers"
-	"github.com/zallarak/db/api/internal/middleware"
-	"github.com/gin-gonic/gin"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/migrate"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/scheduler"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/tracing"
+	"github.com/zallarak/db/api/migrations"
 )
 
 func main() {
-	// Initialize database connection
-	database, err := db.Init()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := runMigrate(os.Args[2:]); err != nil {
+				fatal("Migration failed", err)
+			}
+			return
+		case "worker":
+			if err := runWorker(os.Args[2:]); err != nil {
+				fatal("Worker failed", err)
+			}
+			return
+		case "quota":
+			if err := runQuota(os.Args[2:]); err != nil {
+				fatal("Quota command failed", err)
+			}
+			return
+		case "openapi":
+			if err := runOpenAPI(os.Args[2:]); err != nil {
+				fatal("OpenAPI check failed", err)
+			}
+			return
+		}
+	}
+
+	cfg, args, err := config.Load("server", os.Args[1:])
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	if len(args) > 0 {
+		fatal("Unknown command", fmt.Errorf("%q", args[0]))
+	}
+
+	logger := logging.New(cfg.Log)
+
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing, "api")
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+
+	// Open the store. The memory driver has no database, so features
+	// backed directly by SQL are unavailable with it.
+	var (
+		st       store.Store
+		database *sql.DB
+		migrator *migrate.Migrator
+	)
+	if cfg.Database.Driver == "memory" {
+		logger.Warn("using the in-memory store, all data is lost when the server stops")
+		st = store.NewMemory()
+	} else {
+		database, err = db.Init(cfg.Database)
+		if err != nil {
+			fatal("Failed to connect to database", err)
+		}
+		defer database.Close()
+		metrics.RegisterDB(database)
+
+		migrator, err = migrate.New(database, migrations.FS)
+		if err != nil {
+			fatal("Failed to load migrations", err)
+		}
+		if cfg.Database.AutoMigrate {
+			applied, err := migrator.Up(context.Background())
+			if err != nil {
+				fatal("Failed to migrate database", err)
+			}
+			for _, m := range applied {
+				logger.Info("applied migration", "version", m.Version, "name", m.Name)
+			}
+		}
+
+		st = store.NewPostgres(database)
+	}
+
+	// Without configured clusters, --dev provisions on a fake one
+	if cfg.Dev && len(cfg.Proxmox.Endpoints) == 0 {
+		stopFake, err := startFakeProxmox(cfg)
+		if err != nil {
+			fatal("Failed to start fake Proxmox cluster", err)
+		}
+		defer stopFake()
+	}
+	// Without a configured name server, --dev publishes to a stand-in one
+	var standIn *dns.Server
+	if cfg.Dev && cfg.DNS.Provider == "rfc2136" && cfg.DNS.RFC2136.Server == "" {
+		standIn, err = startStandInDNS(cfg)
+		if err != nil {
+			fatal("Failed to start stand-in name server", err)
+		}
+		defer standIn.Close()
+	}
+	// and issues certificates from a throwaway CA or a stand-in ACME server
+	if cfg.Dev && cfg.TLS.Issuer == "internal" && cfg.TLS.CA.CertFile == "" {
+		removeCA, err := startDevCA(cfg)
+		if err != nil {
+			fatal("Failed to generate a CA", err)
+		}
+		defer removeCA()
+	}
+	if cfg.Dev && cfg.TLS.Issuer == "acme" && cfg.TLS.ACME.DirectoryURL == "" {
+		stopACME, err := startStandInACME(cfg)
+		if err != nil {
+			fatal("Failed to start stand-in ACME server", err)
+		}
+		defer stopACME()
+	}
+
+	if cfg.Dev {
+		authService := auth.NewService(st.Users(), cfg.Auth.JWTSecret, cfg.Auth.JWTPreviousSecrets)
+		if err := seedDev(context.Background(), st, authService); err != nil {
+			fatal("Failed to seed demo data", err)
+		}
+	}
+
+	doc, err := apispec.Load()
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
-	}
-	defer database.Close()
-
-	// Create auth service
-	authService := auth.NewService(database)
-
-	// Create handlers
-	authHandler := handlers.NewAuthHandler(authService)
-	userHandler := handlers.NewUserHandler(database)
-	orgHandler := handlers.NewOrgHandler(database)
-
-	// Setup router
-	r := gin.Default()
-
-	// Middleware
-	r.Use(middleware.CORS())
-	r.Use(middleware.RequestID())
-
-	// Health check
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
-
-	// Serve OpenAPI documentation
-	r.Static("/docs", "./openapi.yaml")
-	r.GET("/openapi.yaml", func(c *gin.Context) {
-		c.File("./openapi.yaml")
-	})
-
-	// API v1 routes
-	v1 := r.Group("/v1")
-	{
-		// Auth routes
-		auth := v1.Group("/auth")
-		{
-			auth.POST("/register", authHandler.Register)
-			auth.POST("/login", authHandler.Login)
-			auth.POST("/logout", authHandler.Logout)
+		fatal("Failed to load the API specification", err)
+	}
+	var validator *apispec.Validator
+	if cfg.OpenAPI.Validation != apispec.ModeOff {
+		validator = apispec.NewValidator(doc, cfg.OpenAPI.Validation)
+	}
+
+	// The API asks the agents of instances how much disk they use
+	cluster, err := proxmox.NewCluster(cfg.Proxmox.Endpoints)
+	if err != nil {
+		fatal("Failed to set up the Proxmox cluster", err)
+	}
+	agents := guest.NewAgents(cfg.Guest, cluster)
+
+	r, healthHandler := newRouter(cfg, st, database, migrator, validator, agents)
+	if cfg.Dev {
+		for _, problem := range apispec.CheckRoutes(doc, r.Routes()) {
+			logger.Warn("route and API specification differ: " + problem)
 		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		serveAdmin(ctx, cfg.Admin, st, cfg.DNS, standIn)
+	}()
+	go func() {
+		defer wg.Done()
+		serveDomainProxy(ctx, cfg.Domains, cfg.Network, st)
+	}()
 
-		// Protected routes
-		protected := v1.Group("/")
-		protected.Use(middleware.AuthRequired(authService))
-		{
-			// User routes
-			protected.GET("/users/me", userHandler.GetCurrentUser)
-
-			// Org routes
-			orgs := protected.Group("/orgs")
-			{
-				orgs.GET("", orgHandler.ListOrgs)
-				orgs.POST("", orgHandler.CreateOrg)
-				orgs.GET("/:orgId", orgHandler.GetOrg)
-				orgs.PATCH("/:orgId", orgHandler.UpdateOrg)
-				orgs.DELETE("/:orgId", orgHandler.DeleteOrg)
+	if cfg.Worker.Embedded {
+		w, err := newWorker(st, cfg)
+		if err != nil {
+			fatal("Failed to create worker", err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := w.Run(ctx); err != nil {
+				logger.Error("worker failed", "error", err)
 			}
+		}()
+		go func() {
+			defer wg.Done()
+			scheduler.New(st, cfg.Backups, cfg.DNS, cfg.TLS, cfg.Domains).Run(ctx)
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	go func() {
+		logger.Info("server starting", "port", cfg.Server.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Failed to start server", err)
 		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logger.Info("shutting down", "drain_period", cfg.Server.DrainPeriod.String(), "timeout", cfg.Server.ShutdownTimeout.String())
+	healthHandler.Drain()
+	drain(cfg.Server.DrainPeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down cleanly", "error", err)
 	}
+	wg.Wait()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", "error", err)
 	}
+}
 
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+// drain keeps the server up for period after /readyz started failing, until
+// readiness probes have noticed, or until a second SIGINT or SIGTERM.
+func drain(period time.Duration) {
+	if period <= 0 {
+		return
 	}
-}
\ No newline at end of file
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-sig:
+	}
+}
+
+// fatal logs err and exits. Unlike log.Fatal it goes through slog, so the
+// line is formatted like every other.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/db"
+	"github.com/zallarak/db/api/internal/migrate"
+	"github.com/zallarak/db/api/migrations"
+)
+
+const migrateUsage = `usage: server migrate <command> [flags] [args]
+
+Commands:
+  up                  apply all pending migrations
+  down [n]            revert the last n applied migrations (default 1)
+  status              list migrations and whether they have been applied
+  baseline <version>  record migrations up to version as applied without
+                      running them, for databases created before migrations
+                      were tracked
+  create <name>       add empty up and down scripts to --dir (default "migrations")
+
+Flags are the same as for the server, e.g. --config or --database-url.`
+
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	command, args := args[0], args[1:]
+
+	// create only touches the source tree and needs no database
+	if command == "create" {
+		fs := flag.NewFlagSet("server migrate create", flag.ContinueOnError)
+		dir := fs.String("dir", "migrations", "directory holding the migration files")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("usage: server migrate create [--dir DIR] <name>")
+		}
+		paths, err := migrate.Create(*dir, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			fmt.Println("Created", p)
+		}
+		return nil
+	}
+
+	switch command {
+	case "up", "down", "status", "baseline":
+	default:
+		return fmt.Errorf("unknown migrate command %q\n\n%s", command, migrateUsage)
+	}
+
+	cfg, args, err := config.Load("server migrate "+command, args)
+	if err != nil {
+		return err
+	}
+	if cfg.Database.Driver != "postgres" {
+		return fmt.Errorf("migrations apply to the postgres database driver, not %s", cfg.Database.Driver)
+	}
+
+	database, err := db.Init(cfg.Database)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer database.Close()
+
+	migrator, err := migrate.New(database, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		printMigrations("Applied", applied)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 0 {
+			steps, err = strconv.Atoi(args[0])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[0])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		printMigrations("Reverted", reverted)
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			fmt.Println("No migrations to revert")
+		}
+
+	case "baseline":
+		if len(args) != 1 {
+			return errors.New("usage: server migrate baseline <version>")
+		}
+		version, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[0])
+		}
+		marked, err := migrator.Baseline(ctx, version)
+		if err != nil {
+			return err
+		}
+		printMigrations("Marked as applied", marked)
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, s := range statuses {
+			state, appliedAt := "pending", ""
+			if s.Applied {
+				state = "applied"
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			switch {
+			case s.Missing:
+				state = "applied, unknown to this binary"
+			case s.Modified:
+				state = "applied, modified since"
+			}
+			fmt.Fprintf(w, "%03d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func printMigrations(verb string, list []migrate.Migration) {
+	for _, m := range list {
+		fmt.Printf("%s %03d_%s\n", verb, m.Version, m.Name)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zallarak/db/api/internal/apispec"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+const openapiUsage = `usage: server openapi check
+
+Commands:
+  check  validate openapi/openapi.yaml and compare it with the routes of the
+         server, failing if a route is undocumented or an operation unrouted`
+
+// runOpenAPI checks the embedded specification. CI runs it so the spec and
+// the routes can't drift apart.
+func runOpenAPI(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New(openapiUsage)
+	}
+
+	doc, err := apispec.Load()
+	if err != nil {
+		return err
+	}
+
+	// The routes don't depend on the store, so a throwaway one will do
+	r, _ := newRouter(config.Default(), store.NewMemory(), nil, nil, nil, nil)
+	problems := apispec.CheckRoutes(doc, r.Routes())
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d differences between the routes and the API specification", len(problems))
+	}
+	fmt.Println("API specification matches the routes")
+	return nil
+}
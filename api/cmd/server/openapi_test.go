@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/apispec"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+func TestRoutesMatchSpec(t *testing.T) {
+	doc, err := apispec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := newRouter(config.Default(), store.NewMemory(), nil, nil, nil, nil)
+	for _, p := range apispec.CheckRoutes(doc, r.Routes()) {
+		t.Error(p)
+	}
+}
+
+// specCall is one request of TestRoutesAgainstSpec. Path is the path of the
+// operation in the spec, with {params} filled in from the values saved by
+// earlier calls.
+type specCall struct {
+	method string
+	path   string
+	body   any
+	want   int
+	// save is called with the decoded response to keep values for later
+	// calls
+	save func(t *testing.T, resp map[string]any)
+}
+
+// TestRoutesAgainstSpec calls every operation of the spec through the
+// router with strict validation, which answers a response that doesn't
+// match the spec with a 500. Requests the spec rejects get a 400, so both
+// show up as an unexpected status.
+func TestRoutesAgainstSpec(t *testing.T) {
+	doc, err := apispec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The identity provider of the org's SSO connection
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	}))
+	defer idp.Close()
+
+	cfg := config.Default()
+	cfg.Auth.JWTSecret = config.DevJWTSecret
+	cfg.Server.BaseURL = "http://127.0.0.1:8080"
+	cfg.Network.WireGuard.Endpoint = "gateway.example.com:51820"
+	cfg.Network.WireGuard.PublicKey = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	st := store.NewMemory()
+	r, _ := newRouter(cfg, st, nil, nil, apispec.NewValidator(doc, apispec.ModeStrict), nil)
+
+	ctx := context.Background()
+	vars := map[string]string{"issuer": idp.URL, "domain": "spec.invalid"}
+	var token string
+	// running marks the instance running, as the worker would once it is
+	// provisioned
+	running := func(t *testing.T) {
+		inst, err := st.Instances().Get(ctx, vars["instanceId"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.Status = models.InstanceRunning
+		if err := st.Instances().Update(ctx, inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save := func(name string, keys ...string) func(*testing.T, map[string]any) {
+		return func(t *testing.T, resp map[string]any) {
+			vars[name] = field(t, resp, keys...)
+		}
+	}
+
+	calls := []specCall{
+		{method: "GET", path: "/plans", want: 200},
+		{method: "GET", path: "/ca.pem", want: 404},
+		{method: "POST", path: "/auth/register", body: map[string]string{"email": "spec@example.com", "password": "password1"}, want: 201},
+		{method: "POST", path: "/auth/login", body: map[string]string{"email": "spec@example.com", "password": "password1"}, want: 200,
+			save: func(t *testing.T, resp map[string]any) { token = field(t, resp, "token") }},
+		{method: "GET", path: "/users/me", want: 200},
+
+		{method: "POST", path: "/auth/device/code", body: url.Values{"client_id": {"dbx-cli"}}, want: 200,
+			save: func(t *testing.T, resp map[string]any) {
+				vars["userCode"] = field(t, resp, "user_code")
+				vars["deviceCode"] = field(t, resp, "device_code")
+			}},
+		{method: "GET", path: "/auth/device/{userCode}", want: 200},
+		{method: "POST", path: "/auth/device/decision", body: map[string]string{"user_code": "{userCode}", "action": "approve"}, want: 200},
+		{method: "POST", path: "/auth/device/token", body: url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {"{deviceCode}"},
+			"client_id":   {"dbx-cli"},
+		}, want: 200},
+
+		{method: "POST", path: "/orgs", body: map[string]string{"name": "Spec"}, want: 201, save: save("orgId", "org", "id")},
+		{method: "GET", path: "/orgs", want: 200},
+		{method: "GET", path: "/orgs/{orgId}", want: 200},
+		{method: "PATCH", path: "/orgs/{orgId}", body: map[string]string{"name": "Spec Org"}, want: 200},
+		{method: "GET", path: "/orgs/{orgId}/quotas", want: 200},
+
+		{method: "GET", path: "/orgs/{orgId}/sso", want: 404},
+		{method: "PUT", path: "/orgs/{orgId}/sso", body: map[string]any{
+			"issuer":            "{issuer}",
+			"client_id":         "db-xyz",
+			"client_secret":     "secret",
+			"auto_join_domains": []string{"{domain}"},
+		}, want: 200},
+		{method: "GET", path: "/orgs/{orgId}/sso", want: 200},
+		{method: "POST", path: "/orgs/{orgId}/sso/domains/{domain}:verify", want: 200},
+		{method: "GET", path: "/auth/sso/start?org_id={orgId}", want: 302},
+		{method: "GET", path: "/auth/sso/callback?state=unknown&code=unknown", want: 400},
+		{method: "POST", path: "/auth/sso/link", body: map[string]string{"org_id": "{orgId}"}, want: 200},
+		{method: "DELETE", path: "/orgs/{orgId}/sso", want: 200},
+
+		{method: "GET", path: "/orgs/{orgId}/network", want: 404},
+		{method: "POST", path: "/orgs/{orgId}/network", want: 201},
+		{method: "GET", path: "/orgs/{orgId}/network", want: 200},
+		{method: "POST", path: "/orgs/{orgId}/network/peers", body: map[string]string{"name": "laptop"}, want: 201,
+			save: save("peerId", "peer", "id")},
+		{method: "GET", path: "/orgs/{orgId}/network/peers", want: 200},
+		{method: "DELETE", path: "/orgs/{orgId}/network/peers/{peerId}", want: 202},
+
+		{method: "POST", path: "/orgs/{orgId}/projects", body: map[string]string{"name": "spec"}, want: 201,
+			save: save("projectId", "project", "id")},
+		{method: "GET", path: "/orgs/{orgId}/projects", want: 200},
+		{method: "GET", path: "/projects/{projectId}", want: 200},
+
+		{method: "POST", path: "/projects/{projectId}/instances", body: map[string]any{"name": "spec", "plan": "nano"}, want: 202,
+			save: func(t *testing.T, resp map[string]any) {
+				vars["instanceId"] = field(t, resp, "instance", "id")
+				vars["jobId"] = field(t, resp, "job_id")
+				running(t)
+			}},
+		{method: "GET", path: "/projects/{projectId}/instances", want: 200},
+		{method: "GET", path: "/instances/{instanceId}", want: 200},
+		{method: "GET", path: "/jobs/{jobId}", want: 200},
+		{method: "GET", path: "/instances/{instanceId}/certificate", want: 404},
+
+		{method: "GET", path: "/instances/{instanceId}/network-policy", want: 200},
+		{method: "PUT", path: "/instances/{instanceId}/network-policy", body: map[string]any{"allowed_cidrs": []string{"203.0.113.0/24"}}, want: 202,
+			save: func(t *testing.T, _ map[string]any) { running(t) }},
+
+		{method: "GET", path: "/instances/{instanceId}/backup-policy", want: 404},
+		{method: "PUT", path: "/instances/{instanceId}/backup-policy", body: map[string]any{"schedule": "0 3 * * *", "retention_days": 7}, want: 200},
+		{method: "GET", path: "/instances/{instanceId}/backup-policy", want: 200},
+		{method: "DELETE", path: "/instances/{instanceId}/backup-policy", want: 200},
+		{method: "POST", path: "/instances/{instanceId}/backups", want: 202,
+			save: func(t *testing.T, resp map[string]any) {
+				vars["backupId"] = field(t, resp, "backup", "id")
+				backup, err := st.Backups().Get(ctx, vars["backupId"])
+				if err != nil {
+					t.Fatal(err)
+				}
+				backup.Status = models.BackupCompleted
+				if err := st.Backups().Update(ctx, backup); err != nil {
+					t.Fatal(err)
+				}
+				running(t)
+			}},
+		{method: "GET", path: "/instances/{instanceId}/backups", want: 200},
+		{method: "POST", path: "/instances/{instanceId}:restore", body: map[string]string{"name": "restored", "backup_id": "{backupId}"}, want: 202},
+
+		{method: "POST", path: "/instances/{instanceId}/domains", body: map[string]string{"name": "db.example.com"}, want: 202,
+			save: save("domainId", "domain", "id")},
+		{method: "GET", path: "/instances/{instanceId}/domains", want: 200},
+		{method: "GET", path: "/instances/{instanceId}/domains/{domainId}", want: 200},
+		{method: "POST", path: "/instances/{instanceId}/domains/{domainId}:verify", want: 202},
+		{method: "DELETE", path: "/instances/{instanceId}/domains/{domainId}", want: 200},
+
+		{method: "POST", path: "/instances/{instanceId}:resize", body: map[string]string{"plan": "lite"}, want: 202,
+			save: func(t *testing.T, _ map[string]any) { running(t) }},
+		{method: "POST", path: "/instances/{instanceId}:upgrade", body: map[string]int{"pg_version": 17}, want: 202},
+		{method: "GET", path: "/instances/{instanceId}/upgrades", want: 200},
+		{method: "POST", path: "/instances/{instanceId}:rollback", want: 409},
+
+		{method: "DELETE", path: "/instances/{instanceId}", want: 202},
+		{method: "DELETE", path: "/projects/{projectId}", want: 409},
+		{method: "DELETE", path: "/orgs/{orgId}", want: 409},
+		{method: "POST", path: "/auth/logout", want: 200},
+	}
+
+	called := map[string]bool{}
+	for _, call := range calls {
+		path := fill(call.path, vars)
+		op := call.method + " " + strings.SplitN(call.path, "?", 2)[0]
+		called[op] = true
+
+		var body []byte
+		var contentType string
+		switch b := call.body.(type) {
+		case nil:
+		case url.Values:
+			form := url.Values{}
+			for k, v := range b {
+				form[k] = []string{fill(v[0], vars)}
+			}
+			body, contentType = []byte(form.Encode()), "application/x-www-form-urlencoded"
+		default:
+			raw, err := json.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, contentType = []byte(fill(string(raw), vars)), "application/json"
+		}
+
+		req := httptest.NewRequest(call.method, "/v1"+path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != call.want {
+			t.Fatalf("%s %s: status %d, want %d: %s", call.method, path, w.Code, call.want, w.Body.String())
+		}
+		if call.save != nil {
+			var resp map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("%s %s: decoding %q: %v", call.method, path, w.Body.String(), err)
+			}
+			call.save(t, resp)
+		}
+	}
+
+	// Every operation must be called, so new ones get added above
+	var missing []string
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !called[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	for _, op := range missing {
+		t.Errorf("operation %s is not called", op)
+	}
+}
+
+// fill replaces the {params} in s with their saved values.
+func fill(s string, vars map[string]string) string {
+	for name, value := range vars {
+		s = strings.ReplaceAll(s, "{"+name+"}", value)
+	}
+	return s
+}
+
+// field returns the string at keys in a decoded JSON response.
+func field(t *testing.T, resp map[string]any, keys ...string) string {
+	t.Helper()
+	var v any = resp
+	for _, key := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			t.Fatalf("response has no %s: %v", strings.Join(keys, "."), resp)
+		}
+		v = m[key]
+	}
+	s, ok := v.(string)
+	if !ok {
+		t.Fatalf("response has no %s: %v", strings.Join(keys, "."), resp)
+	}
+	return s
+}
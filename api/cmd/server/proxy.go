@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// serveDomainProxy routes connections for the verified custom domains of
+// instances until ctx is cancelled. It returns immediately when the proxy is
+// disabled.
+func serveDomainProxy(ctx context.Context, cfg config.DomainsConfig, network config.NetworkConfig, st store.Store) {
+	if cfg.ProxyPort == 0 {
+		return
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.ProxyPort))
+	if err != nil {
+		slog.Error("domain proxy failed", "error", err)
+		return
+	}
+
+	slog.Info("domain proxy starting", "port", cfg.ProxyPort)
+	proxy := customdomain.NewProxy(customdomain.NewStoreRouter(st, netpolicy.NewCompiler(network)))
+	if err := proxy.Serve(ctx, ln); err != nil {
+		slog.Error("domain proxy failed", "error", err)
+	}
+}
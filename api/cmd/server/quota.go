@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/db"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/quota"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+const quotaUsage = `usage: server quota <command> [flags] <org|project> <id> [limit=value...]
+
+Commands:
+  show   print the limits in effect and where each comes from
+  set    override limits, e.g. instances=20 vcpus=64 plans=nano,lite;
+         a value of unlimited lifts the limit and default restores the
+         configured one
+  reset  remove every override, restoring the configured limits
+
+Limits are instances, vcpus, memory_mb, disk_gib and plans. Flags are the
+same as for the server, e.g. --config or --database-url.`
+
+func runQuota(args []string) error {
+	if len(args) == 0 {
+		return errors.New(quotaUsage)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "show", "set", "reset":
+	default:
+		return fmt.Errorf("unknown quota command %q\n\n%s", command, quotaUsage)
+	}
+
+	cfg, args, err := config.Load("server quota "+command, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 || (args[0] != "org" && args[0] != "project") {
+		return errors.New(quotaUsage)
+	}
+	scope, id, settings := args[0], args[1], args[2:]
+	if command != "set" && len(settings) > 0 {
+		return fmt.Errorf("server quota %s takes no limits", command)
+	}
+	if command == "set" && len(settings) == 0 {
+		return errors.New("server quota set needs at least one limit=value")
+	}
+	if cfg.Database.Driver != "postgres" {
+		return fmt.Errorf("quota overrides are stored with the postgres database driver, not %s", cfg.Database.Driver)
+	}
+
+	database, err := db.Init(cfg.Database)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer database.Close()
+
+	ctx := context.Background()
+	st := store.NewPostgres(database)
+	quotas := st.Quotas()
+	get, set, del := quotas.GetOrg, quotas.SetOrg, quotas.DeleteOrg
+	if scope == "project" {
+		get, set, del = quotas.GetProject, quotas.SetProject, quotas.DeleteProject
+		_, err = st.Projects().Get(ctx, id)
+	} else {
+		_, err = st.Orgs().Get(ctx, id)
+	}
+	if err == store.ErrNotFound {
+		return fmt.Errorf("%s %s not found", scope, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "set":
+		override, err := get(ctx, id)
+		if err == store.ErrNotFound {
+			override = &models.Quota{}
+		} else if err != nil {
+			return err
+		}
+		for _, s := range settings {
+			if err := applyQuotaSetting(ctx, st.Plans(), override, s); err != nil {
+				return err
+			}
+		}
+		if err := set(ctx, id, override); err != nil {
+			return err
+		}
+
+	case "reset":
+		if err := del(ctx, id); err == store.ErrNotFound {
+			fmt.Printf("The %s has no overrides\n", scope)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	checker := quota.NewChecker(cfg.Quotas)
+	limits, err := checker.OrgLimits(ctx, st, id)
+	if scope == "project" {
+		limits, err = checker.ProjectLimits(ctx, st, id)
+	}
+	if err != nil {
+		return err
+	}
+	override, err := get(ctx, id)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	printQuota(limits, override)
+	return nil
+}
+
+// applyQuotaSetting applies one limit=value argument of `server quota set`.
+func applyQuotaSetting(ctx context.Context, plans store.Plans, q *models.Quota, setting string) error {
+	name, value, ok := strings.Cut(setting, "=")
+	if !ok {
+		return fmt.Errorf("invalid limit %q, expected limit=value", setting)
+	}
+
+	if name == "plans" {
+		switch value {
+		case "default":
+			q.Plans = nil
+		case "all", "":
+			q.Plans = []string{}
+		default:
+			q.Plans = strings.Split(value, ",")
+			for _, p := range q.Plans {
+				if _, err := plans.Get(ctx, p); err == store.ErrNotFound {
+					return fmt.Errorf("unknown plan %q", p)
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var field **int
+	switch name {
+	case "instances":
+		field = &q.Instances
+	case "vcpus":
+		field = &q.VCPUs
+	case "memory_mb":
+		field = &q.MemoryMB
+	case "disk_gib":
+		field = &q.DiskGiB
+	default:
+		return fmt.Errorf("unknown limit %q", name)
+	}
+	switch value {
+	case "default":
+		*field = nil
+	case "unlimited":
+		n := 0
+		*field = &n
+	default:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q, expected a positive number, unlimited or default", name, value)
+		}
+		*field = &n
+	}
+	return nil
+}
+
+func printQuota(limits quota.Limits, override *models.Quota) {
+	if override == nil {
+		override = &models.Quota{}
+	}
+	source := func(overridden bool) string {
+		if overridden {
+			return "override"
+		}
+		return "config"
+	}
+	limit := func(n int) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(n)
+	}
+	plans := "all"
+	if len(limits.Plans) > 0 {
+		sorted := append([]string(nil), limits.Plans...)
+		sort.Strings(sorted)
+		plans = strings.Join(sorted, ",")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LIMIT\tVALUE\tSOURCE")
+	fmt.Fprintf(w, "instances\t%s\t%s\n", limit(limits.Instances), source(override.Instances != nil))
+	fmt.Fprintf(w, "vcpus\t%s\t%s\n", limit(limits.VCPUs), source(override.VCPUs != nil))
+	fmt.Fprintf(w, "memory_mb\t%s\t%s\n", limit(limits.MemoryMB), source(override.MemoryMB != nil))
+	fmt.Fprintf(w, "disk_gib\t%s\t%s\n", limit(limits.DiskGiB), source(override.DiskGiB != nil))
+	fmt.Fprintf(w, "plans\t%s\t%s\n", plans, source(override.Plans != nil))
+	w.Flush()
+}
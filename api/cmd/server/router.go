@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/apispec"
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/handlers"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/middleware"
+	"github.com/zallarak/db/api/internal/migrate"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/zallarak/db/api/internal/quota"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/tracing"
+	"github.com/zallarak/db/api/openapi"
+	"github.com/gin-gonic/gin"
+	"github.com/swaggest/swgui/v5emb"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// newRouter builds the HTTP handler of the API. database and migrator are
+// nil with the memory store, validator is nil when OpenAPI validation is
+// off, and agents is nil when instances aren't reached, as in openapi
+// check. The health handler is returned so shutdown can drain it.
+func newRouter(cfg *config.Config, st store.Store, database *sql.DB, migrator *migrate.Migrator, validator *apispec.Validator, agents *guest.Agents) (*gin.Engine, *handlers.HealthHandler) {
+	// Create auth services
+	authService := auth.NewService(st.Users(), cfg.Auth.JWTSecret, cfg.Auth.JWTPreviousSecrets)
+	deviceService := auth.NewDeviceService(st, authService, cfg.Server.DeviceURL())
+	ssoService := auth.NewSSOService(st, authService, deviceService, oidc.NewClient(&http.Client{
+		Timeout:   10 * time.Second,
+		Transport: metrics.InstrumentTransport("oidc", tracing.Transport("oidc", nil)),
+	}), customdomain.NewVerifier(cfg.Domains.Resolver), cfg.Server.BaseURL+"/v1/auth/sso/callback")
+
+	// Create handlers
+	authHandler := handlers.NewAuthHandler(authService)
+	authz := handlers.NewAuthorizer(st.Memberships(), ssoService)
+	ssoHandler := handlers.NewSSOHandler(ssoService, authz)
+	deviceHandler := handlers.NewDeviceHandler(deviceService)
+	userHandler := handlers.NewUserHandler(st.Users())
+	orgHandler := handlers.NewOrgHandler(st, authz)
+	projectHandler := handlers.NewProjectHandler(st, authz)
+	quotas := quota.NewChecker(cfg.Quotas)
+	instanceHandler := handlers.NewInstanceHandler(st, quotas, netpolicy.NewCompiler(cfg.Network), authz, cfg.DNS.Zone, cfg.Domains, agents)
+	quotaHandler := handlers.NewQuotaHandler(st, quotas, authz)
+	privateNetworkHandler := handlers.NewPrivateNetworkHandler(st, cfg.Network, authz)
+	planHandler := handlers.NewPlanHandler(st.Plans())
+	caHandler := handlers.NewCAHandler(cfg.TLS)
+	jobHandler := handlers.NewJobHandler(st.Jobs(), authz)
+	healthHandler := handlers.NewHealthHandler(database, st.Workers(), migrator, cfg.Worker.HeartbeatTimeout)
+
+	// Setup router
+	if !cfg.Dev {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	r := gin.New()
+
+	// Middleware
+	r.Use(middleware.RequestID())
+	r.Use(otelgin.Middleware(cfg.Tracing.ServiceName))
+	r.Use(middleware.Logger())
+	r.Use(middleware.Metrics())
+	r.Use(middleware.Recovery())
+	r.Use(middleware.CORS(cfg.CORS.AllowedOrigins))
+	if validator != nil {
+		r.Use(validator.Middleware())
+	}
+
+	r.NoRoute(func(c *gin.Context) {
+		apierror.NotFound(c, "Route not found")
+	})
+
+	// Health checks; /health is kept for existing scripts and monitors
+	r.GET("/livez", healthHandler.Livez)
+	r.GET("/readyz", healthHandler.Readyz)
+	r.GET("/health", healthHandler.Livez)
+
+	// Serve the OpenAPI spec and Swagger UI for it
+	r.GET("/openapi.yaml", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/yaml", openapi.Spec)
+	})
+	r.GET("/docs", func(c *gin.Context) {
+		c.Redirect(http.StatusMovedPermanently, "/docs/")
+	})
+	r.GET("/docs/*any", gin.WrapH(v5emb.New("db.xyz API", "/openapi.yaml", "/docs/")))
+
+	// Where device logins are approved, unless the console serves its own
+	r.GET("/device", deviceHandler.Page)
+
+	// API v1 routes
+	v1 := r.Group("/v1")
+	{
+		// Auth routes
+		auth := v1.Group("/auth")
+		{
+			auth.POST("/register", authHandler.Register)
+			auth.POST("/login", authHandler.Login)
+			auth.POST("/logout", authHandler.Logout)
+			auth.GET("/sso/start", ssoHandler.StartLogin)
+			auth.GET("/sso/callback", ssoHandler.Callback)
+			auth.POST("/device/code", deviceHandler.RequestCode)
+			auth.POST("/device/token", deviceHandler.Token)
+		}
+
+		// The plan catalog is public, like a price list
+		v1.GET("/plans", planHandler.ListPlans)
+		// So is the CA bundle, which clients need before they have a token
+		v1.GET("/ca.pem", caHandler.GetBundle)
+
+		// Protected routes
+		protected := v1.Group("/")
+		protected.Use(middleware.AuthRequired(authService))
+		{
+			// User routes
+			protected.GET("/users/me", userHandler.GetCurrentUser)
+
+			// Linking an SSO identity to the caller's account
+			protected.POST("/auth/sso/link", ssoHandler.StartLink)
+
+			// Device authorization approval (the /device page side of `dbx auth login --web`)
+			protected.GET("/auth/device/:userCode", deviceHandler.GetRequest)
+			protected.POST("/auth/device/decision", deviceHandler.Decide)
+
+			// Org routes
+			orgs := protected.Group("/orgs")
+			{
+				orgs.GET("", orgHandler.ListOrgs)
+				orgs.POST("", orgHandler.CreateOrg)
+				orgs.GET("/:orgId", orgHandler.GetOrg)
+				orgs.PATCH("/:orgId", orgHandler.UpdateOrg)
+				orgs.DELETE("/:orgId", orgHandler.DeleteOrg)
+				orgs.GET("/:orgId/quotas", quotaHandler.GetQuotas)
+				orgs.GET("/:orgId/network", privateNetworkHandler.GetNetwork)
+				orgs.POST("/:orgId/network", privateNetworkHandler.CreateNetwork)
+				orgs.GET("/:orgId/network/peers", privateNetworkHandler.ListPeers)
+				orgs.POST("/:orgId/network/peers", privateNetworkHandler.CreatePeer)
+				orgs.DELETE("/:orgId/network/peers/:peerId", privateNetworkHandler.DeletePeer)
+				orgs.GET("/:orgId/sso", ssoHandler.GetConnection)
+				orgs.PUT("/:orgId/sso", ssoHandler.UpdateConnection)
+				orgs.DELETE("/:orgId/sso", ssoHandler.DeleteConnection)
+				orgs.POST("/:orgId/sso/domains/:domain", apispec.CustomMethods("domain", map[string]gin.HandlerFunc{
+					"verify": ssoHandler.VerifyDomain,
+				}))
+				orgs.GET("/:orgId/projects", projectHandler.ListProjects)
+				orgs.POST("/:orgId/projects", projectHandler.CreateProject)
+			}
+
+			// Project routes
+			projects := protected.Group("/projects")
+			{
+				projects.GET("/:projectId", projectHandler.GetProject)
+				projects.DELETE("/:projectId", projectHandler.DeleteProject)
+				projects.GET("/:projectId/instances", instanceHandler.ListInstances)
+				projects.POST("/:projectId/instances", instanceHandler.CreateInstance)
+			}
+
+			// Instance routes
+			instances := protected.Group("/instances")
+			{
+				instances.GET("/:instanceId", instanceHandler.GetInstance)
+				instances.DELETE("/:instanceId", instanceHandler.DeleteInstance)
+				instances.GET("/:instanceId/upgrades", instanceHandler.ListUpgrades)
+				instances.GET("/:instanceId/backups", instanceHandler.ListBackups)
+				instances.POST("/:instanceId/backups", instanceHandler.CreateBackup)
+				instances.GET("/:instanceId/backup-policy", instanceHandler.GetBackupPolicy)
+				instances.PUT("/:instanceId/backup-policy", instanceHandler.PutBackupPolicy)
+				instances.DELETE("/:instanceId/backup-policy", instanceHandler.DeleteBackupPolicy)
+				instances.GET("/:instanceId/network-policy", instanceHandler.GetNetworkPolicy)
+				instances.PUT("/:instanceId/network-policy", instanceHandler.PutNetworkPolicy)
+				instances.GET("/:instanceId/certificate", instanceHandler.GetCertificate)
+				instances.GET("/:instanceId/domains", instanceHandler.ListDomains)
+				instances.POST("/:instanceId/domains", instanceHandler.CreateDomain)
+				instances.GET("/:instanceId/domains/:domainId", instanceHandler.GetDomain)
+				instances.DELETE("/:instanceId/domains/:domainId", instanceHandler.DeleteDomain)
+				// POST /instances/{instanceId}/domains/{domainId}:verb
+				instances.POST("/:instanceId/domains/:domainId", apispec.CustomMethods("domainId", map[string]gin.HandlerFunc{
+					"verify": instanceHandler.VerifyDomain,
+				}))
+				// Custom methods, POST /instances/{instanceId}:verb
+				instances.POST("/:instanceId", apispec.CustomMethods("instanceId", map[string]gin.HandlerFunc{
+					"resize":   instanceHandler.ResizeInstance,
+					"upgrade":  instanceHandler.UpgradeInstance,
+					"rollback": instanceHandler.RollbackUpgrade,
+					"restore":  instanceHandler.RestoreInstance,
+				}))
+			}
+
+			// Job routes
+			protected.GET("/jobs/:jobId", jobHandler.GetJob)
+		}
+	}
+
+	return r, healthHandler
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/db"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/objectstore"
+	"github.com/zallarak/db/api/internal/pki"
+	"github.com/zallarak/db/api/internal/provisioner"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/scheduler"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/tracing"
+	"github.com/zallarak/db/api/internal/worker"
+)
+
+// runWorker runs a standalone job worker, for deployments that scale
+// workers separately from the API (set worker.embedded to false there).
+func runWorker(args []string) error {
+	cfg, args, err := config.Load("server worker", args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected argument %q", args[0])
+	}
+	logging.New(cfg.Log)
+	if cfg.Database.Driver != "postgres" {
+		return fmt.Errorf("a standalone worker needs the postgres database driver, not %s", cfg.Database.Driver)
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing, "worker")
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	database, err := db.Init(cfg.Database)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer database.Close()
+	metrics.RegisterDB(database)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	st := store.NewPostgres(database)
+	go serveAdmin(ctx, cfg.Admin, st, cfg.DNS, nil)
+
+	w, err := newWorker(st, cfg)
+	if err != nil {
+		return err
+	}
+	go scheduler.New(st, cfg.Backups, cfg.DNS, cfg.TLS, cfg.Domains).Run(ctx)
+	return w.Run(ctx)
+}
+
+// newWorker builds a worker with every job handler registered. Callers
+// also run a scheduler next to it.
+func newWorker(st store.Store, cfg *config.Config) (*worker.Worker, error) {
+	cluster, err := proxmox.NewCluster(cfg.Proxmox.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := objectstore.New(cfg.Backups)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := dns.New(cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := pki.New(cfg.TLS, cfg.DNS, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	w := worker.New(st.Workers(), jobs.NewQueue(st.Jobs()), cfg.Worker)
+	provisioner.New(st, cluster, objects, provider, issuer, cfg).Register(w)
+	return w, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zallarak/db/api/internal/privnet"
+	"github.com/zallarak/db/api/internal/wireguard"
+)
+
+// peer is a peer as the state file and the API hold it.
+type peer struct {
+	ID string `json:"id"`
+	wireguard.GatewayPeer
+}
+
+// runner runs the command name with stdin, if not empty, and returns its
+// output.
+type runner func(ctx context.Context, stdin, name string, args ...string) (string, error)
+
+func execRunner(ctx context.Context, stdin, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// gateway serves the contract, keeping the peers in the state file and
+// applying them to the host.
+type gateway struct {
+	opts   options
+	logger *slog.Logger
+	run    runner
+
+	// mu serializes changes to the peers and applying them
+	mu    sync.Mutex
+	peers map[string]peer
+}
+
+func newGateway(opts options, logger *slog.Logger, run runner) (*gateway, error) {
+	g := &gateway{opts: opts, logger: logger, run: run, peers: make(map[string]peer)}
+	data, err := os.ReadFile(opts.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", opts.stateFile, err)
+	}
+	for _, p := range peers {
+		g.peers[p.ID] = p
+	}
+	return g, nil
+}
+
+// sorted returns the peers by ID.
+func (g *gateway) sorted() []peer {
+	peers := make([]peer, 0, len(g.peers))
+	for _, p := range g.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+func (g *gateway) save() error {
+	data, err := json.MarshalIndent(g.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(g.opts.stateFile), 0o700); err != nil {
+		return err
+	}
+	tmp := g.opts.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.opts.stateFile)
+}
+
+func (g *gateway) listPeers(r *http.Request, _ []string) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return map[string]interface{}{"peers": g.sorted()}, nil
+}
+
+func (g *gateway) putPeer(r *http.Request, args []string) (interface{}, error) {
+	var req wireguard.GatewayPeer
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	if err := checkPeer(req); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, p := range g.peers {
+		if id != args[0] && (p.PublicKey == req.PublicKey || p.Address == req.Address) {
+			return nil, fail(http.StatusConflict, "peer %s has the same key or address", id)
+		}
+	}
+	p := peer{ID: args[0], GatewayPeer: req}
+	g.peers[p.ID] = p
+	if err := g.save(); err != nil {
+		return nil, err
+	}
+	if err := g.apply(r.Context()); err != nil {
+		return nil, err
+	}
+	g.logger.Info("Added peer", "peer_id", p.ID, "address", p.Address, "vlan", p.VLAN)
+	return p, nil
+}
+
+func checkPeer(p wireguard.GatewayPeer) error {
+	if _, err := wireguard.ParseKey(p.PublicKey); err != nil {
+		return fail(http.StatusBadRequest, "invalid public key %q", p.PublicKey)
+	}
+	subnet, err := netip.ParsePrefix(p.Subnet)
+	if err != nil || subnet != subnet.Masked() {
+		return fail(http.StatusBadRequest, "invalid subnet %q", p.Subnet)
+	}
+	addr, err := netip.ParseAddr(p.Address)
+	if err != nil || !subnet.Contains(addr) || addr == privnet.Gateway(subnet) {
+		return fail(http.StatusBadRequest, "address %q is not a peer address of %s", p.Address, subnet)
+	}
+	if p.VLAN < 1 || p.VLAN > 4094 {
+		return fail(http.StatusBadRequest, "invalid VLAN %d", p.VLAN)
+	}
+	return nil
+}
+
+func (g *gateway) deletePeer(r *http.Request, args []string) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.peers[args[0]]
+	if !ok {
+		return nil, fail(http.StatusNotFound, "no peer %s", args[0])
+	}
+	delete(g.peers, p.ID)
+	if err := g.save(); err != nil {
+		return nil, err
+	}
+	if err := g.apply(r.Context()); err != nil {
+		return nil, err
+	}
+	g.logger.Info("Removed peer", "peer_id", p.ID, "address", p.Address)
+	return nil, nil
+}
+
+// vlanInterface returns the name of the interface of vlan on the trunk.
+func (g *gateway) vlanInterface(vlan int) string {
+	return g.opts.trunk + "." + strconv.Itoa(vlan)
+}
+
+// apply makes the host match the peers: it adds and removes the peers of
+// the WireGuard interface and their routes, creates the VLAN interfaces of
+// the networks with peers and deletes the others, and replaces the
+// firewall table.
+func (g *gateway) apply(ctx context.Context) error {
+	peers := g.sorted()
+	run := func(args ...string) (string, error) {
+		return g.run(ctx, "", args[0], args[1:]...)
+	}
+
+	// Peers and their routes
+	keys := make(map[string]bool, len(peers))
+	routes := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		addr := netip.MustParseAddr(p.Address)
+		host := netip.PrefixFrom(addr, addr.BitLen()).String()
+		keys[p.PublicKey], routes[p.Address] = true, true
+		if _, err := run("wg", "set", g.opts.iface, "peer", p.PublicKey, "allowed-ips", host); err != nil {
+			return err
+		}
+		if _, err := run("ip", "route", "replace", host, "dev", g.opts.iface); err != nil {
+			return err
+		}
+	}
+	out, err := run("wg", "show", g.opts.iface, "peers")
+	if err != nil {
+		return err
+	}
+	for _, key := range strings.Fields(out) {
+		if !keys[key] {
+			if _, err := run("wg", "set", g.opts.iface, "peer", key, "remove"); err != nil {
+				return err
+			}
+		}
+	}
+	if out, err = run("ip", "route", "show", "dev", g.opts.iface); err != nil {
+		return err
+	}
+	for _, dest := range routeDestinations(out) {
+		if !routes[dest] {
+			if _, err := run("ip", "route", "del", dest, "dev", g.opts.iface); err != nil {
+				return err
+			}
+		}
+	}
+
+	// VLAN interfaces, holding the gateway's address and answering ARP
+	// for the peers
+	if out, err = run("ip", "-o", "link", "show", "type", "vlan"); err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, name := range linkNames(out) {
+		existing[name] = true
+	}
+	wanted := make(map[string]bool)
+	for _, p := range peers {
+		name := g.vlanInterface(p.VLAN)
+		if wanted[name] {
+			continue
+		}
+		wanted[name] = true
+		subnet := netip.MustParsePrefix(p.Subnet)
+		cmds := [][]string{
+			{"ip", "addr", "replace", netip.PrefixFrom(privnet.Gateway(subnet), subnet.Bits()).String(), "dev", name},
+			{"ip", "link", "set", name, "up"},
+			{"sysctl", "-w", "net.ipv4.conf." + name + ".proxy_arp=1"},
+		}
+		if !existing[name] {
+			cmds = append([][]string{{"ip", "link", "add", "link", g.opts.trunk, "name", name, "type", "vlan", "id", strconv.Itoa(p.VLAN)}}, cmds...)
+		}
+		for _, cmd := range cmds {
+			if _, err := run(cmd...); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range existing {
+		if strings.HasPrefix(name, g.opts.trunk+".") && !wanted[name] {
+			if _, err := run("ip", "link", "del", name); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = g.run(ctx, ruleset(g.opts.iface, g.opts.trunk, peers, g.vlanInterface), "nft", "-f", "-")
+	return err
+}
+
+// routeDestinations returns the destinations of the routes `ip route show`
+// printed.
+func routeDestinations(out string) []string {
+	var dests []string
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			dests = append(dests, strings.TrimSuffix(strings.TrimSuffix(fields[0], "/32"), "/128"))
+		}
+	}
+	return dests
+}
+
+// linkNames returns the names of the interfaces `ip -o link show`
+// printed, as in "12: vmbr1.100@vmbr1: <BROADCAST,...".
+func linkNames(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		_, rest, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, ": ")
+		name, _, _ = strings.Cut(name, "@")
+		names = append(names, name)
+	}
+	return names
+}
+
+// firewallTable is the nftables table the gateway owns.
+const firewallTable = "inet dbx_gateway"
+
+// ruleset returns an nft script replacing the gateway's table with one
+// that forwards only between each peer and the subnet of its network, and
+// keeps peers and containers from reaching the gateway itself or other
+// networks through it.
+func ruleset(iface, trunk string, peers []peer, vlanInterface func(int) string) string {
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed on the first run
+	fmt.Fprintf(&b, "table %s\ndelete table %s\n", firewallTable, firewallTable)
+	fmt.Fprintf(&b, "table %s {\n", firewallTable)
+	b.WriteString("\tchain input {\n\t\ttype filter hook input priority filter; policy accept;\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	fmt.Fprintf(&b, "\t\tiifname %q drop\n", iface)
+	fmt.Fprintf(&b, "\t\tiifname %q drop\n", trunk+".*")
+	b.WriteString("\t}\n")
+
+	b.WriteString("\tchain forward {\n\t\ttype filter hook forward priority filter; policy accept;\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	for _, p := range peers {
+		family := "ip"
+		if netip.MustParseAddr(p.Address).Is6() {
+			family = "ip6"
+		}
+		vlan := vlanInterface(p.VLAN)
+		fmt.Fprintf(&b, "\t\tiifname %q %s saddr %s oifname %q %s daddr %s accept\n", iface, family, p.Address, vlan, family, p.Subnet)
+		fmt.Fprintf(&b, "\t\tiifname %q %s saddr %s oifname %q %s daddr %s accept\n", vlan, family, p.Subnet, iface, family, p.Address)
+	}
+	fmt.Fprintf(&b, "\t\tiifname %q drop\n", iface)
+	fmt.Fprintf(&b, "\t\toifname %q drop\n", iface)
+	fmt.Fprintf(&b, "\t\tiifname %q drop\n", trunk+".*")
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
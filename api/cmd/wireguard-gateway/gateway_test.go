@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/apispec/apispectest"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/wireguard"
+	"github.com/zallarak/db/api/openapi"
+)
+
+// recorder is a runner recording the commands it runs and answering the
+// ones that show state with outputs.
+type recorder struct {
+	outputs map[string]string
+	cmds    []string
+	stdin   []string
+}
+
+func (r *recorder) run(_ context.Context, stdin, name string, args ...string) (string, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	r.cmds = append(r.cmds, cmd)
+	if stdin != "" {
+		r.stdin = append(r.stdin, stdin)
+	}
+	return r.outputs[cmd], nil
+}
+
+func newTestGateway(t *testing.T, rec *recorder) *gateway {
+	t.Helper()
+	opts := options{token: "gateway-token", iface: "wg0", trunk: "vmbr1", stateFile: filepath.Join(t.TempDir(), "state", "peers.json")}
+	g, err := newGateway(opts, slog.New(slog.NewTextHandler(io.Discard, nil)), rec.run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func publicKey(t *testing.T) string {
+	t.Helper()
+	k, err := wireguard.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey().String()
+}
+
+// TestContract drives the gateway with the control plane's client, and
+// fails on any request or response that breaks the contract, or any
+// operation left uncalled.
+func TestContract(t *testing.T) {
+	g := newTestGateway(t, &recorder{})
+	c := apispectest.New(t, openapi.WireGuardGatewaySpec, func(path string) (string, bool) {
+		return strings.CutPrefix(path, "/v1")
+	}, g)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := wireguard.NewGateway(config.WireGuardConfig{GatewayURL: srv.URL, Token: "gateway-token"})
+	laptop := wireguard.GatewayPeer{PublicKey: publicKey(t), Address: "10.96.0.128", Subnet: "10.96.0.0/24", VLAN: 100}
+	if err := client.PutPeer(ctx, "peer-1", laptop); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutPeer(ctx, "peer-1", laptop); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		peer wireguard.GatewayPeer
+		want int
+	}{
+		{"same address", wireguard.GatewayPeer{PublicKey: publicKey(t), Address: "10.96.0.128", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusConflict},
+		{"same key", wireguard.GatewayPeer{PublicKey: laptop.PublicKey, Address: "10.96.0.129", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusConflict},
+		{"invalid key", wireguard.GatewayPeer{PublicKey: "AAAA", Address: "10.96.0.129", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusBadRequest},
+		{"address outside the subnet", wireguard.GatewayPeer{PublicKey: publicKey(t), Address: "10.96.1.129", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusBadRequest},
+		{"gateway address", wireguard.GatewayPeer{PublicKey: publicKey(t), Address: "10.96.0.1", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusBadRequest},
+		{"subnet with host bits", wireguard.GatewayPeer{PublicKey: publicKey(t), Address: "10.96.0.129", Subnet: "10.96.0.1/24", VLAN: 100}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		err := client.PutPeer(ctx, "peer-2", tt.peer)
+		if e, ok := err.(*wireguard.APIError); !ok || e.Status != tt.want {
+			t.Errorf("%s: PutPeer = %v, want status %d", tt.name, err, tt.want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/peers", nil)
+	req.Header.Set("Authorization", "Bearer gateway-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Peers []peer `json:"peers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list.Peers) != 1 || list.Peers[0] != (peer{ID: "peer-1", GatewayPeer: laptop}) {
+		t.Errorf("peers = %+v, %v", list.Peers, err)
+	}
+
+	if err := client.DeletePeer(ctx, "peer-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeletePeer(ctx, "peer-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := wireguard.NewGateway(config.WireGuardConfig{GatewayURL: srv.URL, Token: "other"})
+	if err := bad.PutPeer(ctx, "peer-1", laptop); err == nil {
+		t.Error("gateway accepted an invalid token")
+	}
+
+	c.CheckCalled()
+}
+
+func TestApply(t *testing.T) {
+	rec := &recorder{}
+	g := newTestGateway(t, rec)
+	key := publicKey(t)
+	g.peers["peer-1"] = peer{ID: "peer-1", GatewayPeer: wireguard.GatewayPeer{PublicKey: key, Address: "10.96.0.128", Subnet: "10.96.0.0/24", VLAN: 100}}
+	rec.outputs = map[string]string{
+		"wg show wg0 peers":         key + "\nstalekey=\n",
+		"ip route show dev wg0":     "10.96.0.128 scope link\n10.96.5.130 scope link\n",
+		"ip -o link show type vlan": "7: vmbr1.101@vmbr1: <BROADCAST,MULTICAST,UP> mtu 1500\n8: eth0.5@eth0: <BROADCAST> mtu 1500\n",
+	}
+	if err := g.apply(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"wg set wg0 peer " + key + " allowed-ips 10.96.0.128/32",
+		"ip route replace 10.96.0.128/32 dev wg0",
+		"wg show wg0 peers",
+		"wg set wg0 peer stalekey= remove",
+		"ip route show dev wg0",
+		"ip route del 10.96.5.130 dev wg0",
+		"ip -o link show type vlan",
+		"ip link add link vmbr1 name vmbr1.100 type vlan id 100",
+		"ip addr replace 10.96.0.1/24 dev vmbr1.100",
+		"ip link set vmbr1.100 up",
+		"sysctl -w net.ipv4.conf.vmbr1.100.proxy_arp=1",
+		"ip link del vmbr1.101",
+		"nft -f -",
+	}
+	if !reflect.DeepEqual(rec.cmds, want) {
+		t.Errorf("commands =\n%s\nwant\n%s", strings.Join(rec.cmds, "\n"), strings.Join(want, "\n"))
+	}
+	if len(rec.stdin) != 1 || !strings.Contains(rec.stdin[0], `iifname "wg0" ip saddr 10.96.0.128 oifname "vmbr1.100" ip daddr 10.96.0.0/24 accept`) {
+		t.Errorf("nft script = %q", rec.stdin)
+	}
+}
+
+func TestRuleset(t *testing.T) {
+	g := newTestGateway(t, &recorder{})
+	peers := []peer{
+		{ID: "peer-1", GatewayPeer: wireguard.GatewayPeer{Address: "10.96.0.128", Subnet: "10.96.0.0/24", VLAN: 100}},
+		{ID: "peer-2", GatewayPeer: wireguard.GatewayPeer{Address: "fd00::80", Subnet: "fd00::/64", VLAN: 101}},
+	}
+	want := `table inet dbx_gateway
+delete table inet dbx_gateway
+table inet dbx_gateway {
+	chain input {
+		type filter hook input priority filter; policy accept;
+		ct state established,related accept
+		iifname "wg0" drop
+		iifname "vmbr1.*" drop
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ct state established,related accept
+		iifname "wg0" ip saddr 10.96.0.128 oifname "vmbr1.100" ip daddr 10.96.0.0/24 accept
+		iifname "vmbr1.100" ip saddr 10.96.0.0/24 oifname "wg0" ip daddr 10.96.0.128 accept
+		iifname "wg0" ip6 saddr fd00::80 oifname "vmbr1.101" ip6 daddr fd00::/64 accept
+		iifname "vmbr1.101" ip6 saddr fd00::/64 oifname "wg0" ip6 daddr fd00::80 accept
+		iifname "wg0" drop
+		oifname "wg0" drop
+		iifname "vmbr1.*" drop
+	}
+}
+`
+	if got := ruleset("wg0", "vmbr1", peers, g.vlanInterface); got != want {
+		t.Errorf("ruleset =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestState checks that peers outlive the gateway.
+func TestState(t *testing.T) {
+	g := newTestGateway(t, &recorder{})
+	body := `{"public_key":"` + publicKey(t) + `","address":"10.96.0.128","subnet":"10.96.0.0/24","vlan":100}`
+	req := httptest.NewRequest(http.MethodPut, "/v1/peers/peer-1", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer gateway-token")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+
+	restarted, err := newGateway(g.opts, g.logger, (&recorder{}).run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restarted.peers, g.peers) {
+		t.Errorf("peers after restart = %+v, want %+v", restarted.peers, g.peers)
+	}
+
+	if err := os.WriteFile(g.opts.stateFile, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newGateway(g.opts, g.logger, (&recorder{}).run); err == nil {
+		t.Error("newGateway accepted an invalid state file")
+	}
+}
@@ -0,0 +1,156 @@
+// Command wireguard-gateway is the reference implementation of the
+// WireGuard gateway, whose contract is openapi/wireguard-gateway.yaml. It
+// runs as root on a host with a trunk of the VLANs of private networks,
+// network.private_networks.bridge on a Proxmox node, and a WireGuard
+// interface the operator sets up with the gateway's private key and
+// listen port and no peers, e.g. with wg-quick, as well as IP forwarding.
+//
+// The gateway keeps its peers in a state file and applies them with wg,
+// ip, sysctl and nft: a peer on the WireGuard interface and a route for
+// each peer, a VLAN interface with proxy ARP for each private network with
+// peers, and an nftables table forwarding only between each peer and the
+// subnet of its network. It applies the state again when it starts.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/logging"
+)
+
+type options struct {
+	listen    string
+	token     string
+	iface     string
+	trunk     string
+	stateFile string
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.listen, "listen", env("DBX_GATEWAY_LISTEN", ":7434"), "address to serve the API on")
+	flag.StringVar(&opts.token, "token", env("DBX_NETWORK_WIREGUARD_TOKEN", ""), "token the control plane authenticates with")
+	flag.StringVar(&opts.iface, "interface", env("DBX_GATEWAY_INTERFACE", "wg0"), "WireGuard interface peers connect to")
+	flag.StringVar(&opts.trunk, "trunk", env("DBX_GATEWAY_TRUNK", "vmbr1"), "interface carrying the VLANs of private networks")
+	flag.StringVar(&opts.stateFile, "state-file", env("DBX_GATEWAY_STATE_FILE", "/var/lib/dbx-gateway/peers.json"), "file the peers are kept in")
+	flag.Parse()
+
+	logger := logging.New(config.LogConfig{Level: env("DBX_LOG_LEVEL", "info"), Format: env("DBX_LOG_FORMAT", "json")})
+	if err := run(opts, logger); err != nil {
+		logger.Error("WireGuard gateway failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options, logger *slog.Logger) error {
+	if opts.token == "" {
+		return errors.New("a token is required")
+	}
+	g, err := newGateway(opts, logger, execRunner)
+	if err != nil {
+		return err
+	}
+	if err := g.apply(context.Background()); err != nil {
+		return fmt.Errorf("failed to apply the peers: %w", err)
+	}
+
+	srv := &http.Server{Addr: opts.listen, Handler: g, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	logger.Info("WireGuard gateway listening", "address", opts.listen, "peers", len(g.peers))
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(g *gateway, r *http.Request, args []string) (interface{}, error)
+}
+
+var routes = []route{
+	{http.MethodGet, regexp.MustCompile(`^/v1/peers$`), (*gateway).listPeers},
+	{http.MethodPut, regexp.MustCompile(`^/v1/peers/([^/]+)$`), (*gateway).putPeer},
+	{http.MethodDelete, regexp.MustCompile(`^/v1/peers/([^/]+)$`), (*gateway).deletePeer},
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+g.opts.token)) != 1 {
+		writeError(w, fail(http.StatusUnauthorized, "invalid token"))
+		return
+	}
+	for _, rt := range routes {
+		m := rt.pattern.FindStringSubmatch(r.URL.Path)
+		if m == nil || rt.method != r.Method {
+			continue
+		}
+		data, err := rt.handle(g, r, m[1:])
+		if err != nil {
+			if _, ok := err.(*httpError); !ok {
+				g.logger.Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+			writeError(w, err)
+			return
+		}
+		if data == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	writeError(w, fail(http.StatusNotFound, "no route %s %s", r.Method, r.URL.Path))
+}
+
+// httpError is an error with the status to respond with. Other errors are
+// responded to with 500.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func fail(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if he, ok := err.(*httpError); ok {
+		status = he.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,203 @@
+// Package apierror defines the error body returned by every API endpoint:
+//
+//	{"error": {"code": "validation_failed", "message": "...", "details": [...], "request_id": "..."}}
+//
+// code is stable and meant for programs; message is for people and may
+// change. The device token endpoint is the one exception, since RFC 8628
+// fixes its error format.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeForbidden          = "forbidden"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeSSORequired        = "sso_required"
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict"
+	CodeUpstreamFailed     = "upstream_failed"
+	CodeNotSupported       = "not_supported"
+	CodeInternal           = "internal_error"
+)
+
+type Error struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// FieldError describes a problem with one field of the request body, named
+// as in the JSON body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type response struct {
+	Error *Error `json:"error"`
+}
+
+func init() {
+	// Report JSON field names rather than Go struct field names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(jsonFieldName)
+	}
+}
+
+// Respond aborts the request with an error of the given status and code.
+func Respond(c *gin.Context, status int, code, message string) {
+	write(c, status, &Error{Code: code, Message: message})
+}
+
+func BadRequest(c *gin.Context, message string) {
+	Respond(c, http.StatusBadRequest, CodeInvalidRequest, message)
+}
+
+func Unauthorized(c *gin.Context, message string) {
+	Respond(c, http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func Forbidden(c *gin.Context, message string) {
+	Respond(c, http.StatusForbidden, CodeForbidden, message)
+}
+
+func NotFound(c *gin.Context, message string) {
+	Respond(c, http.StatusNotFound, CodeNotFound, message)
+}
+
+func Conflict(c *gin.Context, message string) {
+	Respond(c, http.StatusConflict, CodeConflict, message)
+}
+
+// Internal logs err with the request logger and responds with a 500 that
+// doesn't reveal it.
+func Internal(c *gin.Context, err error, message string) {
+	logger := logging.FromContext(c.Request.Context())
+	if err != nil {
+		logger.Error(message, "error", err)
+		c.Error(err)
+	} else {
+		logger.Error(message)
+	}
+	Respond(c, http.StatusInternalServerError, CodeInternal, message)
+}
+
+// Validation responds with field-level problems found by the handler
+// itself rather than by binding.
+func Validation(c *gin.Context, details ...FieldError) {
+	write(c, http.StatusBadRequest, &Error{
+		Code:    CodeValidationFailed,
+		Message: "Request validation failed",
+		Details: details,
+	})
+}
+
+// Bind responds to an error from ShouldBind and friends: validation errors
+// become field-level details, anything else an invalid request.
+func Bind(c *gin.Context, err error) {
+	var (
+		verrs     validator.ValidationErrors
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &verrs):
+		details := make([]FieldError, 0, len(verrs))
+		for _, fe := range verrs {
+			details = append(details, fieldError(fe))
+		}
+		Validation(c, details...)
+	case errors.As(err, &typeErr):
+		Validation(c, FieldError{
+			Field:   typeErr.Field,
+			Code:    "invalid_type",
+			Message: "must be a " + typeErr.Type.String(),
+		})
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		BadRequest(c, "Request body is not valid JSON")
+	case errors.Is(err, io.EOF):
+		BadRequest(c, "Request body is required")
+	default:
+		BadRequest(c, "Invalid request")
+	}
+}
+
+func write(c *gin.Context, status int, e *Error) {
+	e.RequestID = c.GetString("request_id")
+	c.AbortWithStatusJSON(status, response{Error: e})
+}
+
+// fieldError maps a validator failure to a FieldError. The code is the
+// validation tag, e.g. "required" or "email".
+func fieldError(fe validator.FieldError) FieldError {
+	field := fe.Namespace()
+	// Drop the struct name: CreateOrgRequest.name -> name
+	if i := strings.Index(field, "."); i >= 0 {
+		field = field[i+1:]
+	}
+
+	var message string
+	switch fe.Tag() {
+	case "required":
+		message = "is required"
+	case "email":
+		message = "must be a valid email address"
+	case "min":
+		message = "must be at least " + fe.Param() + lengthUnit(fe)
+	case "max":
+		message = "must be at most " + fe.Param() + lengthUnit(fe)
+	case "oneof":
+		message = "must be one of: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "url", "http_url":
+		message = "must be a valid URL"
+	case "fqdn":
+		message = "must be a fully qualified domain name"
+	case "hostname_rfc1123":
+		message = "must be letters, digits and hyphens, not starting or ending with a hyphen"
+	case "uuid", "uuid4":
+		message = "must be a valid UUID"
+	default:
+		message = "failed the " + fe.Tag() + " check"
+	}
+
+	return FieldError{Field: field, Code: fe.Tag(), Message: message}
+}
+
+func lengthUnit(fe validator.FieldError) string {
+	switch fe.Kind() {
+	case reflect.String:
+		return " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return " items"
+	}
+	return ""
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
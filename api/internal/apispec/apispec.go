@@ -0,0 +1,106 @@
+// Package apispec holds the server to the OpenAPI specification in package
+// openapi: a middleware validates requests and responses against it, and
+// CheckRoutes reports routes and documented operations that don't match up.
+package apispec
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/zallarak/db/api/openapi"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+)
+
+// Load parses and validates the embedded specification.
+func Load() (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openapi.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse openapi spec: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid openapi spec: %w", err)
+	}
+	return doc, nil
+}
+
+// basePath returns the path prefix of the servers in doc, such as /v1.
+// Spec paths are relative to it.
+func basePath(doc *openapi3.T) string {
+	if len(doc.Servers) == 0 {
+		return ""
+	}
+	base, err := doc.Servers[0].BasePath()
+	if err != nil || base == "/" {
+		return ""
+	}
+	return base
+}
+
+// specPath converts a gin route such as /v1/orgs/:orgId to the spec path
+// /orgs/{orgId}. It returns false for routes outside of base.
+func specPath(base, route string) (string, bool) {
+	if !strings.HasPrefix(route, base+"/") {
+		return "", false
+	}
+	segments := strings.Split(strings.TrimPrefix(route, base), "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// CheckRoutes compares the API routes of a gin engine with the operations
+// in doc, returning one problem per route that isn't documented and per
+// operation that isn't routed. Routes outside of the servers' base path,
+// such as health checks, are not part of the API and are skipped. Custom
+// methods are matched with the route they share; see CustomMethods.
+func CheckRoutes(doc *openapi3.T, routes gin.RoutesInfo) []string {
+	base := basePath(doc)
+
+	custom := make(map[string]bool)
+	for path, item := range doc.Paths.Map() {
+		if baseOperation(path) == path {
+			continue
+		}
+		for method := range item.Operations() {
+			custom[method+" "+baseOperation(path)] = true
+		}
+	}
+
+	routed := make(map[string]bool)
+	var problems []string
+	for _, r := range routes {
+		// gin adds HEAD routes for static files
+		if r.Method == http.MethodHead {
+			continue
+		}
+		path, ok := specPath(base, r.Path)
+		if !ok {
+			continue
+		}
+		routed[r.Method+" "+path] = true
+
+		item := doc.Paths.Value(path)
+		if (item == nil || item.GetOperation(r.Method) == nil) && !custom[r.Method+" "+path] {
+			problems = append(problems, fmt.Sprintf("%s %s is not documented", r.Method, r.Path))
+		}
+	}
+
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !routed[method+" "+baseOperation(path)] {
+				problems = append(problems, fmt.Sprintf("%s %s is documented but not routed", method, base+path))
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
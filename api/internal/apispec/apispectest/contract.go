@@ -0,0 +1,147 @@
+// Package apispectest checks HTTP traffic against an OpenAPI contract, for
+// testing a client and a simulated server of an API together.
+package apispectest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+func init() {
+	openapi3filter.RegisterBodyDecoder("application/gzip", openapi3filter.FileBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("application/octet-stream", openapi3filter.FileBodyDecoder)
+}
+
+// Contract is a handler passing requests on to a server, failing the test
+// on any request or response that breaks the contract. It records the
+// operations called.
+type Contract struct {
+	t      *testing.T
+	doc    *openapi3.T
+	prefix func(path string) (string, bool)
+	next   http.Handler
+
+	mu     sync.Mutex
+	called map[string]bool
+}
+
+// New returns a contract for the OpenAPI document spec in front of next.
+// prefix maps the path of a request to the path it has in spec, returning
+// false for requests to pass on unchecked.
+func New(t *testing.T, spec []byte, prefix func(path string) (string, bool), next http.Handler) *Contract {
+	t.Helper()
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return &Contract{t: t, doc: doc, prefix: prefix, next: next, called: make(map[string]bool)}
+}
+
+func (c *Contract) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := c.prefix(r.URL.Path)
+	if !ok {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	route, params := c.route(r.Method, path)
+	if route == nil {
+		c.t.Errorf("%s %s is not in the contract", r.Method, path)
+		http.Error(w, `{"error":"undocumented"}`, http.StatusNotFound)
+		return
+	}
+	c.mu.Lock()
+	c.called[r.Method+" "+route.Path] = true
+	c.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		c.t.Error(err)
+		return
+	}
+	options := &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc, IncludeResponseStatus: true}
+	input := &openapi3filter.RequestValidationInput{Request: r, PathParams: params, Route: route, Options: options}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+		c.t.Errorf("request %s %s breaks the contract: %v", r.Method, path, err)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	c.next.ServeHTTP(rec, r)
+	err = openapi3filter.ValidateResponse(r.Context(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+		Options:                options,
+	})
+	if err != nil {
+		c.t.Errorf("response to %s %s breaks the contract: %v", r.Method, path, err)
+	}
+
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+// route finds the operation of the contract for method and path.
+func (c *Contract) route(method, path string) (*routers.Route, map[string]string) {
+	segments := strings.Split(path, "/")
+	for specPath, item := range c.doc.Paths.Map() {
+		op := item.GetOperation(method)
+		parts := strings.Split(specPath, "/")
+		if op == nil || len(parts) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") {
+				params[strings.Trim(part, "{}")] = segments[i]
+			} else if part != segments[i] {
+				params = nil
+				break
+			}
+		}
+		if params != nil {
+			return &routers.Route{Spec: c.doc, Path: specPath, PathItem: item, Method: method, Operation: op}, params
+		}
+	}
+	return nil, nil
+}
+
+// CheckCalled fails the test for every operation of the contract that
+// wasn't called.
+func (c *Contract) CheckCalled() {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var missing []string
+	for path, item := range c.doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !c.called[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	for _, op := range missing {
+		c.t.Errorf("operation %s is not called", op)
+	}
+}
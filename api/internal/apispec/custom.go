@@ -0,0 +1,58 @@
+package apispec
+
+import (
+	"strings"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/gin-gonic/gin"
+)
+
+// Custom methods such as POST /instances/{instanceId}:resize act on a
+// resource rather than being one. gin can't match text after a parameter in
+// the same path segment, so they are routed as POST /instances/:instanceId
+// and the verb arrives at the end of the parameter.
+
+// CustomMethods returns a handler dispatching on the verb after the last
+// path parameter, named param, to the handler for it. The handler sees the
+// parameter without the verb. Unknown verbs are not found.
+func CustomMethods(param string, verbs map[string]gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for i, p := range c.Params {
+			if p.Key != param {
+				continue
+			}
+			id, verb, _ := strings.Cut(p.Value, ":")
+			if h, ok := verbs[verb]; ok {
+				c.Params[i].Value = id
+				h(c)
+				return
+			}
+		}
+		apierror.NotFound(c, "Route not found")
+	}
+}
+
+// customVerb splits the parameter ending the route of a custom method
+// request into its name, the ID and the verb. The verb is empty for any
+// other request.
+func customVerb(c *gin.Context) (param, id, verb string) {
+	route := c.FullPath()
+	i := strings.LastIndex(route, "/:")
+	if i < 0 || strings.Contains(route[i+1:], "/") {
+		return "", "", ""
+	}
+	param = route[i+2:]
+	id, verb, _ = strings.Cut(c.Param(param), ":")
+	return param, id, verb
+}
+
+// baseOperation strips the verb of a custom method from a spec path, giving
+// the path it is routed as: /instances/{instanceId}:resize becomes
+// /instances/{instanceId}.
+func baseOperation(path string) string {
+	i := strings.LastIndex(path, "}:")
+	if i < 0 || strings.Contains(path[i:], "/") {
+		return path
+	}
+	return path[:i+1]
+}
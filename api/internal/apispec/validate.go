@@ -0,0 +1,234 @@
+package apispec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+)
+
+// Validation modes, as in config.OpenAPIConfig.
+const (
+	ModeOff      = "off"
+	ModeRequests = "requests"
+	ModeStrict   = "strict"
+)
+
+// Validator checks requests, and in strict mode responses, against the
+// operation documented for their route. Routes that aren't documented pass
+// through unchecked; CheckRoutes is what catches those.
+type Validator struct {
+	doc       *openapi3.T
+	base      string
+	responses bool
+	options   *openapi3filter.Options
+}
+
+func init() {
+	// PEM responses, such as the CA bundle, are checked as strings
+	openapi3filter.RegisterBodyDecoder("application/x-pem-file", openapi3filter.FileBodyDecoder)
+}
+
+func NewValidator(doc *openapi3.T, mode string) *Validator {
+	return &Validator{
+		doc:       doc,
+		base:      basePath(doc),
+		responses: mode == ModeStrict,
+		options: &openapi3filter.Options{
+			// Authentication is enforced by middleware.AuthRequired
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			// Statuses such as 401 and 500 are left undocumented on most
+			// operations; bodies of documented statuses are still checked
+			IncludeResponseStatus: false,
+			SkipSettingDefaults:   true,
+		},
+	}
+}
+
+// Middleware returns the validating middleware. Invalid requests are
+// rejected with a 400 before reaching the handler. An invalid response is
+// a bug in the server, so it is logged and replaced with a 500.
+func (v *Validator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := v.route(c)
+		if route == nil {
+			c.Next()
+			return
+		}
+
+		params := make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			params[p.Key] = p.Value
+		}
+		if param, id, verb := customVerb(c); verb != "" {
+			params[param] = id
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options:    v.options,
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			requestError(c, err)
+			return
+		}
+
+		if !v.responses {
+			c.Next()
+			return
+		}
+
+		rec := &recorder{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = rec
+		c.Next()
+		c.Writer = rec.ResponseWriter
+
+		err := openapi3filter.ValidateResponse(c.Request.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 rec.status,
+			Header:                 rec.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(rec.body.Bytes())),
+			Options:                v.options,
+		})
+		if err != nil {
+			c.Writer.Header().Del("Content-Length")
+			apierror.Internal(c, err, "Response does not match the API specification")
+			return
+		}
+
+		c.Writer.WriteHeader(rec.status)
+		c.Writer.Write(rec.body.Bytes())
+	}
+}
+
+// route returns the documented operation for the matched gin route, or nil.
+func (v *Validator) route(c *gin.Context) *routers.Route {
+	path, ok := specPath(v.base, c.FullPath())
+	if !ok {
+		return nil
+	}
+	if _, _, verb := customVerb(c); verb != "" {
+		path += ":" + verb
+	}
+	item := v.doc.Paths.Value(path)
+	if item == nil {
+		return nil
+	}
+	op := item.GetOperation(c.Request.Method)
+	if op == nil {
+		return nil
+	}
+	return &routers.Route{
+		Spec:      v.doc,
+		Path:      path,
+		PathItem:  item,
+		Method:    c.Request.Method,
+		Operation: op,
+	}
+}
+
+// requestError responds to a failed request validation in the same shape
+// as binding errors.
+func requestError(c *gin.Context, err error) {
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		apierror.BadRequest(c, "Invalid request")
+		return
+	}
+
+	var schemaErr *openapi3.SchemaError
+	switch {
+	case reqErr.Parameter != nil:
+		reason := reqErr.Reason
+		var parseErr *openapi3filter.ParseError
+		switch {
+		case errors.As(reqErr.Err, &schemaErr):
+			reason = schemaErr.Reason
+		case errors.As(reqErr.Err, &parseErr) && parseErr.Kind == openapi3filter.KindInvalidFormat:
+			reason = "is not a valid " + paramType(reqErr.Parameter)
+		case reason == "" && reqErr.Err != nil:
+			reason = reqErr.Err.Error()
+		}
+		apierror.Validation(c, apierror.FieldError{
+			Field:   reqErr.Parameter.Name,
+			Code:    "invalid_parameter",
+			Message: reason,
+		})
+	case errors.As(reqErr.Err, &schemaErr):
+		apierror.Validation(c, apierror.FieldError{
+			Field:   strings.Join(schemaErr.JSONPointer(), "."),
+			Code:    schemaErr.SchemaField,
+			Message: schemaErr.Reason,
+		})
+	case reqErr.RequestBody != nil && errors.Is(reqErr.Err, openapi3filter.ErrInvalidRequired):
+		apierror.BadRequest(c, "Request body is required")
+	case reqErr.RequestBody != nil && reqErr.Err == nil:
+		// The only body error without a cause is an unexpected Content-Type
+		apierror.BadRequest(c, "Request body must be application/json")
+	case reqErr.RequestBody != nil:
+		apierror.BadRequest(c, "Request body is not valid JSON")
+	default:
+		apierror.BadRequest(c, reqErr.Error())
+	}
+}
+
+// paramType names the schema type of a parameter, e.g. "boolean".
+func paramType(p *openapi3.Parameter) string {
+	if p.Schema != nil && p.Schema.Value != nil && p.Schema.Value.Type != nil {
+		if types := p.Schema.Value.Type.Slice(); len(types) > 0 {
+			return types[0]
+		}
+	}
+	return "value"
+}
+
+// recorder buffers a response so it can be validated before it is sent.
+type recorder struct {
+	gin.ResponseWriter
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.written {
+		r.status = status
+	}
+}
+
+func (r *recorder) WriteHeaderNow() {
+	r.written = true
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.written = true
+	return r.body.Write(data)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.written = true
+	return r.body.WriteString(s)
+}
+
+func (r *recorder) Status() int {
+	return r.status
+}
+
+func (r *recorder) Size() int {
+	if !r.written {
+		return -1
+	}
+	return r.body.Len()
+}
+
+func (r *recorder) Written() bool {
+	return r.written
+}
@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// Device flow errors. The messages double as the RFC 8628 error codes
+// returned from the token endpoint.
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	ErrInvalidDeviceCode    = errors.New("invalid_grant")
+	ErrUnknownUserCode      = errors.New("unknown or expired user code")
+)
+
+const (
+	deviceCodeTTL = 15 * time.Minute
+	// devicePollInterval is the minimum number of seconds between polls; each
+	// slow_down response adds another devicePollInterval.
+	devicePollInterval = 5
+	// userCodeAlphabet avoids vowels and look-alike characters, as suggested
+	// by RFC 8628 section 6.1.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// DeviceAuthorization is the response to a device authorization request.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceRequest describes a pending request to a user who is about to
+// approve it.
+type DeviceRequest struct {
+	UserCode  string    `json:"user_code"`
+	ClientID  string    `json:"client_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DeviceService implements the OAuth 2.0 device authorization grant used by
+// `dbx auth login --web`: the CLI obtains a device code and polls while the
+// user approves the matching user code from a signed-in session, at the
+// verification URI or with `dbx auth device approve`.
+type DeviceService struct {
+	store           store.Store
+	auth            *Service
+	verificationURI string
+}
+
+func NewDeviceService(st store.Store, authService *Service, verificationURI string) *DeviceService {
+	return &DeviceService{
+		store:           st,
+		auth:            authService,
+		verificationURI: verificationURI,
+	}
+}
+
+func (s *DeviceService) Start(ctx context.Context, clientID string) (*DeviceAuthorization, error) {
+	deviceCode, err := oidc.RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.DeviceAuthorizations().Create(ctx, &models.DeviceAuthorization{
+		DeviceCodeHash: hashDeviceCode(deviceCode),
+		UserCode:       userCode,
+		ClientID:       clientID,
+		PollInterval:   devicePollInterval,
+		ExpiresAt:      time.Now().Add(deviceCodeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         s.verificationURI,
+		VerificationURIComplete: s.VerificationURIComplete(userCode),
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                devicePollInterval,
+	}, nil
+}
+
+// VerificationURIComplete returns the verification URI with userCode filled
+// in.
+func (s *DeviceService) VerificationURIComplete(userCode string) string {
+	return s.verificationURI + "?user_code=" + url.QueryEscape(userCode)
+}
+
+// Poll is called by the device with its device code. It returns a session
+// token once the request has been approved, and consumes the request.
+func (s *DeviceService) Poll(ctx context.Context, deviceCode string) (string, *models.User, error) {
+	var (
+		token   string
+		user    *models.User
+		pollErr error
+	)
+	// Pending and throttled polls still commit, to record the poll
+	err := s.store.InTx(ctx, func(tx store.Store) error {
+		authz, err := tx.DeviceAuthorizations().GetByDeviceCode(ctx, hashDeviceCode(deviceCode))
+		if err == store.ErrNotFound {
+			pollErr = ErrInvalidDeviceCode
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if now.After(authz.ExpiresAt) {
+			pollErr = ErrExpiredToken
+			return nil
+		}
+
+		if authz.LastPolledAt != nil && now.Sub(*authz.LastPolledAt) < time.Duration(authz.PollInterval)*time.Second {
+			authz.PollInterval += devicePollInterval
+			authz.LastPolledAt = &now
+			pollErr = ErrSlowDown
+			return tx.DeviceAuthorizations().Update(ctx, authz)
+		}
+
+		switch authz.Status {
+		case models.DevicePending:
+			authz.LastPolledAt = &now
+			pollErr = ErrAuthorizationPending
+			return tx.DeviceAuthorizations().Update(ctx, authz)
+		case models.DeviceDenied:
+			pollErr = ErrAccessDenied
+			return nil
+		}
+
+		user, err = tx.Users().Get(ctx, authz.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+
+		// Device codes are single use
+		if err := tx.DeviceAuthorizations().Delete(ctx, authz.ID); err != nil {
+			return fmt.Errorf("failed to consume device authorization: %w", err)
+		}
+
+		token, err = s.auth.IssueToken(user, authz.SSOOrgID)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if pollErr != nil {
+		return "", nil, pollErr
+	}
+	return token, user, nil
+}
+
+// Lookup returns the pending request for userCode so the approving user
+// can see what they approve.
+func (s *DeviceService) Lookup(ctx context.Context, userCode string) (*DeviceRequest, error) {
+	authz, err := s.store.DeviceAuthorizations().GetPending(ctx, normalizeUserCode(userCode))
+	if err == store.ErrNotFound {
+		return nil, ErrUnknownUserCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceRequest{
+		UserCode:  authz.UserCode,
+		ClientID:  authz.ClientID,
+		CreatedAt: authz.CreatedAt,
+		ExpiresAt: authz.ExpiresAt,
+	}, nil
+}
+
+// Decide approves or denies the request for userCode on behalf of userID.
+// The issued token inherits the SSO scope of the approving session.
+func (s *DeviceService) Decide(ctx context.Context, userCode, userID, ssoOrgID string, approve bool) error {
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		authz, err := tx.DeviceAuthorizations().GetPending(ctx, normalizeUserCode(userCode))
+		if err == store.ErrNotFound {
+			return ErrUnknownUserCode
+		}
+		if err != nil {
+			return err
+		}
+
+		authz.Status = models.DeviceDenied
+		if approve {
+			authz.Status = models.DeviceApproved
+		}
+		authz.UserID, authz.SSOOrgID = userID, ssoOrgID
+		return tx.DeviceAuthorizations().Update(ctx, authz)
+	})
+}
+
+// newUserCode returns an eight character code formatted as XXXX-XXXX.
+func newUserCode() (string, error) {
+	// Reject bytes past the largest multiple of the alphabet size so every
+	// character is equally likely.
+	limit := byte(256 - 256%len(userCodeAlphabet))
+
+	code := make([]byte, 0, 9)
+	buf := make([]byte, 16)
+	for len(code) < 9 {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to read random bytes: %w", err)
+		}
+		for _, v := range buf {
+			if v >= limit || len(code) == 9 {
+				continue
+			}
+			if len(code) == 4 {
+				code = append(code, '-')
+			}
+			code = append(code, userCodeAlphabet[int(v)%len(userCodeAlphabet)])
+		}
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode accepts codes typed in any case, with or without the
+// separator, and returns the canonical XXXX-XXXX form.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func hashDeviceCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
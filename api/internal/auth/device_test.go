@@ -0,0 +1,166 @@
+package auth_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+func newDeviceService(t *testing.T) (*store.Memory, *auth.Service, *auth.DeviceService) {
+	t.Helper()
+	st := store.NewMemory()
+	authService := auth.NewService(st.Users(), jwtSecret, nil)
+	return st, authService, auth.NewDeviceService(st, authService, deviceURL)
+}
+
+// agePoll moves the last poll of the pending authorization with userCode
+// back past its poll interval, as if the device had waited.
+func agePoll(t *testing.T, st store.Store, userCode string) {
+	t.Helper()
+	ctx := context.Background()
+	authz, err := st.DeviceAuthorizations().GetPending(ctx, userCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled := time.Now().Add(-time.Duration(authz.PollInterval) * time.Second)
+	authz.LastPolledAt = &polled
+	if err := st.DeviceAuthorizations().Update(ctx, authz); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	st, authService, devices := newDeviceService(t)
+	ctx := context.Background()
+	user, err := authService.Register(ctx, "dev@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := devices.Start(ctx, "dbx-cli")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if start.VerificationURI != deviceURL {
+		t.Errorf("VerificationURI = %q, want %q", start.VerificationURI, deviceURL)
+	}
+	if want := deviceURL + "?user_code=" + start.UserCode; start.VerificationURIComplete != want {
+		t.Errorf("VerificationURIComplete = %q, want %q", start.VerificationURIComplete, want)
+	}
+
+	if _, _, err := devices.Poll(ctx, start.DeviceCode); err != auth.ErrAuthorizationPending {
+		t.Fatalf("first Poll: error = %v, want ErrAuthorizationPending", err)
+	}
+	if _, _, err := devices.Poll(ctx, start.DeviceCode); err != auth.ErrSlowDown {
+		t.Fatalf("Poll right away: error = %v, want ErrSlowDown", err)
+	}
+
+	// Codes are typed in any case, with or without the dash
+	typed := strings.ToLower(strings.ReplaceAll(start.UserCode, "-", ""))
+	req, err := devices.Lookup(ctx, typed)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if req.UserCode != start.UserCode || req.ClientID != "dbx-cli" {
+		t.Errorf("Lookup returned %+v", req)
+	}
+
+	agePoll(t, st, start.UserCode)
+	if err := devices.Decide(ctx, typed, user.ID, "", true); err != nil {
+		t.Fatalf("Decide: %v", err)
+	}
+	token, got, err := devices.Poll(ctx, start.DeviceCode)
+	if err != nil {
+		t.Fatalf("Poll after approval: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("Poll returned user %s, want %s", got.ID, user.ID)
+	}
+	claims, err := authService.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.UserID != user.ID || claims.SSOOrgID != "" {
+		t.Errorf("token claims = %+v", claims)
+	}
+
+	// Device codes are single use
+	if _, _, err := devices.Poll(ctx, start.DeviceCode); err != auth.ErrInvalidDeviceCode {
+		t.Fatalf("Poll after the token was issued: error = %v, want ErrInvalidDeviceCode", err)
+	}
+}
+
+func TestDeviceLoginDenied(t *testing.T) {
+	_, authService, devices := newDeviceService(t)
+	ctx := context.Background()
+	user, err := authService.Register(ctx, "dev@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := devices.Start(ctx, "dbx-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Decide(ctx, start.UserCode, user.ID, "", false); err != nil {
+		t.Fatalf("Decide: %v", err)
+	}
+	if _, _, err := devices.Poll(ctx, start.DeviceCode); err != auth.ErrAccessDenied {
+		t.Fatalf("Poll: error = %v, want ErrAccessDenied", err)
+	}
+
+	// A decided code can't be decided again, nor looked up
+	if err := devices.Decide(ctx, start.UserCode, user.ID, "", true); err != auth.ErrUnknownUserCode {
+		t.Errorf("second Decide: error = %v, want ErrUnknownUserCode", err)
+	}
+	if _, err := devices.Lookup(ctx, start.UserCode); err != auth.ErrUnknownUserCode {
+		t.Errorf("Lookup: error = %v, want ErrUnknownUserCode", err)
+	}
+}
+
+func TestDeviceLoginUnknownCodes(t *testing.T) {
+	_, _, devices := newDeviceService(t)
+	ctx := context.Background()
+
+	if _, _, err := devices.Poll(ctx, "not-a-device-code"); err != auth.ErrInvalidDeviceCode {
+		t.Errorf("Poll: error = %v, want ErrInvalidDeviceCode", err)
+	}
+	if _, err := devices.Lookup(ctx, "BCDF-GHJK"); err != auth.ErrUnknownUserCode {
+		t.Errorf("Lookup: error = %v, want ErrUnknownUserCode", err)
+	}
+	if err := devices.Decide(ctx, "BCDF-GHJK", "user", "", true); err != auth.ErrUnknownUserCode {
+		t.Errorf("Decide: error = %v, want ErrUnknownUserCode", err)
+	}
+}
+
+func TestDeviceDecideForUnknownUser(t *testing.T) {
+	st, authService, devices := newDeviceService(t)
+	ctx := context.Background()
+	user, err := authService.Register(ctx, "dev@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := devices.Start(ctx, "dbx-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz, err := st.DeviceAuthorizations().GetPending(ctx, start.UserCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authz.Status != models.DevicePending || authz.DeviceCodeHash == start.DeviceCode {
+		t.Errorf("stored authorization = %+v; want it pending and the device code hashed", authz)
+	}
+	if err := devices.Decide(ctx, start.UserCode, "00000000-0000-0000-0000-000000000000", "", true); err == nil {
+		t.Error("Decide for an unknown user succeeded")
+	}
+	if err := devices.Decide(ctx, start.UserCode, user.ID, "", true); err != nil {
+		t.Fatalf("Decide after the failed one: %v", err)
+	}
+}
@@ -1,14 +1,14 @@
 package auth
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -17,23 +17,33 @@ var (
 	ErrUserExists         = errors.New("user already exists")
 )
 
+// TokenTTL is the lifetime of session tokens issued by the service.
+const TokenTTL = 24 * time.Hour
+
 type Service struct {
-	db        *sql.DB
+	users     store.Users
 	jwtSecret []byte
+	// previousSecrets still validate tokens signed before a secret rotation
+	previousSecrets [][]byte
 }
 
-func NewService(db *sql.DB) *Service {
-	// In production, use a proper secret from environment
-	secret := []byte("your-secret-key-change-this")
-	return &Service{
-		db:        db,
-		jwtSecret: secret,
+func NewService(users store.Users, jwtSecret string, previousSecrets []string) *Service {
+	s := &Service{
+		users:     users,
+		jwtSecret: []byte(jwtSecret),
+	}
+	for _, secret := range previousSecrets {
+		s.previousSecrets = append(s.previousSecrets, []byte(secret))
 	}
+	return s
 }
 
 type Claims struct {
 	UserID string `json:"user_id"`
 	Email  string `json:"email"`
+	// SSOOrgID is set when the token was obtained through an org's SSO
+	// connection and is used to enforce SSO-only orgs.
+	SSOOrgID string `json:"sso_org_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -43,51 +53,30 @@ func (s *Service) hashPassword(password string) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-func (s *Service) Register(email, password string) (*models.User, error) {
-	// Check if user exists
-	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE email = $1", email).Scan(&count)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check user existence: %w", err)
+func (s *Service) Register(ctx context.Context, email, password string) (*models.User, error) {
+	user := &models.User{
+		Email:  email,
+		PwHash: s.hashPassword(password),
 	}
 
-	if count > 0 {
+	err := s.users.Create(ctx, user)
+	if err == store.ErrConflict {
 		return nil, ErrUserExists
 	}
-
-	// Create user
-	user := &models.User{
-		ID:        uuid.New().String(),
-		Email:     email,
-		PwHash:    s.hashPassword(password),
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-
-	query := `
-		INSERT INTO users (id, email, pw_hash, created_at, updated_at) 
-		VALUES ($1, $2, $3, $4, $5)`
-
-	_, err = s.db.Exec(query, user.ID, user.Email, user.PwHash, user.CreatedAt, user.UpdatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+		return nil, err
 	}
 
 	return user, nil
 }
 
-func (s *Service) Login(email, password string) (string, *models.User, error) {
-	var user models.User
-	query := "SELECT id, email, pw_hash, created_at, updated_at FROM users WHERE email = $1"
-	
-	err := s.db.QueryRow(query, email).Scan(
-		&user.ID, &user.Email, &user.PwHash, &user.CreatedAt, &user.UpdatedAt,
-	)
-	if err == sql.ErrNoRows {
+func (s *Service) Login(ctx context.Context, email, password string) (string, *models.User, error) {
+	user, err := s.users.GetByEmail(ctx, email)
+	if err == store.ErrNotFound {
 		return "", nil, ErrInvalidCredentials
 	}
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get user: %w", err)
+		return "", nil, err
 	}
 
 	// Verify password
@@ -95,12 +84,23 @@ func (s *Service) Login(email, password string) (string, *models.User, error) {
 		return "", nil, ErrInvalidCredentials
 	}
 
-	// Generate JWT token
+	tokenString, err := s.IssueToken(user, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tokenString, user, nil
+}
+
+// IssueToken signs a session token for user. ssoOrgID records the org whose
+// SSO connection authenticated the user, or is empty for password logins.
+func (s *Service) IssueToken(user *models.User, ssoOrgID string) (string, error) {
 	claims := &Claims{
-		UserID: user.ID,
-		Email:  user.Email,
+		UserID:   user.ID,
+		Email:    user.Email,
+		SSOOrgID: ssoOrgID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -108,16 +108,20 @@ func (s *Service) Login(email, password string) (string, *models.User, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString(s.jwtSecret)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to sign token: %w", err)
+		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
 
-	return tokenString, &user, nil
+	return tokenString, nil
 }
 
 func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return s.jwtSecret, nil
-	})
+	token, err := s.parseToken(tokenString, s.jwtSecret)
+	for _, secret := range s.previousSecrets {
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break
+		}
+		token, err = s.parseToken(tokenString, secret)
+	}
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -128,4 +132,10 @@ func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
 	}
 
 	return nil, errors.New("invalid token")
+}
+
+func (s *Service) parseToken(tokenString string, secret []byte) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
 }
\ No newline at end of file
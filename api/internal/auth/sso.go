@@ -0,0 +1,538 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+var (
+	ErrSSONotConfigured = errors.New("sso is not configured")
+	ErrSSORequired      = errors.New("organization requires sso login")
+	ErrInvalidSSOState  = errors.New("invalid or expired sso state")
+	ErrEmailNotVerified = errors.New("identity provider did not return a verified email")
+	ErrDomainClaimed    = errors.New("domain is already claimed by another organization")
+	ErrUnknownDomain    = errors.New("domain is not claimed by the sso connection")
+	// ErrIdentityNotLinked is returned for a new identity whose email is
+	// not on a domain the org has verified. Its owner has to sign in and
+	// link it to their account with StartLink.
+	ErrIdentityNotLinked = errors.New("identity is not linked to an account")
+	ErrIdentityLinked    = errors.New("identity is linked to another account")
+)
+
+// ssoStateTTL bounds how long a user may take at the identity provider
+// between starting and finishing a login.
+const ssoStateTTL = 10 * time.Minute
+
+// SSOService implements the OpenID Connect relying-party side of SSO: it
+// starts authorization code + PKCE logins against an org's connection,
+// links the resulting identities to users and enforces SSO-only orgs.
+//
+// An identity provider vouches for any email it likes, so the email of an
+// identity is only trusted for the domains its org proved it controls, with
+// a TXT record checked by VerifyDomain. Other identities must be linked by
+// their signed-in owner.
+type SSOService struct {
+	store       store.Store
+	auth        *Service
+	devices     *DeviceService
+	oidc        *oidc.Client
+	verifier    *customdomain.Verifier
+	redirectURL string
+}
+
+// SSOLogin is a finished SSO login. Logins started by StartDeviceLogin
+// approve the device login instead of opening a session: their Token is
+// empty and RedirectURL is the verification page, saying so.
+type SSOLogin struct {
+	Token       string
+	User        *models.User
+	RedirectURL string
+}
+
+func NewSSOService(st store.Store, authService *Service, devices *DeviceService, oidcClient *oidc.Client, verifier *customdomain.Verifier, redirectURL string) *SSOService {
+	return &SSOService{
+		store:       st,
+		auth:        authService,
+		devices:     devices,
+		oidc:        oidcClient,
+		verifier:    verifier,
+		redirectURL: redirectURL,
+	}
+}
+
+// StartLogin returns the provider URL to send the user to. The connection is
+// selected by orgID or, when orgID is empty, by the verified domain of
+// email.
+func (s *SSOService) StartLogin(ctx context.Context, orgID, email string) (string, error) {
+	conn, err := s.connectionFor(ctx, orgID, email)
+	if err != nil {
+		return "", err
+	}
+	return s.startLogin(ctx, conn, &models.SSOLoginState{})
+}
+
+// StartDeviceLogin is StartLogin for a user approving the pending device
+// login with userCode: signing in at the provider approves it on their
+// behalf, as Decide would for their SSO session.
+func (s *SSOService) StartDeviceLogin(ctx context.Context, orgID, email, userCode string) (string, error) {
+	req, err := s.devices.Lookup(ctx, userCode)
+	if err != nil {
+		return "", err
+	}
+	conn, err := s.connectionFor(ctx, orgID, email)
+	if err != nil {
+		return "", err
+	}
+	return s.startLogin(ctx, conn, &models.SSOLoginState{DeviceUserCode: req.UserCode})
+}
+
+// StartLink returns the provider URL of orgID's connection for userID, who
+// is signed in, to link the identity they sign in with there to their
+// account.
+func (s *SSOService) StartLink(ctx context.Context, orgID, userID string) (string, error) {
+	conn, err := s.GetConnection(ctx, orgID)
+	if err != nil {
+		return "", err
+	}
+	return s.startLogin(ctx, conn, &models.SSOLoginState{LinkUserID: userID})
+}
+
+// connectionFor returns the connection of orgID or, when orgID is empty, the
+// one that verified the domain of email.
+func (s *SSOService) connectionFor(ctx context.Context, orgID, email string) (*models.SSOConnection, error) {
+	if orgID != "" {
+		return s.GetConnection(ctx, orgID)
+	}
+	return s.connectionForDomain(ctx, emailDomain(email))
+}
+
+// startLogin stores login, which says what the login is for, with a fresh
+// state, nonce and PKCE verifier, and returns the provider URL.
+func (s *SSOService) startLogin(ctx context.Context, conn *models.SSOConnection, login *models.SSOLoginState) (string, error) {
+	provider, err := s.oidc.Discover(ctx, conn.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := oidc.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := oidc.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := oidc.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	login.State = state
+	login.OrgID = conn.OrgID
+	login.CodeVerifier = verifier
+	login.Nonce = nonce
+	login.ExpiresAt = time.Now().Add(ssoStateTTL)
+	if err := s.store.SSOLoginStates().Create(ctx, login); err != nil {
+		return "", err
+	}
+
+	return s.oidc.AuthCodeURL(provider, s.oidcConfig(conn), state, nonce, oidc.CodeChallenge(verifier)), nil
+}
+
+// FinishLogin completes a login from the provider callback. It returns a
+// session token scoped to the org whose connection was used or, for device
+// logins, approves the device with that scope.
+func (s *SSOService) FinishLogin(ctx context.Context, state, code string) (*SSOLogin, error) {
+	login, err := s.store.SSOLoginStates().Take(ctx, state)
+	if err == store.ErrNotFound {
+		return nil, ErrInvalidSSOState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.GetConnection(ctx, login.OrgID)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := s.oidc.Discover(ctx, conn.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := s.oidc.Exchange(ctx, provider, s.oidcConfig(conn), code, login.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := s.oidc.Verify(ctx, provider, conn.ClientID, tok.IDToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.linkIdentity(ctx, conn, provider.Issuer, claims, login.LinkUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if login.DeviceUserCode != "" {
+		if err := s.devices.Decide(ctx, login.DeviceUserCode, user.ID, conn.OrgID, true); err != nil {
+			return nil, err
+		}
+		return &SSOLogin{
+			User:        user,
+			RedirectURL: s.devices.VerificationURIComplete(login.DeviceUserCode) + "&approved=1",
+		}, nil
+	}
+
+	token, err := s.auth.IssueToken(user, conn.OrgID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSOLogin{Token: token, User: user}, nil
+}
+
+// linkIdentity resolves the user for a verified ID token. Known identities
+// map straight to their user. New ones are linked to linkUserID if the
+// login was started by StartLink; otherwise, if their email is verified and
+// on a domain the org has verified, to the user with that email or to a
+// freshly created passwordless user. Such emails also join the org if their
+// domain is one of the connection's auto-join domains.
+func (s *SSOService) linkIdentity(ctx context.Context, conn *models.SSOConnection, issuer string, claims *oidc.IDTokenClaims, linkUserID string) (*models.User, error) {
+	var user *models.User
+	err := s.store.InTx(ctx, func(tx store.Store) error {
+		identity, err := tx.UserIdentities().Get(ctx, issuer, claims.Subject)
+		switch {
+		case err == nil:
+			if linkUserID != "" && identity.UserID != linkUserID {
+				return ErrIdentityLinked
+			}
+			if err := tx.UserIdentities().Touch(ctx, identity.ID, claims.Email); err != nil {
+				return err
+			}
+			if user, err = tx.Users().Get(ctx, identity.UserID); err != nil {
+				return err
+			}
+
+		case err == store.ErrNotFound:
+			if user, err = s.identityUser(ctx, tx, conn, claims, linkUserID); err != nil {
+				return err
+			}
+			err = tx.UserIdentities().Create(ctx, &models.UserIdentity{
+				UserID:  user.ID,
+				Issuer:  issuer,
+				Subject: claims.Subject,
+				Email:   claims.Email,
+			})
+			if err != nil {
+				return err
+			}
+
+		default:
+			return err
+		}
+
+		if !claims.EmailVerified || !containsDomain(conn.AutoJoinDomains, emailDomain(claims.Email)) {
+			return nil
+		}
+		verified, err := domainVerified(ctx, tx, conn.OrgID, emailDomain(claims.Email))
+		if err != nil || !verified {
+			return err
+		}
+		_, err = tx.Memberships().Get(ctx, user.ID, conn.OrgID)
+		if err != store.ErrNotFound {
+			return err
+		}
+		return tx.Memberships().Create(ctx, &models.Membership{
+			UserID: user.ID,
+			OrgID:  conn.OrgID,
+			Role:   conn.AutoJoinRole,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// identityUser returns the user to link a new identity to.
+func (s *SSOService) identityUser(ctx context.Context, tx store.Store, conn *models.SSOConnection, claims *oidc.IDTokenClaims, linkUserID string) (*models.User, error) {
+	if linkUserID != "" {
+		return tx.Users().Get(ctx, linkUserID)
+	}
+
+	// Linking by email is only safe when the provider vouches for it, and
+	// the provider is trusted to do so for its org's domains only
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	verified, err := domainVerified(ctx, tx, conn.OrgID, emailDomain(claims.Email))
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, ErrIdentityNotLinked
+	}
+
+	user, err := tx.Users().GetByEmail(ctx, claims.Email)
+	if err == store.ErrNotFound {
+		// SSO-only users get an empty hash, which never matches a password
+		user = &models.User{Email: claims.Email}
+		err = tx.Users().Create(ctx, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// domainVerified reports whether orgID has verified domain.
+func domainVerified(ctx context.Context, st store.Store, orgID, domain string) (bool, error) {
+	if domain == "" {
+		return false, nil
+	}
+	claim, err := st.SSODomains().GetVerified(ctx, domain)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return claim.OrgID == orgID, nil
+}
+
+// CheckOrgAccess enforces an org's SSO requirement. ssoOrgID is the org
+// recorded in the caller's token. Owners are exempt so that a broken
+// connection can't lock everyone out of the org.
+func (s *SSOService) CheckOrgAccess(ctx context.Context, orgID string, role models.UserRole, ssoOrgID string) error {
+	if role == models.RoleOwner {
+		return nil
+	}
+
+	conn, err := s.store.SSOConnections().Get(ctx, orgID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if conn.Enforced && ssoOrgID != orgID {
+		return ErrSSORequired
+	}
+	return nil
+}
+
+// GetConnection returns the connection of orgID along with the
+// verification state of its domains.
+func (s *SSOService) GetConnection(ctx context.Context, orgID string) (*models.SSOConnection, error) {
+	conn, err := s.store.SSOConnections().Get(ctx, orgID)
+	if err == store.ErrNotFound {
+		return nil, ErrSSONotConfigured
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conn.Domains, err = s.store.SSODomains().ListByOrg(ctx, orgID); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SaveConnection creates or replaces an org's connection after checking
+// that the issuer is reachable and no other org has verified one of its
+// domains. Newly listed domains are claimed pending verification, and
+// domains no longer listed are released. An empty client secret keeps the
+// stored one.
+func (s *SSOService) SaveConnection(ctx context.Context, conn *models.SSOConnection) error {
+	conn.Issuer = strings.TrimSuffix(conn.Issuer, "/")
+	domains := []string{}
+	for _, d := range conn.AutoJoinDomains {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if !containsDomain(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	conn.AutoJoinDomains = domains
+	if conn.AutoJoinRole == "" {
+		conn.AutoJoinRole = models.RoleMember
+	}
+
+	for _, d := range conn.AutoJoinDomains {
+		claim, err := s.store.SSODomains().GetVerified(ctx, d)
+		if err == nil && claim.OrgID != conn.OrgID {
+			return ErrDomainClaimed
+		}
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	if _, err := s.oidc.Discover(ctx, conn.Issuer); err != nil {
+		return err
+	}
+
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.SSOConnections().Put(ctx, conn); err != nil {
+			return err
+		}
+		claims, err := tx.SSODomains().ListByOrg(ctx, conn.OrgID)
+		if err != nil {
+			return err
+		}
+		for _, claim := range claims {
+			if containsDomain(conn.AutoJoinDomains, claim.Name) {
+				continue
+			}
+			if err := tx.SSODomains().Delete(ctx, claim.ID); err != nil {
+				return err
+			}
+		}
+		for _, d := range conn.AutoJoinDomains {
+			if claimed(claims, d) {
+				continue
+			}
+			token, err := customdomain.NewToken()
+			if err != nil {
+				return err
+			}
+			claim := models.SSODomain{
+				OrgID:             conn.OrgID,
+				Name:              d,
+				VerificationName:  customdomain.ChallengeName(d),
+				VerificationValue: token,
+			}
+			if err := tx.SSODomains().Create(ctx, &claim); err != nil {
+				return err
+			}
+		}
+		conn.Domains, err = tx.SSODomains().ListByOrg(ctx, conn.OrgID)
+		return err
+	})
+}
+
+// DeleteConnection removes an org's connection and releases its domains.
+func (s *SSOService) DeleteConnection(ctx context.Context, orgID string) error {
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		err := tx.SSOConnections().Delete(ctx, orgID)
+		if err == store.ErrNotFound {
+			return ErrSSONotConfigured
+		}
+		if err != nil {
+			return err
+		}
+		claims, err := tx.SSODomains().ListByOrg(ctx, orgID)
+		if err != nil {
+			return err
+		}
+		for _, claim := range claims {
+			if err := tx.SSODomains().Delete(ctx, claim.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// VerifyDomain looks up the ownership record of a domain of orgID's
+// connection and marks the domain verified if it holds the verification
+// value. Otherwise the domain stays pending, with an error message saying
+// what was found instead.
+func (s *SSOService) VerifyDomain(ctx context.Context, orgID, name string) (*models.SSODomain, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	claims, err := s.store.SSODomains().ListByOrg(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	var domain *models.SSODomain
+	for i := range claims {
+		if claims[i].Name == name {
+			domain = &claims[i]
+		}
+	}
+	if domain == nil {
+		return nil, ErrUnknownDomain
+	}
+	if domain.Status == models.DomainVerified {
+		return domain, nil
+	}
+
+	if err := s.verifier.Check(ctx, domain.Name, domain.VerificationValue); err != nil {
+		domain.ErrorMessage = err.Error()
+	} else {
+		now := time.Now()
+		domain.Status, domain.ErrorMessage, domain.VerifiedAt = models.DomainVerified, "", &now
+	}
+	err = s.store.SSODomains().Update(ctx, domain)
+	if err == store.ErrConflict {
+		return nil, ErrDomainClaimed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+// connectionForDomain returns the connection of the org that verified
+// domain.
+func (s *SSOService) connectionForDomain(ctx context.Context, domain string) (*models.SSOConnection, error) {
+	if domain == "" {
+		return nil, ErrSSONotConfigured
+	}
+
+	claim, err := s.store.SSODomains().GetVerified(ctx, domain)
+	if err == store.ErrNotFound {
+		return nil, ErrSSONotConfigured
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up sso domain: %w", err)
+	}
+	return s.GetConnection(ctx, claim.OrgID)
+}
+
+func (s *SSOService) oidcConfig(conn *models.SSOConnection) oidc.Config {
+	return oidc.Config{
+		ClientID:     conn.ClientID,
+		ClientSecret: conn.ClientSecret,
+		RedirectURL:  s.redirectURL,
+	}
+}
+
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+func containsDomain(domains []string, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, d := range domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func claimed(claims []models.SSODomain, domain string) bool {
+	for _, claim := range claims {
+		if claim.Name == domain {
+			return true
+		}
+	}
+	return false
+}
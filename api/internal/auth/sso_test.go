@@ -0,0 +1,490 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/zallarak/db/api/internal/oidc/oidctest"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+const (
+	jwtSecret = "test-secret-test-secret-test-secret"
+	deviceURL = "http://127.0.0.1/device"
+)
+
+type ssoEnv struct {
+	store   *store.Memory
+	auth    *auth.Service
+	sso     *auth.SSOService
+	devices *auth.DeviceService
+	idp     *oidctest.Provider
+	dns     *dns.Server
+	org     *models.Org
+	owner   *models.User
+}
+
+func newSSOEnv(t *testing.T) *ssoEnv {
+	t.Helper()
+	ctx := context.Background()
+
+	idp := oidctest.NewProvider("dbx", "secret")
+	t.Cleanup(idp.Close)
+	ns, err := dns.NewServer("cust.db.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	st := store.NewMemory()
+	authService := auth.NewService(st.Users(), jwtSecret, nil)
+	devices := auth.NewDeviceService(st, authService, deviceURL)
+	env := &ssoEnv{
+		store:   st,
+		auth:    authService,
+		sso:     auth.NewSSOService(st, authService, devices, oidc.NewClient(nil), customdomain.NewVerifier(ns.Addr()), "http://127.0.0.1/v1/auth/sso/callback"),
+		devices: devices,
+		idp:     idp,
+		dns:     ns,
+		org:     &models.Org{Name: "Example"},
+	}
+	env.owner = env.user(t, "owner@example.com")
+	if err := st.Orgs().Create(ctx, env.org); err != nil {
+		t.Fatal(err)
+	}
+	env.join(t, env.owner, env.org, models.RoleOwner)
+	return env
+}
+
+func (e *ssoEnv) user(t *testing.T, email string) *models.User {
+	t.Helper()
+	user, err := e.auth.Register(context.Background(), email, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func (e *ssoEnv) join(t *testing.T, user *models.User, org *models.Org, role models.UserRole) {
+	t.Helper()
+	err := e.store.Memberships().Create(context.Background(), &models.Membership{UserID: user.ID, OrgID: org.ID, Role: role})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connect configures an SSO connection for org at the fake provider,
+// claiming domains.
+func (e *ssoEnv) connect(t *testing.T, org *models.Org, domains ...string) *models.SSOConnection {
+	t.Helper()
+	conn := &models.SSOConnection{
+		OrgID:           org.ID,
+		Issuer:          e.idp.Issuer(),
+		ClientID:        "dbx",
+		ClientSecret:    "secret",
+		AutoJoinDomains: domains,
+	}
+	if err := e.sso.SaveConnection(context.Background(), conn); err != nil {
+		t.Fatalf("SaveConnection: %v", err)
+	}
+	return conn
+}
+
+// verify publishes the ownership record of a domain of conn and verifies
+// it.
+func (e *ssoEnv) verify(t *testing.T, conn *models.SSOConnection, name string) {
+	t.Helper()
+	for _, d := range conn.Domains {
+		if d.Name == name {
+			e.dns.SetTXT(d.VerificationName, d.VerificationValue)
+		}
+	}
+	domain, err := e.sso.VerifyDomain(context.Background(), conn.OrgID, name)
+	if err != nil {
+		t.Fatalf("VerifyDomain: %v", err)
+	}
+	if domain.Status != models.DomainVerified {
+		t.Fatalf("domain %s is %s: %s", name, domain.Status, domain.ErrorMessage)
+	}
+}
+
+// login follows authURL through the fake provider, which signs in as its
+// current user at once, and finishes the login with the code it returns.
+func (e *ssoEnv) login(t *testing.T, authURL string) (string, *models.User, error) {
+	t.Helper()
+	login, err := e.finish(t, authURL)
+	if err != nil {
+		return "", nil, err
+	}
+	return login.Token, login.User, nil
+}
+
+// finish is login returning the finished login.
+func (e *ssoEnv) finish(t *testing.T, authURL string) (*auth.SSOLogin, error) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := u.Query(); q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" {
+		t.Fatalf("authorization URL %s lacks PKCE or a nonce", authURL)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", resp.Status)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.sso.FinishLogin(context.Background(), callback.Query().Get("state"), callback.Query().Get("code"))
+}
+
+func (e *ssoEnv) startLogin(t *testing.T, orgID, email string) string {
+	t.Helper()
+	authURL, err := e.sso.StartLogin(context.Background(), orgID, email)
+	if err != nil {
+		t.Fatalf("StartLogin: %v", err)
+	}
+	return authURL
+}
+
+func TestSSOLoginWithVerifiedDomain(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+	conn := e.connect(t, e.org, "example.com")
+	e.verify(t, conn, "example.com")
+	e.idp.SetUser(oidctest.User{Subject: "alice", Email: "alice@example.com", EmailVerified: true})
+
+	// The verified domain routes the login to the org
+	token, user, err := e.login(t, e.startLogin(t, "", "alice@example.com"))
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if user.Email != "alice@example.com" || user.PwHash != "" {
+		t.Errorf("login created %+v, want a passwordless user for alice@example.com", user)
+	}
+	claims, err := e.auth.ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != user.ID || claims.SSOOrgID != e.org.ID {
+		t.Errorf("token claims = %+v, want user %s scoped to org %s", claims, user.ID, e.org.ID)
+	}
+	m, err := e.store.Memberships().Get(ctx, user.ID, e.org.ID)
+	if err != nil || m.Role != models.RoleMember {
+		t.Errorf("membership = %+v, %v; want the auto-join role", m, err)
+	}
+
+	// The identity now maps to the same user
+	_, again, err := e.login(t, e.startLogin(t, e.org.ID, ""))
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second login = %+v, %v; want user %s", again, err, user.ID)
+	}
+}
+
+func TestSSODeviceLogin(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+	conn := e.connect(t, e.org, "example.com")
+	e.verify(t, conn, "example.com")
+	e.idp.SetUser(oidctest.User{Subject: "alice", Email: "alice@example.com", EmailVerified: true})
+
+	if _, err := e.sso.StartDeviceLogin(ctx, "", "alice@example.com", "BCDF-GHJK"); err != auth.ErrUnknownUserCode {
+		t.Fatalf("StartDeviceLogin with an unknown code: error = %v, want ErrUnknownUserCode", err)
+	}
+
+	start, err := e.devices.Start(ctx, "dbx-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := e.sso.StartDeviceLogin(ctx, "", "alice@example.com", start.UserCode)
+	if err != nil {
+		t.Fatalf("StartDeviceLogin: %v", err)
+	}
+	login, err := e.finish(t, authURL)
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if login.Token != "" {
+		t.Error("a device login opened a browser session")
+	}
+	if want := start.VerificationURIComplete + "&approved=1"; login.RedirectURL != want {
+		t.Errorf("RedirectURL = %q, want %q", login.RedirectURL, want)
+	}
+
+	// The device gets a token with the SSO scope of the login
+	token, user, err := e.devices.Poll(ctx, start.DeviceCode)
+	if err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+	claims, err := e.auth.ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != user.ID || user.Email != "alice@example.com" || claims.SSOOrgID != e.org.ID {
+		t.Errorf("token claims = %+v, want alice scoped to org %s", claims, e.org.ID)
+	}
+}
+
+func TestSSOLoginRejectsReplayedState(t *testing.T) {
+	e := newSSOEnv(t)
+	e.connect(t, e.org)
+
+	authURL, err := e.sso.StartLink(context.Background(), e.org.ID, e.owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := mustQuery(t, authURL, "state")
+	if _, _, err := e.login(t, authURL); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if _, err := e.sso.FinishLogin(context.Background(), state, "code"); err != auth.ErrInvalidSSOState {
+		t.Fatalf("replayed state: error = %v, want ErrInvalidSSOState", err)
+	}
+}
+
+func TestSSOLoginRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*oidc.IDTokenClaims)
+	}{
+		{"issuer", func(c *oidc.IDTokenClaims) { c.Issuer = "https://idp.evil.test" }},
+		{"audience", func(c *oidc.IDTokenClaims) { c.Audience = []string{"another-client"} }},
+		{"nonce", func(c *oidc.IDTokenClaims) { c.Nonce = "nonce-of-another-login" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newSSOEnv(t)
+			conn := e.connect(t, e.org, "example.com")
+			e.verify(t, conn, "example.com")
+			e.idp.ModifyClaims(tt.modify)
+
+			_, _, err := e.login(t, e.startLogin(t, e.org.ID, ""))
+			if !errors.Is(err, oidc.ErrInvalidIDToken) {
+				t.Fatalf("FinishLogin error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestSSOLoginAfterKeyRotation(t *testing.T) {
+	e := newSSOEnv(t)
+	conn := e.connect(t, e.org, "example.com")
+	e.verify(t, conn, "example.com")
+
+	if _, _, err := e.login(t, e.startLogin(t, e.org.ID, "")); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	// A fresh client has no cached keys, as after the cache expires
+	e.idp.RotateKey()
+	e.sso = auth.NewSSOService(e.store, e.auth, e.devices, oidc.NewClient(nil), customdomain.NewVerifier(e.dns.Addr()), "http://127.0.0.1/v1/auth/sso/callback")
+	if _, _, err := e.login(t, e.startLogin(t, e.org.ID, "")); err != nil {
+		t.Fatalf("FinishLogin after rotation: %v", err)
+	}
+}
+
+func TestSSOLoginDoesNotTrustUnverifiedDomains(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+	victim := e.user(t, "victim@example.com")
+
+	// An org claims example.com without proving it controls it, and its
+	// provider asserts the victim's email
+	attacker := &models.Org{Name: "Attacker"}
+	if err := e.store.Orgs().Create(ctx, attacker); err != nil {
+		t.Fatal(err)
+	}
+	e.connect(t, attacker, "example.com")
+	e.idp.SetUser(oidctest.User{Subject: "mallory", Email: "victim@example.com", EmailVerified: true})
+
+	if _, err := e.sso.StartLogin(ctx, "", "victim@example.com"); err != auth.ErrSSONotConfigured {
+		t.Errorf("StartLogin by an unverified domain: error = %v, want ErrSSONotConfigured", err)
+	}
+	_, _, err := e.login(t, e.startLogin(t, attacker.ID, ""))
+	if err != auth.ErrIdentityNotLinked {
+		t.Fatalf("FinishLogin error = %v, want ErrIdentityNotLinked", err)
+	}
+	if _, err := e.store.UserIdentities().Get(ctx, e.idp.Issuer(), "mallory"); err != store.ErrNotFound {
+		t.Errorf("identity was linked: %v", err)
+	}
+	if _, err := e.store.Memberships().Get(ctx, victim.ID, attacker.ID); err != store.ErrNotFound {
+		t.Errorf("victim joined the attacker's org: %v", err)
+	}
+}
+
+func TestSSOLinkIdentity(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+	e.connect(t, e.org)
+	e.idp.SetUser(oidctest.User{Subject: "owner-at-idp", Email: "someone@elsewhere.test", EmailVerified: false})
+
+	authURL, err := e.sso.StartLink(ctx, e.org.ID, e.owner.ID)
+	if err != nil {
+		t.Fatalf("StartLink: %v", err)
+	}
+	_, user, err := e.login(t, authURL)
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if user.ID != e.owner.ID {
+		t.Fatalf("identity linked to %s, want the signed-in owner %s", user.ID, e.owner.ID)
+	}
+
+	// The identity signs in as the owner from now on
+	_, user, err = e.login(t, e.startLogin(t, e.org.ID, ""))
+	if err != nil || user.ID != e.owner.ID {
+		t.Fatalf("login with the linked identity = %+v, %v; want the owner", user, err)
+	}
+
+	// and can't be linked to someone else
+	other := e.user(t, "other@example.com")
+	authURL, err = e.sso.StartLink(ctx, e.org.ID, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.login(t, authURL); err != auth.ErrIdentityLinked {
+		t.Fatalf("linking a linked identity: error = %v, want ErrIdentityLinked", err)
+	}
+}
+
+func TestSSODomainVerification(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+	conn := e.connect(t, e.org, "Example.com.")
+	if len(conn.Domains) != 1 || conn.Domains[0].Name != "example.com" || conn.Domains[0].Status != models.DomainPending {
+		t.Fatalf("domains = %+v, want example.com pending", conn.Domains)
+	}
+	domain := conn.Domains[0]
+
+	got, err := e.sso.VerifyDomain(ctx, e.org.ID, "example.com")
+	if err != nil || got.Status != models.DomainPending || got.ErrorMessage == "" {
+		t.Fatalf("VerifyDomain without a record = %+v, %v; want pending with an error", got, err)
+	}
+	e.dns.SetTXT(domain.VerificationName, "dbx-verification=wrong")
+	got, err = e.sso.VerifyDomain(ctx, e.org.ID, "example.com")
+	if err != nil || got.Status != models.DomainPending {
+		t.Fatalf("VerifyDomain with the wrong value = %+v, %v; want pending", got, err)
+	}
+	if _, err := e.sso.VerifyDomain(ctx, e.org.ID, "other.com"); err != auth.ErrUnknownDomain {
+		t.Fatalf("VerifyDomain of an unclaimed domain: error = %v, want ErrUnknownDomain", err)
+	}
+
+	// Another org may claim the domain while it is pending, but only one
+	// verifies it
+	rival := &models.Org{Name: "Rival"}
+	if err := e.store.Orgs().Create(ctx, rival); err != nil {
+		t.Fatal(err)
+	}
+	rivalConn := e.connect(t, rival, "example.com")
+
+	e.verify(t, conn, "example.com")
+	e.dns.SetTXT(rivalConn.Domains[0].VerificationName, rivalConn.Domains[0].VerificationValue)
+	if _, err := e.sso.VerifyDomain(ctx, rival.ID, "example.com"); err != auth.ErrDomainClaimed {
+		t.Fatalf("VerifyDomain of a domain another org verified: error = %v, want ErrDomainClaimed", err)
+	}
+	rivalConn.AutoJoinDomains = []string{"example.com"}
+	if err := e.sso.SaveConnection(ctx, rivalConn); err != auth.ErrDomainClaimed {
+		t.Fatalf("SaveConnection with a domain another org verified: error = %v, want ErrDomainClaimed", err)
+	}
+
+	// Dropping the domain from the connection releases it
+	conn.AutoJoinDomains = nil
+	if err := e.sso.SaveConnection(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Domains) != 0 {
+		t.Errorf("domains after dropping them = %+v", conn.Domains)
+	}
+	if _, err := e.sso.VerifyDomain(ctx, rival.ID, "example.com"); err != nil {
+		t.Errorf("VerifyDomain of a released domain: %v", err)
+	}
+}
+
+func TestSSOAutoJoinNeedsVerifiedDomain(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+	conn := e.connect(t, e.org, "example.com")
+	bob := e.user(t, "bob@example.com")
+	e.idp.SetUser(oidctest.User{Subject: "bob", Email: "bob@example.com", EmailVerified: true})
+
+	// Linked by bob himself while the domain is pending: no auto-join
+	authURL, err := e.sso.StartLink(ctx, e.org.ID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.login(t, authURL); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if _, err := e.store.Memberships().Get(ctx, bob.ID, e.org.ID); err != store.ErrNotFound {
+		t.Fatalf("joined through a pending domain: %v", err)
+	}
+
+	e.verify(t, conn, "example.com")
+	if _, _, err := e.login(t, e.startLogin(t, e.org.ID, "")); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if _, err := e.store.Memberships().Get(ctx, bob.ID, e.org.ID); err != nil {
+		t.Fatalf("not joined through the verified domain: %v", err)
+	}
+}
+
+func TestCheckOrgAccess(t *testing.T) {
+	e := newSSOEnv(t)
+	ctx := context.Background()
+
+	if err := e.sso.CheckOrgAccess(ctx, e.org.ID, models.RoleMember, ""); err != nil {
+		t.Fatalf("without a connection: %v", err)
+	}
+	conn := e.connect(t, e.org)
+	if err := e.sso.CheckOrgAccess(ctx, e.org.ID, models.RoleMember, ""); err != nil {
+		t.Fatalf("connection not enforced: %v", err)
+	}
+
+	conn.Enforced = true
+	if err := e.sso.SaveConnection(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		role     models.UserRole
+		ssoOrgID string
+		want     error
+	}{
+		{models.RoleMember, "", auth.ErrSSORequired},
+		{models.RoleAdmin, "", auth.ErrSSORequired},
+		{models.RoleMember, "another-org", auth.ErrSSORequired},
+		{models.RoleMember, e.org.ID, nil},
+		{models.RoleOwner, "", nil},
+	}
+	for _, tt := range tests {
+		if err := e.sso.CheckOrgAccess(ctx, e.org.ID, tt.role, tt.ssoOrgID); err != tt.want {
+			t.Errorf("CheckOrgAccess(%s, sso org %q) = %v, want %v", tt.role, tt.ssoOrgID, err, tt.want)
+		}
+	}
+}
+
+func mustQuery(t *testing.T, rawURL, key string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get(key)
+}
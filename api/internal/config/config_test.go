@@ -0,0 +1,287 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/config"
+)
+
+// clearEnv unsets the variables Load reads for the test, so the
+// environment it runs in doesn't leak into it.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	aliases := map[string]bool{"PORT": true, "DATABASE_URL": true, "API_BASE_URL": true, "CONSOLE_URL": true}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "DBX_") || strings.HasPrefix(name, "OTEL_") || aliases[name] {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// writeFile writes content to a file in a temporary directory and returns
+// its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := "server:\n  port: 7000\n  console_url: https://console.example.com\n"
+	tests := []struct {
+		name     string
+		file     bool
+		env      map[string]string
+		args     []string
+		wantPort int
+	}{
+		{name: "default", wantPort: 8080},
+		{name: "file", file: true, wantPort: 7000},
+		{name: "env over file", file: true, env: map[string]string{"DBX_SERVER_PORT": "7100"}, wantPort: 7100},
+		{name: "alias over file", file: true, env: map[string]string{"PORT": "7300"}, wantPort: 7300},
+		{name: "name over alias", env: map[string]string{"DBX_SERVER_PORT": "7100", "PORT": "7300"}, wantPort: 7100},
+		{name: "flag over env", file: true, env: map[string]string{"DBX_SERVER_PORT": "7100"}, args: []string{"--port", "7200"}, wantPort: 7200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := append([]string{"--dev"}, tt.args...)
+			if tt.file {
+				args = append(args, "--config", writeFile(t, "config.yaml", file))
+			}
+			cfg, _, err := config.Load("server", args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.Port != tt.wantPort {
+				t.Errorf("server.port = %d, want %d", cfg.Server.Port, tt.wantPort)
+			}
+			// Fields no source overrides keep the value of the file
+			if tt.file && cfg.Server.ConsoleURL != "https://console.example.com" {
+				t.Errorf("server.console_url = %q", cfg.Server.ConsoleURL)
+			}
+		})
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("DBX_DATABASE_URL_FILE", writeFile(t, "url", "postgres://db.example.com/dbx\n"))
+	cfg, rest, err := config.Load("server", []string{"--dev", "migrate", "up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.URL != "postgres://db.example.com/dbx" {
+		t.Errorf("database.url = %q", cfg.Database.URL)
+	}
+	if strings.Join(rest, " ") != "migrate up" {
+		t.Errorf("arguments left = %q", rest)
+	}
+
+	// A variable set directly wins over its file
+	t.Setenv("DBX_DATABASE_URL", "postgres://other.example.com/dbx")
+	if cfg, _, err = config.Load("server", []string{"--dev"}); err != nil || cfg.Database.URL != "postgres://other.example.com/dbx" {
+		t.Errorf("database.url = %q, %v", cfg.Database.URL, err)
+	}
+}
+
+func TestLoadProxmoxEnv(t *testing.T) {
+	file := writeFile(t, "config.yaml", `proxmox:
+  endpoints:
+    - name: pve1
+      url: https://pve1.example.com:8006
+      token_id: dbx@pve!control-plane
+      token_secret: file-secret
+      ca_file: /etc/dbx/pve-ca.pem
+`)
+	tests := []struct {
+		name string
+		file bool
+		env  map[string]string
+		want config.ProxmoxEndpoint
+	}{
+		{
+			name: "file only",
+			file: true,
+			want: config.ProxmoxEndpoint{Name: "pve1", URL: "https://pve1.example.com:8006", TokenID: "dbx@pve!control-plane", TokenSecret: "file-secret", CAFile: "/etc/dbx/pve-ca.pem"},
+		},
+		{
+			name: "URL keeps the rest of the file",
+			file: true,
+			env:  map[string]string{"DBX_PROXMOX_URL": "https://pve2.example.com:8006"},
+			want: config.ProxmoxEndpoint{Name: "pve1", URL: "https://pve2.example.com:8006", TokenID: "dbx@pve!control-plane", TokenSecret: "file-secret", CAFile: "/etc/dbx/pve-ca.pem"},
+		},
+		{
+			name: "every field",
+			file: true,
+			env: map[string]string{
+				"DBX_PROXMOX_URL":                  "https://pve2.example.com:8006",
+				"DBX_PROXMOX_TOKEN_ID":             "dbx@pve!other",
+				"DBX_PROXMOX_TOKEN_SECRET_FILE":    writeFile(t, "secret", "env-secret\n"),
+				"DBX_PROXMOX_CA_FILE":              "/etc/dbx/other-ca.pem",
+				"DBX_PROXMOX_INSECURE_SKIP_VERIFY": "true",
+			},
+			want: config.ProxmoxEndpoint{Name: "pve1", URL: "https://pve2.example.com:8006", TokenID: "dbx@pve!other", TokenSecret: "env-secret", CAFile: "/etc/dbx/other-ca.pem", InsecureSkipVerify: true},
+		},
+		{
+			name: "no file",
+			env: map[string]string{
+				"DBX_PROXMOX_URL":          "https://pve2.example.com:8006",
+				"DBX_PROXMOX_TOKEN_ID":     "dbx@pve!other",
+				"DBX_PROXMOX_TOKEN_SECRET": "env-secret",
+			},
+			want: config.ProxmoxEndpoint{Name: "default", URL: "https://pve2.example.com:8006", TokenID: "dbx@pve!other", TokenSecret: "env-secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := []string{"--dev"}
+			if tt.file {
+				args = append(args, "--config", file)
+			}
+			cfg, _, err := config.Load("server", args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Proxmox.Endpoints) != 1 || cfg.Proxmox.Endpoints[0] != tt.want {
+				t.Errorf("endpoints = %+v, want %+v", cfg.Proxmox.Endpoints, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{name: "unknown flag", args: []string{"--dev", "--prot", "80"}, wantErr: "flag provided but not defined"},
+		{name: "missing file", args: []string{"--dev", "--config", "/nonexistent/config.yaml"}, wantErr: "failed to read config file"},
+		{name: "unknown field", file: "server:\n  prot: 80\n", wantErr: "field prot not found"},
+		{name: "invalid env value", env: map[string]string{"DBX_SERVER_PORT": "eighty"}, wantErr: "invalid value for DBX_SERVER_PORT"},
+		{name: "invalid alias value", env: map[string]string{"PORT": "eighty"}, wantErr: "invalid value for PORT"},
+		{name: "missing secret file", env: map[string]string{"DBX_AUTH_JWT_SECRET_FILE": "/nonexistent/secret"}, wantErr: "failed to read DBX_AUTH_JWT_SECRET_FILE"},
+		{name: "invalid Proxmox env value", env: map[string]string{"DBX_PROXMOX_URL": "https://pve.example.com:8006", "DBX_PROXMOX_INSECURE_SKIP_VERIFY": "maybe"}, wantErr: "invalid value for DBX_PROXMOX_INSECURE_SKIP_VERIFY"},
+		{name: "invalid after overrides", env: map[string]string{"DBX_ADMIN_PORT": "8080"}, wantErr: "admin.port must differ from server.port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if args == nil {
+				args = []string{"--dev"}
+			}
+			if tt.file != "" {
+				args = append(args, "--config", writeFile(t, "config.yaml", tt.file))
+			}
+			_, _, err := config.Load("server", args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// devConfig returns the configuration of --dev with nothing else set.
+func devConfig(t *testing.T) *config.Config {
+	t.Helper()
+	clearEnv(t)
+	cfg, _, err := config.Load("server", []string{"--dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *config.Config)
+		wantErr string
+	}{
+		{"log level", func(c *config.Config) { c.Log.Level = "verbose" }, "log.level must be one of"},
+		{"server port", func(c *config.Config) { c.Server.Port = 70000 }, "server.port must be between 1 and 65535"},
+		{"base URL", func(c *config.Config) { c.Server.BaseURL = "localhost:8080" }, "server.base_url: must be an absolute http(s) URL"},
+		{"timeout", func(c *config.Config) { c.Server.ReadTimeout = 0 }, "server.read_timeout must be positive"},
+		{"database driver", func(c *config.Config) { c.Database.Driver = "sqlite" }, "database.driver must be postgres or memory"},
+		{"idle connections", func(c *config.Config) { c.Database.MaxOpenConns, c.Database.MaxIdleConns = 5, 10 }, "database.max_idle_conns must not exceed"},
+		{"Proxmox endpoint", func(c *config.Config) {
+			c.Proxmox.Endpoints = []config.ProxmoxEndpoint{{Name: "pve1", URL: "https://pve1.example.com:8006"}}
+		}, "token_id and token_secret are required"},
+		{"DNS zone", func(c *config.Config) { c.DNS.Zone = "not a zone" }, "dns.zone must be a domain name"},
+		{"TSIG algorithm", func(c *config.Config) {
+			c.DNS.RFC2136.KeyName, c.DNS.RFC2136.KeyAlgorithm = "dbx-key", "hmac-md5"
+		}, "dns.rfc2136.key_algorithm must be hmac-sha256 or hmac-sha512"},
+		{"domain proxy port", func(c *config.Config) { c.Domains.ProxyPort, c.Domains.ProxyHost = c.Server.Port, "proxy.example.com" }, "domains.proxy_port must differ"},
+		{"domain proxy host", func(c *config.Config) { c.Domains.ProxyPort = 6432 }, "domains.proxy_host is required"},
+		{"backups store", func(c *config.Config) { c.Backups.Store = "tape" }, "backups.store must be local or s3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := devConfig(t)
+			tt.change(cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	cfg := devConfig(t)
+	cfg.Log.Format, cfg.Server.Port = "xml", 0
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "log.format") || !strings.Contains(err.Error(), "server.port") {
+		t.Errorf("Validate = %v, want both errors", err)
+	}
+}
+
+// TestValidateInsecureDefaults checks that a server outside --dev refuses
+// to start with the defaults --dev is fine with.
+func TestValidateInsecureDefaults(t *testing.T) {
+	cfg := devConfig(t)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+	cfg.Dev = false
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted the --dev defaults outside --dev")
+	}
+	for _, want := range []string{
+		"database.driver memory",
+		"auth.jwt_secret uses a well-known development value",
+		`cors.allowed_origins must not contain "*"`,
+		"use --dev for local development",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, want error containing %q", err, want)
+		}
+	}
+
+	clearEnv(t)
+	if _, _, err := config.Load("server", nil); err == nil || !strings.Contains(err.Error(), "auth.jwt_secret is required") {
+		t.Errorf("Load without --dev = %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// applyEnv overrides fields tagged with `env:"NAME[,ALIAS...]"` from the
+// environment. The first name wins over its aliases, which keep older
+// variables such as DATABASE_URL and PORT working. Fields also tagged
+// `secret:"true"` can instead be read from the file named by NAME_FILE, for
+// use with Docker and Kubernetes secrets.
+func applyEnv(cfg *Config) error {
+	return applyEnvStruct(reflect.ValueOf(cfg).Elem())
+}
+
+func applyEnvStruct(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			if err := applyEnvStruct(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := field.Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+
+		raw, name, ok, err := lookupEnv(strings.Split(tag, ","), field.Tag.Get("secret") == "true")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setValue(value, raw); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the value of the first of names that is set, either
+// directly or, for secrets, through NAME_FILE.
+func lookupEnv(names []string, secret bool) (string, string, bool, error) {
+	for _, name := range names {
+		if raw, ok := os.LookupEnv(name); ok {
+			return raw, name, true, nil
+		}
+		if !secret {
+			continue
+		}
+		if path, ok := os.LookupEnv(name + "_FILE"); ok {
+			raw, err := readSecretFile(path)
+			if err != nil {
+				return "", name + "_FILE", false, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+			}
+			return raw, name + "_FILE", true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// applyProxmoxEnv configures a single Proxmox endpoint from the environment,
+// for deployments that don't use a config file. It overrides the fields of
+// the first endpoint from the file, if any, whose variables are set.
+func applyProxmoxEnv(cfg *Config) error {
+	u, ok := os.LookupEnv("DBX_PROXMOX_URL")
+	if !ok {
+		return nil
+	}
+
+	ep := ProxmoxEndpoint{Name: "default", URL: u}
+	if len(cfg.Proxmox.Endpoints) > 0 {
+		ep = cfg.Proxmox.Endpoints[0]
+		ep.URL = u
+	}
+
+	if v, ok := os.LookupEnv("DBX_PROXMOX_TOKEN_ID"); ok {
+		ep.TokenID = v
+	}
+	secret, _, ok, err := lookupEnv([]string{"DBX_PROXMOX_TOKEN_SECRET"}, true)
+	if err != nil {
+		return err
+	}
+	if ok {
+		ep.TokenSecret = secret
+	}
+	if v, ok := os.LookupEnv("DBX_PROXMOX_CA_FILE"); ok {
+		ep.CAFile = v
+	}
+	if v, ok := os.LookupEnv("DBX_PROXMOX_INSECURE_SKIP_VERIFY"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for DBX_PROXMOX_INSECURE_SKIP_VERIFY: %w", err)
+		}
+		ep.InsecureSkipVerify = b
+	}
+
+	if len(cfg.Proxmox.Endpoints) > 0 {
+		cfg.Proxmox.Endpoints[0] = ep
+	} else {
+		cfg.Proxmox.Endpoints = []ProxmoxEndpoint{ep}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// readSecretFile reads a secret, dropping the trailing newline most editors
+// and `echo` add.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,451 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// legacyJWTSecret is the literal the server used to sign tokens with before
+// it was configurable. Anyone who has read the source can forge it.
+const legacyJWTSecret = "your-secret-key-change-this"
+
+// minJWTSecretLen is the shortest accepted HS256 secret, in bytes.
+const minJWTSecretLen = 32
+
+// Validate reports every problem with the configuration at once. Outside of
+// --dev mode it also refuses insecure defaults, so a production server fails
+// at startup rather than running with guessable secrets.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		add("log.level must be one of debug, info, warn or error")
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		add("log.format must be json or text")
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		add("server.port must be between 1 and 65535")
+	}
+	if c.Server.BaseURL == "" {
+		add("server.base_url is required")
+	} else if err := checkURL(c.Server.BaseURL); err != nil {
+		add("server.base_url: %v", err)
+	}
+	if c.Server.ConsoleURL != "" {
+		if err := checkURL(c.Server.ConsoleURL); err != nil {
+			add("server.console_url: %v", err)
+		}
+	}
+
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		add("admin.port must be between 0 and 65535")
+	} else if c.Admin.Port == c.Server.Port {
+		add("admin.port must differ from server.port")
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		if c.Tracing.File == "" {
+			add("tracing.file is required when tracing.exporter is file")
+		}
+	case "otlp":
+		if err := checkURL(c.Tracing.OTLPEndpoint); err != nil {
+			add("tracing.otlp_endpoint: %v", err)
+		}
+	default:
+		add("tracing.exporter must be one of none, stdout, file or otlp")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+	}
+	for _, t := range timeouts {
+		if t.value <= 0 {
+			add("%s must be positive", t.name)
+		}
+	}
+	if c.Server.DrainPeriod < 0 {
+		add("server.drain_period must not be negative")
+	}
+
+	switch c.Database.Driver {
+	case "postgres":
+		if c.Database.URL == "" {
+			add("database.url is required")
+		} else if _, err := url.Parse(c.Database.URL); err != nil {
+			add("database.url is not a valid URL")
+		}
+	case "memory":
+	default:
+		add("database.driver must be postgres or memory")
+	}
+	if c.Database.MaxOpenConns < 0 {
+		add("database.max_open_conns must not be negative")
+	}
+	if c.Database.MaxIdleConns < 0 {
+		add("database.max_idle_conns must not be negative")
+	}
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		add("database.max_idle_conns must not exceed database.max_open_conns")
+	}
+	if c.Database.ConnMaxLifetime < 0 || c.Database.ConnMaxIdleTime < 0 {
+		add("database.conn_max_lifetime and conn_max_idle_time must not be negative")
+	}
+
+	if c.Worker.Concurrency < 1 {
+		add("worker.concurrency must be at least 1")
+	}
+	if c.Worker.PollInterval <= 0 || c.Worker.HeartbeatInterval <= 0 {
+		add("worker.poll_interval and heartbeat_interval must be positive")
+	}
+	if c.Worker.HeartbeatTimeout <= c.Worker.HeartbeatInterval {
+		add("worker.heartbeat_timeout must be longer than worker.heartbeat_interval")
+	}
+
+	if c.Auth.JWTSecret == "" {
+		add("auth.jwt_secret is required")
+	}
+
+	switch c.OpenAPI.Validation {
+	case "off", "requests", "strict":
+	default:
+		add("openapi.validation must be one of off, requests or strict")
+	}
+
+	if c.Proxmox.Template < 100 {
+		add("proxmox.template must be a container ID of at least 100")
+	}
+	versions := make([]int, 0, len(c.Proxmox.Templates))
+	for version := range c.Proxmox.Templates {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	for _, version := range versions {
+		if c.Proxmox.Templates[version] < 100 {
+			add("proxmox.templates[%d] must be a container ID of at least 100", version)
+		}
+	}
+	if c.Proxmox.Storage == "" {
+		add("proxmox.storage is required")
+	}
+	for i, ep := range c.Proxmox.Endpoints {
+		name := fmt.Sprintf("proxmox.endpoints[%d]", i)
+		if ep.Name == "" {
+			add("%s.name is required", name)
+		}
+		if err := checkURL(ep.URL); err != nil {
+			add("%s.url: %v", name, err)
+		}
+		if ep.TokenID == "" || ep.TokenSecret == "" {
+			add("%s.token_id and token_secret are required", name)
+		}
+	}
+
+	if err := checkURL(strings.NewReplacer("{address}", "127.0.0.1", "{vmid}", "100").Replace(c.Guest.URL)); err != nil {
+		add("guest.url: %v", err)
+	}
+	if len(c.Network.PrivateCIDRs) == 0 {
+		add("network.private_cidrs must list at least one network")
+	}
+	for _, list := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"network.private_cidrs", c.Network.PrivateCIDRs},
+		{"network.internal_cidrs", c.Network.InternalCIDRs},
+	} {
+		for _, cidr := range list.cidrs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				add("%s: %q is not a CIDR block", list.name, cidr)
+			}
+		}
+	}
+	privnet := c.Network.PrivateNetworks
+	if pool, err := netip.ParsePrefix(privnet.Pool); err != nil || !pool.Addr().Is4() {
+		add("network.private_networks.pool must be an IPv4 CIDR block")
+	} else if privnet.PrefixLength <= pool.Bits() || privnet.PrefixLength > 28 {
+		add("network.private_networks.prefix_length must be longer than the pool's and at most 28")
+	}
+	if privnet.Bridge == "" {
+		add("network.private_networks.bridge is required")
+	}
+	if privnet.VLANMin < 1 || privnet.VLANMax > 4094 || privnet.VLANMin > privnet.VLANMax {
+		add("network.private_networks.vlan_min and vlan_max must be a range within 1 to 4094")
+	}
+	if wg := c.Network.WireGuard; wg.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(wg.Endpoint); err != nil {
+			add("network.wireguard.endpoint must be host:port")
+		}
+		if key, err := base64.StdEncoding.DecodeString(wg.PublicKey); err != nil || len(key) != 32 {
+			add("network.wireguard.public_key must be a base64 WireGuard key")
+		}
+		if err := checkURL(wg.GatewayURL); err != nil {
+			add("network.wireguard.gateway_url: %v", err)
+		}
+	}
+	if !isDomainName(c.DNS.Zone) {
+		add("dns.zone must be a domain name, such as cust.db.xyz")
+	}
+	switch c.DNS.Provider {
+	case "none", "memory":
+	case "rfc2136":
+		rfc := c.DNS.RFC2136
+		// --dev runs a stand-in name server without one
+		if _, _, err := net.SplitHostPort(rfc.Server); err != nil && !(c.Dev && rfc.Server == "") {
+			add("dns.rfc2136.server must be host:port")
+		}
+		if rfc.KeyName != "" {
+			if !isDomainName(rfc.KeyName) {
+				add("dns.rfc2136.key_name must be a domain name")
+			}
+			if rfc.KeyAlgorithm != "hmac-sha256" && rfc.KeyAlgorithm != "hmac-sha512" {
+				add("dns.rfc2136.key_algorithm must be hmac-sha256 or hmac-sha512")
+			}
+			if key, err := base64.StdEncoding.DecodeString(rfc.KeySecret); err != nil || len(key) == 0 {
+				add("dns.rfc2136.key_secret must be a base64 TSIG key")
+			}
+		}
+		if rfc.Timeout <= 0 {
+			add("dns.rfc2136.timeout must be positive")
+		}
+	default:
+		add("dns.provider must be one of none, memory or rfc2136")
+	}
+	if c.DNS.TTL < time.Second || c.DNS.TTL%time.Second != 0 {
+		add("dns.ttl must be a whole number of seconds, at least 1s")
+	}
+	if len(c.DNS.Nameservers) == 0 {
+		add("dns.nameservers must list at least one server")
+	}
+	for _, ns := range c.DNS.Nameservers {
+		if !isDomainName(ns) {
+			add("dns.nameservers: %q is not a domain name", ns)
+		}
+	}
+	if c.DNS.ReconcileInterval < 0 {
+		add("dns.reconcile_interval must not be negative")
+	}
+	switch c.TLS.Issuer {
+	case "none":
+	case "internal":
+		ca := c.TLS.CA
+		// --dev generates a throwaway CA without them
+		if (ca.CertFile == "" || ca.KeyFile == "") && !(c.Dev && ca.CertFile == "" && ca.KeyFile == "") {
+			add("tls.ca.cert_file and key_file are required for the internal issuer")
+		}
+		if ca.Validity <= c.TLS.RenewBefore {
+			add("tls.ca.validity must be longer than tls.renew_before")
+		}
+	case "acme":
+		acme := c.TLS.ACME
+		// --dev runs a stand-in ACME server without one
+		if acme.DirectoryURL != "" || !c.Dev {
+			if err := checkURL(acme.DirectoryURL); err != nil {
+				add("tls.acme.directory_url: %v", err)
+			}
+		}
+		if c.DNS.Provider == "none" {
+			add("tls.issuer acme needs a dns.provider to answer dns-01 challenges")
+		}
+		if acme.Timeout <= 0 {
+			add("tls.acme.timeout must be positive")
+		}
+	default:
+		add("tls.issuer must be one of none, internal or acme")
+	}
+	if c.TLS.RenewBefore <= 0 {
+		add("tls.renew_before must be positive")
+	}
+	if c.Domains.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Domains.Resolver); err != nil {
+			add("domains.resolver must be host:port")
+		}
+	}
+	if c.Domains.CheckInterval <= 0 {
+		add("domains.check_interval must be positive")
+	}
+	if c.Domains.VerificationTimeout < c.Domains.CheckInterval {
+		add("domains.verification_timeout must be at least domains.check_interval")
+	}
+	if c.Domains.ProxyPort < 0 || c.Domains.ProxyPort > 65535 {
+		add("domains.proxy_port must be between 0 and 65535")
+	} else if c.Domains.ProxyPort != 0 && (c.Domains.ProxyPort == c.Server.Port || c.Domains.ProxyPort == c.Admin.Port) {
+		add("domains.proxy_port must differ from server.port and admin.port")
+	}
+	if c.Domains.ProxyPort != 0 && c.Domains.ProxyHost == "" {
+		add("domains.proxy_host is required with domains.proxy_port")
+	}
+	if c.Upgrades.RollbackWindow <= 0 {
+		add("upgrades.rollback_window must be positive")
+	}
+
+	switch c.Backups.Store {
+	case "local":
+		if c.Backups.Local.Path == "" {
+			add("backups.local.path is required when backups.store is local")
+		}
+	case "s3":
+		s3 := c.Backups.S3
+		if s3.Bucket == "" || s3.Region == "" {
+			add("backups.s3.bucket and region are required when backups.store is s3")
+		}
+		if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			add("backups.s3.access_key_id and secret_access_key are required when backups.store is s3")
+		}
+		if s3.Endpoint != "" {
+			if err := checkURL(s3.Endpoint); err != nil {
+				add("backups.s3.endpoint: %v", err)
+			}
+		}
+	default:
+		add("backups.store must be local or s3")
+	}
+	if c.Backups.SchedulerInterval <= 0 {
+		add("backups.scheduler_interval must be positive")
+	}
+	if c.Backups.RetentionDays < 1 {
+		add("backups.retention_days must be at least 1")
+	}
+	if c.Backups.WALArchiveInterval < 0 {
+		add("backups.wal_archive_interval must not be negative")
+	}
+
+	if c.Mailer.Host != "" {
+		if c.Mailer.Port < 1 || c.Mailer.Port > 65535 {
+			add("mailer.port must be between 1 and 65535")
+		}
+		if c.Mailer.From == "" {
+			add("mailer.from is required when mailer.host is set")
+		}
+	}
+
+	quotas := []struct {
+		name   string
+		limits QuotaLimits
+	}{
+		{"quotas.org", c.Quotas.Org},
+		{"quotas.project", c.Quotas.Project},
+	}
+	for _, q := range quotas {
+		l := q.limits
+		if l.Instances < 0 || l.VCPUs < 0 || l.MemoryMB < 0 || l.DiskGiB < 0 {
+			add("%s limits must not be negative", q.name)
+		}
+	}
+
+	if !c.Dev {
+		errs = append(errs, c.insecureDefaults()...)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (c *Config) insecureDefaults() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format+" (use --dev for local development)", args...))
+	}
+
+	if c.Database.Driver == "memory" {
+		add("database.driver memory loses all data when the server stops")
+	} else if c.Database.URL == DefaultDatabaseURL {
+		add("database.url is the built-in development default")
+	}
+
+	for _, secret := range append([]string{c.Auth.JWTSecret}, c.Auth.JWTPreviousSecrets...) {
+		switch {
+		case secret == legacyJWTSecret || secret == DevJWTSecret:
+			add("auth.jwt_secret uses a well-known development value")
+		case secret != "" && len(secret) < minJWTSecretLen:
+			add("auth.jwt_secret must be at least %d bytes", minJWTSecretLen)
+		}
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			add("cors.allowed_origins must not contain \"*\"")
+		}
+	}
+
+	if c.DNS.Provider == "memory" {
+		add("dns.provider memory publishes records nowhere outside this process")
+	}
+	if c.DNS.Provider == "rfc2136" && c.DNS.RFC2136.KeyName == "" {
+		add("dns.rfc2136.key_name is empty, so updates are unsigned")
+	}
+	if c.TLS.Issuer == "acme" && strings.HasPrefix(c.TLS.ACME.DirectoryURL, "http://") {
+		add("tls.acme.directory_url must use https")
+	}
+
+	for i, ep := range c.Proxmox.Endpoints {
+		if ep.InsecureSkipVerify {
+			add("proxmox.endpoints[%d].insecure_skip_verify disables TLS verification", i)
+		}
+		if strings.HasPrefix(ep.URL, "http://") {
+			add("proxmox.endpoints[%d].url must use https", i)
+		}
+	}
+
+	return errs
+}
+
+// isDomainName reports whether name is a domain name of letters, digits
+// and hyphens, without the trailing dot.
+func isDomainName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an absolute http(s) URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("must include a host")
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Package cron parses the five-field cron expressions backup policies are
+// scheduled with: minute, hour, day of month, month and day of week. Fields
+// take *, numbers, ranges (1-5), steps (*/15, 0-30/10) and lists of those;
+// months and days of the week also take names (JAN, MON). The macros
+// @yearly, @monthly, @weekly, @daily and @hourly are accepted too. As in
+// Vixie cron, when both the day of month and the day of week are
+// restricted, a day matching either runs.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a * day field, which doesn't restrict days
+	domAny, dowAny bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is Sunday too
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := macros[strings.ToLower(expr)]; ok {
+		expr = m
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression must have %d fields, got %d", len(fields), len(parts))
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		b, err := fields[i].parse(part)
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	// Fold Sunday as 7 into 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	s := &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}
+	if s.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return s, nil
+}
+
+func (f field) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepStr, f.name)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		switch {
+		case rng == "*":
+			lo, hi = f.min, f.max
+			if f.max == 7 {
+				hi = 6
+			}
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(a); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(b); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q in %s field", rng, f.name)
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			// 5/15 means from 5 to the end, every 15
+			if hasStep {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field, must be %d-%d", s, f.name, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first time after t the schedule matches, in UTC.
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.next(t.UTC())
+}
+
+// next searches up to five years ahead, enough for February 29, and
+// returns the zero time if nothing matches.
+func (s *Schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
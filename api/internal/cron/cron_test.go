@@ -0,0 +1,111 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/cron"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04 Mon", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want []string
+	}{
+		// Steps
+		{"*/15 * * * *", "2024-05-01 12:07 Wed", []string{"2024-05-01 12:15 Wed", "2024-05-01 12:30 Wed", "2024-05-01 12:45 Wed", "2024-05-01 13:00 Wed"}},
+		{"0-30/10 * * * *", "2024-05-01 12:25 Wed", []string{"2024-05-01 12:30 Wed", "2024-05-01 13:00 Wed", "2024-05-01 13:10 Wed"}},
+		{"5/20 * * * *", "2024-05-01 12:00 Wed", []string{"2024-05-01 12:05 Wed", "2024-05-01 12:25 Wed", "2024-05-01 12:45 Wed", "2024-05-01 13:05 Wed"}},
+		{"0 */6 * * *", "2024-05-01 12:00 Wed", []string{"2024-05-01 18:00 Wed", "2024-05-02 00:00 Thu"}},
+
+		// Ranges and lists
+		{"30 9-11 * * *", "2024-05-01 10:30 Wed", []string{"2024-05-01 11:30 Wed", "2024-05-02 09:30 Thu"}},
+		{"0 3,15 * * *", "2024-05-01 03:00 Wed", []string{"2024-05-01 15:00 Wed", "2024-05-02 03:00 Thu"}},
+		{"0 0 1 jan-mar *", "2024-02-15 00:00 Thu", []string{"2024-03-01 00:00 Fri", "2025-01-01 00:00 Wed"}},
+
+		// Days of the week
+		{"0 9 * * MON-FRI", "2024-05-03 09:00 Fri", []string{"2024-05-06 09:00 Mon", "2024-05-07 09:00 Tue"}},
+		{"0 0 * * 7", "2024-05-01 00:00 Wed", []string{"2024-05-05 00:00 Sun", "2024-05-12 00:00 Sun"}},
+		{"0 0 * * 0", "2024-05-01 00:00 Wed", []string{"2024-05-05 00:00 Sun"}},
+		{"0 0 * * 5-7", "2024-05-01 00:00 Wed", []string{"2024-05-03 00:00 Fri", "2024-05-04 00:00 Sat", "2024-05-05 00:00 Sun", "2024-05-10 00:00 Fri"}},
+
+		// Days of the month
+		{"0 0 31 * *", "2024-01-31 00:00 Wed", []string{"2024-03-31 00:00 Sun", "2024-05-31 00:00 Fri"}},
+		{"0 0 29 2 *", "2024-03-01 00:00 Fri", []string{"2028-02-29 00:00 Tue"}},
+
+		// Both day fields restricted: either matches
+		{"0 0 13 * FRI", "2024-09-01 00:00 Sun", []string{"2024-09-06 00:00 Fri", "2024-09-13 00:00 Fri", "2024-09-20 00:00 Fri", "2024-09-27 00:00 Fri", "2024-10-04 00:00 Fri", "2024-10-11 00:00 Fri", "2024-10-13 00:00 Sun"}},
+		// A day of month with a * day of week is restricted by the former only
+		{"0 0 1 * *", "2024-05-01 00:00 Wed", []string{"2024-06-01 00:00 Sat"}},
+		// */2 is an unrestricted day of month, as in Vixie cron
+		{"0 0 */2 * MON", "2024-05-01 00:00 Wed", []string{"2024-05-06 00:00 Mon", "2024-05-13 00:00 Mon"}},
+
+		// Macros
+		{"@hourly", "2024-05-01 12:00 Wed", []string{"2024-05-01 13:00 Wed"}},
+		{"@daily", "2024-05-01 12:00 Wed", []string{"2024-05-02 00:00 Thu"}},
+		{"@weekly", "2024-05-01 12:00 Wed", []string{"2024-05-05 00:00 Sun"}},
+		{"@monthly", "2024-05-01 12:00 Wed", []string{"2024-06-01 00:00 Sat"}},
+		{"@yearly", "2024-05-01 12:00 Wed", []string{"2025-01-01 00:00 Wed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := cron.Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := date(tt.from)
+			for _, want := range tt.want {
+				at = s.Next(at)
+				if !at.Equal(date(want)) {
+					t.Fatalf("Next = %s, want %s", at.Format("2006-01-02 15:04 Mon"), want)
+				}
+			}
+		})
+	}
+}
+
+func TestNextUTC(t *testing.T) {
+	s, err := cron.Parse("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("UTC-5", -5*60*60)
+	got := s.Next(time.Date(2024, 5, 1, 23, 30, 0, 0, zone))
+	if want := date("2024-05-03 03:00 Fri"); !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("Next = %s, want %s", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"30-10 * * * *",
+		"* * * foo *",
+		"@every 5m",
+		// February 30 never comes
+		"0 0 30 2 *",
+	} {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Errorf("Parse(%q) accepted an invalid expression", expr)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package customdomain checks the custom domains orgs point at their
+// instances. An org proves it controls a domain with a TXT record at
+// _dbx-challenge.<domain> holding a token the API issued, looked up
+// through a configurable resolver. The domain itself is pointed with a
+// CNAME record at the Proxy, which routes connections for verified domains
+// to their instance by TLS server name, or else at the instance's FQDN.
+package customdomain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/dns"
+)
+
+const (
+	// challengePrefix names the ownership record of a domain.
+	challengePrefix = "_dbx-challenge."
+	// tokenPrefix starts the value of ownership records, so they read as
+	// ours among the other TXT records of a name.
+	tokenPrefix = "dbx-verification="
+	// MaxPerInstance bounds the domains of an instance, which all go into
+	// its certificate.
+	MaxPerInstance = 20
+	// lookupTimeout bounds one lookup of an ownership record.
+	lookupTimeout = 10 * time.Second
+)
+
+// Normalize returns name lowercased and without a trailing dot, or an error
+// saying why it can't be a custom domain: it must be a hostname of at least
+// two labels, and not a name in zone, the instance zone, whose names belong
+// to the control plane.
+func Normalize(name, zone string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if _, err := netip.ParseAddr(name); err == nil {
+		return "", errors.New("must be a domain name, not an address")
+	}
+	if len(name) > 253-len(challengePrefix) {
+		return "", errors.New("is too long")
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", errors.New("must have at least two labels, such as db.example.com")
+	}
+	for _, label := range labels {
+		if !isLabel(label) {
+			return "", fmt.Errorf("has an invalid label %q", label)
+		}
+	}
+	if dns.InZone(zone, name) {
+		return "", fmt.Errorf("is in %s, where instances are already named", zone)
+	}
+	return name, nil
+}
+
+func isLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, r := range label {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ChallengeName returns the name of the ownership record of domain.
+func ChallengeName(domain string) string {
+	return challengePrefix + domain
+}
+
+// NewToken returns a random value for an ownership record.
+func NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(b), nil
+}
+
+// Verifier looks up ownership records.
+type Verifier struct {
+	resolver *net.Resolver
+}
+
+// NewVerifier returns a verifier resolving through the name server at
+// resolver, a host:port, or through the resolver of the system if it is
+// empty.
+func NewVerifier(resolver string) *Verifier {
+	return &Verifier{resolver: dns.NewResolver(resolver)}
+}
+
+// Check returns nil if the ownership record of domain holds token, and
+// otherwise an error saying what was found instead.
+func (v *Verifier) Check(ctx context.Context, domain, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	name := ChallengeName(domain)
+	values, err := v.resolver.LookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return fmt.Errorf("no TXT record found at %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	for _, value := range values {
+		if strings.TrimSpace(value) == token {
+			return nil
+		}
+	}
+	return fmt.Errorf("the TXT records at %s don't hold the verification value", name)
+}
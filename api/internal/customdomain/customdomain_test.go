@@ -0,0 +1,134 @@
+package customdomain_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/dns"
+)
+
+// newStandIn starts a stand-in name server, which holds the records of the
+// domains of the tests as their owners' name servers would.
+func newStandIn(t *testing.T) *dns.Server {
+	t.Helper()
+	srv, err := dns.NewServer("cust.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func newToken(t *testing.T) string {
+	t.Helper()
+	token, err := customdomain.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCheck(t *testing.T) {
+	srv := newStandIn(t)
+	verifier := customdomain.NewVerifier(srv.Addr())
+	ctx := context.Background()
+	token := newToken(t)
+
+	tests := []struct {
+		name    string
+		records func()
+		wantErr string
+	}{
+		{
+			name:    "missing record",
+			records: func() {},
+			wantErr: "no TXT record found at _dbx-challenge.db.example.com",
+		},
+		{
+			name:    "wrong token",
+			records: func() { srv.SetTXT("_dbx-challenge.db.example.com", newToken(t)) },
+			wantErr: "don't hold the verification value",
+		},
+		{
+			name:    "token of another domain",
+			records: func() { srv.SetTXT("_dbx-challenge.other.example.com", token) },
+			wantErr: "no TXT record found",
+		},
+		{
+			name:    "success",
+			records: func() { srv.SetTXT("_dbx-challenge.db.example.com", token) },
+		},
+		{
+			name: "success among other records",
+			records: func() {
+				srv.SetTXT("_dbx-challenge.db.example.com", "v=spf1 -all", " "+token+" ", newToken(t))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.SetTXT("_dbx-challenge.db.example.com")
+			srv.SetTXT("_dbx-challenge.other.example.com")
+			tt.records()
+
+			err := verifier.Check(ctx, "db.example.com", token)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Check = %v, want success", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Check = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCheckDelegated checks a domain whose ownership record is a CNAME to
+// a record elsewhere, as a domain delegating its verification would.
+func TestCheckDelegated(t *testing.T) {
+	srv := newStandIn(t)
+	token := newToken(t)
+	if err := srv.SetCNAME("_dbx-challenge.db.example.com", "verify.dns-host.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetTXT("verify.dns-host.example.net", token)
+
+	if err := customdomain.NewVerifier(srv.Addr()).Check(context.Background(), "db.example.com", token); err != nil {
+		t.Errorf("Check = %v", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "db.example.com", want: "db.example.com"},
+		{in: " DB.Example.COM. ", want: "db.example.com"},
+		{in: "a-b.c1.example.com", want: "a-b.c1.example.com"},
+		{in: "localhost", wantErr: true},
+		{in: "203.0.113.7", wantErr: true},
+		{in: "::1", wantErr: true},
+		{in: "-db.example.com", wantErr: true},
+		{in: "db-.example.com", wantErr: true},
+		{in: "db..example.com", wantErr: true},
+		{in: "db_1.example.com", wantErr: true},
+		{in: "*.example.com", wantErr: true},
+		{in: strings.Repeat("a", 64) + ".example.com", wantErr: true},
+		{in: strings.Repeat("a.", 120) + "example.com", wantErr: true},
+		// The instance zone belongs to the control plane
+		{in: "cust.example.com", wantErr: true},
+		{in: "pg-1234abcd.cust.example.com", wantErr: true},
+		{in: "mycust.example.com", want: "mycust.example.com"},
+	}
+	for _, tt := range tests {
+		got, err := customdomain.Normalize(tt.in, "cust.example.com")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Normalize(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
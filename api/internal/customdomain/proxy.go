@@ -0,0 +1,300 @@
+package customdomain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sslRequestCode and gssEncRequestCode are the codes of the messages
+	// a Postgres client asks for TLS and GSSAPI encryption with, in place of
+	// a protocol version.
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	// requestLength is the length of both requests.
+	requestLength = 8
+	// tlsHandshake is the first byte of a TLS record carrying a handshake
+	// message, which clients connecting with sslnegotiation=direct start
+	// with.
+	tlsHandshake = 0x16
+	// handshakeTimeout bounds how long a client has to send its
+	// ClientHello, and dialTimeout how long the instance has to answer.
+	handshakeTimeout = 10 * time.Second
+	dialTimeout      = 10 * time.Second
+)
+
+var (
+	// ErrNoRoute is returned by Router.Route for names that aren't the
+	// verified domain of an instance.
+	ErrNoRoute = errors.New("no instance for the name")
+	// ErrForbidden is returned by Router.Route for clients the network
+	// policy of the instance doesn't let in.
+	ErrForbidden = errors.New("the network policy of the instance does not let the client in")
+)
+
+// Router finds the instance serving a custom domain.
+type Router interface {
+	// Route returns the host:port of the Postgres server of the instance
+	// name is a verified domain of, if client may connect to it.
+	Route(ctx context.Context, name string, client netip.Addr) (string, error)
+}
+
+// Proxy routes Postgres connections to the instances whose verified
+// domains they are for, by the server name their TLS ClientHello carries.
+// It answers the SSLRequest clients start with, reads the ClientHello and
+// replays both to the instance, then passes bytes both ways: TLS is
+// between the client and the instance, whose certificate holds the
+// domain. Clients connecting with sslnegotiation=direct skip the
+// SSLRequest; those that don't ask for TLS are turned away, since without
+// it there is no name to route by.
+type Proxy struct {
+	router Router
+	logger *slog.Logger
+	dialer net.Dialer
+
+	wg sync.WaitGroup
+}
+
+// NewProxy returns a proxy routing connections with router.
+func NewProxy(router Router) *Proxy {
+	return &Proxy{
+		router: router,
+		logger: slog.Default().With("component", "domain_proxy"),
+		dialer: net.Dialer{Timeout: dialTimeout},
+	}
+}
+
+// Serve accepts connections on ln until ctx is cancelled, then closes ln
+// and the connections in progress.
+func (p *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	defer p.wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer conn.Close()
+			p.handle(ctx, conn)
+		}()
+	}
+}
+
+func (p *Proxy) handle(ctx context.Context, conn net.Conn) {
+	logger := p.logger.With("client", conn.RemoteAddr().String())
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	in := bufio.NewReader(conn)
+
+	sslRequest, err := negotiate(conn, in)
+	if err != nil {
+		logger.Debug("connection refused", "error", err)
+		return
+	}
+	var hello bytes.Buffer
+	name, err := serverName(io.TeeReader(in, &hello))
+	if err != nil {
+		logger.Debug("no server name", "error", err)
+		return
+	}
+	logger = logger.With("server_name", name)
+
+	client, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		logger.Warn("unknown client address", "error", err)
+		return
+	}
+	addr, err := p.router.Route(ctx, name, client.Addr())
+	if err != nil {
+		logger.Info("connection refused", "error", err)
+		return
+	}
+
+	backend, err := p.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		logger.Warn("failed to connect to instance", "address", addr, "error", err)
+		return
+	}
+	defer backend.Close()
+	backend.SetDeadline(time.Now().Add(handshakeTimeout))
+	if sslRequest {
+		if err := requestSSL(backend); err != nil {
+			logger.Warn("instance refused TLS", "address", addr, "error", err)
+			return
+		}
+	}
+	if _, err := backend.Write(hello.Bytes()); err != nil {
+		logger.Warn("failed to pass on ClientHello", "address", addr, "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	backend.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		backend.Close()
+	})
+	defer stop()
+
+	logger.Debug("routing connection", "address", addr)
+	splice(conn, in, backend)
+}
+
+// negotiate reads the messages a client sends before its ClientHello,
+// answering them, and reports whether it asked for TLS with an
+// SSLRequest, or else went straight to TLS. Clients not asking for TLS
+// are sent an error.
+func negotiate(conn net.Conn, in *bufio.Reader) (sslRequest bool, err error) {
+	for {
+		first, err := in.Peek(1)
+		if err != nil {
+			return false, err
+		}
+		if first[0] == tlsHandshake {
+			return false, nil
+		}
+
+		var header [8]byte
+		if _, err := io.ReadFull(in, header[:4]); err != nil {
+			return false, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length != requestLength {
+			// A startup message, or something else entirely
+			writeError(conn, "connections to custom domains must use TLS, such as with sslmode=require")
+			return false, fmt.Errorf("message of %d bytes instead of an SSLRequest", length)
+		}
+		if _, err := io.ReadFull(in, header[4:]); err != nil {
+			return false, err
+		}
+		switch binary.BigEndian.Uint32(header[4:]) {
+		case sslRequestCode:
+			_, err := conn.Write([]byte{'S'})
+			return true, err
+		case gssEncRequestCode:
+			// The client then asks for TLS or gives up
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return false, err
+			}
+		default:
+			writeError(conn, "connections to custom domains must use TLS, such as with sslmode=require")
+			return false, errors.New("unknown request code")
+		}
+	}
+}
+
+// writeError sends a Postgres ErrorResponse with msg, the way servers
+// refuse connections before authentication.
+func writeError(w io.Writer, msg string) {
+	var body bytes.Buffer
+	for _, field := range []struct {
+		code  byte
+		value string
+	}{{'S', "FATAL"}, {'V', "FATAL"}, {'C', "08004"}, {'M', msg}} {
+		body.WriteByte(field.code)
+		body.WriteString(field.value)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+	var header [5]byte
+	header[0] = 'E'
+	binary.BigEndian.PutUint32(header[1:], uint32(body.Len()+4))
+	w.Write(append(header[:], body.Bytes()...))
+}
+
+// errHelloRead stops the handshake serverName starts once the ClientHello
+// has been read.
+var errHelloRead = errors.New("ClientHello read")
+
+// serverName reads a ClientHello from r and returns the server name it
+// carries, lowercased.
+func serverName(r io.Reader) (string, error) {
+	var name string
+	err := tls.Server(helloConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", err
+	}
+	if name == "" {
+		return "", errors.New("the ClientHello has no server name")
+	}
+	return strings.TrimSuffix(strings.ToLower(name), "."), nil
+}
+
+// requestSSL sends an SSLRequest to a Postgres server and reads its
+// answer.
+func requestSSL(conn net.Conn) error {
+	var msg [8]byte
+	binary.BigEndian.PutUint32(msg[:4], requestLength)
+	binary.BigEndian.PutUint32(msg[4:], sslRequestCode)
+	if _, err := conn.Write(msg[:]); err != nil {
+		return err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		return err
+	}
+	if answer[0] != 'S' {
+		return fmt.Errorf("answered %q to an SSLRequest", answer[0])
+	}
+	return nil
+}
+
+// splice copies from in, reading client, to backend and from backend to
+// client until both directions are done.
+func splice(client net.Conn, in io.Reader, backend net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backend, in)
+		closeWrite(backend)
+		close(done)
+	}()
+	io.Copy(client, backend)
+	closeWrite(client)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// helloConn is a connection serverName hands crypto/tls, reading from r
+// and dropping what the handshake writes.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
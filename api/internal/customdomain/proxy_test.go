@@ -0,0 +1,320 @@
+package customdomain_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+const (
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// certificate returns a self-signed certificate for names, and a pool
+// trusting it.
+func certificate(t *testing.T, names ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// bufferedConn reads a connection through a bufio.Reader that may hold
+// bytes already.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// instance stands in for the Postgres server of an instance: it answers
+// an SSLRequest, or takes TLS straight away, then echoes lines back over
+// TLS. It counts the SSLRequests it gets.
+type instance struct {
+	ln          net.Listener
+	sslRequests atomic.Int32
+}
+
+func newInstance(t *testing.T, cert tls.Certificate) *instance {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	inst := &instance{ln: ln}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"postgresql"}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go inst.serve(conn, cfg)
+		}
+	}()
+	return inst
+}
+
+func (inst *instance) serve(conn net.Conn, cfg *tls.Config) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != 0x16 {
+		var msg [8]byte
+		if _, err := io.ReadFull(r, msg[:]); err != nil || binary.BigEndian.Uint32(msg[4:]) != sslRequestCode {
+			return
+		}
+		inst.sslRequests.Add(1)
+		conn.Write([]byte{'S'})
+	}
+	tlsConn := tls.Server(bufferedConn{conn, r}, cfg)
+	lines := bufio.NewScanner(tlsConn)
+	for lines.Scan() {
+		io.WriteString(tlsConn, "echo "+lines.Text()+"\n")
+	}
+}
+
+// routes is a Router of names to addresses.
+type routes map[string]string
+
+func (r routes) Route(ctx context.Context, name string, client netip.Addr) (string, error) {
+	if addr, ok := r[name]; ok {
+		return addr, nil
+	}
+	return "", customdomain.ErrNoRoute
+}
+
+func startProxy(t *testing.T, router customdomain.Router) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		customdomain.NewProxy(router).Serve(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+func request(code uint32) []byte {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg, 8)
+	binary.BigEndian.PutUint32(msg[4:], code)
+	return msg
+}
+
+// connect connects to the proxy as a Postgres client would with
+// sslnegotiation=postgres, or direct, and with the GSSAPI encryption
+// request of gssencmode=prefer first if gss is set.
+func connect(t *testing.T, addr string, cfg *tls.Config, direct, gss bool) (*tls.Conn, error) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if gss {
+		conn.Write(request(gssEncRequestCode))
+		var answer [1]byte
+		if _, err := io.ReadFull(conn, answer[:]); err != nil || answer[0] != 'N' {
+			t.Fatalf("GSSENCRequest answered %q, %v", answer[0], err)
+		}
+	}
+	if !direct {
+		conn.Write(request(sslRequestCode))
+		var answer [1]byte
+		if _, err := io.ReadFull(conn, answer[:]); err != nil || answer[0] != 'S' {
+			t.Fatalf("SSLRequest answered %q, %v", answer[0], err)
+		}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	return tlsConn, tlsConn.Handshake()
+}
+
+func TestProxy(t *testing.T) {
+	cert, pool := certificate(t, "pg-1234abcd.cust.example.com", "db.example.com")
+	inst := newInstance(t, cert)
+	addr := startProxy(t, routes{"db.example.com": inst.ln.Addr().String()})
+
+	tests := []struct {
+		name         string
+		direct, gss  bool
+		serverName   string
+		sslRequested int32
+	}{
+		{name: "SSLRequest", serverName: "db.example.com", sslRequested: 1},
+		{name: "GSSENCRequest first", gss: true, serverName: "db.example.com", sslRequested: 1},
+		{name: "direct TLS", direct: true, serverName: "db.example.com"},
+		{name: "name in capitals", serverName: "DB.Example.com", sslRequested: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := inst.sslRequests.Load()
+			cfg := &tls.Config{ServerName: tt.serverName, RootCAs: pool}
+			if tt.direct {
+				cfg.NextProtos = []string{"postgresql"}
+			}
+			conn, err := connect(t, addr, cfg, tt.direct, tt.gss)
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			io.WriteString(conn, "SELECT 1\n")
+			reply, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || reply != "echo SELECT 1\n" {
+				t.Errorf("reply = %q, %v", reply, err)
+			}
+			if got := inst.sslRequests.Load() - before; got != tt.sslRequested {
+				t.Errorf("instance got %d SSLRequests, want %d", got, tt.sslRequested)
+			}
+		})
+	}
+}
+
+func TestProxyRefuses(t *testing.T) {
+	cert, pool := certificate(t, "db.example.com")
+	inst := newInstance(t, cert)
+	addr := startProxy(t, routes{"db.example.com": inst.ln.Addr().String()})
+
+	// A name that isn't routed
+	if _, err := connect(t, addr, &tls.Config{ServerName: "other.example.com", RootCAs: pool}, false, false); err == nil {
+		t.Error("handshake for an unrouted name succeeded")
+	}
+	// No name at all
+	if _, err := connect(t, addr, &tls.Config{InsecureSkipVerify: true}, false, false); err == nil {
+		t.Error("handshake without a server name succeeded")
+	}
+
+	// A client not asking for TLS is told to
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	startup := []byte("\x00\x00\x00\x00\x00\x03\x00\x00user\x00postgres\x00\x00")
+	binary.BigEndian.PutUint32(startup, uint32(len(startup)))
+	conn.Write(startup)
+	reply, _ := io.ReadAll(conn)
+	if len(reply) == 0 || reply[0] != 'E' || !strings.Contains(string(reply), "must use TLS") {
+		t.Errorf("reply to a startup message = %q, want an ErrorResponse", reply)
+	}
+	if got := inst.sslRequests.Load(); got != 0 {
+		t.Errorf("refused connections reached the instance %d times", got)
+	}
+}
+
+func TestStoreRouter(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	org := &models.Org{Name: "acme"}
+	if err := st.Orgs().Create(ctx, org); err != nil {
+		t.Fatal(err)
+	}
+	project := &models.Project{OrgID: org.ID, Name: "default"}
+	if err := st.Projects().Create(ctx, project); err != nil {
+		t.Fatal(err)
+	}
+	inst := &models.Instance{ProjectID: project.ID, Name: "main", Plan: "nano", PgVersion: 16, Status: models.InstanceRunning}
+	if err := st.Instances().Create(ctx, inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DNSRecords().Put(ctx, &models.DNSRecord{Name: "pg-1234abcd.cust.example.com", Type: "A", Value: "10.20.0.5", TTL: 60, InstanceID: inst.ID}); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*models.Domain{
+		{InstanceID: inst.ID, Name: "db.example.com", Status: models.DomainVerified},
+		{InstanceID: inst.ID, Name: "pending.example.com"},
+	} {
+		if err := st.Domains().Create(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := customdomain.NewStoreRouter(st, netpolicy.NewCompiler(config.NetworkConfig{InternalCIDRs: []string{"10.10.0.0/16"}}))
+	client := netip.MustParseAddr("198.51.100.7")
+	if addr, err := router.Route(ctx, "db.example.com", client); err != nil || addr != "10.20.0.5:5432" {
+		t.Errorf("Route = %q, %v", addr, err)
+	}
+	for _, name := range []string{"pending.example.com", "other.example.com"} {
+		if _, err := router.Route(ctx, name, client); err != customdomain.ErrNoRoute {
+			t.Errorf("Route(%s) = %v, want ErrNoRoute", name, err)
+		}
+	}
+
+	// An allow-list applies to clients of the proxy, as the firewall
+	// would apply it to clients connecting straight to the instance
+	policy := &models.NetworkPolicy{InstanceID: inst.ID, Exposure: models.ExposurePublic, AllowedCIDRs: []string{"203.0.113.0/24"}}
+	if err := st.NetworkPolicies().Put(ctx, policy); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		want   error
+	}{
+		{"198.51.100.7", customdomain.ErrForbidden},
+		{"203.0.113.9", nil},
+		{"::ffff:203.0.113.9", nil},
+		{"10.10.3.4", nil},
+	}
+	for _, tt := range tests {
+		if _, err := router.Route(ctx, "db.example.com", netip.MustParseAddr(tt.client)); err != tt.want {
+			t.Errorf("Route from %s = %v, want %v", tt.client, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package customdomain
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// StoreRouter routes verified domains to the address in the DNS record of
+// their instance, checking clients against the instance's network policy.
+// The instance's firewall only sees the proxy, which is on an internal
+// network.
+type StoreRouter struct {
+	store   store.Store
+	network *netpolicy.Compiler
+}
+
+func NewStoreRouter(st store.Store, network *netpolicy.Compiler) *StoreRouter {
+	return &StoreRouter{store: st, network: network}
+}
+
+func (r *StoreRouter) Route(ctx context.Context, name string, client netip.Addr) (string, error) {
+	domain, err := r.store.Domains().GetVerified(ctx, name)
+	if err == store.ErrNotFound {
+		return "", ErrNoRoute
+	}
+	if err != nil {
+		return "", err
+	}
+	record, err := r.store.DNSRecords().GetByInstance(ctx, domain.InstanceID)
+	if err == store.ErrNotFound {
+		return "", ErrNoRoute
+	}
+	if err != nil {
+		return "", err
+	}
+
+	policy, err := r.store.NetworkPolicies().GetByInstance(ctx, domain.InstanceID)
+	if err == store.ErrNotFound {
+		inst, err := r.store.Instances().Get(ctx, domain.InstanceID)
+		if err != nil {
+			return "", err
+		}
+		policy = netpolicy.Default(inst)
+	} else if err != nil {
+		return "", err
+	}
+	// Clients of the proxy aren't on the private network of the org, so
+	// only the allow-list and the internal networks let them in
+	if !r.network.Allows(policy, netip.Prefix{}, client) {
+		return "", ErrForbidden
+	}
+	return net.JoinHostPort(record.Value, strconv.Itoa(netpolicy.Port)), nil
+}
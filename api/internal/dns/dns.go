@@ -0,0 +1,120 @@
+// Package dns names instances in the instance zone and publishes their
+// records through a Provider: RFC2136 sends dynamic updates to the zone's
+// primary server and Memory keeps the records in process. Each instance
+// gets one A or AAAA record, pg-<first 8 characters of its ID>, pointing at
+// its container. Snapshot renders the records the control plane holds as a
+// zone file, to check a provider against or to load into a name server.
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/zallarak/db/api/internal/config"
+)
+
+// hostPrefix starts the name of every instance, which tells the records of
+// instances apart from others in the zone.
+const hostPrefix = "pg-"
+
+// Record is an A or AAAA record. Name is fully qualified, without the
+// trailing dot, and TTL is in seconds.
+type Record struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   int    `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// Provider publishes the records of the instance zone.
+type Provider interface {
+	// Upsert replaces the A and AAAA records of record.Name with record.
+	Upsert(ctx context.Context, record Record) error
+	// Delete removes the A and AAAA records of name. A name without
+	// records is not an error.
+	Delete(ctx context.Context, name string) error
+	// Records returns the A and AAAA records of the zone, by name.
+	Records(ctx context.Context) ([]Record, error)
+	// SetTXT replaces the TXT records of name with one holding each of
+	// values, or removes them if there are none. ACME challenges are
+	// answered with them.
+	SetTXT(ctx context.Context, name string, values []string, ttl int) error
+}
+
+// New returns the provider cfg configures, or nil for none.
+func New(cfg config.DNSConfig) (Provider, error) {
+	switch cfg.Provider {
+	case "none":
+		return nil, nil
+	case "memory":
+		return NewMemory(), nil
+	case "rfc2136":
+		return NewRFC2136(cfg.Zone, cfg.RFC2136)
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", cfg.Provider)
+	}
+}
+
+// Hostname returns the name of the instance with id, and of its
+// containers.
+func Hostname(instanceID string) string {
+	return hostPrefix + instanceID[:8]
+}
+
+// FQDN returns the name of the instance with id in zone, in lowercase as
+// providers return names.
+func FQDN(zone, instanceID string) string {
+	return Hostname(instanceID) + "." + strings.ToLower(zone)
+}
+
+// Managed reports whether name is one FQDN could return for zone, so its
+// records belong to the control plane. Other records of the zone are left
+// alone.
+func Managed(zone, name string) bool {
+	host, ok := strings.CutSuffix(strings.ToLower(name), "."+strings.ToLower(zone))
+	return ok && strings.HasPrefix(host, hostPrefix) && !strings.Contains(host, ".")
+}
+
+// InZone reports whether name is zone or a name below it.
+func InZone(zone, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// NewResolver returns a resolver querying the name server at addr, a
+// host:port, or the resolver of the system if addr is empty.
+func NewResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// AddressRecord returns the A or AAAA record pointing name at addr.
+func AddressRecord(name, addr string, ttl int) (Record, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	ip = ip.Unmap()
+	rrtype := "A"
+	if ip.Is6() {
+		rrtype = "AAAA"
+	}
+	return Record{Name: name, Type: rrtype, TTL: ttl, Value: ip.String()}, nil
+}
+
+func sortRecords(records []Record) {
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+}
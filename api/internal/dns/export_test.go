@@ -0,0 +1,23 @@
+package dns
+
+import "time"
+
+var NewTSIGKey = newTSIGKey
+
+// SignTSIG signs msg with k as the provider would at now, returning the
+// signed message and its MAC.
+func SignTSIG(k *tsigKey, msg []byte, now time.Time) ([]byte, []byte) {
+	return k.sign(msg, now)
+}
+
+// VerifyTSIG checks msgs, the responses to a request signed with
+// requestMAC, as the provider would at now.
+func VerifyTSIG(k *tsigKey, requestMAC []byte, msgs [][]byte, now time.Time) error {
+	v := k.verifier(requestMAC)
+	for i, msg := range msgs {
+		if err := v.verify(msg, i == len(msgs)-1, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
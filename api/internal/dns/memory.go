@@ -0,0 +1,63 @@
+package dns
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Memory keeps records in process memory, for `server --dev` and for
+// checking reconciliation without a name server.
+type Memory struct {
+	mu      sync.Mutex
+	records map[string]Record
+	txt     map[string][]string
+}
+
+var _ Provider = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{records: make(map[string]Record), txt: make(map[string][]string)}
+}
+
+func (m *Memory) Upsert(ctx context.Context, record Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record.Name = strings.ToLower(record.Name)
+	m.records[record.Name] = record
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, strings.ToLower(name))
+	return nil
+}
+
+func (m *Memory) Records(ctx context.Context) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := make([]Record, 0, len(m.records))
+	for _, r := range m.records {
+		records = append(records, r)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func (m *Memory) SetTXT(ctx context.Context, name string, values []string, ttl int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = strings.ToLower(name)
+	if len(values) == 0 {
+		delete(m.txt, name)
+		return nil
+	}
+	m.txt[name] = append([]string(nil), values...)
+	return nil
+}
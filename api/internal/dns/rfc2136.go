@@ -0,0 +1,324 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// opcodeUpdate is the opcode of dynamic updates (RFC 2136).
+const opcodeUpdate = 5
+
+// RFC2136 publishes records by sending dynamic updates (RFC 2136) to the
+// primary server of the zone and lists them with a zone transfer, both
+// over TCP and signed with a TSIG key (RFC 8945) when one is configured.
+type RFC2136 struct {
+	zone    dnsmessage.Name
+	server  string
+	key     *tsigKey
+	timeout time.Duration
+}
+
+var _ Provider = (*RFC2136)(nil)
+
+func NewRFC2136(zone string, cfg config.RFC2136Config) (*RFC2136, error) {
+	name, err := fqdnName(zone)
+	if err != nil {
+		return nil, err
+	}
+	p := &RFC2136{zone: name, server: cfg.Server, timeout: cfg.Timeout}
+	if cfg.KeyName != "" {
+		if p.key, err = newTSIGKey(cfg.KeyName, cfg.KeyAlgorithm, cfg.KeySecret); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Upsert replaces the records of record.Name in a single update, so the
+// name always resolves.
+func (p *RFC2136) Upsert(ctx context.Context, record Record) error {
+	name, err := fqdnName(record.Name)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(record.Value)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", record.Value, err)
+	}
+	return p.update(ctx, func(b *dnsmessage.Builder) error {
+		if err := deleteAddresses(b, name); err != nil {
+			return err
+		}
+		h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: uint32(record.TTL)}
+		if addr.Is4() {
+			return b.AResource(h, dnsmessage.AResource{A: addr.As4()})
+		}
+		return b.AAAAResource(h, dnsmessage.AAAAResource{AAAA: addr.As16()})
+	})
+}
+
+func (p *RFC2136) Delete(ctx context.Context, name string) error {
+	n, err := fqdnName(name)
+	if err != nil {
+		return err
+	}
+	return p.update(ctx, func(b *dnsmessage.Builder) error {
+		return deleteAddresses(b, n)
+	})
+}
+
+func (p *RFC2136) SetTXT(ctx context.Context, name string, values []string, ttl int) error {
+	n, err := fqdnName(name)
+	if err != nil {
+		return err
+	}
+	return p.update(ctx, func(b *dnsmessage.Builder) error {
+		h := dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassANY}
+		if err := b.UnknownResource(h, dnsmessage.UnknownResource{Type: dnsmessage.TypeTXT}); err != nil {
+			return err
+		}
+		for _, v := range values {
+			h := dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassINET, TTL: uint32(ttl)}
+			if err := b.TXTResource(h, dnsmessage.TXTResource{TXT: splitTXT(v)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// splitTXT splits v into the strings of at most 255 bytes a TXT record
+// holds; resolvers join them back.
+func splitTXT(v string) []string {
+	parts := []string{}
+	for len(v) > 255 {
+		parts = append(parts, v[:255])
+		v = v[255:]
+	}
+	return append(parts, v)
+}
+
+// deleteAddresses adds the deletion of the A and AAAA records of name to
+// the update section.
+func deleteAddresses(b *dnsmessage.Builder, name dnsmessage.Name) error {
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		// Class ANY with no data deletes the whole RRset (RFC 2136 2.5.2)
+		h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassANY}
+		if err := b.UnknownResource(h, dnsmessage.UnknownResource{Type: t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update sends an update of the zone whose update section build adds.
+func (p *RFC2136) update(ctx context.Context, build func(b *dnsmessage.Builder) error) error {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: newID(), OpCode: opcodeUpdate})
+	if err := b.StartQuestions(); err != nil {
+		return err
+	}
+	// The zone section names the zone updated
+	err := b.Question(dnsmessage.Question{Name: p.zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return err
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return err
+	}
+	if err := build(&b); err != nil {
+		return err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	return p.exchange(ctx, msg, func(h dnsmessage.Header, _ *dnsmessage.Parser) (bool, error) {
+		if h.RCode != dnsmessage.RCodeSuccess {
+			return true, fmt.Errorf("server refused the update: %s", rcodeName(h.RCode))
+		}
+		return true, nil
+	})
+}
+
+// Records transfers the zone (AXFR) and returns its A and AAAA records.
+func (p *RFC2136) Records(ctx context.Context) ([]Record, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: newID()})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	err := b.Question(dnsmessage.Question{Name: p.zone, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	soas := 0
+	err = p.exchange(ctx, msg, func(h dnsmessage.Header, parser *dnsmessage.Parser) (bool, error) {
+		if h.RCode != dnsmessage.RCodeSuccess {
+			return true, fmt.Errorf("server refused the zone transfer: %s", rcodeName(h.RCode))
+		}
+		if err := parser.SkipAllQuestions(); err != nil {
+			return false, err
+		}
+		for {
+			rh, err := parser.AnswerHeader()
+			if err == dnsmessage.ErrSectionDone {
+				break
+			}
+			if err != nil {
+				return false, err
+			}
+			name := strings.TrimSuffix(strings.ToLower(rh.Name.String()), ".")
+			switch rh.Type {
+			case dnsmessage.TypeSOA:
+				// The transfer starts and ends with the SOA record
+				soas++
+				err = parser.SkipAnswer()
+			case dnsmessage.TypeA:
+				var r dnsmessage.AResource
+				if r, err = parser.AResource(); err == nil {
+					records = append(records, Record{Name: name, Type: "A", TTL: int(rh.TTL), Value: netip.AddrFrom4(r.A).String()})
+				}
+			case dnsmessage.TypeAAAA:
+				var r dnsmessage.AAAAResource
+				if r, err = parser.AAAAResource(); err == nil {
+					records = append(records, Record{Name: name, Type: "AAAA", TTL: int(rh.TTL), Value: netip.AddrFrom16(r.AAAA).String()})
+				}
+			default:
+				err = parser.SkipAnswer()
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		if soas == 0 {
+			return false, fmt.Errorf("zone transfer did not start with the SOA record")
+		}
+		return soas >= 2, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// exchange sends msg to the server, signed if there is a key, and hands
+// each response to handle until it reports the last one or fails.
+// Responses are checked against the key before they are handled, but for
+// errors reported without a signature.
+func (p *RFC2136) exchange(ctx context.Context, msg []byte, handle func(h dnsmessage.Header, parser *dnsmessage.Parser) (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var verifier *tsigVerifier
+	if p.key != nil {
+		var mac []byte
+		msg, mac = p.key.sign(msg, time.Now())
+		verifier = p.key.verifier(mac)
+	}
+	id := binary.BigEndian.Uint16(msg[0:2])
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return fmt.Errorf("failed to reach DNS server: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return fmt.Errorf("failed to send to DNS server: %w", err)
+	}
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return fmt.Errorf("failed to read from DNS server: %w", err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return fmt.Errorf("failed to read from DNS server: %w", err)
+		}
+
+		var parser dnsmessage.Parser
+		h, err := parser.Start(resp)
+		if err != nil {
+			return fmt.Errorf("invalid response from DNS server: %w", err)
+		}
+		if h.ID != id || !h.Response {
+			return fmt.Errorf("invalid response from DNS server: not an answer to the request")
+		}
+
+		// Whether this is the last message is only known once it is
+		// handled, so a zone transfer's is checked afterwards
+		if verifier != nil {
+			err := verifier.verify(resp, false, time.Now())
+			if err == errUnsigned && h.RCode != dnsmessage.RCodeSuccess {
+				err = nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid response from DNS server: %w", err)
+			}
+		}
+		last, err := handle(h, &parser)
+		if err != nil {
+			return err
+		}
+		if last {
+			if verifier != nil && len(verifier.unsigned) > 0 {
+				return fmt.Errorf("invalid response from DNS server: %w", errUnsigned)
+			}
+			return nil
+		}
+	}
+}
+
+// fqdnName returns name as a fully qualified dnsmessage.Name.
+func fqdnName(name string) (dnsmessage.Name, error) {
+	n, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return n, fmt.Errorf("invalid domain name %q: %w", name, err)
+	}
+	return n, nil
+}
+
+// newID returns a random message ID.
+func newID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// rcodeName returns the mnemonic of rcode, such as REFUSED.
+func rcodeName(rcode dnsmessage.RCode) string {
+	names := map[dnsmessage.RCode]string{
+		dnsmessage.RCodeFormatError:    "FORMERR",
+		dnsmessage.RCodeServerFailure:  "SERVFAIL",
+		dnsmessage.RCodeNameError:      "NXDOMAIN",
+		dnsmessage.RCodeNotImplemented: "NOTIMP",
+		dnsmessage.RCodeRefused:        "REFUSED",
+		9:                              "NOTAUTH",
+		10:                             "NOTZONE",
+	}
+	if name, ok := names[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE %d", rcode)
+}
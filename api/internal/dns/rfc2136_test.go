@@ -0,0 +1,118 @@
+package dns_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+)
+
+// TestRFC2136 sends updates to the stand-in name server and reads them
+// back with a zone transfer and queries.
+func TestRFC2136(t *testing.T) {
+	srv, err := dns.NewServer("cust.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	p, err := dns.NewRFC2136("cust.example.com", config.RFC2136Config{Server: srv.Addr(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, r := range []dns.Record{
+		{Name: "pg-1.cust.example.com", Type: "A", TTL: 60, Value: "10.20.0.5"},
+		{Name: "pg-2.cust.example.com", Type: "AAAA", TTL: 60, Value: "fd00::5"},
+		// Replaces the A record of pg-1, rather than adding one
+		{Name: "PG-1.cust.example.com", Type: "A", TTL: 120, Value: "10.20.0.6"},
+		{Name: "pg-3.cust.example.com", Type: "A", TTL: 60, Value: "10.20.0.7"},
+	} {
+		if err := p.Upsert(ctx, r); err != nil {
+			t.Fatalf("Upsert(%s): %v", r.Name, err)
+		}
+	}
+	long := strings.Repeat("x", 300)
+	if err := p.SetTXT(ctx, "_acme-challenge.pg-1.cust.example.com", []string{"token", long}, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Delete(ctx, "pg-3.cust.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Delete(ctx, "pg-4.cust.example.com"); err != nil {
+		t.Errorf("Delete of a name without records = %v", err)
+	}
+
+	records, err := p.Records(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dns.Record{
+		{Name: "pg-1.cust.example.com", Type: "A", TTL: 120, Value: "10.20.0.6"},
+		{Name: "pg-2.cust.example.com", Type: "AAAA", TTL: 60, Value: "fd00::5"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("Records = %+v, want %+v", records, want)
+	}
+
+	resolver := dns.NewResolver(srv.Addr())
+	txt, err := resolver.LookupTXT(ctx, "_acme-challenge.pg-1.cust.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values longer than a TXT string are split, and joined back
+	sort.Strings(txt)
+	if !reflect.DeepEqual(txt, []string{"token", long}) {
+		t.Errorf("TXT records = %q", txt)
+	}
+	if err := p.SetTXT(ctx, "_acme-challenge.pg-1.cust.example.com", nil, 60); err != nil {
+		t.Fatal(err)
+	}
+	if txt, err := resolver.LookupTXT(ctx, "_acme-challenge.pg-1.cust.example.com"); err == nil {
+		t.Errorf("TXT records left after removing them: %q", txt)
+	}
+
+	// The server takes updates to its zone only
+	err = p.Upsert(ctx, dns.Record{Name: "pg-1.other.example.com", Type: "A", TTL: 60, Value: "10.20.0.8"})
+	if err == nil || !strings.Contains(err.Error(), "NOTZONE") {
+		t.Errorf("Upsert outside the zone = %v, want NOTZONE", err)
+	}
+}
+
+// TestRFC2136Refused checks that errors the server reports without a
+// signature reach a provider with a key, which the stand-in has none for.
+func TestRFC2136Refused(t *testing.T) {
+	srv, err := dns.NewServer("cust.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	p, err := dns.NewRFC2136("cust.example.com", config.RFC2136Config{
+		Server:       srv.Addr(),
+		KeyName:      "dbx-key",
+		KeyAlgorithm: "hmac-sha256",
+		KeySecret:    testSecret,
+		Timeout:      5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Upsert(context.Background(), dns.Record{Name: "pg-1.cust.example.com", Type: "A", TTL: 60, Value: "10.20.0.5"})
+	if err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Errorf("Upsert = %v, want NOTAUTH", err)
+	}
+	if _, err := p.Records(context.Background()); err == nil {
+		t.Error("Records accepted an unsigned zone transfer")
+	}
+}
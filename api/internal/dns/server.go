@@ -0,0 +1,435 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxUDPSize is the largest response sent over UDP; longer ones are
+// truncated, so the resolver retries over TCP.
+const maxUDPSize = 1232
+
+// Server is a name server holding records in memory. It stands in for the
+// primary server of the instance zone under --dev, taking the unsigned
+// dynamic updates and zone transfers of the RFC2136 provider, and for the
+// name servers that ACME and domain ownership checks resolve through. It
+// answers for every name it holds, inside the zone or not, but only takes
+// updates to the zone.
+type Server struct {
+	zone dnsmessage.Name
+
+	mu sync.Mutex
+	// records are by lowercase name, with the trailing dot. Their data is
+	// kept as sent, which is only safe for types without names in it.
+	records map[string][]rr
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+type rr struct {
+	rrtype dnsmessage.Type
+	ttl    uint32
+	data   []byte
+}
+
+func NewServer(zone string) (*Server, error) {
+	name, err := fqdnName(strings.ToLower(zone))
+	if err != nil {
+		return nil, err
+	}
+	return &Server{zone: name, records: make(map[string][]rr)}, nil
+}
+
+// Start listens on addr over UDP and TCP, on the same port, and serves
+// until Close. A port of 0 picks a free one; Addr reports it.
+func (s *Server) Start(addr string) error {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return err
+	}
+	s.tcp, s.udp = tcp, udp
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.tcp.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return errors.Join(s.tcp.Close(), s.udp.Close())
+}
+
+// SetTXT replaces the TXT records of name, as a name server of someone
+// else's zone would hold them.
+func (s *Server) SetTXT(name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	s.deleteRRset(key, dnsmessage.TypeTXT)
+	for _, v := range values {
+		var data []byte
+		for _, part := range splitTXT(v) {
+			data = append(data, byte(len(part)))
+			data = append(data, part...)
+		}
+		s.records[key] = append(s.records[key], rr{rrtype: dnsmessage.TypeTXT, ttl: 60, data: data})
+	}
+}
+
+// SetCNAME points name at target, as the owner of a custom domain would, or
+// removes its CNAME record if target is empty. Queries for other types at
+// name are answered with the records of target.
+func (s *Server) SetCNAME(name, target string) error {
+	var data []byte
+	if target != "" {
+		var err error
+		if data, err = wireName(target); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	s.deleteRRset(key, dnsmessage.TypeCNAME)
+	if data != nil {
+		s.records[key] = append(s.records[key], rr{rrtype: dnsmessage.TypeCNAME, ttl: 60, data: data})
+	}
+	return nil
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := s.handle(buf[:n], false)
+		if resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				var size [2]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				resp := s.handle(req, true)
+				if resp == nil {
+					return
+				}
+				if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle returns the response to req, or nil if it can't be answered.
+func (s *Server) handle(req []byte, stream bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return s.reply(h, nil, dnsmessage.RCodeFormatError, nil, stream)
+	}
+	q.Name = lowerName(q.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case h.OpCode == opcodeUpdate:
+		return s.reply(h, &q, s.update(&p, req, q), nil, stream)
+	case h.OpCode != 0:
+		return s.reply(h, &q, dnsmessage.RCodeNotImplemented, nil, stream)
+	case q.Type == dnsmessage.TypeAXFR:
+		if !stream || q.Name != s.zone {
+			return s.reply(h, &q, dnsmessage.RCodeRefused, nil, stream)
+		}
+		return s.reply(h, &q, dnsmessage.RCodeSuccess, s.transfer(), stream)
+	default:
+		rcode, answers := s.query(q)
+		return s.reply(h, &q, rcode, answers, stream)
+	}
+}
+
+// answer is a record of a response.
+type answer struct {
+	name dnsmessage.Name
+	rr
+}
+
+// maxCNAMEs bounds the CNAME records followed in answering a query.
+const maxCNAMEs = 8
+
+// query answers q from the records held, following CNAME records to the
+// records of their target as a recursive resolver would.
+func (s *Server) query(q dnsmessage.Question) (dnsmessage.RCode, []answer) {
+	if q.Name == s.zone && q.Type == dnsmessage.TypeSOA {
+		return dnsmessage.RCodeSuccess, []answer{s.soa()}
+	}
+	var answers []answer
+	name := q.Name
+	for hops := 0; ; hops++ {
+		held, ok := s.records[name.String()]
+		if !ok && name != s.zone {
+			if hops == 0 {
+				return dnsmessage.RCodeNameError, nil
+			}
+			return dnsmessage.RCodeSuccess, answers
+		}
+		var (
+			found bool
+			cname *rr
+		)
+		for i, r := range held {
+			if r.rrtype == q.Type || q.Type == dnsmessage.TypeALL {
+				answers = append(answers, answer{name, r})
+				found = true
+			} else if r.rrtype == dnsmessage.TypeCNAME {
+				cname = &held[i]
+			}
+		}
+		if found || cname == nil || hops == maxCNAMEs {
+			return dnsmessage.RCodeSuccess, answers
+		}
+		target, err := nameFromWire(cname.data)
+		if err != nil {
+			return dnsmessage.RCodeServerFailure, nil
+		}
+		answers = append(answers, answer{name, *cname})
+		name = target
+	}
+}
+
+// transfer returns the records of the zone between two SOA records, as a
+// single message.
+func (s *Server) transfer() []answer {
+	names := make([]string, 0, len(s.records))
+	for name := range s.records {
+		if inZone(name, s.zone.String()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	answers := []answer{s.soa()}
+	for _, name := range names {
+		n := dnsmessage.MustNewName(name)
+		for _, r := range s.records[name] {
+			answers = append(answers, answer{n, r})
+		}
+	}
+	return append(answers, s.soa())
+}
+
+func (s *Server) soa() answer {
+	var data []byte
+	for _, name := range []string{"ns." + s.zone.String(), "hostmaster." + s.zone.String()} {
+		wire, _ := wireName(name)
+		data = append(data, wire...)
+	}
+	// The serial is the time, so secondaries always see a change
+	data = binary.BigEndian.AppendUint32(data, uint32(time.Now().Unix()))
+	for _, v := range []uint32{soaRefresh, soaRetry, soaExpire, 60} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return answer{s.zone, rr{rrtype: dnsmessage.TypeSOA, ttl: 60, data: data}}
+}
+
+// update applies the update section of req (RFC 2136 section 3.4.2) and
+// returns the response code. Prerequisites are not checked, and signed
+// updates are refused, since there is no key to check them with.
+func (s *Server) update(p *dnsmessage.Parser, req []byte, zone dnsmessage.Question) dnsmessage.RCode {
+	if zone.Name != s.zone || zone.Type != dnsmessage.TypeSOA {
+		return dnsmessage.RCode(10) // NOTZONE
+	}
+	if _, tsig, err := splitTSIG(req); err != nil || tsig != nil {
+		return dnsmessage.RCode(9) // NOTAUTH
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+
+	type change struct {
+		h    dnsmessage.ResourceHeader
+		data []byte
+	}
+	var changes []change
+	for {
+		h, err := p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsmessage.RCodeFormatError
+		}
+		r, err := p.UnknownResource()
+		if err != nil {
+			return dnsmessage.RCodeFormatError
+		}
+		h.Name = lowerName(h.Name)
+		if !inZone(h.Name.String(), s.zone.String()) {
+			return dnsmessage.RCode(10)
+		}
+		changes = append(changes, change{h, r.Data})
+	}
+
+	// The update is applied only once all of it has been read
+	for _, c := range changes {
+		key := c.h.Name.String()
+		switch c.h.Class {
+		case dnsmessage.ClassANY:
+			if c.h.Type == dnsmessage.TypeALL {
+				delete(s.records, key)
+			} else {
+				s.deleteRRset(key, c.h.Type)
+			}
+		case dnsmessage.Class(254): // NONE: delete one record
+			s.deleteRecord(key, c.h.Type, c.data)
+		case dnsmessage.ClassINET:
+			s.deleteRecord(key, c.h.Type, c.data)
+			s.records[key] = append(s.records[key], rr{rrtype: c.h.Type, ttl: c.h.TTL, data: c.data})
+		}
+	}
+	slog.Debug("stand-in name server applied update", "changes", len(changes))
+	return dnsmessage.RCodeSuccess
+}
+
+func (s *Server) deleteRRset(key string, t dnsmessage.Type) {
+	kept := s.records[key][:0]
+	for _, r := range s.records[key] {
+		if r.rrtype != t {
+			kept = append(kept, r)
+		}
+	}
+	s.setRecords(key, kept)
+}
+
+func (s *Server) deleteRecord(key string, t dnsmessage.Type, data []byte) {
+	kept := s.records[key][:0]
+	for _, r := range s.records[key] {
+		if r.rrtype != t || string(r.data) != string(data) {
+			kept = append(kept, r)
+		}
+	}
+	s.setRecords(key, kept)
+}
+
+func (s *Server) setRecords(key string, records []rr) {
+	if len(records) == 0 {
+		delete(s.records, key)
+		return
+	}
+	s.records[key] = records
+}
+
+// reply builds the response to the request with header h. Over UDP a
+// response too long is sent truncated.
+func (s *Server) reply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answers []answer, stream bool) []byte {
+	msg := buildReply(h, q, rcode, answers, false)
+	if !stream && len(msg) > maxUDPSize {
+		msg = buildReply(h, q, rcode, nil, true)
+	}
+	return msg
+}
+
+func buildReply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answers []answer, truncated bool) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            h.ID,
+		Response:      true,
+		OpCode:        h.OpCode,
+		Authoritative: true,
+		Truncated:     truncated,
+		RCode:         rcode,
+	})
+	b.StartQuestions()
+	if q != nil {
+		b.Question(*q)
+	}
+	b.StartAnswers()
+	for _, a := range answers {
+		b.UnknownResource(
+			dnsmessage.ResourceHeader{Name: a.name, Class: dnsmessage.ClassINET, TTL: a.ttl},
+			dnsmessage.UnknownResource{Type: a.rrtype, Data: a.data},
+		)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		slog.Error("stand-in name server failed to build a response", "error", err)
+		return nil
+	}
+	return msg
+}
+
+// nameFromWire decodes an uncompressed name in wire format, as SetCNAME
+// stores targets.
+func nameFromWire(data []byte) (dnsmessage.Name, error) {
+	var labels []string
+	for len(data) > 0 && data[0] != 0 {
+		n := int(data[0])
+		if n > 63 || len(data) < 1+n {
+			return dnsmessage.Name{}, errors.New("invalid name")
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return dnsmessage.NewName(strings.Join(labels, ".") + ".")
+}
+
+func lowerName(n dnsmessage.Name) dnsmessage.Name {
+	lower, err := dnsmessage.NewName(strings.ToLower(n.String()))
+	if err != nil {
+		return n
+	}
+	return lower
+}
+
+// inZone reports whether name is zone or below it; both are fully
+// qualified and lowercase.
+func inZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,325 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+const (
+	// typeTSIG is the type of TSIG records, which dnsmessage doesn't know.
+	typeTSIG = 250
+	// classANY is the class of TSIG records.
+	classANY = 255
+	// tsigFudge is how far the clocks of the server and the control plane
+	// may drift apart, in seconds.
+	tsigFudge = 300
+	// tsigMaxUnsigned is how many messages of a zone transfer may go
+	// without a TSIG record in a row (RFC 8945 section 5.3.1).
+	tsigMaxUnsigned = 99
+)
+
+// TSIG errors a server may return in the TSIG record of its response
+var tsigErrors = map[uint16]string{
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+	22: "BADTRUNC",
+}
+
+// tsigKey signs requests and checks responses (RFC 8945).
+type tsigKey struct {
+	// name and algorithm are in canonical wire format
+	name      []byte
+	algorithm []byte
+	secret    []byte
+	hash      func() hash.Hash
+}
+
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	key := &tsigKey{}
+	switch algorithm {
+	case "hmac-sha256":
+		key.hash = sha256.New
+	case "hmac-sha512":
+		key.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", algorithm)
+	}
+	var err error
+	if key.secret, err = base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %w", err)
+	}
+	if key.name, err = wireName(name); err != nil {
+		return nil, err
+	}
+	if key.algorithm, err = wireName(algorithm); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wireName returns name, with or without the trailing dot, in canonical
+// wire format: lowercase and uncompressed.
+func wireName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	var wire []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %q", name)
+			}
+			wire = append(wire, byte(len(label)))
+			wire = append(wire, label...)
+		}
+	}
+	return append(wire, 0), nil
+}
+
+// sign appends a TSIG record to msg, an unsigned message, and returns the
+// signed message along with its MAC, which the response is signed over.
+func (k *tsigKey) sign(msg []byte, now time.Time) ([]byte, []byte) {
+	timeSigned := uint64(now.Unix())
+	mac := k.mac(nil, msg, k.variables(timeSigned, 0, nil))
+
+	rdata := append([]byte{}, k.algorithm...)
+	rdata = appendUint48(rdata, timeSigned)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...) // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	signed := append([]byte{}, msg...)
+	signed = append(signed, k.name...)
+	signed = binary.BigEndian.AppendUint16(signed, typeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, classANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+	binary.BigEndian.PutUint16(signed[10:12], binary.BigEndian.Uint16(signed[10:12])+1)
+	return signed, mac
+}
+
+// variables returns the TSIG variables a MAC is computed over.
+func (k *tsigKey) variables(timeSigned uint64, tsigErr uint16, other []byte) []byte {
+	v := append([]byte{}, k.name...)
+	v = binary.BigEndian.AppendUint16(v, classANY)
+	v = binary.BigEndian.AppendUint32(v, 0)
+	v = append(v, k.algorithm...)
+	v = appendUint48(v, timeSigned)
+	v = binary.BigEndian.AppendUint16(v, tsigFudge)
+	v = binary.BigEndian.AppendUint16(v, tsigErr)
+	v = binary.BigEndian.AppendUint16(v, uint16(len(other)))
+	return append(v, other...)
+}
+
+// mac returns the MAC of msg and vars, chained to prior, the MAC of the
+// request or of the previous signed message, unless it is nil.
+func (k *tsigKey) mac(prior, msg, vars []byte) []byte {
+	h := hmac.New(k.hash, k.secret)
+	if prior != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prior))))
+		h.Write(prior)
+	}
+	h.Write(msg)
+	h.Write(vars)
+	return h.Sum(nil)
+}
+
+// tsigVerifier checks the TSIG records of the responses to one request:
+// the response to an update, or the messages of a zone transfer.
+type tsigVerifier struct {
+	key *tsigKey
+	// prior is the MAC of the request, then of the last signed message
+	prior []byte
+	// unsigned holds the messages since the last signed one
+	unsigned [][]byte
+	// first is set until a message has been verified
+	first bool
+}
+
+func (k *tsigKey) verifier(requestMAC []byte) *tsigVerifier {
+	return &tsigVerifier{key: k, prior: requestMAC, first: true}
+}
+
+var errUnsigned = errors.New("response is not signed")
+
+// verify checks the TSIG record of msg, which must have one if it is the
+// first or last message, or too many have gone unsigned.
+func (v *tsigVerifier) verify(msg []byte, last bool, now time.Time) error {
+	body, tsig, err := splitTSIG(msg)
+	if err != nil {
+		return err
+	}
+	if tsig == nil {
+		if v.first || last || len(v.unsigned) >= tsigMaxUnsigned {
+			return errUnsigned
+		}
+		v.unsigned = append(v.unsigned, msg)
+		return nil
+	}
+	if !equalFold(tsig.algorithm, v.key.algorithm) {
+		return fmt.Errorf("response is signed with another algorithm")
+	}
+	if tsig.err != 0 {
+		name := tsigErrors[tsig.err]
+		if name == "" {
+			name = fmt.Sprintf("error %d", tsig.err)
+		}
+		return fmt.Errorf("server rejected the TSIG key: %s", name)
+	}
+	// Truncated MACs are allowed by RFC 8945 section 5.2.2.1, but never
+	// sent by the servers the provider talks to
+	if len(tsig.mac) != v.key.hash().Size() {
+		return fmt.Errorf("response has a truncated TSIG MAC of %d bytes", len(tsig.mac))
+	}
+	if d := now.Unix() - int64(tsig.timeSigned); d > int64(tsig.fudge) || -d > int64(tsig.fudge) {
+		return fmt.Errorf("response was signed %ds away from now, outside the fudge of %ds", d, tsig.fudge)
+	}
+
+	// The MAC covers the message as it was before the TSIG record was added
+	binary.BigEndian.PutUint16(body[0:2], tsig.originalID)
+	var signed []byte
+	for _, m := range v.unsigned {
+		signed = append(signed, m...)
+	}
+	signed = append(signed, body...)
+	var vars []byte
+	if v.first {
+		vars = v.key.variables(tsig.timeSigned, tsig.err, tsig.other)
+	} else {
+		vars = appendUint48(nil, tsig.timeSigned)
+		vars = binary.BigEndian.AppendUint16(vars, tsig.fudge)
+	}
+	if !hmac.Equal(v.key.mac(v.prior, signed, vars), tsig.mac) {
+		return fmt.Errorf("response has an invalid TSIG signature")
+	}
+	v.prior, v.unsigned, v.first = tsig.mac, nil, false
+	return nil
+}
+
+// tsigRecord is the RDATA of a TSIG record.
+type tsigRecord struct {
+	algorithm  []byte
+	timeSigned uint64
+	fudge      uint16
+	mac        []byte
+	originalID uint16
+	err        uint16
+	other      []byte
+}
+
+// splitTSIG returns msg without its TSIG record, with the additional count
+// decremented, and the record, or msg and nil if it has none. The TSIG
+// record is the last of the message and its names are never compressed.
+func splitTSIG(msg []byte) ([]byte, *tsigRecord, error) {
+	if len(msg) < 12 {
+		return nil, nil, fmt.Errorf("short message")
+	}
+	if binary.BigEndian.Uint16(msg[10:12]) == 0 {
+		return msg, nil, nil
+	}
+	// Find the last record by walking the message
+	off := 12
+	var err error
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, nil, err
+		}
+		off += 4
+	}
+	records := 0
+	for _, at := range []int{6, 8, 10} {
+		records += int(binary.BigEndian.Uint16(msg[at : at+2]))
+	}
+	start := off
+	for i := 0; i < records; i++ {
+		start = off
+		if off, err = skipName(msg, off); err != nil {
+			return nil, nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, nil, fmt.Errorf("short record")
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off : off+2])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10 + rdlen
+		if off > len(msg) {
+			return nil, nil, fmt.Errorf("short record")
+		}
+		if i == records-1 && rrtype == typeTSIG {
+			tsig, err := parseTSIG(msg[off-rdlen : off])
+			if err != nil {
+				return nil, nil, err
+			}
+			body := append([]byte{}, msg[:start]...)
+			binary.BigEndian.PutUint16(body[10:12], binary.BigEndian.Uint16(body[10:12])-1)
+			return body, tsig, nil
+		}
+	}
+	return msg, nil, nil
+}
+
+// skipName returns the offset after the name at off in msg.
+func skipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xC0 == 0xC0:
+			// A compression pointer ends the name
+			return off + 2, nil
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, fmt.Errorf("short name")
+}
+
+func parseTSIG(rdata []byte) (*tsigRecord, error) {
+	errShort := errors.New("short TSIG record")
+	off, err := skipName(rdata, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &tsigRecord{algorithm: rdata[:off]}
+	if off+10 > len(rdata) {
+		return nil, errShort
+	}
+	t.timeSigned = uint64(binary.BigEndian.Uint16(rdata[off:]))<<32 | uint64(binary.BigEndian.Uint32(rdata[off+2:]))
+	t.fudge = binary.BigEndian.Uint16(rdata[off+6:])
+	macLen := int(binary.BigEndian.Uint16(rdata[off+8:]))
+	off += 10
+	if off+macLen+6 > len(rdata) {
+		return nil, errShort
+	}
+	t.mac = rdata[off : off+macLen]
+	off += macLen
+	t.originalID = binary.BigEndian.Uint16(rdata[off:])
+	t.err = binary.BigEndian.Uint16(rdata[off+2:])
+	otherLen := int(binary.BigEndian.Uint16(rdata[off+4:]))
+	off += 6
+	if off+otherLen > len(rdata) {
+		return nil, errShort
+	}
+	t.other = rdata[off : off+otherLen]
+	return t, nil
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func equalFold(a, b []byte) bool {
+	return strings.EqualFold(string(a), string(b))
+}
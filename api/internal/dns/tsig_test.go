@@ -0,0 +1,228 @@
+package dns_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/dns"
+)
+
+// The vectors below are laid out by hand from RFC 8945: the TSIG record of
+// section 4.2 and the digest components of section 4.3. Their MACs were
+// computed with another HMAC implementation over those components.
+const (
+	// testSecret is "dbx-tsig-test-secret-0123456789!", the secret of the
+	// key dbx-key.
+	testSecret = "ZGJ4LXRzaWctdGVzdC1zZWNyZXQtMDEyMzQ1Njc4OSE="
+
+	// request is an update of example.com with ID 0x1234.
+	request = "1234 2800 0001 0000 0000 0000" + // header
+		"07 6578616d706c65 03 636f6d 00 0006 0001" // zone: example.com SOA IN
+
+	// signedRequest is request signed at 1700000000 (0x6553f100): the
+	// additional count goes up and the TSIG record is appended.
+	signedRequest = "1234 2800 0001 0000 0000 0001" +
+		"07 6578616d706c65 03 636f6d 00 0006 0001" +
+		"07 6462782d6b6579 00" + // key name: dbx-key
+		"00fa 00ff 00000000 003d" + // type TSIG, class ANY, TTL 0, RDLENGTH
+		"0b 686d61632d736861323536 00" + // algorithm: hmac-sha256
+		"0000 6553f100 012c" + // time signed, fudge 300
+		"0020" + requestMAC +
+		"1234 0000 0000" // original ID, error, other length
+	requestMAC = "7dc92d9c1d9c3033ceee4dcf6a1e873ba2e1098c34ae75f0064fc4e53d62657f"
+
+	// response answers request; it is signed at 1700000001 with
+	// responseMAC, over the request MAC, the response and the TSIG
+	// variables.
+	response = "1234 a800 0001 0000 0000 0000" +
+		"07 6578616d706c65 03 636f6d 00 0006 0001"
+	responseMAC = "79272c1e40617e68564c5f1d81565e69ef91bec27d791ebdc70d90323a2ec5a9"
+	signedAt    = 1700000000
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// tsigRR returns the TSIG record of dbx-key with mac, as a server would
+// append it to a message.
+func tsigRR(t *testing.T, timeSigned uint64, mac []byte, tsigErr uint16) []byte {
+	t.Helper()
+	rdata := unhex(t, "0b 686d61632d736861323536 00")
+	rdata = append(rdata, byte(timeSigned>>40), byte(timeSigned>>32))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(timeSigned))
+	rdata = binary.BigEndian.AppendUint16(rdata, 300)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, 0x12, 0x34)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigErr)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	rr := unhex(t, "07 6462782d6b6579 00 00fa 00ff 00000000")
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// withTSIG appends rr to msg, counting it in the additional section.
+func withTSIG(msg, rr []byte) []byte {
+	signed := append(append([]byte{}, msg...), rr...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed
+}
+
+// timersMAC returns the MAC of a message after the first of a zone
+// transfer: over the prior MAC, the messages since it and the timers.
+func timersMAC(t *testing.T, prior []byte, timeSigned uint64, msgs ...[]byte) []byte {
+	t.Helper()
+	h := hmac.New(sha256.New, []byte("dbx-tsig-test-secret-0123456789!"))
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prior))))
+	h.Write(prior)
+	for _, m := range msgs {
+		h.Write(m)
+	}
+	h.Write([]byte{byte(timeSigned >> 40), byte(timeSigned >> 32)})
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(timeSigned)))
+	h.Write(binary.BigEndian.AppendUint16(nil, 300))
+	return h.Sum(nil)
+}
+
+func TestTSIGSign(t *testing.T) {
+	key, err := dns.NewTSIGKey("dbx-key.", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, mac := dns.SignTSIG(key, unhex(t, request), time.Unix(signedAt, 0))
+	if got, want := hex.EncodeToString(signed), hex.EncodeToString(unhex(t, signedRequest)); got != want {
+		t.Errorf("signed request =\n%s\nwant\n%s", got, want)
+	}
+	if got := hex.EncodeToString(mac); got != requestMAC {
+		t.Errorf("MAC = %s, want %s", got, requestMAC)
+	}
+
+	// Key names are compared in canonical form
+	upper, err := dns.NewTSIGKey("DBX-Key", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed, _ := dns.SignTSIG(upper, unhex(t, request), time.Unix(signedAt, 0)); hex.EncodeToString(signed) != hex.EncodeToString(unhex(t, signedRequest)) {
+		t.Error("a key name in capitals changed the signature")
+	}
+}
+
+func TestTSIGVerify(t *testing.T) {
+	key, err := dns.NewTSIGKey("dbx-key", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := unhex(t, responseMAC)
+	flipped := append([]byte{}, mac...)
+	flipped[0] ^= 1
+	tampered := unhex(t, response)
+	tampered[3] = 5 // REFUSED
+	now := time.Unix(signedAt+1, 0)
+
+	tests := []struct {
+		name       string
+		msg        []byte
+		requestMAC string
+		now        time.Time
+		wantErr    string
+	}{
+		{name: "valid", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac, 0))},
+		{name: "valid at the edge of the fudge", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac, 0)), now: now.Add(300 * time.Second)},
+		{name: "bad MAC", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, flipped, 0)), wantErr: "invalid TSIG signature"},
+		{name: "tampered response", msg: withTSIG(tampered, tsigRR(t, signedAt+1, mac, 0)), wantErr: "invalid TSIG signature"},
+		{name: "answer to another request", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac, 0)), requestMAC: responseMAC, wantErr: "invalid TSIG signature"},
+		{name: "stale", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac, 0)), now: now.Add(301 * time.Second), wantErr: "outside the fudge"},
+		{name: "from the future", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac, 0)), now: now.Add(-301 * time.Second), wantErr: "outside the fudge"},
+		{name: "truncated MAC", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac[:16], 0)), wantErr: "truncated TSIG MAC"},
+		{name: "BADKEY", msg: withTSIG(unhex(t, response), tsigRR(t, signedAt+1, nil, 17)), wantErr: "BADKEY"},
+		{name: "unsigned", msg: unhex(t, response), wantErr: "not signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestMAC := requestMAC
+			if tt.requestMAC != "" {
+				requestMAC = tt.requestMAC
+			}
+			at := now
+			if !tt.now.IsZero() {
+				at = tt.now
+			}
+			err := dns.VerifyTSIG(key, unhex(t, requestMAC), [][]byte{tt.msg}, at)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("VerifyTSIG = %v, want success", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("VerifyTSIG = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	other, err := dns.NewTSIGKey("dbx-key", "hmac-sha512", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := withTSIG(unhex(t, response), tsigRR(t, signedAt+1, mac, 0))
+	if err := dns.VerifyTSIG(other, unhex(t, requestMAC), [][]byte{msg}, now); err == nil || !strings.Contains(err.Error(), "another algorithm") {
+		t.Errorf("VerifyTSIG with another algorithm = %v", err)
+	}
+}
+
+// TestTSIGZoneTransfer checks the MACs of the messages of a zone transfer,
+// each chained to the one before (RFC 8945 section 5.3.1).
+func TestTSIGZoneTransfer(t *testing.T) {
+	key, err := dns.NewTSIGKey("dbx-key", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := withTSIG(unhex(t, response), tsigRR(t, signedAt+1, unhex(t, responseMAC), 0))
+	// The messages after the first carry other records; these ask about
+	// other types to tell them apart
+	second := unhex(t, response)
+	second[26] = 1 // A
+	third := unhex(t, response)
+	third[26] = 2 // NS
+	thirdMAC := timersMAC(t, unhex(t, responseMAC), signedAt+2, second, third)
+	signedThird := withTSIG(third, tsigRR(t, signedAt+2, thirdMAC, 0))
+	now := time.Unix(signedAt+2, 0)
+
+	if err := dns.VerifyTSIG(key, unhex(t, requestMAC), [][]byte{first, second, signedThird}, now); err != nil {
+		t.Errorf("VerifyTSIG = %v", err)
+	}
+	if err := dns.VerifyTSIG(key, unhex(t, requestMAC), [][]byte{first, signedThird}, now); err == nil {
+		t.Error("VerifyTSIG accepted a transfer with a message left out")
+	}
+	if err := dns.VerifyTSIG(key, unhex(t, requestMAC), [][]byte{first, second, third}, now); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("VerifyTSIG of a transfer with an unsigned last message = %v", err)
+	}
+	if err := dns.VerifyTSIG(key, unhex(t, requestMAC), [][]byte{second, signedThird}, now); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("VerifyTSIG of a transfer with an unsigned first message = %v", err)
+	}
+}
+
+func TestNewTSIGKey(t *testing.T) {
+	tests := []struct {
+		name, algorithm, secret string
+	}{
+		{"dbx-key", "hmac-md5", testSecret},
+		{"dbx-key", "hmac-sha256", "not base64!"},
+		{"dbx..key", "hmac-sha256", testSecret},
+		{strings.Repeat("a", 64), "hmac-sha256", testSecret},
+	}
+	for _, tt := range tests {
+		if _, err := dns.NewTSIGKey(tt.name, tt.algorithm, tt.secret); err == nil {
+			t.Errorf("NewTSIGKey(%q, %q, %q) succeeded", tt.name, tt.algorithm, tt.secret)
+		}
+	}
+}
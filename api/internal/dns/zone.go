@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/models"
+)
+
+// SOA timers of the snapshot, in seconds. Secondaries loading it refresh
+// hourly; the negative caching TTL is the TTL of the records.
+const (
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 14 * 24 * 3600
+)
+
+// Snapshot is the instance zone as the control plane holds it.
+type Snapshot struct {
+	Zone        string
+	Nameservers []string
+	// TTL is the default TTL of the zone, in seconds.
+	TTL int
+	// Serial goes up with every snapshot: it is the time it was taken.
+	Serial  uint32
+	Taken   time.Time
+	Records []Record
+}
+
+// NewSnapshot returns a snapshot of the zone cfg configures holding
+// records, taken at now.
+func NewSnapshot(cfg config.DNSConfig, records []models.DNSRecord, now time.Time) *Snapshot {
+	s := &Snapshot{
+		Zone:        cfg.Zone,
+		Nameservers: cfg.Nameservers,
+		TTL:         int(cfg.TTL / time.Second),
+		Serial:      uint32(now.Unix()),
+		Taken:       now,
+		Records:     make([]Record, 0, len(records)),
+	}
+	for _, r := range records {
+		s.Records = append(s.Records, Record{Name: r.Name, Type: r.Type, TTL: r.TTL, Value: r.Value})
+	}
+	return s
+}
+
+// WriteTo writes the snapshot as a zone file (RFC 1035 section 5), which
+// named-checkzone can check and name servers can load.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	origin := strings.ToLower(s.Zone) + "."
+	var n int64
+	printf := func(format string, args ...interface{}) {
+		m, _ := fmt.Fprintf(bw, format, args...)
+		n += int64(m)
+	}
+
+	printf("; %s as of %s\n", s.Zone, s.Taken.UTC().Format(time.RFC3339))
+	printf("$ORIGIN %s\n", origin)
+	printf("$TTL %d\n", s.TTL)
+	printf("@\tIN\tSOA\t%s. hostmaster.%s (\n", s.Nameservers[0], origin)
+	printf("\t\t%d ; serial\n\t\t%d ; refresh\n\t\t%d ; retry\n\t\t%d ; expire\n\t\t%d ; minimum\n\t\t)\n",
+		s.Serial, soaRefresh, soaRetry, soaExpire, s.TTL)
+	for _, ns := range s.Nameservers {
+		printf("@\tIN\tNS\t%s.\n", ns)
+	}
+	for _, r := range s.Records {
+		// Records named in a zone configured earlier are renamed by the
+		// next reconcile; they don't belong here
+		name, ok := strings.CutSuffix(strings.ToLower(r.Name)+".", "."+origin)
+		if !ok {
+			continue
+		}
+		printf("%s\t%d\tIN\t%s\t%s\n", name, r.TTL, r.Type, r.Value)
+	}
+	return n, bw.Flush()
+}
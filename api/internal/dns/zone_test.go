@@ -0,0 +1,54 @@
+package dns_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/models"
+)
+
+func TestSnapshot(t *testing.T) {
+	cfg := config.DNSConfig{
+		Zone:        "Cust.Example.com",
+		Nameservers: []string{"ns1.example.com", "ns2.example.com"},
+		TTL:         time.Minute,
+	}
+	records := []models.DNSRecord{
+		{Name: "pg-1.cust.example.com", Type: "A", TTL: 60, Value: "10.20.0.5"},
+		{Name: "PG-2.cust.example.com", Type: "AAAA", TTL: 300, Value: "fd00::5"},
+		// Named in a zone configured earlier
+		{Name: "pg-3.old.example.com", Type: "A", TTL: 60, Value: "10.20.0.7"},
+	}
+	taken := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	snap := dns.NewSnapshot(cfg, records, taken)
+
+	var b strings.Builder
+	n, err := snap.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `; Cust.Example.com as of 2026-10-19T12:00:00Z
+$ORIGIN cust.example.com.
+$TTL 60
+@	IN	SOA	ns1.example.com. hostmaster.cust.example.com. (
+		1792411200 ; serial
+		3600 ; refresh
+		600 ; retry
+		1209600 ; expire
+		60 ; minimum
+		)
+@	IN	NS	ns1.example.com.
+@	IN	NS	ns2.example.com.
+pg-1	60	IN	A	10.20.0.5
+pg-2	300	IN	AAAA	fd00::5
+`
+	if b.String() != want {
+		t.Errorf("zone file =\n%s\nwant\n%s", b.String(), want)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo = %d, wrote %d bytes", n, b.Len())
+	}
+}
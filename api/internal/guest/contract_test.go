@@ -0,0 +1,234 @@
+package guest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apispec/apispectest"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/proxmox/fake"
+	"github.com/zallarak/db/api/openapi"
+)
+
+const (
+	guestToken = "guest-token"
+	template   = 9000
+)
+
+// startContainer clones the template as vmid, starts it and returns a
+// client for its agent.
+func startContainer(t *testing.T, ctx context.Context, client *proxmox.Client, url string, vmid int) *guest.Client {
+	t.Helper()
+	task, err := client.CloneContainer(ctx, template, vmid, "pve-fake-1", "pg", "local-zfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WaitTask(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if task, err = client.StartContainer(ctx, "pve-fake-1", vmid); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WaitTask(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	return guest.NewClient(url+"/guest/"+strconv.Itoa(vmid), guestToken)
+}
+
+// TestContract runs the upgrade, backup, restore and certificate flows of
+// the worker against the simulated agent, and fails on any request or
+// response that breaks the contract, or any operation left uncalled.
+func TestContract(t *testing.T) {
+	cluster := fake.New(fake.Options{
+		TokenID:      "test@pve!test",
+		TokenSecret:  "secret",
+		GuestToken:   guestToken,
+		TaskDuration: 10 * time.Millisecond,
+	})
+	// Agents are served under /guest/{vmid}
+	c := apispectest.New(t, openapi.GuestAgentSpec, func(path string) (string, bool) {
+		if !strings.HasPrefix(path, "/guest/") {
+			return "", false
+		}
+		_, rest, ok := strings.Cut(strings.TrimPrefix(path, "/guest/"), "/v1")
+		return rest, ok
+	}, cluster)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	ctx := context.Background()
+	client, err := proxmox.NewClient(config.ProxmoxEndpoint{URL: srv.URL, TokenID: "test@pve!test", TokenSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blue := startContainer(t, ctx, client, srv.URL, 100)
+	green := startContainer(t, ctx, client, srv.URL, 101)
+
+	status, err := blue.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Ready || status.PgVersion != 16 || status.DiskUsedBytes == 0 {
+		t.Errorf("Status = %+v", status)
+	}
+	err = blue.SetHBA(ctx, []guest.HBAEntry{{Type: "hostssl", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "scram-sha-256"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blue.SetSettings(ctx, guest.Settings{MaxConnections: 100, SharedBuffersMB: 512, EffectiveCacheSizeMB: 1536, MaintenanceWorkMemMB: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Certificates
+	csrDER, err := blue.CertificateRequest(ctx, []string{"pg-1.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blue.InstallCertificate(ctx, signCSR(t, csrDER)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backups and WAL archiving
+	if err := blue.SetWALArchiving(ctx, true, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	backup := readAll(t)(blue.BaseBackup(ctx))
+	segments, err := blue.WALSegments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("WALSegments returned %d segments, want 1", len(segments))
+	}
+	segment := readAll(t)(blue.ReadWALSegment(ctx, segments[0].Name))
+
+	// Upgrades
+	pub, err := blue.CreatePublication(ctx, "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := green.CreateSubscription(ctx, "upgrade", pub); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		sub, err := green.Subscription(ctx, "upgrade")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.State == guest.SubscriptionStreaming {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := blue.SetReadOnly(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := green.FinishSubscription(ctx, "upgrade"); err != nil {
+		t.Fatal(err)
+	}
+	blueSums, err := blue.Checksums(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	greenSums, err := green.Checksums(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blueSums) == 0 || len(blueSums) != len(greenSums) {
+		t.Errorf("checksums differ: %v and %v", blueSums, greenSums)
+	}
+	if err := blue.DropPublication(ctx, "upgrade"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := green.Subscription(ctx, "upgrade"); err == nil {
+		t.Error("finished subscription still reported")
+	}
+
+	// Restores
+	if err := green.RestoreBaseBackup(ctx, bytes.NewReader(backup)); err != nil {
+		t.Fatal(err)
+	}
+	if err := green.RestoreWALSegment(ctx, segments[0].Name, bytes.NewReader(segment)); err != nil {
+		t.Fatal(err)
+	}
+	point, err := green.Recover(ctx, guest.RecoveryTarget{LSN: segments[0].EndLSN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.LSN != segments[0].EndLSN {
+		t.Errorf("Recover stopped at %s, want %s", point.LSN, segments[0].EndLSN)
+	}
+	if err := blue.DeleteWALSegment(ctx, segments[0].Name); err != nil {
+		t.Fatal(err)
+	}
+
+	c.CheckCalled()
+}
+
+// readAll returns a function reading and closing what a streaming call
+// returned.
+func readAll(t *testing.T) func(io.ReadCloser, error) []byte {
+	return func(r io.ReadCloser, err error) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+}
+
+// signCSR issues a certificate for a DER certificate request from a
+// throwaway CA and returns it in PEM.
+func signCSR(t *testing.T, der []byte) []byte {
+	t.Helper()
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, leaf, ca, csr.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+}
@@ -0,0 +1,405 @@
+// Package guest is a client for the agent that instance templates run next
+// to Postgres. The agent does the work the Proxmox API can't reach inside a
+// container: reporting on Postgres, sizing it for the plan of its
+// instance, replicating between instances for upgrades, checksumming tables
+// to verify a copy, taking backups, handing over WAL for archiving,
+// restoring backups and installing the certificate Postgres serves.
+package guest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/tracing"
+)
+
+// APIError is an error response from an agent.
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("guest agent: %d %s", e.Status, e.Message)
+}
+
+// Status describes Postgres in a container.
+type Status struct {
+	PgVersion int `json:"pg_version"`
+	// Ready is true once Postgres accepts connections.
+	Ready    bool `json:"ready"`
+	ReadOnly bool `json:"read_only"`
+	// WALLSN is the current write-ahead log insert position.
+	WALLSN string `json:"wal_lsn"`
+	// DiskUsedBytes is how much of the data volume is in use, as df
+	// reports it.
+	DiskUsedBytes int64 `json:"disk_used_bytes"`
+}
+
+// Publication is a logical replication publication of every table, with
+// the credentials a subscriber connects with.
+type Publication struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// Subscription states
+const (
+	// SubscriptionCopying: the initial copy of the tables is running
+	SubscriptionCopying = "copying"
+	// SubscriptionStreaming: every table is copied and changes stream in
+	SubscriptionStreaming = "streaming"
+)
+
+// Subscription reports how far a subscription has got.
+type Subscription struct {
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	TablesTotal  int    `json:"tables_total"`
+	TablesCopied int    `json:"tables_copied"`
+	// LagBytes is how much WAL of the publisher is yet to be applied.
+	LagBytes int64 `json:"lag_bytes"`
+}
+
+// TableChecksum summarizes the contents of a table.
+type TableChecksum struct {
+	Rows     int64  `json:"rows"`
+	Checksum string `json:"checksum"`
+}
+
+// WALSegment is a completed WAL segment the agent keeps for archiving.
+type WALSegment struct {
+	Name     string `json:"name"`
+	StartLSN string `json:"start_lsn"`
+	EndLSN   string `json:"end_lsn"`
+	// EndTime is when the last transaction in the segment committed.
+	EndTime   time.Time `json:"end_time"`
+	SizeBytes int64     `json:"size_bytes"`
+}
+
+// RecoveryTarget is where recovery stops replaying WAL: at Time or LSN,
+// including the transactions committed there, or if both are empty at the
+// first point the base backup is consistent.
+type RecoveryTarget struct {
+	Time *time.Time `json:"target_time,omitempty"`
+	LSN  string     `json:"target_lsn,omitempty"`
+}
+
+// RecoveryPoint is where a recovery stopped: the LSN it replayed to and
+// the commit time of the last transaction it replayed, if any.
+type RecoveryPoint struct {
+	LSN  string     `json:"lsn"`
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// requestTimeout bounds calls to an agent, other than those streaming
+// backups and WAL or waiting for a recovery.
+const requestTimeout = 30 * time.Second
+
+// HBAEntry is a host-based authentication rule of Postgres, a line of
+// pg_hba.conf.
+type HBAEntry struct {
+	// Type is host, hostssl or hostnossl.
+	Type     string `json:"type"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+	// Address is a CIDR block.
+	Address string `json:"address"`
+	Method  string `json:"method"`
+}
+
+// Settings are the Postgres settings the plan of an instance sizes.
+type Settings struct {
+	MaxConnections       int `json:"max_connections"`
+	SharedBuffersMB      int `json:"shared_buffers_mb"`
+	EffectiveCacheSizeMB int `json:"effective_cache_size_mb"`
+	MaintenanceWorkMemMB int `json:"maintenance_work_mem_mb"`
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client for the agent at baseURL.
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/v1",
+		token:   token,
+		http: &http.Client{
+			Transport: metrics.InstrumentTransport("guest", tracing.Transport("guest", http.DefaultTransport)),
+		},
+	}
+}
+
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := c.do(ctx, http.MethodGet, "/status", nil, &status)
+	return status, err
+}
+
+// CreatePublication publishes every table under name. It returns the
+// existing publication if there is one.
+func (c *Client) CreatePublication(ctx context.Context, name string) (Publication, error) {
+	var pub Publication
+	err := c.do(ctx, http.MethodPost, "/publications", map[string]string{"name": name}, &pub)
+	return pub, err
+}
+
+// DropPublication drops the publication name, if it exists.
+func (c *Client) DropPublication(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/publications/"+url.PathEscape(name), nil, nil)
+}
+
+// CreateSubscription subscribes to source, copying its schema and tables
+// before streaming changes. It does nothing if the subscription exists.
+func (c *Client) CreateSubscription(ctx context.Context, name string, source Publication) error {
+	body := map[string]interface{}{"name": name, "source": source}
+	return c.do(ctx, http.MethodPost, "/subscriptions", body, nil)
+}
+
+func (c *Client) Subscription(ctx context.Context, name string) (Subscription, error) {
+	var sub Subscription
+	err := c.do(ctx, http.MethodGet, "/subscriptions/"+url.PathEscape(name), nil, &sub)
+	return sub, err
+}
+
+// FinishSubscription copies sequence values from the publisher, which
+// logical replication leaves behind, and drops the subscription.
+func (c *Client) FinishSubscription(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, "/subscriptions/"+url.PathEscape(name)+"/finish", nil, nil)
+}
+
+// SetReadOnly makes Postgres refuse or accept writes from clients.
+func (c *Client) SetReadOnly(ctx context.Context, readOnly bool) error {
+	return c.do(ctx, http.MethodPut, "/read-only", map[string]bool{"read_only": readOnly}, nil)
+}
+
+// SetHBA replaces the pg_hba.conf entries the control plane manages with
+// entries, in order, and reloads Postgres. The local entries the template
+// ships with are kept.
+func (c *Client) SetHBA(ctx context.Context, entries []HBAEntry) error {
+	return c.do(ctx, http.MethodPut, "/pg-hba", map[string]interface{}{"entries": entries}, nil)
+}
+
+// SetSettings sets settings with ALTER SYSTEM and reloads Postgres,
+// restarting it if max_connections or shared_buffers changed, since those
+// only take effect on a restart.
+func (c *Client) SetSettings(ctx context.Context, settings Settings) error {
+	return c.do(ctx, http.MethodPut, "/settings", settings, nil)
+}
+
+// CertificateRequest has the agent generate a private key for Postgres to
+// serve TLS with and returns a certificate request for it, in DER, signed
+// by it and naming dnsNames. The key stays in the container, pending until
+// a certificate for it is installed; a later request replaces it.
+func (c *Client) CertificateRequest(ctx context.Context, dnsNames []string) ([]byte, error) {
+	var out struct {
+		CSR []byte `json:"csr"`
+	}
+	err := c.do(ctx, http.MethodPost, "/tls/csr", map[string][]string{"dns_names": dnsNames}, &out)
+	return out.CSR, err
+}
+
+// InstallCertificate makes Postgres serve chainPEM, a certificate for the
+// pending key followed by its intermediates, with that key, and reloads
+// it. The agent refuses a certificate for another key.
+func (c *Client) InstallCertificate(ctx context.Context, chainPEM []byte) error {
+	return c.do(ctx, http.MethodPut, "/tls/certificate", map[string]string{"certificate": string(chainPEM)}, nil)
+}
+
+// Checksums returns a checksum of every table, by qualified name.
+func (c *Client) Checksums(ctx context.Context) (map[string]TableChecksum, error) {
+	var out struct {
+		Tables map[string]TableChecksum `json:"tables"`
+	}
+	err := c.do(ctx, http.MethodGet, "/checksums", nil, &out)
+	return out.Tables, err
+}
+
+// BaseBackup streams a base backup of Postgres as a gzipped tar archive,
+// taken with pg_basebackup, along with the WAL needed to make it
+// consistent. The caller must close it.
+func (c *Client) BaseBackup(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/base-backup", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// SetWALArchiving turns archiving on or off. While it is on, Postgres
+// switches to a new WAL segment at least every timeout and the agent keeps
+// completed segments until they are deleted with DeleteWALSegment.
+func (c *Client) SetWALArchiving(ctx context.Context, enabled bool, timeout time.Duration) error {
+	body := map[string]interface{}{"enabled": enabled, "archive_timeout_seconds": int(timeout.Seconds())}
+	return c.do(ctx, http.MethodPut, "/wal-archiving", body, nil)
+}
+
+// WALSegments switches to a new WAL segment, so everything written so far
+// can be archived, and returns the completed segments the agent keeps,
+// oldest first.
+func (c *Client) WALSegments(ctx context.Context) ([]WALSegment, error) {
+	var out struct {
+		Segments []WALSegment `json:"segments"`
+	}
+	err := c.do(ctx, http.MethodPost, "/wal/switch", nil, &out)
+	return out.Segments, err
+}
+
+// ReadWALSegment streams the WAL segment name. The caller must close it.
+func (c *Client) ReadWALSegment(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/wal/"+url.PathEscape(name), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteWALSegment lets the agent drop the WAL segment name once it is
+// archived. A segment that is already gone is not an error.
+func (c *Client) DeleteWALSegment(ctx context.Context, name string) error {
+	err := c.do(ctx, http.MethodDelete, "/wal/"+url.PathEscape(name), nil, nil)
+	if e, ok := err.(*APIError); ok && e.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// RestoreBaseBackup stops Postgres and replaces its data directory with a
+// base backup, as streamed by BaseBackup. Staged WAL segments are dropped.
+func (c *Client) RestoreBaseBackup(ctx context.Context, archive io.Reader) error {
+	resp, err := c.send(ctx, http.MethodPut, "/restore/base-backup", "application/gzip", archive)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// RestoreWALSegment stages the WAL segment name for Recover to replay.
+func (c *Client) RestoreWALSegment(ctx context.Context, name string, segment io.Reader) error {
+	resp, err := c.send(ctx, http.MethodPut, "/restore/wal/"+url.PathEscape(name), "application/octet-stream", segment)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Recover starts Postgres from the restored base backup, replays the
+// staged WAL up to target and promotes it to accept writes. It returns
+// once Postgres is ready, however long replaying takes.
+func (c *Client) Recover(ctx context.Context, target RecoveryTarget) (RecoveryPoint, error) {
+	var point RecoveryPoint
+	err := c.call(ctx, http.MethodPost, "/restore", target, &point)
+	return point, err
+}
+
+// do is call bounded by requestTimeout.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	return c.call(ctx, method, path, in, out)
+}
+
+// call sends in as JSON, if not nil, and decodes the response into out, if
+// not nil.
+func (c *Client) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	resp, err := c.send(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode guest agent response: %w", err)
+	}
+	return nil
+}
+
+// send sends body, if not nil, and returns the response if its status is
+// 2xx, or an *APIError.
+func (c *Client) send(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("guest agent request failed: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, &APIError{Status: resp.StatusCode, Message: e.Error}
+	}
+	return resp, nil
+}
+
+// Agents finds the agent of a container.
+type Agents struct {
+	cfg     config.GuestConfig
+	cluster *proxmox.Cluster
+}
+
+func NewAgents(cfg config.GuestConfig, cluster *proxmox.Cluster) *Agents {
+	return &Agents{cfg: cfg, cluster: cluster}
+}
+
+// For returns a client for the agent of container vmid on node, which must
+// be running when the URL needs its address.
+func (a *Agents) For(ctx context.Context, node string, vmid int) (*Client, error) {
+	base := strings.ReplaceAll(a.cfg.URL, "{vmid}", strconv.Itoa(vmid))
+	if strings.Contains(base, "{address}") {
+		client, err := a.cluster.Client(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := client.ContainerAddress(ctx, node, vmid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get address of container %d: %w", vmid, err)
+		}
+		base = strings.ReplaceAll(base, "{address}", addr)
+	}
+	return NewClient(base, a.cfg.Token), nil
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"github.com/zallarak/db/api/internal/apierror"
 	"github.com/zallarak/db/api/internal/auth"
 	"github.com/gin-gonic/gin"
 )
@@ -28,17 +29,17 @@ type LoginRequest struct {
 func (h *AuthHandler) Register(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierror.Bind(c, err)
 		return
 	}
 
-	user, err := h.authService.Register(req.Email, req.Password)
+	user, err := h.authService.Register(c.Request.Context(), req.Email, req.Password)
 	if err == auth.ErrUserExists {
-		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		apierror.Conflict(c, "User already exists")
 		return
 	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		apierror.Internal(c, err, "Failed to create user")
 		return
 	}
 
@@ -51,17 +52,17 @@ func (h *AuthHandler) Register(c *gin.Context) {
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierror.Bind(c, err)
 		return
 	}
 
-	token, user, err := h.authService.Login(req.Email, req.Password)
+	token, user, err := h.authService.Login(c.Request.Context(), req.Email, req.Password)
 	if err == auth.ErrInvalidCredentials {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "Invalid credentials")
 		return
 	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Login failed"})
+		apierror.Internal(c, err, "Login failed")
 		return
 	}
 
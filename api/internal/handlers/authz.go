@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// Authorizer checks the caller's role in an org before a handler acts on
+// it. Every org-scoped handler goes through RequireRole.
+type Authorizer struct {
+	memberships store.Memberships
+	ssoService  *auth.SSOService
+}
+
+// NewAuthorizer returns an Authorizer. ssoService may be nil when SSO is
+// unavailable, in which case SSO-only orgs aren't enforced.
+func NewAuthorizer(memberships store.Memberships, ssoService *auth.SSOService) *Authorizer {
+	return &Authorizer{memberships: memberships, ssoService: ssoService}
+}
+
+// RequireRole returns the caller's role in orgID if it ranks at least
+// minRole and the org's SSO requirement is met. Otherwise it responds with
+// an error and returns false.
+func (a *Authorizer) RequireRole(c *gin.Context, orgID string, minRole models.UserRole) (models.UserRole, bool) {
+	ctx := c.Request.Context()
+
+	role, err := store.RequireRole(ctx, a.memberships, c.GetString("user_id"), orgID, minRole)
+	if err == store.ErrNotMember {
+		apierror.Forbidden(c, "Access denied")
+		return "", false
+	}
+	if err != nil && err != store.ErrInsufficientRole {
+		apierror.Internal(c, err, "Failed to check access")
+		return "", false
+	}
+
+	// SSO is checked before the role so members of an SSO-only org learn
+	// they need to sign in again rather than that they lack permissions
+	if a.ssoService != nil {
+		err := a.ssoService.CheckOrgAccess(ctx, orgID, role, c.GetString("sso_org_id"))
+		if err == auth.ErrSSORequired {
+			apierror.Respond(c, http.StatusForbidden, apierror.CodeSSORequired, "Organization requires SSO login")
+			return "", false
+		}
+		if err != nil {
+			apierror.Internal(c, err, "Failed to check access")
+			return "", false
+		}
+	}
+
+	if !role.AtLeast(minRole) {
+		apierror.Forbidden(c, "Insufficient permissions: requires the "+string(minRole)+" role")
+		return "", false
+	}
+	return role, true
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/cron"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRetentionDays is the retention of backup policies that don't set
+// one, as in the backup_policies table.
+const defaultRetentionDays = 7
+
+// CreateBackupRequest is the optional body of an on-demand backup.
+type CreateBackupRequest struct {
+	// RetentionDays defaults to the instance's backup policy, if any, or
+	// else to backups.retention_days.
+	RetentionDays int `json:"retention_days" binding:"omitempty,min=1,max=3650"`
+}
+
+// BackupPolicyRequest sets the backup schedule of an instance.
+type BackupPolicyRequest struct {
+	// Schedule is a five-field cron expression, evaluated in UTC.
+	Schedule      string `json:"schedule" binding:"required,max=100"`
+	RetentionDays int    `json:"retention_days" binding:"omitempty,min=1,max=3650"`
+	// WALArchiving defaults to true.
+	WALArchiving *bool `json:"wal_archiving"`
+}
+
+// ListBackups returns the backups of an instance, newest first, and the
+// window it can be restored to any point of, or null if its archived WAL
+// doesn't follow on from a completed backup.
+func (h *InstanceHandler) ListBackups(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	backups, err := h.store.Backups().ListByInstance(ctx, instance.ID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get backups")
+		return
+	}
+	segments, err := h.store.WALSegments().ListByInstance(ctx, instance.ID, "")
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get archived WAL")
+		return
+	}
+
+	var window *models.RecoveryWindow
+	for i := range backups {
+		if w := recoveryWindow(&backups[i], segments); w != nil && (window == nil || w.FromTime.Before(window.FromTime)) {
+			window = w
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"backups": backups, "recovery_window": window})
+}
+
+// CreateBackup enqueues a backup of a running instance. Only one backup of
+// an instance runs at a time.
+func (h *InstanceHandler) CreateBackup(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req CreateBackupRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Bind(c, err)
+		return
+	}
+
+	if instance.Status != models.InstanceRunning {
+		apierror.Conflict(c, "Instance is "+instance.Status+"; only running instances can be backed up")
+		return
+	}
+
+	ctx := c.Request.Context()
+	var (
+		backup  *models.Backup
+		job     *models.Job
+		message string
+	)
+	err := h.store.InTx(ctx, func(tx store.Store) error {
+		// The scheduler takes the same lock before starting a backup
+		if err := tx.Orgs().Lock(ctx, project.OrgID); err != nil {
+			return err
+		}
+		backups, err := tx.Backups().ListByInstance(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+		for _, b := range backups {
+			if b.Status == models.BackupPending || b.Status == models.BackupRunning {
+				message = "A backup of the instance is already in progress"
+				return store.ErrConflict
+			}
+		}
+
+		retention := req.RetentionDays
+		if retention == 0 {
+			policy, err := tx.BackupPolicies().GetByInstance(ctx, instance.ID)
+			switch {
+			case err == nil:
+				retention = policy.RetentionDays
+			case err != store.ErrNotFound:
+				return err
+			}
+		}
+
+		backup = &models.Backup{InstanceID: instance.ID, Kind: models.BackupManual, Status: models.BackupPending}
+		if err := tx.Backups().Create(ctx, backup); err != nil {
+			return err
+		}
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeBackupInstance, jobs.BackupPayload{
+			InstanceID:    instance.ID,
+			OrgID:         project.OrgID,
+			BackupID:      backup.ID,
+			RetentionDays: retention,
+		})
+		return err
+	})
+	if err == store.ErrConflict {
+		apierror.Conflict(c, message)
+		return
+	}
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to back up instance")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"backup": backup, "job_id": job.ID})
+}
+
+// GetBackupPolicy returns the backup schedule of an instance.
+func (h *InstanceHandler) GetBackupPolicy(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	policy, err := h.store.BackupPolicies().GetByInstance(c.Request.Context(), instance.ID)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance has no backup policy")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get backup policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// PutBackupPolicy creates or replaces the backup schedule of an instance.
+// The next backup is the schedule's first run from now, and WAL archiving,
+// if on, starts right away. Turning it off enqueues an archive_wal job
+// that ships the WAL not yet archived and stops archiving on the instance.
+func (h *InstanceHandler) PutBackupPolicy(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req BackupPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+	schedule, err := cron.Parse(req.Schedule)
+	if err != nil {
+		apierror.Validation(c, apierror.FieldError{Field: "schedule", Code: "cron", Message: err.Error()})
+		return
+	}
+	if req.RetentionDays == 0 {
+		req.RetentionDays = defaultRetentionDays
+	}
+	if req.WALArchiving == nil {
+		walArchiving := true
+		req.WALArchiving = &walArchiving
+	}
+
+	now := time.Now()
+	policy := &models.BackupPolicy{
+		InstanceID:       instance.ID,
+		Schedule:         req.Schedule,
+		RetentionDays:    req.RetentionDays,
+		NextRunAt:        schedule.Next(now),
+		WALArchiving:     *req.WALArchiving,
+		NextWALArchiveAt: now,
+	}
+	ctx := c.Request.Context()
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.BackupPolicies().Put(ctx, policy); err != nil {
+			return err
+		}
+		if policy.WALArchiving {
+			return nil
+		}
+		return h.stopWALArchiving(ctx, tx, instance, project)
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to set backup policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// DeleteBackupPolicy stops scheduled backups and WAL archiving of an
+// instance. Its backups and archived WAL are kept until the backups
+// expire.
+func (h *InstanceHandler) DeleteBackupPolicy(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	err := h.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.BackupPolicies().DeleteByInstance(ctx, instance.ID); err != nil {
+			return err
+		}
+		return h.stopWALArchiving(ctx, tx, instance, project)
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance has no backup policy")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete backup policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Backup policy deleted successfully"})
+}
+
+// stopWALArchiving enqueues the archive_wal job that turns WAL archiving
+// off on an instance whose policy no longer archives it, if it is running
+// and its agent can be reached.
+func (h *InstanceHandler) stopWALArchiving(ctx context.Context, tx store.Store, instance *models.Instance, project *models.Project) error {
+	if instance.Status != models.InstanceRunning {
+		return nil
+	}
+	_, err := jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeArchiveWAL, jobs.InstancePayload{
+		InstanceID: instance.ID,
+		OrgID:      project.OrgID,
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/gin-gonic/gin"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// devicePage is the verification page of device logins, where a user enters
+// their code, signs in with a password or SSO, and approves or denies.
+//
+//go:embed device.html
+var devicePage []byte
+
+type DeviceHandler struct {
+	deviceService *auth.DeviceService
+}
+
+func NewDeviceHandler(deviceService *auth.DeviceService) *DeviceHandler {
+	return &DeviceHandler{deviceService: deviceService}
+}
+
+type DeviceCodeRequest struct {
+	ClientID string `form:"client_id" json:"client_id"`
+}
+
+type DeviceTokenRequest struct {
+	GrantType  string `form:"grant_type" json:"grant_type" binding:"required"`
+	DeviceCode string `form:"device_code" json:"device_code" binding:"required"`
+}
+
+type DeviceDecisionRequest struct {
+	UserCode string `json:"user_code" binding:"required"`
+	Action   string `json:"action" binding:"required,oneof=approve deny"`
+}
+
+// RequestCode starts a device authorization. Like the token endpoint it
+// accepts form-encoded bodies as required by RFC 8628, as well as JSON, and
+// answers errors in the OAuth format rather than the usual error envelope.
+func (h *DeviceHandler) RequestCode(c *gin.Context) {
+	var req DeviceCodeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	if req.ClientID == "" {
+		req.ClientID = "dbx-cli"
+	}
+
+	authz, err := h.deviceService.Start(c.Request.Context(), req.ClientID)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to start device authorization", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, authz)
+}
+
+// Token is polled by the device. Pending and failed polls answer with the
+// RFC 8628 error codes so standard clients can drive the loop.
+func (h *DeviceHandler) Token(c *gin.Context) {
+	var req DeviceTokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	if req.GrantType != deviceCodeGrantType {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	token, user, err := h.deviceService.Poll(c.Request.Context(), req.DeviceCode)
+	switch err {
+	case nil:
+	case auth.ErrAuthorizationPending, auth.ErrSlowDown, auth.ErrAccessDenied,
+		auth.ErrExpiredToken, auth.ErrInvalidDeviceCode:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		logging.FromContext(c.Request.Context()).Error("failed to check device authorization", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(auth.TokenTTL.Seconds()),
+		"user":         user,
+	})
+}
+
+// Page serves the verification page. It must not be framed, so a site can't
+// trick a signed-in user into clicking Approve.
+func (h *DeviceHandler) Page(c *gin.Context) {
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", devicePage)
+}
+
+// GetRequest lets a signed-in user review a pending request before deciding.
+func (h *DeviceHandler) GetRequest(c *gin.Context) {
+	req, err := h.deviceService.Lookup(c.Request.Context(), c.Param("userCode"))
+	if err == auth.ErrUnknownUserCode {
+		apierror.NotFound(c, "Unknown or expired code")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get device authorization")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"device": req})
+}
+
+func (h *DeviceHandler) Decide(c *gin.Context) {
+	var req DeviceDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	approve := req.Action == "approve"
+	err := h.deviceService.Decide(c.Request.Context(), req.UserCode, c.GetString("user_id"), c.GetString("sso_org_id"), approve)
+	if err == auth.ErrUnknownUserCode {
+		apierror.NotFound(c, "Unknown or expired code")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to update device authorization")
+		return
+	}
+
+	if approve {
+		c.JSON(http.StatusOK, gin.H{"message": "Device approved"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Device denied"})
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateDomainRequest names a custom domain to point at an instance.
+type CreateDomainRequest struct {
+	Name string `json:"name" binding:"required,max=253"`
+}
+
+// ListDomains returns the custom domains of an instance, by name.
+func (h *InstanceHandler) ListDomains(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	domains, err := h.store.Domains().ListByInstance(c.Request.Context(), instance.ID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get domains")
+		return
+	}
+	for i := range domains {
+		domains[i].CNAMETarget = h.cnameTarget(instance)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domains": domains})
+}
+
+// CreateDomain adds a pending custom domain to an instance and enqueues its
+// first check. The response holds the TXT record that proves ownership of
+// the domain; until it is found the scheduler checks again every
+// domains.check_interval, for up to domains.verification_timeout.
+func (h *InstanceHandler) CreateDomain(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req CreateDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+	name, err := customdomain.Normalize(req.Name, h.zone)
+	if err != nil {
+		apierror.Validation(c, apierror.FieldError{Field: "name", Code: "hostname", Message: err.Error()})
+		return
+	}
+	token, err := customdomain.NewToken()
+	if err != nil {
+		apierror.Internal(c, err, "Failed to add domain")
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	next := now.Add(h.domains.CheckInterval)
+	domain := &models.Domain{
+		InstanceID:        instance.ID,
+		Name:              name,
+		Status:            models.DomainPending,
+		VerificationName:  customdomain.ChallengeName(name),
+		VerificationValue: token,
+		NextCheckAt:       &next,
+		ExpiresAt:         now.Add(h.domains.VerificationTimeout),
+		CreatedBy:         c.GetString("user_id"),
+	}
+	var (
+		job     *models.Job
+		message string
+	)
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		domains, err := tx.Domains().ListByInstance(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+		if len(domains) >= customdomain.MaxPerInstance {
+			message = "Instance already has the most custom domains allowed"
+			return store.ErrConflict
+		}
+		if err := tx.Domains().Create(ctx, domain); err != nil {
+			if err == store.ErrConflict {
+				message = "Instance already has the domain " + name
+			}
+			return err
+		}
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeVerifyDomain, jobs.DomainPayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+			DomainID:   domain.ID,
+		})
+		return err
+	})
+	if err == store.ErrConflict {
+		apierror.Conflict(c, message)
+		return
+	}
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to add domain")
+		return
+	}
+
+	domain.CNAMETarget = h.cnameTarget(instance)
+	c.JSON(http.StatusAccepted, gin.H{"domain": domain, "job_id": job.ID})
+}
+
+// GetDomain returns a custom domain of an instance.
+func (h *InstanceHandler) GetDomain(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+	domain, ok := h.domain(c, instance)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain})
+}
+
+// VerifyDomain enqueues a check of a custom domain now rather than at its
+// next scheduled check. A failed domain goes back to pending with a new
+// expiry, so it can be verified once its record is fixed.
+func (h *InstanceHandler) VerifyDomain(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+	domain, ok := h.domain(c, instance)
+	if !ok {
+		return
+	}
+	if domain.Status == models.DomainVerified {
+		apierror.Conflict(c, "Domain is already verified")
+		return
+	}
+
+	ctx := c.Request.Context()
+	var job *models.Job
+	err := h.store.InTx(ctx, func(tx store.Store) error {
+		if domain.Status == models.DomainFailed {
+			now := time.Now()
+			next := now.Add(h.domains.CheckInterval)
+			domain.Status = models.DomainPending
+			domain.NextCheckAt = &next
+			domain.ExpiresAt = now.Add(h.domains.VerificationTimeout)
+			if err := tx.Domains().Update(ctx, domain); err != nil {
+				return err
+			}
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeVerifyDomain, jobs.DomainPayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+			DomainID:   domain.ID,
+		})
+		return err
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Domain not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to verify domain")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"domain": domain, "job_id": job.ID})
+}
+
+// DeleteDomain removes a custom domain from an instance. A verified one is
+// also dropped from the instance's certificate, by an issue_certificate
+// job; the customer's own records are left to them.
+func (h *InstanceHandler) DeleteDomain(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleAdmin)
+	if !ok {
+		return
+	}
+	domain, ok := h.domain(c, instance)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var job *models.Job
+	err := h.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Domains().Delete(ctx, domain.ID); err != nil {
+			return err
+		}
+		if domain.Status != models.DomainVerified {
+			return nil
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeIssueCertificate, jobs.InstancePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+		})
+		return err
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Domain not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete domain")
+		return
+	}
+
+	if job == nil {
+		c.JSON(http.StatusOK, gin.H{"message": "Domain deleted successfully"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Domain deleted successfully", "job_id": job.ID})
+}
+
+// cnameTarget returns the name the domains of instance are pointed at: the
+// domain proxy, which routes them by TLS server name, or else the
+// instance's FQDN.
+func (h *InstanceHandler) cnameTarget(instance *models.Instance) string {
+	if h.domains.ProxyPort != 0 {
+		return h.domains.ProxyHost
+	}
+	return instance.FQDN
+}
+
+// domain returns the custom domain of instance in the path, or responds
+// with an error and returns false.
+func (h *InstanceHandler) domain(c *gin.Context, instance *models.Instance) (*models.Domain, bool) {
+	domain, err := h.store.Domains().Get(c.Request.Context(), c.Param("domainId"))
+	if err == store.ErrNotFound || (err == nil && domain.InstanceID != instance.ID) {
+		apierror.NotFound(c, "Domain not found")
+		return nil, false
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get domain")
+		return nil, false
+	}
+	domain.CNAMETarget = h.cnameTarget(instance)
+	return domain, true
+}
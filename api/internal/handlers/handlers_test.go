@@ -0,0 +1,331 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/apispec"
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/handlers"
+	"github.com/zallarak/db/api/internal/middleware"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// testEnv serves a subset of the API's routes from a memory store, behind
+// the strict validator of --dev so that every test also checks its traffic
+// against the API specification.
+type testEnv struct {
+	store  *store.Memory
+	auth   *auth.Service
+	router *gin.Engine
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	st := store.NewMemory()
+	authService := auth.NewService(st.Users(), "test-secret-test-secret-test-secret", nil)
+	authz := handlers.NewAuthorizer(st.Memberships(), nil)
+	authHandler := handlers.NewAuthHandler(authService)
+	userHandler := handlers.NewUserHandler(st.Users())
+	orgHandler := handlers.NewOrgHandler(st, authz)
+	projectHandler := handlers.NewProjectHandler(st, authz)
+	deviceHandler := handlers.NewDeviceHandler(auth.NewDeviceService(st, authService, "http://127.0.0.1/device"))
+
+	doc, err := apispec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	// The validator turns a response that doesn't match the specification
+	// into a 500, which tests expecting another status would report
+	// without the reason
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		if c.Writer.Status() == http.StatusInternalServerError {
+			t.Errorf("%s %s: %v", c.Request.Method, c.Request.URL.Path, c.Errors)
+		}
+	})
+	r.Use(apispec.NewValidator(doc, apispec.ModeStrict).Middleware())
+	v1 := r.Group("/v1")
+	v1.POST("/auth/login", authHandler.Login)
+	v1.POST("/auth/device/code", deviceHandler.RequestCode)
+	v1.POST("/auth/device/token", deviceHandler.Token)
+	protected := v1.Group("/")
+	protected.Use(middleware.AuthRequired(authService))
+	protected.GET("/users/me", userHandler.GetCurrentUser)
+	protected.GET("/auth/device/:userCode", deviceHandler.GetRequest)
+	protected.POST("/auth/device/decision", deviceHandler.Decide)
+	protected.GET("/orgs", orgHandler.ListOrgs)
+	protected.POST("/orgs", orgHandler.CreateOrg)
+	protected.GET("/orgs/:orgId", orgHandler.GetOrg)
+	protected.PATCH("/orgs/:orgId", orgHandler.UpdateOrg)
+	protected.DELETE("/orgs/:orgId", orgHandler.DeleteOrg)
+	protected.GET("/orgs/:orgId/projects", projectHandler.ListProjects)
+	protected.POST("/orgs/:orgId/projects", projectHandler.CreateProject)
+
+	// The validator passes undocumented routes through unchecked; the
+	// operations these tests leave out are expected
+	for _, problem := range apispec.CheckRoutes(doc, r.Routes()) {
+		if strings.HasSuffix(problem, " is not documented") {
+			t.Fatal(problem)
+		}
+	}
+
+	return &testEnv{store: st, auth: authService, router: r}
+}
+
+// user registers a user and returns a session token for them.
+func (e *testEnv) user(t *testing.T, email string) (*models.User, string) {
+	t.Helper()
+	user, err := e.auth.Register(context.Background(), email, "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := e.auth.IssueToken(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// do sends a request with body as JSON, or as a form if it is url.Values,
+// and decodes the JSON response into out unless out is nil.
+func (e *testEnv) do(t *testing.T, method, path, token string, body, out any) int {
+	t.Helper()
+	var req *http.Request
+	switch b := body.(type) {
+	case nil:
+		req = httptest.NewRequest(method, path, nil)
+	case url.Values:
+		req = httptest.NewRequest(method, path, strings.NewReader(b.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = httptest.NewRequest(method, path, bytes.NewReader(raw))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestOrgRoles(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	_, ownerToken := e.user(t, "owner@example.com")
+
+	var created struct{ Org models.Org }
+	if code := e.do(t, http.MethodPost, "/v1/orgs", ownerToken, map[string]string{"name": "Acme"}, &created); code != http.StatusCreated {
+		t.Fatalf("create org: status %d", code)
+	}
+	orgPath := "/v1/orgs/" + created.Org.ID
+
+	tokens := map[models.UserRole]string{models.RoleOwner: ownerToken}
+	for _, role := range []models.UserRole{models.RoleAdmin, models.RoleMember, models.RoleViewer} {
+		user, token := e.user(t, string(role)+"@example.com")
+		err := e.store.Memberships().Create(ctx, &models.Membership{UserID: user.ID, OrgID: created.Org.ID, Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[role] = token
+	}
+	_, outsiderToken := e.user(t, "outsider@example.com")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   map[models.UserRole]int
+	}{
+		{"get org", http.MethodGet, orgPath, nil, map[models.UserRole]int{
+			models.RoleViewer: http.StatusOK, models.RoleMember: http.StatusOK,
+		}},
+		{"create project", http.MethodPost, orgPath + "/projects", map[string]string{"name": "p"}, map[models.UserRole]int{
+			models.RoleViewer: http.StatusForbidden,
+		}},
+		{"rename org", http.MethodPatch, orgPath, map[string]string{"name": "Acme Inc"}, map[models.UserRole]int{
+			models.RoleMember: http.StatusForbidden, models.RoleAdmin: http.StatusOK,
+		}},
+		{"delete org", http.MethodDelete, orgPath, nil, map[models.UserRole]int{
+			models.RoleAdmin: http.StatusForbidden,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := e.do(t, tt.method, tt.path, outsiderToken, tt.body, nil); code != http.StatusForbidden {
+				t.Errorf("non-member: status %d, want 403", code)
+			}
+			for role, want := range tt.want {
+				if code := e.do(t, tt.method, tt.path, tokens[role], tt.body, nil); code != want {
+					t.Errorf("%s: status %d, want %d", role, code, want)
+				}
+			}
+		})
+	}
+
+	var got struct {
+		Org  models.Org
+		Role models.UserRole
+	}
+	if code := e.do(t, http.MethodGet, orgPath, tokens[models.RoleViewer], nil, &got); code != http.StatusOK {
+		t.Fatalf("get org: status %d", code)
+	}
+	if got.Org.Name != "Acme Inc" || got.Role != models.RoleViewer {
+		t.Errorf("get org = %+v", got)
+	}
+
+	// Deleting is a job, which the owner may start
+	var deleted struct {
+		JobID string `json:"job_id"`
+	}
+	if code := e.do(t, http.MethodDelete, orgPath, ownerToken, nil, &deleted); code != http.StatusAccepted || deleted.JobID == "" {
+		t.Errorf("owner deleting the org: status %d, job %q", code, deleted.JobID)
+	}
+}
+
+func TestListOrgsOfCaller(t *testing.T) {
+	e := newTestEnv(t)
+	_, aliceToken := e.user(t, "alice@example.com")
+	_, bobToken := e.user(t, "bob@example.com")
+
+	for _, name := range []string{"One", "Two"} {
+		if code := e.do(t, http.MethodPost, "/v1/orgs", aliceToken, map[string]string{"name": name}, nil); code != http.StatusCreated {
+			t.Fatalf("create org: status %d", code)
+		}
+	}
+
+	var list struct{ Orgs []models.Org }
+	if code := e.do(t, http.MethodGet, "/v1/orgs", aliceToken, nil, &list); code != http.StatusOK || len(list.Orgs) != 2 {
+		t.Errorf("alice's orgs: status %d, %d orgs, want 2", code, len(list.Orgs))
+	}
+	list.Orgs = nil
+	if code := e.do(t, http.MethodGet, "/v1/orgs", bobToken, nil, &list); code != http.StatusOK || len(list.Orgs) != 0 {
+		t.Errorf("bob's orgs: status %d, %d orgs, want none", code, len(list.Orgs))
+	}
+}
+
+func TestCreateProject(t *testing.T) {
+	e := newTestEnv(t)
+	_, token := e.user(t, "owner@example.com")
+
+	var created struct{ Org models.Org }
+	if code := e.do(t, http.MethodPost, "/v1/orgs", token, map[string]string{"name": "Acme"}, &created); code != http.StatusCreated {
+		t.Fatalf("create org: status %d", code)
+	}
+	path := "/v1/orgs/" + created.Org.ID + "/projects"
+
+	if code := e.do(t, http.MethodPost, path, token, map[string]string{"name": "web"}, nil); code != http.StatusCreated {
+		t.Fatalf("create project: status %d", code)
+	}
+	if code := e.do(t, http.MethodPost, path, token, map[string]string{"name": "web"}, nil); code != http.StatusConflict {
+		t.Errorf("create a project with a taken name: status %d, want 409", code)
+	}
+	if code := e.do(t, http.MethodPost, path, token, map[string]string{}, nil); code != http.StatusBadRequest {
+		t.Errorf("create a project without a name: status %d, want 400", code)
+	}
+
+	var list struct{ Projects []models.Project }
+	if code := e.do(t, http.MethodGet, path, token, nil, &list); code != http.StatusOK || len(list.Projects) != 1 || list.Projects[0].Name != "web" {
+		t.Errorf("list projects: status %d, %+v", code, list.Projects)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	e := newTestEnv(t)
+
+	if code := e.do(t, http.MethodGet, "/v1/users/me", "", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("no token: status %d, want 401", code)
+	}
+	if code := e.do(t, http.MethodGet, "/v1/users/me", "not-a-token", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("invalid token: status %d, want 401", code)
+	}
+
+	user, token := e.user(t, "me@example.com")
+	var me struct{ User models.User }
+	if code := e.do(t, http.MethodGet, "/v1/users/me", token, nil, &me); code != http.StatusOK || me.User.ID != user.ID {
+		t.Errorf("users/me: status %d, %+v", code, me.User)
+	}
+}
+
+func TestDeviceLoginEndpoints(t *testing.T) {
+	e := newTestEnv(t)
+	user, token := e.user(t, "me@example.com")
+
+	var start auth.DeviceAuthorization
+	if code := e.do(t, http.MethodPost, "/v1/auth/device/code", "", url.Values{"client_id": {"dbx-cli"}}, &start); code != http.StatusOK {
+		t.Fatalf("device code: status %d", code)
+	}
+	poll := url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {start.DeviceCode},
+		"client_id":   {"dbx-cli"},
+	}
+
+	var pending struct{ Error string }
+	if code := e.do(t, http.MethodPost, "/v1/auth/device/token", "", poll, &pending); code != http.StatusBadRequest || pending.Error != "authorization_pending" {
+		t.Fatalf("poll before approval: status %d, %+v", code, pending)
+	}
+
+	var req struct{ Device auth.DeviceRequest }
+	if code := e.do(t, http.MethodGet, "/v1/auth/device/"+start.UserCode, token, nil, &req); code != http.StatusOK || req.Device.ClientID != "dbx-cli" {
+		t.Fatalf("get device request: status %d, %+v", code, req)
+	}
+	if code := e.do(t, http.MethodGet, "/v1/auth/device/"+start.UserCode, "", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("get device request without a session: status %d, want 401", code)
+	}
+
+	// As if the device had waited its poll interval since
+	authz, err := e.store.DeviceAuthorizations().GetPending(context.Background(), start.UserCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz.LastPolledAt = nil
+	if err := e.store.DeviceAuthorizations().Update(context.Background(), authz); err != nil {
+		t.Fatal(err)
+	}
+
+	decision := map[string]string{"user_code": start.UserCode, "action": "approve"}
+	if code := e.do(t, http.MethodPost, "/v1/auth/device/decision", token, decision, nil); code != http.StatusOK {
+		t.Fatalf("approve: status %d", code)
+	}
+	if code := e.do(t, http.MethodPost, "/v1/auth/device/decision", token, decision, nil); code != http.StatusNotFound {
+		t.Errorf("approve again: status %d, want 404", code)
+	}
+
+	var issued struct {
+		AccessToken string `json:"access_token"`
+		User        models.User
+	}
+	if code := e.do(t, http.MethodPost, "/v1/auth/device/token", "", poll, &issued); code != http.StatusOK {
+		t.Fatalf("poll after approval: status %d", code)
+	}
+	if issued.User.ID != user.ID {
+		t.Errorf("token issued for %+v, want %s", issued.User, user.ID)
+	}
+	if code := e.do(t, http.MethodGet, "/v1/users/me", issued.AccessToken, nil, nil); code != http.StatusOK {
+		t.Errorf("users/me with the device token: status %d", code)
+	}
+}
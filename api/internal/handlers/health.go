@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/zallarak/db/api/internal/migrate"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// readyCheckTimeout bounds each dependency check so a hung database makes
+// /readyz fail rather than hang.
+const readyCheckTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	db               *sql.DB
+	workers          store.Workers
+	migrator         *migrate.Migrator
+	heartbeatTimeout time.Duration
+	draining         atomic.Bool
+}
+
+// NewHealthHandler returns a HealthHandler. db and migrator are nil with
+// the memory store, which skips their checks.
+func NewHealthHandler(db *sql.DB, workers store.Workers, migrator *migrate.Migrator, heartbeatTimeout time.Duration) *HealthHandler {
+	return &HealthHandler{
+		db:               db,
+		workers:          workers,
+		migrator:         migrator,
+		heartbeatTimeout: heartbeatTimeout,
+	}
+}
+
+type check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Drain makes /readyz fail so load balancers stop routing new requests while
+// the server shuts down.
+func (h *HealthHandler) Drain() {
+	h.draining.Store(true)
+}
+
+// Livez reports that the process is up and serving HTTP. It deliberately
+// checks nothing else, so a database outage doesn't get the server restarted.
+func (h *HealthHandler) Livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether the server can do useful work: the database is
+// reachable, its schema is current and some worker is processing jobs.
+func (h *HealthHandler) Readyz(c *gin.Context) {
+	if h.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyCheckTimeout)
+	defer cancel()
+
+	checks := gin.H{}
+	ready := true
+	fail := func(name string, err string) {
+		checks[name] = check{Status: "fail", Error: err}
+		ready = false
+	}
+
+	if h.db != nil {
+		if err := h.db.PingContext(ctx); err != nil {
+			fail("database", "Database is unreachable")
+		} else {
+			checks["database"] = check{Status: "ok"}
+		}
+	}
+
+	// A schema newer than this binary is fine during a rolling deploy
+	if h.migrator != nil {
+		version, err := h.migrator.Version(ctx)
+		switch {
+		case err != nil:
+			fail("migrations", "Failed to get schema version")
+		case version < h.migrator.Latest():
+			fail("migrations", "Pending schema migrations")
+		default:
+			checks["migrations"] = gin.H{"status": "ok", "version": version}
+		}
+	}
+
+	last, err := h.workers.LastHeartbeat(ctx)
+	switch {
+	case err != nil:
+		fail("worker", "Failed to get worker heartbeat")
+	case time.Since(last) > h.heartbeatTimeout:
+		fail("worker", "No worker heartbeat")
+	default:
+		checks["worker"] = gin.H{"status": "ok", "last_heartbeat": last}
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/quota"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPgVersion is used when a create request doesn't name a version
+// and the plan supports it; otherwise the plan's newest version is.
+const defaultPgVersion = 16
+
+type InstanceHandler struct {
+	store   store.Store
+	quotas  *quota.Checker
+	network *netpolicy.Compiler
+	authz   *Authorizer
+	// zone is the instance zone, which custom domains can't be in
+	zone    string
+	domains config.DomainsConfig
+	// agents report how much disk instances use; nil skips the check
+	agents *guest.Agents
+}
+
+func NewInstanceHandler(s store.Store, quotas *quota.Checker, network *netpolicy.Compiler, authz *Authorizer, zone string, domains config.DomainsConfig, agents *guest.Agents) *InstanceHandler {
+	return &InstanceHandler{store: s, quotas: quotas, network: network, authz: authz, zone: zone, domains: domains, agents: agents}
+}
+
+// CreateInstanceRequest is checked against the plan catalog once bound; see
+// checkPlan.
+type CreateInstanceRequest struct {
+	Name      string `json:"name" binding:"required,max=63"`
+	Plan      string `json:"plan" binding:"required"`
+	PgVersion int    `json:"pg_version"`
+	// DiskGiB overrides the disk size of the plan.
+	DiskGiB int `json:"disk_gib"`
+}
+
+// ResizeInstanceRequest names the plan and disk size to move to; either may
+// be left out to keep the current one. See checkResize.
+type ResizeInstanceRequest struct {
+	Plan    string `json:"plan"`
+	DiskGiB int    `json:"disk_gib" binding:"omitempty,min=1"`
+}
+
+func (h *InstanceHandler) ListInstances(c *gin.Context) {
+	project, ok := h.project(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	instances, err := h.store.Instances().ListByProject(c.Request.Context(), project.ID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get instances")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"instances": instances})
+}
+
+// CreateInstance records a pending instance and enqueues the job that
+// provisions it. The instance and its job are created together, so an
+// instance is never left without a job to move it along, and in the same
+// transaction as the quota check so concurrent creates can't both fit.
+func (h *InstanceHandler) CreateInstance(c *gin.Context) {
+	project, ok := h.project(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req CreateInstanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	plans, err := h.store.Plans().List(ctx)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get plans")
+		return
+	}
+	if details := checkPlan(plans, &req); len(details) > 0 {
+		apierror.Validation(c, details...)
+		return
+	}
+
+	instance := models.Instance{
+		ProjectID: project.ID,
+		Name:      req.Name,
+		Plan:      req.Plan,
+		PgVersion: req.PgVersion,
+		DiskGiB:   req.DiskGiB,
+		Status:    models.InstancePending,
+	}
+	var job *models.Job
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		if err := h.quotas.Check(ctx, tx, project, &instance); err != nil {
+			return err
+		}
+		if err := tx.Instances().Create(ctx, &instance); err != nil {
+			return err
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeCreateInstance, jobs.InstancePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+		})
+		return err
+	})
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeQuotaExceeded, exceeded.Error())
+		return
+	}
+	if err == store.ErrConflict {
+		apierror.Conflict(c, "An instance with this name already exists in the project")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to create instance")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"instance": instance,
+		"job_id":   job.ID,
+	})
+}
+
+// checkPlan checks req against its plan in the catalog and fills in the
+// plan's defaults for the Postgres version and disk size.
+func checkPlan(plans []models.Plan, req *CreateInstanceRequest) []apierror.FieldError {
+	var plan *models.Plan
+	var names []string
+	for i := range plans {
+		if plans[i].Name == req.Plan {
+			plan = &plans[i]
+		}
+		if !plans[i].Deprecated {
+			names = append(names, plans[i].Name)
+		}
+	}
+	if plan == nil {
+		return []apierror.FieldError{{Field: "plan", Code: "oneof", Message: "must be one of: " + strings.Join(names, ", ")}}
+	}
+	if plan.Deprecated {
+		return []apierror.FieldError{{Field: "plan", Code: "deprecated", Message: "is deprecated and takes no new instances"}}
+	}
+
+	var details []apierror.FieldError
+	switch {
+	case req.PgVersion == 0 && plan.SupportsVersion(defaultPgVersion):
+		req.PgVersion = defaultPgVersion
+	case req.PgVersion == 0:
+		for _, v := range plan.PgVersions {
+			if v > req.PgVersion {
+				req.PgVersion = v
+			}
+		}
+	case !plan.SupportsVersion(req.PgVersion):
+		versions := make([]string, len(plan.PgVersions))
+		for i, v := range plan.PgVersions {
+			versions[i] = strconv.Itoa(v)
+		}
+		details = append(details, apierror.FieldError{
+			Field:   "pg_version",
+			Code:    "oneof",
+			Message: "must be one of: " + strings.Join(versions, ", ") + " with the " + plan.Name + " plan",
+		})
+	}
+
+	switch {
+	case req.DiskGiB == 0:
+		req.DiskGiB = plan.DiskGiB
+	case req.DiskGiB < plan.MinDiskGiB:
+		details = append(details, apierror.FieldError{Field: "disk_gib", Code: "min", Message: "must be at least " + strconv.Itoa(plan.MinDiskGiB)})
+	case req.DiskGiB > plan.MaxDiskGiB:
+		details = append(details, apierror.FieldError{Field: "disk_gib", Code: "max", Message: "must be at most " + strconv.Itoa(plan.MaxDiskGiB)})
+	}
+	return details
+}
+
+// ResizeInstance marks the instance as resizing and enqueues the job that
+// applies its new plan and disk size. The resized instance is checked
+// against the quotas in the same transaction, as on create.
+func (h *InstanceHandler) ResizeInstance(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req ResizeInstanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	if instance.Status != models.InstanceRunning && instance.Status != models.InstanceStopped {
+		apierror.Conflict(c, "Instance is "+instance.Status+"; only running or stopped instances can be resized")
+		return
+	}
+
+	ctx := c.Request.Context()
+	plans, err := h.store.Plans().List(ctx)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get plans")
+		return
+	}
+	used, err := h.diskUsed(ctx, instance)
+	if err != nil {
+		apierror.Respond(c, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Failed to get the disk usage of the instance")
+		return
+	}
+	if details := checkResize(plans, instance, used, &req); len(details) > 0 {
+		apierror.Validation(c, details...)
+		return
+	}
+	if req.Plan == instance.Plan && req.DiskGiB == instance.DiskGiB {
+		apierror.BadRequest(c, "The instance already has this plan and disk size")
+		return
+	}
+
+	resized := *instance
+	resized.Plan, resized.DiskGiB = req.Plan, req.DiskGiB
+	var job *models.Job
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		if err := h.quotas.Check(ctx, tx, project, &resized); err != nil {
+			return err
+		}
+		// The org is locked now, so a concurrent resize has either
+		// committed or waits
+		current, err := tx.Instances().Get(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != instance.Status {
+			return store.ErrConflict
+		}
+
+		instance.Status = models.InstanceResizing
+		if err := tx.Instances().Update(ctx, instance); err != nil {
+			return err
+		}
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeResizeInstance, jobs.ResizePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+			Plan:       req.Plan,
+			DiskGiB:    req.DiskGiB,
+			Status:     current.Status,
+		})
+		return err
+	})
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeQuotaExceeded, exceeded.Error())
+		return
+	}
+	if err == store.ErrConflict {
+		apierror.Conflict(c, "Instance changed while it was being resized; try again")
+		return
+	}
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to resize instance")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"instance": instance,
+		"job_id":   job.ID,
+	})
+}
+
+// diskUsed returns how many bytes of its disk inst uses, or 0 when there
+// is no agent to ask. Only the agent of a running container can tell; a
+// stopped one uses no more than its disk, which checkResize checks anyway.
+func (h *InstanceHandler) diskUsed(ctx context.Context, inst *models.Instance) (int64, error) {
+	if h.agents == nil || inst.Status != models.InstanceRunning {
+		return 0, nil
+	}
+	agent, err := h.agents.For(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return 0, err
+	}
+	status, err := agent.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return status.DiskUsedBytes, nil
+}
+
+// checkResize checks req against the catalog and inst, filling in the
+// current plan and disk size for those left out. The resized disk must
+// hold the used bytes of the instance, and a smaller plan must allow them.
+// The disk can only grow, since Proxmox can't shrink volumes, so a smaller
+// plan must also allow the disk the instance has; a kept disk below the
+// new plan's minimum is grown to it.
+func checkResize(plans []models.Plan, inst *models.Instance, used int64, req *ResizeInstanceRequest) []apierror.FieldError {
+	if req.Plan == "" && req.DiskGiB == 0 {
+		return []apierror.FieldError{{Field: "plan", Code: "required", Message: "is required without disk_gib"}}
+	}
+	if req.Plan == "" {
+		req.Plan = inst.Plan
+	}
+
+	var plan *models.Plan
+	var names []string
+	for i := range plans {
+		if plans[i].Name == req.Plan {
+			plan = &plans[i]
+		}
+		if !plans[i].Deprecated {
+			names = append(names, plans[i].Name)
+		}
+	}
+	switch {
+	case plan == nil:
+		return []apierror.FieldError{{Field: "plan", Code: "oneof", Message: "must be one of: " + strings.Join(names, ", ")}}
+	case plan.Deprecated && plan.Name != inst.Plan:
+		return []apierror.FieldError{{Field: "plan", Code: "deprecated", Message: "is deprecated and takes no new instances"}}
+	case !plan.SupportsVersion(inst.PgVersion):
+		return []apierror.FieldError{{Field: "plan", Code: "pg_version", Message: "doesn't support PostgreSQL " + strconv.Itoa(inst.PgVersion)}}
+	}
+
+	current := strconv.Itoa(inst.DiskGiB)
+	usedGiB := strconv.FormatFloat(float64(used)/(1<<30), 'f', 1, 64)
+	if req.DiskGiB == 0 {
+		req.DiskGiB = inst.DiskGiB
+		if int64(plan.MaxDiskGiB)<<30 < used {
+			return []apierror.FieldError{{
+				Field:   "plan",
+				Code:    "disk_usage",
+				Message: "allows at most " + strconv.Itoa(plan.MaxDiskGiB) + " GiB of disk, less than the " + usedGiB + " GiB the instance uses",
+			}}
+		}
+		if req.DiskGiB > plan.MaxDiskGiB {
+			return []apierror.FieldError{{
+				Field:   "plan",
+				Code:    "max_disk_gib",
+				Message: "allows at most " + strconv.Itoa(plan.MaxDiskGiB) + " GiB of disk, less than the instance's " + current,
+			}}
+		}
+		if req.DiskGiB < plan.MinDiskGiB {
+			req.DiskGiB = plan.MinDiskGiB
+		}
+		return nil
+	}
+
+	switch {
+	case int64(req.DiskGiB)<<30 < used:
+		return []apierror.FieldError{{Field: "disk_gib", Code: "disk_usage", Message: "must hold the " + usedGiB + " GiB the instance uses"}}
+	case req.DiskGiB < inst.DiskGiB:
+		return []apierror.FieldError{{Field: "disk_gib", Code: "min", Message: "must be at least the current " + current + "; disks can't shrink"}}
+	case req.DiskGiB < plan.MinDiskGiB:
+		return []apierror.FieldError{{Field: "disk_gib", Code: "min", Message: "must be at least " + strconv.Itoa(plan.MinDiskGiB)}}
+	case req.DiskGiB > plan.MaxDiskGiB:
+		return []apierror.FieldError{{Field: "disk_gib", Code: "max", Message: "must be at most " + strconv.Itoa(plan.MaxDiskGiB)}}
+	}
+	return nil
+}
+
+func (h *InstanceHandler) GetInstance(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"instance": instance})
+}
+
+// DeleteInstance marks the instance as deleting and enqueues the job that
+// destroys its container and then removes it.
+func (h *InstanceHandler) DeleteInstance(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleAdmin)
+	if !ok {
+		return
+	}
+	if instance.Status == models.InstanceDeleting {
+		apierror.Conflict(c, "Instance is already being deleted")
+		return
+	}
+
+	ctx := c.Request.Context()
+	var job *models.Job
+	err := h.store.InTx(ctx, func(tx store.Store) error {
+		instance.Status = models.InstanceDeleting
+		if err := tx.Instances().Update(ctx, instance); err != nil {
+			return err
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeDeleteInstance, jobs.InstancePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+		})
+		return err
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete instance")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
+
+// project returns the project named in the path once the caller is known
+// to have at least minRole in its org.
+func (h *InstanceHandler) project(c *gin.Context, minRole models.UserRole) (*models.Project, bool) {
+	project, err := h.store.Projects().Get(c.Request.Context(), c.Param("projectId"))
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Project not found")
+		return nil, false
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get project")
+		return nil, false
+	}
+
+	if _, ok := h.authz.RequireRole(c, project.OrgID, minRole); !ok {
+		return nil, false
+	}
+	return project, true
+}
+
+// instance returns the instance named in the path and its project once the
+// caller is known to have at least minRole in the project's org.
+func (h *InstanceHandler) instance(c *gin.Context, minRole models.UserRole) (*models.Instance, *models.Project, bool) {
+	ctx := c.Request.Context()
+
+	instance, err := h.store.Instances().Get(ctx, c.Param("instanceId"))
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return nil, nil, false
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get instance")
+		return nil, nil, false
+	}
+
+	project, err := h.store.Projects().Get(ctx, instance.ProjectID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get instance")
+		return nil, nil, false
+	}
+
+	if _, ok := h.authz.RequireRole(c, project.OrgID, minRole); !ok {
+		return nil, nil, false
+	}
+	return instance, project, true
+}
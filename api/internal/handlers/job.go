@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+type JobHandler struct {
+	jobs  store.Jobs
+	authz *Authorizer
+}
+
+func NewJobHandler(jobs store.Jobs, authz *Authorizer) *JobHandler {
+	return &JobHandler{jobs: jobs, authz: authz}
+}
+
+// GetJob returns a job to members of the org it was enqueued for, and to
+// the user who enqueued it. Jobs that belong to no org are internal and
+// reported as not found.
+func (h *JobHandler) GetJob(c *gin.Context) {
+	job, err := h.jobs.Get(c.Request.Context(), c.Param("jobId"))
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Job not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get job")
+		return
+	}
+
+	orgID := jobs.OrgID(job)
+	if orgID == "" {
+		apierror.NotFound(c, "Job not found")
+		return
+	}
+	// Deleting an org removes the memberships its members would need to
+	// follow the job
+	if userID := jobs.UserID(job); userID == "" || userID != c.GetString("user_id") {
+		if _, ok := h.authz.RequireRole(c, orgID, models.RoleViewer); !ok {
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
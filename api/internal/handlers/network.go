@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// NetworkPolicyRequest sets who can connect to an instance.
+type NetworkPolicyRequest struct {
+	// Exposure defaults to public.
+	Exposure string `json:"exposure" binding:"omitempty,oneof=public private"`
+	// AllowedCIDRs are CIDR blocks or single addresses. Empty allows any
+	// address, or every private network for private exposure.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+// GetNetworkPolicy returns the network policy of an instance; instances
+// that never had one set are public to any address.
+func (h *InstanceHandler) GetNetworkPolicy(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	policy, err := h.store.NetworkPolicies().GetByInstance(c.Request.Context(), instance.ID)
+	if err == store.ErrNotFound {
+		policy = netpolicy.Default(instance)
+	} else if err != nil {
+		apierror.Internal(c, err, "Failed to get network policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// PutNetworkPolicy replaces the network policy of a running instance and
+// enqueues the apply_network_policy job that compiles it into the
+// container's firewall rules and pg_hba.conf. Opening or closing an
+// instance takes an admin.
+func (h *InstanceHandler) PutNetworkPolicy(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req NetworkPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+	if req.Exposure == "" {
+		req.Exposure = models.ExposurePublic
+	}
+	cidrs, err := h.network.Normalize(req.Exposure, req.AllowedCIDRs)
+	var cidrErr *netpolicy.CIDRError
+	if errors.As(err, &cidrErr) {
+		apierror.Validation(c, apierror.FieldError{Field: "allowed_cidrs", Code: "cidr", Message: cidrErr.Error()})
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to set network policy")
+		return
+	}
+
+	if instance.Status != models.InstanceRunning {
+		apierror.Conflict(c, "Instance is "+instance.Status+"; only the network policy of running instances can be changed")
+		return
+	}
+
+	policy := &models.NetworkPolicy{InstanceID: instance.ID, Exposure: req.Exposure, AllowedCIDRs: cidrs}
+	ctx := c.Request.Context()
+	var job *models.Job
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.NetworkPolicies().Put(ctx, policy); err != nil {
+			return err
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeApplyNetworkPolicy, jobs.InstancePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+		})
+		return err
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to set network policy")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"policy": policy, "job_id": job.ID})
+}
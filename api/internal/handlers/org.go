@@ -1,21 +1,24 @@
 package handlers
 
 import (
-	"database/sql"
+	"fmt"
 	"net/http"
-	"time"
+	"strconv"
 
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/jobs"
 	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 type OrgHandler struct {
-	db *sql.DB
+	store store.Store
+	authz *Authorizer
 }
 
-func NewOrgHandler(db *sql.DB) *OrgHandler {
-	return &OrgHandler{db: db}
+func NewOrgHandler(s store.Store, authz *Authorizer) *OrgHandler {
+	return &OrgHandler{store: s, authz: authz}
 }
 
 type CreateOrgRequest struct {
@@ -29,44 +32,15 @@ type UpdateOrgRequest struct {
 func (h *OrgHandler) ListOrgs(c *gin.Context) {
 	userID := c.GetString("user_id")
 	if userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		apierror.Unauthorized(c, "User not authenticated")
 		return
 	}
 
-	query := `
-		SELECT o.id, o.name, o.created_at, o.updated_at, m.role
-		FROM orgs o
-		JOIN memberships m ON o.id = m.org_id
-		WHERE m.user_id = $1
-		ORDER BY o.created_at DESC
-	`
-
-	rows, err := h.db.Query(query, userID)
+	orgs, err := h.store.Orgs().ListForUser(c.Request.Context(), userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get organizations"})
+		apierror.Internal(c, err, "Failed to get organizations")
 		return
 	}
-	defer rows.Close()
-
-	var orgs []gin.H
-	for rows.Next() {
-		var org models.Org
-		var role models.UserRole
-		
-		err := rows.Scan(&org.ID, &org.Name, &org.CreatedAt, &org.UpdatedAt, &role)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan organization"})
-			return
-		}
-
-		orgs = append(orgs, gin.H{
-			"id":         org.ID,
-			"name":       org.Name,
-			"created_at": org.CreatedAt,
-			"updated_at": org.UpdatedAt,
-			"role":       role,
-		})
-	}
 
 	c.JSON(http.StatusOK, gin.H{"orgs": orgs})
 }
@@ -74,55 +48,30 @@ func (h *OrgHandler) ListOrgs(c *gin.Context) {
 func (h *OrgHandler) CreateOrg(c *gin.Context) {
 	userID := c.GetString("user_id")
 	if userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		apierror.Unauthorized(c, "User not authenticated")
 		return
 	}
 
 	var req CreateOrgRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Start transaction
-	tx, err := h.db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
-		return
-	}
-	defer tx.Rollback()
-
-	// Create org
-	org := models.Org{
-		ID:        uuid.New().String(),
-		Name:      req.Name,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-
-	orgQuery := `
-		INSERT INTO orgs (id, name, created_at, updated_at) 
-		VALUES ($1, $2, $3, $4)
-	`
-	_, err = tx.Exec(orgQuery, org.ID, org.Name, org.CreatedAt, org.UpdatedAt)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+		apierror.Bind(c, err)
 		return
 	}
 
-	// Add user as owner
-	memberQuery := `
-		INSERT INTO memberships (user_id, org_id, role) 
-		VALUES ($1, $2, $3)
-	`
-	_, err = tx.Exec(memberQuery, userID, org.ID, models.RoleOwner)
+	// Create the org with the caller as its owner
+	org := models.Org{Name: req.Name}
+	err := h.store.InTx(c.Request.Context(), func(tx store.Store) error {
+		if err := tx.Orgs().Create(c.Request.Context(), &org); err != nil {
+			return err
+		}
+		return tx.Memberships().Create(c.Request.Context(), &models.Membership{
+			UserID: userID,
+			OrgID:  org.ID,
+			Role:   models.RoleOwner,
+		})
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create membership"})
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		apierror.Internal(c, err, "Failed to create organization")
 		return
 	}
 
@@ -131,31 +80,19 @@ func (h *OrgHandler) CreateOrg(c *gin.Context) {
 
 func (h *OrgHandler) GetOrg(c *gin.Context) {
 	orgID := c.Param("orgId")
-	userID := c.GetString("user_id")
 
-	// Check if user has access to this org
-	var role models.UserRole
-	roleQuery := "SELECT role FROM memberships WHERE user_id = $1 AND org_id = $2"
-	err := h.db.QueryRow(roleQuery, userID, orgID).Scan(&role)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
-	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+	role, ok := h.authz.RequireRole(c, orgID, models.RoleViewer)
+	if !ok {
 		return
 	}
 
-	// Get org
-	var org models.Org
-	orgQuery := "SELECT id, name, created_at, updated_at FROM orgs WHERE id = $1"
-	err = h.db.QueryRow(orgQuery, orgID).Scan(&org.ID, &org.Name, &org.CreatedAt, &org.UpdatedAt)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+	org, err := h.store.Orgs().Get(c.Request.Context(), orgID)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Organization not found")
 		return
 	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get organization"})
+		apierror.Internal(c, err, "Failed to get organization")
 		return
 	}
 
@@ -167,72 +104,102 @@ func (h *OrgHandler) GetOrg(c *gin.Context) {
 
 func (h *OrgHandler) UpdateOrg(c *gin.Context) {
 	orgID := c.Param("orgId")
-	userID := c.GetString("user_id")
 
-	// Check if user is admin or owner
-	var role models.UserRole
-	roleQuery := "SELECT role FROM memberships WHERE user_id = $1 AND org_id = $2"
-	err := h.db.QueryRow(roleQuery, userID, orgID).Scan(&role)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
-	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
-		return
-	}
-
-	if role != models.RoleOwner && role != models.RoleAdmin {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleAdmin); !ok {
 		return
 	}
 
 	var req UpdateOrgRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierror.Bind(c, err)
 		return
 	}
 
-	query := "UPDATE orgs SET name = $1, updated_at = $2 WHERE id = $3"
-	_, err = h.db.Exec(query, req.Name, time.Now(), orgID)
+	org := models.Org{ID: orgID, Name: req.Name}
+	err := h.store.Orgs().Update(c.Request.Context(), &org)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Organization not found")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update organization"})
+		apierror.Internal(c, err, "Failed to update organization")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Organization updated successfully"})
 }
 
+// DeleteOrg enqueues the job that removes the org. Orgs with instances are
+// refused unless cascade=true is passed, in which case every instance is
+// marked deleting and gets its own delete_instance job; the org job waits
+// for those before removing the org.
 func (h *OrgHandler) DeleteOrg(c *gin.Context) {
 	orgID := c.Param("orgId")
-	userID := c.GetString("user_id")
 
-	// Check if user is owner
-	var role models.UserRole
-	roleQuery := "SELECT role FROM memberships WHERE user_id = $1 AND org_id = $2"
-	err := h.db.QueryRow(roleQuery, userID, orgID).Scan(&role)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
-	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleOwner); !ok {
 		return
 	}
 
-	if role != models.RoleOwner {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can delete organizations"})
-		return
+	cascade := false
+	if v := c.Query("cascade"); v != "" {
+		var err error
+		cascade, err = strconv.ParseBool(v)
+		if err != nil {
+			apierror.Validation(c, apierror.FieldError{
+				Field:   "cascade",
+				Code:    "invalid_parameter",
+				Message: "is not a valid boolean",
+			})
+			return
+		}
 	}
 
-	// TODO: Check for dependent resources (projects, instances)
+	ctx := c.Request.Context()
+	instances, err := h.store.Instances().ListByOrg(ctx, orgID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete organization")
+		return
+	}
+	if len(instances) > 0 && !cascade {
+		apierror.Conflict(c, fmt.Sprintf("Organization has %d instance(s); delete them first or pass cascade=true", len(instances)))
+		return
+	}
+
+	var job *models.Job
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		queue := jobs.NewQueue(tx.Jobs())
+		payload := jobs.OrgPayload{OrgID: orgID, UserID: c.GetString("user_id")}
+		for i := range instances {
+			// Instances already being deleted get another job too: deleting
+			// is idempotent, and a failed deletion would otherwise block
+			// the org's forever
+			instance := &instances[i]
+			instance.Status = models.InstanceDeleting
+			if err := tx.Instances().Update(ctx, instance); err != nil {
+				return err
+			}
+			instanceJob, err := queue.Enqueue(ctx, jobs.TypeDeleteInstance, jobs.InstancePayload{
+				InstanceID: instance.ID,
+				OrgID:      orgID,
+			})
+			if err != nil {
+				return err
+			}
+			payload.InstanceJobs = append(payload.InstanceJobs, instanceJob.ID)
+		}
 
-	query := "DELETE FROM orgs WHERE id = $1"
-	_, err = h.db.Exec(query, orgID)
+		var err error
+		job, err = queue.Enqueue(ctx, jobs.TypeDeleteOrg, payload)
+		return err
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Organization not found")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete organization"})
+		apierror.Internal(c, err, "Failed to delete organization")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Organization deleted successfully"})
-}
\ No newline at end of file
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
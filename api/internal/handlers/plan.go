@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+type PlanHandler struct {
+	plans store.Plans
+}
+
+func NewPlanHandler(plans store.Plans) *PlanHandler {
+	return &PlanHandler{plans: plans}
+}
+
+// ListPlans returns the plan catalog, deprecated plans included so existing
+// instances can be looked up.
+func (h *PlanHandler) ListPlans(c *gin.Context) {
+	plans, err := h.plans.List(c.Request.Context())
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get plans")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/privnet"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/wireguard"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// allocateAttempts bounds how often a subnet or address is allocated
+	// again after another request took it first.
+	allocateAttempts = 3
+	// peerKeepalive keeps the NAT mappings of peers open, in seconds.
+	peerKeepalive = 25
+)
+
+// errNetworkExists is returned from the transaction creating a private
+// network when the org already has one.
+var errNetworkExists = errors.New("organization already has a private network")
+
+type PrivateNetworkHandler struct {
+	store     store.Store
+	privnet   *privnet.Allocator
+	wireguard config.WireGuardConfig
+	authz     *Authorizer
+}
+
+func NewPrivateNetworkHandler(s store.Store, cfg config.NetworkConfig, authz *Authorizer) *PrivateNetworkHandler {
+	return &PrivateNetworkHandler{
+		store:     s,
+		privnet:   privnet.New(cfg.PrivateNetworks),
+		wireguard: cfg.WireGuard,
+		authz:     authz,
+	}
+}
+
+type CreatePeerRequest struct {
+	// Name names the peer within the network, e.g. after the machine it
+	// runs on.
+	Name string `json:"name" binding:"required,max=63,hostname_rfc1123"`
+}
+
+// CreateNetwork allocates the private network of an org, a subnet on a VLAN
+// of its own, and enqueues the attach_private_network job that attaches
+// the org's instances to it. Instances created later are attached as they
+// are provisioned.
+func (h *PrivateNetworkHandler) CreateNetwork(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleAdmin); !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var (
+		network models.PrivateNetwork
+		job     *models.Job
+		err     error
+	)
+	// Networks of other orgs may take the subnet or VLAN allocated first
+	for attempt := 0; attempt < allocateAttempts; attempt++ {
+		err = h.store.InTx(ctx, func(tx store.Store) error {
+			if err := tx.Orgs().Lock(ctx, orgID); err != nil {
+				return err
+			}
+			if _, err := tx.PrivateNetworks().GetByOrg(ctx, orgID); err == nil {
+				return errNetworkExists
+			} else if err != store.ErrNotFound {
+				return err
+			}
+			taken, err := tx.PrivateNetworks().List(ctx)
+			if err != nil {
+				return err
+			}
+			subnet, vlan, err := h.privnet.Allocate(taken)
+			if err != nil {
+				return err
+			}
+
+			network = models.PrivateNetwork{OrgID: orgID, Subnet: subnet.String(), VLAN: vlan}
+			if err := tx.PrivateNetworks().Create(ctx, &network); err != nil {
+				return err
+			}
+			job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeAttachNetwork, jobs.NetworkPayload{
+				OrgID:     orgID,
+				NetworkID: network.ID,
+			})
+			return err
+		})
+		if err != store.ErrConflict {
+			break
+		}
+	}
+	switch {
+	case err == errNetworkExists:
+		apierror.Conflict(c, "Organization already has a private network")
+		return
+	case err == privnet.ErrExhausted:
+		apierror.Conflict(c, "No private network subnet or VLAN is left to allocate")
+		return
+	case err == store.ErrNotFound:
+		apierror.NotFound(c, "Organization not found")
+		return
+	case err != nil:
+		apierror.Internal(c, err, "Failed to create private network")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"network": network, "job_id": job.ID})
+}
+
+// GetNetwork returns the private network of an org.
+func (h *PrivateNetworkHandler) GetNetwork(c *gin.Context) {
+	network, _, ok := h.network(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"network": network})
+}
+
+// ListPeers returns the WireGuard peers of the private network of an org,
+// oldest first.
+func (h *PrivateNetworkHandler) ListPeers(c *gin.Context) {
+	network, _, ok := h.network(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	peers, err := h.store.WireGuardPeers().ListByNetwork(c.Request.Context(), network.ID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get peers")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"peers": peers})
+}
+
+// CreatePeer mints the keys of a WireGuard peer of the private network of
+// an org, allocates it an address and enqueues the add_wireguard_peer job
+// that adds it to the gateway. The response carries the wg-quick config of
+// the peer; its private key is not stored, so the config can't be fetched
+// again.
+func (h *PrivateNetworkHandler) CreatePeer(c *gin.Context) {
+	if h.wireguard.Endpoint == "" {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeNotSupported, "WireGuard peers are not configured on this server")
+		return
+	}
+	network, _, ok := h.network(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req CreatePeerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	key, err := wireguard.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to create peer")
+		return
+	}
+	subnet := netip.MustParsePrefix(network.Subnet)
+
+	ctx := c.Request.Context()
+	var (
+		peer models.WireGuardPeer
+		job  *models.Job
+	)
+	// Other peers may take the address allocated first
+	for attempt := 0; attempt < allocateAttempts; attempt++ {
+		peers, err := h.store.WireGuardPeers().ListByNetwork(ctx, network.ID)
+		if err != nil {
+			apierror.Internal(c, err, "Failed to create peer")
+			return
+		}
+		taken := make([]string, 0, len(peers))
+		for _, p := range peers {
+			if p.Name == req.Name {
+				apierror.Conflict(c, "A peer with this name already exists")
+				return
+			}
+			taken = append(taken, p.Address)
+		}
+		addr, err := privnet.PeerAddress(subnet, taken)
+		if err == privnet.ErrExhausted {
+			apierror.Conflict(c, "The private network has no address left for peers")
+			return
+		}
+
+		peer = models.WireGuardPeer{
+			NetworkID: network.ID,
+			Name:      req.Name,
+			PublicKey: key.PublicKey().String(),
+			Address:   addr.String(),
+			CreatedBy: c.GetString("user_id"),
+		}
+		err = h.store.InTx(ctx, func(tx store.Store) error {
+			if err := tx.WireGuardPeers().Create(ctx, &peer); err != nil {
+				return err
+			}
+			var err error
+			job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeAddPeer, jobs.PeerPayload{
+				OrgID:     network.OrgID,
+				NetworkID: network.ID,
+				PeerID:    peer.ID,
+			})
+			return err
+		})
+		if err == nil {
+			break
+		}
+		if err == store.ErrNotFound {
+			apierror.NotFound(c, "Private network not found")
+			return
+		}
+		if err != store.ErrConflict || attempt+1 == allocateAttempts {
+			apierror.Internal(c, err, "Failed to create peer")
+			return
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"peer":   peer,
+		"config": h.peerConfig(network, &peer, key).String(),
+		"job_id": job.ID,
+	})
+}
+
+// peerConfig returns the wg-quick config of peer, routing the subnet of
+// network through the gateway.
+func (h *PrivateNetworkHandler) peerConfig(network *models.PrivateNetwork, peer *models.WireGuardPeer, key wireguard.Key) wireguard.Config {
+	// Validate checked the gateway's key
+	gatewayKey, _ := wireguard.ParseKey(h.wireguard.PublicKey)
+	addr := netip.MustParseAddr(peer.Address)
+	return wireguard.Config{
+		Comment: fmt.Sprintf("WireGuard peer %q of private network %s, created %s.\nThe private key below is not kept anywhere else; keep this file safe.",
+			peer.Name, network.Subnet, peer.CreatedAt.UTC().Format(time.RFC3339)),
+		PrivateKey: key,
+		Address:    []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())},
+		Peers: []wireguard.Peer{{
+			PublicKey:           gatewayKey,
+			Endpoint:            h.wireguard.Endpoint,
+			AllowedIPs:          []netip.Prefix{netip.MustParsePrefix(network.Subnet)},
+			PersistentKeepalive: peerKeepalive,
+		}},
+	}
+}
+
+// DeletePeer removes a WireGuard peer and enqueues the
+// remove_wireguard_peer job that closes its tunnel. Members can delete
+// the peers they created, admins any.
+func (h *PrivateNetworkHandler) DeletePeer(c *gin.Context) {
+	network, role, ok := h.network(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	peer, err := h.store.WireGuardPeers().Get(ctx, c.Param("peerId"))
+	if err == store.ErrNotFound || (err == nil && peer.NetworkID != network.ID) {
+		apierror.NotFound(c, "Peer not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete peer")
+		return
+	}
+	if !role.AtLeast(models.RoleAdmin) && peer.CreatedBy != c.GetString("user_id") {
+		apierror.Forbidden(c, "Only admins can delete the peers of others")
+		return
+	}
+
+	var job *models.Job
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.WireGuardPeers().Delete(ctx, peer.ID); err != nil {
+			return err
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeRemovePeer, jobs.PeerPayload{
+			OrgID:     network.OrgID,
+			NetworkID: network.ID,
+			PeerID:    peer.ID,
+			Address:   peer.Address,
+		})
+		return err
+	})
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Peer not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete peer")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
+
+// network returns the private network of the org in the path if the caller
+// has at least minRole in it, along with their role. Otherwise it responds
+// with an error and returns false.
+func (h *PrivateNetworkHandler) network(c *gin.Context, minRole models.UserRole) (*models.PrivateNetwork, models.UserRole, bool) {
+	orgID := c.Param("orgId")
+
+	role, ok := h.authz.RequireRole(c, orgID, minRole)
+	if !ok {
+		return nil, "", false
+	}
+
+	network, err := h.store.PrivateNetworks().GetByOrg(c.Request.Context(), orgID)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Organization has no private network")
+		return nil, "", false
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get private network")
+		return nil, "", false
+	}
+	return network, role, true
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+type ProjectHandler struct {
+	store store.Store
+	authz *Authorizer
+}
+
+func NewProjectHandler(s store.Store, authz *Authorizer) *ProjectHandler {
+	return &ProjectHandler{store: s, authz: authz}
+}
+
+type CreateProjectRequest struct {
+	Name string `json:"name" binding:"required,max=63"`
+}
+
+func (h *ProjectHandler) ListProjects(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleViewer); !ok {
+		return
+	}
+
+	projects, err := h.store.Projects().ListByOrg(c.Request.Context(), orgID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get projects")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"projects": projects})
+}
+
+func (h *ProjectHandler) CreateProject(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleMember); !ok {
+		return
+	}
+
+	var req CreateProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	project := models.Project{OrgID: orgID, Name: req.Name}
+	err := h.store.Projects().Create(c.Request.Context(), &project)
+	if err == store.ErrConflict {
+		apierror.Conflict(c, "A project with this name already exists")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to create project")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"project": project})
+}
+
+func (h *ProjectHandler) GetProject(c *gin.Context) {
+	project, ok := h.load(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"project": project})
+}
+
+func (h *ProjectHandler) DeleteProject(c *gin.Context) {
+	project, ok := h.load(c, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Instances have containers to destroy, so they must be deleted first
+	instances, err := h.store.Instances().ListByProject(c.Request.Context(), project.ID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete project")
+		return
+	}
+	if len(instances) > 0 {
+		apierror.Conflict(c, "Delete the instances of the project first")
+		return
+	}
+
+	err = h.store.Projects().Delete(c.Request.Context(), project.ID)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Project not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete project")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Project deleted successfully"})
+}
+
+// load returns the project named in the path once the caller is known to
+// have at least minRole in its org.
+func (h *ProjectHandler) load(c *gin.Context, minRole models.UserRole) (*models.Project, bool) {
+	project, err := h.store.Projects().Get(c.Request.Context(), c.Param("projectId"))
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Project not found")
+		return nil, false
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get project")
+		return nil, false
+	}
+
+	if _, ok := h.authz.RequireRole(c, project.OrgID, minRole); !ok {
+		return nil, false
+	}
+	return project, true
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/quota"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+type QuotaHandler struct {
+	store  store.Store
+	quotas *quota.Checker
+	authz  *Authorizer
+}
+
+func NewQuotaHandler(s store.Store, quotas *quota.Checker, authz *Authorizer) *QuotaHandler {
+	return &QuotaHandler{store: s, quotas: quotas, authz: authz}
+}
+
+// GetQuotas reports the usage of the org and each of its projects against
+// their limits.
+func (h *QuotaHandler) GetQuotas(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleViewer); !ok {
+		return
+	}
+
+	report, err := h.quotas.Report(c.Request.Context(), h.store, orgID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get quotas")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quotas": report})
+}
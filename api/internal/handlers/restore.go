@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/pglsn"
+	"github.com/zallarak/db/api/internal/quota"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// RestoreInstanceRequest creates an instance from a backup of another.
+type RestoreInstanceRequest struct {
+	Name     string `json:"name" binding:"required,max=63"`
+	BackupID string `json:"backup_id" binding:"required"`
+	// TargetTime or TargetLSN replays the WAL archived after the backup up
+	// to that point. Without either, the instance is as of the end of the
+	// backup.
+	TargetTime *time.Time `json:"target_time"`
+	TargetLSN  string     `json:"target_lsn"`
+	// Plan and DiskGiB default to those of the source instance.
+	Plan    string `json:"plan"`
+	DiskGiB int    `json:"disk_gib" binding:"omitempty,min=1"`
+}
+
+// RestoreInstance creates an instance in the project of the source
+// instance from one of its completed backups, on the backup's Postgres
+// version, and enqueues the restore_instance job that provisions it and
+// restores the backup. A target must fall within the backup's recovery
+// window. As on create, the instance is checked against the quotas and
+// created with its job in one transaction.
+func (h *InstanceHandler) RestoreInstance(c *gin.Context) {
+	source, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req RestoreInstanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+	if req.TargetTime != nil && req.TargetLSN != "" {
+		apierror.Validation(c, apierror.FieldError{Field: "target_lsn", Code: "excluded_with", Message: "can't be set along with target_time"})
+		return
+	}
+	var targetLSN pglsn.LSN
+	if req.TargetLSN != "" {
+		lsn, err := pglsn.Parse(req.TargetLSN)
+		if err != nil {
+			apierror.Validation(c, apierror.FieldError{Field: "target_lsn", Code: "lsn", Message: "must be an LSN such as 16/B374D848"})
+			return
+		}
+		targetLSN, req.TargetLSN = lsn, lsn.String()
+	}
+	if source.Status == models.InstanceDeleting {
+		apierror.Conflict(c, "Instance is deleting; its backups can't be restored")
+		return
+	}
+
+	ctx := c.Request.Context()
+	backup, err := h.store.Backups().Get(ctx, req.BackupID)
+	if err == store.ErrNotFound || err == nil && backup.InstanceID != source.ID {
+		apierror.NotFound(c, "Backup not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get backup")
+		return
+	}
+	if backup.Status != models.BackupCompleted {
+		apierror.Conflict(c, "Backup is "+backup.Status+"; only completed backups can be restored")
+		return
+	}
+
+	if req.TargetTime != nil || req.TargetLSN != "" {
+		segments, err := h.store.WALSegments().ListByInstance(ctx, source.ID, "")
+		if err != nil {
+			apierror.Internal(c, err, "Failed to get archived WAL")
+			return
+		}
+		window := recoveryWindow(backup, segments)
+		if window == nil {
+			field := "target_time"
+			if req.TargetLSN != "" {
+				field = "target_lsn"
+			}
+			apierror.Validation(c, apierror.FieldError{Field: field, Code: "wal", Message: "needs WAL archived since the backup; the backup policy of the instance must archive WAL"})
+			return
+		}
+		switch {
+		case req.TargetTime != nil && (req.TargetTime.Before(window.FromTime) || req.TargetTime.After(window.ToTime)):
+			apierror.Validation(c, apierror.FieldError{
+				Field:   "target_time",
+				Code:    "range",
+				Message: fmt.Sprintf("must be between %s and %s, the recovery window of the backup", window.FromTime.Format(time.RFC3339), window.ToTime.Format(time.RFC3339)),
+			})
+			return
+		case req.TargetLSN != "" && (targetLSN < pglsn.MustParse(window.FromLSN) || targetLSN > pglsn.MustParse(window.ToLSN)):
+			apierror.Validation(c, apierror.FieldError{
+				Field:   "target_lsn",
+				Code:    "range",
+				Message: fmt.Sprintf("must be between %s and %s, the recovery window of the backup", window.FromLSN, window.ToLSN),
+			})
+			return
+		}
+	}
+
+	create := CreateInstanceRequest{Name: req.Name, Plan: req.Plan, PgVersion: backup.PgVersion, DiskGiB: req.DiskGiB}
+	if create.Plan == "" {
+		create.Plan = source.Plan
+	}
+	if create.DiskGiB == 0 {
+		create.DiskGiB = source.DiskGiB
+	}
+	if create.DiskGiB < source.DiskGiB {
+		apierror.Validation(c, apierror.FieldError{Field: "disk_gib", Code: "min", Message: "must be at least " + strconv.Itoa(source.DiskGiB) + ", the disk size of the source instance"})
+		return
+	}
+	plans, err := h.store.Plans().List(ctx)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get plans")
+		return
+	}
+	if details := checkPlan(plans, &create); len(details) > 0 {
+		for i, d := range details {
+			// The version is the backup's, not one the caller chose
+			if d.Field == "pg_version" {
+				details[i] = apierror.FieldError{Field: "plan", Code: "pg_version", Message: "doesn't support PostgreSQL " + strconv.Itoa(backup.PgVersion) + ", the version of the backup"}
+			}
+		}
+		apierror.Validation(c, details...)
+		return
+	}
+
+	var targetTime *time.Time
+	if req.TargetTime != nil {
+		t := req.TargetTime.UTC()
+		targetTime = &t
+	}
+	instance := models.Instance{
+		ProjectID: project.ID,
+		Name:      create.Name,
+		Plan:      create.Plan,
+		PgVersion: create.PgVersion,
+		DiskGiB:   create.DiskGiB,
+		Status:    models.InstancePending,
+		RestoredFrom: &models.RestoreSource{
+			InstanceID: source.ID,
+			BackupID:   backup.ID,
+			PgVersion:  backup.PgVersion,
+			TargetTime: targetTime,
+			TargetLSN:  req.TargetLSN,
+		},
+	}
+	var job *models.Job
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		if err := h.quotas.Check(ctx, tx, project, &instance); err != nil {
+			return err
+		}
+		if err := tx.Instances().Create(ctx, &instance); err != nil {
+			return err
+		}
+		var err error
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeRestoreInstance, jobs.InstancePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+		})
+		return err
+	})
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeQuotaExceeded, exceeded.Error())
+		return
+	}
+	if err == store.ErrConflict {
+		apierror.Conflict(c, "An instance with this name already exists in the project")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to restore instance")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"instance": instance,
+		"job_id":   job.ID,
+	})
+}
+
+// recoveryWindow returns the span backup can be restored to any point of:
+// from its end to the end of the WAL archived since, provided segments, in
+// WAL order, reach back to the start of the backup without a gap. It
+// returns nil otherwise.
+func recoveryWindow(backup *models.Backup, segments []models.WALSegment) *models.RecoveryWindow {
+	if backup.Status != models.BackupCompleted || backup.StartLSN == "" || backup.EndLSN == "" || backup.CompletedAt == nil || len(segments) == 0 {
+		return nil
+	}
+	first := len(segments) - 1
+	for first > 0 && pglsn.MustParse(segments[first-1].EndLSN) == pglsn.MustParse(segments[first].StartLSN) {
+		first--
+	}
+	last := segments[len(segments)-1]
+	if pglsn.MustParse(segments[first].StartLSN) > pglsn.MustParse(backup.StartLSN) ||
+		pglsn.MustParse(last.EndLSN) <= pglsn.MustParse(backup.EndLSN) ||
+		last.EndTime.Before(*backup.CompletedAt) {
+		return nil
+	}
+	return &models.RecoveryWindow{
+		FromTime: *backup.CompletedAt,
+		FromLSN:  backup.EndLSN,
+		ToTime:   last.EndTime,
+		ToLSN:    last.EndLSN,
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+type SSOHandler struct {
+	ssoService *auth.SSOService
+	authz      *Authorizer
+}
+
+func NewSSOHandler(ssoService *auth.SSOService, authz *Authorizer) *SSOHandler {
+	return &SSOHandler{ssoService: ssoService, authz: authz}
+}
+
+type SSOConnectionRequest struct {
+	Issuer          string          `json:"issuer" binding:"required,url"`
+	ClientID        string          `json:"client_id" binding:"required"`
+	ClientSecret    string          `json:"client_secret"`
+	Enforced        bool            `json:"enforced"`
+	AutoJoinDomains []string        `json:"auto_join_domains" binding:"dive,fqdn"`
+	AutoJoinRole    models.UserRole `json:"auto_join_role" binding:"omitempty,oneof=admin member viewer"`
+}
+
+// SSOLinkRequest names the org whose identity provider to link an identity
+// from.
+type SSOLinkRequest struct {
+	OrgID string `json:"org_id" binding:"required,uuid"`
+}
+
+// StartLogin redirects to the identity provider of the org given by org_id,
+// or of the org that claims the domain of email. With user_code, signing in
+// there approves that device login rather than opening a session.
+func (h *SSOHandler) StartLogin(c *gin.Context) {
+	orgID := c.Query("org_id")
+	email := c.Query("email")
+	if orgID == "" && email == "" {
+		apierror.BadRequest(c, "org_id or email is required")
+		return
+	}
+
+	var authURL string
+	var err error
+	if userCode := c.Query("user_code"); userCode != "" {
+		authURL, err = h.ssoService.StartDeviceLogin(c.Request.Context(), orgID, email, userCode)
+	} else {
+		authURL, err = h.ssoService.StartLogin(c.Request.Context(), orgID, email)
+	}
+	if err == auth.ErrSSONotConfigured {
+		apierror.NotFound(c, "SSO is not configured for this organization")
+		return
+	}
+	if err == auth.ErrUnknownUserCode {
+		apierror.NotFound(c, "Unknown or expired code")
+		return
+	}
+	if errors.Is(err, oidc.ErrDiscoveryFailed) {
+		apierror.Respond(c, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Failed to reach identity provider")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to start SSO login")
+		return
+	}
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+func (h *SSOHandler) Callback(c *gin.Context) {
+	if providerErr := c.Query("error"); providerErr != "" {
+		apierror.Unauthorized(c, "SSO login failed: "+providerErr)
+		return
+	}
+
+	state := c.Query("state")
+	code := c.Query("code")
+	if state == "" || code == "" {
+		apierror.BadRequest(c, "state and code are required")
+		return
+	}
+
+	login, err := h.ssoService.FinishLogin(c.Request.Context(), state, code)
+	if err == auth.ErrInvalidSSOState {
+		apierror.BadRequest(c, "Invalid or expired SSO state")
+		return
+	}
+	if err == auth.ErrEmailNotVerified {
+		apierror.Forbidden(c, "Identity provider did not return a verified email")
+		return
+	}
+	if err == auth.ErrIdentityNotLinked {
+		apierror.Forbidden(c, "No account is linked to this identity: sign in and link it first")
+		return
+	}
+	if err == auth.ErrIdentityLinked {
+		apierror.Conflict(c, "Identity is linked to another account")
+		return
+	}
+	if err == auth.ErrUnknownUserCode {
+		apierror.NotFound(c, "Unknown or expired code")
+		return
+	}
+	if errors.Is(err, oidc.ErrExchangeFailed) || errors.Is(err, oidc.ErrInvalidIDToken) {
+		apierror.Unauthorized(c, "SSO login failed")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "SSO login failed")
+		return
+	}
+
+	if login.RedirectURL != "" {
+		c.Redirect(http.StatusFound, login.RedirectURL)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token": login.Token,
+		"user":  login.User,
+	})
+}
+
+// StartLink returns the URL of an org's identity provider for the caller to
+// sign in at, linking the identity they sign in with to their account when
+// the provider redirects back to the callback. Identities whose email isn't
+// on a domain verified by the org can only be linked this way.
+func (h *SSOHandler) StartLink(c *gin.Context) {
+	var req SSOLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	authURL, err := h.ssoService.StartLink(c.Request.Context(), req.OrgID, c.GetString("user_id"))
+	if err == auth.ErrSSONotConfigured {
+		apierror.NotFound(c, "SSO is not configured for this organization")
+		return
+	}
+	if errors.Is(err, oidc.ErrDiscoveryFailed) {
+		apierror.Respond(c, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Failed to reach identity provider")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to start SSO link")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+func (h *SSOHandler) GetConnection(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleAdmin); !ok {
+		return
+	}
+
+	conn, err := h.ssoService.GetConnection(c.Request.Context(), orgID)
+	if err == auth.ErrSSONotConfigured {
+		apierror.NotFound(c, "SSO is not configured for this organization")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get SSO connection")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sso": conn})
+}
+
+func (h *SSOHandler) UpdateConnection(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleOwner); !ok {
+		return
+	}
+
+	var req SSOConnectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	conn := &models.SSOConnection{
+		OrgID:           orgID,
+		Issuer:          req.Issuer,
+		ClientID:        req.ClientID,
+		ClientSecret:    req.ClientSecret,
+		Enforced:        req.Enforced,
+		AutoJoinDomains: req.AutoJoinDomains,
+		AutoJoinRole:    req.AutoJoinRole,
+	}
+
+	err := h.ssoService.SaveConnection(c.Request.Context(), conn)
+	if err == auth.ErrDomainClaimed {
+		apierror.Conflict(c, "Domain is already claimed by another organization")
+		return
+	}
+	if errors.Is(err, oidc.ErrDiscoveryFailed) {
+		apierror.Validation(c, apierror.FieldError{
+			Field:   "issuer",
+			Code:    "discovery_failed",
+			Message: "OpenID Connect discovery failed: " + err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to save SSO connection")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sso": conn})
+}
+
+func (h *SSOHandler) DeleteConnection(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleOwner); !ok {
+		return
+	}
+
+	err := h.ssoService.DeleteConnection(c.Request.Context(), orgID)
+	if err == auth.ErrSSONotConfigured {
+		apierror.NotFound(c, "SSO is not configured for this organization")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to delete SSO connection")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SSO connection deleted successfully"})
+}
+
+// VerifyDomain checks the TXT record of a domain of an org's SSO connection
+// now. The domain comes back verified, or still pending with an error
+// message saying what was found instead of the record.
+func (h *SSOHandler) VerifyDomain(c *gin.Context) {
+	orgID := c.Param("orgId")
+
+	if _, ok := h.authz.RequireRole(c, orgID, models.RoleOwner); !ok {
+		return
+	}
+
+	domain, err := h.ssoService.VerifyDomain(c.Request.Context(), orgID, c.Param("domain"))
+	if err == auth.ErrUnknownDomain {
+		apierror.NotFound(c, "Domain is not one of the SSO connection's domains")
+		return
+	}
+	if err == auth.ErrDomainClaimed {
+		apierror.Conflict(c, "Domain is already claimed by another organization")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to verify domain")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain})
+}
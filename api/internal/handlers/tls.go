@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/pki"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+type CAHandler struct {
+	tls config.TLSConfig
+}
+
+func NewCAHandler(tls config.TLSConfig) *CAHandler {
+	return &CAHandler{tls: tls}
+}
+
+// GetBundle returns the CA certificates that instance certificates chain
+// to, for clients to verify instances with. The files are read on every
+// request, so a rotated CA is served without a restart.
+func (h *CAHandler) GetBundle(c *gin.Context) {
+	bundle, err := pki.Bundle(h.tls)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to read the CA bundle")
+		return
+	}
+	if bundle == nil {
+		apierror.NotFound(c, "No CA bundle; instances serve self-signed certificates")
+		return
+	}
+	c.Data(http.StatusOK, "application/x-pem-file", bundle)
+}
+
+// GetCertificate returns the certificate an instance serves, once one has
+// been issued.
+func (h *InstanceHandler) GetCertificate(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	cert, err := h.store.Certificates().GetByInstance(c.Request.Context(), instance.ID)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance has no certificate issued")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get certificate")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"certificate": cert})
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// UpgradeInstanceRequest names the Postgres major version to upgrade to.
+type UpgradeInstanceRequest struct {
+	PgVersion int `json:"pg_version" binding:"required"`
+}
+
+// UpgradeInstance starts a blue/green upgrade of a running instance to a
+// newer Postgres major version its plan supports. The instance is
+// upgrading, and still serves reads and writes, until the job cuts over to
+// the new container; see provisioner.UpgradeInstance.
+func (h *InstanceHandler) UpgradeInstance(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	var req UpgradeInstanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Bind(c, err)
+		return
+	}
+
+	if instance.Status != models.InstanceRunning {
+		apierror.Conflict(c, "Instance is "+instance.Status+"; only running instances can be upgraded")
+		return
+	}
+
+	ctx := c.Request.Context()
+	plan, err := h.store.Plans().Get(ctx, instance.Plan)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get plan")
+		return
+	}
+	current := strconv.Itoa(instance.PgVersion)
+	switch {
+	case req.PgVersion <= instance.PgVersion:
+		apierror.Validation(c, apierror.FieldError{Field: "pg_version", Code: "min", Message: "must be newer than the current " + current})
+		return
+	case !plan.SupportsVersion(req.PgVersion):
+		versions := make([]string, len(plan.PgVersions))
+		for i, v := range plan.PgVersions {
+			versions[i] = strconv.Itoa(v)
+		}
+		apierror.Validation(c, apierror.FieldError{
+			Field:   "pg_version",
+			Code:    "oneof",
+			Message: "must be one of: " + strings.Join(versions, ", ") + " with the " + plan.Name + " plan",
+		})
+		return
+	}
+
+	var (
+		upgrade *models.Upgrade
+		job     *models.Job
+	)
+	err = h.store.InTx(ctx, func(tx store.Store) error {
+		// Upgrades, rollbacks and the end of rollback windows lock the org
+		if err := tx.Orgs().Lock(ctx, project.OrgID); err != nil {
+			return err
+		}
+		current, err := tx.Instances().Get(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.InstanceRunning {
+			return store.ErrConflict
+		}
+
+		instance.Status = models.InstanceUpgrading
+		if err := tx.Instances().Update(ctx, instance); err != nil {
+			return err
+		}
+		upgrade = &models.Upgrade{
+			InstanceID:  instance.ID,
+			FromVersion: instance.PgVersion,
+			ToVersion:   req.PgVersion,
+			Status:      models.UpgradeRunning,
+			BlueNode:    instance.Node,
+			BlueCTID:    instance.CTID,
+		}
+		if err := tx.Upgrades().Create(ctx, upgrade); err != nil {
+			return err
+		}
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeUpgradeInstance, jobs.UpgradePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+			UpgradeID:  upgrade.ID,
+		})
+		return err
+	})
+	if err == store.ErrConflict {
+		apierror.Conflict(c, "Instance changed while it was being upgraded; try again")
+		return
+	}
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to upgrade instance")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"instance": instance,
+		"upgrade":  upgrade,
+		"job_id":   job.ID,
+	})
+}
+
+// RollbackUpgrade moves an instance back to the container and Postgres
+// version it had before its latest upgrade, while that upgrade's rollback
+// window is open. Writes made since the cutover are lost.
+func (h *InstanceHandler) RollbackUpgrade(c *gin.Context) {
+	instance, project, ok := h.instance(c, models.RoleMember)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var (
+		upgrade *models.Upgrade
+		job     *models.Job
+		message string
+	)
+	err := h.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Orgs().Lock(ctx, project.OrgID); err != nil {
+			return err
+		}
+		upgrades, err := tx.Upgrades().ListByInstance(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+		current, err := tx.Instances().Get(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(upgrades) == 0 || upgrades[0].Status != models.UpgradeCutOver:
+			message = "Instance has no upgrade to roll back"
+		case !time.Now().Before(*upgrades[0].RollbackUntil):
+			message = "The rollback window of the upgrade closed at " + upgrades[0].RollbackUntil.UTC().Format(time.RFC3339)
+		case current.Status != models.InstanceRunning:
+			message = "Instance is " + current.Status + "; only running instances can be rolled back"
+		}
+		if message != "" {
+			return store.ErrConflict
+		}
+
+		upgrade = &upgrades[0]
+		upgrade.Status = models.UpgradeRollingBack
+		if err := tx.Upgrades().Update(ctx, upgrade); err != nil {
+			return err
+		}
+		*instance = *current
+		instance.Status = models.InstanceUpgrading
+		if err := tx.Instances().Update(ctx, instance); err != nil {
+			return err
+		}
+		job, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeRollbackUpgrade, jobs.UpgradePayload{
+			InstanceID: instance.ID,
+			OrgID:      project.OrgID,
+			UpgradeID:  upgrade.ID,
+		})
+		return err
+	})
+	if err == store.ErrConflict {
+		if message == "" {
+			message = "Instance changed while it was being rolled back; try again"
+		}
+		apierror.Conflict(c, message)
+		return
+	}
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "Instance not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(c, err, "Failed to roll back upgrade")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"instance": instance,
+		"upgrade":  upgrade,
+		"job_id":   job.ID,
+	})
+}
+
+// ListUpgrades returns the upgrades of an instance, newest first.
+func (h *InstanceHandler) ListUpgrades(c *gin.Context) {
+	instance, _, ok := h.instance(c, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	upgrades, err := h.store.Upgrades().ListByInstance(c.Request.Context(), instance.ID)
+	if err != nil {
+		apierror.Internal(c, err, "Failed to get upgrades")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"upgrades": upgrades})
+}
@@ -1,40 +1,35 @@
 package handlers
 
 import (
-	"database/sql"
 	"net/http"
 
-	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/store"
 	"github.com/gin-gonic/gin"
 )
 
 type UserHandler struct {
-	db *sql.DB
+	users store.Users
 }
 
-func NewUserHandler(db *sql.DB) *UserHandler {
-	return &UserHandler{db: db}
+func NewUserHandler(users store.Users) *UserHandler {
+	return &UserHandler{users: users}
 }
 
 func (h *UserHandler) GetCurrentUser(c *gin.Context) {
 	userID := c.GetString("user_id")
 	if userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		apierror.Unauthorized(c, "User not authenticated")
 		return
 	}
 
-	var user models.User
-	query := "SELECT id, email, created_at, updated_at FROM users WHERE id = $1"
-	
-	err := h.db.QueryRow(query, userID).Scan(
-		&user.ID, &user.Email, &user.CreatedAt, &user.UpdatedAt,
-	)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	user, err := h.users.Get(c.Request.Context(), userID)
+	if err == store.ErrNotFound {
+		apierror.NotFound(c, "User not found")
 		return
 	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		apierror.Internal(c, err, "Failed to get user")
 		return
 	}
 
@@ -0,0 +1,260 @@
+// Package jobs is the queue for asynchronous work such as provisioning
+// instances. Jobs live in store.Jobs, which in Postgres are claimed with FOR
+// UPDATE SKIP LOCKED so any number of workers can poll the same table.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Job types
+const (
+	TypeCreateInstance     = "create_instance"
+	TypeDeleteInstance     = "delete_instance"
+	TypeResizeInstance     = "resize_instance"
+	TypeUpgradeInstance    = "upgrade_instance"
+	TypeRollbackUpgrade    = "rollback_upgrade"
+	TypeFinishUpgrade      = "finish_upgrade"
+	TypeBackupInstance     = "backup_instance"
+	TypeDeleteBackup       = "delete_backup"
+	TypeArchiveWAL         = "archive_wal"
+	TypeRestoreInstance    = "restore_instance"
+	TypeApplyNetworkPolicy = "apply_network_policy"
+	TypeAttachNetwork      = "attach_private_network"
+	TypeAddPeer            = "add_wireguard_peer"
+	TypeRemovePeer         = "remove_wireguard_peer"
+	TypeDeleteOrg          = "delete_org"
+	TypeReconcileDNS       = "reconcile_dns"
+	TypeIssueCertificate   = "issue_certificate"
+	TypeVerifyDomain       = "verify_domain"
+)
+
+var ErrJobNotFound = store.ErrNotFound
+
+// InstancePayload is the payload of instance jobs. OrgID lets the job be
+// shown to members of the org that owns the instance.
+type InstancePayload struct {
+	InstanceID string `json:"instance_id"`
+	OrgID      string `json:"org_id"`
+}
+
+// ResizePayload is the payload of resize_instance jobs: the plan and disk
+// size the instance is moving to, and the status it returns to afterwards.
+type ResizePayload struct {
+	InstanceID string `json:"instance_id"`
+	OrgID      string `json:"org_id"`
+	Plan       string `json:"plan"`
+	DiskGiB    int    `json:"disk_gib"`
+	Status     string `json:"status"`
+}
+
+// UpgradePayload is the payload of the upgrade_instance, rollback_upgrade
+// and finish_upgrade jobs of an upgrade.
+type UpgradePayload struct {
+	InstanceID string `json:"instance_id"`
+	OrgID      string `json:"org_id"`
+	UpgradeID  string `json:"upgrade_id"`
+}
+
+// BackupPayload is the payload of backup_instance and delete_backup jobs.
+// RetentionDays is how long the backup is kept once taken.
+type BackupPayload struct {
+	InstanceID    string `json:"instance_id"`
+	OrgID         string `json:"org_id"`
+	BackupID      string `json:"backup_id"`
+	RetentionDays int    `json:"retention_days,omitempty"`
+}
+
+// NetworkPayload is the payload of attach_private_network jobs.
+type NetworkPayload struct {
+	OrgID     string `json:"org_id"`
+	NetworkID string `json:"network_id"`
+}
+
+// PeerPayload is the payload of add_wireguard_peer and
+// remove_wireguard_peer jobs. A removed peer is already gone from the
+// store, so the job carries its address to log it.
+type PeerPayload struct {
+	OrgID     string `json:"org_id"`
+	NetworkID string `json:"network_id"`
+	PeerID    string `json:"peer_id"`
+	Address   string `json:"address,omitempty"`
+}
+
+// DomainPayload is the payload of verify_domain jobs.
+type DomainPayload struct {
+	InstanceID string `json:"instance_id"`
+	OrgID      string `json:"org_id"`
+	DomainID   string `json:"domain_id"`
+}
+
+// OrgPayload is the payload of delete_org jobs. InstanceJobs are the
+// delete_instance jobs enqueued along with it, which must succeed before
+// the org is removed. UserID records who asked, so they can still see the
+// job once the org and their membership are gone.
+type OrgPayload struct {
+	OrgID        string   `json:"org_id"`
+	UserID       string   `json:"user_id"`
+	InstanceJobs []string `json:"instance_jobs,omitempty"`
+}
+
+// metaKey is the payload field holding Meta. Handlers decoding payloads
+// into structs can ignore it.
+const metaKey = "_meta"
+
+// Meta links a job to the request that enqueued it. Enqueue stores it in
+// every payload.
+type Meta struct {
+	RequestID string `json:"request_id,omitempty"`
+	// Traceparent and Tracestate are the W3C trace context of the enqueueing
+	// span, so the job's spans join the same trace.
+	Traceparent string `json:"traceparent,omitempty"`
+	Tracestate  string `json:"tracestate,omitempty"`
+}
+
+// TraceContext returns the trace fields in the form tracing.Extract expects.
+func (m Meta) TraceContext() map[string]string {
+	return map[string]string{"traceparent": m.Traceparent, "tracestate": m.Tracestate}
+}
+
+type Queue struct {
+	jobs store.Jobs
+}
+
+func NewQueue(jobs store.Jobs) *Queue {
+	return &Queue{jobs: jobs}
+}
+
+// Enqueue adds a pending job of jobType. payload must encode to a JSON
+// object; the request ID carried by ctx is added to it as Meta.
+func (q *Queue) Enqueue(ctx context.Context, jobType string, payload interface{}) (*models.Job, error) {
+	return q.enqueue(ctx, jobType, payload, nil)
+}
+
+// EnqueueAt is Enqueue for a job that isn't claimed before at.
+func (q *Queue) EnqueueAt(ctx context.Context, jobType string, payload interface{}, at time.Time) (*models.Job, error) {
+	return q.enqueue(ctx, jobType, payload, &at)
+}
+
+func (q *Queue) enqueue(ctx context.Context, jobType string, payload interface{}, runAfter *time.Time) (*models.Job, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "enqueue "+jobType,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("job.type", jobType)),
+	)
+	defer span.End()
+
+	data, err := encodePayload(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := models.Job{Type: jobType, PayloadJSON: string(data), RunAfter: runAfter}
+	if err := q.jobs.Create(ctx, &job); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("job.id", job.ID))
+	return &job, nil
+}
+
+// Claim marks the oldest pending job that is due as running on workerID
+// and returns it, or returns nil when there is none.
+func (q *Queue) Claim(ctx context.Context, workerID string) (*models.Job, error) {
+	return q.jobs.Claim(ctx, workerID)
+}
+
+// SetProgress records how far a running job has got, for clients polling
+// it.
+func (q *Queue) SetProgress(ctx context.Context, id, step string, percent int, message string) error {
+	return q.jobs.SetProgress(ctx, id, &models.JobProgress{Step: step, Percent: percent, Message: message})
+}
+
+// Finish records the outcome of a job: completed when jobErr is nil,
+// failed with its message otherwise.
+func (q *Queue) Finish(ctx context.Context, id string, jobErr error) error {
+	status, message := StatusCompleted, ""
+	if jobErr != nil {
+		status, message = StatusFailed, jobErr.Error()
+	}
+	return q.jobs.Finish(ctx, id, status, message)
+}
+
+// Release returns running jobs to the queue when their worker has not sent
+// a heartbeat within timeout, so a crashed worker's jobs are retried.
+func (q *Queue) Release(ctx context.Context, timeout time.Duration) (int64, error) {
+	return q.jobs.Release(ctx, timeout)
+}
+
+// OrgID returns the org a job was enqueued for, if its payload records one.
+func OrgID(job *models.Job) string {
+	var payload struct {
+		OrgID string `json:"org_id"`
+	}
+	json.Unmarshal([]byte(job.PayloadJSON), &payload)
+	return payload.OrgID
+}
+
+// UserID returns the user a job was enqueued by, if its payload records one.
+func UserID(job *models.Job) string {
+	var payload struct {
+		UserID string `json:"user_id"`
+	}
+	json.Unmarshal([]byte(job.PayloadJSON), &payload)
+	return payload.UserID
+}
+
+// ParseMeta returns the Meta stored in a job payload.
+func ParseMeta(payloadJSON string) Meta {
+	var payload struct {
+		Meta Meta `json:"_meta"`
+	}
+	json.Unmarshal([]byte(payloadJSON), &payload)
+	return payload.Meta
+}
+
+func encodePayload(ctx context.Context, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job payload: %w", err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("job payload must be a JSON object")
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+
+	carrier := tracing.Inject(ctx)
+	meta, err := json.Marshal(Meta{
+		RequestID:   logging.RequestID(ctx),
+		Traceparent: carrier["traceparent"],
+		Tracestate:  carrier["tracestate"],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job metadata: %w", err)
+	}
+	fields[metaKey] = meta
+
+	return json.Marshal(fields)
+}
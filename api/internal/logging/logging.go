@@ -0,0 +1,109 @@
+// Package logging configures structured JSON logging with log/slog and
+// carries a request-scoped logger through context.Context, so every line
+// logged while serving a request or running a job shares its request ID.
+package logging
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/zallarak/db/api/internal/config"
+)
+
+type ctxKey int
+
+const (
+	loggerKey ctxKey = iota
+	requestIDKey
+)
+
+// New returns a logger writing to stdout in cfg.Format and makes it the
+// default for slog and the standard log package.
+func New(cfg config.LogConfig) *slog.Logger {
+	logger := slog.New(newHandler(os.Stdout, cfg))
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	return logger
+}
+
+func newHandler(w io.Writer, cfg config.LogConfig) slog.Handler {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	if cfg.Format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With adds attributes to the logger carried by ctx.
+func With(ctx context.Context, args ...interface{}) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID and a logger
+// that includes it.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return With(ctx, "request_id", requestID)
+}
+
+// RequestID returns the request ID carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// sensitiveKeys are attribute names whose values are never logged. Keys are
+// matched case-insensitively, and also as suffixes such as "jwt_secret".
+var sensitiveKeys = []string{
+	"password",
+	"pw_hash",
+	"token",
+	"secret",
+	"authorization",
+	"cookie",
+	"code_verifier",
+	"device_code",
+	"private_key",
+}
+
+const redacted = "[REDACTED]"
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitiveKeys {
+		if key == s || strings.HasSuffix(key, "_"+s) || strings.HasSuffix(key, "."+s) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+
+	if a.Value.Kind() == slog.KindString && strings.HasPrefix(a.Value.String(), "Bearer ") {
+		return slog.String(a.Key, "Bearer "+redacted)
+	}
+	return a
+}
@@ -0,0 +1,81 @@
+// Package metrics defines the Prometheus metrics of the control plane and
+// serves them in the text exposition format on the admin listener.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dbx"
+
+// Registry holds every metric below plus the Go runtime and process
+// collectors. A dedicated registry keeps metrics registered by libraries
+// out of /metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests, by route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time spent running jobs, by type and outcome.",
+		// Provisioning can take minutes
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"type", "status"})
+
+	JobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_failures_total",
+		Help:      "Jobs that failed, by type.",
+	}, []string{"type"})
+
+	ClientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "client_request_duration_seconds",
+		Help:      "Latency of outgoing HTTP calls, by client (proxmox, oidc), method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client", "method", "status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		JobDuration,
+		JobFailures,
+		ClientRequestDuration,
+	)
+}
+
+// RegisterDB exports the connection pool statistics of db, and the depth and
+// age of the job queue stored in it.
+func RegisterDB(db *sql.DB) {
+	Registry.MustRegister(
+		collectors.NewDBStatsCollector(db, "dbxyz"),
+		newQueueCollector(db),
+	)
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
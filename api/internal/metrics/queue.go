@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queueScrapeTimeout bounds the query run on every scrape.
+const queueScrapeTimeout = 5 * time.Second
+
+var (
+	jobsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "jobs"),
+		"Jobs waiting or running, by type and status.",
+		[]string{"type", "status"}, nil,
+	)
+	jobAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "job_oldest_age_seconds"),
+		"Age of the oldest waiting or running job, by type and status.",
+		[]string{"type", "status"}, nil,
+	)
+)
+
+// queueCollector reads the job queue on each scrape rather than tracking it
+// in memory, so it is correct with any number of API servers and workers.
+// Finished jobs are left out to keep the query on the pending/running rows,
+// and so are jobs delayed until later, which aren't waiting yet.
+type queueCollector struct {
+	db *sql.DB
+}
+
+func newQueueCollector(db *sql.DB) *queueCollector {
+	return &queueCollector{db: db}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jobsDesc
+	ch <- jobAgeDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), queueScrapeTimeout)
+	defer cancel()
+
+	query := `
+		SELECT type, status, COUNT(*), EXTRACT(EPOCH FROM NOW() - MIN(COALESCE(run_after, created_at)))
+		FROM jobs
+		WHERE status IN ('pending', 'running')
+		AND (run_after IS NULL OR run_after <= NOW())
+		GROUP BY type, status`
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		slog.Error("failed to collect job queue metrics", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			jobType, status string
+			count           int64
+			age             float64
+		)
+		if err := rows.Scan(&jobType, &status, &count, &age); err != nil {
+			slog.Error("failed to collect job queue metrics", "error", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(count), jobType, status)
+		ch <- prometheus.MustNewConstMetric(jobAgeDesc, prometheus.GaugeValue, age, jobType, status)
+	}
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InstrumentTransport wraps rt, or http.DefaultTransport if nil, so calls
+// made through it are recorded in ClientRequestDuration under client.
+func InstrumentTransport(client string, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &instrumentedTransport{client: client, next: rt}
+}
+
+type instrumentedTransport struct {
+	client string
+	next   http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	ClientRequestDuration.WithLabelValues(t.client, req.Method, status).Observe(time.Since(start).Seconds())
+	return resp, err
+}
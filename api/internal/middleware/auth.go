@@ -1,10 +1,11 @@
 package middleware
 
 import (
-	"net/http"
 	"strings"
 
+	"github.com/zallarak/db/api/internal/apierror"
 	"github.com/zallarak/db/api/internal/auth"
+	"github.com/zallarak/db/api/internal/logging"
 	"github.com/gin-gonic/gin"
 )
 
@@ -12,27 +13,26 @@ func AuthRequired(authService *auth.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+			apierror.Unauthorized(c, "Authorization header required")
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 		if tokenString == authHeader {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
-			c.Abort()
+			apierror.Unauthorized(c, "Bearer token required")
 			return
 		}
 
 		claims, err := authService.ValidateToken(tokenString)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			apierror.Unauthorized(c, "Invalid token")
 			return
 		}
 
 		c.Set("user_id", claims.UserID)
 		c.Set("email", claims.Email)
+		c.Set("sso_org_id", claims.SSOOrgID)
+		c.Request = c.Request.WithContext(logging.With(c.Request.Context(), "user_id", claims.UserID))
 		c.Next()
 	}
 }
\ No newline at end of file
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/zallarak/db/api/internal/apierror"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logger logs one line per request once it has been served. It must run
+// after RequestID and the tracing middleware so the line carries the request
+// and trace IDs.
+func Logger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Taken before the handlers run, which may add user_id to the
+		// context logger themselves.
+		logger := logging.FromContext(c.Request.Context())
+		if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		// The query string is left out: it can carry OAuth codes and state
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if userID := c.GetString("user_id"); userID != "" {
+			attrs = append(attrs, slog.String("user_id", userID))
+		}
+		if orgID := c.Param("orgId"); orgID != "" {
+			attrs = append(attrs, slog.String("org_id", orgID))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+
+		logger.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recovery turns panics into 500 responses and logs them with the stack,
+// through the request logger.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+				logging.FromContext(c.Request.Context()).Error("panic serving request",
+					"panic", r,
+					"stack", string(debug.Stack()),
+				)
+				apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Internal server error")
+			}
+		}()
+		c.Next()
+	}
+}
@@ -1,18 +1,23 @@
 package middleware
 
 import (
+	"github.com/zallarak/db/api/internal/logging"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
+// maxRequestIDLen caps client-supplied request IDs so they can't bloat logs.
+const maxRequestIDLen = 128
+
 func RequestID() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		requestID := c.GetHeader("X-Request-ID")
-		if requestID == "" {
+		if requestID == "" || len(requestID) > maxRequestIDLen {
 			requestID = uuid.New().String()
 		}
 		c.Set("request_id", requestID)
 		c.Header("X-Request-ID", requestID)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), requestID))
 		c.Next()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,51 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Create writes empty up and down scripts for a new migration in dir,
+// numbered after the highest existing version, and returns their paths.
+func Create(dir, name string) ([]string, error) {
+	name = strings.ToLower(strings.NewReplacer("-", "_", " ", "_").Replace(name))
+	if !namePattern.MatchString(name) {
+		return nil, fmt.Errorf("migration name must contain only letters, digits and underscores")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	var latest int64
+	for _, entry := range entries {
+		m := fileNamePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		if v, _ := strconv.ParseInt(m[1], 10, 64); v > latest {
+			latest = v
+		}
+	}
+
+	base := fmt.Sprintf("%03d_%s", latest+1, name)
+	paths := []string{
+		filepath.Join(dir, base+".up.sql"),
+		filepath.Join(dir, base+".down.sql"),
+	}
+	for _, p := range paths {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create migration: %w", err)
+		}
+		f.Close()
+	}
+	return paths, nil
+}
@@ -0,0 +1,381 @@
+// Package migrate applies the embedded SQL schema migrations. Applied
+// versions are recorded in schema_migrations together with a checksum of
+// their up script, so a migration edited after it ran is reported instead of
+// silently diverging from the databases it was applied to.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("applied migrations have been modified")
+	ErrNoDownMigration  = errors.New("migration has no down script")
+	ErrAlreadyApplied   = errors.New("database already has applied migrations")
+)
+
+// lockID is the pg_advisory_lock key held while migrating, so servers that
+// start at the same time with auto-migrate don't race each other.
+const lockID int64 = 0x6462787a6d6967 // "dbxzmig"
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Status describes a migration and whether it has been applied. Missing is
+// set for versions recorded in the database that this binary doesn't know.
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+	Modified  bool
+	Missing   bool
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New reads the migrations in fsys.
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Load parses NNN_name.up.sql and NNN_name.down.sql files from the root of
+// fsys, ordered by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		m := fileNamePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+			mig.Checksum = checksum(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest returns the highest known migration version.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the highest applied version, or 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	var version sql.NullInt64
+	err := m.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		if isUndefinedTable(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return version.Int64, nil
+}
+
+// Up applies every pending migration in order, each in its own transaction.
+// It refuses to run if an applied migration has been modified.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		records, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(records); err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := records[mig.Version]; ok {
+				continue
+			}
+			if err := run(ctx, conn, mig, mig.Up, true); err != nil {
+				return err
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations, newest first.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		records, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(records); err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := records[mig.Version]; !ok {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("%w: %d_%s", ErrNoDownMigration, mig.Version, mig.Name)
+			}
+			if err := run(ctx, conn, mig, mig.Down, false); err != nil {
+				return err
+			}
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Baseline records every migration up to and including version as applied
+// without running it, for databases created before the runner existed.
+func (m *Migrator) Baseline(ctx context.Context, version int64) ([]Migration, error) {
+	var marked []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		records, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			return ErrAlreadyApplied
+		}
+
+		for _, mig := range m.migrations {
+			if mig.Version > version {
+				break
+			}
+			_, err := conn.ExecContext(ctx,
+				"INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+				mig.Version, mig.Name, mig.Checksum)
+			if err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", mig.Version, err)
+			}
+			marked = append(marked, mig)
+		}
+		return nil
+	})
+	return marked, err
+}
+
+// Status lists known and applied migrations ordered by version.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	records, err := appliedVersions(ctx, m.db)
+	if err != nil && !isUndefinedTable(err) {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, mig := range m.migrations {
+		s := Status{Version: mig.Version, Name: mig.Name}
+		if r, ok := records[mig.Version]; ok {
+			appliedAt := r.appliedAt
+			s.Applied = true
+			s.AppliedAt = &appliedAt
+			s.Modified = r.checksum != mig.Checksum
+			delete(records, mig.Version)
+		}
+		statuses = append(statuses, s)
+	}
+	for _, r := range records {
+		appliedAt := r.appliedAt
+		statuses = append(statuses, Status{
+			Version:   r.version,
+			Name:      r.name,
+			Applied:   true,
+			AppliedAt: &appliedAt,
+			Missing:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+type record struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// withLock runs fn on a single connection holding the migration advisory
+// lock. Session-level advisory locks belong to a connection, so everything
+// has to go through conn rather than the pool.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		)`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) verify(records map[int64]record) error {
+	var modified []string
+	for _, mig := range m.migrations {
+		if r, ok := records[mig.Version]; ok && r.checksum != mig.Checksum {
+			modified = append(modified, fmt.Sprintf("%d_%s", mig.Version, mig.Name))
+		}
+	}
+	if len(modified) > 0 {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, strings.Join(modified, ", "))
+	}
+	return nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func appliedVersions(ctx context.Context, q queryer) (map[int64]record, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	records := make(map[int64]record)
+	for rows.Next() {
+		var r record
+		if err := rows.Scan(&r.version, &r.name, &r.checksum, &r.appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		records[r.version] = r
+	}
+	return records, rows.Err()
+}
+
+// run executes script and records (up) or forgets (down) mig in the same
+// transaction, so a failed migration leaves no trace.
+func run(ctx context.Context, conn *sql.Conn, mig Migration, script string, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s (%s) failed: %w", mig.Version, mig.Name, direction, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+			mig.Version, mig.Name, mig.Checksum)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", mig.Version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", mig.Version, err)
+	}
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isUndefinedTable reports whether err is Postgres error 42P01, which Status
+// and Version treat as a database that has never been migrated.
+func isUndefinedTable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "42P01"
+}
@@ -21,6 +21,19 @@ const (
 	RoleViewer UserRole = "viewer"
 )
 
+var roleRanks = map[UserRole]int{
+	RoleViewer: 1,
+	RoleMember: 2,
+	RoleAdmin:  3,
+	RoleOwner:  4,
+}
+
+// AtLeast reports whether r grants every permission of min. Owners outrank
+// admins, admins members and members viewers.
+func (r UserRole) AtLeast(min UserRole) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[min]
+}
+
 type Membership struct {
 	UserID string   `json:"user_id" db:"user_id"`
 	OrgID  string   `json:"org_id" db:"org_id"`
@@ -50,11 +63,82 @@ type Instance struct {
 	Node      string    `json:"node" db:"node"`
 	CTID      int       `json:"ctid" db:"ctid"`
 	FQDN      string    `json:"fqdn" db:"fqdn"`
+	DiskGiB   int       `json:"disk_gib" db:"disk_gib"`
 	Status    string    `json:"status" db:"status"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// RestoredFrom is set on instances created by restoring a backup.
+	RestoredFrom *RestoreSource `json:"restored_from,omitempty" db:"restored_from"`
+	// PrivateAddress is the address of the instance on the private network
+	// of its org, once it is attached to it.
+	PrivateAddress string `json:"private_address,omitempty" db:"private_address"`
+}
+
+// RestoreSource is the provenance of a restored instance: the backup it
+// was restored from, replayed up to TargetTime or TargetLSN if either is
+// set, and the point the recovery reached once the restore has run.
+type RestoreSource struct {
+	InstanceID    string     `json:"instance_id"`
+	BackupID      string     `json:"backup_id"`
+	PgVersion     int        `json:"pg_version"`
+	TargetTime    *time.Time `json:"target_time,omitempty"`
+	TargetLSN     string     `json:"target_lsn,omitempty"`
+	RecoveredLSN  string     `json:"recovered_lsn,omitempty"`
+	RecoveredTime *time.Time `json:"recovered_time,omitempty"`
+}
+
+// Plan is an entry of the plan catalog: the size of the container of its
+// instances and what they may be created with.
+type Plan struct {
+	Name     string `json:"name" db:"name"`
+	VCPUs    int    `json:"vcpus" db:"vcpus"`
+	MemoryMB int    `json:"memory_mb" db:"memory_mb"`
+	// DiskGiB is the disk of instances that don't choose a size between
+	// MinDiskGiB and MaxDiskGiB.
+	DiskGiB        int   `json:"disk_gib" db:"disk_gib"`
+	MinDiskGiB     int   `json:"min_disk_gib" db:"min_disk_gib"`
+	MaxDiskGiB     int   `json:"max_disk_gib" db:"max_disk_gib"`
+	MaxConnections int   `json:"max_connections" db:"max_connections"`
+	PgVersions     []int `json:"pg_versions" db:"pg_versions"`
+	// Deprecated plans keep their instances but take no new ones.
+	Deprecated bool      `json:"deprecated" db:"deprecated"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// SupportsVersion reports whether instances of the plan may run Postgres
+// version v.
+func (p *Plan) SupportsVersion(v int) bool {
+	for _, pv := range p.PgVersions {
+		if pv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Quota overrides the configured instance limits of one org or project.
+// Nil fields keep the configured limit; zero means no limit.
+type Quota struct {
+	Instances *int `json:"instances" db:"max_instances"`
+	VCPUs     *int `json:"vcpus" db:"max_vcpus"`
+	MemoryMB  *int `json:"memory_mb" db:"max_memory_mb"`
+	DiskGiB   *int `json:"disk_gib" db:"max_disk_gib"`
+	// Plans lists the plans allowed; nil keeps the configured list.
+	Plans     []string  `json:"plans" db:"allowed_plans"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
+const (
+	InstancePending      = "pending"
+	InstanceProvisioning = "provisioning"
+	InstanceRunning      = "running"
+	InstanceStopped      = "stopped"
+	InstanceResizing     = "resizing"
+	InstanceUpgrading    = "upgrading"
+	InstanceDeleting     = "deleting"
+	InstanceFailed       = "failed"
+)
+
 type ApiKey struct {
 	ID         string    `json:"id" db:"id"`
 	UserID     string    `json:"user_id" db:"user_id"`
@@ -77,10 +161,322 @@ type AuditLog struct {
 }
 
 type Job struct {
-	ID          string    `json:"id" db:"id"`
-	Type        string    `json:"type" db:"type"`
-	PayloadJSON string    `json:"payload_json" db:"payload_json"`
-	Status      string    `json:"status" db:"status"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
-}
\ No newline at end of file
+	ID           string     `json:"id" db:"id"`
+	Type         string     `json:"type" db:"type"`
+	PayloadJSON  string     `json:"payload_json" db:"payload_json"`
+	Status       string     `json:"status" db:"status"`
+	ErrorMessage string     `json:"error_message,omitempty" db:"error_message"`
+	WorkerID     string     `json:"-" db:"worker_id"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty" db:"started_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+	// RunAfter delays a pending job; nil runs it as soon as possible.
+	RunAfter *time.Time   `json:"run_after,omitempty" db:"run_after"`
+	Progress *JobProgress `json:"progress,omitempty" db:"progress"`
+}
+
+// JobProgress is what a running job reports about how far it has got.
+type JobProgress struct {
+	// Step names the stage the job is in, e.g. copying.
+	Step    string `json:"step"`
+	Percent int    `json:"percent"`
+	Message string `json:"message,omitempty"`
+}
+
+// Upgrade moves an instance to a newer Postgres major version, blue/green:
+// a green container is provisioned with the new version, the data is
+// copied from the blue one and the instance cut over to green. Blue is
+// kept, stopped, until RollbackUntil.
+type Upgrade struct {
+	ID          string `json:"id" db:"id"`
+	InstanceID  string `json:"instance_id" db:"instance_id"`
+	FromVersion int    `json:"from_version" db:"from_version"`
+	ToVersion   int    `json:"to_version" db:"to_version"`
+	Status      string `json:"status" db:"status"`
+	BlueNode    string `json:"blue_node" db:"blue_node"`
+	BlueCTID    int    `json:"blue_ctid" db:"blue_ctid"`
+	GreenNode   string `json:"green_node,omitempty" db:"green_node"`
+	GreenCTID   int    `json:"green_ctid,omitempty" db:"green_ctid"`
+	// CutOverAt is when the instance moved to green.
+	CutOverAt     *time.Time `json:"cut_over_at,omitempty" db:"cut_over_at"`
+	RollbackUntil *time.Time `json:"rollback_until,omitempty" db:"rollback_until"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+const (
+	// UpgradeRunning: green is being provisioned and filled
+	UpgradeRunning = "running"
+	// UpgradeCutOver: the instance runs on green, blue is kept for rollback
+	UpgradeCutOver = "cut_over"
+	// UpgradeFinished: the rollback window closed and blue is gone
+	UpgradeFinished    = "finished"
+	UpgradeRollingBack = "rolling_back"
+	// UpgradeRolledBack: the instance is back on blue and green is gone
+	UpgradeRolledBack = "rolled_back"
+	UpgradeFailed     = "failed"
+)
+
+// BackupPolicy schedules base backups of an instance with a five-field
+// cron expression, evaluated in UTC.
+type BackupPolicy struct {
+	ID         string `json:"id" db:"id"`
+	InstanceID string `json:"instance_id" db:"instance_id"`
+	Schedule   string `json:"schedule" db:"schedule"`
+	// RetentionDays is how long its backups are kept once taken.
+	RetentionDays int `json:"retention_days" db:"retention_days"`
+	// NextRunAt is when the scheduler next backs the instance up.
+	NextRunAt time.Time `json:"next_run_at" db:"next_run_at"`
+	// WALArchiving archives the instance's WAL between backups, for
+	// point-in-time recovery. NextWALArchiveAt is when the scheduler next
+	// ships it.
+	WALArchiving     bool      `json:"wal_archiving" db:"wal_archiving"`
+	NextWALArchiveAt time.Time `json:"-" db:"next_wal_archive_at"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Backup is a base backup of an instance, stored as an object at RepoURL.
+type Backup struct {
+	ID         string `json:"id" db:"id"`
+	InstanceID string `json:"instance_id" db:"instance_id"`
+	// Kind is scheduled, or manual for backups taken on demand.
+	Kind         string     `json:"kind" db:"kind"`
+	Status       string     `json:"status" db:"status"`
+	PgVersion    int        `json:"pg_version,omitempty" db:"pg_version"`
+	RepoURL      string     `json:"repo_url" db:"repo_url"`
+	SizeBytes    int64      `json:"size_bytes,omitempty" db:"size_bytes"`
+	ErrorMessage string     `json:"error_message,omitempty" db:"error_message"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty" db:"started_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+	// ExpiresAt is when the backup is pruned.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	// StartLSN is where WAL replay from the backup starts, and EndLSN the
+	// first point it is consistent at.
+	StartLSN string `json:"start_lsn,omitempty" db:"start_lsn"`
+	EndLSN   string `json:"end_lsn,omitempty" db:"end_lsn"`
+}
+
+const (
+	BackupScheduled = "scheduled"
+	BackupManual    = "manual"
+)
+
+const (
+	BackupPending   = "pending"
+	BackupRunning   = "running"
+	BackupCompleted = "completed"
+	BackupFailed    = "failed"
+	// BackupDeleting: the backup expired and its object is being removed
+	BackupDeleting = "deleting"
+)
+
+// WALSegment is a WAL segment file of an instance, archived to the object
+// store for point-in-time recovery. It holds the WAL from StartLSN up to
+// EndLSN, the last transaction of which committed at EndTime.
+type WALSegment struct {
+	InstanceID string    `json:"instance_id" db:"instance_id"`
+	Name       string    `json:"name" db:"name"`
+	StartLSN   string    `json:"start_lsn" db:"start_lsn"`
+	EndLSN     string    `json:"end_lsn" db:"end_lsn"`
+	EndTime    time.Time `json:"end_time" db:"end_time"`
+	SizeBytes  int64     `json:"size_bytes" db:"size_bytes"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// RecoveryWindow is the span an instance can be restored to any point of:
+// from the end of its oldest usable backup to the end of its archived WAL.
+type RecoveryWindow struct {
+	FromTime time.Time `json:"from_time"`
+	FromLSN  string    `json:"from_lsn"`
+	ToTime   time.Time `json:"to_time"`
+	ToLSN    string    `json:"to_lsn"`
+}
+
+// NetworkPolicy decides who can connect to an instance's Postgres. A public
+// instance accepts AllowedCIDRs, or any address if the list is empty; a
+// private one accepts AllowedCIDRs, or every private network if the list is
+// empty, and its CIDRs must be within the private networks.
+type NetworkPolicy struct {
+	ID           string    `json:"id,omitempty" db:"id"`
+	InstanceID   string    `json:"instance_id" db:"instance_id"`
+	Exposure     string    `json:"exposure" db:"exposure"`
+	AllowedCIDRs []string  `json:"allowed_cidrs" db:"allowed_cidrs"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+const (
+	ExposurePublic  = "public"
+	ExposurePrivate = "private"
+)
+
+// PrivateNetwork is the private network of an org: a subnet on a VLAN of its
+// own, which the org's instances are attached to and its WireGuard peers
+// reach through the gateway.
+type PrivateNetwork struct {
+	ID        string    `json:"id" db:"id"`
+	OrgID     string    `json:"org_id" db:"org_id"`
+	Subnet    string    `json:"subnet" db:"subnet"`
+	VLAN      int       `json:"vlan" db:"vlan"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// WireGuardPeer is a client of a private network, such as a laptop or a
+// server outside the platform, connecting through the WireGuard gateway
+// from Address. Only its public key is kept.
+type WireGuardPeer struct {
+	ID        string    `json:"id" db:"id"`
+	NetworkID string    `json:"network_id" db:"network_id"`
+	Name      string    `json:"name" db:"name"`
+	PublicKey string    `json:"public_key" db:"public_key"`
+	Address   string    `json:"address" db:"address"`
+	CreatedBy string    `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// DNSRecord is the record published for an instance in the instance zone:
+// its FQDN, without the trailing dot, pointing at the address of its
+// container. Type is A or AAAA and TTL is in seconds.
+type DNSRecord struct {
+	Name       string    `json:"name" db:"name"`
+	Type       string    `json:"type" db:"type"`
+	Value      string    `json:"value" db:"value"`
+	TTL        int       `json:"ttl" db:"ttl"`
+	InstanceID string    `json:"instance_id" db:"instance_id"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Certificate is the certificate an instance serves, issued for DNSNames
+// by Issuer, internal or acme. CertificatePEM is the chain the instance
+// serves; its key never leaves the container. RenewAt is when the scheduler
+// next renews it.
+type Certificate struct {
+	InstanceID     string    `json:"instance_id" db:"instance_id"`
+	Issuer         string    `json:"issuer" db:"issuer"`
+	Serial         string    `json:"serial" db:"serial"`
+	DNSNames       []string  `json:"dns_names" db:"dns_names"`
+	NotBefore      time.Time `json:"not_before" db:"not_before"`
+	NotAfter       time.Time `json:"not_after" db:"not_after"`
+	RenewAt        time.Time `json:"renew_at" db:"renew_at"`
+	CertificatePEM string    `json:"certificate" db:"certificate"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+const (
+	DomainPending  = "pending"
+	DomainVerified = "verified"
+	// DomainFailed: the ownership record didn't show up in time
+	DomainFailed = "failed"
+)
+
+// Domain is a custom domain of an instance, such as db.internal.ourco.com.
+// It is pending until the TXT record at VerificationName holds
+// VerificationValue, proving the org controls the domain, and fails if that
+// doesn't happen by ExpiresAt; NextCheckAt is when the record is next
+// looked up. A verified domain is added to the certificate of the instance.
+// Each domain is verified for one instance at a time.
+type Domain struct {
+	ID                string     `json:"id" db:"id"`
+	InstanceID        string     `json:"instance_id" db:"instance_id"`
+	Name              string     `json:"name" db:"name"`
+	Status            string     `json:"status" db:"status"`
+	VerificationName  string     `json:"verification_name" db:"verification_name"`
+	VerificationValue string     `json:"verification_value" db:"verification_value"`
+	ErrorMessage      string     `json:"error_message,omitempty" db:"error_message"`
+	NextCheckAt       *time.Time `json:"next_check_at,omitempty" db:"next_check_at"`
+	ExpiresAt         time.Time  `json:"expires_at" db:"expires_at"`
+	VerifiedAt        *time.Time `json:"verified_at,omitempty" db:"verified_at"`
+	CreatedBy         string     `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+	// CNAMETarget is the name the org points the domain at: the domain
+	// proxy, or the instance's FQDN when there is none. It isn't stored.
+	CNAMETarget string `json:"cname_target,omitempty" db:"-"`
+}
+
+type UserIdentity struct {
+	ID          string     `json:"id" db:"id"`
+	UserID      string     `json:"user_id" db:"user_id"`
+	Issuer      string     `json:"issuer" db:"issuer"`
+	Subject     string     `json:"subject" db:"subject"`
+	Email       string     `json:"email" db:"email"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at" db:"last_login_at"`
+}
+
+// SSOConnection is the OpenID Connect provider of an org. Domains holds the
+// verification state of each of AutoJoinDomains, which only route logins
+// and auto-join users once verified.
+type SSOConnection struct {
+	OrgID           string      `json:"org_id" db:"org_id"`
+	Issuer          string      `json:"issuer" db:"issuer"`
+	ClientID        string      `json:"client_id" db:"client_id"`
+	ClientSecret    string      `json:"-" db:"client_secret"`
+	Enforced        bool        `json:"enforced" db:"enforced"`
+	AutoJoinDomains []string    `json:"auto_join_domains" db:"auto_join_domains"`
+	AutoJoinRole    UserRole    `json:"auto_join_role" db:"auto_join_role"`
+	Domains         []SSODomain `json:"domains" db:"-"`
+	CreatedAt       time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// SSODomain is an email domain claimed by the SSO connection of an org. Like
+// a custom domain, it is pending until the TXT record at VerificationName
+// holds VerificationValue; ErrorMessage says what the last check found
+// instead. A domain is verified for one org at a time.
+type SSODomain struct {
+	ID                string     `json:"id" db:"id"`
+	OrgID             string     `json:"org_id" db:"org_id"`
+	Name              string     `json:"name" db:"name"`
+	Status            string     `json:"status" db:"status"`
+	VerificationName  string     `json:"verification_name" db:"verification_name"`
+	VerificationValue string     `json:"verification_value" db:"verification_value"`
+	ErrorMessage      string     `json:"error_message,omitempty" db:"error_message"`
+	VerifiedAt        *time.Time `json:"verified_at,omitempty" db:"verified_at"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// SSOLoginState is an SSO login in flight at the identity provider.
+// LinkUserID is set when a signed-in user started it to link the identity
+// to their account, and DeviceUserCode when it was started to approve a
+// device login.
+type SSOLoginState struct {
+	State          string    `db:"state"`
+	OrgID          string    `db:"org_id"`
+	CodeVerifier   string    `db:"code_verifier"`
+	Nonce          string    `db:"nonce"`
+	LinkUserID     string    `db:"link_user_id"`
+	DeviceUserCode string    `db:"device_user_code"`
+	ExpiresAt      time.Time `db:"expires_at"`
+}
+
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceDenied   = "denied"
+)
+
+// DeviceAuthorization is a device login (RFC 8628), such as from `dbx auth
+// login --web`, waiting for a signed-in user to approve UserCode. Only a
+// hash of the device code the device polls with is kept. UserID and
+// SSOOrgID are those of the session that approved it.
+type DeviceAuthorization struct {
+	ID             string     `db:"id"`
+	DeviceCodeHash string     `db:"device_code_hash"`
+	UserCode       string     `db:"user_code"`
+	ClientID       string     `db:"client_id"`
+	Status         string     `db:"status"`
+	UserID         string     `db:"user_id"`
+	SSOOrgID       string     `db:"sso_org_id"`
+	PollInterval   int        `db:"poll_interval"`
+	LastPolledAt   *time.Time `db:"last_polled_at"`
+	ExpiresAt      time.Time  `db:"expires_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
@@ -0,0 +1,224 @@
+// Package netpolicy compiles the network policies of instances into what
+// enforces them: rules of the container's Proxmox firewall for the Postgres
+// port, and the pg_hba.conf entries Postgres authenticates connections
+// with. Both are always rebuilt from the whole policy, so applying one twice
+// changes nothing.
+package netpolicy
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/proxmox"
+)
+
+const (
+	// Port is the port Postgres listens on in every container.
+	Port = 5432
+	// MaxCIDRs bounds the allow-list of a policy.
+	MaxCIDRs = 100
+	// RuleComment marks the firewall rules a policy compiles to, telling
+	// them apart from those operators add.
+	RuleComment = "dbx: network policy"
+)
+
+// anywhere is what the pg_hba.conf entries of an instance open to every
+// address use as sources.
+var anywhere = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// CIDRError is an allow-list that can't be used, because of its entry
+// CIDR if set.
+type CIDRError struct {
+	CIDR   string
+	Reason string
+}
+
+func (e *CIDRError) Error() string {
+	if e.CIDR == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s %s", e.CIDR, e.Reason)
+}
+
+// Compiler compiles policies against the networks of the configuration.
+type Compiler struct {
+	private  []netip.Prefix
+	internal []netip.Prefix
+}
+
+// NewCompiler returns a compiler for cfg, which Validate has checked.
+func NewCompiler(cfg config.NetworkConfig) *Compiler {
+	c := &Compiler{}
+	for _, cidr := range cfg.PrivateCIDRs {
+		c.private = append(c.private, netip.MustParsePrefix(cidr))
+	}
+	for _, cidr := range cfg.InternalCIDRs {
+		c.internal = append(c.internal, netip.MustParsePrefix(cidr))
+	}
+	return c
+}
+
+// Default returns the policy of an instance that has none: public to any
+// address, as instances were before policies, since it was created.
+func Default(inst *models.Instance) *models.NetworkPolicy {
+	return &models.NetworkPolicy{
+		InstanceID:   inst.ID,
+		Exposure:     models.ExposurePublic,
+		AllowedCIDRs: []string{},
+		CreatedAt:    inst.CreatedAt,
+		UpdatedAt:    inst.CreatedAt,
+	}
+}
+
+// Normalize returns cidrs in canonical form without duplicates, in the
+// order given. A bare address is taken as a block of one address. It
+// returns a *CIDRError for the first entry that isn't a CIDR block, has
+// host bits set, or, for private exposure, is outside the private
+// networks.
+func (c *Compiler) Normalize(exposure string, cidrs []string) ([]string, error) {
+	if len(cidrs) > MaxCIDRs {
+		return nil, &CIDRError{Reason: "can list at most " + strconv.Itoa(MaxCIDRs) + " blocks"}
+	}
+	normalized := make([]string, 0, len(cidrs))
+	seen := make(map[netip.Prefix]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := parse(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if exposure == models.ExposurePrivate && !within(prefix, c.private) {
+			return nil, &CIDRError{CIDR: cidr, Reason: "is not within the private networks, which private instances only accept"}
+		}
+		if !seen[prefix] {
+			seen[prefix] = true
+			normalized = append(normalized, prefix.String())
+		}
+	}
+	return normalized, nil
+}
+
+func parse(cidr string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(cidr); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, &CIDRError{CIDR: cidr, Reason: "is not a CIDR block such as 203.0.113.0/24"}
+	}
+	if masked := prefix.Masked(); masked != prefix {
+		return netip.Prefix{}, &CIDRError{CIDR: cidr, Reason: "has host bits set; the block is " + masked.String()}
+	}
+	return prefix, nil
+}
+
+// within reports whether prefix is inside one of networks.
+func within(prefix netip.Prefix, networks []netip.Prefix) bool {
+	for _, n := range networks {
+		if n.Bits() <= prefix.Bits() && n.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources returns the blocks policy lets connect to Postgres, internal
+// networks first, or nil if it lets any address connect. The subnet of the
+// org's private network, if valid, is always let in after them, whatever the
+// allow-list says.
+func (c *Compiler) Sources(policy *models.NetworkPolicy, subnet netip.Prefix) []netip.Prefix {
+	allowed := make([]netip.Prefix, 0, len(policy.AllowedCIDRs))
+	for _, cidr := range policy.AllowedCIDRs {
+		// Normalized when the policy was set
+		if prefix, err := parse(cidr); err == nil {
+			allowed = append(allowed, prefix)
+		}
+	}
+	if len(allowed) == 0 {
+		if policy.Exposure != models.ExposurePrivate {
+			return nil
+		}
+		allowed = c.private
+	}
+
+	sources := append([]netip.Prefix{}, c.internal...)
+	if subnet.IsValid() && !within(subnet, sources) {
+		sources = append(sources, subnet)
+	}
+	always := len(sources)
+	for _, prefix := range allowed {
+		if !within(prefix, sources[:always]) {
+			sources = append(sources, prefix)
+		}
+	}
+	return sources
+}
+
+// FirewallRules returns the rules policy compiles to, to go first in the
+// firewall of the instance's container: one accepting the Postgres port
+// from each source, then one dropping it from anywhere else. Other ports
+// are left to the rules operators manage.
+func (c *Compiler) FirewallRules(policy *models.NetworkPolicy, subnet netip.Prefix) []proxmox.FirewallRule {
+	sources := c.Sources(policy, subnet)
+	if sources == nil {
+		return []proxmox.FirewallRule{rule(0, "ACCEPT", "")}
+	}
+	rules := make([]proxmox.FirewallRule, 0, len(sources)+1)
+	for _, source := range sources {
+		rules = append(rules, rule(len(rules), "ACCEPT", source.String()))
+	}
+	return append(rules, rule(len(rules), "DROP", ""))
+}
+
+func rule(pos int, action, source string) proxmox.FirewallRule {
+	return proxmox.FirewallRule{
+		Pos:     pos,
+		Type:    "in",
+		Action:  action,
+		Proto:   "tcp",
+		Dport:   strconv.Itoa(Port),
+		Source:  source,
+		Comment: RuleComment,
+		Enable:  1,
+	}
+}
+
+// HBAEntries returns the pg_hba.conf entries policy compiles to: a
+// password-authenticated TLS entry for each source.
+func (c *Compiler) HBAEntries(policy *models.NetworkPolicy, subnet netip.Prefix) []guest.HBAEntry {
+	sources := c.Sources(policy, subnet)
+	if sources == nil {
+		sources = anywhere
+	}
+	entries := make([]guest.HBAEntry, 0, len(sources))
+	for _, source := range sources {
+		entries = append(entries, guest.HBAEntry{
+			Type:     "hostssl",
+			Database: "all",
+			User:     "all",
+			Address:  source.String(),
+			Method:   "scram-sha-256",
+		})
+	}
+	return entries
+}
+
+// Allows reports whether policy lets addr connect to Postgres, as the
+// firewall rules it compiles to would. The domain proxy checks the clients
+// it passes on with it, since the firewall only sees the proxy.
+func (c *Compiler) Allows(policy *models.NetworkPolicy, subnet netip.Prefix, addr netip.Addr) bool {
+	sources := c.Sources(policy, subnet)
+	if sources == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, source := range sources {
+		if source.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package objectstore
+
+import (
+	"net/http"
+	"time"
+)
+
+var CanonicalQuery = canonicalQuery
+
+// Sign signs req as s would at now.
+func Sign(s *S3, req *http.Request, body []byte, now time.Time) {
+	s.sign(req, body, now)
+}
@@ -0,0 +1,110 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Local keeps objects as files under a directory.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a store rooted at dir, creating it if needed.
+func NewLocal(dir string) (*Local, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return &Local{root: root}, nil
+}
+
+// Put writes to a temporary file next to the object and renames it into
+// place, so readers never see a partial object.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return 0, fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := io.Copy(f, contextReader{ctx, r})
+	if err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *Local) URL(key string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(l.root, filepath.FromSlash(key)))
+}
+
+func (l *Local) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// contextReader stops a copy once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,54 @@
+// Package objectstore stores backups as objects: in a local directory, or
+// in an S3-compatible bucket such as AWS S3 or MinIO. Keys are slash
+// separated paths, e.g. instances/<id>/backups/<id>.tar.gz.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zallarak/db/api/internal/config"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Store is a place objects are kept.
+type Store interface {
+	// Put writes what r yields to key, replacing any object there, and
+	// returns its size. A failed Put leaves no object at key.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the object at key. It returns ErrNotFound if there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object at key, if there is one.
+	Delete(ctx context.Context, key string) error
+	// URL locates key for people, e.g. s3://bucket/prefix/key.
+	URL(key string) string
+}
+
+// New returns the store cfg configures.
+func New(cfg config.BackupConfig) (Store, error) {
+	switch cfg.Store {
+	case "local":
+		return NewLocal(cfg.Local.Path)
+	case "s3":
+		return NewS3(cfg.S3), nil
+	default:
+		return nil, fmt.Errorf("unknown backup store %q", cfg.Store)
+	}
+}
+
+// checkKey rejects keys that could escape the store's root.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("invalid object key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/tracing"
+)
+
+// partSize is the size of the parts of multipart uploads, which objects
+// larger than one part are sent with. S3 allows up to 10,000 parts, so
+// objects can reach about 160 GiB.
+const partSize = 16 << 20
+
+// S3Error is an error response from an S3-compatible API.
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// S3 keeps objects in an S3-compatible bucket, signing requests with
+// Signature Version 4.
+type S3 struct {
+	cfg      config.S3StoreConfig
+	endpoint *url.URL
+	http     *http.Client
+	partSize int
+}
+
+func NewS3(cfg config.S3StoreConfig) *S3 {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	u, _ := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	return &S3{
+		cfg:      cfg,
+		endpoint: u,
+		http: &http.Client{
+			Transport: metrics.InstrumentTransport("s3", tracing.Transport("s3", http.DefaultTransport)),
+		},
+		partSize: partSize,
+	}
+}
+
+// Put sends objects that fit in one part with a single request and larger
+// ones as a multipart upload, holding one part in memory at a time.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+
+	part := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, part[:n])
+		if err != nil {
+			return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		resp.Body.Close()
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return s.putMultipart(ctx, key, part, r)
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3) putMultipart(ctx context.Context, key string, first []byte, r io.Reader) (int64, error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+
+	size, err := s.uploadParts(ctx, key, initiated.UploadID, first, r)
+	if err != nil {
+		// Abort even when ctx is done, so the bucket isn't left holding
+		// the parts
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if resp, abortErr := s.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return size, nil
+}
+
+func (s *S3) uploadParts(ctx context.Context, key, uploadID string, part []byte, r io.Reader) (int64, error) {
+	var (
+		parts []completedPart
+		size  int64
+		eof   bool
+	)
+	for number := 1; ; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, query, part)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		size += int64(len(part))
+		if eof {
+			break
+		}
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		part = part[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Completing can fail after the 200 status has been sent
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &S3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return 0, e
+	}
+	return size, nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if e, ok := err.(*S3Error); ok && e.Status == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if e, ok := err.(*S3Error); ok && e.Status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) URL(key string) string {
+	return "s3://" + s.cfg.Bucket + "/" + s.objectKey(key)
+}
+
+func (s *S3) objectKey(key string) string {
+	if prefix := strings.Trim(s.cfg.Prefix, "/"); prefix != "" {
+		return prefix + "/" + key
+	}
+	return key
+}
+
+// do sends a signed request for the object at key and returns the
+// response if its status is 2xx, or an *S3Error.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	path := "/" + s.objectKey(key)
+	if s.cfg.PathStyle {
+		path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = s.endpoint.Path + path
+	u.RawPath = uriEncode(s.endpoint.Path+path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 request failed: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &S3Error{Status: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(e)
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to req, covering
+// the host, the payload and any Content-Type, Content-MD5, Range and
+// X-Amz-* headers.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		switch {
+		case name == "content-type", name == "content-md5", name == "range", strings.HasPrefix(name, "x-amz-"):
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.cfg.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as signatures need it.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,205 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDiscoveryFailed = errors.New("oidc discovery failed")
+	ErrExchangeFailed  = errors.New("oidc code exchange failed")
+)
+
+// discoveryTTL controls how long provider metadata is reused before it is
+// fetched again from the issuer's well-known endpoint.
+const discoveryTTL = time.Hour
+
+// Provider holds the subset of the OpenID Provider metadata we rely on.
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+
+	keys      *keySet
+	fetchedAt time.Time
+}
+
+// Config describes this relying party as registered with a provider.
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Token is the response of a successful authorization code exchange.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Client performs discovery, code exchange and ID token verification. It
+// caches provider metadata and signing keys per issuer and is safe for
+// concurrent use.
+type Client struct {
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	providers map[string]*Provider
+}
+
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		httpClient: httpClient,
+		providers:  make(map[string]*Provider),
+	}
+}
+
+// Discover returns the provider metadata for issuer, fetching
+// /.well-known/openid-configuration when it is not cached or has expired.
+func (c *Client) Discover(ctx context.Context, issuer string) (*Provider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	c.mu.Lock()
+	cached, ok := c.providers[issuer]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < discoveryTTL {
+		return cached, nil
+	}
+
+	var p Provider
+	if err := c.getJSON(ctx, issuer+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscoveryFailed, err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: issuer mismatch (got %q, want %q)", ErrDiscoveryFailed, p.Issuer, issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: metadata is missing required endpoints", ErrDiscoveryFailed)
+	}
+	p.fetchedAt = time.Now()
+
+	// Keep the existing key cache across metadata refreshes as long as the
+	// JWKS location has not moved.
+	if ok && cached.JWKSURI == p.JWKSURI {
+		p.keys = cached.keys
+	} else {
+		p.keys = newKeySet(c, p.JWKSURI)
+	}
+
+	c.mu.Lock()
+	c.providers[issuer] = &p
+	c.mu.Unlock()
+
+	return &p, nil
+}
+
+// AuthCodeURL builds the authorization request URL for the code flow with a
+// S256 PKCE challenge.
+func (c *Client) AuthCodeURL(p *Provider, cfg Config, state, nonce, codeChallenge string) string {
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", cfg.ClientID)
+	q.Set("redirect_uri", cfg.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Exchange trades an authorization code and its PKCE verifier for tokens.
+func (c *Client) Exchange(ctx context.Context, p *Provider, cfg Config, code, codeVerifier string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &oauthErr)
+		if oauthErr.Error != "" {
+			return nil, fmt.Errorf("%w: %s %s", ErrExchangeFailed, oauthErr.Error, oauthErr.Description)
+		}
+		return nil, fmt.Errorf("%w: token endpoint returned status %d", ErrExchangeFailed, resp.StatusCode)
+	}
+
+	var tok Token
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+	}
+	if tok.IDToken == "" {
+		return nil, fmt.Errorf("%w: response did not include an id_token", ErrExchangeFailed)
+	}
+	return &tok, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
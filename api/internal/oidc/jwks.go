@@ -0,0 +1,181 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("no matching signing key")
+
+const (
+	// jwksTTL is how long a fetched key set is trusted before a refresh.
+	jwksTTL = time.Hour
+	// jwksMinRefresh rate-limits refetches triggered by an unknown kid, so
+	// tokens with garbage headers cannot hammer the provider.
+	jwksMinRefresh = time.Minute
+)
+
+// JWK is a single JSON Web Key as published by a provider.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type keySet struct {
+	client *Client
+	uri    string
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newKeySet(c *Client, uri string) *keySet {
+	return &keySet{client: c, uri: uri}
+}
+
+// key returns the public key for kid, refreshing the cached set when it is
+// stale or does not contain kid.
+func (ks *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	fresh := time.Since(ks.fetchedAt) < jwksTTL
+	if k, ok := ks.lookup(kid); ok && fresh {
+		return k, nil
+	}
+
+	if !fresh || time.Since(ks.fetchedAt) >= jwksMinRefresh {
+		if err := ks.refresh(ctx); err != nil {
+			// Serve from the stale cache rather than failing logins while
+			// the provider is briefly unavailable.
+			if k, ok := ks.lookup(kid); ok {
+				return k, nil
+			}
+			return nil, err
+		}
+	}
+
+	if k, ok := ks.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, kid)
+}
+
+// lookup finds kid in the cache. An empty kid matches only when the set has
+// exactly one key, which some providers rely on.
+func (ks *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+func (ks *keySet) refresh(ctx context.Context) error {
+	var set JWKS
+	if err := ks.client.getJSON(ctx, ks.uri, &set); err != nil {
+		return fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = pub
+	}
+
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	return nil
+}
+
+// PublicKey decodes the RSA or EC public key described by the JWK.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// NewRSAJWK encodes an RSA public key as a JWK. It is used by the fake
+// provider in oidctest.
+func NewRSAJWK(kid string, pub *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
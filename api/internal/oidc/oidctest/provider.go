@@ -0,0 +1,277 @@
+// Package oidctest runs an in-process OpenID Connect provider for exercising
+// the SSO flow without a real identity provider.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// User is the identity the fake provider signs in as.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type pendingCode struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	user          User
+}
+
+// Provider is a fake OIDC provider backed by an httptest.Server. The
+// authorization endpoint approves every request immediately and redirects
+// back with a code for the configured user.
+type Provider struct {
+	Server *httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	user   User
+	key    *rsa.PrivateKey
+	kid    string
+	keyN   int
+	codes  map[string]pendingCode
+	modify func(*oidc.IDTokenClaims)
+}
+
+// NewProvider starts a provider that accepts the given client credentials.
+// An empty clientSecret registers a public client.
+func NewProvider(clientID, clientSecret string) *Provider {
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		codes:        make(map[string]pendingCode),
+		user: User{
+			Subject:       "fake-user-1",
+			Email:         "user@example.com",
+			EmailVerified: true,
+			Name:          "Fake User",
+		},
+	}
+	p.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+func (p *Provider) Issuer() string {
+	return p.Server.URL
+}
+
+func (p *Provider) Close() {
+	p.Server.Close()
+}
+
+// SetUser changes the identity returned for subsequent logins.
+func (p *Provider) SetUser(u User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = u
+}
+
+// ModifyClaims has fn alter the claims of the ID tokens issued from now on,
+// such as to give them the wrong nonce or audience. A nil fn issues honest
+// tokens again.
+func (p *Provider) ModifyClaims(fn func(*oidc.IDTokenClaims)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.modify = fn
+}
+
+// SignIDToken signs claims with the current key, as the token endpoint
+// does.
+func (p *Provider) SignIDToken(claims oidc.IDTokenClaims) (string, error) {
+	p.mu.Lock()
+	key, kid := p.key, p.kid
+	p.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// RotateKey replaces the signing key with a new one under a new kid.
+func (p *Provider) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: failed to generate key: %v", err))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keyN++
+	p.key = key
+	p.kid = fmt.Sprintf("key-%d", p.keyN)
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.Issuer() + "/authorize",
+		"token_endpoint":                        p.Issuer() + "/token",
+		"jwks_uri":                              p.Issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" {
+		http.Error(w, "unsupported response_type", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != p.ClientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code, _ := oidc.RandomString(16)
+
+	p.mu.Lock()
+	p.codes[code] = pendingCode{
+		clientID:      q.Get("client_id"),
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		user:          p.user,
+	}
+	p.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type", "")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != p.ClientID || clientSecret != p.ClientSecret {
+		oauthError(w, "invalid_client", "")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	pending, found := p.codes[code]
+	delete(p.codes, code)
+	modify := p.modify
+	p.mu.Unlock()
+
+	if !found || pending.clientID != clientID || pending.redirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, "invalid_grant", "unknown code or redirect_uri mismatch")
+		return
+	}
+	if oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != pending.codeChallenge {
+		oauthError(w, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	now := time.Now()
+	claims := oidc.IDTokenClaims{
+		Email:         pending.user.Email,
+		EmailVerified: pending.user.EmailVerified,
+		Name:          pending.user.Name,
+		Nonce:         pending.nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.Issuer(),
+			Subject:   pending.user.Subject,
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+	if modify != nil {
+		modify(&claims)
+	}
+	idToken, err := p.SignIDToken(claims)
+	if err != nil {
+		oauthError(w, "server_error", err.Error())
+		return
+	}
+
+	accessToken, _ := oidc.RandomString(16)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	jwk := oidc.NewRSAJWK(p.kid, &p.key.PublicKey)
+	p.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, oidc.JWKS{Keys: []oidc.JWK{jwk}})
+}
+
+func oauthError(w http.ResponseWriter, code, description string) {
+	status := http.StatusBadRequest
+	if code == "invalid_client" {
+		status = http.StatusUnauthorized
+	}
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
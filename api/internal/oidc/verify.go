@@ -0,0 +1,72 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// IDTokenClaims are the claims we read from a verified ID token.
+type IDTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// Verify checks the signature of rawIDToken against the provider's JWKS and
+// validates issuer, audience, expiry and nonce.
+func (c *Client) Verify(ctx context.Context, p *Provider, clientID, rawIDToken, nonce string) (*IDTokenClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(clientID),
+		jwt.WithLeeway(time.Minute),
+	)
+
+	claims := &IDTokenClaims{}
+	_, err := parser.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub claim", ErrInvalidIDToken)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	return claims, nil
+}
+
+// RandomString returns a URL-safe random string with n bytes of entropy,
+// suitable for state, nonce and PKCE verifier values.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the S256 PKCE challenge for verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
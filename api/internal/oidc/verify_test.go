@@ -0,0 +1,192 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/oidc"
+	"github.com/zallarak/db/api/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	clientID    = "dbx"
+	redirectURL = "http://127.0.0.1/callback"
+)
+
+func newProvider(t *testing.T) (*oidctest.Provider, *oidc.Client, *oidc.Provider) {
+	t.Helper()
+	p := oidctest.NewProvider(clientID, "secret")
+	t.Cleanup(p.Close)
+
+	c := oidc.NewClient(nil)
+	provider, err := c.Discover(context.Background(), p.Issuer())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	return p, c, provider
+}
+
+// claims returns valid claims for an ID token of p with nonce.
+func claims(p *oidctest.Provider, nonce string) oidc.IDTokenClaims {
+	now := time.Now()
+	return oidc.IDTokenClaims{
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Nonce:         nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.Issuer(),
+			Subject:   "user-1",
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p, c, provider := newProvider(t)
+
+	tests := []struct {
+		name   string
+		modify func(*oidc.IDTokenClaims)
+		ok     bool
+	}{
+		{"valid", func(*oidc.IDTokenClaims) {}, true},
+		{"other issuer", func(cl *oidc.IDTokenClaims) { cl.Issuer = "https://evil.example.com" }, false},
+		{"other audience", func(cl *oidc.IDTokenClaims) { cl.Audience = jwt.ClaimStrings{"someone-else"} }, false},
+		{"extra audience", func(cl *oidc.IDTokenClaims) { cl.Audience = append(cl.Audience, "someone-else") }, true},
+		{"wrong nonce", func(cl *oidc.IDTokenClaims) { cl.Nonce = "replayed" }, false},
+		{"no nonce", func(cl *oidc.IDTokenClaims) { cl.Nonce = "" }, false},
+		{"expired", func(cl *oidc.IDTokenClaims) { cl.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute)) }, false},
+		{"no expiry", func(cl *oidc.IDTokenClaims) { cl.ExpiresAt = nil }, false},
+		{"no subject", func(cl *oidc.IDTokenClaims) { cl.Subject = "" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := claims(p, "nonce-1")
+			tt.modify(&cl)
+			raw, err := p.SignIDToken(cl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := c.Verify(context.Background(), provider, clientID, raw, "nonce-1")
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if got.Subject != "user-1" || got.Email != "user@example.com" {
+					t.Errorf("Verify returned %+v", got)
+				}
+				return
+			}
+			if !errors.Is(err, oidc.ErrInvalidIDToken) {
+				t.Fatalf("Verify error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnsignedToken(t *testing.T) {
+	p, c, provider := newProvider(t)
+
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims(p, "n")).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Verify(context.Background(), provider, clientID, raw, "n"); !errors.Is(err, oidc.ErrInvalidIDToken) {
+		t.Fatalf("Verify error = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestExchangeRequiresPKCEVerifier(t *testing.T) {
+	_, c, provider := newProvider(t)
+	cfg := oidc.Config{ClientID: clientID, ClientSecret: "secret", RedirectURL: redirectURL}
+
+	authorize := func(verifier string) string {
+		t.Helper()
+		code, _ := authorizeCode(t, c.AuthCodeURL(provider, cfg, "state-1", "nonce-1", oidc.CodeChallenge(verifier)))
+		return code
+	}
+
+	ctx := context.Background()
+	if _, err := c.Exchange(ctx, provider, cfg, authorize("verifier-1"), "verifier-2"); !errors.Is(err, oidc.ErrExchangeFailed) {
+		t.Fatalf("Exchange with the wrong verifier: error = %v, want ErrExchangeFailed", err)
+	}
+
+	tok, err := c.Exchange(ctx, provider, cfg, authorize("verifier-1"), "verifier-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err := c.Verify(ctx, provider, clientID, tok.IDToken, "nonce-1"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+// authorizeCode follows authURL to the fake provider and returns the code
+// and state it redirects back with.
+func authorizeCode(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL %s has no S256 code challenge", authURL)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", resp.Status)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestVerifyAfterKeyRotation(t *testing.T) {
+	p, c, provider := newProvider(t)
+	ctx := context.Background()
+
+	oldToken, err := p.SignIDToken(claims(p, "n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Verify(ctx, provider, clientID, oldToken, "n"); err != nil {
+		t.Fatalf("Verify before rotation: %v", err)
+	}
+
+	p.RotateKey()
+	newToken, err := p.SignIDToken(claims(p, "n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key set was just fetched, so the unknown kid doesn't trigger a
+	// refetch yet
+	if _, err := c.Verify(ctx, provider, clientID, newToken, "n"); !errors.Is(err, oidc.ErrUnknownKey) {
+		t.Fatalf("Verify right after rotation: error = %v, want ErrUnknownKey", err)
+	}
+
+	oidc.AgeKeySet(provider, oidc.JWKSMinRefresh)
+	if _, err := c.Verify(ctx, provider, clientID, newToken, "n"); err != nil {
+		t.Fatalf("Verify with the new key: %v", err)
+	}
+	// The provider no longer publishes the old key
+	if _, err := c.Verify(ctx, provider, clientID, oldToken, "n"); !errors.Is(err, oidc.ErrUnknownKey) {
+		t.Fatalf("Verify with the retired key: error = %v, want ErrUnknownKey", err)
+	}
+}
@@ -0,0 +1,56 @@
+// Package pglsn parses and formats PostgreSQL log sequence numbers, the
+// positions in the write-ahead log that backups and point-in-time
+// recovery are measured in.
+package pglsn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LSN is a byte position in the write-ahead log.
+type LSN uint64
+
+// SegmentSize is the size of a WAL segment file with the default
+// --wal-segsize.
+const SegmentSize = 16 << 20
+
+// Parse parses an LSN in the X/X form PostgreSQL prints, e.g. 16/B374D848.
+func Parse(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok || hi == "" || lo == "" {
+		return 0, fmt.Errorf("invalid LSN %q: must be two hexadecimal numbers separated by /", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: must be two hexadecimal numbers separated by /", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: must be two hexadecimal numbers separated by /", s)
+	}
+	return LSN(h<<32 | l), nil
+}
+
+// MustParse is Parse for LSNs that are known to be valid, such as ones
+// read back from the database. It panics otherwise.
+func MustParse(s string) LSN {
+	lsn, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return lsn
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint64(l)&0xFFFFFFFF)
+}
+
+// SegmentName is the name of the file of the WAL segment holding l on
+// timeline 1, e.g. 000000010000001600000083.
+func (l LSN) SegmentName() string {
+	segsPerID := uint64(1<<32) / SegmentSize
+	seg := uint64(l) / SegmentSize
+	return fmt.Sprintf("%08X%08X%08X", 1, seg/segsPerID, seg%segsPerID)
+}
@@ -0,0 +1,204 @@
+package pki
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/tracing"
+	"golang.org/x/crypto/acme"
+)
+
+// ACME is the acme issuer. It answers the dns-01 challenge of each name
+// with a TXT record at _acme-challenge.<name>, published through the DNS
+// provider and removed once the CA has checked it. Names outside the zone
+// the provider updates, the custom domains of instances, are answered at
+// the challenge record of the first name, the instance's own, which their
+// owners point theirs at with a CNAME record.
+type ACME struct {
+	client   *acme.Client
+	provider dns.Provider
+	zone     string
+	email    string
+	timeout  time.Duration
+	ttl      int
+
+	mu         sync.Mutex
+	registered bool
+}
+
+// NewACME returns the issuer of cfg, publishing challenge records in zone.
+// The account is registered, or looked up if the key has one, on first use.
+func NewACME(cfg config.ACMEConfig, provider dns.Provider, zone string, ttl int) (*ACME, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+	if cfg.AccountKeyFile != "" {
+		data, err := os.ReadFile(cfg.AccountKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = ParsePrivateKey(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.AccountKeyFile, err)
+		}
+	} else if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+
+	return &ACME{
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.DirectoryURL,
+			UserAgent:    "dbx-api",
+			HTTPClient: &http.Client{
+				Timeout:   30 * time.Second,
+				Transport: metrics.InstrumentTransport("acme", tracing.Transport("acme", nil)),
+			},
+		},
+		provider: provider,
+		zone:     zone,
+		email:    cfg.Email,
+		timeout:  cfg.Timeout,
+		ttl:      ttl,
+	}, nil
+}
+
+func (a *ACME) Name() string { return "acme" }
+
+// Issue orders a certificate for dnsNames, answers the challenges of the
+// names not yet authorized and finalizes the order with csr.
+func (a *ACME) Issue(ctx context.Context, csr []byte, dnsNames []string) (*Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	if err := a.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs(dnsNames...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+	if order.Status == acme.StatusPending {
+		if err := a.authorize(ctx, order.AuthzURLs, dnsNames[0]); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = a.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("order not ready: %w", err)
+	}
+	chain, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	return newCertificate(chain)
+}
+
+func (a *ACME) register(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.registered {
+		return nil
+	}
+	account := &acme.Account{}
+	if a.email != "" {
+		account.Contact = []string{"mailto:" + a.email}
+	}
+	_, err := a.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	a.registered = true
+	return nil
+}
+
+// authorize answers the dns-01 challenges of the pending authorizations at
+// urls and waits for the CA to accept them. Names outside the zone are
+// answered at the challenge record of delegate. Names sharing a challenge
+// record, such as a name and its wildcard, get one TXT value each.
+func (a *ACME) authorize(ctx context.Context, urls []string, delegate string) error {
+	logger := logging.FromContext(ctx)
+
+	var (
+		pending []*acme.Authorization
+		accept  []*acme.Challenge
+		records = make(map[string][]string)
+	)
+	for _, u := range urls {
+		authz, err := a.client.GetAuthorization(ctx, u)
+		if err != nil {
+			return fmt.Errorf("failed to get authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("%s: the CA offers no dns-01 challenge", authz.Identifier.Value)
+		}
+		value, err := a.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + authz.Identifier.Value
+		if !dns.InZone(a.zone, authz.Identifier.Value) {
+			name = "_acme-challenge." + delegate
+		}
+		records[name] = append(records[name], value)
+		pending = append(pending, authz)
+		accept = append(accept, chal)
+	}
+
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var published []string
+	defer func() {
+		// The challenges are over either way; clean up even if ctx is done
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		for _, name := range published {
+			if err := a.provider.SetTXT(ctx, name, nil, a.ttl); err != nil {
+				logger.Warn("failed to remove ACME challenge record", "name", name, "error", err)
+			}
+		}
+	}()
+	for _, name := range names {
+		if err := a.provider.SetTXT(ctx, name, records[name], a.ttl); err != nil {
+			return fmt.Errorf("failed to publish challenge record %s: %w", name, err)
+		}
+		published = append(published, name)
+	}
+
+	for _, chal := range accept {
+		if _, err := a.client.Accept(ctx, chal); err != nil {
+			return fmt.Errorf("failed to accept challenge: %w", err)
+		}
+	}
+	for _, authz := range pending {
+		if _, err := a.client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return fmt.Errorf("%s: challenge failed: %w", authz.Identifier.Value, err)
+		}
+	}
+	return nil
+}
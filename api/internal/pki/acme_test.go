@@ -0,0 +1,224 @@
+package pki_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/pki"
+	"github.com/zallarak/db/api/internal/pki/acmetest"
+)
+
+const zone = "cust.example.com"
+
+// countingProvider counts the challenge records published through it.
+type countingProvider struct {
+	dns.Provider
+
+	mu        sync.Mutex
+	published []string
+}
+
+func (p *countingProvider) SetTXT(ctx context.Context, name string, values []string, ttl int) error {
+	if len(values) > 0 {
+		p.mu.Lock()
+		p.published = append(p.published, name)
+		p.mu.Unlock()
+	}
+	return p.Provider.SetTXT(ctx, name, values, ttl)
+}
+
+// testACME is the acme issuer of a stand-in CA checking challenges
+// through a stand-in name server of the instance zone, which the issuer
+// updates.
+type testACME struct {
+	ns       *dns.Server
+	ca       *acmetest.Server
+	provider *countingProvider
+	issuer   *pki.ACME
+}
+
+func newTestACME(t *testing.T) *testACME {
+	t.Helper()
+	ns, err := dns.NewServer(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	ca, err := acmetest.NewServer(ns.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ca.Close)
+
+	rfc2136, err := dns.NewRFC2136(zone, config.RFC2136Config{Server: ns.Addr(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &countingProvider{Provider: rfc2136}
+	issuer, err := pki.NewACME(config.ACMEConfig{DirectoryURL: ca.DirectoryURL(), Email: "ops@example.com", Timeout: time.Minute}, provider, zone, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testACME{ns: ns, ca: ca, provider: provider, issuer: issuer}
+}
+
+// issue has the issuer certify dnsNames for a new key, and checks the
+// certificate chains to the stand-in's roots for every name.
+func (a *testACME) issue(t *testing.T, dnsNames ...string) (*pki.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := a.issuer.Issue(context.Background(), csr, dnsNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, rest := pem.Decode(cert.ChainPEM)
+	if block == nil {
+		t.Fatalf("no certificate in chain %q", cert.ChainPEM)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(a.ca.Roots()) {
+		t.Fatal("no roots")
+	}
+	intermediates.AppendCertsFromPEM(rest)
+	for _, name := range dnsNames {
+		opts := x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		if _, err := leaf.Verify(opts); err != nil {
+			t.Errorf("certificate does not verify for %s: %v", name, err)
+		}
+	}
+	if !key.PublicKey.Equal(leaf.PublicKey) {
+		t.Error("certificate is not for the key of the request")
+	}
+	if !reflect.DeepEqual(cert.DNSNames, dnsNames) {
+		t.Errorf("DNSNames = %v, want %v", cert.DNSNames, dnsNames)
+	}
+	if cert.Serial == "" || !cert.NotAfter.Equal(leaf.NotAfter) || !cert.NotBefore.Equal(leaf.NotBefore) {
+		t.Errorf("certificate %+v does not describe %v", cert, leaf.SerialNumber)
+	}
+	return cert, leaf
+}
+
+// checkCleanedUp fails unless the challenge records are gone.
+func (a *testACME) checkCleanedUp(t *testing.T) {
+	t.Helper()
+	resolver := dns.NewResolver(a.ns.Addr())
+	a.provider.mu.Lock()
+	defer a.provider.mu.Unlock()
+	for _, name := range a.provider.published {
+		values, err := resolver.LookupTXT(context.Background(), name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("challenge record %s left behind: %v, %v", name, values, err)
+		}
+	}
+}
+
+func TestACMEIssue(t *testing.T) {
+	a := newTestACME(t)
+	a.issue(t, "pg-1234abcd."+zone)
+
+	if want := []string{"_acme-challenge.pg-1234abcd." + zone}; !reflect.DeepEqual(a.provider.published, want) {
+		t.Errorf("published %v, want %v", a.provider.published, want)
+	}
+	a.checkCleanedUp(t)
+}
+
+// TestACMEIssueCustomDomain issues a certificate for a name outside the
+// zone, whose owner points its challenge record at the instance's.
+func TestACMEIssueCustomDomain(t *testing.T) {
+	a := newTestACME(t)
+	if err := a.ns.SetCNAME("_acme-challenge.db.ourco.com", "_acme-challenge.pg-1234abcd."+zone); err != nil {
+		t.Fatal(err)
+	}
+	a.issue(t, "pg-1234abcd."+zone, "db.ourco.com")
+
+	// Both challenges are answered at the instance's record
+	if want := []string{"_acme-challenge.pg-1234abcd." + zone}; !reflect.DeepEqual(a.provider.published, want) {
+		t.Errorf("published %v, want %v", a.provider.published, want)
+	}
+	a.checkCleanedUp(t)
+}
+
+// TestACMERenew issues a certificate again, as renewals do, for a new key.
+// The account's authorizations are still valid, so no challenge is
+// answered again.
+func TestACMERenew(t *testing.T) {
+	a := newTestACME(t)
+	name := "pg-1234abcd." + zone
+	first, firstLeaf := a.issue(t, name)
+	published := len(a.provider.published)
+
+	second, secondLeaf := a.issue(t, name)
+	if second.Serial == first.Serial {
+		t.Errorf("renewal kept serial %s", first.Serial)
+	}
+	if firstLeaf.PublicKey.(*ecdsa.PublicKey).Equal(secondLeaf.PublicKey) {
+		t.Error("renewal kept the key")
+	}
+	if second.NotAfter.Before(first.NotAfter) {
+		t.Errorf("renewal expires at %v, before %v", second.NotAfter, first.NotAfter)
+	}
+	if len(a.provider.published) != published {
+		t.Errorf("renewal answered challenges again: %v", a.provider.published[published:])
+	}
+
+	// Adding a name to the certificate only answers the challenge of the
+	// new one
+	if err := a.ns.SetCNAME("_acme-challenge.db.ourco.com", "_acme-challenge."+name); err != nil {
+		t.Fatal(err)
+	}
+	a.issue(t, name, "db.ourco.com")
+	if len(a.provider.published) != published+1 {
+		t.Errorf("published %v, want one more challenge record", a.provider.published)
+	}
+	a.checkCleanedUp(t)
+}
+
+// TestACMEChallengeFailed issues a certificate for a custom domain whose
+// owner did not delegate its challenge record.
+func TestACMEChallengeFailed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the stand-in retries the check for seconds")
+	}
+	a := newTestACME(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.issuer.Issue(context.Background(), csr, []string{"pg-1234abcd." + zone, "db.ourco.com"}); err == nil {
+		t.Fatal("Issue succeeded without the challenge of db.ourco.com answered")
+	}
+	a.checkCleanedUp(t)
+}
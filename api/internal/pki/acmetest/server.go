@@ -0,0 +1,741 @@
+// Package acmetest runs an in-process ACME server for issuing certificates
+// without a real CA, as Pebble does for Let's Encrypt. It implements the
+// parts of RFC 8555 the acme issuer uses, with dns-01 as the only
+// challenge, checked by resolving the TXT record through a given name
+// server. Certificates are signed by a CA generated on start, which Roots
+// returns.
+package acmetest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/pki"
+)
+
+const (
+	// validity of the certificates issued
+	validity = 90 * 24 * time.Hour
+	// checkAttempts and checkInterval bound how long a challenge record
+	// may take to appear
+	checkAttempts = 10
+	checkInterval = 500 * time.Millisecond
+)
+
+// Server is a fake ACME CA backed by an httptest.Server. Accounts are
+// created for any key, and orders are valid for any DNS names whose
+// challenges are answered. Valid authorizations are reused by the orders
+// of the same account until they expire.
+type Server struct {
+	Server *httptest.Server
+
+	ca       *pki.CA
+	roots    []byte
+	resolver *net.Resolver
+
+	mu       sync.Mutex
+	next     int
+	nonces   map[string]bool
+	accounts map[string]*account
+	orders   map[string]*order
+	authzs   map[string]*authz
+	certs    map[string][]byte
+}
+
+type account struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	contact    []string
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+type order struct {
+	id          string
+	account     string
+	status      string
+	expires     time.Time
+	identifiers []identifier
+	authzs      []string
+	cert        string
+	err         *problem
+}
+
+type authz struct {
+	id         string
+	account    string
+	status     string
+	expires    time.Time
+	identifier identifier
+	token      string
+	chalStatus string
+	validated  time.Time
+	err        *problem
+}
+
+// NewServer starts a server that resolves challenge records through the
+// name server at resolver, host:port, or the system resolver if empty.
+func NewServer(resolver string) (*Server, error) {
+	certPEM, keyPEM, err := pki.GenerateCA("acmetest root")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := pki.ParseCA(certPEM, keyPEM, validity)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ca:       ca,
+		roots:    certPEM,
+		resolver: dns.NewResolver(resolver),
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*account),
+		orders:   make(map[string]*order),
+		authzs:   make(map[string]*authz),
+		certs:    make(map[string][]byte),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/nonce", s.handleNonce)
+	mux.HandleFunc("/roots", s.handleRoots)
+	for _, path := range []string{"/new-account", "/new-order", "/account/", "/order/", "/authz/", "/chall/", "/finalize/", "/cert/"} {
+		mux.HandleFunc(path, s.handlePost)
+	}
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// DirectoryURL is the URL ACME clients start from.
+func (s *Server) DirectoryURL() string {
+	return s.Server.URL + "/directory"
+}
+
+// Roots returns the certificate, in PEM, that issued certificates chain
+// to.
+func (s *Server) Roots() []byte {
+	return s.roots
+}
+
+func (s *Server) Close() {
+	s.Server.Close()
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   s.Server.URL + "/nonce",
+		"newAccount": s.Server.URL + "/new-account",
+		"newOrder":   s.Server.URL + "/new-order",
+		"revokeCert": s.Server.URL + "/revoke-cert",
+		"keyChange":  s.Server.URL + "/key-change",
+		"meta": map[string]interface{}{
+			"termsOfService": s.Server.URL + "/terms",
+		},
+	})
+}
+
+func (s *Server) handleNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRoots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(s.roots)
+}
+
+// request is a verified JWS request.
+type request struct {
+	account *account
+	jwk     crypto.PublicKey
+	payload []byte
+}
+
+// handlePost verifies the JWS body of a request (RFC 8555 section 6.2)
+// and dispatches it by path.
+func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	if r.Method != http.MethodPost {
+		writeProblem(w, http.StatusMethodNotAllowed, "malformed", "requests must be POSTed")
+		return
+	}
+	var body struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid JWS: %v", err)
+		return
+	}
+	var header struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		JWK   json.RawMessage `json:"jwk"`
+		KID   string          `json:"kid"`
+	}
+	if err := decodeSegment(body.Protected, &header); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid protected header: %v", err)
+		return
+	}
+	if !s.useNonce(header.Nonce) {
+		writeProblem(w, http.StatusBadRequest, "badNonce", "unknown or reused nonce")
+		return
+	}
+	if header.URL != s.Server.URL+r.URL.Path {
+		writeProblem(w, http.StatusUnauthorized, "unauthorized", "url %q does not match the request", header.URL)
+		return
+	}
+
+	req := &request{}
+	var key crypto.PublicKey
+	if r.URL.Path == "/new-account" {
+		if header.JWK == nil {
+			writeProblem(w, http.StatusBadRequest, "malformed", "new accounts are signed with a jwk")
+			return
+		}
+		var err error
+		if key, err = parseJWK(header.JWK); err != nil {
+			writeProblem(w, http.StatusBadRequest, "badPublicKey", "%v", err)
+			return
+		}
+		req.jwk = key
+	} else {
+		s.mu.Lock()
+		req.account = s.accounts[strings.TrimPrefix(header.KID, s.Server.URL+"/account/")]
+		s.mu.Unlock()
+		if req.account == nil {
+			writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "unknown kid %q", header.KID)
+			return
+		}
+		key = req.account.key
+	}
+	if err := verify(header.Alg, key, body.Protected+"."+body.Payload, body.Signature); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid signature: %v", err)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body.Payload)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid payload")
+		return
+	}
+	req.payload = payload
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch dir, id := splitPath(r.URL.Path); dir {
+	case "new-account":
+		s.newAccount(w, req)
+	case "account":
+		s.getAccount(w, req, id)
+	case "new-order":
+		s.newOrder(w, req)
+	case "order":
+		s.getOrder(w, req, id)
+	case "authz":
+		s.getAuthz(w, req, id)
+	case "chall":
+		s.acceptChallenge(w, req, id)
+	case "finalize":
+		s.finalize(w, req, id)
+	case "cert":
+		s.getCert(w, req, id)
+	}
+}
+
+func (s *Server) newAccount(w http.ResponseWriter, req *request) {
+	var in struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &in); err != nil {
+			writeProblem(w, http.StatusBadRequest, "malformed", "%v", err)
+			return
+		}
+	}
+	thumbprint, err := thumbprint(req.jwk)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badPublicKey", "%v", err)
+		return
+	}
+	for _, acct := range s.accounts {
+		if acct.thumbprint == thumbprint {
+			w.Header().Set("Location", s.Server.URL+"/account/"+acct.id)
+			writeJSON(w, http.StatusOK, accountJSON(acct))
+			return
+		}
+	}
+	if in.OnlyReturnExisting {
+		writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "no account for this key")
+		return
+	}
+	acct := &account{id: s.newID(), key: req.jwk, thumbprint: thumbprint, contact: in.Contact}
+	s.accounts[acct.id] = acct
+	w.Header().Set("Location", s.Server.URL+"/account/"+acct.id)
+	writeJSON(w, http.StatusCreated, accountJSON(acct))
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, req *request, id string) {
+	if id != req.account.id {
+		writeProblem(w, http.StatusForbidden, "unauthorized", "not your account")
+		return
+	}
+	w.Header().Set("Location", s.Server.URL+"/account/"+id)
+	writeJSON(w, http.StatusOK, accountJSON(req.account))
+}
+
+func (s *Server) newOrder(w http.ResponseWriter, req *request) {
+	var in struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &in); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "%v", err)
+		return
+	}
+	if len(in.Identifiers) == 0 {
+		writeProblem(w, http.StatusBadRequest, "malformed", "no identifiers")
+		return
+	}
+	o := &order{
+		id:      s.newID(),
+		account: req.account.id,
+		status:  "pending",
+		expires: time.Now().Add(24 * time.Hour),
+	}
+	for _, id := range in.Identifiers {
+		if id.Type != "dns" || id.Value == "" || strings.HasPrefix(id.Value, "*") {
+			writeProblem(w, http.StatusBadRequest, "rejectedIdentifier", "unsupported identifier %s:%s", id.Type, id.Value)
+			return
+		}
+		id.Value = strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if z := s.validAuthz(req.account.id, id); z != nil {
+			o.identifiers = append(o.identifiers, id)
+			o.authzs = append(o.authzs, z.id)
+			continue
+		}
+		z := &authz{
+			id:         s.newID(),
+			account:    req.account.id,
+			status:     "pending",
+			expires:    o.expires,
+			identifier: id,
+			token:      randomToken(),
+			chalStatus: "pending",
+		}
+		s.authzs[z.id] = z
+		o.identifiers = append(o.identifiers, id)
+		o.authzs = append(o.authzs, z.id)
+	}
+	s.updateOrder(o)
+	s.orders[o.id] = o
+	w.Header().Set("Location", s.Server.URL+"/order/"+o.id)
+	writeJSON(w, http.StatusCreated, s.orderJSON(o))
+}
+
+// validAuthz returns a valid authorization of account for id that hasn't
+// expired, which new orders reuse as Let's Encrypt's do, or nil.
+func (s *Server) validAuthz(account string, id identifier) *authz {
+	for _, z := range s.authzs {
+		if z.account == account && z.identifier == id && z.status == "valid" && time.Now().Before(z.expires) {
+			return z
+		}
+	}
+	return nil
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, req *request, id string) {
+	o, ok := s.orders[id]
+	if !ok || o.account != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	s.updateOrder(o)
+	w.Header().Set("Location", s.Server.URL+"/order/"+o.id)
+	writeJSON(w, http.StatusOK, s.orderJSON(o))
+}
+
+func (s *Server) getAuthz(w http.ResponseWriter, req *request, id string) {
+	z, ok := s.authzs[id]
+	if !ok || z.account != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such authorization")
+		return
+	}
+	if z.status == "pending" && z.chalStatus == "processing" {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, http.StatusOK, s.authzJSON(z))
+}
+
+// acceptChallenge starts checking the challenge record of an
+// authorization, which clients then poll.
+func (s *Server) acceptChallenge(w http.ResponseWriter, req *request, id string) {
+	z, ok := s.authzs[id]
+	if !ok || z.account != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+	if z.chalStatus == "pending" {
+		z.chalStatus = "processing"
+		go s.check(z.id, req.account.thumbprint)
+	}
+	w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", s.Server.URL, z.id))
+	writeJSON(w, http.StatusOK, s.challengeJSON(z))
+}
+
+// check resolves the TXT record of the challenge of the authorization id
+// until it holds the expected value, or gives up.
+func (s *Server) check(id, thumbprint string) {
+	s.mu.Lock()
+	z := s.authzs[id]
+	name, token := "_acme-challenge."+z.identifier.Value, z.token
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(token + "." + thumbprint))
+	want := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	var detail string
+	for i := 0; i < checkAttempts; i++ {
+		if i > 0 {
+			time.Sleep(checkInterval)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		values, err := s.resolver.LookupTXT(ctx, name)
+		cancel()
+		if err != nil {
+			detail = fmt.Sprintf("failed to look up TXT for %s: %v", name, err)
+			continue
+		}
+		for _, v := range values {
+			if v == want {
+				s.mu.Lock()
+				z.status, z.chalStatus, z.validated = "valid", "valid", time.Now()
+				s.mu.Unlock()
+				return
+			}
+		}
+		detail = fmt.Sprintf("incorrect TXT record found at %s", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z.status, z.chalStatus = "invalid", "invalid"
+	z.err = &problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: detail, Status: http.StatusForbidden}
+}
+
+// finalize issues the certificate of a ready order for the key of its CSR.
+func (s *Server) finalize(w http.ResponseWriter, req *request, id string) {
+	o, ok := s.orders[id]
+	if !ok || o.account != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	s.updateOrder(o)
+	if o.status != "ready" {
+		writeProblem(w, http.StatusForbidden, "orderNotReady", "order is %s", o.status)
+		return
+	}
+	var in struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &in); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "%v", err)
+		return
+	}
+	csr, err := base64.RawURLEncoding.DecodeString(in.CSR)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", "invalid CSR encoding")
+		return
+	}
+	names := make([]string, len(o.identifiers))
+	for i, id := range o.identifiers {
+		names[i] = id.Value
+	}
+	der, err := s.ca.Sign(csr, names, validity)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", "%v", err)
+		return
+	}
+	o.cert = s.newID()
+	s.certs[o.cert] = der
+	o.status = "valid"
+	w.Header().Set("Location", s.Server.URL+"/order/"+o.id)
+	writeJSON(w, http.StatusOK, s.orderJSON(o))
+}
+
+func (s *Server) getCert(w http.ResponseWriter, req *request, id string) {
+	der, ok := s.certs[id]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such certificate")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// updateOrder moves a pending order to ready once all its authorizations
+// are valid, or to invalid once one is.
+func (s *Server) updateOrder(o *order) {
+	if o.status != "pending" {
+		return
+	}
+	ready := true
+	for _, id := range o.authzs {
+		switch z := s.authzs[id]; z.status {
+		case "invalid":
+			o.status, o.err = "invalid", z.err
+			return
+		case "valid":
+		default:
+			ready = false
+		}
+	}
+	if ready {
+		o.status = "ready"
+	}
+}
+
+func accountJSON(acct *account) map[string]interface{} {
+	return map[string]interface{}{"status": "valid", "contact": acct.contact}
+}
+
+func (s *Server) orderJSON(o *order) map[string]interface{} {
+	authzs := make([]string, len(o.authzs))
+	for i, id := range o.authzs {
+		authzs[i] = s.Server.URL + "/authz/" + id
+	}
+	v := map[string]interface{}{
+		"status":         o.status,
+		"expires":        o.expires.Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       s.Server.URL + "/finalize/" + o.id,
+	}
+	if o.cert != "" {
+		v["certificate"] = s.Server.URL + "/cert/" + o.cert
+	}
+	if o.err != nil {
+		v["error"] = o.err
+	}
+	return v
+}
+
+func (s *Server) authzJSON(z *authz) map[string]interface{} {
+	return map[string]interface{}{
+		"status":     z.status,
+		"expires":    z.expires.Format(time.RFC3339),
+		"identifier": z.identifier,
+		"challenges": []interface{}{s.challengeJSON(z)},
+	}
+}
+
+func (s *Server) challengeJSON(z *authz) map[string]interface{} {
+	v := map[string]interface{}{
+		"type":   "dns-01",
+		"url":    s.Server.URL + "/chall/" + z.id,
+		"token":  z.token,
+		"status": z.chalStatus,
+	}
+	if !z.validated.IsZero() {
+		v["validated"] = z.validated.Format(time.RFC3339)
+	}
+	if z.err != nil {
+		v["error"] = z.err
+	}
+	return v
+}
+
+func (s *Server) newID() string {
+	s.next++
+	return fmt.Sprintf("%d", s.next)
+}
+
+func (s *Server) newNonce() string {
+	nonce := randomToken()
+	s.mu.Lock()
+	s.nonces[nonce] = true
+	s.mu.Unlock()
+	return nonce
+}
+
+func (s *Server) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.nonces[nonce] {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return true
+}
+
+func randomToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// parseJWK returns the public key of an EC P-256 or RSA JWK.
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	switch {
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := decodeInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on P-256")
+		}
+		return key, nil
+	case jwk.Kty == "RSA":
+		n, err := decodeInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s %s", jwk.Kty, jwk.Crv)
+	}
+}
+
+// thumbprint returns the JWK thumbprint of key (RFC 7638).
+func thumbprint(key crypto.PublicKey) (string, error) {
+	var jwk string
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		jwk = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+			encodeInt(key.X, 32), encodeInt(key.Y, 32))
+	case *rsa.PublicKey:
+		jwk = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+			encodeInt(big.NewInt(int64(key.E)), 0), encodeInt(key.N, 0))
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+	sum := sha256.Sum256([]byte(jwk))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// verify checks the ES256 or RS256 signature of input by key.
+func verify(alg string, key crypto.PublicKey, input, signature string) error {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(input))
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return fmt.Errorf("want an ES256 signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("want an RS256 signature")
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// encodeInt encodes n big-endian, padded to size bytes.
+func encodeInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// splitPath splits /dir/id into dir and id.
+func splitPath(path string) (dir, id string) {
+	dir, id, _ = strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return dir, id
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, status int, typ, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	})
+}
@@ -0,0 +1,211 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+)
+
+// backdate is how far before issuing certificates become valid, for
+// clients whose clock is behind.
+const backdate = 5 * time.Minute
+
+// CA is the internal issuer: a CA whose certificate and key the control
+// plane holds, signing certificates valid for a fixed period.
+type CA struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	validity time.Duration
+}
+
+// LoadCA reads the CA of cfg.
+func LoadCA(cfg config.CAConfig) (*CA, error) {
+	certPEM, err := os.ReadFile(cfg.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ParseCA(certPEM, keyPEM, cfg.Validity)
+	if err != nil {
+		return nil, fmt.Errorf("tls.ca: %w", err)
+	}
+	return ca, nil
+}
+
+// ParseCA returns the CA with the PEM certificate and key, issuing
+// certificates valid for validity.
+func ParseCA(certPEM, keyPEM []byte, validity time.Duration) (*CA, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert := certs[0]
+	if !cert.IsCA {
+		return nil, errors.New("not a CA certificate")
+	}
+	if !publicKeyEqual(cert.PublicKey, key.Public()) {
+		return nil, errors.New("the private key is not the key of the CA certificate")
+	}
+	return &CA{cert: cert, key: key, validity: validity}, nil
+}
+
+// GenerateCA returns the certificate and key, in PEM, of a new CA named
+// commonName, valid for ten years.
+func GenerateCA(commonName string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func (ca *CA) Name() string { return "internal" }
+
+// Issue signs a certificate valid for the configured validity. The chain
+// is the certificate alone: clients verify it against the CA from
+// /v1/ca.pem.
+func (ca *CA) Issue(ctx context.Context, csr []byte, dnsNames []string) (*Certificate, error) {
+	der, err := ca.Sign(csr, dnsNames, ca.validity)
+	if err != nil {
+		return nil, err
+	}
+	return newCertificate([][]byte{der})
+}
+
+// Sign returns a DER server certificate for dnsNames and the key of csr,
+// valid for validity from now.
+func (ca *CA) Sign(csr []byte, dnsNames []string, validity time.Duration) ([]byte, error) {
+	if len(dnsNames) == 0 {
+		return nil, errors.New("no DNS names to certify")
+	}
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %w", err)
+	}
+	if err := req.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %w", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := x509.KeyUsageDigitalSignature
+	if _, ok := req.PublicKey.(*rsa.PublicKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	return x509.CreateCertificate(rand.Reader, template, ca.cert, req.PublicKey, ca.key)
+}
+
+// Certificate returns the certificate of the CA, in PEM.
+func (ca *CA) Certificate() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// ParsePrivateKey parses the first private key of the PEM data, in PKCS
+// #8, SEC 1 or PKCS #1 form.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key in PEM data")
+		}
+		var (
+			key interface{}
+			err error
+		)
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	ka, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	kb, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ka, kb)
+}
+
+// newSerial returns a random 128-bit serial number.
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,257 @@
+package pki_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/pki"
+)
+
+// newTestCA returns a new internal CA issuing certificates valid for a day,
+// and its certificate.
+func newTestCA(t *testing.T) (*pki.CA, *x509.Certificate) {
+	t.Helper()
+	certPEM, keyPEM, err := pki.GenerateCA("dbx test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := pki.ParseCA(certPEM, keyPEM, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(ca.Certificate())
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, cert
+}
+
+// newCSR returns a certificate request of key for template.
+func newCSR(t *testing.T, template *x509.CertificateRequest, key crypto.Signer) []byte {
+	t.Helper()
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// TestCASign checks that certificates carry the requested names and none
+// of the names of the request, which the agent of a container makes.
+func TestCASign(t *testing.T) {
+	ca, caCert := newTestCA(t)
+	key := newKey(t)
+	csr := newCSR(t, &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: "evil.example.com", Organization: []string{"Evil"}},
+		DNSNames:       []string{"pg-1234abcd." + zone, "evil.example.com", "*." + zone},
+		IPAddresses:    []net.IP{net.ParseIP("10.20.0.5")},
+		EmailAddresses: []string{"root@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com"}},
+	}, key)
+	dnsNames := []string{"pg-1234abcd." + zone, "db.ourco.com"}
+
+	before := time.Now()
+	der, err := ca.Sign(csr, dnsNames, 6*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cert.DNSNames, dnsNames) {
+		t.Errorf("DNSNames = %v, want %v", cert.DNSNames, dnsNames)
+	}
+	if len(cert.IPAddresses) != 0 || len(cert.EmailAddresses) != 0 || len(cert.URIs) != 0 {
+		t.Errorf("certificate kept the SANs of the request: %v %v %v", cert.IPAddresses, cert.EmailAddresses, cert.URIs)
+	}
+	if want := (pkix.Name{CommonName: dnsNames[0]}).String(); cert.Subject.String() != want {
+		t.Errorf("Subject = %s, want %s", cert.Subject, want)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		t.Error("certificate is not for the key of the request")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	for _, name := range dnsNames {
+		opts := x509.VerifyOptions{DNSName: name, Roots: roots, CurrentTime: before, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		if _, err := cert.Verify(opts); err != nil {
+			t.Errorf("certificate does not verify for %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"evil.example.com", "other." + zone} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err == nil {
+			t.Errorf("certificate verifies for %s", name)
+		}
+	}
+	if cert.IsCA {
+		t.Error("certificate is a CA")
+	}
+	if cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Error("certificate of an ECDSA key allows key encipherment")
+	}
+
+	// Valid from shortly before issue, for clocks behind, for the validity
+	// asked for
+	if cert.NotBefore.After(before.Add(-time.Minute)) || cert.NotBefore.Before(before.Add(-10*time.Minute)) {
+		t.Errorf("NotBefore = %v, issued at %v", cert.NotBefore, before)
+	}
+	if cert.NotAfter.Before(before.Add(6*time.Hour).Truncate(time.Second)) || cert.NotAfter.After(after.Add(6*time.Hour)) {
+		t.Errorf("NotAfter = %v, want 6h after %v", cert.NotAfter, before)
+	}
+}
+
+func TestCASignRSA(t *testing.T) {
+	ca, _ := newTestCA(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ca.Sign(newCSR(t, &x509.CertificateRequest{}, key), []string{"pg-1234abcd." + zone}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment; cert.KeyUsage != want {
+		t.Errorf("KeyUsage = %v, want %v", cert.KeyUsage, want)
+	}
+}
+
+func TestCASignInvalid(t *testing.T) {
+	ca, _ := newTestCA(t)
+	csr := newCSR(t, &x509.CertificateRequest{}, newKey(t))
+
+	// A request whose signature was altered
+	forged := append([]byte{}, csr...)
+	forged[len(forged)-1] ^= 1
+
+	// A request with the public key of another swapped in, which its
+	// signature doesn't match
+	req, err := x509.ParseCertificateRequest(newCSR(t, &x509.CertificateRequest{}, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := append([]byte{}, csr...)
+	other, err := x509.MarshalPKIXPublicKey(req.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownKey, err := x509.MarshalPKIXPublicKey(own.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.Index(string(swapped), string(ownKey))
+	if i < 0 {
+		t.Fatal("no public key in the request")
+	}
+	copy(swapped[i:], other)
+
+	tests := []struct {
+		name     string
+		csr      []byte
+		dnsNames []string
+		wantErr  string
+	}{
+		{"bad signature", forged, []string{"pg-1234abcd." + zone}, "invalid certificate request"},
+		{"key of another", swapped, []string{"pg-1234abcd." + zone}, "invalid certificate request"},
+		{"not a request", []byte("not a request"), []string{"pg-1234abcd." + zone}, "invalid certificate request"},
+		{"no names", csr, nil, "no DNS names"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ca.Sign(tt.csr, tt.dnsNames, time.Hour)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Sign = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCAIssue checks the certificate the internal issuer describes: valid
+// for the validity of the CA, chaining to it alone.
+func TestCAIssue(t *testing.T) {
+	ca, caCert := newTestCA(t)
+	dnsNames := []string{"pg-1234abcd." + zone}
+	cert, err := ca.Issue(context.Background(), newCSR(t, &x509.CertificateRequest{}, newKey(t)), dnsNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, rest := pem.Decode(cert.ChainPEM)
+	if block == nil || len(strings.TrimSpace(string(rest))) != 0 {
+		t.Fatalf("chain %q is not one certificate", cert.ChainPEM)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("certificate is not signed by the CA: %v", err)
+	}
+	if !reflect.DeepEqual(cert.DNSNames, dnsNames) || cert.Serial != leaf.SerialNumber.Text(16) {
+		t.Errorf("certificate %+v does not describe %v", cert, leaf.SerialNumber)
+	}
+	if got := cert.NotAfter.Sub(cert.NotBefore); got < 24*time.Hour || got > 24*time.Hour+10*time.Minute {
+		t.Errorf("certificate is valid for %v, want a day", got)
+	}
+}
+
+func TestParseCA(t *testing.T) {
+	certPEM, keyPEM, err := pki.GenerateCA("dbx test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeyPEM, err := pki.GenerateCA("another CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := newTestCA(t)
+	der, err := ca.Sign(newCSR(t, &x509.CertificateRequest{}, newKey(t)), []string{"pg-1234abcd." + zone}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if _, err := pki.ParseCA(certPEM, otherKeyPEM, time.Hour); err == nil {
+		t.Error("ParseCA accepted the key of another CA")
+	}
+	if _, err := pki.ParseCA(leafPEM, keyPEM, time.Hour); err == nil {
+		t.Error("ParseCA accepted a server certificate")
+	}
+	if _, err := pki.ParseCA(keyPEM, keyPEM, time.Hour); err == nil {
+		t.Error("ParseCA accepted PEM data without a certificate")
+	}
+}
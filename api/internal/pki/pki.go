@@ -0,0 +1,143 @@
+// Package pki issues the certificates instances serve, for the names DNS
+// publishes for them, from the CA configured under tls: an internal CA the
+// control plane holds the key of, or an ACME CA whose dns-01 challenges are
+// answered through the DNS provider. Keys never leave the containers; the
+// issuers sign the certificate requests their guest agents make.
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/dns"
+)
+
+// Certificate is an issued certificate.
+type Certificate struct {
+	// ChainPEM is the certificate followed by the intermediates it chains
+	// to, as Postgres serves them.
+	ChainPEM  []byte
+	Serial    string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// RenewAt is when the certificate is due for renewal: renewBefore ahead of
+// its expiry, or two thirds into its validity if it is too short for that.
+func (c *Certificate) RenewAt(renewBefore time.Duration) time.Time {
+	lifetime := c.NotAfter.Sub(c.NotBefore)
+	if renewBefore >= lifetime {
+		return c.NotBefore.Add(lifetime * 2 / 3)
+	}
+	return c.NotAfter.Add(-renewBefore)
+}
+
+// Issuer issues certificates.
+type Issuer interface {
+	// Name is internal or acme, as recorded with the certificates issued.
+	Name() string
+	// Issue returns a certificate for dnsNames and the public key of csr, a
+	// DER certificate request signed by its key. The names of csr are
+	// ignored.
+	Issue(ctx context.Context, csr []byte, dnsNames []string) (*Certificate, error)
+}
+
+// New returns the issuer cfg configures, or nil for none. The acme issuer
+// answers challenges through provider, in the zone of dnsCfg.
+func New(cfg config.TLSConfig, dnsCfg config.DNSConfig, provider dns.Provider) (Issuer, error) {
+	switch cfg.Issuer {
+	case "none":
+		return nil, nil
+	case "internal":
+		return LoadCA(cfg.CA)
+	case "acme":
+		if provider == nil {
+			return nil, errors.New("the acme issuer needs a DNS provider")
+		}
+		return NewACME(cfg.ACME, provider, dnsCfg.Zone, int(dnsCfg.TTL/time.Second))
+	default:
+		return nil, fmt.Errorf("unknown TLS issuer %q", cfg.Issuer)
+	}
+}
+
+// Bundle returns the certificates, in PEM, that the certificates of
+// instances chain to: the internal CA and the ACME roots, whichever are
+// configured, so clients switched from one issuer to the other keep
+// verifying certificates issued before. It returns nil when there are none.
+func Bundle(cfg config.TLSConfig) ([]byte, error) {
+	var bundle bytes.Buffer
+	for _, name := range []string{cfg.CA.CertFile, cfg.ACME.RootsFile} {
+		if name == "" {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, cert := range certs {
+			pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+	}
+	if bundle.Len() == 0 {
+		return nil, nil
+	}
+	return bundle.Bytes(), nil
+}
+
+// parseCertificates returns the certificates of the PEM data, in order.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate in PEM data")
+	}
+	return certs, nil
+}
+
+// newCertificate describes the chain of DER certificates, leaf first.
+func newCertificate(chain [][]byte) (*Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, der := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return &Certificate{
+		ChainPEM:  buf.Bytes(),
+		Serial:    fmt.Sprintf("%x", leaf.SerialNumber),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}, nil
+}
@@ -0,0 +1,35 @@
+package pki_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/pki"
+)
+
+func TestCertificateRenewAt(t *testing.T) {
+	const day = 24 * time.Hour
+	issued := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		validity    time.Duration
+		renewBefore time.Duration
+		want        time.Time
+	}{
+		{"ACME", 90 * day, 30 * day, issued.Add(60 * day)},
+		{"internal CA", 365 * day, 30 * day, issued.Add(335 * day)},
+		{"a second of renewal window", 30*day + time.Second, 30 * day, issued.Add(time.Second)},
+		// Certificates no longer than the renewal window would be renewed
+		// as soon as they are issued
+		{"as long as the window", 30 * day, 30 * day, issued.Add(20 * day)},
+		{"shorter than the window", 6 * time.Hour, 30 * day, issued.Add(4 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &pki.Certificate{NotBefore: issued, NotAfter: issued.Add(tt.validity)}
+			if got := cert.RenewAt(tt.renewBefore); !got.Equal(tt.want) {
+				t.Errorf("RenewAt(%v) = %v, want %v", tt.renewBefore, got, tt.want)
+			}
+		})
+	}
+}
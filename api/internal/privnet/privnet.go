@@ -0,0 +1,164 @@
+// Package privnet lays out the private networks of orgs. Each is a subnet
+// of the configured pool on a VLAN of its own. The first address of the
+// subnet is the WireGuard gateway's, the rest of its lower half goes to
+// instances and its upper half, but for the broadcast address, to
+// WireGuard peers.
+package privnet
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/proxmox"
+)
+
+const (
+	// InterfaceKey is the container config key of the network device
+	// attaching an instance to its private network.
+	InterfaceKey = "net1"
+	// InterfaceName is the name of that device inside the container.
+	InterfaceName = "eth1"
+)
+
+// ErrExhausted is returned when there is no subnet, VLAN or address left
+// to allocate.
+var ErrExhausted = errors.New("no free address space left")
+
+// Allocator allocates subnets and VLANs to networks.
+type Allocator struct {
+	pool    netip.Prefix
+	bits    int
+	bridge  string
+	vlanMin int
+	vlanMax int
+}
+
+// New returns an allocator for cfg, which Validate has checked.
+func New(cfg config.PrivateNetworksConfig) *Allocator {
+	return &Allocator{
+		pool:    netip.MustParsePrefix(cfg.Pool).Masked(),
+		bits:    cfg.PrefixLength,
+		bridge:  cfg.Bridge,
+		vlanMin: cfg.VLANMin,
+		vlanMax: cfg.VLANMax,
+	}
+}
+
+// Allocate returns the first subnet of the pool and the lowest VLAN that
+// none of the networks taken has.
+func (a *Allocator) Allocate(taken []models.PrivateNetwork) (netip.Prefix, int, error) {
+	subnets := make([]netip.Prefix, 0, len(taken))
+	vlans := make(map[int]bool, len(taken))
+	for _, n := range taken {
+		if subnet, err := netip.ParsePrefix(n.Subnet); err == nil {
+			subnets = append(subnets, subnet)
+		}
+		vlans[n.VLAN] = true
+	}
+
+	subnet, found := netip.PrefixFrom(a.pool.Addr(), a.bits), false
+	for a.pool.Contains(subnet.Addr()) {
+		if !overlaps(subnet, subnets) {
+			found = true
+			break
+		}
+		subnet = next(subnet)
+	}
+	if !found {
+		return netip.Prefix{}, 0, ErrExhausted
+	}
+	for vlan := a.vlanMin; vlan <= a.vlanMax; vlan++ {
+		if !vlans[vlan] {
+			return subnet, vlan, nil
+		}
+	}
+	return netip.Prefix{}, 0, ErrExhausted
+}
+
+func overlaps(subnet netip.Prefix, subnets []netip.Prefix) bool {
+	for _, s := range subnets {
+		if s.Overlaps(subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the subnet of the same size right after subnet, which is
+// outside the pool once subnet is its last.
+func next(subnet netip.Prefix) netip.Prefix {
+	addr := subnet.Addr()
+	for i := 0; i < 1<<(addr.BitLen()-subnet.Bits()); i++ {
+		addr = addr.Next()
+		if !addr.IsValid() {
+			return netip.Prefix{}
+		}
+	}
+	return netip.PrefixFrom(addr, subnet.Bits())
+}
+
+// Interface returns the network device attaching a container to network
+// with address.
+func (a *Allocator) Interface(network *models.PrivateNetwork, address string) proxmox.NetworkInterface {
+	subnet := netip.MustParsePrefix(network.Subnet)
+	return proxmox.NetworkInterface{
+		Name:     InterfaceName,
+		Bridge:   a.bridge,
+		Tag:      network.VLAN,
+		IP:       netip.PrefixFrom(netip.MustParseAddr(address), subnet.Bits()).String(),
+		Firewall: true,
+	}
+}
+
+// Gateway returns the address of the WireGuard gateway on subnet.
+func Gateway(subnet netip.Prefix) netip.Addr {
+	return subnet.Addr().Next()
+}
+
+// InstanceAddress returns the lowest address for instances on subnet that
+// isn't taken.
+func InstanceAddress(subnet netip.Prefix, taken []string) (netip.Addr, error) {
+	upper, _ := halves(subnet)
+	return free(Gateway(subnet).Next(), upper, taken)
+}
+
+// PeerAddress returns the lowest address for WireGuard peers on subnet
+// that isn't taken.
+func PeerAddress(subnet netip.Prefix, taken []string) (netip.Addr, error) {
+	upper, broadcast := halves(subnet)
+	return free(upper, broadcast, taken)
+}
+
+// halves returns the first address of the upper half of subnet and its
+// broadcast address.
+func halves(subnet netip.Prefix) (netip.Addr, netip.Addr) {
+	size := 1 << (subnet.Addr().BitLen() - subnet.Bits())
+	addr := subnet.Addr()
+	var upper netip.Addr
+	for i := 1; i < size; i++ {
+		addr = addr.Next()
+		if i == size/2 {
+			upper = addr
+		}
+	}
+	return upper, addr
+}
+
+// free returns the lowest address from from up to, but not including, to
+// that isn't taken.
+func free(from, to netip.Addr, taken []string) (netip.Addr, error) {
+	used := make(map[netip.Addr]bool, len(taken))
+	for _, s := range taken {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			used[addr] = true
+		}
+	}
+	for addr := from; addr.Less(to); addr = addr.Next() {
+		if !used[addr] {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, ErrExhausted
+}
@@ -0,0 +1,168 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// BackupInstance takes a base backup of the instance through its guest
+// agent and streams it to the object store. The backup row is created
+// pending along with the job, by the API or the scheduler; a job retried
+// after a worker crash takes the backup again, replacing the object.
+func (p *Provisioner) BackupInstance(ctx context.Context, job *models.Job) error {
+	payload, backup, err := p.loadBackup(ctx, job)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if backup.Status != models.BackupPending && backup.Status != models.BackupRunning {
+		return nil
+	}
+
+	if err := p.backup(ctx, backup); err != nil {
+		p.finishBackup(backup, payload.RetentionDays, err)
+		return err
+	}
+	p.finishBackup(backup, payload.RetentionDays, nil)
+	return nil
+}
+
+func (p *Provisioner) backup(ctx context.Context, backup *models.Backup) error {
+	inst, err := p.store.Instances().Get(ctx, backup.InstanceID)
+	if err != nil {
+		return err
+	}
+	if inst.Status != models.InstanceRunning {
+		return fmt.Errorf("instance is %s; only running instances can be backed up", inst.Status)
+	}
+
+	agent, err := p.agents.For(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return err
+	}
+	// WAL replay from the backup starts no earlier than the insert
+	// position before it, and is consistent once past the one after it
+	status, err := agent.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get PostgreSQL status: %w", err)
+	}
+
+	key := backupKey(backup)
+	now := time.Now()
+	backup.Status, backup.StartedAt, backup.PgVersion = models.BackupRunning, &now, inst.PgVersion
+	backup.RepoURL, backup.StartLSN = p.objects.URL(key), status.WALLSN
+	if err := p.store.Backups().Update(ctx, backup); err != nil {
+		return err
+	}
+
+	archive, err := agent.BaseBackup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start base backup: %w", err)
+	}
+	defer archive.Close()
+
+	logging.FromContext(ctx).Info("backing up instance", "node", inst.Node, "ctid", inst.CTID, "url", backup.RepoURL)
+	size, err := p.objects.Put(ctx, key, archive)
+	if err != nil {
+		return err
+	}
+	backup.SizeBytes = size
+
+	status, err = agent.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get PostgreSQL status: %w", err)
+	}
+	backup.EndLSN = status.WALLSN
+	return nil
+}
+
+// finishBackup records how the backup ended, even when ctx was cancelled
+// by shutdown. Failed backups expire like completed ones, so they don't
+// pile up in the list.
+func (p *Provisioner) finishBackup(backup *models.Backup, retentionDays int, backupErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if retentionDays < 1 {
+		retentionDays = p.backupRetention
+	}
+	now := time.Now()
+	expires := now.AddDate(0, 0, retentionDays)
+	backup.Status, backup.CompletedAt, backup.ExpiresAt = models.BackupCompleted, &now, &expires
+	if backupErr != nil {
+		backup.Status, backup.ErrorMessage = models.BackupFailed, backupErr.Error()
+	}
+	p.store.Backups().Update(ctx, backup)
+}
+
+// DeleteBackup removes an expired backup's object, then the backup, then
+// the archived WAL that no remaining backup can replay.
+func (p *Provisioner) DeleteBackup(ctx context.Context, job *models.Job) error {
+	_, backup, err := p.loadBackup(ctx, job)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := p.objects.Delete(ctx, backupKey(backup)); err != nil {
+		return err
+	}
+	err = p.store.Backups().Delete(ctx, backup.ID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	logging.FromContext(ctx).Info("deleted backup", "backup_id", backup.ID, "url", backup.RepoURL)
+	return p.pruneWAL(ctx, backup.InstanceID)
+}
+
+// deleteBackups removes the objects of every backup and archived WAL
+// segment of inst, whose rows go with the instance.
+func (p *Provisioner) deleteBackups(ctx context.Context, inst *models.Instance) error {
+	backups, err := p.store.Backups().ListByInstance(ctx, inst.ID)
+	if err != nil {
+		return err
+	}
+	for i := range backups {
+		if err := p.objects.Delete(ctx, backupKey(&backups[i])); err != nil {
+			return err
+		}
+	}
+	segments, err := p.store.WALSegments().ListByInstance(ctx, inst.ID, "")
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if err := p.objects.Delete(ctx, walKey(inst.ID, seg.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) loadBackup(ctx context.Context, job *models.Job) (jobs.BackupPayload, *models.Backup, error) {
+	var payload jobs.BackupPayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return payload, nil, fmt.Errorf("invalid job payload: %w", err)
+	}
+	backup, err := p.store.Backups().Get(ctx, payload.BackupID)
+	if err != nil {
+		return payload, nil, err
+	}
+	return payload, backup, nil
+}
+
+// backupKey is where the object of backup is stored.
+func backupKey(backup *models.Backup) string {
+	return "instances/" + backup.InstanceID + "/backups/" + backup.ID + ".tar.gz"
+}
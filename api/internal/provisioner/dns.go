@@ -0,0 +1,210 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// publishRecord points the instance's name at the address of its current
+// container, recording it before publishing it so a failed update is
+// retried by the next reconcile, and sets inst.FQDN. The caller saves inst.
+func (p *Provisioner) publishRecord(ctx context.Context, inst *models.Instance) error {
+	client, err := p.cluster.Client(ctx, inst.Node)
+	if err != nil {
+		return err
+	}
+	addr, err := client.ContainerAddress(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return fmt.Errorf("failed to get container address: %w", err)
+	}
+	record, err := dns.AddressRecord(dns.FQDN(p.dnsCfg.Zone, inst.ID), addr, int(p.dnsCfg.TTL/time.Second))
+	if err != nil {
+		return err
+	}
+
+	err = p.store.DNSRecords().Put(ctx, &models.DNSRecord{
+		Name:       record.Name,
+		Type:       record.Type,
+		Value:      record.Value,
+		TTL:        record.TTL,
+		InstanceID: inst.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record %s: %w", record.Name, err)
+	}
+	inst.FQDN = record.Name
+	if p.dns != nil {
+		if err := p.dns.Upsert(ctx, record); err != nil {
+			return fmt.Errorf("failed to publish %s: %w", record.Name, err)
+		}
+	}
+	logging.FromContext(ctx).Info("published instance record", "fqdn", record.Name, "type", record.Type, "value", record.Value)
+	return nil
+}
+
+// republishRecord publishes the record of an instance that moved to
+// another container. The instance keeps running either way, so a failure
+// is logged and left to the next reconcile.
+func (p *Provisioner) republishRecord(ctx context.Context, inst *models.Instance) {
+	if err := p.publishRecord(ctx, inst); err != nil {
+		logging.FromContext(ctx).Warn("failed to publish instance record", "error", err)
+		return
+	}
+	if err := p.store.Instances().Update(ctx, inst); err != nil {
+		logging.FromContext(ctx).Warn("failed to save instance FQDN", "error", err)
+	}
+}
+
+// unpublishRecord removes the records of the instance from the provider.
+// The stored record goes with the instance.
+func (p *Provisioner) unpublishRecord(ctx context.Context, inst *models.Instance) error {
+	if p.dns == nil {
+		return nil
+	}
+	record, err := p.store.DNSRecords().GetByInstance(ctx, inst.ID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.dns.Delete(ctx, record.Name); err != nil {
+		return fmt.Errorf("failed to unpublish %s: %w", record.Name, err)
+	}
+	logging.FromContext(ctx).Info("unpublished instance record", "fqdn", record.Name)
+	return nil
+}
+
+// ReconcileDNS brings the records back in line with the instances, then
+// the provider with the records. Running instances whose record is
+// missing, names another zone or points elsewhere than their container
+// are published again. Records the provider lacks or holds differently
+// are upserted, and names of the zone it holds that no instance has are
+// deleted; records outside the naming scheme are left alone. The
+// scheduler enqueues it every dns.reconcile_interval. An instance that
+// fails is logged and skipped, so one stuck container doesn't hold back
+// the rest.
+func (p *Provisioner) ReconcileDNS(ctx context.Context, job *models.Job) error {
+	logger := logging.FromContext(ctx)
+
+	instances, err := p.store.Instances().ListByStatus(ctx, models.InstanceRunning)
+	if err != nil {
+		return err
+	}
+	var failed []error
+	for i := range instances {
+		inst := &instances[i]
+		if err := p.reconcileInstance(ctx, inst); err != nil {
+			logger.Warn("failed to reconcile instance record", "instance_id", inst.ID, "error", err)
+			failed = append(failed, fmt.Errorf("instance %s: %w", inst.ID, err))
+		}
+	}
+
+	if p.dns != nil {
+		if err := p.reconcileProvider(ctx); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to reconcile %d instance record(s): %w", len(failed), errors.Join(failed...))
+	}
+	return nil
+}
+
+// reconcileInstance publishes the record of inst if it is missing or
+// stale. The provider is brought in line afterwards by reconcileProvider.
+func (p *Provisioner) reconcileInstance(ctx context.Context, inst *models.Instance) error {
+	client, err := p.cluster.Client(ctx, inst.Node)
+	if err != nil {
+		return err
+	}
+	addr, err := client.ContainerAddress(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return fmt.Errorf("failed to get container address: %w", err)
+	}
+	want, err := dns.AddressRecord(dns.FQDN(p.dnsCfg.Zone, inst.ID), addr, int(p.dnsCfg.TTL/time.Second))
+	if err != nil {
+		return err
+	}
+
+	record, err := p.store.DNSRecords().GetByInstance(ctx, inst.ID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	if err == nil && inst.FQDN == want.Name &&
+		(dns.Record{Name: record.Name, Type: record.Type, TTL: record.TTL, Value: record.Value}) == want {
+		return nil
+	}
+
+	// Put renames a record of a zone configured earlier; the provider only
+	// serves the current zone, so there is nothing to delete there
+	if err := p.store.DNSRecords().Put(ctx, &models.DNSRecord{
+		Name:       want.Name,
+		Type:       want.Type,
+		Value:      want.Value,
+		TTL:        want.TTL,
+		InstanceID: inst.ID,
+	}); err != nil {
+		return err
+	}
+	inst.FQDN = want.Name
+	if err := p.store.Instances().Update(ctx, inst); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Info("corrected instance record", "instance_id", inst.ID, "fqdn", want.Name, "value", want.Value)
+	return nil
+}
+
+// reconcileProvider makes the provider hold the stored records of the
+// zone.
+func (p *Provisioner) reconcileProvider(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+
+	stored, err := p.store.DNSRecords().List(ctx)
+	if err != nil {
+		return err
+	}
+	published, err := p.dns.Records(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list published records: %w", err)
+	}
+	have := make(map[string][]dns.Record, len(published))
+	for _, r := range published {
+		have[r.Name] = append(have[r.Name], r)
+	}
+
+	want := make(map[string]bool, len(stored))
+	for _, s := range stored {
+		if !dns.Managed(p.dnsCfg.Zone, s.Name) {
+			continue
+		}
+		record := dns.Record{Name: s.Name, Type: s.Type, TTL: s.TTL, Value: s.Value}
+		want[record.Name] = true
+		if held := have[record.Name]; len(held) == 1 && held[0] == record {
+			continue
+		}
+		if err := p.dns.Upsert(ctx, record); err != nil {
+			return fmt.Errorf("failed to publish %s: %w", record.Name, err)
+		}
+		logger.Info("republished drifted record", "fqdn", record.Name, "value", record.Value)
+	}
+	for _, r := range published {
+		if want[r.Name] || !dns.Managed(p.dnsCfg.Zone, r.Name) {
+			continue
+		}
+		if err := p.dns.Delete(ctx, r.Name); err != nil {
+			return fmt.Errorf("failed to unpublish %s: %w", r.Name, err)
+		}
+		// A name with both an A and an AAAA record is deleted once
+		want[r.Name] = true
+		logger.Info("unpublished stray record", "fqdn", r.Name, "value", r.Value)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// VerifyDomain looks up the ownership record of a pending custom domain.
+// Once it holds the domain's token, the domain is verified and an
+// issue_certificate job adds it to the instance's certificate. Until then
+// the domain stays pending, with what was found instead, and the scheduler
+// checks it again; past its expiry it fails.
+func (p *Provisioner) VerifyDomain(ctx context.Context, job *models.Job) error {
+	logger := logging.FromContext(ctx)
+
+	var payload jobs.DomainPayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	domain, err := p.store.Domains().Get(ctx, payload.DomainID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if domain.Status != models.DomainPending {
+		logger.Info("skipping domain verification", "domain", domain.Name, "reason", "domain is "+domain.Status)
+		return nil
+	}
+
+	now := time.Now()
+	if err := p.verifier.Check(ctx, domain.Name, domain.VerificationValue); err != nil {
+		domain.ErrorMessage = err.Error()
+		if !now.Before(domain.ExpiresAt) {
+			domain.Status = models.DomainFailed
+			domain.NextCheckAt = nil
+			domain.ErrorMessage += "; gave up waiting for the record"
+		}
+		logger.Info("domain not verified", "domain", domain.Name, "status", domain.Status, "reason", err.Error())
+		return p.store.Domains().Update(ctx, domain)
+	}
+
+	domain.Status = models.DomainVerified
+	domain.ErrorMessage = ""
+	domain.NextCheckAt = nil
+	domain.VerifiedAt = &now
+	err = p.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Domains().Update(ctx, domain); err != nil {
+			return err
+		}
+		inst, err := tx.Instances().Get(ctx, domain.InstanceID)
+		if err != nil {
+			return err
+		}
+		return p.enqueueCertificate(ctx, tx.Jobs(), inst, payload.OrgID)
+	})
+	if err == store.ErrConflict {
+		domain.Status = models.DomainFailed
+		domain.VerifiedAt = nil
+		domain.ErrorMessage = "the domain is verified for another instance; remove it there first"
+		logger.Info("domain not verified", "domain", domain.Name, "reason", "verified for another instance")
+		return p.store.Domains().Update(ctx, domain)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("verified domain", "domain", domain.Name)
+	return nil
+}
+
+// domainNames returns the verified custom domains of inst, which its
+// certificate is issued for after its FQDN.
+func (p *Provisioner) domainNames(ctx context.Context, inst *models.Instance) ([]string, error) {
+	domains, err := p.store.Domains().ListByInstance(ctx, inst.ID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, d := range domains {
+		if d.Status == models.DomainVerified {
+			names = append(names, d.Name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,146 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// ApplyNetworkPolicy applies the network policy of the instance to its
+// container, and to the green container of an upgrade in progress, which
+// otherwise only gets the policy as it was when it was provisioned. The API
+// enqueues it when the policy is set. Instances being deleted, or that
+// failed, are skipped.
+func (p *Provisioner) ApplyNetworkPolicy(ctx context.Context, job *models.Job) error {
+	_, inst, err := p.load(ctx, job)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if inst.Status == models.InstanceDeleting || inst.Status == models.InstanceFailed || inst.CTID == 0 {
+		return nil
+	}
+	return p.applyNetworkPolicies(ctx, inst)
+}
+
+// applyNetworkPolicies applies the network policy of inst to its container
+// and to the green container of an upgrade in progress.
+func (p *Provisioner) applyNetworkPolicies(ctx context.Context, inst *models.Instance) error {
+	agent, err := p.waitForAgent(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return err
+	}
+	if err := p.applyNetworkPolicy(ctx, inst, inst.Node, inst.CTID, agent); err != nil {
+		return err
+	}
+
+	if inst.Status != models.InstanceUpgrading {
+		return nil
+	}
+	upgrades, err := p.store.Upgrades().ListByInstance(ctx, inst.ID)
+	if err != nil {
+		return err
+	}
+	for _, u := range upgrades {
+		if u.Status != models.UpgradeRunning || u.GreenCTID == 0 {
+			continue
+		}
+		green, err := p.waitForAgent(ctx, u.GreenNode, u.GreenCTID)
+		if err != nil {
+			return err
+		}
+		if err := p.applyNetworkPolicy(ctx, inst, u.GreenNode, u.GreenCTID, green); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyNetworkPolicy compiles the network policy of inst, or the default
+// one if it has none, along with the private network of its org, into the
+// firewall of container ctid on node and the pg_hba.conf entries of its
+// agent.
+func (p *Provisioner) applyNetworkPolicy(ctx context.Context, inst *models.Instance, node string, ctid int, agent *guest.Client) error {
+	policy, err := p.store.NetworkPolicies().GetByInstance(ctx, inst.ID)
+	if err == store.ErrNotFound {
+		policy = netpolicy.Default(inst)
+	} else if err != nil {
+		return err
+	}
+	subnet, err := p.subnet(ctx, inst)
+	if err != nil {
+		return err
+	}
+
+	client, err := p.cluster.Client(ctx, node)
+	if err != nil {
+		return err
+	}
+	rules := p.network.FirewallRules(policy, subnet)
+	if err := p.setFirewallRules(ctx, client, node, ctid, rules); err != nil {
+		return err
+	}
+	if err := agent.SetHBA(ctx, p.network.HBAEntries(policy, subnet)); err != nil {
+		return fmt.Errorf("failed to set pg_hba.conf: %w", err)
+	}
+	logging.FromContext(ctx).Info("applied network policy", "node", node, "ctid", ctid, "exposure", policy.Exposure, "allowed_cidrs", len(policy.AllowedCIDRs))
+	return nil
+}
+
+// setFirewallRules replaces the rules a network policy compiled to earlier
+// in the firewall of container ctid with rules, unless they are the same,
+// leaving the other rules after them.
+func (p *Provisioner) setFirewallRules(ctx context.Context, client *proxmox.Client, node string, ctid int, rules []proxmox.FirewallRule) error {
+	if err := client.EnableFirewall(ctx, node, ctid); err != nil {
+		return fmt.Errorf("failed to enable firewall: %w", err)
+	}
+	current, err := client.FirewallRules(ctx, node, ctid)
+	if err != nil {
+		return fmt.Errorf("failed to get firewall rules: %w", err)
+	}
+
+	var managed []proxmox.FirewallRule
+	for _, r := range current {
+		if r.Comment == netpolicy.RuleComment {
+			managed = append(managed, r)
+		}
+	}
+	if sameRules(managed, rules) {
+		return nil
+	}
+
+	// Deleting from the bottom keeps the positions of the rest
+	for i := len(managed) - 1; i >= 0; i-- {
+		if err := client.DeleteFirewallRule(ctx, node, ctid, managed[i].Pos); err != nil {
+			return fmt.Errorf("failed to delete firewall rule: %w", err)
+		}
+	}
+	for _, r := range rules {
+		if err := client.AddFirewallRule(ctx, node, ctid, r); err != nil {
+			return fmt.Errorf("failed to add firewall rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// sameRules reports whether the managed rules of a container are want, in
+// the same positions.
+func sameRules(managed, want []proxmox.FirewallRule) bool {
+	if len(managed) != len(want) {
+		return false
+	}
+	for i := range managed {
+		if managed[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
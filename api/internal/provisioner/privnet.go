@@ -0,0 +1,241 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/privnet"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/wireguard"
+)
+
+// addressAttempts bounds how often an instance address is allocated again
+// after another instance took it first.
+const addressAttempts = 3
+
+// AttachNetwork attaches the instances of an org to its private network and
+// reapplies their network policies, which let the network in. The API
+// enqueues it when the network is created; instances provisioned later are
+// attached as they start. Instances being deleted, or that failed, are
+// skipped.
+func (p *Provisioner) AttachNetwork(ctx context.Context, job *models.Job) error {
+	var payload jobs.NetworkPayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	instances, err := p.store.Instances().ListByOrg(ctx, payload.OrgID)
+	if err != nil {
+		return err
+	}
+	for i := range instances {
+		inst := &instances[i]
+		if inst.Status == models.InstanceDeleting || inst.Status == models.InstanceFailed || inst.CTID == 0 {
+			continue
+		}
+		if err := p.attachNetwork(ctx, inst, inst.Node, inst.CTID); err != nil {
+			return err
+		}
+		// Stopped instances get their policy when they start
+		if inst.Status == models.InstanceRunning || inst.Status == models.InstanceUpgrading {
+			if err := p.applyNetworkPolicies(ctx, inst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// privateNetwork returns the private network of the org of inst, or nil if
+// it has none.
+func (p *Provisioner) privateNetwork(ctx context.Context, inst *models.Instance) (*models.PrivateNetwork, error) {
+	project, err := p.store.Projects().Get(ctx, inst.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	network, err := p.store.PrivateNetworks().GetByOrg(ctx, project.OrgID)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	return network, err
+}
+
+// subnet returns the subnet of the private network of the org of inst, or
+// the zero prefix if it has none.
+func (p *Provisioner) subnet(ctx context.Context, inst *models.Instance) (netip.Prefix, error) {
+	network, err := p.privateNetwork(ctx, inst)
+	if network == nil || err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.ParsePrefix(network.Subnet)
+}
+
+// attachNetwork attaches container ctid on node to the private network of
+// the org of inst, if it has one, allocating inst an address on it first
+// if it has none yet.
+func (p *Provisioner) attachNetwork(ctx context.Context, inst *models.Instance, node string, ctid int) error {
+	network, err := p.privateNetwork(ctx, inst)
+	if network == nil || err != nil {
+		return err
+	}
+	if inst.PrivateAddress == "" {
+		if err := p.allocateAddress(ctx, inst, network); err != nil {
+			return err
+		}
+	}
+
+	client, err := p.cluster.Client(ctx, node)
+	if err != nil {
+		return err
+	}
+	if err := client.SetInterface(ctx, node, ctid, privnet.InterfaceKey, p.privnet.Interface(network, inst.PrivateAddress)); err != nil {
+		return fmt.Errorf("failed to attach private network: %w", err)
+	}
+	logging.FromContext(ctx).Info("attached private network", "node", node, "ctid", ctid, "address", inst.PrivateAddress, "vlan", network.VLAN)
+	return nil
+}
+
+// allocateAddress saves the lowest free address of network as the private
+// address of inst.
+func (p *Provisioner) allocateAddress(ctx context.Context, inst *models.Instance, network *models.PrivateNetwork) error {
+	subnet, err := netip.ParsePrefix(network.Subnet)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		instances, err := p.store.Instances().ListByOrg(ctx, network.OrgID)
+		if err != nil {
+			return err
+		}
+		taken := make([]string, 0, len(instances))
+		for _, other := range instances {
+			taken = append(taken, other.PrivateAddress)
+		}
+		addr, err := privnet.InstanceAddress(subnet, taken)
+		if err != nil {
+			return fmt.Errorf("failed to allocate a private address: %w", err)
+		}
+
+		inst.PrivateAddress = addr.String()
+		err = p.store.Instances().Update(ctx, inst)
+		if err == nil {
+			return nil
+		}
+		inst.PrivateAddress = ""
+		if err != store.ErrConflict || attempt+1 == addressAttempts {
+			return err
+		}
+	}
+}
+
+// detachNetwork removes the private network device of container ctid on
+// node, so another container of the instance can take its address.
+func (p *Provisioner) detachNetwork(ctx context.Context, inst *models.Instance, node string, ctid int) error {
+	if inst.PrivateAddress == "" {
+		return nil
+	}
+	client, err := p.cluster.Client(ctx, node)
+	if err != nil {
+		return err
+	}
+	if err := client.DeleteInterface(ctx, node, ctid, privnet.InterfaceKey); err != nil {
+		return fmt.Errorf("failed to detach private network: %w", err)
+	}
+	logging.FromContext(ctx).Info("detached private network", "node", node, "ctid", ctid, "address", inst.PrivateAddress)
+	return nil
+}
+
+// moveNetwork moves the private address of inst from one of its
+// containers to another, as it moves between them.
+func (p *Provisioner) moveNetwork(ctx context.Context, inst *models.Instance, fromNode string, fromCTID int, toNode string, toCTID int) error {
+	if err := p.detachNetwork(ctx, inst, fromNode, fromCTID); err != nil {
+		return err
+	}
+	return p.attachNetwork(ctx, inst, toNode, toCTID)
+}
+
+// AddPeer adds a WireGuard peer to the gateway, which then routes it onto
+// its private network. A peer deleted meanwhile is removed again.
+func (p *Provisioner) AddPeer(ctx context.Context, job *models.Job) error {
+	var payload jobs.PeerPayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	if p.gateway == nil {
+		return fmt.Errorf("WireGuard is not configured")
+	}
+
+	peer, err := p.store.WireGuardPeers().Get(ctx, payload.PeerID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	network, err := p.store.PrivateNetworks().GetByOrg(ctx, payload.OrgID)
+	if err != nil {
+		return err
+	}
+	err = p.gateway.PutPeer(ctx, peer.ID, wireguard.GatewayPeer{
+		PublicKey: peer.PublicKey,
+		Address:   peer.Address,
+		Subnet:    network.Subnet,
+		VLAN:      network.VLAN,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add peer to the gateway: %w", err)
+	}
+
+	// The remove_wireguard_peer job may have run before the peer was added
+	if _, err := p.store.WireGuardPeers().Get(ctx, peer.ID); err == store.ErrNotFound {
+		return p.gateway.DeletePeer(ctx, peer.ID)
+	}
+	logging.FromContext(ctx).Info("added WireGuard peer", "peer_id", peer.ID, "address", peer.Address, "vlan", network.VLAN)
+	return nil
+}
+
+// RemovePeer removes a deleted WireGuard peer from the gateway, closing its
+// tunnel.
+func (p *Provisioner) RemovePeer(ctx context.Context, job *models.Job) error {
+	var payload jobs.PeerPayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	if p.gateway == nil {
+		return fmt.Errorf("WireGuard is not configured")
+	}
+	if err := p.gateway.DeletePeer(ctx, payload.PeerID); err != nil {
+		return fmt.Errorf("failed to remove peer from the gateway: %w", err)
+	}
+	logging.FromContext(ctx).Info("removed WireGuard peer", "peer_id", payload.PeerID, "address", payload.Address)
+	return nil
+}
+
+// removePeers removes the WireGuard peers of the private network of orgID
+// from the gateway, before the org and its network are deleted.
+func (p *Provisioner) removePeers(ctx context.Context, orgID string) error {
+	network, err := p.store.PrivateNetworks().GetByOrg(ctx, orgID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	peers, err := p.store.WireGuardPeers().ListByNetwork(ctx, network.ID)
+	if err != nil || len(peers) == 0 {
+		return err
+	}
+	if p.gateway == nil {
+		return fmt.Errorf("WireGuard is not configured")
+	}
+	for _, peer := range peers {
+		if err := p.gateway.DeletePeer(ctx, peer.ID); err != nil {
+			return fmt.Errorf("failed to remove peer from the gateway: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+// Package provisioner runs the jobs that create, resize, upgrade, back up,
+// restore and delete instances on Proxmox. Each instance is an LXC
+// container cloned from the template of its Postgres version, sized by its
+// plan, with a separate volume for the Postgres data directory, and
+// reachable as its network policy allows, and attached to the private
+// network of its org if it has one. Each running instance is named in the
+// instance zone through a DNS provider, which a scheduled job reconciles,
+// and serves a certificate for that name, and the custom domains verified
+// for it, from the configured issuer. Backups and archived WAL go to an
+// object store. It also adds WireGuard peers of private networks to the
+// gateway, and deletes orgs, whose instances have to be torn down first.
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/customdomain"
+	"github.com/zallarak/db/api/internal/dns"
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/netpolicy"
+	"github.com/zallarak/db/api/internal/objectstore"
+	"github.com/zallarak/db/api/internal/pki"
+	"github.com/zallarak/db/api/internal/privnet"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/wireguard"
+	"github.com/zallarak/db/api/internal/worker"
+)
+
+type Provisioner struct {
+	store   store.Store
+	cluster *proxmox.Cluster
+	agents  *guest.Agents
+	objects objectstore.Store
+	network *netpolicy.Compiler
+	privnet *privnet.Allocator
+	// gateway is nil unless WireGuard is configured
+	gateway *wireguard.Gateway
+	// dns is nil if records are only kept in the store
+	dns             dns.Provider
+	dnsCfg          config.DNSConfig
+	// issuer is nil if instances keep their self-signed certificates
+	issuer          pki.Issuer
+	renewBefore     time.Duration
+	verifier        *customdomain.Verifier
+	proxmox         config.ProxmoxConfig
+	rollbackWindow  time.Duration
+	backupRetention int
+	walInterval     time.Duration
+}
+
+func New(st store.Store, cluster *proxmox.Cluster, objects objectstore.Store, provider dns.Provider, issuer pki.Issuer, cfg *config.Config) *Provisioner {
+	var gateway *wireguard.Gateway
+	if cfg.Network.WireGuard.Endpoint != "" {
+		gateway = wireguard.NewGateway(cfg.Network.WireGuard)
+	}
+	return &Provisioner{
+		store:           st,
+		cluster:         cluster,
+		agents:          guest.NewAgents(cfg.Guest, cluster),
+		objects:         objects,
+		network:         netpolicy.NewCompiler(cfg.Network),
+		privnet:         privnet.New(cfg.Network.PrivateNetworks),
+		gateway:         gateway,
+		dns:             provider,
+		dnsCfg:          cfg.DNS,
+		issuer:          issuer,
+		renewBefore:     cfg.TLS.RenewBefore,
+		verifier:        customdomain.NewVerifier(cfg.Domains.Resolver),
+		proxmox:         cfg.Proxmox,
+		rollbackWindow:  cfg.Upgrades.RollbackWindow,
+		backupRetention: cfg.Backups.RetentionDays,
+		walInterval:     cfg.Backups.WALArchiveInterval,
+	}
+}
+
+// Register adds the instance job handlers to w.
+func (p *Provisioner) Register(w *worker.Worker) {
+	w.Handle(jobs.TypeCreateInstance, p.CreateInstance)
+	w.Handle(jobs.TypeDeleteInstance, p.DeleteInstance)
+	w.Handle(jobs.TypeResizeInstance, p.ResizeInstance)
+	w.Handle(jobs.TypeUpgradeInstance, p.UpgradeInstance)
+	w.Handle(jobs.TypeRollbackUpgrade, p.RollbackUpgrade)
+	w.Handle(jobs.TypeFinishUpgrade, p.FinishUpgrade)
+	w.Handle(jobs.TypeBackupInstance, p.BackupInstance)
+	w.Handle(jobs.TypeDeleteBackup, p.DeleteBackup)
+	w.Handle(jobs.TypeArchiveWAL, p.ArchiveWAL)
+	w.Handle(jobs.TypeRestoreInstance, p.RestoreInstance)
+	w.Handle(jobs.TypeApplyNetworkPolicy, p.ApplyNetworkPolicy)
+	w.Handle(jobs.TypeAttachNetwork, p.AttachNetwork)
+	w.Handle(jobs.TypeAddPeer, p.AddPeer)
+	w.Handle(jobs.TypeRemovePeer, p.RemovePeer)
+	w.Handle(jobs.TypeDeleteOrg, p.DeleteOrg)
+	w.Handle(jobs.TypeReconcileDNS, p.ReconcileDNS)
+	w.Handle(jobs.TypeIssueCertificate, p.IssueCertificate)
+	w.Handle(jobs.TypeVerifyDomain, p.VerifyDomain)
+}
+
+// CreateInstance places the instance on a node, clones the template,
+// applies the plan, starts the container, attaches it to the org's private
+// network and, once Postgres is up, sizes its settings for the plan,
+// applies the instance's network policy and publishes its record, then has a certificate issued for it. The
+// chosen node and CTID are saved before
+// cloning, so a job retried after a worker crash continues
+// with the same container instead of leaking one.
+func (p *Provisioner) CreateInstance(ctx context.Context, job *models.Job) error {
+	payload, inst, err := p.load(ctx, job)
+	if err != nil {
+		return err
+	}
+	if inst.Status == models.InstanceDeleting {
+		return fmt.Errorf("instance %s is being deleted", inst.ID)
+	}
+
+	if err := p.provision(ctx, payload, inst); err != nil {
+		p.setStatus(inst, models.InstanceFailed)
+		return err
+	}
+	return nil
+}
+
+func (p *Provisioner) provision(ctx context.Context, payload jobs.InstancePayload, inst *models.Instance) error {
+	if err := p.startInstance(ctx, inst); err != nil {
+		return err
+	}
+	if err := p.attachNetwork(ctx, inst, inst.Node, inst.CTID); err != nil {
+		return err
+	}
+	agent, err := p.waitForAgent(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return err
+	}
+	if err := p.applySettings(ctx, inst, agent); err != nil {
+		return err
+	}
+	if err := p.applyNetworkPolicy(ctx, inst, inst.Node, inst.CTID, agent); err != nil {
+		return err
+	}
+	if err := p.publishRecord(ctx, inst); err != nil {
+		return err
+	}
+	inst.Status = models.InstanceRunning
+	// The certificate job skips instances that aren't running yet
+	return p.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Instances().Update(ctx, inst); err != nil {
+			return err
+		}
+		return p.enqueueCertificate(ctx, tx.Jobs(), inst, payload.OrgID)
+	})
+}
+
+// startInstance places, clones and starts the container of inst, leaving
+// it provisioning.
+func (p *Provisioner) startInstance(ctx context.Context, inst *models.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	plan, err := p.store.Plans().Get(ctx, inst.Plan)
+	if err != nil {
+		return fmt.Errorf("failed to get plan %q: %w", inst.Plan, err)
+	}
+	inst.Status = models.InstanceProvisioning
+	if err := p.store.Instances().Update(ctx, inst); err != nil {
+		return err
+	}
+
+	var client *proxmox.Client
+	if inst.Node == "" || inst.CTID == 0 {
+		c, node, err := p.cluster.Place(ctx, int64(plan.MemoryMB)<<20)
+		if err != nil {
+			return err
+		}
+		ctid, err := c.NextID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to allocate container ID: %w", err)
+		}
+		client, inst.Node, inst.CTID = c, node.Node, ctid
+		if err := p.store.Instances().Update(ctx, inst); err != nil {
+			return err
+		}
+
+		if err := p.cloneContainer(ctx, client, inst, inst.PgVersion, inst.Node, inst.CTID, plan, inst.DiskGiB); err != nil {
+			return err
+		}
+	} else {
+		c, err := p.cluster.Client(ctx, inst.Node)
+		if err != nil {
+			return err
+		}
+		client = c
+		logger.Info("resuming provisioning", "node", inst.Node, "ctid", inst.CTID)
+	}
+
+	status, err := client.ContainerStatus(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return fmt.Errorf("failed to get container status: %w", err)
+	}
+	if status != "running" {
+		task, err := client.StartContainer(ctx, inst.Node, inst.CTID)
+		if err != nil {
+			return fmt.Errorf("failed to start container: %w", err)
+		}
+		if err := client.WaitTask(ctx, task); err != nil {
+			return fmt.Errorf("failed to start container: %w", err)
+		}
+	}
+	return nil
+}
+
+// cloneContainer clones the template of Postgres version as ctid on node
+// and sizes it for inst.
+func (p *Provisioner) cloneContainer(ctx context.Context, client *proxmox.Client, inst *models.Instance, version int, node string, ctid int, plan *models.Plan, diskGiB int) error {
+	template := p.proxmox.TemplateFor(version)
+	logging.FromContext(ctx).Info("cloning container", "node", node, "ctid", ctid, "template", template)
+	task, err := client.CloneContainer(ctx, template, ctid, node, hostname(inst), p.proxmox.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to clone template: %w", err)
+	}
+	if err := client.WaitTask(ctx, task); err != nil {
+		return fmt.Errorf("failed to clone template: %w", err)
+	}
+
+	err = client.ConfigureContainer(ctx, node, ctid, proxmox.ContainerConfig{
+		Cores:      plan.VCPUs,
+		MemoryMB:   plan.MemoryMB,
+		DataVolume: fmt.Sprintf("%s:%d", p.proxmox.Storage, diskGiB),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure container: %w", err)
+	}
+	return nil
+}
+
+// planSettings sizes the settings of Postgres for plan: a quarter of the
+// memory for shared buffers, leaving the rest to the page cache, which the
+// planner is told about, and to sessions.
+func planSettings(plan *models.Plan) guest.Settings {
+	return guest.Settings{
+		MaxConnections:       plan.MaxConnections,
+		SharedBuffersMB:      plan.MemoryMB / 4,
+		EffectiveCacheSizeMB: plan.MemoryMB * 3 / 4,
+		MaintenanceWorkMemMB: min(plan.MemoryMB/16, 2048),
+	}
+}
+
+// applySettings sizes the Postgres of inst served by agent for its plan,
+// restarting it if it needs to.
+func (p *Provisioner) applySettings(ctx context.Context, inst *models.Instance, agent *guest.Client) error {
+	plan, err := p.store.Plans().Get(ctx, inst.Plan)
+	if err != nil {
+		return fmt.Errorf("failed to get plan %q: %w", inst.Plan, err)
+	}
+	return setSettings(ctx, agent, plan)
+}
+
+// setSettings sizes the Postgres served by agent for plan.
+func setSettings(ctx context.Context, agent *guest.Client, plan *models.Plan) error {
+	if err := agent.SetSettings(ctx, planSettings(plan)); err != nil {
+		return fmt.Errorf("failed to apply the settings of plan %s: %w", plan.Name, err)
+	}
+	return nil
+}
+
+// DeleteInstance stops and destroys the container, along with the other
+// container of an upgrade in progress or within its rollback window,
+// deletes the instance's backups and archived WAL, unpublishes its record
+// and then removes the instance. A container that is already gone is not an error.
+func (p *Provisioner) DeleteInstance(ctx context.Context, job *models.Job) error {
+	_, inst, err := p.load(ctx, job)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	upgrades, err := p.store.Upgrades().ListByInstance(ctx, inst.ID)
+	if err != nil {
+		return err
+	}
+	for _, u := range upgrades {
+		if u.Status == models.UpgradeFinished || u.Status == models.UpgradeRolledBack || u.Status == models.UpgradeFailed {
+			continue
+		}
+		for _, ct := range []struct {
+			node string
+			ctid int
+		}{{u.BlueNode, u.BlueCTID}, {u.GreenNode, u.GreenCTID}} {
+			if ct.ctid == 0 || (ct.node == inst.Node && ct.ctid == inst.CTID) {
+				continue
+			}
+			if err := p.destroy(ctx, ct.node, ct.ctid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if inst.Node != "" && inst.CTID != 0 {
+		if err := p.destroy(ctx, inst.Node, inst.CTID); err != nil {
+			return err
+		}
+	}
+	if err := p.deleteBackups(ctx, inst); err != nil {
+		return err
+	}
+	if err := p.unpublishRecord(ctx, inst); err != nil {
+		return err
+	}
+
+	err = p.store.Instances().Delete(ctx, inst.ID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// destroy stops and destroys container ctid on node, if it exists.
+func (p *Provisioner) destroy(ctx context.Context, node string, ctid int) error {
+	client, err := p.cluster.Client(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	status, err := client.ContainerStatus(ctx, node, ctid)
+	if proxmox.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get container status: %w", err)
+	}
+
+	if status == "running" {
+		task, err := client.StopContainer(ctx, node, ctid)
+		if err != nil {
+			return fmt.Errorf("failed to stop container: %w", err)
+		}
+		if err := client.WaitTask(ctx, task); err != nil {
+			return fmt.Errorf("failed to stop container: %w", err)
+		}
+	}
+
+	logging.FromContext(ctx).Info("destroying container", "node", node, "ctid", ctid)
+	task, err := client.DeleteContainer(ctx, node, ctid)
+	if proxmox.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to destroy container: %w", err)
+	}
+	if err := client.WaitTask(ctx, task); err != nil {
+		return fmt.Errorf("failed to destroy container: %w", err)
+	}
+	return nil
+}
+
+// DeleteOrg waits for the delete_instance jobs enqueued with the org job,
+// then removes the org with its projects and memberships. It refuses if any
+// of those jobs failed or the org still has instances, such as ones created
+// while the deletion was queued, so no container is left running without a
+// record.
+func (p *Provisioner) DeleteOrg(ctx context.Context, job *models.Job) error {
+	var payload jobs.OrgPayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, orgDeleteTimeout)
+	defer cancel()
+	for _, id := range payload.InstanceJobs {
+		if err := p.waitForJob(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	instances, err := p.store.Instances().ListByOrg(ctx, payload.OrgID)
+	if err != nil {
+		return err
+	}
+	if len(instances) > 0 {
+		return fmt.Errorf("organization still has %d instance(s)", len(instances))
+	}
+	if err := p.removePeers(ctx, payload.OrgID); err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("deleting organization", "org_id", payload.OrgID)
+	err = p.store.Orgs().Delete(ctx, payload.OrgID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+const (
+	// orgDeleteTimeout bounds how long DeleteOrg waits for instance jobs.
+	orgDeleteTimeout = 30 * time.Minute
+	// jobPollInterval is how often waitForJob checks on a job.
+	jobPollInterval = time.Second
+)
+
+// waitForJob polls the job with id until it finishes, returning an error
+// unless it completed. The jobs DeleteOrg waits on are enqueued before it
+// and jobs are claimed oldest first, so they are never stuck behind it.
+func (p *Provisioner) waitForJob(ctx context.Context, id string) error {
+	for {
+		job, err := p.store.Jobs().Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to get job %s: %w", id, err)
+		}
+		switch job.Status {
+		case jobs.StatusCompleted:
+			return nil
+		case jobs.StatusFailed, jobs.StatusCancelled:
+			return fmt.Errorf("job %s %s: %s", job.Type, job.Status, job.ErrorMessage)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for job %s: %w", id, ctx.Err())
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+func (p *Provisioner) load(ctx context.Context, job *models.Job) (jobs.InstancePayload, *models.Instance, error) {
+	var payload jobs.InstancePayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return payload, nil, fmt.Errorf("invalid job payload: %w", err)
+	}
+	inst, err := p.store.Instances().Get(ctx, payload.InstanceID)
+	if err != nil {
+		return payload, nil, err
+	}
+	return payload, inst, nil
+}
+
+// setStatus records status even when ctx was cancelled by shutdown, so a
+// failed instance isn't left looking like it's still provisioning.
+func (p *Provisioner) setStatus(inst *models.Instance, status string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inst.Status = status
+	p.store.Instances().Update(ctx, inst)
+}
+
+func hostname(inst *models.Instance) string {
+	return dns.Hostname(inst.ID)
+}
@@ -0,0 +1,220 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/proxmox"
+)
+
+// dataVolume is the container volume holding the Postgres data directory.
+const dataVolume = "mp0"
+
+// ResizeInstance moves the instance to the plan and disk size of the job.
+// Nothing changes unless the node has room for the new plan and disk. The
+// volume grows first, since it can't be undone; then the CPU and memory
+// limits of the container change and the guest agent sizes Postgres for the
+// plan, restarting Postgres only if it needs to. If those fail, the old plan
+// is put back. The instance then returns to the status it had before, even
+// when the resize fails.
+func (p *Provisioner) ResizeInstance(ctx context.Context, job *models.Job) error {
+	var payload jobs.ResizePayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	inst, err := p.store.Instances().Get(ctx, payload.InstanceID)
+	if err != nil {
+		return err
+	}
+	if inst.Status != models.InstanceResizing {
+		return fmt.Errorf("instance %s is %s, not resizing", inst.ID, inst.Status)
+	}
+
+	client, err := p.cluster.Client(ctx, inst.Node)
+	if err != nil {
+		return err
+	}
+	resizeErr := p.resize(ctx, client, payload, inst)
+	if err := p.settle(ctx, client, payload, inst); err != nil && resizeErr == nil {
+		return err
+	}
+	return resizeErr
+}
+
+func (p *Provisioner) resize(ctx context.Context, client *proxmox.Client, payload jobs.ResizePayload, inst *models.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	from, err := p.store.Plans().Get(ctx, inst.Plan)
+	if err != nil {
+		return fmt.Errorf("failed to get plan %q: %w", inst.Plan, err)
+	}
+	to, err := p.store.Plans().Get(ctx, payload.Plan)
+	if err != nil {
+		return fmt.Errorf("failed to get plan %q: %w", payload.Plan, err)
+	}
+	if payload.DiskGiB < inst.DiskGiB {
+		return fmt.Errorf("the disk can't shrink from %d to %d GiB", inst.DiskGiB, payload.DiskGiB)
+	}
+
+	status, err := client.ContainerStatus(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return fmt.Errorf("failed to get container status: %w", err)
+	}
+	running := status == "running"
+	if err := p.checkHeadroom(ctx, client, inst, from, to, running, payload.DiskGiB-inst.DiskGiB); err != nil {
+		return err
+	}
+
+	if payload.DiskGiB > inst.DiskGiB {
+		logger.Info("growing data volume", "node", inst.Node, "ctid", inst.CTID, "disk_gib", payload.DiskGiB)
+		task, err := client.ResizeVolume(ctx, inst.Node, inst.CTID, dataVolume, payload.DiskGiB)
+		if err != nil {
+			return fmt.Errorf("failed to grow data volume: %w", err)
+		}
+		if err := client.WaitTask(ctx, task); err != nil {
+			return fmt.Errorf("failed to grow data volume: %w", err)
+		}
+		// The disk stays grown whatever happens next
+		inst.DiskGiB = payload.DiskGiB
+	}
+	if to.Name == from.Name {
+		return nil
+	}
+
+	logger.Info("resizing container", "node", inst.Node, "ctid", inst.CTID, "plan", to.Name)
+	if err := p.applyPlan(ctx, client, inst, from, to, running); err != nil {
+		logger.Error("failed to resize container, putting back its plan", "plan", from.Name, "error", err)
+		if err := p.applyPlan(ctx, client, inst, to, from, running); err != nil {
+			logger.Error("failed to put back the plan of the container", "plan", from.Name, "error", err)
+		}
+		return err
+	}
+	inst.Plan = to.Name
+	return nil
+}
+
+// applyPlan moves the container of inst and its Postgres from one plan to
+// the other. Postgres is sized down before the memory limit shrinks and up
+// after it grows, so it never asks for more memory than the container has.
+// A stopped container is started for its agent to apply the settings, then
+// stopped again.
+func (p *Provisioner) applyPlan(ctx context.Context, client *proxmox.Client, inst *models.Instance, from, to *models.Plan, running bool) error {
+	settings := func() error {
+		agent, err := p.waitForAgent(ctx, inst.Node, inst.CTID)
+		if err != nil {
+			return err
+		}
+		return setSettings(ctx, agent, to)
+	}
+	configure := func() error {
+		err := client.ConfigureContainer(ctx, inst.Node, inst.CTID, proxmox.ContainerConfig{
+			Cores:    to.VCPUs,
+			MemoryMB: to.MemoryMB,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to configure container: %w", err)
+		}
+		return nil
+	}
+	if !running {
+		if err := configure(); err != nil {
+			return err
+		}
+		if err := p.setContainerStatus(ctx, client, inst.Node, inst.CTID, "start"); err != nil {
+			return err
+		}
+		err := settings()
+		if stopErr := p.setContainerStatus(ctx, client, inst.Node, inst.CTID, "stop"); err == nil {
+			err = stopErr
+		}
+		return err
+	}
+
+	if to.MemoryMB < from.MemoryMB {
+		if err := settings(); err != nil {
+			return err
+		}
+		return configure()
+	}
+	if err := configure(); err != nil {
+		return err
+	}
+	return settings()
+}
+
+// checkHeadroom fails unless the node of inst has the memory, CPUs and
+// storage to move it from one plan to the other and grow its disk by
+// growGiB. A running container's memory is already counted as in use.
+func (p *Provisioner) checkHeadroom(ctx context.Context, client *proxmox.Client, inst *models.Instance, from, to *models.Plan, running bool, growGiB int) error {
+	node, err := client.Node(ctx, inst.Node)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", inst.Node, err)
+	}
+	need := int64(to.MemoryMB) << 20
+	if running {
+		need -= int64(from.MemoryMB) << 20
+	}
+	if need > node.FreeMemory() {
+		return fmt.Errorf("node %s has %d MiB of memory free, the %s plan needs %d MiB more", inst.Node, node.FreeMemory()>>20, to.Name, need>>20)
+	}
+	if to.VCPUs > node.MaxCPU {
+		return fmt.Errorf("node %s has %d CPUs, fewer than the %d of the %s plan", inst.Node, node.MaxCPU, to.VCPUs, to.Name)
+	}
+
+	if growGiB > 0 {
+		storage, err := client.StorageStatus(ctx, inst.Node, p.proxmox.Storage)
+		if err != nil {
+			return fmt.Errorf("failed to get storage %s on node %s: %w", p.proxmox.Storage, inst.Node, err)
+		}
+		if int64(growGiB)<<30 > storage.Avail {
+			return fmt.Errorf("storage %s on node %s has %d GiB available, the disk needs %d GiB more", p.proxmox.Storage, inst.Node, storage.Avail>>30, growGiB)
+		}
+	}
+	return nil
+}
+
+// settle puts the container back in the state it was in before the resize,
+// starting it if a failed resize left it stopped, and saves the instance with that status.
+func (p *Provisioner) settle(ctx context.Context, client *proxmox.Client, payload jobs.ResizePayload, inst *models.Instance) error {
+	var err error
+	if payload.Status == models.InstanceRunning {
+		var status string
+		status, err = client.ContainerStatus(ctx, inst.Node, inst.CTID)
+		if err == nil && status != "running" {
+			err = p.setContainerStatus(ctx, client, inst.Node, inst.CTID, "start")
+		}
+	}
+
+	// The instance may have been deleted meanwhile; leave it to its job then
+	current, getErr := p.store.Instances().Get(ctx, inst.ID)
+	if getErr != nil || current.Status != models.InstanceResizing {
+		return err
+	}
+	status := payload.Status
+	if err != nil {
+		status = models.InstanceFailed
+	}
+	p.setStatus(inst, status)
+	return err
+}
+
+// setContainerStatus starts or stops container ctid on node and waits for
+// it.
+func (p *Provisioner) setContainerStatus(ctx context.Context, client *proxmox.Client, node string, ctid int, action string) error {
+	change := client.StartContainer
+	if action == "stop" {
+		change = client.StopContainer
+	}
+	task, err := change(ctx, node, ctid)
+	if err != nil {
+		return fmt.Errorf("failed to %s container: %w", action, err)
+	}
+	if err := client.WaitTask(ctx, task); err != nil {
+		return fmt.Errorf("failed to %s container: %w", action, err)
+	}
+	return nil
+}
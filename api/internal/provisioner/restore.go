@@ -0,0 +1,174 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/pglsn"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// Restore steps, reported as the progress of the restore job
+const (
+	stepRestoring  = "restoring"
+	stepFetching   = "fetching_wal"
+	stepRecovering = "recovering"
+	stepRestored   = "restored"
+)
+
+// RestoreInstance provisions an instance created by a restore, as
+// CreateInstance does, then restores the backup it came from into it
+// through the guest agent. With a target time or LSN, the archived WAL of
+// the source instance is replayed up to the target; without one Postgres
+// recovers to the end of the backup. The instance's own network policy then
+// replaces the one restored with the data, and its record is published.
+// Where recovery stopped is recorded in the instance's RestoredFrom. A job
+// retried after a worker crash restores into the same container again.
+func (p *Provisioner) RestoreInstance(ctx context.Context, job *models.Job) error {
+	_, inst, err := p.load(ctx, job)
+	if err != nil {
+		return err
+	}
+	if inst.Status == models.InstanceDeleting {
+		return fmt.Errorf("instance %s is being deleted", inst.ID)
+	}
+	if inst.RestoredFrom == nil {
+		return fmt.Errorf("instance %s has nothing to restore from", inst.ID)
+	}
+
+	p.progress(ctx, job, stepProvisioning, 0, "Provisioning a container with PostgreSQL %d", inst.PgVersion)
+	if err := p.startInstance(ctx, inst); err != nil {
+		p.setStatus(inst, models.InstanceFailed)
+		return err
+	}
+	if err := p.restore(ctx, job, inst); err != nil {
+		p.setStatus(inst, models.InstanceFailed)
+		return err
+	}
+	return nil
+}
+
+func (p *Provisioner) restore(ctx context.Context, job *models.Job, inst *models.Instance) error {
+	src := inst.RestoredFrom
+	backup, err := p.store.Backups().Get(ctx, src.BackupID)
+	if err == store.ErrNotFound {
+		return fmt.Errorf("backup %s no longer exists", src.BackupID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := p.attachNetwork(ctx, inst, inst.Node, inst.CTID); err != nil {
+		return err
+	}
+	agent, err := p.waitForAgent(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return err
+	}
+
+	p.progress(ctx, job, stepRestoring, 20, "Restoring backup %s", backup.ID)
+	archive, err := p.objects.Get(ctx, backupKey(backup))
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	err = agent.RestoreBaseBackup(ctx, archive)
+	archive.Close()
+	if err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	if src.TargetTime != nil || src.TargetLSN != "" {
+		segments, err := p.walToReplay(ctx, backup, src)
+		if err != nil {
+			return err
+		}
+		for i, seg := range segments {
+			p.progress(ctx, job, stepFetching, 40+40*i/len(segments), "Fetching WAL segment %d of %d", i+1, len(segments))
+			if err := p.fetchSegment(ctx, agent, &seg); err != nil {
+				return err
+			}
+		}
+	}
+
+	target := "the end of the backup"
+	switch {
+	case src.TargetTime != nil:
+		target = src.TargetTime.Format(time.RFC3339)
+	case src.TargetLSN != "":
+		target = src.TargetLSN
+	}
+	p.progress(ctx, job, stepRecovering, 80, "Recovering to %s", target)
+	point, err := agent.Recover(ctx, guest.RecoveryTarget{Time: src.TargetTime, LSN: src.TargetLSN})
+	if err != nil {
+		return fmt.Errorf("failed to recover: %w", err)
+	}
+
+	// The restored data directory has the settings and pg_hba.conf of the
+	// source
+	if err := p.applySettings(ctx, inst, agent); err != nil {
+		return err
+	}
+	if err := p.applyNetworkPolicy(ctx, inst, inst.Node, inst.CTID, agent); err != nil {
+		return err
+	}
+
+	if err := p.publishRecord(ctx, inst); err != nil {
+		return err
+	}
+
+	src.RecoveredLSN, src.RecoveredTime = point.LSN, point.Time
+	inst.Status = models.InstanceRunning
+	err = p.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Instances().Update(ctx, inst); err != nil {
+			return err
+		}
+		return p.enqueueCertificate(ctx, tx.Jobs(), inst, jobs.OrgID(job))
+	})
+	if err != nil {
+		return err
+	}
+	p.progress(ctx, job, stepRestored, 100, "Recovered to LSN %s", point.LSN)
+	return nil
+}
+
+// walToReplay returns the archived segments of the source instance from
+// the start of backup up to and including the first that reaches the
+// target of src.
+func (p *Provisioner) walToReplay(ctx context.Context, backup *models.Backup, src *models.RestoreSource) ([]models.WALSegment, error) {
+	segments, err := p.store.WALSegments().ListByInstance(ctx, src.InstanceID, backup.StartLSN)
+	if err != nil {
+		return nil, err
+	}
+	var target pglsn.LSN
+	if src.TargetLSN != "" {
+		if target, err = pglsn.Parse(src.TargetLSN); err != nil {
+			return nil, err
+		}
+	}
+	for i, seg := range segments {
+		end, err := pglsn.Parse(seg.EndLSN)
+		if err != nil {
+			return nil, err
+		}
+		if src.TargetTime != nil && !seg.EndTime.Before(*src.TargetTime) || src.TargetLSN != "" && end >= target {
+			return segments[:i+1], nil
+		}
+	}
+	return segments, nil
+}
+
+func (p *Provisioner) fetchSegment(ctx context.Context, agent *guest.Client, seg *models.WALSegment) error {
+	r, err := p.objects.Get(ctx, walKey(seg.InstanceID, seg.Name))
+	if err != nil {
+		return fmt.Errorf("failed to read WAL segment %s: %w", seg.Name, err)
+	}
+	defer r.Close()
+	if err := agent.RestoreWALSegment(ctx, seg.Name, r); err != nil {
+		return fmt.Errorf("failed to restore WAL segment %s: %w", seg.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// IssueCertificate has the instance's container generate a key, gets a
+// certificate for it, the instance's FQDN and its verified custom domains
+// from the issuer and installs it, replacing the self-signed certificate of
+// the template or the one before. It is enqueued once an instance is
+// provisioned, restored, upgraded or rolled back, when its custom domains
+// change, and by the scheduler ahead of expiry. Instances
+// that aren't running are skipped; the scheduler retries their renewal.
+func (p *Provisioner) IssueCertificate(ctx context.Context, job *models.Job) error {
+	logger := logging.FromContext(ctx)
+
+	_, inst, err := p.load(ctx, job)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.issuer == nil {
+		logger.Info("skipping certificate", "reason", "tls.issuer is none")
+		return nil
+	}
+	if inst.Status != models.InstanceRunning {
+		logger.Info("skipping certificate", "reason", "instance is "+inst.Status)
+		return nil
+	}
+	if inst.FQDN == "" {
+		return fmt.Errorf("instance %s has no FQDN to certify", inst.ID)
+	}
+
+	domains, err := p.domainNames(ctx, inst)
+	if err != nil {
+		return err
+	}
+	dnsNames := append([]string{inst.FQDN}, domains...)
+	agent, err := p.agents.For(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return err
+	}
+	csr, err := agent.CertificateRequest(ctx, dnsNames)
+	if err != nil {
+		return fmt.Errorf("failed to get certificate request: %w", err)
+	}
+	cert, err := p.issuer.Issue(ctx, csr, dnsNames)
+	if err != nil {
+		return fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	if err := agent.InstallCertificate(ctx, cert.ChainPEM); err != nil {
+		return fmt.Errorf("failed to install certificate: %w", err)
+	}
+
+	err = p.store.Certificates().Put(ctx, &models.Certificate{
+		InstanceID:     inst.ID,
+		Issuer:         p.issuer.Name(),
+		Serial:         cert.Serial,
+		DNSNames:       cert.DNSNames,
+		NotBefore:      cert.NotBefore,
+		NotAfter:       cert.NotAfter,
+		RenewAt:        cert.RenewAt(p.renewBefore),
+		CertificatePEM: string(cert.ChainPEM),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("installed certificate", "issuer", p.issuer.Name(), "serial", cert.Serial, "dns_names", cert.DNSNames, "not_after", cert.NotAfter)
+	return nil
+}
+
+// enqueueCertificate enqueues an issue_certificate job for inst on q,
+// unless instances keep their self-signed certificates.
+func (p *Provisioner) enqueueCertificate(ctx context.Context, q store.Jobs, inst *models.Instance, orgID string) error {
+	if p.issuer == nil {
+		return nil
+	}
+	_, err := jobs.NewQueue(q).Enqueue(ctx, jobs.TypeIssueCertificate, jobs.InstancePayload{
+		InstanceID: inst.ID,
+		OrgID:      orgID,
+	})
+	return err
+}
@@ -0,0 +1,621 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/proxmox"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+const (
+	// agentTimeout bounds how long a started container's agent has to
+	// report Postgres ready.
+	agentTimeout = 5 * time.Minute
+	// catchUpLag is the replication lag, in bytes, below which blue is
+	// made read-only for the cutover; writes then wait for green to
+	// apply the rest.
+	catchUpLag = 16 << 20
+	// cleanupTimeout bounds putting things back after a failed upgrade or
+	// rollback, which runs even when the job was cancelled.
+	cleanupTimeout = 5 * time.Minute
+)
+
+// Upgrade steps, reported as the progress of the upgrade job
+const (
+	stepProvisioning = "provisioning"
+	stepCopying      = "copying"
+	stepCatchingUp   = "catching_up"
+	stepCuttingOver  = "cutting_over"
+	stepVerifying    = "verifying"
+	stepCutOver      = "cut_over"
+)
+
+// UpgradeInstance moves the instance to a newer Postgres major version,
+// blue/green. A green container is cloned from the template of the new
+// version and subscribes to a logical replication publication of blue, the
+// instance's container. Once green has caught up, blue is made read-only,
+// green applies the last changes and the tables of both are compared. The
+// instance then moves to green, its record is pointed at green, and blue
+// is stopped and kept until the rollback window closes, when a
+// finish_upgrade job destroys it.
+//
+// Until the cutover, a failure leaves the instance running on blue and
+// destroys green. Green's node and CTID are saved before cloning, so a job
+// retried after a worker crash continues with the same container.
+func (p *Provisioner) UpgradeInstance(ctx context.Context, job *models.Job) error {
+	inst, upgrade, err := p.loadUpgrade(ctx, job)
+	if err != nil {
+		return err
+	}
+	if upgrade.Status != models.UpgradeRunning {
+		return fmt.Errorf("upgrade %s is %s, not running", upgrade.ID, upgrade.Status)
+	}
+	if inst.Status != models.InstanceUpgrading {
+		return fmt.Errorf("instance %s is %s, not upgrading", inst.ID, inst.Status)
+	}
+
+	cutOver, err := p.upgrade(ctx, job, inst, upgrade)
+	if err != nil && !cutOver {
+		p.abortUpgrade(ctx, inst, upgrade)
+	}
+	return err
+}
+
+// upgrade runs the steps of UpgradeInstance, reporting whether the
+// instance was cut over to green.
+func (p *Provisioner) upgrade(ctx context.Context, job *models.Job, inst *models.Instance, upgrade *models.Upgrade) (bool, error) {
+	logger := logging.FromContext(ctx)
+
+	// A new upgrade ends the rollback window of the one before
+	previous, err := p.store.Upgrades().ListByInstance(ctx, inst.ID)
+	if err != nil {
+		return false, err
+	}
+	for i := range previous {
+		if previous[i].ID != upgrade.ID && previous[i].Status == models.UpgradeCutOver {
+			if err := p.finishUpgrade(ctx, jobs.OrgID(job), &previous[i]); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	p.progress(ctx, job, stepProvisioning, 0, "Provisioning a container with PostgreSQL %d", upgrade.ToVersion)
+	green, err := p.provisionGreen(ctx, inst, upgrade)
+	if err != nil {
+		return false, err
+	}
+	blue, err := p.agents.For(ctx, upgrade.BlueNode, upgrade.BlueCTID)
+	if err != nil {
+		return false, err
+	}
+
+	p.progress(ctx, job, stepCopying, 20, "Copying tables")
+	name := publicationName(upgrade)
+	pub, err := blue.CreatePublication(ctx, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to publish tables: %w", err)
+	}
+	if err := green.CreateSubscription(ctx, name, pub); err != nil {
+		return false, fmt.Errorf("failed to subscribe to tables: %w", err)
+	}
+	err = p.poll(ctx, func() (bool, error) {
+		sub, err := green.Subscription(ctx, name)
+		if err != nil {
+			return false, fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if sub.State == guest.SubscriptionStreaming {
+			return true, nil
+		}
+		percent := 20
+		if sub.TablesTotal > 0 {
+			percent += 50 * sub.TablesCopied / sub.TablesTotal
+		}
+		p.progress(ctx, job, stepCopying, percent, "Copied %d of %d tables", sub.TablesCopied, sub.TablesTotal)
+		return false, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	p.progress(ctx, job, stepCatchingUp, 70, "Applying changes made during the copy")
+	if err := p.waitForLag(ctx, green, name, catchUpLag); err != nil {
+		return false, err
+	}
+
+	p.progress(ctx, job, stepCuttingOver, 80, "Making PostgreSQL %d read-only and applying the last changes", upgrade.FromVersion)
+	if err := blue.SetReadOnly(ctx, true); err != nil {
+		return false, fmt.Errorf("failed to make the instance read-only: %w", err)
+	}
+	if err := p.waitForLag(ctx, green, name, 0); err != nil {
+		return false, err
+	}
+	if err := green.FinishSubscription(ctx, name); err != nil {
+		return false, fmt.Errorf("failed to finish subscription: %w", err)
+	}
+
+	p.progress(ctx, job, stepVerifying, 90, "Comparing tables")
+	if err := verifyCopy(ctx, blue, green); err != nil {
+		return false, err
+	}
+	if err := p.moveNetwork(ctx, inst, upgrade.BlueNode, upgrade.BlueCTID, upgrade.GreenNode, upgrade.GreenCTID); err != nil {
+		return false, err
+	}
+
+	rollbackUntil, err := p.cutOver(ctx, job, inst, upgrade)
+	if err != nil {
+		return false, err
+	}
+
+	// Blue only has to stay around, stopped; failing to tidy it is logged
+	if err := blue.DropPublication(ctx, name); err != nil {
+		logger.Warn("failed to drop upgrade publication", "error", err)
+	}
+	if err := p.stopContainer(ctx, upgrade.BlueNode, upgrade.BlueCTID); err != nil {
+		logger.Warn("failed to stop the old container", "node", upgrade.BlueNode, "ctid", upgrade.BlueCTID, "error", err)
+	}
+	p.progress(ctx, job, stepCutOver, 100, "Upgraded to PostgreSQL %d; can be rolled back until %s", upgrade.ToVersion, rollbackUntil.Format(time.RFC3339))
+	return true, nil
+}
+
+// provisionGreen clones and starts the green container of upgrade, applies
+// the instance's network policy to it and returns its agent once Postgres
+// is ready.
+func (p *Provisioner) provisionGreen(ctx context.Context, inst *models.Instance, upgrade *models.Upgrade) (*guest.Client, error) {
+	var client *proxmox.Client
+	if upgrade.GreenCTID == 0 {
+		plan, err := p.store.Plans().Get(ctx, inst.Plan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get plan %q: %w", inst.Plan, err)
+		}
+		c, node, err := p.cluster.Place(ctx, int64(plan.MemoryMB)<<20)
+		if err != nil {
+			return nil, err
+		}
+		ctid, err := c.NextID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate container ID: %w", err)
+		}
+		client, upgrade.GreenNode, upgrade.GreenCTID = c, node.Node, ctid
+		if err := p.store.Upgrades().Update(ctx, upgrade); err != nil {
+			return nil, err
+		}
+		if err := p.cloneContainer(ctx, client, inst, upgrade.ToVersion, upgrade.GreenNode, upgrade.GreenCTID, plan, inst.DiskGiB); err != nil {
+			return nil, err
+		}
+	} else {
+		c, err := p.cluster.Client(ctx, upgrade.GreenNode)
+		if err != nil {
+			return nil, err
+		}
+		client = c
+		logging.FromContext(ctx).Info("resuming upgrade", "node", upgrade.GreenNode, "ctid", upgrade.GreenCTID)
+	}
+
+	if err := p.startContainer(ctx, client, upgrade.GreenNode, upgrade.GreenCTID); err != nil {
+		return nil, err
+	}
+	green, err := p.waitForAgent(ctx, upgrade.GreenNode, upgrade.GreenCTID)
+	if err != nil {
+		return nil, err
+	}
+	status, err := green.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PostgreSQL status: %w", err)
+	}
+	if status.PgVersion != upgrade.ToVersion {
+		return nil, fmt.Errorf("template %d runs PostgreSQL %d, not %d", p.proxmox.TemplateFor(upgrade.ToVersion), status.PgVersion, upgrade.ToVersion)
+	}
+	if err := p.applySettings(ctx, inst, green); err != nil {
+		return nil, err
+	}
+	if err := p.applyNetworkPolicy(ctx, inst, upgrade.GreenNode, upgrade.GreenCTID, green); err != nil {
+		return nil, err
+	}
+	return green, nil
+}
+
+// cutOver points the instance's name at green, moves the instance to green
+// and starts the rollback window, returning when it closes. The name moves
+// first, so the instance never runs on green under a name pointing at
+// blue; if the cutover then fails, abortUpgrade points it back. It fails if
+// the instance was deleted meanwhile.
+func (p *Provisioner) cutOver(ctx context.Context, job *models.Job, inst *models.Instance, upgrade *models.Upgrade) (time.Time, error) {
+	green := *inst
+	green.Node, green.CTID = upgrade.GreenNode, upgrade.GreenCTID
+	if err := p.publishRecord(ctx, &green); err != nil {
+		return time.Time{}, fmt.Errorf("failed to point the instance's name at the upgraded container: %w", err)
+	}
+
+	now := time.Now()
+	rollbackUntil := now.Add(p.rollbackWindow)
+	err := p.store.InTx(ctx, func(tx store.Store) error {
+		current, err := tx.Instances().Get(ctx, inst.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.InstanceUpgrading {
+			return fmt.Errorf("instance %s is %s, not upgrading", inst.ID, current.Status)
+		}
+		current.Node, current.CTID, current.PgVersion = upgrade.GreenNode, upgrade.GreenCTID, upgrade.ToVersion
+		current.FQDN = green.FQDN
+		current.Status = models.InstanceRunning
+		if err := tx.Instances().Update(ctx, current); err != nil {
+			return err
+		}
+
+		upgrade.Status = models.UpgradeCutOver
+		upgrade.CutOverAt, upgrade.RollbackUntil = &now, &rollbackUntil
+		if err := tx.Upgrades().Update(ctx, upgrade); err != nil {
+			return err
+		}
+		_, err = jobs.NewQueue(tx.Jobs()).EnqueueAt(ctx, jobs.TypeFinishUpgrade, jobs.UpgradePayload{
+			InstanceID: inst.ID,
+			OrgID:      jobs.OrgID(job),
+			UpgradeID:  upgrade.ID,
+		}, rollbackUntil)
+		if err != nil {
+			return err
+		}
+		// Green starts with the template's self-signed certificate
+		if err := p.enqueueCertificate(ctx, tx.Jobs(), current, jobs.OrgID(job)); err != nil {
+			return err
+		}
+		*inst = *current
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to cut over: %w", err)
+	}
+	logging.FromContext(ctx).Info("cut over to upgraded container", "node", inst.Node, "ctid", inst.CTID, "pg_version", inst.PgVersion)
+	return rollbackUntil, nil
+}
+
+// abortUpgrade puts the instance back the way it was before a failed
+// upgrade: blue writable and on the private network, green destroyed and
+// the instance running, unless it is being deleted.
+func (p *Provisioner) abortUpgrade(ctx context.Context, inst *models.Instance, upgrade *models.Upgrade) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+
+	if blue, err := p.agents.For(ctx, upgrade.BlueNode, upgrade.BlueCTID); err != nil {
+		logger.Error("failed to reach the instance after a failed upgrade", "error", err)
+	} else {
+		if err := blue.SetReadOnly(ctx, false); err != nil {
+			logger.Error("failed to make the instance writable after a failed upgrade", "error", err)
+		}
+		if err := blue.DropPublication(ctx, publicationName(upgrade)); err != nil {
+			logger.Warn("failed to drop upgrade publication", "error", err)
+		}
+	}
+	if upgrade.GreenCTID != 0 {
+		if err := p.destroy(ctx, upgrade.GreenNode, upgrade.GreenCTID); err != nil {
+			logger.Error("failed to destroy the container of a failed upgrade", "node", upgrade.GreenNode, "ctid", upgrade.GreenCTID, "error", err)
+		}
+	}
+	// Green may have taken the private address just before failing
+	if err := p.attachNetwork(ctx, inst, upgrade.BlueNode, upgrade.BlueCTID); err != nil {
+		logger.Error("failed to attach the instance to its private network after a failed upgrade", "error", err)
+	}
+
+	upgrade.Status = models.UpgradeFailed
+	if err := p.store.Upgrades().Update(ctx, upgrade); err != nil && err != store.ErrNotFound {
+		logger.Error("failed to record failed upgrade", "error", err)
+	}
+	if current, err := p.store.Instances().Get(ctx, inst.ID); err == nil && current.Status == models.InstanceUpgrading {
+		p.setStatus(current, models.InstanceRunning)
+		// A failed cutover may have pointed the name at green already
+		p.republishRecord(ctx, current)
+	}
+}
+
+// RollbackUpgrade moves the instance back to the blue container of an
+// upgrade within its rollback window, pointing its record back at blue, and
+// destroys green. Writes made since the cutover are lost. If blue can't be
+// brought back, the instance stays on green and the upgrade can be rolled
+// back again.
+func (p *Provisioner) RollbackUpgrade(ctx context.Context, job *models.Job) error {
+	inst, upgrade, err := p.loadUpgrade(ctx, job)
+	if err != nil {
+		return err
+	}
+	if upgrade.Status != models.UpgradeRollingBack {
+		return fmt.Errorf("upgrade %s is %s, not rolling back", upgrade.ID, upgrade.Status)
+	}
+
+	if err := p.rollback(ctx, job, inst, upgrade); err != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		// The finish_upgrade job may have run and left the upgrade alone
+		// while it was rolling back, so queue another
+		recErr := p.store.InTx(ctx, func(tx store.Store) error {
+			upgrade.Status = models.UpgradeCutOver
+			if err := tx.Upgrades().Update(ctx, upgrade); err != nil {
+				return err
+			}
+			_, err := jobs.NewQueue(tx.Jobs()).EnqueueAt(ctx, jobs.TypeFinishUpgrade, jobs.UpgradePayload{
+				InstanceID: inst.ID,
+				OrgID:      jobs.OrgID(job),
+				UpgradeID:  upgrade.ID,
+			}, *upgrade.RollbackUntil)
+			return err
+		})
+		if recErr != nil && recErr != store.ErrNotFound {
+			logging.FromContext(ctx).Error("failed to record failed rollback", "error", recErr)
+		}
+		if current, getErr := p.store.Instances().Get(ctx, inst.ID); getErr == nil && current.Status == models.InstanceUpgrading {
+			// Blue may have taken the private address before failing
+			if err := p.attachNetwork(ctx, current, current.Node, current.CTID); err != nil {
+				logging.FromContext(ctx).Error("failed to attach the instance to its private network after a failed rollback", "error", err)
+			}
+			p.setStatus(current, models.InstanceRunning)
+		}
+		return fmt.Errorf("failed to roll back: %w", err)
+	}
+
+	p.progress(ctx, job, stepCutOver, 90, "Destroying the PostgreSQL %d container", upgrade.ToVersion)
+	if err := p.destroy(ctx, upgrade.GreenNode, upgrade.GreenCTID); err != nil {
+		return fmt.Errorf("rolled back, but failed to destroy container %d: %w", upgrade.GreenCTID, err)
+	}
+	p.progress(ctx, job, stepCutOver, 100, "Rolled back to PostgreSQL %d", upgrade.FromVersion)
+	return nil
+}
+
+func (p *Provisioner) rollback(ctx context.Context, job *models.Job, inst *models.Instance, upgrade *models.Upgrade) error {
+	p.progress(ctx, job, stepProvisioning, 0, "Starting the PostgreSQL %d container", upgrade.FromVersion)
+	client, err := p.cluster.Client(ctx, upgrade.BlueNode)
+	if err != nil {
+		return err
+	}
+	if err := p.startContainer(ctx, client, upgrade.BlueNode, upgrade.BlueCTID); err != nil {
+		return err
+	}
+	blue, err := p.waitForAgent(ctx, upgrade.BlueNode, upgrade.BlueCTID)
+	if err != nil {
+		return err
+	}
+	if err := blue.SetReadOnly(ctx, false); err != nil {
+		return fmt.Errorf("failed to make the container writable: %w", err)
+	}
+	// The policy may have changed since the cutover
+	if err := p.applyNetworkPolicy(ctx, inst, upgrade.BlueNode, upgrade.BlueCTID, blue); err != nil {
+		return err
+	}
+	if err := p.moveNetwork(ctx, inst, upgrade.GreenNode, upgrade.GreenCTID, upgrade.BlueNode, upgrade.BlueCTID); err != nil {
+		return err
+	}
+
+	p.progress(ctx, job, stepCuttingOver, 50, "Moving the instance back to PostgreSQL %d", upgrade.FromVersion)
+	err = p.store.InTx(ctx, func(tx store.Store) error {
+		current, err := tx.Instances().Get(ctx, inst.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.InstanceUpgrading {
+			return fmt.Errorf("instance %s is %s, not upgrading", inst.ID, current.Status)
+		}
+		current.Node, current.CTID, current.PgVersion = upgrade.BlueNode, upgrade.BlueCTID, upgrade.FromVersion
+		current.Status = models.InstanceRunning
+		if err := tx.Instances().Update(ctx, current); err != nil {
+			return err
+		}
+		upgrade.Status = models.UpgradeRolledBack
+		if err := tx.Upgrades().Update(ctx, upgrade); err != nil {
+			return err
+		}
+		// Blue's certificate may have expired while it was stopped
+		if err := p.enqueueCertificate(ctx, tx.Jobs(), current, jobs.OrgID(job)); err != nil {
+			return err
+		}
+		*inst = *current
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to roll back: %w", err)
+	}
+	p.republishRecord(ctx, inst)
+	logging.FromContext(ctx).Info("rolled back upgrade", "node", inst.Node, "ctid", inst.CTID, "pg_version", inst.PgVersion)
+	return nil
+}
+
+// FinishUpgrade closes the rollback window of an upgrade, destroying blue.
+// Upgrades that were rolled back or already finished are left alone.
+func (p *Provisioner) FinishUpgrade(ctx context.Context, job *models.Job) error {
+	var payload jobs.UpgradePayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	upgrade, err := p.store.Upgrades().Get(ctx, payload.UpgradeID)
+	if err == store.ErrNotFound {
+		// Deleted along with its instance
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return p.finishUpgrade(ctx, payload.OrgID, upgrade)
+}
+
+// finishUpgrade marks a cut over upgrade finished, so it can no longer be
+// rolled back, then destroys blue. Only the call that finishes the upgrade
+// destroys blue: its CTID may have been reused since. The org is locked so
+// a rollback can't start meanwhile.
+func (p *Provisioner) finishUpgrade(ctx context.Context, orgID string, upgrade *models.Upgrade) error {
+	finished := false
+	err := p.store.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Orgs().Lock(ctx, orgID); err != nil {
+			return err
+		}
+		current, err := tx.Upgrades().Get(ctx, upgrade.ID)
+		if err != nil {
+			return err
+		}
+		*upgrade = *current
+		if upgrade.Status != models.UpgradeCutOver {
+			return nil
+		}
+		upgrade.Status = models.UpgradeFinished
+		finished = true
+		return tx.Upgrades().Update(ctx, upgrade)
+	})
+	if err != nil || !finished {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("closing rollback window", "upgrade_id", upgrade.ID, "node", upgrade.BlueNode, "ctid", upgrade.BlueCTID)
+	return p.destroy(ctx, upgrade.BlueNode, upgrade.BlueCTID)
+}
+
+// waitForAgent waits for Postgres in a started container to accept
+// connections and returns its agent.
+func (p *Provisioner) waitForAgent(ctx context.Context, node string, ctid int) (*guest.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, agentTimeout)
+	defer cancel()
+
+	var agent *guest.Client
+	var lastErr error
+	err := p.poll(ctx, func() (bool, error) {
+		if agent == nil {
+			a, err := p.agents.For(ctx, node, ctid)
+			if err != nil {
+				lastErr = err
+				return false, nil
+			}
+			agent = a
+		}
+		status, err := agent.Status(ctx)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		return status.Ready, nil
+	})
+	if err != nil && lastErr != nil {
+		return nil, fmt.Errorf("PostgreSQL in container %d isn't ready: %w", ctid, lastErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("PostgreSQL in container %d isn't ready: %w", ctid, err)
+	}
+	return agent, nil
+}
+
+// waitForLag waits until the subscription name of green is at most
+// maxBytes behind its publisher.
+func (p *Provisioner) waitForLag(ctx context.Context, green *guest.Client, name string, maxBytes int64) error {
+	return p.poll(ctx, func() (bool, error) {
+		sub, err := green.Subscription(ctx, name)
+		if err != nil {
+			return false, fmt.Errorf("failed to get subscription: %w", err)
+		}
+		return sub.LagBytes <= maxBytes, nil
+	})
+}
+
+// poll calls check every jobPollInterval until it reports done or fails.
+func (p *Provisioner) poll(ctx context.Context, check func() (bool, error)) error {
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// verifyCopy fails unless blue and green have the same tables with the
+// same contents.
+func verifyCopy(ctx context.Context, blue, green *guest.Client) error {
+	want, err := blue.Checksums(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to checksum tables: %w", err)
+	}
+	got, err := green.Checksums(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to checksum copied tables: %w", err)
+	}
+	for name, w := range want {
+		g, ok := got[name]
+		if !ok {
+			return fmt.Errorf("table %s wasn't copied", name)
+		}
+		if g != w {
+			return fmt.Errorf("table %s differs after the copy: %d rows before, %d after", name, w.Rows, g.Rows)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			return fmt.Errorf("table %s appeared in the copy", name)
+		}
+	}
+	return nil
+}
+
+// progress records how far the job has got; failing to is only logged.
+func (p *Provisioner) progress(ctx context.Context, job *models.Job, step string, percent int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logging.FromContext(ctx).Info(message, "step", step, "percent", percent)
+	if err := jobs.NewQueue(p.store.Jobs()).SetProgress(ctx, job.ID, step, percent, message); err != nil {
+		logging.FromContext(ctx).Warn("failed to record job progress", "error", err)
+	}
+}
+
+// startContainer starts container ctid on node unless it is running.
+func (p *Provisioner) startContainer(ctx context.Context, client *proxmox.Client, node string, ctid int) error {
+	status, err := client.ContainerStatus(ctx, node, ctid)
+	if err != nil {
+		return fmt.Errorf("failed to get container status: %w", err)
+	}
+	if status == "running" {
+		return nil
+	}
+	return p.setContainerStatus(ctx, client, node, ctid, "start")
+}
+
+// stopContainer stops container ctid on node if it is running.
+func (p *Provisioner) stopContainer(ctx context.Context, node string, ctid int) error {
+	client, err := p.cluster.Client(ctx, node)
+	if err != nil {
+		return err
+	}
+	status, err := client.ContainerStatus(ctx, node, ctid)
+	if err != nil {
+		return fmt.Errorf("failed to get container status: %w", err)
+	}
+	if status != "running" {
+		return nil
+	}
+	return p.setContainerStatus(ctx, client, node, ctid, "stop")
+}
+
+func (p *Provisioner) loadUpgrade(ctx context.Context, job *models.Job) (*models.Instance, *models.Upgrade, error) {
+	var payload jobs.UpgradePayload
+	if err := json.Unmarshal([]byte(job.PayloadJSON), &payload); err != nil {
+		return nil, nil, fmt.Errorf("invalid job payload: %w", err)
+	}
+	inst, err := p.store.Instances().Get(ctx, payload.InstanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	upgrade, err := p.store.Upgrades().Get(ctx, payload.UpgradeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inst, upgrade, nil
+}
+
+// publicationName names the publication and subscription of upgrade.
+func publicationName(upgrade *models.Upgrade) string {
+	return "dbx_upgrade_" + strings.ReplaceAll(upgrade.ID, "-", "")[:12]
+}
@@ -0,0 +1,157 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zallarak/db/api/internal/guest"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/pglsn"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// ArchiveWAL ships the completed WAL segments of the instance from its
+// guest agent to the object store, and turns archiving on the agent on or
+// off to match the instance's backup policy. The scheduler enqueues it
+// every backups.wal_archive_interval for policies that archive WAL, and
+// the API when a policy stops archiving. A segment is recorded before the
+// agent drops it, so a retried job may ship one again but never loses one.
+// Instances that aren't running are skipped; their agent keeps the
+// segments until the next run.
+func (p *Provisioner) ArchiveWAL(ctx context.Context, job *models.Job) error {
+	_, inst, err := p.load(ctx, job)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if inst.Status != models.InstanceRunning {
+		return nil
+	}
+
+	enabled := false
+	policy, err := p.store.BackupPolicies().GetByInstance(ctx, inst.ID)
+	if err == nil {
+		enabled = policy.WALArchiving
+	} else if err != store.ErrNotFound {
+		return err
+	}
+
+	agent, err := p.agents.For(ctx, inst.Node, inst.CTID)
+	if err != nil {
+		return err
+	}
+	// Turning archiving off comes after shipping what the agent holds, so
+	// the archive has no gap up to that point
+	if enabled {
+		if err := agent.SetWALArchiving(ctx, true, p.walInterval); err != nil {
+			return fmt.Errorf("failed to turn on WAL archiving: %w", err)
+		}
+	}
+	segments, err := agent.WALSegments(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	for _, seg := range segments {
+		if err := p.archiveSegment(ctx, inst, agent, seg); err != nil {
+			return err
+		}
+	}
+	if !enabled {
+		if err := agent.SetWALArchiving(ctx, false, 0); err != nil {
+			return fmt.Errorf("failed to turn off WAL archiving: %w", err)
+		}
+	}
+
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		logging.FromContext(ctx).Info("archived WAL", "segments", len(segments), "end_lsn", last.EndLSN, "end_time", last.EndTime)
+	}
+	return nil
+}
+
+func (p *Provisioner) archiveSegment(ctx context.Context, inst *models.Instance, agent *guest.Client, seg guest.WALSegment) error {
+	r, err := agent.ReadWALSegment(ctx, seg.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL segment %s: %w", seg.Name, err)
+	}
+	defer r.Close()
+	size, err := p.objects.Put(ctx, walKey(inst.ID, seg.Name), r)
+	if err != nil {
+		return err
+	}
+
+	err = p.store.WALSegments().Create(ctx, &models.WALSegment{
+		InstanceID: inst.ID,
+		Name:       seg.Name,
+		StartLSN:   seg.StartLSN,
+		EndLSN:     seg.EndLSN,
+		EndTime:    seg.EndTime,
+		SizeBytes:  size,
+	})
+	if err != nil {
+		return err
+	}
+	if err := agent.DeleteWALSegment(ctx, seg.Name); err != nil {
+		return fmt.Errorf("failed to release WAL segment %s: %w", seg.Name, err)
+	}
+	return nil
+}
+
+// pruneWAL deletes the archived WAL of an instance that ends before the
+// oldest of its backups that has started, which is all a restore replays
+// from. Without such a backup no segment is of use.
+func (p *Provisioner) pruneWAL(ctx context.Context, instanceID string) error {
+	backups, err := p.store.Backups().ListByInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	var oldest pglsn.LSN
+	keep := false
+	for _, b := range backups {
+		if b.StartLSN == "" || b.Status == models.BackupFailed || b.Status == models.BackupDeleting {
+			continue
+		}
+		lsn, err := pglsn.Parse(b.StartLSN)
+		if err != nil {
+			return err
+		}
+		if !keep || lsn < oldest {
+			oldest, keep = lsn, true
+		}
+	}
+
+	segments, err := p.store.WALSegments().ListByInstance(ctx, instanceID, "")
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	for _, seg := range segments {
+		end, err := pglsn.Parse(seg.EndLSN)
+		if err != nil {
+			return err
+		}
+		if keep && end > oldest {
+			break
+		}
+		if err := p.objects.Delete(ctx, walKey(instanceID, seg.Name)); err != nil {
+			return err
+		}
+		err = p.store.WALSegments().Delete(ctx, instanceID, seg.Name)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		logging.FromContext(ctx).Info("pruned archived WAL", "instance_id", instanceID, "segments", pruned)
+	}
+	return nil
+}
+
+// walKey is where the object of WAL segment name of an instance is stored.
+func walKey(instanceID, name string) string {
+	return "instances/" + instanceID + "/wal/" + name
+}
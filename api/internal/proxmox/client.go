@@ -0,0 +1,455 @@
+// Package proxmox is a client for the parts of the Proxmox VE API used to run
+// instances: placing, cloning, configuring, resizing, starting and destroying
+// LXC containers, and managing their network devices and firewall rules.
+// Calls are recorded in the client metrics and traced.
+package proxmox
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/tracing"
+)
+
+// taskPollInterval is how often WaitTask checks a running task.
+const taskPollInterval = time.Second
+
+// APIError is an error response from Proxmox.
+type APIError struct {
+	Status  int
+	Message string
+	// Errors holds per-parameter validation messages.
+	Errors map[string]string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("proxmox: %d %s", e.Status, e.Message)
+	if len(e.Errors) > 0 {
+		params := make([]string, 0, len(e.Errors))
+		for p := range e.Errors {
+			params = append(params, p)
+		}
+		sort.Strings(params)
+		for _, p := range params {
+			msg += fmt.Sprintf("; %s: %s", p, e.Errors[p])
+		}
+	}
+	return msg
+}
+
+// IsNotFound reports whether err says a guest doesn't exist. Proxmox
+// reports this as a 500 with a message rather than a 404.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Status == http.StatusNotFound || strings.Contains(apiErr.Message, "does not exist")
+}
+
+type Node struct {
+	Node   string `json:"node"`
+	Status string `json:"status"`
+	// Memory in bytes
+	MaxMem int64   `json:"maxmem"`
+	Mem    int64   `json:"mem"`
+	MaxCPU int     `json:"maxcpu"`
+	CPU    float64 `json:"cpu"`
+}
+
+// FreeMemory returns the memory not in use on the node, in bytes.
+func (n Node) FreeMemory() int64 {
+	return n.MaxMem - n.Mem
+}
+
+// StorageStatus is the capacity of a storage on a node, in bytes.
+type StorageStatus struct {
+	Total int64 `json:"total"`
+	Used  int64 `json:"used"`
+	Avail int64 `json:"avail"`
+}
+
+// Task is an asynchronous operation started on a node, identified by its
+// UPID.
+type Task struct {
+	Node string
+	UPID string
+}
+
+// ContainerConfig holds the container settings applied after cloning.
+type ContainerConfig struct {
+	Cores    int
+	MemoryMB int
+	// DataVolume allocates the volume mounted at /var/lib/postgresql, e.g.
+	// "local-zfs:40" for 40 GiB on local-zfs. Empty leaves it unchanged.
+	DataVolume string
+}
+
+// NetworkInterface is a network device of a container, such as net1.
+type NetworkInterface struct {
+	// Name is the interface inside the container, e.g. eth1.
+	Name   string
+	Bridge string
+	// Tag puts the interface on a VLAN of Bridge; 0 leaves it untagged.
+	Tag int
+	// IP is the static address of the interface in CIDR notation.
+	IP string
+	// Firewall applies the container's firewall rules to the interface.
+	Firewall bool
+}
+
+// String formats iface as a netN option of the container config.
+func (iface NetworkInterface) String() string {
+	opts := []string{"name=" + iface.Name, "bridge=" + iface.Bridge}
+	if iface.Tag != 0 {
+		opts = append(opts, "tag="+strconv.Itoa(iface.Tag))
+	}
+	opts = append(opts, "ip="+iface.IP)
+	if iface.Firewall {
+		opts = append(opts, "firewall=1")
+	}
+	return strings.Join(opts, ",")
+}
+
+// FirewallRule is a rule of a container's firewall. Rules are evaluated in
+// order of Pos, the first that matches deciding.
+type FirewallRule struct {
+	Pos int `json:"pos"`
+	// Type is in or out, Action ACCEPT, DROP or REJECT.
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	Proto  string `json:"proto,omitempty"`
+	Dport  string `json:"dport,omitempty"`
+	// Source is a CIDR block; empty matches any address.
+	Source  string `json:"source,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Enable  int    `json:"enable"`
+}
+
+type Client struct {
+	name    string
+	baseURL string
+	auth    string
+	http    *http.Client
+}
+
+// NewClient returns a client for ep, authenticating with its API token.
+func NewClient(ep config.ProxmoxEndpoint) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ep.CAFile != "" || ep.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: ep.InsecureSkipVerify}
+		if ep.CAFile != "" {
+			pem, err := os.ReadFile(ep.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file of proxmox endpoint %s: %w", ep.Name, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("CA file of proxmox endpoint %s contains no certificates", ep.Name)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Client{
+		name:    ep.Name,
+		baseURL: strings.TrimSuffix(ep.URL, "/") + "/api2/json",
+		auth:    fmt.Sprintf("PVEAPIToken=%s=%s", ep.TokenID, ep.TokenSecret),
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: metrics.InstrumentTransport("proxmox", tracing.Transport("proxmox", transport)),
+		},
+	}, nil
+}
+
+// Name returns the name of the endpoint from the configuration.
+func (c *Client) Name() string {
+	return c.name
+}
+
+func (c *Client) Nodes(ctx context.Context) ([]Node, error) {
+	var nodes []Node
+	err := c.do(ctx, http.MethodGet, "/nodes", nil, &nodes)
+	return nodes, err
+}
+
+// Node returns the node named name.
+func (c *Client) Node(ctx context.Context, name string) (Node, error) {
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return Node{}, err
+	}
+	for _, n := range nodes {
+		if n.Node == name {
+			return n, nil
+		}
+	}
+	return Node{}, &APIError{Status: http.StatusNotFound, Message: fmt.Sprintf("node %s does not exist", name)}
+}
+
+// StorageStatus returns the capacity of storage on node.
+func (c *Client) StorageStatus(ctx context.Context, node, storage string) (StorageStatus, error) {
+	var status StorageStatus
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/storage/%s/status", node, storage), nil, &status)
+	return status, err
+}
+
+// NextID returns a container ID not used anywhere in the cluster.
+func (c *Client) NextID(ctx context.Context) (int, error) {
+	var id json.Number
+	if err := c.do(ctx, http.MethodGet, "/cluster/nextid", nil, &id); err != nil {
+		return 0, err
+	}
+	n, err := id.Int64()
+	return int(n), err
+}
+
+// GuestNode returns the node hosting the container or VM vmid.
+func (c *Client) GuestNode(ctx context.Context, vmid int) (string, error) {
+	var resources []struct {
+		VMID int    `json:"vmid"`
+		Node string `json:"node"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/cluster/resources?type=vm", nil, &resources); err != nil {
+		return "", err
+	}
+	for _, r := range resources {
+		if r.VMID == vmid {
+			return r.Node, nil
+		}
+	}
+	return "", &APIError{Status: http.StatusNotFound, Message: fmt.Sprintf("guest %d does not exist", vmid)}
+}
+
+// CloneContainer makes a full clone of template as newID on target.
+func (c *Client) CloneContainer(ctx context.Context, template, newID int, target, hostname, storage string) (Task, error) {
+	node, err := c.GuestNode(ctx, template)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to find template %d: %w", template, err)
+	}
+
+	params := url.Values{}
+	params.Set("newid", strconv.Itoa(newID))
+	params.Set("hostname", hostname)
+	params.Set("full", "1")
+	params.Set("storage", storage)
+	params.Set("target", target)
+	return c.task(ctx, node, http.MethodPost, fmt.Sprintf("/nodes/%s/lxc/%d/clone", node, template), params)
+}
+
+func (c *Client) ConfigureContainer(ctx context.Context, node string, vmid int, cfg ContainerConfig) error {
+	params := url.Values{}
+	params.Set("cores", strconv.Itoa(cfg.Cores))
+	params.Set("memory", strconv.Itoa(cfg.MemoryMB))
+	if cfg.DataVolume != "" {
+		params.Set("mp0", cfg.DataVolume+",mp=/var/lib/postgresql")
+	}
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/nodes/%s/lxc/%d/config", node, vmid), params, nil)
+}
+
+// SetInterface adds or replaces the network device key of a container, such
+// as "net1". Running containers get it without a restart.
+func (c *Client) SetInterface(ctx context.Context, node string, vmid int, key string, iface NetworkInterface) error {
+	params := url.Values{}
+	params.Set(key, iface.String())
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/nodes/%s/lxc/%d/config", node, vmid), params, nil)
+}
+
+// DeleteInterface removes the network device key of a container, if it has
+// one.
+func (c *Client) DeleteInterface(ctx context.Context, node string, vmid int, key string) error {
+	params := url.Values{}
+	params.Set("delete", key)
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/nodes/%s/lxc/%d/config", node, vmid), params, nil)
+}
+
+// ResizeVolume grows the volume disk of a container, e.g. "mp0", to sizeGiB.
+// Proxmox refuses to shrink volumes.
+func (c *Client) ResizeVolume(ctx context.Context, node string, vmid int, disk string, sizeGiB int) (Task, error) {
+	params := url.Values{}
+	params.Set("disk", disk)
+	params.Set("size", fmt.Sprintf("%dG", sizeGiB))
+	return c.task(ctx, node, http.MethodPut, fmt.Sprintf("/nodes/%s/lxc/%d/resize", node, vmid), params)
+}
+
+func (c *Client) StartContainer(ctx context.Context, node string, vmid int) (Task, error) {
+	return c.task(ctx, node, http.MethodPost, fmt.Sprintf("/nodes/%s/lxc/%d/status/start", node, vmid), nil)
+}
+
+func (c *Client) StopContainer(ctx context.Context, node string, vmid int) (Task, error) {
+	return c.task(ctx, node, http.MethodPost, fmt.Sprintf("/nodes/%s/lxc/%d/status/stop", node, vmid), nil)
+}
+
+// DeleteContainer destroys a stopped container along with its volumes.
+func (c *Client) DeleteContainer(ctx context.Context, node string, vmid int) (Task, error) {
+	path := fmt.Sprintf("/nodes/%s/lxc/%d?purge=1&destroy-unreferenced-disks=1", node, vmid)
+	return c.task(ctx, node, http.MethodDelete, path, nil)
+}
+
+// ContainerStatus returns "running" or "stopped".
+func (c *Client) ContainerStatus(ctx context.Context, node string, vmid int) (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/lxc/%d/status/current", node, vmid), nil, &status)
+	return status.Status, err
+}
+
+// ContainerAddress returns the first IPv4 address of a running container,
+// leaving out loopback.
+func (c *Client) ContainerAddress(ctx context.Context, node string, vmid int) (string, error) {
+	var ifaces []struct {
+		Name string `json:"name"`
+		Inet string `json:"inet"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/lxc/%d/interfaces", node, vmid), nil, &ifaces); err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Name == "lo" || iface.Inet == "" {
+			continue
+		}
+		// inet is in CIDR notation
+		addr, _, _ := strings.Cut(iface.Inet, "/")
+		return addr, nil
+	}
+	return "", fmt.Errorf("container %d on %s has no IPv4 address", vmid, node)
+}
+
+// EnableFirewall turns on the firewall of a container. Its interfaces must
+// also have firewall=1 for the rules to apply, as the templates set.
+func (c *Client) EnableFirewall(ctx context.Context, node string, vmid int) error {
+	params := url.Values{}
+	params.Set("enable", "1")
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/nodes/%s/lxc/%d/firewall/options", node, vmid), params, nil)
+}
+
+// FirewallRules returns the firewall rules of a container, in order.
+func (c *Client) FirewallRules(ctx context.Context, node string, vmid int) ([]FirewallRule, error) {
+	var rules []FirewallRule
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/lxc/%d/firewall/rules", node, vmid), nil, &rules); err != nil {
+		return nil, err
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pos < rules[j].Pos })
+	return rules, nil
+}
+
+// AddFirewallRule inserts rule into the firewall of a container at
+// rule.Pos, moving the rules from there down.
+func (c *Client) AddFirewallRule(ctx context.Context, node string, vmid int, rule FirewallRule) error {
+	params := url.Values{}
+	params.Set("pos", strconv.Itoa(rule.Pos))
+	params.Set("type", rule.Type)
+	params.Set("action", rule.Action)
+	params.Set("enable", strconv.Itoa(rule.Enable))
+	for key, value := range map[string]string{"proto": rule.Proto, "dport": rule.Dport, "source": rule.Source, "comment": rule.Comment} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/lxc/%d/firewall/rules", node, vmid), params, nil)
+}
+
+// DeleteFirewallRule removes the rule at pos from the firewall of a
+// container, moving the rules after it up.
+func (c *Client) DeleteFirewallRule(ctx context.Context, node string, vmid, pos int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/nodes/%s/lxc/%d/firewall/rules/%d", node, vmid, pos), nil, nil)
+}
+
+// WaitTask polls task until it finishes, returning an error if it failed.
+func (c *Client) WaitTask(ctx context.Context, task Task) error {
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", task.Node, url.PathEscape(task.UPID))
+	for {
+		var status struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := c.do(ctx, http.MethodGet, path, nil, &status); err != nil {
+			return err
+		}
+		if status.Status == "stopped" {
+			if status.ExitStatus != "OK" {
+				return fmt.Errorf("proxmox task %s failed: %s", task.UPID, status.ExitStatus)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
+
+func (c *Client) task(ctx context.Context, node, method, path string, params url.Values) (Task, error) {
+	var upid string
+	if err := c.do(ctx, method, path, params, &upid); err != nil {
+		return Task{}, err
+	}
+	return Task{Node: node, UPID: upid}, nil
+}
+
+// do sends params form-encoded and decodes the "data" field of the response
+// into out, if not nil.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.auth)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("proxmox request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data    json.RawMessage   `json:"data"`
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode proxmox response: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		// Proxmox puts the error in the status line rather than the body
+		message := envelope.Message
+		if message == "" {
+			message = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+		}
+		return &APIError{Status: resp.StatusCode, Message: message, Errors: envelope.Errors}
+	}
+
+	if out == nil || len(envelope.Data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return fmt.Errorf("failed to decode proxmox response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/zallarak/db/api/internal/config"
+)
+
+var (
+	ErrNoEndpoints = errors.New("no proxmox endpoints are configured")
+	ErrNoCapacity  = errors.New("no proxmox node has enough free memory")
+)
+
+// Cluster spreads instances over every configured endpoint and remembers
+// which endpoint hosts each node.
+type Cluster struct {
+	clients []*Client
+
+	mu     sync.Mutex
+	byNode map[string]*Client
+}
+
+func NewCluster(endpoints []config.ProxmoxEndpoint) (*Cluster, error) {
+	c := &Cluster{byNode: make(map[string]*Client)}
+	for _, ep := range endpoints {
+		client, err := NewClient(ep)
+		if err != nil {
+			return nil, err
+		}
+		c.clients = append(c.clients, client)
+	}
+	return c, nil
+}
+
+// Place picks the online node with the most free memory, provided it has at
+// least memoryBytes free.
+func (c *Cluster) Place(ctx context.Context, memoryBytes int64) (*Client, Node, error) {
+	if len(c.clients) == 0 {
+		return nil, Node{}, ErrNoEndpoints
+	}
+
+	var (
+		best       *Client
+		bestNode   Node
+		reachError error
+	)
+	for _, client := range c.clients {
+		nodes, err := client.Nodes(ctx)
+		if err != nil {
+			// Place on the endpoints that are reachable
+			reachError = fmt.Errorf("failed to list nodes of %s: %w", client.Name(), err)
+			continue
+		}
+		for _, n := range nodes {
+			c.remember(n.Node, client)
+			if n.Status != "online" || n.FreeMemory() < memoryBytes {
+				continue
+			}
+			if best == nil || n.FreeMemory() > bestNode.FreeMemory() {
+				best, bestNode = client, n
+			}
+		}
+	}
+
+	if best == nil {
+		if reachError != nil {
+			return nil, Node{}, reachError
+		}
+		return nil, Node{}, ErrNoCapacity
+	}
+	return best, bestNode, nil
+}
+
+// Client returns the client of the endpoint that hosts node.
+func (c *Cluster) Client(ctx context.Context, node string) (*Client, error) {
+	c.mu.Lock()
+	client, ok := c.byNode[node]
+	c.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	for _, client := range c.clients {
+		nodes, err := client.Nodes(ctx)
+		if err != nil {
+			continue
+		}
+		for _, n := range nodes {
+			c.remember(n.Node, client)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.byNode[node]; ok {
+		return client, nil
+	}
+	return nil, fmt.Errorf("no proxmox endpoint hosts node %s", node)
+}
+
+func (c *Cluster) remember(node string, client *Client) {
+	c.mu.Lock()
+	c.byNode[node] = client
+	c.mu.Unlock()
+}
@@ -0,0 +1,627 @@
+// Package fake is an in-process stand-in for a Proxmox VE cluster. It serves
+// the subset of the Proxmox API that package proxmox uses, keeping
+// containers in memory and completing tasks after a short delay, so instance
+// flows can run on a laptop with `server --dev`. It also plays the guest
+// agent of every container, see guest.go, and the WireGuard gateway, see
+// gateway.go.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures a Cluster. Zero values get the defaults noted.
+type Options struct {
+	// Nodes names the cluster nodes; default pve-fake-1 and pve-fake-2.
+	Nodes []string
+	// NodeMemory is the memory of each node in bytes; default 64 GiB.
+	NodeMemory int64
+	// NodeStorage is the size of each storage of each node in bytes;
+	// default 2 TiB.
+	NodeStorage int64
+	// Template is the CTID of the template container, created on the first
+	// node and running Postgres 16; default 9000.
+	Template int
+	// Templates adds a template container for each Postgres major version,
+	// by CTID.
+	Templates map[int]int
+	// TokenID and TokenSecret are the only credentials accepted.
+	TokenID     string
+	TokenSecret string
+	// GuestToken is the only token the guest agents accept.
+	GuestToken string
+	// GatewayToken is the only token the WireGuard gateway accepts; the
+	// gateway refuses every request without one.
+	GatewayToken string
+	// TaskDuration is how long tasks stay running; default 2s.
+	TaskDuration time.Duration
+}
+
+type container struct {
+	vmid     int
+	node     string
+	hostname string
+	status   string
+	template bool
+	config   map[string]string
+	firewall firewall
+	pg       postgres
+}
+
+// firewall is the firewall of a container, which Proxmox keeps apart from
+// its config.
+type firewall struct {
+	enabled bool
+	rules   []firewallRule
+}
+
+type firewallRule struct {
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+	Proto   string `json:"proto,omitempty"`
+	Dport   string `json:"dport,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Enable  int    `json:"enable"`
+}
+
+type task struct {
+	node     string
+	exit     string
+	finishAt time.Time
+}
+
+// Cluster is an http.Handler serving the fake Proxmox API under /api2/json.
+type Cluster struct {
+	opts Options
+
+	mu         sync.Mutex
+	containers map[int]*container
+	tasks      map[string]*task
+	taskSeq    int
+	peers      map[string]gatewayPeer
+}
+
+func New(opts Options) *Cluster {
+	if len(opts.Nodes) == 0 {
+		opts.Nodes = []string{"pve-fake-1", "pve-fake-2"}
+	}
+	if opts.NodeMemory == 0 {
+		opts.NodeMemory = 64 << 30
+	}
+	if opts.NodeStorage == 0 {
+		opts.NodeStorage = 2 << 40
+	}
+	if opts.Template == 0 {
+		opts.Template = 9000
+	}
+	if opts.TaskDuration == 0 {
+		opts.TaskDuration = 2 * time.Second
+	}
+
+	c := &Cluster{
+		opts:       opts,
+		containers: make(map[int]*container),
+		tasks:      make(map[string]*task),
+		peers:      make(map[string]gatewayPeer),
+	}
+	templates := map[int]int{opts.Template: 16}
+	for version, vmid := range opts.Templates {
+		templates[vmid] = version
+	}
+	for vmid, version := range templates {
+		c.containers[vmid] = &container{
+			vmid:     vmid,
+			node:     opts.Nodes[0],
+			hostname: fmt.Sprintf("pg%d-template", version),
+			status:   "stopped",
+			template: true,
+			config:   map[string]string{"cores": "1", "memory": "512", "unprivileged": "1"},
+			pg:       postgres{version: version},
+		}
+	}
+	return c
+}
+
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(c *Cluster, r *http.Request, args []string) (interface{}, error)
+}
+
+var routes = []route{
+	{http.MethodGet, regexp.MustCompile(`^/nodes$`), (*Cluster).nodes},
+	{http.MethodGet, regexp.MustCompile(`^/cluster/nextid$`), (*Cluster).nextID},
+	{http.MethodGet, regexp.MustCompile(`^/cluster/resources$`), (*Cluster).resources},
+	{http.MethodPost, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/clone$`), (*Cluster).clone},
+	{http.MethodPut, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/config$`), (*Cluster).configure},
+	{http.MethodPut, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/resize$`), (*Cluster).resize},
+	{http.MethodGet, regexp.MustCompile(`^/nodes/([^/]+)/storage/([^/]+)/status$`), (*Cluster).storageStatus},
+	{http.MethodGet, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/status/current$`), (*Cluster).status},
+	{http.MethodGet, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/interfaces$`), (*Cluster).interfaces},
+	{http.MethodPost, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/status/(start|stop)$`), (*Cluster).setStatus},
+	{http.MethodDelete, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)$`), (*Cluster).destroy},
+	{http.MethodPut, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/firewall/options$`), (*Cluster).firewallOptions},
+	{http.MethodGet, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/firewall/rules$`), (*Cluster).firewallRules},
+	{http.MethodPost, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/firewall/rules$`), (*Cluster).addFirewallRule},
+	{http.MethodDelete, regexp.MustCompile(`^/nodes/([^/]+)/lxc/(\d+)/firewall/rules/(\d+)$`), (*Cluster).deleteFirewallRule},
+	{http.MethodGet, regexp.MustCompile(`^/nodes/([^/]+)/tasks/([^/]+)/status$`), (*Cluster).taskStatus},
+}
+
+// httpError is returned by route handlers to produce an error response.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string { return e.message }
+
+func fail(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/guest/") {
+		c.serveGuest(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/wireguard/") {
+		c.serveGateway(w, r)
+		return
+	}
+
+	want := fmt.Sprintf("PVEAPIToken=%s=%s", c.opts.TokenID, c.opts.TokenSecret)
+	if r.Header.Get("Authorization") != want {
+		writeError(w, fail(http.StatusUnauthorized, "authentication failure"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api2/json")
+	for _, rt := range routes {
+		m := rt.pattern.FindStringSubmatch(path)
+		if m == nil || rt.method != r.Method {
+			continue
+		}
+		args := make([]string, len(m)-1)
+		for i, raw := range m[1:] {
+			args[i], _ = url.PathUnescape(raw)
+		}
+		if err := r.ParseForm(); err != nil {
+			writeError(w, fail(http.StatusBadRequest, "invalid parameters"))
+			return
+		}
+
+		c.mu.Lock()
+		data, err := rt.handle(c, r, args)
+		c.mu.Unlock()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		return
+	}
+	writeError(w, fail(http.StatusNotImplemented, "Method '%s %s' not implemented", r.Method, path))
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, message := http.StatusInternalServerError, err.Error()
+	if he, ok := err.(*httpError); ok {
+		status = he.status
+	}
+	// Like Proxmox, report the message in the status line
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": nil, "message": message})
+}
+
+func (c *Cluster) nodes(r *http.Request, _ []string) (interface{}, error) {
+	nodes := make([]map[string]interface{}, 0, len(c.opts.Nodes))
+	for _, name := range c.opts.Nodes {
+		var used int64
+		for _, ct := range c.containers {
+			if ct.node == name && ct.status == "running" {
+				mem, _ := strconv.ParseInt(ct.config["memory"], 10, 64)
+				used += mem << 20
+			}
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"node":   name,
+			"status": "online",
+			"maxmem": c.opts.NodeMemory,
+			"mem":    used,
+			"maxcpu": 32,
+			"cpu":    0.05,
+		})
+	}
+	return nodes, nil
+}
+
+func (c *Cluster) nextID(r *http.Request, _ []string) (interface{}, error) {
+	id := 100
+	for c.containers[id] != nil || id == c.opts.Template {
+		id++
+	}
+	return strconv.Itoa(id), nil
+}
+
+func (c *Cluster) resources(r *http.Request, _ []string) (interface{}, error) {
+	ids := make([]int, 0, len(c.containers))
+	for id := range c.containers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	resources := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		ct := c.containers[id]
+		template := 0
+		if ct.template {
+			template = 1
+		}
+		resources = append(resources, map[string]interface{}{
+			"id":       fmt.Sprintf("lxc/%d", id),
+			"type":     "lxc",
+			"vmid":     id,
+			"node":     ct.node,
+			"name":     ct.hostname,
+			"status":   ct.status,
+			"template": template,
+		})
+	}
+	return resources, nil
+}
+
+func (c *Cluster) clone(r *http.Request, args []string) (interface{}, error) {
+	src, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	newID, err := strconv.Atoi(r.PostForm.Get("newid"))
+	if err != nil || newID < 100 {
+		return nil, fail(http.StatusBadRequest, "Parameter verification failed: newid")
+	}
+	if c.containers[newID] != nil {
+		return nil, fail(http.StatusInternalServerError, "CT %d already exists", newID)
+	}
+	target := r.PostForm.Get("target")
+	if target == "" {
+		target = src.node
+	}
+	if !c.hasNode(target) {
+		return nil, fail(http.StatusInternalServerError, "no such cluster node '%s'", target)
+	}
+
+	config := make(map[string]string, len(src.config))
+	for k, v := range src.config {
+		config[k] = v
+	}
+	c.containers[newID] = &container{
+		vmid:     newID,
+		node:     target,
+		hostname: r.PostForm.Get("hostname"),
+		status:   "stopped",
+		config:   config,
+		pg:       postgres{version: src.pg.version},
+	}
+	return c.startTask(src.node, "vzclone", newID), nil
+}
+
+func (c *Cluster) configure(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range r.PostForm {
+		value := values[0]
+		if key == "delete" {
+			for _, k := range strings.Split(value, ",") {
+				delete(ct.config, k)
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "net") {
+			if _, err := netInterface(value); err != nil {
+				return nil, fail(http.StatusBadRequest, "Parameter verification failed: %s: %v", key, err)
+			}
+		}
+		// A volume given as storage:size is allocated, and named as
+		// Proxmox would name it
+		if strings.HasPrefix(key, "mp") {
+			storage, spec, _ := strings.Cut(value, ":")
+			size, options, _ := strings.Cut(spec, ",")
+			if gib, err := strconv.Atoi(size); err == nil {
+				value = fmt.Sprintf("%s:subvol-%d-disk-%s,%s,size=%dG", storage, ct.vmid, key[2:], options, gib)
+			}
+		}
+		ct.config[key] = value
+	}
+	return nil, nil
+}
+
+func (c *Cluster) resize(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	disk := r.PostForm.Get("disk")
+	storage, current, ok := volume(ct.config[disk])
+	if !ok {
+		return nil, fail(http.StatusInternalServerError, "unable to parse config line for %s", disk)
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(r.PostForm.Get("size"), "G"))
+	if err != nil {
+		return nil, fail(http.StatusBadRequest, "Parameter verification failed: size")
+	}
+	if size < current {
+		return nil, fail(http.StatusInternalServerError, "unable to shrink disk size")
+	}
+	if int64(size-current)<<30 > c.opts.NodeStorage-c.storageUsed(ct.node, storage) {
+		return nil, fail(http.StatusInternalServerError, "zfs error: cannot set property for '%s': size is greater than available space", disk)
+	}
+	ct.config[disk] = strings.Replace(ct.config[disk], fmt.Sprintf("size=%dG", current), fmt.Sprintf("size=%dG", size), 1)
+	return c.startTask(ct.node, "resize", ct.vmid), nil
+}
+
+func (c *Cluster) storageStatus(r *http.Request, args []string) (interface{}, error) {
+	if !c.hasNode(args[0]) {
+		return nil, fail(http.StatusInternalServerError, "no such cluster node '%s'", args[0])
+	}
+	used := c.storageUsed(args[0], args[1])
+	return map[string]interface{}{
+		"total": c.opts.NodeStorage,
+		"used":  used,
+		"avail": c.opts.NodeStorage - used,
+	}, nil
+}
+
+// storageUsed adds up the volumes allocated on storage of node.
+func (c *Cluster) storageUsed(node, storage string) int64 {
+	var used int64
+	for _, ct := range c.containers {
+		if ct.node != node {
+			continue
+		}
+		for key, value := range ct.config {
+			if s, gib, ok := volume(value); ok && strings.HasPrefix(key, "mp") && s == storage {
+				used += int64(gib) << 30
+			}
+		}
+	}
+	return used
+}
+
+// volume parses an allocated volume such as
+// "local-zfs:subvol-101-disk-0,mp=/data,size=40G".
+func volume(value string) (storage string, gib int, ok bool) {
+	storage, rest, found := strings.Cut(value, ":")
+	if !found {
+		return "", 0, false
+	}
+	for _, option := range strings.Split(rest, ",") {
+		if size, found := strings.CutPrefix(option, "size="); found {
+			gib, err := strconv.Atoi(strings.TrimSuffix(size, "G"))
+			return storage, gib, err == nil
+		}
+	}
+	return "", 0, false
+}
+
+func (c *Cluster) status(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"vmid": ct.vmid, "name": ct.hostname, "status": ct.status}, nil
+}
+
+func (c *Cluster) interfaces(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if ct.status != "running" {
+		return nil, fail(http.StatusInternalServerError, "CT %d not running", ct.vmid)
+	}
+	ifaces := []map[string]interface{}{
+		{"name": "lo", "inet": "127.0.0.1/8", "hwaddr": "00:00:00:00:00:00"},
+		{"name": "eth0", "inet": address(ct.vmid) + "/24", "hwaddr": fmt.Sprintf("bc:24:11:00:%02x:%02x", ct.vmid/256, ct.vmid%256)},
+	}
+	// Devices added to the config, in order after eth0
+	var keys []string
+	for key := range ct.config {
+		if strings.HasPrefix(key, "net") && key != "net0" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		opts, _ := netInterface(ct.config[key])
+		ifaces = append(ifaces, map[string]interface{}{
+			"name": opts["name"], "inet": opts["ip"], "hwaddr": fmt.Sprintf("bc:24:11:%02x:%02x:%02x", i+1, ct.vmid/256, ct.vmid%256),
+		})
+	}
+	return ifaces, nil
+}
+
+// netInterface parses a network device of a container config, such as
+// "name=eth1,bridge=vmbr1,tag=100,ip=10.96.0.2/24", into its options.
+func netInterface(value string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, option := range strings.Split(value, ",") {
+		k, v, _ := strings.Cut(option, "=")
+		opts[k] = v
+	}
+	if opts["name"] == "" || opts["bridge"] == "" {
+		return nil, fmt.Errorf("name and bridge are required")
+	}
+	if ip := opts["ip"]; ip != "dhcp" {
+		if _, err := netip.ParsePrefix(ip); err != nil {
+			return nil, fmt.Errorf("invalid ip %q", ip)
+		}
+	}
+	if tag, ok := opts["tag"]; ok {
+		if n, err := strconv.Atoi(tag); err != nil || n < 1 || n > 4094 {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return opts, nil
+}
+
+// address is the IP address of container vmid.
+func address(vmid int) string {
+	return fmt.Sprintf("10.10.%d.%d", vmid/256, vmid%256)
+}
+
+func (c *Cluster) setStatus(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if ct.template {
+		return nil, fail(http.StatusInternalServerError, "cannot start template")
+	}
+	if args[2] == "start" {
+		ct.status = "running"
+		return c.startTask(ct.node, "vzstart", ct.vmid), nil
+	}
+	ct.status = "stopped"
+	return c.startTask(ct.node, "vzstop", ct.vmid), nil
+}
+
+func (c *Cluster) destroy(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if ct.status == "running" {
+		return nil, fail(http.StatusInternalServerError, "CT %d is running - destroy failed", ct.vmid)
+	}
+	delete(c.containers, ct.vmid)
+	return c.startTask(ct.node, "vzdestroy", ct.vmid), nil
+}
+
+func (c *Cluster) firewallOptions(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if enable := r.PostForm.Get("enable"); enable != "" {
+		ct.firewall.enabled = enable == "1"
+	}
+	return nil, nil
+}
+
+func (c *Cluster) firewallRules(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]map[string]interface{}, 0, len(ct.firewall.rules))
+	for pos, rule := range ct.firewall.rules {
+		var fields map[string]interface{}
+		raw, _ := json.Marshal(rule)
+		json.Unmarshal(raw, &fields)
+		fields["pos"] = pos
+		rules = append(rules, fields)
+	}
+	return rules, nil
+}
+
+func (c *Cluster) addFirewallRule(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	form := r.PostForm
+	rule := firewallRule{
+		Type:    form.Get("type"),
+		Action:  form.Get("action"),
+		Proto:   form.Get("proto"),
+		Dport:   form.Get("dport"),
+		Source:  form.Get("source"),
+		Comment: form.Get("comment"),
+	}
+	if rule.Type != "in" && rule.Type != "out" {
+		return nil, fail(http.StatusBadRequest, "Parameter verification failed: type")
+	}
+	if rule.Action != "ACCEPT" && rule.Action != "DROP" && rule.Action != "REJECT" {
+		return nil, fail(http.StatusBadRequest, "Parameter verification failed: action")
+	}
+	if rule.Source != "" {
+		if _, err := netip.ParsePrefix(rule.Source); err != nil {
+			return nil, fail(http.StatusBadRequest, "Parameter verification failed: source")
+		}
+	}
+	rule.Enable, _ = strconv.Atoi(form.Get("enable"))
+	// Like Proxmox, insert at the top unless told where
+	pos, err := strconv.Atoi(form.Get("pos"))
+	if err != nil || pos > len(ct.firewall.rules) {
+		pos = 0
+	}
+	ct.firewall.rules = append(ct.firewall.rules[:pos], append([]firewallRule{rule}, ct.firewall.rules[pos:]...)...)
+	return nil, nil
+}
+
+func (c *Cluster) deleteFirewallRule(r *http.Request, args []string) (interface{}, error) {
+	ct, err := c.container(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	pos, _ := strconv.Atoi(args[2])
+	if pos >= len(ct.firewall.rules) {
+		return nil, fail(http.StatusInternalServerError, "no rule at position %d", pos)
+	}
+	ct.firewall.rules = append(ct.firewall.rules[:pos], ct.firewall.rules[pos+1:]...)
+	return nil, nil
+}
+
+func (c *Cluster) taskStatus(r *http.Request, args []string) (interface{}, error) {
+	t, ok := c.tasks[args[1]]
+	if !ok || t.node != args[0] {
+		return nil, fail(http.StatusInternalServerError, "no such task")
+	}
+	if time.Now().Before(t.finishAt) {
+		return map[string]interface{}{"upid": args[1], "status": "running"}, nil
+	}
+	return map[string]interface{}{"upid": args[1], "status": "stopped", "exitstatus": t.exit}, nil
+}
+
+func (c *Cluster) container(node, vmid string) (*container, error) {
+	id, _ := strconv.Atoi(vmid)
+	ct, ok := c.containers[id]
+	if !ok || ct.node != node {
+		return nil, fail(http.StatusInternalServerError, "Configuration file 'nodes/%s/lxc/%s.conf' does not exist", node, vmid)
+	}
+	return ct, nil
+}
+
+func (c *Cluster) hasNode(name string) bool {
+	for _, n := range c.opts.Nodes {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// startTask records a task that finishes successfully after TaskDuration
+// and returns its UPID.
+func (c *Cluster) startTask(node, kind string, vmid int) string {
+	c.taskSeq++
+	now := time.Now()
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%d:%s:", node, c.taskSeq, c.taskSeq, now.Unix(), kind, vmid, c.opts.TokenID)
+	c.tasks[upid] = &task{node: node, exit: "OK", finishAt: now.Add(c.opts.TaskDuration)}
+	return upid
+}
@@ -0,0 +1,114 @@
+package fake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// gatewayPeer is a peer of the WireGuard gateway.
+type gatewayPeer struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"public_key"`
+	Address   string `json:"address"`
+	Subnet    string `json:"subnet"`
+	VLAN      int    `json:"vlan"`
+}
+
+var gatewayRoutes = []struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(c *Cluster, r *http.Request, args []string) (interface{}, error)
+}{
+	{http.MethodGet, regexp.MustCompile(`^/v1/peers$`), (*Cluster).gatewayPeers},
+	{http.MethodPut, regexp.MustCompile(`^/v1/peers/([^/]+)$`), (*Cluster).putGatewayPeer},
+	{http.MethodDelete, regexp.MustCompile(`^/v1/peers/([^/]+)$`), (*Cluster).deleteGatewayPeer},
+}
+
+// serveGateway serves the API of the WireGuard gateway under /wireguard.
+// The gateway keeps its peers in memory; no tunnel is set up.
+func (c *Cluster) serveGateway(w http.ResponseWriter, r *http.Request) {
+	if c.opts.GatewayToken == "" || r.Header.Get("Authorization") != "Bearer "+c.opts.GatewayToken {
+		writeGuestError(w, fail(http.StatusUnauthorized, "invalid token"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/wireguard")
+	for _, rt := range gatewayRoutes {
+		m := rt.pattern.FindStringSubmatch(path)
+		if m == nil || rt.method != r.Method {
+			continue
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		data, err := rt.handle(c, r, m[1:])
+		if err != nil {
+			writeGuestError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if data == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	writeGuestError(w, fail(http.StatusNotFound, "no route %s %s", r.Method, path))
+}
+
+func (c *Cluster) gatewayPeers(r *http.Request, _ []string) (interface{}, error) {
+	peers := make([]gatewayPeer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return map[string]interface{}{"peers": peers}, nil
+}
+
+func (c *Cluster) putGatewayPeer(r *http.Request, args []string) (interface{}, error) {
+	var req gatewayPeer
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	req.ID = args[0]
+
+	if key, err := base64.StdEncoding.DecodeString(req.PublicKey); err != nil || len(key) != 32 {
+		return nil, fail(http.StatusBadRequest, "invalid public key %q", req.PublicKey)
+	}
+	subnet, err := netip.ParsePrefix(req.Subnet)
+	if err != nil || subnet != subnet.Masked() {
+		return nil, fail(http.StatusBadRequest, "invalid subnet %q", req.Subnet)
+	}
+	addr, err := netip.ParseAddr(req.Address)
+	if err != nil || !subnet.Contains(addr) {
+		return nil, fail(http.StatusBadRequest, "address %q is not in %s", req.Address, subnet)
+	}
+	if req.VLAN < 1 || req.VLAN > 4094 {
+		return nil, fail(http.StatusBadRequest, "invalid VLAN %d", req.VLAN)
+	}
+	for id, p := range c.peers {
+		if id == req.ID {
+			continue
+		}
+		if p.PublicKey == req.PublicKey || p.Address == req.Address {
+			return nil, fail(http.StatusConflict, "peer %s has the same key or address", id)
+		}
+	}
+
+	c.peers[req.ID] = req
+	return req, nil
+}
+
+func (c *Cluster) deleteGatewayPeer(r *http.Request, args []string) (interface{}, error) {
+	if _, ok := c.peers[args[0]]; !ok {
+		return nil, fail(http.StatusNotFound, "no peer %s", args[0])
+	}
+	delete(c.peers, args[0])
+	return nil, nil
+}
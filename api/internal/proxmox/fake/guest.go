@@ -0,0 +1,716 @@
+package fake
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/pglsn"
+)
+
+// postgres is what the guest agent of a container knows about its Postgres.
+// Tables hold row counts only; they are seeded the first time a container is
+// published or backed up, standing in for whatever its users wrote, and
+// grow while it is published and writable, or archiving WAL.
+type postgres struct {
+	version       int
+	readOnly      bool
+	hba           []hbaEntry
+	settings      settings
+	tables        map[string]int64
+	publications  map[string]bool
+	subscriptions map[string]*subscription
+	// lsn is the WAL insert position, walArchiving whether completed
+	// segments are kept in wal until archived.
+	lsn          pglsn.LSN
+	walArchiving bool
+	wal          []walSegment
+	// restore is set between restoring a base backup and recovering.
+	restore *restore
+	// tlsKey is the key generated for the next certificate, and certificate
+	// the one served, nil while it is the template's self-signed one.
+	tlsKey      *ecdsa.PrivateKey
+	certificate []byte
+}
+
+// walSegment is a completed WAL segment. Instead of WAL records it holds
+// the tables as they were at its end, so replaying is taking the tables of
+// the last segment replayed.
+type walSegment struct {
+	Name     string           `json:"name"`
+	StartLSN pglsn.LSN        `json:"-"`
+	EndLSN   pglsn.LSN        `json:"-"`
+	EndTime  time.Time        `json:"end_time"`
+	Tables   map[string]int64 `json:"tables"`
+	// Start and End are the LSNs in the form agents report them.
+	Start string `json:"start_lsn"`
+	End   string `json:"end_lsn"`
+}
+
+// restore is a base backup restored into a container, with the WAL staged
+// to replay on top of it.
+type restore struct {
+	tables map[string]int64
+	lsn    pglsn.LSN
+	wal    []walSegment
+}
+
+// settings are the Postgres settings the plan of an instance sizes.
+type settings struct {
+	MaxConnections       int `json:"max_connections"`
+	SharedBuffersMB      int `json:"shared_buffers_mb"`
+	EffectiveCacheSizeMB int `json:"effective_cache_size_mb"`
+	MaintenanceWorkMemMB int `json:"maintenance_work_mem_mb"`
+}
+
+// hbaEntry is a managed line of pg_hba.conf.
+type hbaEntry struct {
+	Type     string `json:"type"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+	Address  string `json:"address"`
+	Method   string `json:"method"`
+}
+
+type subscription struct {
+	source  int
+	created time.Time
+}
+
+// seedTables are the tables of a container once seeded, with a row count
+// per CTID so instances differ.
+var seedTables = map[string]int64{
+	"public.accounts": 1200,
+	"public.events":   48000,
+	"public.invoices": 5300,
+}
+
+// writeRows is how many rows a writable publisher gains between two polls
+// of a subscription to it, and rowBytes the WAL each takes.
+const (
+	writeRows = 25
+	rowBytes  = 128
+)
+
+// emptyClusterBytes is the disk a cluster takes up before any tables.
+const emptyClusterBytes = 40 << 20
+
+// initialLSN is where the WAL of a new cluster starts.
+const initialLSN = pglsn.LSN(pglsn.SegmentSize + 0x28)
+
+// walLSN returns the WAL insert position of ct.
+func (ct *container) walLSN() pglsn.LSN {
+	if ct.pg.lsn == 0 {
+		ct.pg.lsn = initialLSN
+	}
+	return ct.pg.lsn
+}
+
+// seed gives ct the seed tables if it has none yet.
+func (ct *container) seed() {
+	if ct.pg.tables != nil {
+		return
+	}
+	ct.pg.tables = make(map[string]int64, len(seedTables))
+	for name, rows := range seedTables {
+		ct.pg.tables[name] = rows + int64(ct.vmid)
+	}
+}
+
+type guestRoute struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(c *Cluster, ct *container, r *http.Request, args []string) (interface{}, error)
+}
+
+var guestRoutes = []guestRoute{
+	{http.MethodGet, regexp.MustCompile(`^/v1/status$`), (*Cluster).guestStatus},
+	{http.MethodPost, regexp.MustCompile(`^/v1/publications$`), (*Cluster).createPublication},
+	{http.MethodDelete, regexp.MustCompile(`^/v1/publications/([^/]+)$`), (*Cluster).dropPublication},
+	{http.MethodPost, regexp.MustCompile(`^/v1/subscriptions$`), (*Cluster).createSubscription},
+	{http.MethodGet, regexp.MustCompile(`^/v1/subscriptions/([^/]+)$`), (*Cluster).getSubscription},
+	{http.MethodPost, regexp.MustCompile(`^/v1/subscriptions/([^/]+)/finish$`), (*Cluster).finishSubscription},
+	{http.MethodPut, regexp.MustCompile(`^/v1/read-only$`), (*Cluster).setReadOnly},
+	{http.MethodPut, regexp.MustCompile(`^/v1/pg-hba$`), (*Cluster).setHBA},
+	{http.MethodPut, regexp.MustCompile(`^/v1/settings$`), (*Cluster).setSettings},
+	{http.MethodPost, regexp.MustCompile(`^/v1/tls/csr$`), (*Cluster).createCSR},
+	{http.MethodPut, regexp.MustCompile(`^/v1/tls/certificate$`), (*Cluster).installCertificate},
+	{http.MethodGet, regexp.MustCompile(`^/v1/checksums$`), (*Cluster).checksums},
+	{http.MethodGet, regexp.MustCompile(`^/v1/base-backup$`), (*Cluster).baseBackup},
+	{http.MethodPut, regexp.MustCompile(`^/v1/wal-archiving$`), (*Cluster).setWALArchiving},
+	{http.MethodPost, regexp.MustCompile(`^/v1/wal/switch$`), (*Cluster).switchWAL},
+	{http.MethodGet, regexp.MustCompile(`^/v1/wal/([^/]+)$`), (*Cluster).getWALSegment},
+	{http.MethodDelete, regexp.MustCompile(`^/v1/wal/([^/]+)$`), (*Cluster).deleteWALSegment},
+	{http.MethodPut, regexp.MustCompile(`^/v1/restore/base-backup$`), (*Cluster).restoreBaseBackup},
+	{http.MethodPut, regexp.MustCompile(`^/v1/restore/wal/([^/]+)$`), (*Cluster).restoreWALSegment},
+	{http.MethodPost, regexp.MustCompile(`^/v1/restore$`), (*Cluster).recover},
+}
+
+// rawBody is a response that isn't JSON.
+type rawBody struct {
+	contentType string
+	data        []byte
+}
+
+// serveGuest serves the agent of container vmid under /guest/{vmid}.
+func (c *Cluster) serveGuest(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+c.opts.GuestToken {
+		writeGuestError(w, fail(http.StatusUnauthorized, "invalid token"))
+		return
+	}
+
+	id, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/guest/"), "/")
+	vmid, _ := strconv.Atoi(id)
+	path = "/" + path
+	for _, rt := range guestRoutes {
+		m := rt.pattern.FindStringSubmatch(path)
+		if m == nil || rt.method != r.Method {
+			continue
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		ct, ok := c.containers[vmid]
+		if !ok || ct.template {
+			writeGuestError(w, fail(http.StatusNotFound, "no container %s", id))
+			return
+		}
+		// A stopped container's agent is unreachable
+		if ct.status != "running" {
+			writeGuestError(w, fail(http.StatusBadGateway, "container %d is not running", vmid))
+			return
+		}
+		data, err := rt.handle(c, ct, r, m[1:])
+		if err != nil {
+			writeGuestError(w, err)
+			return
+		}
+		if raw, ok := data.(rawBody); ok {
+			w.Header().Set("Content-Type", raw.contentType)
+			w.Write(raw.data)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if data == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	writeGuestError(w, fail(http.StatusNotFound, "no route %s %s", r.Method, path))
+}
+
+func writeGuestError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if he, ok := err.(*httpError); ok {
+		status = he.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fail(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func (c *Cluster) guestStatus(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	return map[string]interface{}{
+		"pg_version":      ct.pg.version,
+		"ready":           ct.pg.restore == nil,
+		"read_only":       ct.pg.readOnly,
+		"wal_lsn":         ct.walLSN().String(),
+		"disk_used_bytes": ct.diskUsed(),
+	}, nil
+}
+
+// diskUsed returns how much of the data volume of ct is in use.
+func (ct *container) diskUsed() int64 {
+	used := int64(emptyClusterBytes)
+	for _, rows := range ct.pg.tables {
+		used += rows * rowBytes
+	}
+	return used
+}
+
+func (c *Cluster) createPublication(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, fail(http.StatusBadRequest, "name is required")
+	}
+	ct.seed()
+	if ct.pg.publications == nil {
+		ct.pg.publications = make(map[string]bool)
+	}
+	ct.pg.publications[req.Name] = true
+	return map[string]interface{}{
+		"name":     req.Name,
+		"host":     address(ct.vmid),
+		"port":     5432,
+		"user":     "dbx_replication",
+		"password": "fake-" + req.Name,
+	}, nil
+}
+
+func (c *Cluster) dropPublication(ct *container, r *http.Request, args []string) (interface{}, error) {
+	delete(ct.pg.publications, args[0])
+	return nil, nil
+}
+
+func (c *Cluster) createSubscription(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Name   string `json:"name"`
+		Source struct {
+			Name string `json:"name"`
+			Host string `json:"host"`
+		} `json:"source"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if ct.pg.subscriptions[req.Name] != nil {
+		return nil, nil
+	}
+	src := c.byAddress(req.Source.Host)
+	if src == nil || src.status != "running" {
+		return nil, fail(http.StatusBadRequest, "could not connect to the publisher at %s", req.Source.Host)
+	}
+	if !src.pg.publications[req.Source.Name] {
+		return nil, fail(http.StatusBadRequest, "publication %q does not exist", req.Source.Name)
+	}
+	if ct.pg.subscriptions == nil {
+		ct.pg.subscriptions = make(map[string]*subscription)
+	}
+	ct.pg.subscriptions[req.Name] = &subscription{source: src.vmid, created: time.Now()}
+	return nil, nil
+}
+
+// getSubscription copies the tables over TaskDuration, then streams: each
+// poll applies what the publisher wrote since the last one and reports it
+// as the lag.
+func (c *Cluster) getSubscription(ct *container, r *http.Request, args []string) (interface{}, error) {
+	sub := ct.pg.subscriptions[args[0]]
+	if sub == nil {
+		return nil, fail(http.StatusNotFound, "subscription %q does not exist", args[0])
+	}
+	src := c.containers[sub.source]
+	if src == nil {
+		return nil, fail(http.StatusBadGateway, "could not connect to the publisher")
+	}
+
+	total := len(src.pg.tables)
+	elapsed := time.Since(sub.created)
+	if elapsed < c.opts.TaskDuration {
+		return map[string]interface{}{
+			"name":          args[0],
+			"state":         "copying",
+			"tables_total":  total,
+			"tables_copied": int(int64(total) * int64(elapsed) / int64(c.opts.TaskDuration)),
+			"lag_bytes":     0,
+		}, nil
+	}
+
+	var lag int64
+	for name, rows := range src.pg.tables {
+		lag += (rows - ct.pg.tables[name]) * rowBytes
+	}
+	copyTables(ct, src)
+	if !src.pg.readOnly && src.status == "running" {
+		src.pg.tables["public.events"] += writeRows
+	}
+	return map[string]interface{}{
+		"name":          args[0],
+		"state":         "streaming",
+		"tables_total":  total,
+		"tables_copied": total,
+		"lag_bytes":     lag,
+	}, nil
+}
+
+func (c *Cluster) finishSubscription(ct *container, r *http.Request, args []string) (interface{}, error) {
+	sub := ct.pg.subscriptions[args[0]]
+	if sub == nil {
+		return nil, fail(http.StatusNotFound, "subscription %q does not exist", args[0])
+	}
+	if src := c.containers[sub.source]; src != nil {
+		copyTables(ct, src)
+	}
+	delete(ct.pg.subscriptions, args[0])
+	return nil, nil
+}
+
+func copyTables(dst, src *container) {
+	dst.pg.tables = make(map[string]int64, len(src.pg.tables))
+	for name, rows := range src.pg.tables {
+		dst.pg.tables[name] = rows
+	}
+}
+
+func (c *Cluster) setReadOnly(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	ct.pg.readOnly = req.ReadOnly
+	return nil, nil
+}
+
+func (c *Cluster) setHBA(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Entries []hbaEntry `json:"entries"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	for _, e := range req.Entries {
+		switch e.Type {
+		case "host", "hostssl", "hostnossl":
+		default:
+			return nil, fail(http.StatusBadRequest, "invalid connection type %q", e.Type)
+		}
+		if _, err := netip.ParsePrefix(e.Address); err != nil {
+			return nil, fail(http.StatusBadRequest, "invalid address %q", e.Address)
+		}
+	}
+	ct.pg.hba = req.Entries
+	return nil, nil
+}
+
+func (c *Cluster) setSettings(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req settings
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if req.MaxConnections < 1 || req.SharedBuffersMB < 1 || req.EffectiveCacheSizeMB < 1 || req.MaintenanceWorkMemMB < 1 {
+		return nil, fail(http.StatusBadRequest, "settings must be positive")
+	}
+	ct.pg.settings = req
+	return nil, nil
+}
+
+func (c *Cluster) createCSR(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		DNSNames []string `json:"dns_names"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.DNSNames) == 0 {
+		return nil, fail(http.StatusBadRequest, "dns_names is required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: req.DNSNames[0]},
+		DNSNames: req.DNSNames,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	ct.pg.tlsKey = key
+	return map[string][]byte{"csr": csr}, nil
+}
+
+func (c *Cluster) installCertificate(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(req.Certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fail(http.StatusBadRequest, "certificate must be PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid certificate: %v", err)
+	}
+	if ct.pg.tlsKey == nil || !ct.pg.tlsKey.PublicKey.Equal(cert.PublicKey) {
+		return nil, fail(http.StatusBadRequest, "certificate is not for the pending key")
+	}
+	ct.pg.certificate = []byte(req.Certificate)
+	return nil, nil
+}
+
+func (c *Cluster) checksums(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	names := make([]string, 0, len(ct.pg.tables))
+	for name := range ct.pg.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tables := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", name, ct.pg.tables[name])))
+		tables[name] = map[string]interface{}{"rows": ct.pg.tables[name], "checksum": hex.EncodeToString(sum[:8])}
+	}
+	return map[string]interface{}{"tables": tables}, nil
+}
+
+// baseBackup archives what the fake knows of Postgres: its version, the
+// row counts of its tables in tables.json, standing in for the data
+// directory, and the LSN it was taken at in backup_label.
+func (c *Cluster) baseBackup(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	ct.seed()
+	tables, err := json.Marshal(ct.pg.tables)
+	if err != nil {
+		return nil, err
+	}
+	label := fmt.Sprintf("START WAL LOCATION: %s (file %s)\n", ct.walLSN(), ct.walLSN().SegmentName())
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"PG_VERSION", []byte(strconv.Itoa(ct.pg.version) + "\n")},
+		{"tables.json", tables},
+		{"backup_label", []byte(label)},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0o600, Size: int64(len(f.data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return rawBody{contentType: "application/gzip", data: buf.Bytes()}, nil
+}
+
+// byAddress returns the container with IP address addr, or nil.
+func (c *Cluster) byAddress(addr string) *container {
+	for _, ct := range c.containers {
+		if !ct.template && address(ct.vmid) == addr {
+			return ct
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) setWALArchiving(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	ct.pg.walArchiving = req.Enabled
+	if !req.Enabled {
+		ct.pg.wal = nil
+	}
+	return nil, nil
+}
+
+// switchWAL closes the current segment while archiving, after a writable
+// container wrote writeRows rows into it, and lists the segments waiting
+// to be archived.
+func (c *Cluster) switchWAL(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	if ct.pg.walArchiving {
+		ct.seed()
+		if !ct.pg.readOnly {
+			ct.pg.tables["public.events"] += writeRows
+		}
+		start := ct.walLSN()
+		end := (start/pglsn.SegmentSize + 1) * pglsn.SegmentSize
+		tables := make(map[string]int64, len(ct.pg.tables))
+		for name, rows := range ct.pg.tables {
+			tables[name] = rows
+		}
+		ct.pg.wal = append(ct.pg.wal, walSegment{
+			Name:     start.SegmentName(),
+			StartLSN: start,
+			EndLSN:   end,
+			EndTime:  time.Now().UTC(),
+			Tables:   tables,
+			Start:    start.String(),
+			End:      end.String(),
+		})
+		ct.pg.lsn = end
+	}
+
+	segments := make([]map[string]interface{}, 0, len(ct.pg.wal))
+	for _, seg := range ct.pg.wal {
+		segments = append(segments, map[string]interface{}{
+			"name":       seg.Name,
+			"start_lsn":  seg.Start,
+			"end_lsn":    seg.End,
+			"end_time":   seg.EndTime,
+			"size_bytes": pglsn.SegmentSize,
+		})
+	}
+	return map[string]interface{}{"segments": segments}, nil
+}
+
+func (c *Cluster) getWALSegment(ct *container, r *http.Request, args []string) (interface{}, error) {
+	for _, seg := range ct.pg.wal {
+		if seg.Name == args[0] {
+			data, err := json.Marshal(seg)
+			if err != nil {
+				return nil, err
+			}
+			return rawBody{contentType: "application/octet-stream", data: data}, nil
+		}
+	}
+	return nil, fail(http.StatusNotFound, "WAL segment %s does not exist", args[0])
+}
+
+func (c *Cluster) deleteWALSegment(ct *container, r *http.Request, args []string) (interface{}, error) {
+	for i, seg := range ct.pg.wal {
+		if seg.Name == args[0] {
+			ct.pg.wal = append(ct.pg.wal[:i], ct.pg.wal[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, fail(http.StatusNotFound, "WAL segment %s does not exist", args[0])
+}
+
+// restoreBaseBackup reads an archive written by baseBackup. Postgres is
+// not ready until recover.
+func (c *Cluster) restoreBaseBackup(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+		}
+	}
+
+	version, _ := strconv.Atoi(strings.TrimSpace(string(files["PG_VERSION"])))
+	if version != ct.pg.version {
+		return nil, fail(http.StatusBadRequest, "base backup is of PostgreSQL %d, this container runs %d", version, ct.pg.version)
+	}
+	var tables map[string]int64
+	if err := json.Unmarshal(files["tables.json"], &tables); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+	}
+	var lsn string
+	if _, err := fmt.Sscanf(string(files["backup_label"]), "START WAL LOCATION: %s", &lsn); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: no backup_label")
+	}
+	start, err := pglsn.Parse(lsn)
+	if err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid base backup: %v", err)
+	}
+	ct.pg.restore = &restore{tables: tables, lsn: start}
+	return nil, nil
+}
+
+func (c *Cluster) restoreWALSegment(ct *container, r *http.Request, args []string) (interface{}, error) {
+	if ct.pg.restore == nil {
+		return nil, fail(http.StatusConflict, "no base backup is restored")
+	}
+	var seg walSegment
+	if err := decode(r, &seg); err != nil {
+		return nil, err
+	}
+	var err error
+	if seg.StartLSN, err = pglsn.Parse(seg.Start); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid WAL segment %s: %v", args[0], err)
+	}
+	if seg.EndLSN, err = pglsn.Parse(seg.End); err != nil {
+		return nil, fail(http.StatusBadRequest, "invalid WAL segment %s: %v", args[0], err)
+	}
+	seg.Name = args[0]
+	ct.pg.restore.wal = append(ct.pg.restore.wal, seg)
+	return nil, nil
+}
+
+// recover replays the staged segments that end at or before the target,
+// which must follow on from the base backup without gaps.
+func (c *Cluster) recover(ct *container, r *http.Request, _ []string) (interface{}, error) {
+	rs := ct.pg.restore
+	if rs == nil {
+		return nil, fail(http.StatusConflict, "no base backup is restored")
+	}
+	var req struct {
+		TargetTime *time.Time `json:"target_time"`
+		TargetLSN  string     `json:"target_lsn"`
+	}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	var target pglsn.LSN
+	if req.TargetLSN != "" {
+		var err error
+		if target, err = pglsn.Parse(req.TargetLSN); err != nil {
+			return nil, fail(http.StatusBadRequest, "%v", err)
+		}
+	}
+
+	sort.Slice(rs.wal, func(i, j int) bool { return rs.wal[i].StartLSN < rs.wal[j].StartLSN })
+	tables, lsn := rs.tables, rs.lsn
+	var replayed *time.Time
+	for _, seg := range rs.wal {
+		if seg.EndLSN <= lsn {
+			continue
+		}
+		if req.TargetTime == nil && req.TargetLSN == "" ||
+			req.TargetTime != nil && seg.EndTime.After(*req.TargetTime) ||
+			req.TargetLSN != "" && seg.EndLSN > target {
+			break
+		}
+		if seg.StartLSN > lsn {
+			return nil, fail(http.StatusBadRequest, "WAL from %s to %s is missing", lsn, seg.StartLSN)
+		}
+		tables, lsn = seg.Tables, seg.EndLSN
+		end := seg.EndTime
+		replayed = &end
+	}
+
+	ct.pg.tables, ct.pg.lsn, ct.pg.restore = tables, lsn, nil
+	ct.pg.wal = nil
+	return map[string]interface{}{"lsn": lsn.String(), "time": replayed}, nil
+}
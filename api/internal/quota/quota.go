@@ -0,0 +1,314 @@
+// Package quota limits the instances orgs and projects may create: how many,
+// their total vCPUs, memory and disk, and which plans they may use. Limits
+// come from the quotas section of the configuration, overridden for single
+// orgs and projects by rows an operator stores with `server quota set`.
+//
+// Every instance counts against the limits until it is deleted, including
+// failed ones and those being deleted.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// Limits are the effective limits of an org or project. Zero is unlimited
+// and an empty Plans allows every plan.
+type Limits struct {
+	Instances int
+	VCPUs     int
+	MemoryMB  int
+	DiskGiB   int
+	Plans     []string
+}
+
+// MarshalJSON writes unlimited values as null.
+func (l Limits) MarshalJSON() ([]byte, error) {
+	limit := func(n int) *int {
+		if n == 0 {
+			return nil
+		}
+		return &n
+	}
+	var plans []string
+	if len(l.Plans) > 0 {
+		plans = l.Plans
+	}
+	return json.Marshal(struct {
+		Instances *int     `json:"instances"`
+		VCPUs     *int     `json:"vcpus"`
+		MemoryMB  *int     `json:"memory_mb"`
+		DiskGiB   *int     `json:"disk_gib"`
+		Plans     []string `json:"plans"`
+	}{limit(l.Instances), limit(l.VCPUs), limit(l.MemoryMB), limit(l.DiskGiB), plans})
+}
+
+// allows reports whether plan is one of the allowed plans.
+func (l Limits) allows(plan string) bool {
+	if len(l.Plans) == 0 {
+		return true
+	}
+	for _, p := range l.Plans {
+		if p == plan {
+			return true
+		}
+	}
+	return false
+}
+
+// override applies the non-nil fields of an operator override.
+func (l Limits) override(q *models.Quota) Limits {
+	if q == nil {
+		return l
+	}
+	for _, f := range []struct {
+		dst *int
+		src *int
+	}{
+		{&l.Instances, q.Instances},
+		{&l.VCPUs, q.VCPUs},
+		{&l.MemoryMB, q.MemoryMB},
+		{&l.DiskGiB, q.DiskGiB},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	if q.Plans != nil {
+		l.Plans = q.Plans
+	}
+	return l
+}
+
+// Usage is what the instances of an org or project add up to.
+type Usage struct {
+	Instances int `json:"instances"`
+	VCPUs     int `json:"vcpus"`
+	MemoryMB  int `json:"memory_mb"`
+	DiskGiB   int `json:"disk_gib"`
+}
+
+func (u *Usage) add(inst *models.Instance, plans map[string]models.Plan) {
+	plan := plans[inst.Plan]
+	u.Instances++
+	u.VCPUs += plan.VCPUs
+	u.MemoryMB += plan.MemoryMB
+	u.DiskGiB += inst.DiskGiB
+}
+
+// catalog returns the plans by name.
+func catalog(ctx context.Context, s store.Store) (map[string]models.Plan, error) {
+	list, err := s.Plans().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plans := make(map[string]models.Plan, len(list))
+	for _, p := range list {
+		plans[p.Name] = p
+	}
+	return plans, nil
+}
+
+// ExceededError is returned by Check when an instance doesn't fit.
+type ExceededError struct {
+	// Scope is org or project.
+	Scope string
+	// Resource is instances, vcpus, memory_mb, disk_gib or plan.
+	Resource string
+	Limit    int
+	Used     int
+	Plan     string
+}
+
+func (e *ExceededError) Error() string {
+	scope := e.Scope
+	if scope == "org" {
+		scope = "organization"
+	}
+	if e.Resource == "plan" {
+		return fmt.Sprintf("The %s plan is not allowed in this %s", e.Plan, scope)
+	}
+	return fmt.Sprintf("The instance would exceed the %s quota of %d %s (%d in use)", scope, e.Limit, e.Resource, e.Used)
+}
+
+// Checker computes limits and usage and enforces them.
+type Checker struct {
+	cfg config.QuotaConfig
+}
+
+func NewChecker(cfg config.QuotaConfig) *Checker {
+	return &Checker{cfg: cfg}
+}
+
+// OrgLimits returns the configured org limits with the override of orgID.
+func (c *Checker) OrgLimits(ctx context.Context, s store.Store, orgID string) (Limits, error) {
+	q, err := s.Quotas().GetOrg(ctx, orgID)
+	if err != nil && err != store.ErrNotFound {
+		return Limits{}, err
+	}
+	return fromConfig(c.cfg.Org).override(q), nil
+}
+
+// ProjectLimits returns the configured project limits with the override of
+// projectID.
+func (c *Checker) ProjectLimits(ctx context.Context, s store.Store, projectID string) (Limits, error) {
+	q, err := s.Quotas().GetProject(ctx, projectID)
+	if err != nil && err != store.ErrNotFound {
+		return Limits{}, err
+	}
+	return fromConfig(c.cfg.Project).override(q), nil
+}
+
+// Check returns an *ExceededError if inst doesn't fit in the quotas of
+// project and its org. Call it in the transaction that creates inst: it
+// locks the org, so concurrent creates in the org are checked one at a time
+// against what the others committed. To check a resize, pass the existing
+// instance with its new plan and disk size; it then counts only as resized.
+func (c *Checker) Check(ctx context.Context, tx store.Store, project *models.Project, inst *models.Instance) error {
+	if err := tx.Orgs().Lock(ctx, project.OrgID); err != nil {
+		return err
+	}
+
+	orgLimits, err := c.OrgLimits(ctx, tx, project.OrgID)
+	if err != nil {
+		return err
+	}
+	projectLimits, err := c.ProjectLimits(ctx, tx, project.ID)
+	if err != nil {
+		return err
+	}
+
+	plans, err := catalog(ctx, tx)
+	if err != nil {
+		return err
+	}
+	instances, err := tx.Instances().ListByOrg(ctx, project.OrgID)
+	if err != nil {
+		return err
+	}
+	var orgUsage, projectUsage, current Usage
+	var existing *models.Instance
+	for i := range instances {
+		if instances[i].ID == inst.ID {
+			existing = &instances[i]
+			current.add(existing, plans)
+			continue
+		}
+		orgUsage.add(&instances[i], plans)
+		if instances[i].ProjectID == project.ID {
+			projectUsage.add(&instances[i], plans)
+		}
+	}
+
+	// An instance may keep a plan that is no longer allowed when resized
+	if existing == nil || existing.Plan != inst.Plan {
+		if !orgLimits.allows(inst.Plan) {
+			return &ExceededError{Scope: "org", Resource: "plan", Plan: inst.Plan}
+		}
+		if !projectLimits.allows(inst.Plan) {
+			return &ExceededError{Scope: "project", Resource: "plan", Plan: inst.Plan}
+		}
+	}
+	if err := check("org", orgLimits, orgUsage, current, inst, plans); err != nil {
+		return err
+	}
+	return check("project", projectLimits, projectUsage, current, inst, plans)
+}
+
+// Status is the usage of an org or project against its limits.
+type Status struct {
+	Limits Limits `json:"limits"`
+	Usage  Usage  `json:"usage"`
+}
+
+type ProjectStatus struct {
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	Status
+}
+
+// Report lists the quotas of an org and of each of its projects.
+type Report struct {
+	Org      Status          `json:"org"`
+	Projects []ProjectStatus `json:"projects"`
+}
+
+func (c *Checker) Report(ctx context.Context, s store.Store, orgID string) (*Report, error) {
+	var r Report
+	var err error
+	if r.Org.Limits, err = c.OrgLimits(ctx, s, orgID); err != nil {
+		return nil, err
+	}
+
+	projects, err := s.Projects().ListByOrg(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := s.Instances().ListByOrg(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	plans, err := catalog(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	byProject := make(map[string]*Usage, len(projects))
+	r.Projects = make([]ProjectStatus, len(projects))
+	for i, p := range projects {
+		r.Projects[i] = ProjectStatus{ProjectID: p.ID, Name: p.Name}
+		if r.Projects[i].Limits, err = c.ProjectLimits(ctx, s, p.ID); err != nil {
+			return nil, err
+		}
+		byProject[p.ID] = &r.Projects[i].Usage
+	}
+	for i := range instances {
+		r.Org.Usage.add(&instances[i], plans)
+		if u, ok := byProject[instances[i].ProjectID]; ok {
+			u.add(&instances[i], plans)
+		}
+	}
+	return &r, nil
+}
+
+// check fails if adding inst to used would go over limits. current is what
+// inst uses before a resize; a resize only fails on resources it grows, so
+// an instance over a lowered limit can still be downsized.
+func check(scope string, limits Limits, used, current Usage, inst *models.Instance, plans map[string]models.Plan) error {
+	before, after := used, used
+	before.Instances += current.Instances
+	before.VCPUs += current.VCPUs
+	before.MemoryMB += current.MemoryMB
+	before.DiskGiB += current.DiskGiB
+	after.add(inst, plans)
+	for _, r := range []struct {
+		name          string
+		limit         int
+		before, after int
+	}{
+		{"instances", limits.Instances, before.Instances, after.Instances},
+		{"vcpus", limits.VCPUs, before.VCPUs, after.VCPUs},
+		{"memory_mb", limits.MemoryMB, before.MemoryMB, after.MemoryMB},
+		{"disk_gib", limits.DiskGiB, before.DiskGiB, after.DiskGiB},
+	} {
+		if r.limit > 0 && r.after > r.limit && r.after > r.before {
+			return &ExceededError{Scope: scope, Resource: r.name, Limit: r.limit, Used: r.before}
+		}
+	}
+	return nil
+}
+
+func fromConfig(l config.QuotaLimits) Limits {
+	return Limits{
+		Instances: l.Instances,
+		VCPUs:     l.VCPUs,
+		MemoryMB:  l.MemoryMB,
+		DiskGiB:   l.DiskGiB,
+		Plans:     l.Plans,
+	}
+}
@@ -0,0 +1,359 @@
+// Package scheduler enqueues the jobs that run on a clock rather than on
+// request: backups of instances whose backup policy is due, archiving of
+// their WAL, the removal of expired backups, the reconciliation of instance
+// DNS records, the renewal of instance certificates and the checks of
+// pending custom domains. It runs next to every worker; policies, backups,
+// certificates and domains are claimed in transactions that skip rows
+// another scheduler holds, and reconciliation through a single due time,
+// so running several is safe.
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/cron"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+// batchSize bounds the policies and backups handled in one transaction.
+const batchSize = 100
+
+// renewalRetry is how long after a renewal is enqueued it is enqueued
+// again, unless the certificate was renewed by then.
+const renewalRetry = time.Hour
+
+type Scheduler struct {
+	store       store.Store
+	interval    time.Duration
+	walInterval time.Duration
+	dnsInterval time.Duration
+	renewals    bool
+	// domainInterval is how long after a domain is checked it is checked
+	// again
+	domainInterval time.Duration
+	logger         *slog.Logger
+}
+
+func New(st store.Store, cfg config.BackupConfig, dns config.DNSConfig, tls config.TLSConfig, domains config.DomainsConfig) *Scheduler {
+	return &Scheduler{
+		store:       st,
+		interval:    cfg.SchedulerInterval,
+		walInterval: cfg.WALArchiveInterval,
+		dnsInterval: dns.ReconcileInterval,
+		renewals:    tls.Issuer != "none",
+		logger:      slog.Default().With("component", "scheduler"),
+
+		domainInterval: domains.CheckInterval,
+	}
+}
+
+// Run checks for due and expired backups every interval until ctx is
+// cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.Tick(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick enqueues the backups, WAL archiving, DNS reconciliation,
+// certificate renewals and domain checks due at now and the deletion of
+// backups expired by then, logging failures.
+func (s *Scheduler) Tick(ctx context.Context, now time.Time) {
+	if err := s.scheduleBackups(ctx, now); err != nil && ctx.Err() == nil {
+		s.logger.Error("failed to schedule backups", "error", err)
+	}
+	if err := s.scheduleWALArchiving(ctx, now); err != nil && ctx.Err() == nil {
+		s.logger.Error("failed to schedule WAL archiving", "error", err)
+	}
+	if err := s.pruneBackups(ctx, now); err != nil && ctx.Err() == nil {
+		s.logger.Error("failed to prune backups", "error", err)
+	}
+	if err := s.scheduleDNSReconcile(ctx, now); err != nil && ctx.Err() == nil {
+		s.logger.Error("failed to schedule DNS reconciliation", "error", err)
+	}
+	if err := s.scheduleRenewals(ctx, now); err != nil && ctx.Err() == nil {
+		s.logger.Error("failed to schedule certificate renewals", "error", err)
+	}
+	if err := s.scheduleDomainChecks(ctx, now); err != nil && ctx.Err() == nil {
+		s.logger.Error("failed to schedule domain checks", "error", err)
+	}
+}
+
+// scheduleBackups enqueues a backup of each instance whose policy is due
+// and moves the policy to its next run. Runs missed while no scheduler was
+// running collapse into one. Instances that aren't running, or are still
+// being backed up, skip the run.
+func (s *Scheduler) scheduleBackups(ctx context.Context, now time.Time) error {
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		policies, err := tx.BackupPolicies().ListDue(ctx, now, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range policies {
+			policy := &policies[i]
+			logger := s.logger.With("instance_id", policy.InstanceID)
+
+			schedule, err := cron.Parse(policy.Schedule)
+			if err != nil {
+				// Schedules are checked when set, so this only happens if
+				// the parser got stricter; retry after a day
+				logger.Error("invalid backup schedule", "schedule", policy.Schedule, "error", err)
+				policy.NextRunAt = now.Add(24 * time.Hour)
+			} else {
+				policy.NextRunAt = schedule.Next(now)
+				if err := s.enqueueBackup(ctx, tx, policy, logger); err != nil {
+					return err
+				}
+			}
+			if err := tx.BackupPolicies().Put(ctx, policy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Scheduler) enqueueBackup(ctx context.Context, tx store.Store, policy *models.BackupPolicy, logger *slog.Logger) error {
+	inst, err := tx.Instances().Get(ctx, policy.InstanceID)
+	if err != nil {
+		return err
+	}
+	if inst.Status != models.InstanceRunning {
+		logger.Info("skipping scheduled backup", "reason", "instance is "+inst.Status)
+		return nil
+	}
+	project, err := tx.Projects().Get(ctx, inst.ProjectID)
+	if err != nil {
+		return err
+	}
+	// As the API does before an on-demand backup
+	if err := tx.Orgs().Lock(ctx, project.OrgID); err != nil {
+		return err
+	}
+	backups, err := tx.Backups().ListByInstance(ctx, inst.ID)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if b.Status == models.BackupPending || b.Status == models.BackupRunning {
+			logger.Info("skipping scheduled backup", "reason", "a backup is in progress", "backup_id", b.ID)
+			return nil
+		}
+	}
+
+	backup := &models.Backup{InstanceID: inst.ID, Kind: models.BackupScheduled, Status: models.BackupPending}
+	if err := tx.Backups().Create(ctx, backup); err != nil {
+		return err
+	}
+	job, err := jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeBackupInstance, jobs.BackupPayload{
+		InstanceID:    inst.ID,
+		OrgID:         project.OrgID,
+		BackupID:      backup.ID,
+		RetentionDays: policy.RetentionDays,
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("scheduled backup", "backup_id", backup.ID, "job_id", job.ID, "next_run_at", policy.NextRunAt)
+	return nil
+}
+
+// scheduleWALArchiving enqueues an archive_wal job for each running
+// instance whose policy archives WAL and is due, and moves the policy to
+// its next run. A wal_archive_interval of 0 turns this off.
+func (s *Scheduler) scheduleWALArchiving(ctx context.Context, now time.Time) error {
+	if s.walInterval <= 0 {
+		return nil
+	}
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		policies, err := tx.BackupPolicies().ListWALDue(ctx, now, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range policies {
+			policy := &policies[i]
+			policy.NextWALArchiveAt = now.Add(s.walInterval)
+			if err := tx.BackupPolicies().Put(ctx, policy); err != nil {
+				return err
+			}
+
+			inst, err := tx.Instances().Get(ctx, policy.InstanceID)
+			if err != nil {
+				return err
+			}
+			if inst.Status != models.InstanceRunning {
+				continue
+			}
+			project, err := tx.Projects().Get(ctx, inst.ProjectID)
+			if err != nil {
+				return err
+			}
+			_, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeArchiveWAL, jobs.InstancePayload{
+				InstanceID: inst.ID,
+				OrgID:      project.OrgID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneBackups marks expired backups as deleting and enqueues the jobs
+// that remove them.
+func (s *Scheduler) pruneBackups(ctx context.Context, now time.Time) error {
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		backups, err := tx.Backups().ListExpired(ctx, now, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range backups {
+			backup := &backups[i]
+			inst, err := tx.Instances().Get(ctx, backup.InstanceID)
+			if err != nil {
+				return err
+			}
+			project, err := tx.Projects().Get(ctx, inst.ProjectID)
+			if err != nil {
+				return err
+			}
+
+			backup.Status = models.BackupDeleting
+			if err := tx.Backups().Update(ctx, backup); err != nil {
+				return err
+			}
+			_, err = jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeDeleteBackup, jobs.BackupPayload{
+				InstanceID: inst.ID,
+				OrgID:      project.OrgID,
+				BackupID:   backup.ID,
+			})
+			if err != nil {
+				return err
+			}
+			s.logger.Info("pruning expired backup", "instance_id", inst.ID, "backup_id", backup.ID, "expired_at", backup.ExpiresAt)
+		}
+		return nil
+	})
+}
+
+// scheduleDNSReconcile enqueues a reconcile_dns job once every
+// dns.reconcile_interval, whichever scheduler claims it first. An interval
+// of 0 turns this off.
+func (s *Scheduler) scheduleDNSReconcile(ctx context.Context, now time.Time) error {
+	if s.dnsInterval <= 0 {
+		return nil
+	}
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		due, err := tx.DNSRecords().ClaimReconcile(ctx, now, s.dnsInterval)
+		if err != nil || !due {
+			return err
+		}
+		job, err := jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeReconcileDNS, struct{}{})
+		if err != nil {
+			return err
+		}
+		s.logger.Info("scheduled DNS reconciliation", "job_id", job.ID)
+		return nil
+	})
+}
+
+// scheduleRenewals enqueues an issue_certificate job for each running
+// instance whose certificate is due for renewal, and moves the renewal
+// renewalRetry on, so a renewal that fails, or of an instance that isn't
+// running, is tried again then. A tls.issuer of none turns this off.
+func (s *Scheduler) scheduleRenewals(ctx context.Context, now time.Time) error {
+	if !s.renewals {
+		return nil
+	}
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		certs, err := tx.Certificates().ListDue(ctx, now, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range certs {
+			cert := &certs[i]
+			cert.RenewAt = now.Add(renewalRetry)
+			if err := tx.Certificates().Put(ctx, cert); err != nil {
+				return err
+			}
+
+			inst, err := tx.Instances().Get(ctx, cert.InstanceID)
+			if err != nil {
+				return err
+			}
+			if inst.Status != models.InstanceRunning {
+				continue
+			}
+			project, err := tx.Projects().Get(ctx, inst.ProjectID)
+			if err != nil {
+				return err
+			}
+			job, err := jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeIssueCertificate, jobs.InstancePayload{
+				InstanceID: inst.ID,
+				OrgID:      project.OrgID,
+			})
+			if err != nil {
+				return err
+			}
+			s.logger.Info("scheduled certificate renewal", "instance_id", inst.ID, "job_id", job.ID, "not_after", cert.NotAfter)
+		}
+		return nil
+	})
+}
+
+// scheduleDomainChecks enqueues a verify_domain job for each pending domain
+// due for a check, and moves its next check domains.check_interval on. The
+// job fails the domain once it has expired.
+func (s *Scheduler) scheduleDomainChecks(ctx context.Context, now time.Time) error {
+	return s.store.InTx(ctx, func(tx store.Store) error {
+		domains, err := tx.Domains().ListDue(ctx, now, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range domains {
+			domain := &domains[i]
+			next := now.Add(s.domainInterval)
+			domain.NextCheckAt = &next
+			if err := tx.Domains().Update(ctx, domain); err != nil {
+				return err
+			}
+
+			inst, err := tx.Instances().Get(ctx, domain.InstanceID)
+			if err != nil {
+				return err
+			}
+			project, err := tx.Projects().Get(ctx, inst.ProjectID)
+			if err != nil {
+				return err
+			}
+			job, err := jobs.NewQueue(tx.Jobs()).Enqueue(ctx, jobs.TypeVerifyDomain, jobs.DomainPayload{
+				InstanceID: inst.ID,
+				OrgID:      project.OrgID,
+				DomainID:   domain.ID,
+			})
+			if err != nil {
+				return err
+			}
+			s.logger.Info("scheduled domain check", "instance_id", inst.ID, "domain", domain.Name, "job_id", job.ID)
+		}
+		return nil
+	})
+}
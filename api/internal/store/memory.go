@@ -0,0 +1,1870 @@
+package store
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/pglsn"
+	"github.com/google/uuid"
+)
+
+// Memory implements Store in process memory, enforcing the same uniqueness
+// and foreign key rules and cascading deletes as the Postgres schema. It is
+// meant for tests and `server --dev`: a transaction runs alone, with calls
+// made outside it waiting until it ends, so rolling it back by restoring a
+// snapshot can't lose anyone else's writes.
+type Memory struct {
+	*memState
+	// inTx is set on the Store InTx passes to its callback, whose calls
+	// don't wait for the transaction they are part of.
+	inTx bool
+}
+
+type memState struct {
+	// txMu is held by a transaction for its whole run, and by every call
+	// outside one for its own
+	txMu sync.Mutex
+	mu   sync.Mutex
+	data memData
+}
+
+type memberKey struct{ userID, orgID string }
+
+type walSegmentKey struct{ instanceID, name string }
+
+type memData struct {
+	users       map[string]models.User
+	identities  map[string]models.UserIdentity
+	orgs        map[string]models.Org
+	memberships map[memberKey]models.Membership
+	ssoConns    map[string]models.SSOConnection
+	ssoDomains  map[string]models.SSODomain
+	ssoStates   map[string]models.SSOLoginState
+	devices     map[string]models.DeviceAuthorization
+	projects    map[string]models.Project
+	instances   map[string]models.Instance
+	plans       map[string]models.Plan
+	orgQuotas   map[string]models.Quota
+	projQuotas  map[string]models.Quota
+	upgrades    map[string]models.Upgrade
+	policies    map[string]models.BackupPolicy
+	backups     map[string]models.Backup
+	walSegments map[walSegmentKey]models.WALSegment
+	netPolicies map[string]models.NetworkPolicy
+	networks    map[string]models.PrivateNetwork
+	peers       map[string]models.WireGuardPeer
+	dnsRecords  map[string]models.DNSRecord
+	certs       map[string]models.Certificate
+	domains     map[string]models.Domain
+	jobs        map[string]models.Job
+	heartbeats  map[string]time.Time
+
+	// nextReconcile is when the DNS records are next reconciled
+	nextReconcile time.Time
+}
+
+var _ Store = (*Memory)(nil)
+
+// defaultPlans is the catalog a Memory store starts with, the same that
+// migration 006 seeds.
+var defaultPlans = []models.Plan{
+	{Name: "nano", VCPUs: 1, MemoryMB: 2048, DiskGiB: 20, MaxConnections: 100},
+	{Name: "lite", VCPUs: 2, MemoryMB: 4096, DiskGiB: 80, MaxConnections: 200},
+	{Name: "pro", VCPUs: 4, MemoryMB: 8192, DiskGiB: 150, MaxConnections: 400},
+	{Name: "pro-heavy", VCPUs: 8, MemoryMB: 16384, DiskGiB: 300, MaxConnections: 800},
+}
+
+func NewMemory() *Memory {
+	plans := make(map[string]models.Plan, len(defaultPlans))
+	now := time.Now()
+	for _, p := range defaultPlans {
+		p.MinDiskGiB, p.MaxDiskGiB = 10, 2048
+		p.PgVersions = []int{14, 15, 16, 17}
+		p.CreatedAt = now
+		plans[p.Name] = p
+	}
+
+	return &Memory{memState: &memState{data: memData{
+		users:       make(map[string]models.User),
+		identities:  make(map[string]models.UserIdentity),
+		orgs:        make(map[string]models.Org),
+		memberships: make(map[memberKey]models.Membership),
+		ssoConns:    make(map[string]models.SSOConnection),
+		ssoDomains:  make(map[string]models.SSODomain),
+		ssoStates:   make(map[string]models.SSOLoginState),
+		devices:     make(map[string]models.DeviceAuthorization),
+		projects:    make(map[string]models.Project),
+		instances:   make(map[string]models.Instance),
+		plans:       plans,
+		orgQuotas:   make(map[string]models.Quota),
+		projQuotas:  make(map[string]models.Quota),
+		upgrades:    make(map[string]models.Upgrade),
+		policies:    make(map[string]models.BackupPolicy),
+		backups:     make(map[string]models.Backup),
+		walSegments: make(map[walSegmentKey]models.WALSegment),
+		netPolicies: make(map[string]models.NetworkPolicy),
+		networks:    make(map[string]models.PrivateNetwork),
+		peers:       make(map[string]models.WireGuardPeer),
+		dnsRecords:  make(map[string]models.DNSRecord),
+		certs:       make(map[string]models.Certificate),
+		domains:     make(map[string]models.Domain),
+		jobs:        make(map[string]models.Job),
+		heartbeats:  make(map[string]time.Time),
+	}}}
+}
+
+func (s *Memory) Users() Users                               { return memUsers{s} }
+func (s *Memory) UserIdentities() UserIdentities             { return memUserIdentities{s} }
+func (s *Memory) Orgs() Orgs                                 { return memOrgs{s} }
+func (s *Memory) Memberships() Memberships                   { return memMemberships{s} }
+func (s *Memory) SSOConnections() SSOConnections             { return memSSOConnections{s} }
+func (s *Memory) SSODomains() SSODomains                     { return memSSODomains{s} }
+func (s *Memory) SSOLoginStates() SSOLoginStates             { return memSSOLoginStates{s} }
+func (s *Memory) Projects() Projects                         { return memProjects{s} }
+func (s *Memory) Instances() Instances                       { return memInstances{s} }
+func (s *Memory) Plans() Plans                               { return memPlans{s} }
+func (s *Memory) Quotas() Quotas                             { return memQuotas{s} }
+func (s *Memory) Upgrades() Upgrades                         { return memUpgrades{s} }
+func (s *Memory) BackupPolicies() BackupPolicies             { return memBackupPolicies{s} }
+func (s *Memory) Backups() Backups                           { return memBackups{s} }
+func (s *Memory) WALSegments() WALSegments                   { return memWALSegments{s} }
+func (s *Memory) NetworkPolicies() NetworkPolicies           { return memNetworkPolicies{s} }
+func (s *Memory) PrivateNetworks() PrivateNetworks           { return memPrivateNetworks{s} }
+func (s *Memory) WireGuardPeers() WireGuardPeers             { return memWireGuardPeers{s} }
+func (s *Memory) DNSRecords() DNSRecords                     { return memDNSRecords{s} }
+func (s *Memory) Certificates() Certificates                 { return memCertificates{s} }
+func (s *Memory) Domains() Domains                           { return memDomains{s} }
+func (s *Memory) Jobs() Jobs                                 { return memJobs{s} }
+func (s *Memory) Workers() Workers                           { return memWorkers{s} }
+func (s *Memory) DeviceAuthorizations() DeviceAuthorizations { return memDeviceAuthorizations{s} }
+
+// InTx runs fn alone, restoring the data as it was before if fn fails.
+// Nested calls join the running transaction.
+func (s *Memory) InTx(ctx context.Context, fn func(tx Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.Lock()
+	snapshot := s.data.clone()
+	s.mu.Unlock()
+
+	if err := fn(&Memory{memState: s.memState, inTx: true}); err != nil {
+		s.mu.Lock()
+		s.data = snapshot
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// lock locks the data for one call. Outside a transaction it first waits
+// for the running one, if any, to end.
+func (s *Memory) lock() {
+	if !s.inTx {
+		s.txMu.Lock()
+	}
+	s.mu.Lock()
+}
+
+func (s *Memory) unlock() {
+	s.mu.Unlock()
+	if !s.inTx {
+		s.txMu.Unlock()
+	}
+}
+
+func (d memData) clone() memData {
+	return memData{
+		users:       cloneMap(d.users),
+		identities:  cloneMap(d.identities),
+		orgs:        cloneMap(d.orgs),
+		memberships: cloneMap(d.memberships),
+		ssoConns:    cloneMap(d.ssoConns),
+		ssoDomains:  cloneMap(d.ssoDomains),
+		ssoStates:   cloneMap(d.ssoStates),
+		devices:     cloneMap(d.devices),
+		projects:    cloneMap(d.projects),
+		instances:   cloneMap(d.instances),
+		plans:       cloneMap(d.plans),
+		orgQuotas:   cloneMap(d.orgQuotas),
+		projQuotas:  cloneMap(d.projQuotas),
+		upgrades:    cloneMap(d.upgrades),
+		policies:    cloneMap(d.policies),
+		backups:     cloneMap(d.backups),
+		walSegments: cloneMap(d.walSegments),
+		netPolicies: cloneMap(d.netPolicies),
+		networks:    cloneMap(d.networks),
+		peers:       cloneMap(d.peers),
+		dnsRecords:  cloneMap(d.dnsRecords),
+		certs:       cloneMap(d.certs),
+		domains:     cloneMap(d.domains),
+		jobs:        cloneMap(d.jobs),
+		heartbeats:  cloneMap(d.heartbeats),
+
+		nextReconcile: d.nextReconcile,
+	}
+}
+
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// deleteOrg, deleteProject and deleteInstance cascade like the foreign keys in the schema.
+// The caller holds s.mu.
+func (s *Memory) deleteOrg(id string) {
+	delete(s.data.orgs, id)
+	delete(s.data.orgQuotas, id)
+	delete(s.data.ssoConns, id)
+	for did, d := range s.data.ssoDomains {
+		if d.OrgID == id {
+			delete(s.data.ssoDomains, did)
+		}
+	}
+	for state, st := range s.data.ssoStates {
+		if st.OrgID == id {
+			delete(s.data.ssoStates, state)
+		}
+	}
+	for did, d := range s.data.devices {
+		if d.SSOOrgID == id {
+			d.SSOOrgID = ""
+			s.data.devices[did] = d
+		}
+	}
+	for k := range s.data.memberships {
+		if k.orgID == id {
+			delete(s.data.memberships, k)
+		}
+	}
+	for pid, p := range s.data.projects {
+		if p.OrgID == id {
+			s.deleteProject(pid)
+		}
+	}
+	for nid, n := range s.data.networks {
+		if n.OrgID == id {
+			delete(s.data.networks, nid)
+			for peerID, peer := range s.data.peers {
+				if peer.NetworkID == nid {
+					delete(s.data.peers, peerID)
+				}
+			}
+		}
+	}
+}
+
+func (s *Memory) deleteProject(id string) {
+	delete(s.data.projects, id)
+	delete(s.data.projQuotas, id)
+	for iid, inst := range s.data.instances {
+		if inst.ProjectID == id {
+			s.deleteInstance(iid)
+		}
+	}
+}
+
+func (s *Memory) deleteInstance(id string) {
+	delete(s.data.instances, id)
+	for uid, u := range s.data.upgrades {
+		if u.InstanceID == id {
+			delete(s.data.upgrades, uid)
+		}
+	}
+	for pid, p := range s.data.policies {
+		if p.InstanceID == id {
+			delete(s.data.policies, pid)
+		}
+	}
+	for bid, b := range s.data.backups {
+		if b.InstanceID == id {
+			delete(s.data.backups, bid)
+		}
+	}
+	for k := range s.data.walSegments {
+		if k.instanceID == id {
+			delete(s.data.walSegments, k)
+		}
+	}
+	delete(s.data.netPolicies, id)
+	delete(s.data.dnsRecords, id)
+	delete(s.data.certs, id)
+	for did, d := range s.data.domains {
+		if d.InstanceID == id {
+			delete(s.data.domains, did)
+		}
+	}
+}
+
+type memUsers struct{ s *Memory }
+
+func (r memUsers) Create(ctx context.Context, user *models.User) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, u := range r.s.data.users {
+		if u.Email == user.Email {
+			return ErrConflict
+		}
+	}
+	newID(&user.ID)
+	if _, ok := r.s.data.users[user.ID]; ok {
+		return ErrConflict
+	}
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	r.s.data.users[user.ID] = *user
+	return nil
+}
+
+func (r memUsers) Get(ctx context.Context, id string) (*models.User, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	user, ok := r.s.data.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (r memUsers) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, u := range r.s.data.users {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type memUserIdentities struct{ s *Memory }
+
+func (r memUserIdentities) Get(ctx context.Context, issuer, subject string) (*models.UserIdentity, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, identity := range r.s.data.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memUserIdentities) Create(ctx context.Context, identity *models.UserIdentity) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.users[identity.UserID]; !ok {
+		return ErrNotFound
+	}
+	for _, other := range r.s.data.identities {
+		if other.Issuer == identity.Issuer && other.Subject == identity.Subject {
+			return ErrConflict
+		}
+	}
+	newID(&identity.ID)
+	now := time.Now()
+	identity.CreatedAt, identity.LastLoginAt = now, &now
+	r.s.data.identities[identity.ID] = *identity
+	return nil
+}
+
+func (r memUserIdentities) Touch(ctx context.Context, id, email string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	identity, ok := r.s.data.identities[id]
+	if !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	identity.Email, identity.LastLoginAt = email, &now
+	r.s.data.identities[id] = identity
+	return nil
+}
+
+type memOrgs struct{ s *Memory }
+
+func (r memOrgs) Create(ctx context.Context, org *models.Org) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	newID(&org.ID)
+	if _, ok := r.s.data.orgs[org.ID]; ok {
+		return ErrConflict
+	}
+	now := time.Now()
+	org.CreatedAt, org.UpdatedAt = now, now
+	r.s.data.orgs[org.ID] = *org
+	return nil
+}
+
+func (r memOrgs) Get(ctx context.Context, id string) (*models.Org, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	org, ok := r.s.data.orgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &org, nil
+}
+
+func (r memOrgs) ListForUser(ctx context.Context, userID string) ([]OrgWithRole, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	orgs := []OrgWithRole{}
+	for k, m := range r.s.data.memberships {
+		if k.userID == userID {
+			orgs = append(orgs, OrgWithRole{Org: r.s.data.orgs[k.orgID], Role: m.Role})
+		}
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].CreatedAt.After(orgs[j].CreatedAt) })
+	return orgs, nil
+}
+
+func (r memOrgs) Update(ctx context.Context, org *models.Org) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.orgs[org.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Name = org.Name
+	stored.UpdatedAt = time.Now()
+	r.s.data.orgs[org.ID] = stored
+	*org = stored
+	return nil
+}
+
+func (r memOrgs) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.deleteOrg(id)
+	return nil
+}
+
+// Lock only checks that the org exists: transactions on Memory are already
+// serialized.
+func (r memOrgs) Lock(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[id]; !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type memMemberships struct{ s *Memory }
+
+func (r memMemberships) Create(ctx context.Context, m *models.Membership) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.users[m.UserID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := r.s.data.orgs[m.OrgID]; !ok {
+		return ErrNotFound
+	}
+	key := memberKey{m.UserID, m.OrgID}
+	if _, ok := r.s.data.memberships[key]; ok {
+		return ErrConflict
+	}
+	r.s.data.memberships[key] = *m
+	return nil
+}
+
+func (r memMemberships) Get(ctx context.Context, userID, orgID string) (*models.Membership, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	m, ok := r.s.data.memberships[memberKey{userID, orgID}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &m, nil
+}
+
+func (r memMemberships) ListByOrg(ctx context.Context, orgID string) ([]models.Membership, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	memberships := []models.Membership{}
+	for k, m := range r.s.data.memberships {
+		if k.orgID == orgID {
+			memberships = append(memberships, m)
+		}
+	}
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].UserID < memberships[j].UserID })
+	return memberships, nil
+}
+
+func (r memMemberships) Delete(ctx context.Context, userID, orgID string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	key := memberKey{userID, orgID}
+	if _, ok := r.s.data.memberships[key]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.memberships, key)
+	return nil
+}
+
+type memSSOConnections struct{ s *Memory }
+
+func (r memSSOConnections) Get(ctx context.Context, orgID string) (*models.SSOConnection, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	conn, ok := r.s.data.ssoConns[orgID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	conn.AutoJoinDomains = append([]string{}, conn.AutoJoinDomains...)
+	return &conn, nil
+}
+
+func (r memSSOConnections) Put(ctx context.Context, conn *models.SSOConnection) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[conn.OrgID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	conn.CreatedAt, conn.UpdatedAt = now, now
+	if stored, ok := r.s.data.ssoConns[conn.OrgID]; ok {
+		conn.CreatedAt = stored.CreatedAt
+		if conn.ClientSecret == "" {
+			conn.ClientSecret = stored.ClientSecret
+		}
+	}
+	stored := *conn
+	stored.AutoJoinDomains = append([]string{}, conn.AutoJoinDomains...)
+	stored.Domains = nil
+	r.s.data.ssoConns[conn.OrgID] = stored
+	return nil
+}
+
+func (r memSSOConnections) Delete(ctx context.Context, orgID string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.ssoConns[orgID]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.ssoConns, orgID)
+	return nil
+}
+
+type memSSODomains struct{ s *Memory }
+
+func (r memSSODomains) Create(ctx context.Context, domain *models.SSODomain) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[domain.OrgID]; !ok {
+		return ErrNotFound
+	}
+	for _, other := range r.s.data.ssoDomains {
+		if other.OrgID == domain.OrgID && other.Name == domain.Name {
+			return ErrConflict
+		}
+	}
+	newID(&domain.ID)
+	if domain.Status == "" {
+		domain.Status = models.DomainPending
+	}
+	now := time.Now()
+	domain.CreatedAt, domain.UpdatedAt = now, now
+	r.s.data.ssoDomains[domain.ID] = *domain
+	return nil
+}
+
+func (r memSSODomains) ListByOrg(ctx context.Context, orgID string) ([]models.SSODomain, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	domains := []models.SSODomain{}
+	for _, d := range r.s.data.ssoDomains {
+		if d.OrgID == orgID {
+			domains = append(domains, d)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	return domains, nil
+}
+
+func (r memSSODomains) GetVerified(ctx context.Context, name string) (*models.SSODomain, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, d := range r.s.data.ssoDomains {
+		if d.Name == name && d.Status == models.DomainVerified {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memSSODomains) Update(ctx context.Context, domain *models.SSODomain) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.ssoDomains[domain.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if domain.Status == models.DomainVerified {
+		for id, other := range r.s.data.ssoDomains {
+			if id != domain.ID && other.Name == stored.Name && other.Status == models.DomainVerified {
+				return ErrConflict
+			}
+		}
+	}
+	stored.Status, stored.ErrorMessage, stored.VerifiedAt = domain.Status, domain.ErrorMessage, domain.VerifiedAt
+	stored.UpdatedAt = time.Now()
+	r.s.data.ssoDomains[domain.ID] = stored
+	*domain = stored
+	return nil
+}
+
+func (r memSSODomains) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.ssoDomains[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.ssoDomains, id)
+	return nil
+}
+
+type memSSOLoginStates struct{ s *Memory }
+
+func (r memSSOLoginStates) Create(ctx context.Context, state *models.SSOLoginState) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[state.OrgID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	for key, st := range r.s.data.ssoStates {
+		if st.ExpiresAt.Before(now) {
+			delete(r.s.data.ssoStates, key)
+		}
+	}
+	if _, ok := r.s.data.ssoStates[state.State]; ok {
+		return ErrConflict
+	}
+	r.s.data.ssoStates[state.State] = *state
+	return nil
+}
+
+func (r memSSOLoginStates) Take(ctx context.Context, state string) (*models.SSOLoginState, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	st, ok := r.s.data.ssoStates[state]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(r.s.data.ssoStates, state)
+	if !st.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return &st, nil
+}
+
+type memDeviceAuthorizations struct{ s *Memory }
+
+func (r memDeviceAuthorizations) Create(ctx context.Context, authz *models.DeviceAuthorization) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	now := time.Now()
+	for id, d := range r.s.data.devices {
+		if d.ExpiresAt.Before(now) {
+			delete(r.s.data.devices, id)
+		}
+	}
+	for _, d := range r.s.data.devices {
+		if d.UserCode == authz.UserCode || d.DeviceCodeHash == authz.DeviceCodeHash {
+			return ErrConflict
+		}
+	}
+	newID(&authz.ID)
+	if authz.Status == "" {
+		authz.Status = models.DevicePending
+	}
+	authz.CreatedAt = now
+	r.s.data.devices[authz.ID] = *authz
+	return nil
+}
+
+func (r memDeviceAuthorizations) GetByDeviceCode(ctx context.Context, hash string) (*models.DeviceAuthorization, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, d := range r.s.data.devices {
+		if d.DeviceCodeHash == hash {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memDeviceAuthorizations) GetPending(ctx context.Context, userCode string) (*models.DeviceAuthorization, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	now := time.Now()
+	for _, d := range r.s.data.devices {
+		if d.UserCode == userCode && d.Status == models.DevicePending && d.ExpiresAt.After(now) {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memDeviceAuthorizations) Update(ctx context.Context, authz *models.DeviceAuthorization) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.devices[authz.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if authz.UserID != "" {
+		if _, ok := r.s.data.users[authz.UserID]; !ok {
+			return ErrNotFound
+		}
+	}
+	stored.Status, stored.UserID, stored.SSOOrgID = authz.Status, authz.UserID, authz.SSOOrgID
+	stored.PollInterval, stored.LastPolledAt = authz.PollInterval, authz.LastPolledAt
+	r.s.data.devices[authz.ID] = stored
+	*authz = stored
+	return nil
+}
+
+func (r memDeviceAuthorizations) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.devices[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.devices, id)
+	return nil
+}
+
+type memProjects struct{ s *Memory }
+
+func (r memProjects) Create(ctx context.Context, project *models.Project) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[project.OrgID]; !ok {
+		return ErrNotFound
+	}
+	for _, p := range r.s.data.projects {
+		if p.OrgID == project.OrgID && p.Name == project.Name {
+			return ErrConflict
+		}
+	}
+	newID(&project.ID)
+	project.CreatedAt = time.Now()
+	r.s.data.projects[project.ID] = *project
+	return nil
+}
+
+func (r memProjects) Get(ctx context.Context, id string) (*models.Project, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	p, ok := r.s.data.projects[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (r memProjects) ListByOrg(ctx context.Context, orgID string) ([]models.Project, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	projects := []models.Project{}
+	for _, p := range r.s.data.projects {
+		if p.OrgID == orgID {
+			projects = append(projects, p)
+		}
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].CreatedAt.Before(projects[j].CreatedAt) })
+	return projects, nil
+}
+
+func (r memProjects) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.projects[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.deleteProject(id)
+	return nil
+}
+
+type memInstances struct{ s *Memory }
+
+func (r memInstances) Create(ctx context.Context, inst *models.Instance) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.projects[inst.ProjectID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := r.s.data.plans[inst.Plan]; !ok {
+		return ErrNotFound
+	}
+	if err := r.checkUnique(inst); err != nil {
+		return err
+	}
+	newID(&inst.ID)
+	now := time.Now()
+	inst.CreatedAt, inst.UpdatedAt = now, now
+	stored := *inst
+	stored.RestoredFrom = copyRestoreSource(inst.RestoredFrom)
+	r.s.data.instances[inst.ID] = stored
+	return nil
+}
+
+// copyRestoreSource copies src, so callers can't change a stored instance
+// through the pointer.
+func copyRestoreSource(src *models.RestoreSource) *models.RestoreSource {
+	if src == nil {
+		return nil
+	}
+	c := *src
+	return &c
+}
+
+// checkUnique enforces the unique names within a project and container IDs
+// within a node.
+func (r memInstances) checkUnique(inst *models.Instance) error {
+	for id, other := range r.s.data.instances {
+		if id == inst.ID {
+			continue
+		}
+		if other.ProjectID == inst.ProjectID && other.Name == inst.Name {
+			return ErrConflict
+		}
+		if inst.Node != "" && inst.CTID != 0 && other.Node == inst.Node && other.CTID == inst.CTID {
+			return ErrConflict
+		}
+		if inst.PrivateAddress != "" && other.PrivateAddress == inst.PrivateAddress {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (r memInstances) Get(ctx context.Context, id string) (*models.Instance, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	inst, ok := r.s.data.instances[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &inst, nil
+}
+
+func (r memInstances) ListByProject(ctx context.Context, projectID string) ([]models.Instance, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	instances := []models.Instance{}
+	for _, inst := range r.s.data.instances {
+		if inst.ProjectID == projectID {
+			instances = append(instances, inst)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].CreatedAt.Before(instances[j].CreatedAt) })
+	return instances, nil
+}
+
+func (r memInstances) ListByOrg(ctx context.Context, orgID string) ([]models.Instance, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	instances := []models.Instance{}
+	for _, inst := range r.s.data.instances {
+		if r.s.data.projects[inst.ProjectID].OrgID == orgID {
+			instances = append(instances, inst)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].CreatedAt.Before(instances[j].CreatedAt) })
+	return instances, nil
+}
+
+func (r memInstances) ListByStatus(ctx context.Context, status string) ([]models.Instance, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	instances := []models.Instance{}
+	for _, inst := range r.s.data.instances {
+		if inst.Status == status {
+			instances = append(instances, inst)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].CreatedAt.Before(instances[j].CreatedAt) })
+	return instances, nil
+}
+
+func (r memInstances) Update(ctx context.Context, inst *models.Instance) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.instances[inst.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := r.s.data.plans[inst.Plan]; !ok {
+		return ErrNotFound
+	}
+	if err := r.checkUnique(inst); err != nil {
+		return err
+	}
+	// Only the fields the Postgres UPDATE sets change
+	stored.Name, stored.Plan, stored.PgVersion = inst.Name, inst.Plan, inst.PgVersion
+	stored.Node, stored.CTID, stored.FQDN, stored.Status = inst.Node, inst.CTID, inst.FQDN, inst.Status
+	stored.DiskGiB, stored.RestoredFrom = inst.DiskGiB, copyRestoreSource(inst.RestoredFrom)
+	stored.PrivateAddress = inst.PrivateAddress
+	stored.UpdatedAt = time.Now()
+	r.s.data.instances[inst.ID] = stored
+	*inst = stored
+	return nil
+}
+
+func (r memInstances) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.deleteInstance(id)
+	return nil
+}
+
+type memPlans struct{ s *Memory }
+
+func (r memPlans) List(ctx context.Context) ([]models.Plan, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	plans := make([]models.Plan, 0, len(r.s.data.plans))
+	for _, p := range r.s.data.plans {
+		plans = append(plans, p)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		a, b := plans[i], plans[j]
+		if a.VCPUs != b.VCPUs {
+			return a.VCPUs < b.VCPUs
+		}
+		if a.MemoryMB != b.MemoryMB {
+			return a.MemoryMB < b.MemoryMB
+		}
+		return a.Name < b.Name
+	})
+	return plans, nil
+}
+
+func (r memPlans) Get(ctx context.Context, name string) (*models.Plan, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	p, ok := r.s.data.plans[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+type memQuotas struct{ s *Memory }
+
+// quotaScope picks the org or project overrides from d along with the
+// records they belong to.
+type quotaScope func(d *memData) (quotas map[string]models.Quota, exists func(id string) bool)
+
+func orgQuotas(d *memData) (map[string]models.Quota, func(string) bool) {
+	return d.orgQuotas, func(id string) bool { _, ok := d.orgs[id]; return ok }
+}
+
+func projectQuotas(d *memData) (map[string]models.Quota, func(string) bool) {
+	return d.projQuotas, func(id string) bool { _, ok := d.projects[id]; return ok }
+}
+
+func (r memQuotas) GetOrg(ctx context.Context, orgID string) (*models.Quota, error) {
+	return r.get(orgQuotas, orgID)
+}
+
+func (r memQuotas) SetOrg(ctx context.Context, orgID string, quota *models.Quota) error {
+	return r.set(orgQuotas, orgID, quota)
+}
+
+func (r memQuotas) DeleteOrg(ctx context.Context, orgID string) error {
+	return r.delete(orgQuotas, orgID)
+}
+
+func (r memQuotas) GetProject(ctx context.Context, projectID string) (*models.Quota, error) {
+	return r.get(projectQuotas, projectID)
+}
+
+func (r memQuotas) SetProject(ctx context.Context, projectID string, quota *models.Quota) error {
+	return r.set(projectQuotas, projectID, quota)
+}
+
+func (r memQuotas) DeleteProject(ctx context.Context, projectID string) error {
+	return r.delete(projectQuotas, projectID)
+}
+
+func (r memQuotas) get(scope quotaScope, id string) (*models.Quota, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	quotas, _ := scope(&r.s.data)
+	q, ok := quotas[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &q, nil
+}
+
+func (r memQuotas) set(scope quotaScope, id string, quota *models.Quota) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	quotas, exists := scope(&r.s.data)
+	if !exists(id) {
+		return ErrNotFound
+	}
+	quota.UpdatedAt = time.Now()
+	quotas[id] = *quota
+	return nil
+}
+
+func (r memQuotas) delete(scope quotaScope, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	quotas, _ := scope(&r.s.data)
+	if _, ok := quotas[id]; !ok {
+		return ErrNotFound
+	}
+	delete(quotas, id)
+	return nil
+}
+
+type memUpgrades struct{ s *Memory }
+
+func (r memUpgrades) Create(ctx context.Context, u *models.Upgrade) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[u.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	newID(&u.ID)
+	now := time.Now()
+	u.CreatedAt, u.UpdatedAt = now, now
+	r.s.data.upgrades[u.ID] = *u
+	return nil
+}
+
+func (r memUpgrades) Get(ctx context.Context, id string) (*models.Upgrade, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	u, ok := r.s.data.upgrades[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+func (r memUpgrades) ListByInstance(ctx context.Context, instanceID string) ([]models.Upgrade, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	upgrades := []models.Upgrade{}
+	for _, u := range r.s.data.upgrades {
+		if u.InstanceID == instanceID {
+			upgrades = append(upgrades, u)
+		}
+	}
+	sort.Slice(upgrades, func(i, j int) bool { return upgrades[i].CreatedAt.After(upgrades[j].CreatedAt) })
+	return upgrades, nil
+}
+
+func (r memUpgrades) Update(ctx context.Context, u *models.Upgrade) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.upgrades[u.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	// Only the fields the Postgres UPDATE sets change
+	stored.Status, stored.GreenNode, stored.GreenCTID = u.Status, u.GreenNode, u.GreenCTID
+	stored.CutOverAt, stored.RollbackUntil = u.CutOverAt, u.RollbackUntil
+	stored.UpdatedAt = time.Now()
+	r.s.data.upgrades[u.ID] = stored
+	*u = stored
+	return nil
+}
+
+type memBackupPolicies struct{ s *Memory }
+
+func (r memBackupPolicies) GetByInstance(ctx context.Context, instanceID string) (*models.BackupPolicy, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, p := range r.s.data.policies {
+		if p.InstanceID == instanceID {
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memBackupPolicies) Put(ctx context.Context, p *models.BackupPolicy) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[p.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	stored := *p
+	stored.CreatedAt, stored.UpdatedAt = now, now
+	for _, existing := range r.s.data.policies {
+		if existing.InstanceID == p.InstanceID {
+			stored.ID, stored.CreatedAt = existing.ID, existing.CreatedAt
+		}
+	}
+	newID(&stored.ID)
+	r.s.data.policies[stored.ID] = stored
+	*p = stored
+	return nil
+}
+
+func (r memBackupPolicies) DeleteByInstance(ctx context.Context, instanceID string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for id, p := range r.s.data.policies {
+		if p.InstanceID == instanceID {
+			delete(r.s.data.policies, id)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// ListDue needs no locking: memory transactions are serialized.
+func (r memBackupPolicies) ListDue(ctx context.Context, now time.Time, limit int) ([]models.BackupPolicy, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	policies := []models.BackupPolicy{}
+	for _, p := range r.s.data.policies {
+		if !p.NextRunAt.After(now) {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].NextRunAt.Before(policies[j].NextRunAt) })
+	if len(policies) > limit {
+		policies = policies[:limit]
+	}
+	return policies, nil
+}
+
+func (r memBackupPolicies) ListWALDue(ctx context.Context, now time.Time, limit int) ([]models.BackupPolicy, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	policies := []models.BackupPolicy{}
+	for _, p := range r.s.data.policies {
+		if p.WALArchiving && !p.NextWALArchiveAt.After(now) {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].NextWALArchiveAt.Before(policies[j].NextWALArchiveAt) })
+	if len(policies) > limit {
+		policies = policies[:limit]
+	}
+	return policies, nil
+}
+
+type memBackups struct{ s *Memory }
+
+func (r memBackups) Create(ctx context.Context, b *models.Backup) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[b.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	newID(&b.ID)
+	b.CreatedAt = time.Now()
+	r.s.data.backups[b.ID] = *b
+	return nil
+}
+
+func (r memBackups) Get(ctx context.Context, id string) (*models.Backup, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	b, ok := r.s.data.backups[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &b, nil
+}
+
+func (r memBackups) ListByInstance(ctx context.Context, instanceID string) ([]models.Backup, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	backups := []models.Backup{}
+	for _, b := range r.s.data.backups {
+		if b.InstanceID == instanceID {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+func (r memBackups) Update(ctx context.Context, b *models.Backup) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.backups[b.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	// Only the fields the Postgres UPDATE sets change
+	stored.Status, stored.PgVersion, stored.RepoURL = b.Status, b.PgVersion, b.RepoURL
+	stored.SizeBytes, stored.ErrorMessage = b.SizeBytes, b.ErrorMessage
+	stored.StartedAt, stored.CompletedAt, stored.ExpiresAt = b.StartedAt, b.CompletedAt, b.ExpiresAt
+	stored.StartLSN, stored.EndLSN = b.StartLSN, b.EndLSN
+	r.s.data.backups[b.ID] = stored
+	*b = stored
+	return nil
+}
+
+func (r memBackups) ListExpired(ctx context.Context, now time.Time, limit int) ([]models.Backup, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	backups := []models.Backup{}
+	for _, b := range r.s.data.backups {
+		if (b.Status == models.BackupCompleted || b.Status == models.BackupFailed) && b.ExpiresAt != nil && !b.ExpiresAt.After(now) {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ExpiresAt.Before(*backups[j].ExpiresAt) })
+	if len(backups) > limit {
+		backups = backups[:limit]
+	}
+	return backups, nil
+}
+
+func (r memBackups) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.backups[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.backups, id)
+	return nil
+}
+
+type memWALSegments struct{ s *Memory }
+
+func (r memWALSegments) Create(ctx context.Context, seg *models.WALSegment) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[seg.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	seg.CreatedAt = time.Now()
+	k := walSegmentKey{seg.InstanceID, seg.Name}
+	if _, ok := r.s.data.walSegments[k]; !ok {
+		r.s.data.walSegments[k] = *seg
+	}
+	return nil
+}
+
+func (r memWALSegments) ListByInstance(ctx context.Context, instanceID, afterLSN string) ([]models.WALSegment, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	var after pglsn.LSN
+	if afterLSN != "" {
+		lsn, err := pglsn.Parse(afterLSN)
+		if err != nil {
+			return nil, err
+		}
+		after = lsn
+	}
+	segments := []models.WALSegment{}
+	for k, seg := range r.s.data.walSegments {
+		if k.instanceID == instanceID && (afterLSN == "" || lsnOf(seg.EndLSN) > after) {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return lsnOf(segments[i].StartLSN) < lsnOf(segments[j].StartLSN) })
+	return segments, nil
+}
+
+func (r memWALSegments) Delete(ctx context.Context, instanceID, name string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	k := walSegmentKey{instanceID, name}
+	if _, ok := r.s.data.walSegments[k]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.walSegments, k)
+	return nil
+}
+
+// lsnOf parses an LSN stored by the memory store, which only stores the
+// ones the pg_lsn columns would accept.
+func lsnOf(s string) pglsn.LSN {
+	lsn, _ := pglsn.Parse(s)
+	return lsn
+}
+
+type memNetworkPolicies struct{ s *Memory }
+
+func (r memNetworkPolicies) GetByInstance(ctx context.Context, instanceID string) (*models.NetworkPolicy, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	p, ok := r.s.data.netPolicies[instanceID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	p.AllowedCIDRs = append([]string{}, p.AllowedCIDRs...)
+	return &p, nil
+}
+
+func (r memNetworkPolicies) Put(ctx context.Context, p *models.NetworkPolicy) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[p.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	stored := *p
+	stored.AllowedCIDRs = append([]string{}, p.AllowedCIDRs...)
+	stored.CreatedAt, stored.UpdatedAt = now, now
+	if existing, ok := r.s.data.netPolicies[p.InstanceID]; ok {
+		stored.ID, stored.CreatedAt = existing.ID, existing.CreatedAt
+	}
+	newID(&stored.ID)
+	r.s.data.netPolicies[p.InstanceID] = stored
+	*p = stored
+	return nil
+}
+
+type memPrivateNetworks struct{ s *Memory }
+
+func (r memPrivateNetworks) Create(ctx context.Context, n *models.PrivateNetwork) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.orgs[n.OrgID]; !ok {
+		return ErrNotFound
+	}
+	subnet, err := netip.ParsePrefix(n.Subnet)
+	if err != nil {
+		return err
+	}
+	for _, other := range r.s.data.networks {
+		if other.OrgID == n.OrgID || other.VLAN == n.VLAN || netip.MustParsePrefix(other.Subnet).Overlaps(subnet) {
+			return ErrConflict
+		}
+	}
+	newID(&n.ID)
+	now := time.Now()
+	n.CreatedAt, n.UpdatedAt = now, now
+	r.s.data.networks[n.ID] = *n
+	return nil
+}
+
+func (r memPrivateNetworks) GetByOrg(ctx context.Context, orgID string) (*models.PrivateNetwork, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, n := range r.s.data.networks {
+		if n.OrgID == orgID {
+			return &n, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memPrivateNetworks) List(ctx context.Context) ([]models.PrivateNetwork, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	networks := make([]models.PrivateNetwork, 0, len(r.s.data.networks))
+	for _, n := range r.s.data.networks {
+		networks = append(networks, n)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return netip.MustParsePrefix(networks[i].Subnet).Addr().Less(netip.MustParsePrefix(networks[j].Subnet).Addr())
+	})
+	return networks, nil
+}
+
+type memWireGuardPeers struct{ s *Memory }
+
+func (r memWireGuardPeers) Create(ctx context.Context, peer *models.WireGuardPeer) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.networks[peer.NetworkID]; !ok {
+		return ErrNotFound
+	}
+	for _, other := range r.s.data.peers {
+		if (other.NetworkID == peer.NetworkID && other.Name == peer.Name) || other.PublicKey == peer.PublicKey || other.Address == peer.Address {
+			return ErrConflict
+		}
+	}
+	newID(&peer.ID)
+	peer.CreatedAt = time.Now()
+	r.s.data.peers[peer.ID] = *peer
+	return nil
+}
+
+func (r memWireGuardPeers) Get(ctx context.Context, id string) (*models.WireGuardPeer, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	peer, ok := r.s.data.peers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &peer, nil
+}
+
+func (r memWireGuardPeers) ListByNetwork(ctx context.Context, networkID string) ([]models.WireGuardPeer, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	peers := []models.WireGuardPeer{}
+	for _, peer := range r.s.data.peers {
+		if peer.NetworkID == networkID {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].CreatedAt.Before(peers[j].CreatedAt) })
+	return peers, nil
+}
+
+func (r memWireGuardPeers) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.peers[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.peers, id)
+	return nil
+}
+
+// memDNSRecords keys records by the ID of their instance.
+type memDNSRecords struct{ s *Memory }
+
+func (r memDNSRecords) Put(ctx context.Context, record *models.DNSRecord) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[record.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	for id, other := range r.s.data.dnsRecords {
+		if id != record.InstanceID && other.Name == record.Name {
+			return ErrConflict
+		}
+	}
+	now := time.Now()
+	record.CreatedAt, record.UpdatedAt = now, now
+	if stored, ok := r.s.data.dnsRecords[record.InstanceID]; ok {
+		record.CreatedAt = stored.CreatedAt
+	}
+	r.s.data.dnsRecords[record.InstanceID] = *record
+	return nil
+}
+
+func (r memDNSRecords) GetByInstance(ctx context.Context, instanceID string) (*models.DNSRecord, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	record, ok := r.s.data.dnsRecords[instanceID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (r memDNSRecords) List(ctx context.Context) ([]models.DNSRecord, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	records := make([]models.DNSRecord, 0, len(r.s.data.dnsRecords))
+	for _, record := range r.s.data.dnsRecords {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+func (r memDNSRecords) ClaimReconcile(ctx context.Context, now time.Time, interval time.Duration) (bool, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if now.Before(r.s.data.nextReconcile) {
+		return false, nil
+	}
+	r.s.data.nextReconcile = now.Add(interval)
+	return true, nil
+}
+
+// memCertificates keys certificates by the ID of their instance.
+type memCertificates struct{ s *Memory }
+
+func (r memCertificates) Put(ctx context.Context, cert *models.Certificate) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[cert.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	cert.CreatedAt, cert.UpdatedAt = now, now
+	if stored, ok := r.s.data.certs[cert.InstanceID]; ok {
+		cert.CreatedAt = stored.CreatedAt
+	}
+	stored := *cert
+	stored.DNSNames = append([]string(nil), cert.DNSNames...)
+	r.s.data.certs[cert.InstanceID] = stored
+	return nil
+}
+
+func (r memCertificates) GetByInstance(ctx context.Context, instanceID string) (*models.Certificate, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	cert, ok := r.s.data.certs[instanceID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cert.DNSNames = append([]string(nil), cert.DNSNames...)
+	return &cert, nil
+}
+
+func (r memCertificates) ListDue(ctx context.Context, now time.Time, limit int) ([]models.Certificate, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	certs := []models.Certificate{}
+	for _, c := range r.s.data.certs {
+		if !c.RenewAt.After(now) {
+			c.DNSNames = append([]string(nil), c.DNSNames...)
+			certs = append(certs, c)
+		}
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].RenewAt.Before(certs[j].RenewAt) })
+	if len(certs) > limit {
+		certs = certs[:limit]
+	}
+	return certs, nil
+}
+
+type memDomains struct{ s *Memory }
+
+func (r memDomains) Create(ctx context.Context, domain *models.Domain) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.instances[domain.InstanceID]; !ok {
+		return ErrNotFound
+	}
+	for _, other := range r.s.data.domains {
+		if other.InstanceID == domain.InstanceID && other.Name == domain.Name {
+			return ErrConflict
+		}
+	}
+	newID(&domain.ID)
+	if domain.Status == "" {
+		domain.Status = models.DomainPending
+	}
+	now := time.Now()
+	domain.CreatedAt, domain.UpdatedAt = now, now
+	r.s.data.domains[domain.ID] = *domain
+	return nil
+}
+
+func (r memDomains) Get(ctx context.Context, id string) (*models.Domain, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	domain, ok := r.s.data.domains[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &domain, nil
+}
+
+func (r memDomains) ListByInstance(ctx context.Context, instanceID string) ([]models.Domain, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	domains := []models.Domain{}
+	for _, d := range r.s.data.domains {
+		if d.InstanceID == instanceID {
+			domains = append(domains, d)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	return domains, nil
+}
+
+func (r memDomains) GetVerified(ctx context.Context, name string) (*models.Domain, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	for _, d := range r.s.data.domains {
+		if d.Name == name && d.Status == models.DomainVerified {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r memDomains) Update(ctx context.Context, domain *models.Domain) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	stored, ok := r.s.data.domains[domain.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if domain.Status == models.DomainVerified {
+		for id, other := range r.s.data.domains {
+			if id != domain.ID && other.Name == stored.Name && other.Status == models.DomainVerified {
+				return ErrConflict
+			}
+		}
+	}
+	// Only the fields the Postgres UPDATE sets change
+	stored.Status, stored.ErrorMessage = domain.Status, domain.ErrorMessage
+	stored.NextCheckAt, stored.ExpiresAt, stored.VerifiedAt = domain.NextCheckAt, domain.ExpiresAt, domain.VerifiedAt
+	stored.UpdatedAt = time.Now()
+	r.s.data.domains[domain.ID] = stored
+	*domain = stored
+	return nil
+}
+
+func (r memDomains) ListDue(ctx context.Context, now time.Time, limit int) ([]models.Domain, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	domains := []models.Domain{}
+	for _, d := range r.s.data.domains {
+		if d.Status == models.DomainPending && d.NextCheckAt != nil && !d.NextCheckAt.After(now) {
+			domains = append(domains, d)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].NextCheckAt.Before(*domains[j].NextCheckAt) })
+	if len(domains) > limit {
+		domains = domains[:limit]
+	}
+	return domains, nil
+}
+
+func (r memDomains) Delete(ctx context.Context, id string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	if _, ok := r.s.data.domains[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.s.data.domains, id)
+	return nil
+}
+
+type memJobs struct{ s *Memory }
+
+func (r memJobs) Create(ctx context.Context, job *models.Job) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	job.ID = uuid.New().String()
+	job.Status = "pending"
+	now := time.Now()
+	job.CreatedAt, job.UpdatedAt = now, now
+	r.s.data.jobs[job.ID] = *job
+	return nil
+}
+
+func (r memJobs) Get(ctx context.Context, id string) (*models.Job, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	job, ok := r.s.data.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+func (r memJobs) Claim(ctx context.Context, workerID string) (*models.Job, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	var oldest *models.Job
+	now := time.Now()
+	for _, job := range r.s.data.jobs {
+		if job.Status != "pending" || (job.RunAfter != nil && job.RunAfter.After(now)) {
+			continue
+		}
+		if oldest == nil || job.CreatedAt.Before(oldest.CreatedAt) {
+			j := job
+			oldest = &j
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+
+	oldest.Status, oldest.WorkerID = "running", workerID
+	oldest.StartedAt, oldest.UpdatedAt = &now, now
+	r.s.data.jobs[oldest.ID] = *oldest
+	return oldest, nil
+}
+
+func (r memJobs) SetProgress(ctx context.Context, id string, progress *models.JobProgress) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	job, ok := r.s.data.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	p := *progress
+	job.Progress = &p
+	r.s.data.jobs[id] = job
+	return nil
+}
+
+func (r memJobs) Finish(ctx context.Context, id, status, message string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	job, ok := r.s.data.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	job.Status, job.ErrorMessage, job.WorkerID = status, message, ""
+	job.CompletedAt, job.UpdatedAt = &now, now
+	r.s.data.jobs[id] = job
+	return nil
+}
+
+func (r memJobs) Release(ctx context.Context, timeout time.Duration) (int64, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	var n int64
+	cutoff := time.Now().Add(-timeout)
+	for id, job := range r.s.data.jobs {
+		if job.Status != "running" || job.WorkerID == "" {
+			continue
+		}
+		if seen, ok := r.s.data.heartbeats[job.WorkerID]; ok && seen.After(cutoff) {
+			continue
+		}
+		job.Status, job.WorkerID, job.StartedAt = "pending", "", nil
+		job.UpdatedAt = time.Now()
+		r.s.data.jobs[id] = job
+		n++
+	}
+	return n, nil
+}
+
+type memWorkers struct{ s *Memory }
+
+func (r memWorkers) Heartbeat(ctx context.Context, workerID, hostname string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	r.s.data.heartbeats[workerID] = time.Now()
+	return nil
+}
+
+func (r memWorkers) Deregister(ctx context.Context, workerID string) error {
+	r.s.lock()
+	defer r.s.unlock()
+
+	delete(r.s.data.heartbeats, workerID)
+	return nil
+}
+
+func (r memWorkers) LastHeartbeat(ctx context.Context) (time.Time, error) {
+	r.s.lock()
+	defer r.s.unlock()
+
+	var last time.Time
+	for _, seen := range r.s.data.heartbeats {
+		if seen.After(last) {
+			last = seen
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,84 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+)
+
+func TestMemoryRollbackKeepsOtherWrites(t *testing.T) {
+	st := store.NewMemory()
+	ctx := context.Background()
+	errRollback := errors.New("roll back")
+
+	outside := make(chan error, 1)
+	err := st.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Users().Create(ctx, &models.User{Email: "inside@example.com"}); err != nil {
+			return err
+		}
+		// A write outside the transaction while it runs
+		go func() {
+			outside <- st.Users().Create(ctx, &models.User{Email: "outside@example.com"})
+		}()
+		select {
+		case err := <-outside:
+			t.Errorf("write outside the transaction ran during it: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("InTx error = %v, want the callback's", err)
+	}
+	if err := <-outside; err != nil {
+		t.Fatalf("write outside the transaction: %v", err)
+	}
+
+	if _, err := st.Users().GetByEmail(ctx, "inside@example.com"); err != store.ErrNotFound {
+		t.Errorf("write of the rolled back transaction: error = %v, want ErrNotFound", err)
+	}
+	if _, err := st.Users().GetByEmail(ctx, "outside@example.com"); err != nil {
+		t.Errorf("write outside the transaction was lost: %v", err)
+	}
+}
+
+func TestMemoryNestedTx(t *testing.T) {
+	st := store.NewMemory()
+	ctx := context.Background()
+
+	err := st.InTx(ctx, func(tx store.Store) error {
+		if err := tx.Users().Create(ctx, &models.User{Email: "outer@example.com"}); err != nil {
+			return err
+		}
+		// Joins the running transaction rather than waiting for it
+		err := tx.InTx(ctx, func(tx store.Store) error {
+			return tx.Users().Create(ctx, &models.User{Email: "inner@example.com"})
+		})
+		if err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	if err == nil {
+		t.Fatal("InTx succeeded")
+	}
+	for _, email := range []string{"outer@example.com", "inner@example.com"} {
+		if _, err := st.Users().GetByEmail(ctx, email); err != store.ErrNotFound {
+			t.Errorf("GetByEmail(%s) error = %v, want ErrNotFound", email, err)
+		}
+	}
+
+	err = st.InTx(ctx, func(tx store.Store) error {
+		return tx.Users().Create(ctx, &models.User{Email: "kept@example.com"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Users().GetByEmail(ctx, "kept@example.com"); err != nil {
+		t.Errorf("write of the committed transaction: %v", err)
+	}
+}
@@ -0,0 +1,1934 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// dbtx is the subset of *sql.DB and *sql.Tx the repositories use.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Postgres implements Store on the control plane database.
+type Postgres struct {
+	db *sql.DB // nil inside a transaction
+	q  dbtx
+}
+
+var _ Store = (*Postgres)(nil)
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db, q: db}
+}
+
+func (s *Postgres) Users() Users                               { return pgUsers{s.q} }
+func (s *Postgres) UserIdentities() UserIdentities             { return pgUserIdentities{s.q} }
+func (s *Postgres) Orgs() Orgs                                 { return pgOrgs{s.q} }
+func (s *Postgres) Memberships() Memberships                   { return pgMemberships{s.q} }
+func (s *Postgres) SSOConnections() SSOConnections             { return pgSSOConnections{s.q} }
+func (s *Postgres) SSODomains() SSODomains                     { return pgSSODomains{s.q} }
+func (s *Postgres) SSOLoginStates() SSOLoginStates             { return pgSSOLoginStates{s.q} }
+func (s *Postgres) Projects() Projects                         { return pgProjects{s.q} }
+func (s *Postgres) Instances() Instances                       { return pgInstances{s.q} }
+func (s *Postgres) Plans() Plans                               { return pgPlans{s.q} }
+func (s *Postgres) Quotas() Quotas                             { return pgQuotas{s.q} }
+func (s *Postgres) Upgrades() Upgrades                         { return pgUpgrades{s.q} }
+func (s *Postgres) BackupPolicies() BackupPolicies             { return pgBackupPolicies{s.q} }
+func (s *Postgres) Backups() Backups                           { return pgBackups{s.q} }
+func (s *Postgres) WALSegments() WALSegments                   { return pgWALSegments{s.q} }
+func (s *Postgres) NetworkPolicies() NetworkPolicies           { return pgNetworkPolicies{s.q} }
+func (s *Postgres) PrivateNetworks() PrivateNetworks           { return pgPrivateNetworks{s.q} }
+func (s *Postgres) WireGuardPeers() WireGuardPeers             { return pgWireGuardPeers{s.q} }
+func (s *Postgres) DNSRecords() DNSRecords                     { return pgDNSRecords{s.q} }
+func (s *Postgres) Certificates() Certificates                 { return pgCertificates{s.q} }
+func (s *Postgres) Domains() Domains                           { return pgDomains{s.q} }
+func (s *Postgres) Jobs() Jobs                                 { return pgJobs{s.q} }
+func (s *Postgres) Workers() Workers                           { return pgWorkers{s.q} }
+func (s *Postgres) DeviceAuthorizations() DeviceAuthorizations { return pgDeviceAuthorizations{s.q} }
+
+func (s *Postgres) InTx(ctx context.Context, fn func(tx Store) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&Postgres{q: tx}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// pgError maps constraint violations to ErrConflict and ErrNotFound, and
+// wraps anything else with what was being done.
+func pgError(err error, action string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505", "23P01": // unique_violation, exclusion_violation
+			return ErrConflict
+		case "23503": // foreign_key_violation
+			return ErrNotFound
+		}
+	}
+	return fmt.Errorf("failed to %s: %w", action, err)
+}
+
+// expectRow returns ErrNotFound if an UPDATE or DELETE matched nothing.
+func expectRow(result sql.Result) error {
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func newID(id *string) {
+	if *id == "" {
+		*id = uuid.New().String()
+	}
+}
+
+type pgUsers struct{ q dbtx }
+
+func (r pgUsers) Create(ctx context.Context, user *models.User) error {
+	newID(&user.ID)
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO users (id, email, pw_hash, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.q.ExecContext(ctx, query, user.ID, user.Email, user.PwHash, user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		return pgError(err, "create user")
+	}
+	return nil
+}
+
+func (r pgUsers) Get(ctx context.Context, id string) (*models.User, error) {
+	return r.get(ctx, "id", id)
+}
+
+func (r pgUsers) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	return r.get(ctx, "email", email)
+}
+
+func (r pgUsers) get(ctx context.Context, column, value string) (*models.User, error) {
+	var user models.User
+	query := "SELECT id, email, pw_hash, created_at, updated_at FROM users WHERE " + column + " = $1"
+	err := r.q.QueryRowContext(ctx, query, value).Scan(
+		&user.ID, &user.Email, &user.PwHash, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+type pgUserIdentities struct{ q dbtx }
+
+func (r pgUserIdentities) Get(ctx context.Context, issuer, subject string) (*models.UserIdentity, error) {
+	var (
+		identity    models.UserIdentity
+		email       sql.NullString
+		lastLoginAt sql.NullTime
+	)
+	query := `
+		SELECT id, user_id, issuer, subject, email, created_at, last_login_at
+		FROM user_identities
+		WHERE issuer = $1 AND subject = $2`
+	err := r.q.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject, &email,
+		&identity.CreatedAt, &lastLoginAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+	identity.Email = email.String
+	if lastLoginAt.Valid {
+		identity.LastLoginAt = &lastLoginAt.Time
+	}
+	return &identity, nil
+}
+
+func (r pgUserIdentities) Create(ctx context.Context, identity *models.UserIdentity) error {
+	newID(&identity.ID)
+	now := time.Now()
+	identity.CreatedAt, identity.LastLoginAt = now, &now
+
+	query := `
+		INSERT INTO user_identities (id, user_id, issuer, subject, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $6)`
+	_, err := r.q.ExecContext(ctx, query,
+		identity.ID, identity.UserID, identity.Issuer, identity.Subject, identity.Email, now,
+	)
+	if err != nil {
+		return pgError(err, "link identity")
+	}
+	return nil
+}
+
+func (r pgUserIdentities) Touch(ctx context.Context, id, email string) error {
+	result, err := r.q.ExecContext(ctx,
+		"UPDATE user_identities SET last_login_at = NOW(), email = NULLIF($2, '') WHERE id = $1", id, email)
+	if err != nil {
+		return pgError(err, "update identity")
+	}
+	return expectRow(result)
+}
+
+type pgOrgs struct{ q dbtx }
+
+func (r pgOrgs) Create(ctx context.Context, org *models.Org) error {
+	newID(&org.ID)
+	now := time.Now()
+	org.CreatedAt, org.UpdatedAt = now, now
+
+	query := "INSERT INTO orgs (id, name, created_at, updated_at) VALUES ($1, $2, $3, $4)"
+	if _, err := r.q.ExecContext(ctx, query, org.ID, org.Name, org.CreatedAt, org.UpdatedAt); err != nil {
+		return pgError(err, "create organization")
+	}
+	return nil
+}
+
+func (r pgOrgs) Get(ctx context.Context, id string) (*models.Org, error) {
+	var org models.Org
+	query := "SELECT id, name, created_at, updated_at FROM orgs WHERE id = $1"
+	err := r.q.QueryRowContext(ctx, query, id).Scan(&org.ID, &org.Name, &org.CreatedAt, &org.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization: %w", err)
+	}
+	return &org, nil
+}
+
+func (r pgOrgs) ListForUser(ctx context.Context, userID string) ([]OrgWithRole, error) {
+	query := `
+		SELECT o.id, o.name, o.created_at, o.updated_at, m.role
+		FROM orgs o
+		JOIN memberships m ON o.id = m.org_id
+		WHERE m.user_id = $1
+		ORDER BY o.created_at DESC`
+	rows, err := r.q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	defer rows.Close()
+
+	orgs := []OrgWithRole{}
+	for rows.Next() {
+		var o OrgWithRole
+		if err := rows.Scan(&o.ID, &o.Name, &o.CreatedAt, &o.UpdatedAt, &o.Role); err != nil {
+			return nil, fmt.Errorf("failed to scan organization: %w", err)
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func (r pgOrgs) Update(ctx context.Context, org *models.Org) error {
+	org.UpdatedAt = time.Now()
+	result, err := r.q.ExecContext(ctx, "UPDATE orgs SET name = $1, updated_at = $2 WHERE id = $3",
+		org.Name, org.UpdatedAt, org.ID)
+	if err != nil {
+		return pgError(err, "update organization")
+	}
+	return expectRow(result)
+}
+
+func (r pgOrgs) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM orgs WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete organization")
+	}
+	return expectRow(result)
+}
+
+func (r pgOrgs) Lock(ctx context.Context, id string) error {
+	var locked string
+	err := r.q.QueryRowContext(ctx, "SELECT id FROM orgs WHERE id = $1 FOR UPDATE", id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock organization: %w", err)
+	}
+	return nil
+}
+
+type pgMemberships struct{ q dbtx }
+
+func (r pgMemberships) Create(ctx context.Context, m *models.Membership) error {
+	query := "INSERT INTO memberships (user_id, org_id, role) VALUES ($1, $2, $3)"
+	if _, err := r.q.ExecContext(ctx, query, m.UserID, m.OrgID, m.Role); err != nil {
+		return pgError(err, "create membership")
+	}
+	return nil
+}
+
+func (r pgMemberships) Get(ctx context.Context, userID, orgID string) (*models.Membership, error) {
+	m := models.Membership{UserID: userID, OrgID: orgID}
+	query := "SELECT role FROM memberships WHERE user_id = $1 AND org_id = $2"
+	err := r.q.QueryRowContext(ctx, query, userID, orgID).Scan(&m.Role)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get membership: %w", err)
+	}
+	return &m, nil
+}
+
+func (r pgMemberships) ListByOrg(ctx context.Context, orgID string) ([]models.Membership, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT user_id, org_id, role FROM memberships WHERE org_id = $1 ORDER BY user_id", orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list memberships: %w", err)
+	}
+	defer rows.Close()
+
+	memberships := []models.Membership{}
+	for rows.Next() {
+		var m models.Membership
+		if err := rows.Scan(&m.UserID, &m.OrgID, &m.Role); err != nil {
+			return nil, fmt.Errorf("failed to scan membership: %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+func (r pgMemberships) Delete(ctx context.Context, userID, orgID string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM memberships WHERE user_id = $1 AND org_id = $2", userID, orgID)
+	if err != nil {
+		return pgError(err, "delete membership")
+	}
+	return expectRow(result)
+}
+
+type pgSSOConnections struct{ q dbtx }
+
+func (r pgSSOConnections) Get(ctx context.Context, orgID string) (*models.SSOConnection, error) {
+	var conn models.SSOConnection
+	query := `
+		SELECT org_id, issuer, client_id, client_secret, enforced, auto_join_domains,
+		       auto_join_role, created_at, updated_at
+		FROM org_sso_connections
+		WHERE org_id = $1`
+	err := r.q.QueryRowContext(ctx, query, orgID).Scan(
+		&conn.OrgID, &conn.Issuer, &conn.ClientID, &conn.ClientSecret, &conn.Enforced,
+		pq.Array(&conn.AutoJoinDomains), &conn.AutoJoinRole, &conn.CreatedAt, &conn.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sso connection: %w", err)
+	}
+	return &conn, nil
+}
+
+func (r pgSSOConnections) Put(ctx context.Context, conn *models.SSOConnection) error {
+	query := `
+		INSERT INTO org_sso_connections
+			(org_id, issuer, client_id, client_secret, enforced, auto_join_domains, auto_join_role)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (org_id) DO UPDATE SET
+			issuer = EXCLUDED.issuer,
+			client_id = EXCLUDED.client_id,
+			client_secret = CASE WHEN EXCLUDED.client_secret = ''
+				THEN org_sso_connections.client_secret ELSE EXCLUDED.client_secret END,
+			enforced = EXCLUDED.enforced,
+			auto_join_domains = EXCLUDED.auto_join_domains,
+			auto_join_role = EXCLUDED.auto_join_role
+		RETURNING client_secret, created_at, updated_at`
+	err := r.q.QueryRowContext(ctx, query,
+		conn.OrgID, conn.Issuer, conn.ClientID, conn.ClientSecret, conn.Enforced,
+		pq.Array(conn.AutoJoinDomains), conn.AutoJoinRole,
+	).Scan(&conn.ClientSecret, &conn.CreatedAt, &conn.UpdatedAt)
+	if err != nil {
+		return pgError(err, "save sso connection")
+	}
+	return nil
+}
+
+func (r pgSSOConnections) Delete(ctx context.Context, orgID string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM org_sso_connections WHERE org_id = $1", orgID)
+	if err != nil {
+		return pgError(err, "delete sso connection")
+	}
+	return expectRow(result)
+}
+
+type pgSSODomains struct{ q dbtx }
+
+const ssoDomainColumns = `id, org_id, name, status, verification_name, verification_value, error_message,
+	verified_at, created_at, updated_at`
+
+func (r pgSSODomains) Create(ctx context.Context, domain *models.SSODomain) error {
+	newID(&domain.ID)
+	if domain.Status == "" {
+		domain.Status = models.DomainPending
+	}
+	now := time.Now()
+	domain.CreatedAt, domain.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO sso_domains (` + ssoDomainColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10)`
+	_, err := r.q.ExecContext(ctx, query,
+		domain.ID, domain.OrgID, domain.Name, domain.Status, domain.VerificationName, domain.VerificationValue,
+		domain.ErrorMessage, domain.VerifiedAt, domain.CreatedAt, domain.UpdatedAt,
+	)
+	if err != nil {
+		return pgError(err, "create sso domain")
+	}
+	return nil
+}
+
+func (r pgSSODomains) ListByOrg(ctx context.Context, orgID string) ([]models.SSODomain, error) {
+	query := "SELECT " + ssoDomainColumns + " FROM sso_domains WHERE org_id = $1 ORDER BY name"
+	rows, err := r.q.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sso domains: %w", err)
+	}
+	defer rows.Close()
+
+	domains := []models.SSODomain{}
+	for rows.Next() {
+		domain, err := scanSSODomain(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sso domain: %w", err)
+		}
+		domains = append(domains, *domain)
+	}
+	return domains, rows.Err()
+}
+
+func (r pgSSODomains) GetVerified(ctx context.Context, name string) (*models.SSODomain, error) {
+	query := "SELECT " + ssoDomainColumns + " FROM sso_domains WHERE name = $1 AND status = 'verified'"
+	domain, err := scanSSODomain(r.q.QueryRowContext(ctx, query, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sso domain: %w", err)
+	}
+	return domain, nil
+}
+
+func (r pgSSODomains) Update(ctx context.Context, domain *models.SSODomain) error {
+	query := `
+		UPDATE sso_domains
+		SET status = $2, error_message = NULLIF($3, ''), verified_at = $4
+		WHERE id = $1
+		RETURNING ` + ssoDomainColumns
+	stored, err := scanSSODomain(r.q.QueryRowContext(ctx, query,
+		domain.ID, domain.Status, domain.ErrorMessage, domain.VerifiedAt,
+	))
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return pgError(err, "update sso domain")
+	}
+	*domain = *stored
+	return nil
+}
+
+func (r pgSSODomains) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM sso_domains WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete sso domain")
+	}
+	return expectRow(result)
+}
+
+func scanSSODomain(row scanner) (*models.SSODomain, error) {
+	var (
+		domain       models.SSODomain
+		errorMessage sql.NullString
+		verifiedAt   sql.NullTime
+	)
+	err := row.Scan(
+		&domain.ID, &domain.OrgID, &domain.Name, &domain.Status, &domain.VerificationName, &domain.VerificationValue,
+		&errorMessage, &verifiedAt, &domain.CreatedAt, &domain.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	domain.ErrorMessage = errorMessage.String
+	if verifiedAt.Valid {
+		domain.VerifiedAt = &verifiedAt.Time
+	}
+	return &domain, nil
+}
+
+type pgSSOLoginStates struct{ q dbtx }
+
+func (r pgSSOLoginStates) Create(ctx context.Context, state *models.SSOLoginState) error {
+	// Opportunistically drop abandoned logins
+	if _, err := r.q.ExecContext(ctx, "DELETE FROM sso_login_states WHERE expires_at < NOW()"); err != nil {
+		return fmt.Errorf("failed to prune sso states: %w", err)
+	}
+
+	query := `
+		INSERT INTO sso_login_states (state, org_id, code_verifier, nonce, link_user_id, device_user_code, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, NULLIF($6, ''), $7)`
+	_, err := r.q.ExecContext(ctx, query,
+		state.State, state.OrgID, state.CodeVerifier, state.Nonce, state.LinkUserID, state.DeviceUserCode, state.ExpiresAt,
+	)
+	if err != nil {
+		return pgError(err, "store sso state")
+	}
+	return nil
+}
+
+func (r pgSSOLoginStates) Take(ctx context.Context, state string) (*models.SSOLoginState, error) {
+	st := models.SSOLoginState{State: state}
+	var linkUserID, deviceUserCode sql.NullString
+	query := `
+		DELETE FROM sso_login_states
+		WHERE state = $1 AND expires_at > NOW()
+		RETURNING org_id, code_verifier, nonce, link_user_id, device_user_code, expires_at`
+	err := r.q.QueryRowContext(ctx, query, state).Scan(
+		&st.OrgID, &st.CodeVerifier, &st.Nonce, &linkUserID, &deviceUserCode, &st.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sso state: %w", err)
+	}
+	st.LinkUserID = linkUserID.String
+	st.DeviceUserCode = deviceUserCode.String
+	return &st, nil
+}
+
+type pgDeviceAuthorizations struct{ q dbtx }
+
+const deviceAuthorizationColumns = `id, device_code_hash, user_code, client_id, status, user_id, sso_org_id,
+	poll_interval, last_polled_at, expires_at, created_at`
+
+func (r pgDeviceAuthorizations) Create(ctx context.Context, authz *models.DeviceAuthorization) error {
+	if _, err := r.q.ExecContext(ctx, "DELETE FROM device_authorizations WHERE expires_at < NOW()"); err != nil {
+		return fmt.Errorf("failed to prune device authorizations: %w", err)
+	}
+
+	newID(&authz.ID)
+	if authz.Status == "" {
+		authz.Status = models.DevicePending
+	}
+	authz.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO device_authorizations (id, device_code_hash, user_code, client_id, status, poll_interval, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := r.q.ExecContext(ctx, query,
+		authz.ID, authz.DeviceCodeHash, authz.UserCode, authz.ClientID, authz.Status,
+		authz.PollInterval, authz.ExpiresAt, authz.CreatedAt,
+	)
+	if err != nil {
+		return pgError(err, "create device authorization")
+	}
+	return nil
+}
+
+func (r pgDeviceAuthorizations) GetByDeviceCode(ctx context.Context, hash string) (*models.DeviceAuthorization, error) {
+	query := "SELECT " + deviceAuthorizationColumns + " FROM device_authorizations WHERE device_code_hash = $1 FOR UPDATE"
+	authz, err := scanDeviceAuthorization(r.q.QueryRowContext(ctx, query, hash))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device authorization: %w", err)
+	}
+	return authz, nil
+}
+
+func (r pgDeviceAuthorizations) GetPending(ctx context.Context, userCode string) (*models.DeviceAuthorization, error) {
+	query := "SELECT " + deviceAuthorizationColumns + ` FROM device_authorizations
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > NOW()
+		FOR UPDATE`
+	authz, err := scanDeviceAuthorization(r.q.QueryRowContext(ctx, query, userCode))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device authorization: %w", err)
+	}
+	return authz, nil
+}
+
+func (r pgDeviceAuthorizations) Update(ctx context.Context, authz *models.DeviceAuthorization) error {
+	query := `
+		UPDATE device_authorizations
+		SET status = $2, user_id = NULLIF($3, '')::uuid, sso_org_id = NULLIF($4, '')::uuid,
+			poll_interval = $5, last_polled_at = $6
+		WHERE id = $1`
+	result, err := r.q.ExecContext(ctx, query,
+		authz.ID, authz.Status, authz.UserID, authz.SSOOrgID, authz.PollInterval, authz.LastPolledAt,
+	)
+	if err != nil {
+		return pgError(err, "update device authorization")
+	}
+	return expectRow(result)
+}
+
+func (r pgDeviceAuthorizations) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM device_authorizations WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete device authorization: %w", err)
+	}
+	return expectRow(result)
+}
+
+func scanDeviceAuthorization(row scanner) (*models.DeviceAuthorization, error) {
+	var (
+		authz            models.DeviceAuthorization
+		userID, ssoOrgID sql.NullString
+		lastPolledAt     sql.NullTime
+	)
+	err := row.Scan(
+		&authz.ID, &authz.DeviceCodeHash, &authz.UserCode, &authz.ClientID, &authz.Status, &userID, &ssoOrgID,
+		&authz.PollInterval, &lastPolledAt, &authz.ExpiresAt, &authz.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	authz.UserID, authz.SSOOrgID = userID.String, ssoOrgID.String
+	if lastPolledAt.Valid {
+		authz.LastPolledAt = &lastPolledAt.Time
+	}
+	return &authz, nil
+}
+
+type pgProjects struct{ q dbtx }
+
+func (r pgProjects) Create(ctx context.Context, project *models.Project) error {
+	newID(&project.ID)
+	project.CreatedAt = time.Now()
+
+	query := "INSERT INTO projects (id, org_id, name, created_at) VALUES ($1, $2, $3, $4)"
+	if _, err := r.q.ExecContext(ctx, query, project.ID, project.OrgID, project.Name, project.CreatedAt); err != nil {
+		return pgError(err, "create project")
+	}
+	return nil
+}
+
+func (r pgProjects) Get(ctx context.Context, id string) (*models.Project, error) {
+	var p models.Project
+	query := "SELECT id, org_id, name, created_at FROM projects WHERE id = $1"
+	err := r.q.QueryRowContext(ctx, query, id).Scan(&p.ID, &p.OrgID, &p.Name, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project: %w", err)
+	}
+	return &p, nil
+}
+
+func (r pgProjects) ListByOrg(ctx context.Context, orgID string) ([]models.Project, error) {
+	query := "SELECT id, org_id, name, created_at FROM projects WHERE org_id = $1 ORDER BY created_at"
+	rows, err := r.q.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list projects: %w", err)
+	}
+	defer rows.Close()
+
+	projects := []models.Project{}
+	for rows.Next() {
+		var p models.Project
+		if err := rows.Scan(&p.ID, &p.OrgID, &p.Name, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan project: %w", err)
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+func (r pgProjects) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM projects WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete project")
+	}
+	return expectRow(result)
+}
+
+type pgInstances struct{ q dbtx }
+
+const instanceColumns = "id, project_id, name, plan, pg_version, node, ctid, fqdn, disk_gib, status, created_at, updated_at, restored_from, private_address"
+
+func (r pgInstances) Create(ctx context.Context, inst *models.Instance) error {
+	restoredFrom, err := restoreSourceJSON(inst.RestoredFrom)
+	if err != nil {
+		return err
+	}
+	newID(&inst.ID)
+	now := time.Now()
+	inst.CreatedAt, inst.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO instances (` + instanceColumns + `)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, 0), NULLIF($8, ''), $9, $10, $11, $12, $13, NULLIF($14, '')::inet)`
+	_, err = r.q.ExecContext(ctx, query,
+		inst.ID, inst.ProjectID, inst.Name, inst.Plan, inst.PgVersion,
+		inst.Node, inst.CTID, inst.FQDN, inst.DiskGiB, inst.Status, inst.CreatedAt, inst.UpdatedAt, restoredFrom,
+		inst.PrivateAddress,
+	)
+	if err != nil {
+		return pgError(err, "create instance")
+	}
+	return nil
+}
+
+func (r pgInstances) Get(ctx context.Context, id string) (*models.Instance, error) {
+	row := r.q.QueryRowContext(ctx, "SELECT "+instanceColumns+" FROM instances WHERE id = $1", id)
+	inst, err := scanInstance(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance: %w", err)
+	}
+	return inst, nil
+}
+
+func (r pgInstances) ListByProject(ctx context.Context, projectID string) ([]models.Instance, error) {
+	query := "SELECT " + instanceColumns + " FROM instances WHERE project_id = $1 ORDER BY created_at"
+	return r.list(ctx, query, projectID)
+}
+
+func (r pgInstances) ListByOrg(ctx context.Context, orgID string) ([]models.Instance, error) {
+	query := `
+		SELECT ` + instanceColumns + ` FROM instances
+		WHERE project_id IN (SELECT id FROM projects WHERE org_id = $1)
+		ORDER BY created_at`
+	return r.list(ctx, query, orgID)
+}
+
+func (r pgInstances) ListByStatus(ctx context.Context, status string) ([]models.Instance, error) {
+	query := "SELECT " + instanceColumns + " FROM instances WHERE status = $1 ORDER BY created_at"
+	return r.list(ctx, query, status)
+}
+
+func (r pgInstances) list(ctx context.Context, query string, args ...interface{}) ([]models.Instance, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	defer rows.Close()
+
+	instances := []models.Instance{}
+	for rows.Next() {
+		inst, err := scanInstance(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan instance: %w", err)
+		}
+		instances = append(instances, *inst)
+	}
+	return instances, rows.Err()
+}
+
+func (r pgInstances) Update(ctx context.Context, inst *models.Instance) error {
+	restoredFrom, err := restoreSourceJSON(inst.RestoredFrom)
+	if err != nil {
+		return err
+	}
+	inst.UpdatedAt = time.Now()
+	query := `
+		UPDATE instances
+		SET name = $2, plan = $3, pg_version = $4, node = NULLIF($5, ''), ctid = NULLIF($6, 0),
+		    fqdn = NULLIF($7, ''), status = $8, disk_gib = $9, updated_at = $10, restored_from = $11,
+		    private_address = NULLIF($12, '')::inet
+		WHERE id = $1`
+	result, err := r.q.ExecContext(ctx, query,
+		inst.ID, inst.Name, inst.Plan, inst.PgVersion, inst.Node, inst.CTID, inst.FQDN, inst.Status, inst.DiskGiB, inst.UpdatedAt,
+		restoredFrom, inst.PrivateAddress,
+	)
+	if err != nil {
+		return pgError(err, "update instance")
+	}
+	return expectRow(result)
+}
+
+func (r pgInstances) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM instances WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete instance")
+	}
+	return expectRow(result)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInstance(row scanner) (*models.Instance, error) {
+	var (
+		inst                                     models.Instance
+		node, fqdn, restoredFrom, privateAddress sql.NullString
+		ctid                                     sql.NullInt64
+	)
+	err := row.Scan(
+		&inst.ID, &inst.ProjectID, &inst.Name, &inst.Plan, &inst.PgVersion,
+		&node, &ctid, &fqdn, &inst.DiskGiB, &inst.Status, &inst.CreatedAt, &inst.UpdatedAt, &restoredFrom,
+		&privateAddress,
+	)
+	if err != nil {
+		return nil, err
+	}
+	inst.Node, inst.CTID, inst.FQDN = node.String, int(ctid.Int64), fqdn.String
+	inst.PrivateAddress = privateAddress.String
+	if restoredFrom.Valid {
+		inst.RestoredFrom = &models.RestoreSource{}
+		if err := json.Unmarshal([]byte(restoredFrom.String), inst.RestoredFrom); err != nil {
+			return nil, fmt.Errorf("failed to decode restore source: %w", err)
+		}
+	}
+	return &inst, nil
+}
+
+// restoreSourceJSON encodes src for the restored_from column, as NULL when
+// the instance wasn't restored.
+func restoreSourceJSON(src *models.RestoreSource) (sql.NullString, error) {
+	if src == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode restore source: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+type pgPlans struct{ q dbtx }
+
+const planColumns = "name, vcpus, memory_mb, disk_gib, min_disk_gib, max_disk_gib, max_connections, pg_versions, deprecated, created_at"
+
+func (r pgPlans) List(ctx context.Context) ([]models.Plan, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT "+planColumns+" FROM plans ORDER BY vcpus, memory_mb, name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []models.Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan plan: %w", err)
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, rows.Err()
+}
+
+func (r pgPlans) Get(ctx context.Context, name string) (*models.Plan, error) {
+	plan, err := scanPlan(r.q.QueryRowContext(ctx, "SELECT "+planColumns+" FROM plans WHERE name = $1", name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plan: %w", err)
+	}
+	return plan, nil
+}
+
+func scanPlan(row scanner) (*models.Plan, error) {
+	var (
+		p        models.Plan
+		versions pq.Int64Array
+	)
+	err := row.Scan(
+		&p.Name, &p.VCPUs, &p.MemoryMB, &p.DiskGiB, &p.MinDiskGiB, &p.MaxDiskGiB,
+		&p.MaxConnections, &versions, &p.Deprecated, &p.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.PgVersions = make([]int, len(versions))
+	for i, v := range versions {
+		p.PgVersions[i] = int(v)
+	}
+	return &p, nil
+}
+
+type pgQuotas struct{ q dbtx }
+
+func (r pgQuotas) GetOrg(ctx context.Context, orgID string) (*models.Quota, error) {
+	return r.get(ctx, "org_quotas", "org_id", orgID)
+}
+
+func (r pgQuotas) SetOrg(ctx context.Context, orgID string, quota *models.Quota) error {
+	return r.set(ctx, "org_quotas", "org_id", orgID, quota)
+}
+
+func (r pgQuotas) DeleteOrg(ctx context.Context, orgID string) error {
+	return r.delete(ctx, "org_quotas", "org_id", orgID)
+}
+
+func (r pgQuotas) GetProject(ctx context.Context, projectID string) (*models.Quota, error) {
+	return r.get(ctx, "project_quotas", "project_id", projectID)
+}
+
+func (r pgQuotas) SetProject(ctx context.Context, projectID string, quota *models.Quota) error {
+	return r.set(ctx, "project_quotas", "project_id", projectID, quota)
+}
+
+func (r pgQuotas) DeleteProject(ctx context.Context, projectID string) error {
+	return r.delete(ctx, "project_quotas", "project_id", projectID)
+}
+
+func (r pgQuotas) get(ctx context.Context, table, key, id string) (*models.Quota, error) {
+	var (
+		q     models.Quota
+		plans pq.StringArray
+	)
+	query := "SELECT max_instances, max_vcpus, max_memory_mb, max_disk_gib, allowed_plans, updated_at FROM " + table + " WHERE " + key + " = $1"
+	err := r.q.QueryRowContext(ctx, query, id).Scan(&q.Instances, &q.VCPUs, &q.MemoryMB, &q.DiskGiB, &plans, &q.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota: %w", err)
+	}
+	q.Plans = plans
+	return &q, nil
+}
+
+func (r pgQuotas) set(ctx context.Context, table, key, id string, q *models.Quota) error {
+	q.UpdatedAt = time.Now()
+	query := `
+		INSERT INTO ` + table + ` (` + key + `, max_instances, max_vcpus, max_memory_mb, max_disk_gib, allowed_plans, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (` + key + `) DO UPDATE
+		SET max_instances = $2, max_vcpus = $3, max_memory_mb = $4, max_disk_gib = $5, allowed_plans = $6, updated_at = $7`
+	_, err := r.q.ExecContext(ctx, query, id, q.Instances, q.VCPUs, q.MemoryMB, q.DiskGiB, pq.StringArray(q.Plans), q.UpdatedAt)
+	if err != nil {
+		return pgError(err, "set quota")
+	}
+	return nil
+}
+
+func (r pgQuotas) delete(ctx context.Context, table, key, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM "+table+" WHERE "+key+" = $1", id)
+	if err != nil {
+		return pgError(err, "delete quota")
+	}
+	return expectRow(result)
+}
+
+type pgUpgrades struct{ q dbtx }
+
+const upgradeColumns = "id, instance_id, from_version, to_version, status, blue_node, blue_ctid, green_node, green_ctid, cut_over_at, rollback_until, created_at, updated_at"
+
+func (r pgUpgrades) Create(ctx context.Context, u *models.Upgrade) error {
+	newID(&u.ID)
+	now := time.Now()
+	u.CreatedAt, u.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO instance_upgrades (` + upgradeColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, 0), $10, $11, $12, $13)`
+	_, err := r.q.ExecContext(ctx, query,
+		u.ID, u.InstanceID, u.FromVersion, u.ToVersion, u.Status, u.BlueNode, u.BlueCTID,
+		u.GreenNode, u.GreenCTID, u.CutOverAt, u.RollbackUntil, u.CreatedAt, u.UpdatedAt,
+	)
+	if err != nil {
+		return pgError(err, "create upgrade")
+	}
+	return nil
+}
+
+func (r pgUpgrades) Get(ctx context.Context, id string) (*models.Upgrade, error) {
+	u, err := scanUpgrade(r.q.QueryRowContext(ctx, "SELECT "+upgradeColumns+" FROM instance_upgrades WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upgrade: %w", err)
+	}
+	return u, nil
+}
+
+func (r pgUpgrades) ListByInstance(ctx context.Context, instanceID string) ([]models.Upgrade, error) {
+	query := "SELECT " + upgradeColumns + " FROM instance_upgrades WHERE instance_id = $1 ORDER BY created_at DESC"
+	rows, err := r.q.QueryContext(ctx, query, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upgrades: %w", err)
+	}
+	defer rows.Close()
+
+	upgrades := []models.Upgrade{}
+	for rows.Next() {
+		u, err := scanUpgrade(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan upgrade: %w", err)
+		}
+		upgrades = append(upgrades, *u)
+	}
+	return upgrades, rows.Err()
+}
+
+func (r pgUpgrades) Update(ctx context.Context, u *models.Upgrade) error {
+	u.UpdatedAt = time.Now()
+	query := `
+		UPDATE instance_upgrades
+		SET status = $2, green_node = NULLIF($3, ''), green_ctid = NULLIF($4, 0),
+		    cut_over_at = $5, rollback_until = $6, updated_at = $7
+		WHERE id = $1`
+	result, err := r.q.ExecContext(ctx, query,
+		u.ID, u.Status, u.GreenNode, u.GreenCTID, u.CutOverAt, u.RollbackUntil, u.UpdatedAt,
+	)
+	if err != nil {
+		return pgError(err, "update upgrade")
+	}
+	return expectRow(result)
+}
+
+func scanUpgrade(row scanner) (*models.Upgrade, error) {
+	var (
+		u                        models.Upgrade
+		greenNode                sql.NullString
+		greenCTID                sql.NullInt64
+		cutOverAt, rollbackUntil sql.NullTime
+	)
+	err := row.Scan(
+		&u.ID, &u.InstanceID, &u.FromVersion, &u.ToVersion, &u.Status, &u.BlueNode, &u.BlueCTID,
+		&greenNode, &greenCTID, &cutOverAt, &rollbackUntil, &u.CreatedAt, &u.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	u.GreenNode, u.GreenCTID = greenNode.String, int(greenCTID.Int64)
+	if cutOverAt.Valid {
+		u.CutOverAt = &cutOverAt.Time
+	}
+	if rollbackUntil.Valid {
+		u.RollbackUntil = &rollbackUntil.Time
+	}
+	return &u, nil
+}
+
+type pgBackupPolicies struct{ q dbtx }
+
+const backupPolicyColumns = "id, instance_id, schedule, retention_days, next_run_at, wal_archiving, next_wal_archive_at, created_at, updated_at"
+
+func (r pgBackupPolicies) GetByInstance(ctx context.Context, instanceID string) (*models.BackupPolicy, error) {
+	query := "SELECT " + backupPolicyColumns + " FROM backup_policies WHERE instance_id = $1"
+	p, err := scanBackupPolicy(r.q.QueryRowContext(ctx, query, instanceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup policy: %w", err)
+	}
+	return p, nil
+}
+
+func (r pgBackupPolicies) Put(ctx context.Context, p *models.BackupPolicy) error {
+	newID(&p.ID)
+	now := time.Now()
+	p.CreatedAt, p.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO backup_policies (` + backupPolicyColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (instance_id) DO UPDATE
+		SET schedule = $3, retention_days = $4, next_run_at = $5, wal_archiving = $6, next_wal_archive_at = $7, updated_at = $9
+		RETURNING ` + backupPolicyColumns
+	stored, err := scanBackupPolicy(r.q.QueryRowContext(ctx, query,
+		p.ID, p.InstanceID, p.Schedule, p.RetentionDays, p.NextRunAt, p.WALArchiving, p.NextWALArchiveAt, p.CreatedAt, p.UpdatedAt,
+	))
+	if err != nil {
+		return pgError(err, "set backup policy")
+	}
+	*p = *stored
+	return nil
+}
+
+func (r pgBackupPolicies) DeleteByInstance(ctx context.Context, instanceID string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM backup_policies WHERE instance_id = $1", instanceID)
+	if err != nil {
+		return pgError(err, "delete backup policy")
+	}
+	return expectRow(result)
+}
+
+func (r pgBackupPolicies) ListDue(ctx context.Context, now time.Time, limit int) ([]models.BackupPolicy, error) {
+	query := `
+		SELECT ` + backupPolicyColumns + ` FROM backup_policies
+		WHERE next_run_at <= $1
+		ORDER BY next_run_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+	return r.list(ctx, query, now, limit)
+}
+
+func (r pgBackupPolicies) ListWALDue(ctx context.Context, now time.Time, limit int) ([]models.BackupPolicy, error) {
+	query := `
+		SELECT ` + backupPolicyColumns + ` FROM backup_policies
+		WHERE wal_archiving AND next_wal_archive_at <= $1
+		ORDER BY next_wal_archive_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+	return r.list(ctx, query, now, limit)
+}
+
+func (r pgBackupPolicies) list(ctx context.Context, query string, args ...interface{}) ([]models.BackupPolicy, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup policies: %w", err)
+	}
+	defer rows.Close()
+
+	policies := []models.BackupPolicy{}
+	for rows.Next() {
+		p, err := scanBackupPolicy(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan backup policy: %w", err)
+		}
+		policies = append(policies, *p)
+	}
+	return policies, rows.Err()
+}
+
+func scanBackupPolicy(row scanner) (*models.BackupPolicy, error) {
+	var p models.BackupPolicy
+	err := row.Scan(
+		&p.ID, &p.InstanceID, &p.Schedule, &p.RetentionDays, &p.NextRunAt, &p.WALArchiving, &p.NextWALArchiveAt,
+		&p.CreatedAt, &p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+type pgBackups struct{ q dbtx }
+
+const backupColumns = "id, instance_id, kind, status, pg_version, repo_url, size_bytes, error_message, created_at, started_at, completed_at, expires_at, start_lsn, end_lsn"
+
+func (r pgBackups) Create(ctx context.Context, b *models.Backup) error {
+	newID(&b.ID)
+	b.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO backups (` + backupColumns + `)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, NULLIF($7, 0), NULLIF($8, ''), $9, $10, $11, $12,
+		        NULLIF($13, '')::pg_lsn, NULLIF($14, '')::pg_lsn)`
+	_, err := r.q.ExecContext(ctx, query,
+		b.ID, b.InstanceID, b.Kind, b.Status, b.PgVersion, b.RepoURL, b.SizeBytes, b.ErrorMessage,
+		b.CreatedAt, b.StartedAt, b.CompletedAt, b.ExpiresAt, b.StartLSN, b.EndLSN,
+	)
+	if err != nil {
+		return pgError(err, "create backup")
+	}
+	return nil
+}
+
+func (r pgBackups) Get(ctx context.Context, id string) (*models.Backup, error) {
+	b, err := scanBackup(r.q.QueryRowContext(ctx, "SELECT "+backupColumns+" FROM backups WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup: %w", err)
+	}
+	return b, nil
+}
+
+func (r pgBackups) ListByInstance(ctx context.Context, instanceID string) ([]models.Backup, error) {
+	query := "SELECT " + backupColumns + " FROM backups WHERE instance_id = $1 ORDER BY created_at DESC"
+	return r.list(ctx, query, instanceID)
+}
+
+func (r pgBackups) Update(ctx context.Context, b *models.Backup) error {
+	query := `
+		UPDATE backups
+		SET status = $2, pg_version = NULLIF($3, 0), repo_url = $4, size_bytes = NULLIF($5, 0), error_message = NULLIF($6, ''),
+		    started_at = $7, completed_at = $8, expires_at = $9,
+		    start_lsn = NULLIF($10, '')::pg_lsn, end_lsn = NULLIF($11, '')::pg_lsn
+		WHERE id = $1`
+	result, err := r.q.ExecContext(ctx, query,
+		b.ID, b.Status, b.PgVersion, b.RepoURL, b.SizeBytes, b.ErrorMessage, b.StartedAt, b.CompletedAt, b.ExpiresAt,
+		b.StartLSN, b.EndLSN,
+	)
+	if err != nil {
+		return pgError(err, "update backup")
+	}
+	return expectRow(result)
+}
+
+func (r pgBackups) ListExpired(ctx context.Context, now time.Time, limit int) ([]models.Backup, error) {
+	query := `
+		SELECT ` + backupColumns + ` FROM backups
+		WHERE status IN ('completed', 'failed') AND expires_at <= $1
+		ORDER BY expires_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+	return r.list(ctx, query, now, limit)
+}
+
+func (r pgBackups) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM backups WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete backup")
+	}
+	return expectRow(result)
+}
+
+func (r pgBackups) list(ctx context.Context, query string, args ...interface{}) ([]models.Backup, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	defer rows.Close()
+
+	backups := []models.Backup{}
+	for rows.Next() {
+		b, err := scanBackup(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan backup: %w", err)
+		}
+		backups = append(backups, *b)
+	}
+	return backups, rows.Err()
+}
+
+func scanBackup(row scanner) (*models.Backup, error) {
+	var (
+		b                                 models.Backup
+		pgVersion, sizeBytes              sql.NullInt64
+		errorMessage, startLSN, endLSN    sql.NullString
+		startedAt, completedAt, expiresAt sql.NullTime
+	)
+	err := row.Scan(
+		&b.ID, &b.InstanceID, &b.Kind, &b.Status, &pgVersion, &b.RepoURL, &sizeBytes, &errorMessage,
+		&b.CreatedAt, &startedAt, &completedAt, &expiresAt, &startLSN, &endLSN,
+	)
+	if err != nil {
+		return nil, err
+	}
+	b.PgVersion, b.SizeBytes, b.ErrorMessage = int(pgVersion.Int64), sizeBytes.Int64, errorMessage.String
+	b.StartLSN, b.EndLSN = startLSN.String, endLSN.String
+	if startedAt.Valid {
+		b.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		b.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		b.ExpiresAt = &expiresAt.Time
+	}
+	return &b, nil
+}
+
+type pgWALSegments struct{ q dbtx }
+
+const walSegmentColumns = "instance_id, name, start_lsn, end_lsn, end_time, size_bytes, created_at"
+
+func (r pgWALSegments) Create(ctx context.Context, seg *models.WALSegment) error {
+	seg.CreatedAt = time.Now()
+	query := `
+		INSERT INTO wal_segments (` + walSegmentColumns + `)
+		VALUES ($1, $2, $3::pg_lsn, $4::pg_lsn, $5, $6, $7)
+		ON CONFLICT (instance_id, name) DO NOTHING`
+	_, err := r.q.ExecContext(ctx, query,
+		seg.InstanceID, seg.Name, seg.StartLSN, seg.EndLSN, seg.EndTime, seg.SizeBytes, seg.CreatedAt,
+	)
+	if err != nil {
+		return pgError(err, "record WAL segment")
+	}
+	return nil
+}
+
+func (r pgWALSegments) ListByInstance(ctx context.Context, instanceID, afterLSN string) ([]models.WALSegment, error) {
+	query := `
+		SELECT ` + walSegmentColumns + ` FROM wal_segments
+		WHERE instance_id = $1 AND ($2 = '' OR end_lsn > NULLIF($2, '')::pg_lsn)
+		ORDER BY start_lsn`
+	rows, err := r.q.QueryContext(ctx, query, instanceID, afterLSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	defer rows.Close()
+
+	segments := []models.WALSegment{}
+	for rows.Next() {
+		seg, err := scanWALSegment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan WAL segment: %w", err)
+		}
+		segments = append(segments, *seg)
+	}
+	return segments, rows.Err()
+}
+
+func (r pgWALSegments) Delete(ctx context.Context, instanceID, name string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM wal_segments WHERE instance_id = $1 AND name = $2", instanceID, name)
+	if err != nil {
+		return pgError(err, "delete WAL segment")
+	}
+	return expectRow(result)
+}
+
+func scanWALSegment(row scanner) (*models.WALSegment, error) {
+	var seg models.WALSegment
+	err := row.Scan(&seg.InstanceID, &seg.Name, &seg.StartLSN, &seg.EndLSN, &seg.EndTime, &seg.SizeBytes, &seg.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &seg, nil
+}
+
+type pgNetworkPolicies struct{ q dbtx }
+
+const networkPolicyColumns = "id, instance_id, exposure, allowed_cidrs, created_at, updated_at"
+
+func (r pgNetworkPolicies) GetByInstance(ctx context.Context, instanceID string) (*models.NetworkPolicy, error) {
+	query := "SELECT " + networkPolicyColumns + " FROM network_policies WHERE instance_id = $1"
+	p, err := scanNetworkPolicy(r.q.QueryRowContext(ctx, query, instanceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network policy: %w", err)
+	}
+	return p, nil
+}
+
+func (r pgNetworkPolicies) Put(ctx context.Context, p *models.NetworkPolicy) error {
+	newID(&p.ID)
+	now := time.Now()
+	p.CreatedAt, p.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO network_policies (` + networkPolicyColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (instance_id) DO UPDATE
+		SET exposure = $3, allowed_cidrs = $4, updated_at = $6
+		RETURNING ` + networkPolicyColumns
+	stored, err := scanNetworkPolicy(r.q.QueryRowContext(ctx, query,
+		p.ID, p.InstanceID, p.Exposure, pq.StringArray(p.AllowedCIDRs), p.CreatedAt, p.UpdatedAt,
+	))
+	if err != nil {
+		return pgError(err, "set network policy")
+	}
+	*p = *stored
+	return nil
+}
+
+func scanNetworkPolicy(row scanner) (*models.NetworkPolicy, error) {
+	var (
+		p     models.NetworkPolicy
+		cidrs pq.StringArray
+	)
+	if err := row.Scan(&p.ID, &p.InstanceID, &p.Exposure, &cidrs, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.AllowedCIDRs = []string(cidrs)
+	if p.AllowedCIDRs == nil {
+		p.AllowedCIDRs = []string{}
+	}
+	return &p, nil
+}
+
+type pgPrivateNetworks struct{ q dbtx }
+
+const privateNetworkColumns = "id, org_id, subnet, vlan, created_at, updated_at"
+
+func (r pgPrivateNetworks) Create(ctx context.Context, n *models.PrivateNetwork) error {
+	newID(&n.ID)
+	now := time.Now()
+	n.CreatedAt, n.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO private_networks (` + privateNetworkColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.q.ExecContext(ctx, query, n.ID, n.OrgID, n.Subnet, n.VLAN, n.CreatedAt, n.UpdatedAt)
+	if err != nil {
+		return pgError(err, "create private network")
+	}
+	return nil
+}
+
+func (r pgPrivateNetworks) GetByOrg(ctx context.Context, orgID string) (*models.PrivateNetwork, error) {
+	query := "SELECT " + privateNetworkColumns + " FROM private_networks WHERE org_id = $1"
+	n, err := scanPrivateNetwork(r.q.QueryRowContext(ctx, query, orgID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private network: %w", err)
+	}
+	return n, nil
+}
+
+func (r pgPrivateNetworks) List(ctx context.Context) ([]models.PrivateNetwork, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT "+privateNetworkColumns+" FROM private_networks ORDER BY subnet")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list private networks: %w", err)
+	}
+	defer rows.Close()
+
+	networks := []models.PrivateNetwork{}
+	for rows.Next() {
+		n, err := scanPrivateNetwork(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan private network: %w", err)
+		}
+		networks = append(networks, *n)
+	}
+	return networks, rows.Err()
+}
+
+func scanPrivateNetwork(row scanner) (*models.PrivateNetwork, error) {
+	var n models.PrivateNetwork
+	if err := row.Scan(&n.ID, &n.OrgID, &n.Subnet, &n.VLAN, &n.CreatedAt, &n.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+type pgWireGuardPeers struct{ q dbtx }
+
+const wireGuardPeerColumns = "id, network_id, name, public_key, address, created_by, created_at"
+
+func (r pgWireGuardPeers) Create(ctx context.Context, peer *models.WireGuardPeer) error {
+	newID(&peer.ID)
+	peer.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO wireguard_peers (` + wireGuardPeerColumns + `)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, $7)`
+	_, err := r.q.ExecContext(ctx, query,
+		peer.ID, peer.NetworkID, peer.Name, peer.PublicKey, peer.Address, peer.CreatedBy, peer.CreatedAt,
+	)
+	if err != nil {
+		return pgError(err, "create wireguard peer")
+	}
+	return nil
+}
+
+func (r pgWireGuardPeers) Get(ctx context.Context, id string) (*models.WireGuardPeer, error) {
+	query := "SELECT " + wireGuardPeerColumns + " FROM wireguard_peers WHERE id = $1"
+	peer, err := scanWireGuardPeer(r.q.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wireguard peer: %w", err)
+	}
+	return peer, nil
+}
+
+func (r pgWireGuardPeers) ListByNetwork(ctx context.Context, networkID string) ([]models.WireGuardPeer, error) {
+	query := "SELECT " + wireGuardPeerColumns + " FROM wireguard_peers WHERE network_id = $1 ORDER BY created_at"
+	rows, err := r.q.QueryContext(ctx, query, networkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wireguard peers: %w", err)
+	}
+	defer rows.Close()
+
+	peers := []models.WireGuardPeer{}
+	for rows.Next() {
+		peer, err := scanWireGuardPeer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan wireguard peer: %w", err)
+		}
+		peers = append(peers, *peer)
+	}
+	return peers, rows.Err()
+}
+
+func (r pgWireGuardPeers) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM wireguard_peers WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete wireguard peer")
+	}
+	return expectRow(result)
+}
+
+func scanWireGuardPeer(row scanner) (*models.WireGuardPeer, error) {
+	var (
+		peer      models.WireGuardPeer
+		createdBy sql.NullString
+	)
+	err := row.Scan(&peer.ID, &peer.NetworkID, &peer.Name, &peer.PublicKey, &peer.Address, &createdBy, &peer.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	peer.CreatedBy = createdBy.String
+	return &peer, nil
+}
+
+type pgDNSRecords struct{ q dbtx }
+
+const dnsRecordColumns = "name, type, host(value), ttl, instance_id, created_at, updated_at"
+
+func (r pgDNSRecords) Put(ctx context.Context, record *models.DNSRecord) error {
+	now := time.Now()
+	record.CreatedAt, record.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO dns_records (name, type, value, ttl, instance_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (instance_id) DO UPDATE
+		SET name = $1, type = $2, value = $3, ttl = $4, updated_at = $7
+		RETURNING ` + dnsRecordColumns
+	stored, err := scanDNSRecord(r.q.QueryRowContext(ctx, query,
+		record.Name, record.Type, record.Value, record.TTL, record.InstanceID, record.CreatedAt, record.UpdatedAt,
+	))
+	if err != nil {
+		return pgError(err, "set dns record")
+	}
+	*record = *stored
+	return nil
+}
+
+func (r pgDNSRecords) GetByInstance(ctx context.Context, instanceID string) (*models.DNSRecord, error) {
+	query := "SELECT " + dnsRecordColumns + " FROM dns_records WHERE instance_id = $1"
+	record, err := scanDNSRecord(r.q.QueryRowContext(ctx, query, instanceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dns record: %w", err)
+	}
+	return record, nil
+}
+
+func (r pgDNSRecords) List(ctx context.Context) ([]models.DNSRecord, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT "+dnsRecordColumns+" FROM dns_records ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dns records: %w", err)
+	}
+	defer rows.Close()
+
+	records := []models.DNSRecord{}
+	for rows.Next() {
+		record, err := scanDNSRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dns record: %w", err)
+		}
+		records = append(records, *record)
+	}
+	return records, rows.Err()
+}
+
+func (r pgDNSRecords) ClaimReconcile(ctx context.Context, now time.Time, interval time.Duration) (bool, error) {
+	result, err := r.q.ExecContext(ctx,
+		"UPDATE dns_zone SET next_reconcile_at = $2 WHERE next_reconcile_at <= $1",
+		now, now.Add(interval),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim dns reconcile: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func scanDNSRecord(row scanner) (*models.DNSRecord, error) {
+	var record models.DNSRecord
+	err := row.Scan(&record.Name, &record.Type, &record.Value, &record.TTL, &record.InstanceID, &record.CreatedAt, &record.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+type pgCertificates struct{ q dbtx }
+
+const certificateColumns = "instance_id, issuer, serial, dns_names, not_before, not_after, renew_at, certificate, created_at, updated_at"
+
+func (r pgCertificates) Put(ctx context.Context, cert *models.Certificate) error {
+	now := time.Now()
+	cert.CreatedAt, cert.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO certificates (` + certificateColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (instance_id) DO UPDATE
+		SET issuer = $2, serial = $3, dns_names = $4, not_before = $5, not_after = $6, renew_at = $7, certificate = $8, updated_at = $10
+		RETURNING ` + certificateColumns
+	stored, err := scanCertificate(r.q.QueryRowContext(ctx, query,
+		cert.InstanceID, cert.Issuer, cert.Serial, pq.StringArray(cert.DNSNames), cert.NotBefore, cert.NotAfter,
+		cert.RenewAt, cert.CertificatePEM, cert.CreatedAt, cert.UpdatedAt,
+	))
+	if err != nil {
+		return pgError(err, "set certificate")
+	}
+	*cert = *stored
+	return nil
+}
+
+func (r pgCertificates) GetByInstance(ctx context.Context, instanceID string) (*models.Certificate, error) {
+	query := "SELECT " + certificateColumns + " FROM certificates WHERE instance_id = $1"
+	cert, err := scanCertificate(r.q.QueryRowContext(ctx, query, instanceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func (r pgCertificates) ListDue(ctx context.Context, now time.Time, limit int) ([]models.Certificate, error) {
+	query := `
+		SELECT ` + certificateColumns + ` FROM certificates
+		WHERE renew_at <= $1
+		ORDER BY renew_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+	rows, err := r.q.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	defer rows.Close()
+
+	certs := []models.Certificate{}
+	for rows.Next() {
+		cert, err := scanCertificate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan certificate: %w", err)
+		}
+		certs = append(certs, *cert)
+	}
+	return certs, rows.Err()
+}
+
+func scanCertificate(row scanner) (*models.Certificate, error) {
+	var (
+		cert     models.Certificate
+		dnsNames pq.StringArray
+	)
+	err := row.Scan(&cert.InstanceID, &cert.Issuer, &cert.Serial, &dnsNames, &cert.NotBefore, &cert.NotAfter,
+		&cert.RenewAt, &cert.CertificatePEM, &cert.CreatedAt, &cert.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	cert.DNSNames = dnsNames
+	return &cert, nil
+}
+
+type pgDomains struct{ q dbtx }
+
+const domainColumns = `id, instance_id, name, status, verification_name, verification_value, error_message,
+	next_check_at, expires_at, verified_at, created_by, created_at, updated_at`
+
+func (r pgDomains) Create(ctx context.Context, domain *models.Domain) error {
+	newID(&domain.ID)
+	if domain.Status == "" {
+		domain.Status = models.DomainPending
+	}
+	now := time.Now()
+	domain.CreatedAt, domain.UpdatedAt = now, now
+
+	query := `
+		INSERT INTO domains (` + domainColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, NULLIF($11, '')::uuid, $12, $13)`
+	_, err := r.q.ExecContext(ctx, query,
+		domain.ID, domain.InstanceID, domain.Name, domain.Status, domain.VerificationName, domain.VerificationValue,
+		domain.ErrorMessage, domain.NextCheckAt, domain.ExpiresAt, domain.VerifiedAt, domain.CreatedBy,
+		domain.CreatedAt, domain.UpdatedAt,
+	)
+	if err != nil {
+		return pgError(err, "create domain")
+	}
+	return nil
+}
+
+func (r pgDomains) Get(ctx context.Context, id string) (*models.Domain, error) {
+	query := "SELECT " + domainColumns + " FROM domains WHERE id = $1"
+	domain, err := scanDomain(r.q.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain: %w", err)
+	}
+	return domain, nil
+}
+
+func (r pgDomains) ListByInstance(ctx context.Context, instanceID string) ([]models.Domain, error) {
+	query := "SELECT " + domainColumns + " FROM domains WHERE instance_id = $1 ORDER BY name"
+	return r.list(ctx, query, instanceID)
+}
+
+func (r pgDomains) GetVerified(ctx context.Context, name string) (*models.Domain, error) {
+	query := "SELECT " + domainColumns + " FROM domains WHERE name = $1 AND status = 'verified'"
+	domain, err := scanDomain(r.q.QueryRowContext(ctx, query, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain: %w", err)
+	}
+	return domain, nil
+}
+
+func (r pgDomains) Update(ctx context.Context, domain *models.Domain) error {
+	query := `
+		UPDATE domains
+		SET status = $2, error_message = NULLIF($3, ''), next_check_at = $4, expires_at = $5, verified_at = $6
+		WHERE id = $1
+		RETURNING ` + domainColumns
+	stored, err := scanDomain(r.q.QueryRowContext(ctx, query,
+		domain.ID, domain.Status, domain.ErrorMessage, domain.NextCheckAt, domain.ExpiresAt, domain.VerifiedAt,
+	))
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return pgError(err, "update domain")
+	}
+	*domain = *stored
+	return nil
+}
+
+func (r pgDomains) ListDue(ctx context.Context, now time.Time, limit int) ([]models.Domain, error) {
+	query := `
+		SELECT ` + domainColumns + ` FROM domains
+		WHERE status = 'pending' AND next_check_at <= $1
+		ORDER BY next_check_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+	return r.list(ctx, query, now, limit)
+}
+
+func (r pgDomains) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM domains WHERE id = $1", id)
+	if err != nil {
+		return pgError(err, "delete domain")
+	}
+	return expectRow(result)
+}
+
+func (r pgDomains) list(ctx context.Context, query string, args ...interface{}) ([]models.Domain, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	defer rows.Close()
+
+	domains := []models.Domain{}
+	for rows.Next() {
+		domain, err := scanDomain(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan domain: %w", err)
+		}
+		domains = append(domains, *domain)
+	}
+	return domains, rows.Err()
+}
+
+func scanDomain(row scanner) (*models.Domain, error) {
+	var (
+		domain                  models.Domain
+		errorMessage, createdBy sql.NullString
+		nextCheckAt, verifiedAt sql.NullTime
+	)
+	err := row.Scan(
+		&domain.ID, &domain.InstanceID, &domain.Name, &domain.Status, &domain.VerificationName, &domain.VerificationValue,
+		&errorMessage, &nextCheckAt, &domain.ExpiresAt, &verifiedAt, &createdBy, &domain.CreatedAt, &domain.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	domain.ErrorMessage, domain.CreatedBy = errorMessage.String, createdBy.String
+	if nextCheckAt.Valid {
+		domain.NextCheckAt = &nextCheckAt.Time
+	}
+	if verifiedAt.Valid {
+		domain.VerifiedAt = &verifiedAt.Time
+	}
+	return &domain, nil
+}
+
+type pgJobs struct{ q dbtx }
+
+func (r pgJobs) Create(ctx context.Context, job *models.Job) error {
+	job.Status = "pending"
+	// jsonb parameters must be sent as text; lib/pq sends []byte as bytea
+	query := `
+		INSERT INTO jobs (type, payload_json, status, run_after)
+		VALUES ($1, $2, 'pending', $3)
+		RETURNING id, created_at, updated_at`
+	err := r.q.QueryRowContext(ctx, query, job.Type, job.PayloadJSON, job.RunAfter).Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return pgError(err, "enqueue job")
+	}
+	return nil
+}
+
+const jobColumns = "id, type, payload_json, status, error_message, worker_id, created_at, updated_at, started_at, completed_at, run_after, progress"
+
+func (r pgJobs) Get(ctx context.Context, id string) (*models.Job, error) {
+	job, err := scanJob(r.q.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM jobs WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	return job, nil
+}
+
+func (r pgJobs) Claim(ctx context.Context, workerID string) (*models.Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'running', worker_id = $1, started_at = NOW()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = 'pending'
+			AND (run_after IS NULL OR run_after <= NOW())
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING ` + jobColumns
+	job, err := scanJob(r.q.QueryRowContext(ctx, query, workerID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim job: %w", err)
+	}
+	return job, nil
+}
+
+func (r pgJobs) SetProgress(ctx context.Context, id string, progress *models.JobProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to encode job progress: %w", err)
+	}
+	result, err := r.q.ExecContext(ctx, "UPDATE jobs SET progress = $2 WHERE id = $1", id, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to update job progress: %w", err)
+	}
+	return expectRow(result)
+}
+
+func (r pgJobs) Finish(ctx context.Context, id, status, message string) error {
+	query := `
+		UPDATE jobs
+		SET status = $2, error_message = NULLIF($3, ''), worker_id = NULL, completed_at = NOW()
+		WHERE id = $1`
+	result, err := r.q.ExecContext(ctx, query, id, status, message)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %w", err)
+	}
+	return expectRow(result)
+}
+
+func (r pgJobs) Release(ctx context.Context, timeout time.Duration) (int64, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'pending', worker_id = NULL, started_at = NULL
+		WHERE status = 'running'
+		AND worker_id IS NOT NULL
+		AND worker_id NOT IN (
+			SELECT worker_id FROM worker_heartbeats
+			WHERE last_seen_at > NOW() - make_interval(secs => $1)
+		)`
+	result, err := r.q.ExecContext(ctx, query, timeout.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to release jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func scanJob(row scanner) (*models.Job, error) {
+	var (
+		job                    models.Job
+		message, workerID      sql.NullString
+		startedAt, completedAt sql.NullTime
+		runAfter               sql.NullTime
+		progress               sql.NullString
+	)
+	err := row.Scan(
+		&job.ID, &job.Type, &job.PayloadJSON, &job.Status, &message, &workerID,
+		&job.CreatedAt, &job.UpdatedAt, &startedAt, &completedAt, &runAfter, &progress,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if runAfter.Valid {
+		job.RunAfter = &runAfter.Time
+	}
+	if progress.Valid {
+		job.Progress = &models.JobProgress{}
+		if err := json.Unmarshal([]byte(progress.String), job.Progress); err != nil {
+			return nil, fmt.Errorf("invalid job progress: %w", err)
+		}
+	}
+	job.ErrorMessage, job.WorkerID = message.String, workerID.String
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	return &job, nil
+}
+
+type pgWorkers struct{ q dbtx }
+
+func (r pgWorkers) Heartbeat(ctx context.Context, workerID, hostname string) error {
+	query := `
+		INSERT INTO worker_heartbeats (worker_id, hostname)
+		VALUES ($1, $2)
+		ON CONFLICT (worker_id) DO UPDATE SET last_seen_at = NOW()`
+	if _, err := r.q.ExecContext(ctx, query, workerID, hostname); err != nil {
+		return fmt.Errorf("failed to record worker heartbeat: %w", err)
+	}
+	return nil
+}
+
+func (r pgWorkers) Deregister(ctx context.Context, workerID string) error {
+	if _, err := r.q.ExecContext(ctx, "DELETE FROM worker_heartbeats WHERE worker_id = $1", workerID); err != nil {
+		return fmt.Errorf("failed to remove worker heartbeat: %w", err)
+	}
+	return nil
+}
+
+func (r pgWorkers) LastHeartbeat(ctx context.Context) (time.Time, error) {
+	var last sql.NullTime
+	err := r.q.QueryRowContext(ctx, "SELECT MAX(last_seen_at) FROM worker_heartbeats").Scan(&last)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get worker heartbeat: %w", err)
+	}
+	return last.Time, nil
+}
@@ -0,0 +1,413 @@
+// Package store is the persistence layer of the control plane. Handlers and
+// services depend on the interfaces below rather than on *sql.DB; Postgres is
+// the production implementation and Memory backs tests and local
+// development.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zallarak/db/api/internal/models"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write would violate a uniqueness
+	// constraint, such as a second user with the same email.
+	ErrConflict = errors.New("already exists")
+
+	ErrNotMember        = errors.New("not a member of the organization")
+	ErrInsufficientRole = errors.New("insufficient role")
+)
+
+// Store gives access to every repository. The repositories of a Store
+// returned by InTx share its transaction.
+type Store interface {
+	Users() Users
+	UserIdentities() UserIdentities
+	Orgs() Orgs
+	Memberships() Memberships
+	SSOConnections() SSOConnections
+	SSODomains() SSODomains
+	SSOLoginStates() SSOLoginStates
+	DeviceAuthorizations() DeviceAuthorizations
+	Projects() Projects
+	Instances() Instances
+	Plans() Plans
+	Quotas() Quotas
+	Upgrades() Upgrades
+	BackupPolicies() BackupPolicies
+	Backups() Backups
+	WALSegments() WALSegments
+	NetworkPolicies() NetworkPolicies
+	PrivateNetworks() PrivateNetworks
+	WireGuardPeers() WireGuardPeers
+	DNSRecords() DNSRecords
+	Certificates() Certificates
+	Domains() Domains
+	Jobs() Jobs
+	Workers() Workers
+
+	// InTx runs fn in a transaction, committing if it returns nil and
+	// rolling back otherwise. Calling InTx on the Store passed to fn runs
+	// in the same transaction.
+	InTx(ctx context.Context, fn func(tx Store) error) error
+}
+
+type Users interface {
+	// Create inserts user, assigning an ID and timestamps if unset. It
+	// returns ErrConflict if the email is taken.
+	Create(ctx context.Context, user *models.User) error
+	Get(ctx context.Context, id string) (*models.User, error)
+	GetByEmail(ctx context.Context, email string) (*models.User, error)
+}
+
+// UserIdentities stores the identity provider accounts linked to users.
+type UserIdentities interface {
+	// Get returns the identity issuer knows by subject.
+	Get(ctx context.Context, issuer, subject string) (*models.UserIdentity, error)
+	// Create links identity to its user, assigning its ID and timestamps.
+	// It returns ErrConflict if the identity is linked already and
+	// ErrNotFound if the user doesn't exist.
+	Create(ctx context.Context, identity *models.UserIdentity) error
+	// Touch records a login with the identity, saving the email it came
+	// with.
+	Touch(ctx context.Context, id, email string) error
+}
+
+// OrgWithRole is an org along with the role of the user it was listed for.
+type OrgWithRole struct {
+	models.Org
+	Role models.UserRole `json:"role"`
+}
+
+type Orgs interface {
+	Create(ctx context.Context, org *models.Org) error
+	Get(ctx context.Context, id string) (*models.Org, error)
+	// ListForUser returns the orgs userID belongs to, newest first.
+	ListForUser(ctx context.Context, userID string) ([]OrgWithRole, error)
+	// Update saves the name of org and refreshes its UpdatedAt.
+	Update(ctx context.Context, org *models.Org) error
+	// Delete removes the org with its memberships, projects and instances.
+	Delete(ctx context.Context, id string) error
+	// Lock holds a lock on the org until the transaction ends, so writes
+	// checked against org-wide limits don't race each other. It returns
+	// ErrNotFound if the org doesn't exist.
+	Lock(ctx context.Context, id string) error
+}
+
+type Memberships interface {
+	// Create adds a membership. It returns ErrNotFound if the user or org
+	// doesn't exist and ErrConflict if the user is already a member.
+	Create(ctx context.Context, m *models.Membership) error
+	Get(ctx context.Context, userID, orgID string) (*models.Membership, error)
+	ListByOrg(ctx context.Context, orgID string) ([]models.Membership, error)
+	Delete(ctx context.Context, userID, orgID string) error
+}
+
+// SSOConnections stores the SSO connections of orgs, one at most each,
+// which are deleted with their org.
+type SSOConnections interface {
+	Get(ctx context.Context, orgID string) (*models.SSOConnection, error)
+	// Put creates the connection of conn.OrgID or replaces it, keeping the
+	// stored client secret if conn has none. It returns ErrNotFound if the
+	// org doesn't exist.
+	Put(ctx context.Context, conn *models.SSOConnection) error
+	Delete(ctx context.Context, orgID string) error
+}
+
+// SSODomains stores the email domains SSO connections claim, which are
+// deleted with their org. Several orgs may claim a name, but it is verified
+// for one at a time.
+type SSODomains interface {
+	// Create inserts domain, assigning its ID and timestamps. It returns
+	// ErrConflict if the org already claims the name and ErrNotFound if
+	// the org doesn't exist.
+	Create(ctx context.Context, domain *models.SSODomain) error
+	// ListByOrg returns the domains an org claims, by name.
+	ListByOrg(ctx context.Context, orgID string) ([]models.SSODomain, error)
+	// GetVerified returns the verified claim on name, or ErrNotFound if no
+	// org has verified it.
+	GetVerified(ctx context.Context, name string) (*models.SSODomain, error)
+	// Update sets the status, error message and verification time of
+	// domain. It returns ErrConflict if domain is verified and another org
+	// has verified the same name.
+	Update(ctx context.Context, domain *models.SSODomain) error
+	Delete(ctx context.Context, id string) error
+}
+
+// SSOLoginStates stores the SSO logins in flight at identity providers.
+type SSOLoginStates interface {
+	// Create inserts state, dropping the expired ones first.
+	Create(ctx context.Context, state *models.SSOLoginState) error
+	// Take deletes the unexpired login with state and returns it, or
+	// ErrNotFound if there is none.
+	Take(ctx context.Context, state string) (*models.SSOLoginState, error)
+}
+
+// DeviceAuthorizations stores the device logins waiting for approval.
+type DeviceAuthorizations interface {
+	// Create inserts authz, assigning its ID and CreatedAt, after dropping
+	// expired ones. It returns ErrConflict if the user code is taken.
+	Create(ctx context.Context, authz *models.DeviceAuthorization) error
+	// GetByDeviceCode returns the authorization whose device code has
+	// hash, locked until the transaction ends.
+	GetByDeviceCode(ctx context.Context, hash string) (*models.DeviceAuthorization, error)
+	// GetPending returns the unexpired pending authorization with
+	// userCode, locked until the transaction ends.
+	GetPending(ctx context.Context, userCode string) (*models.DeviceAuthorization, error)
+	// Update sets the status, approving user and SSO org, poll interval
+	// and last poll of authz.
+	Update(ctx context.Context, authz *models.DeviceAuthorization) error
+	Delete(ctx context.Context, id string) error
+}
+
+type Projects interface {
+	// Create inserts project. Names are unique within an org.
+	Create(ctx context.Context, project *models.Project) error
+	Get(ctx context.Context, id string) (*models.Project, error)
+	ListByOrg(ctx context.Context, orgID string) ([]models.Project, error)
+	// Delete removes the project with its instances.
+	Delete(ctx context.Context, id string) error
+}
+
+type Instances interface {
+	// Create inserts instance. Names are unique within a project.
+	Create(ctx context.Context, instance *models.Instance) error
+	Get(ctx context.Context, id string) (*models.Instance, error)
+	ListByProject(ctx context.Context, projectID string) ([]models.Instance, error)
+	// ListByOrg returns the instances of every project in orgID.
+	ListByOrg(ctx context.Context, orgID string) ([]models.Instance, error)
+	// ListByStatus returns the instances of every org with status, oldest
+	// first.
+	ListByStatus(ctx context.Context, status string) ([]models.Instance, error)
+	// Update saves every mutable field of instance and refreshes its
+	// UpdatedAt. It returns ErrConflict if the private address is taken.
+	Update(ctx context.Context, instance *models.Instance) error
+	Delete(ctx context.Context, id string) error
+}
+
+// Plans is the plan catalog. Plans are added and deprecated by migrations or
+// operators, not through the API.
+type Plans interface {
+	// List returns every plan, deprecated ones included, smallest first.
+	List(ctx context.Context) ([]models.Plan, error)
+	Get(ctx context.Context, name string) (*models.Plan, error)
+}
+
+// Quotas stores the overrides of the configured quotas for single orgs and
+// projects. Get returns ErrNotFound when there is no override.
+type Quotas interface {
+	GetOrg(ctx context.Context, orgID string) (*models.Quota, error)
+	// SetOrg creates or replaces the override of orgID. It returns
+	// ErrNotFound if the org doesn't exist.
+	SetOrg(ctx context.Context, orgID string, quota *models.Quota) error
+	DeleteOrg(ctx context.Context, orgID string) error
+	GetProject(ctx context.Context, projectID string) (*models.Quota, error)
+	SetProject(ctx context.Context, projectID string, quota *models.Quota) error
+	DeleteProject(ctx context.Context, projectID string) error
+}
+
+// Upgrades stores the major version upgrades of instances, which are
+// deleted with their instance.
+type Upgrades interface {
+	// Create inserts upgrade, assigning its ID and timestamps. It returns
+	// ErrNotFound if the instance doesn't exist.
+	Create(ctx context.Context, upgrade *models.Upgrade) error
+	Get(ctx context.Context, id string) (*models.Upgrade, error)
+	// ListByInstance returns the upgrades of an instance, newest first.
+	ListByInstance(ctx context.Context, instanceID string) ([]models.Upgrade, error)
+	// Update saves every mutable field of upgrade and refreshes its
+	// UpdatedAt.
+	Update(ctx context.Context, upgrade *models.Upgrade) error
+}
+
+// BackupPolicies stores the backup schedules of instances, at most one per
+// instance, which are deleted with their instance.
+type BackupPolicies interface {
+	// GetByInstance returns ErrNotFound if the instance has no policy.
+	GetByInstance(ctx context.Context, instanceID string) (*models.BackupPolicy, error)
+	// Put creates the policy of policy.InstanceID or replaces its schedule,
+	// retention and next run. It returns ErrNotFound if the instance
+	// doesn't exist.
+	Put(ctx context.Context, policy *models.BackupPolicy) error
+	DeleteByInstance(ctx context.Context, instanceID string) error
+	// ListDue returns up to limit policies whose NextRunAt is not after
+	// now, earliest first. Inside a transaction the rows stay locked until
+	// it ends, and rows locked by other transactions are skipped, so
+	// concurrent schedulers never pick the same policy.
+	ListDue(ctx context.Context, now time.Time, limit int) ([]models.BackupPolicy, error)
+	// ListWALDue returns up to limit policies with WALArchiving whose
+	// NextWALArchiveAt is not after now, locked like ListDue.
+	ListWALDue(ctx context.Context, now time.Time, limit int) ([]models.BackupPolicy, error)
+}
+
+// NetworkPolicies stores the network policies of instances, at most one
+// per instance, which are deleted with their instance.
+type NetworkPolicies interface {
+	// GetByInstance returns ErrNotFound if the instance has no policy.
+	GetByInstance(ctx context.Context, instanceID string) (*models.NetworkPolicy, error)
+	// Put creates the policy of policy.InstanceID or replaces its exposure
+	// and allowed CIDRs. It returns ErrNotFound if the instance doesn't
+	// exist.
+	Put(ctx context.Context, policy *models.NetworkPolicy) error
+}
+
+// PrivateNetworks stores the private networks of orgs, which are deleted
+// with their org.
+type PrivateNetworks interface {
+	// Create inserts network, assigning its ID and timestamps. It returns
+	// ErrConflict if the org already has one or the subnet or VLAN is
+	// taken, and ErrNotFound if the org doesn't exist.
+	Create(ctx context.Context, network *models.PrivateNetwork) error
+	// GetByOrg returns ErrNotFound if the org has no private network.
+	GetByOrg(ctx context.Context, orgID string) (*models.PrivateNetwork, error)
+	// List returns every private network, which new ones are allocated
+	// around.
+	List(ctx context.Context) ([]models.PrivateNetwork, error)
+}
+
+// WireGuardPeers stores the WireGuard peers of private networks, which are
+// deleted with their network.
+type WireGuardPeers interface {
+	// Create inserts peer, assigning its ID and CreatedAt. It returns
+	// ErrConflict if the network has a peer of the same name or the
+	// address or public key is taken, and ErrNotFound if the network
+	// doesn't exist.
+	Create(ctx context.Context, peer *models.WireGuardPeer) error
+	Get(ctx context.Context, id string) (*models.WireGuardPeer, error)
+	// ListByNetwork returns the peers of a network, oldest first.
+	ListByNetwork(ctx context.Context, networkID string) ([]models.WireGuardPeer, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// DNSRecords stores the records published for instances, at most one per
+// instance, which are deleted with their instance.
+type DNSRecords interface {
+	// Put creates the record of record.InstanceID or replaces it. It
+	// returns ErrNotFound if the instance doesn't exist and ErrConflict if
+	// another instance has the name.
+	Put(ctx context.Context, record *models.DNSRecord) error
+	// GetByInstance returns ErrNotFound if the instance has no record.
+	GetByInstance(ctx context.Context, instanceID string) (*models.DNSRecord, error)
+	// List returns every record, by name.
+	List(ctx context.Context) ([]models.DNSRecord, error)
+	// ClaimReconcile reports whether the records are due to be reconciled
+	// with the DNS provider at now and, if so, moves the next time to
+	// now+interval. Of concurrent calls, at most one claims a due time.
+	ClaimReconcile(ctx context.Context, now time.Time, interval time.Duration) (bool, error)
+}
+
+// Certificates stores the certificates instances serve, at most one per
+// instance, which are deleted with their instance.
+type Certificates interface {
+	// Put creates the certificate of cert.InstanceID or replaces it. It
+	// returns ErrNotFound if the instance doesn't exist.
+	Put(ctx context.Context, cert *models.Certificate) error
+	// GetByInstance returns ErrNotFound if the instance has no certificate.
+	GetByInstance(ctx context.Context, instanceID string) (*models.Certificate, error)
+	// ListDue returns up to limit certificates whose RenewAt is not after
+	// now, earliest first, locked like BackupPolicies.ListDue.
+	ListDue(ctx context.Context, now time.Time, limit int) ([]models.Certificate, error)
+}
+
+// Domains stores the custom domains of instances, which are deleted with
+// their instance.
+type Domains interface {
+	// Create inserts domain, assigning its ID and timestamps. It returns
+	// ErrConflict if the instance already has a domain of the same name
+	// and ErrNotFound if the instance doesn't exist.
+	Create(ctx context.Context, domain *models.Domain) error
+	Get(ctx context.Context, id string) (*models.Domain, error)
+	// ListByInstance returns the domains of an instance, by name.
+	ListByInstance(ctx context.Context, instanceID string) ([]models.Domain, error)
+	// GetVerified returns the verified domain of name, or ErrNotFound if no
+	// instance has verified it.
+	GetVerified(ctx context.Context, name string) (*models.Domain, error)
+	// Update sets the status, error message, next check, expiry and
+	// verification time of domain. It returns ErrConflict if domain is verified and
+	// another instance has a verified domain of the same name.
+	Update(ctx context.Context, domain *models.Domain) error
+	// ListDue returns up to limit pending domains whose NextCheckAt is not
+	// after now, earliest first, locked like BackupPolicies.ListDue.
+	ListDue(ctx context.Context, now time.Time, limit int) ([]models.Domain, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// Backups stores the backups of instances, which are deleted with their
+// instance; their objects are not.
+type Backups interface {
+	// Create inserts backup, assigning its ID and CreatedAt. It returns
+	// ErrNotFound if the instance doesn't exist.
+	Create(ctx context.Context, backup *models.Backup) error
+	Get(ctx context.Context, id string) (*models.Backup, error)
+	// ListByInstance returns the backups of an instance, newest first.
+	ListByInstance(ctx context.Context, instanceID string) ([]models.Backup, error)
+	// Update saves every mutable field of backup.
+	Update(ctx context.Context, backup *models.Backup) error
+	// ListExpired returns up to limit completed or failed backups whose
+	// ExpiresAt is not after now, locked like BackupPolicies.ListDue.
+	ListExpired(ctx context.Context, now time.Time, limit int) ([]models.Backup, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// WALSegments stores the WAL segments archived for instances, which are
+// deleted with their instance; their objects are not.
+type WALSegments interface {
+	// Create records segment. Recording a segment again is not an error,
+	// so a retried archive job can ship one twice. It returns ErrNotFound
+	// if the instance doesn't exist.
+	Create(ctx context.Context, segment *models.WALSegment) error
+	// ListByInstance returns the segments of an instance that end after
+	// afterLSN, or all of them if it is empty, in WAL order.
+	ListByInstance(ctx context.Context, instanceID, afterLSN string) ([]models.WALSegment, error)
+	Delete(ctx context.Context, instanceID, name string) error
+}
+
+// Jobs stores the job queue. See package jobs for the queue itself.
+type Jobs interface {
+	// Create inserts a pending job, assigning its ID and timestamps. A job
+	// with RunAfter set is not claimed before then.
+	Create(ctx context.Context, job *models.Job) error
+	Get(ctx context.Context, id string) (*models.Job, error)
+	// Claim marks the oldest pending job that is due as running on
+	// workerID and returns it, or returns nil when there is none.
+	// Concurrent calls never claim the same job.
+	Claim(ctx context.Context, workerID string) (*models.Job, error)
+	// SetProgress records the progress of a running job.
+	SetProgress(ctx context.Context, id string, progress *models.JobProgress) error
+	// Finish records the final status of a job and releases it from its
+	// worker.
+	Finish(ctx context.Context, id, status, message string) error
+	// Release returns running jobs to pending when their worker has not
+	// sent a heartbeat within timeout.
+	Release(ctx context.Context, timeout time.Duration) (int64, error)
+}
+
+// Workers records the heartbeats of job workers.
+type Workers interface {
+	Heartbeat(ctx context.Context, workerID, hostname string) error
+	Deregister(ctx context.Context, workerID string) error
+	// LastHeartbeat returns the most recent heartbeat of any worker, or the
+	// zero time if none has been recorded.
+	LastHeartbeat(ctx context.Context) (time.Time, error)
+}
+
+// RequireRole returns the role of userID in orgID. It returns ErrNotMember
+// if the user doesn't belong to the org and ErrInsufficientRole if their
+// role ranks below minRole.
+func RequireRole(ctx context.Context, memberships Memberships, userID, orgID string, minRole models.UserRole) (models.UserRole, error) {
+	m, err := memberships.Get(ctx, userID, orgID)
+	if err == ErrNotFound {
+		return "", ErrNotMember
+	}
+	if err != nil {
+		return "", err
+	}
+	if !m.Role.AtLeast(minRole) {
+		return m.Role, ErrInsufficientRole
+	}
+	return m.Role, nil
+}
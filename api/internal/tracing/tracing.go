@@ -0,0 +1,130 @@
+// Package tracing sets up OpenTelemetry tracing. Spans cover gin routes, SQL
+// statements, outgoing HTTP calls and jobs; the trace context travels in job
+// payloads so a job's spans join the trace of the request that enqueued it.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/zallarak/db/api/internal/config"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies spans created by this module's own code.
+const instrumentationName = "github.com/zallarak/db/api"
+
+// Init installs the global tracer provider and W3C trace context
+// propagation. component ("api" or "worker") is recorded on every span. The
+// returned function flushes buffered spans and must be called on shutdown.
+//
+// The propagator is installed even when tracing is off, so trace context
+// from callers still reaches jobs and outgoing requests.
+func Init(ctx context.Context, cfg config.TracingConfig, component string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	exporter, closer, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+		attribute.String("dbx.component", component),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+func newExporter(ctx context.Context, cfg config.TracingConfig) (sdktrace.SpanExporter, io.Closer, error) {
+	switch cfg.Exporter {
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, err
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exporter, f, nil
+	case "otlp":
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		return exporter, nil, nil
+	}
+	return nil, nil, nil
+}
+
+// Tracer returns the tracer for spans created by this module.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Inject returns the W3C trace context of ctx, keyed by header name, for
+// storing alongside queued work.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract returns ctx with the trace context previously captured by Inject.
+func Extract(ctx context.Context, fields map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(fields))
+}
+
+// Transport wraps rt, or http.DefaultTransport if nil, with client spans
+// named after client (proxmox, oidc) that propagate the trace context to the
+// server.
+func Transport(client string, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return client + " " + r.Method
+		}),
+	)
+}
@@ -0,0 +1,116 @@
+package wireguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/tracing"
+)
+
+// requestTimeout bounds calls to the gateway.
+const requestTimeout = 30 * time.Second
+
+// APIError is an error response from the gateway.
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("wireguard gateway: %d %s", e.Status, e.Message)
+}
+
+// GatewayPeer is a peer as the gateway routes it: tunnels from PublicKey
+// may only send from Address, and reach Subnet on VLAN.
+type GatewayPeer struct {
+	PublicKey string `json:"public_key"`
+	Address   string `json:"address"`
+	Subnet    string `json:"subnet"`
+	VLAN      int    `json:"vlan"`
+}
+
+// Gateway is a client for the API of the WireGuard gateway. The gateway
+// has an address on the VLAN of every private network, the first of its
+// subnet, and only routes peers to the subnet of their own network.
+type Gateway struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewGateway(cfg config.WireGuardConfig) *Gateway {
+	return &Gateway{
+		baseURL: strings.TrimSuffix(cfg.GatewayURL, "/") + "/v1",
+		token:   cfg.Token,
+		http: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: metrics.InstrumentTransport("wireguard", tracing.Transport("wireguard", http.DefaultTransport)),
+		},
+	}
+}
+
+// PutPeer adds the peer id to the gateway, or replaces it.
+func (g *Gateway) PutPeer(ctx context.Context, id string, peer GatewayPeer) error {
+	return g.do(ctx, http.MethodPut, "/peers/"+url.PathEscape(id), peer)
+}
+
+// DeletePeer removes the peer id from the gateway, closing its tunnel. A
+// peer that is already gone is not an error.
+func (g *Gateway) DeletePeer(ctx context.Context, id string) error {
+	err := g.do(ctx, http.MethodDelete, "/peers/"+url.PathEscape(id), nil)
+	if e, ok := err.(*APIError); ok && e.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// do sends in as JSON, if not nil, and returns an *APIError unless the
+// response status is 2xx.
+func (g *Gateway) do(ctx context.Context, method, path string, in interface{}) error {
+	var body *bytes.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req, err = http.NewRequestWithContext(ctx, method, g.baseURL+path, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("wireguard gateway request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &APIError{Status: resp.StatusCode, Message: e.Error}
+	}
+	return nil
+}
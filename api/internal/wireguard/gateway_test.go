@@ -0,0 +1,116 @@
+package wireguard_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/apispec/apispectest"
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/proxmox/fake"
+	"github.com/zallarak/db/api/internal/wireguard"
+	"github.com/zallarak/db/api/openapi"
+)
+
+// TestGatewayContract drives the simulated gateway with the client, and
+// fails on any request or response that breaks the contract, or any
+// operation left uncalled.
+func TestGatewayContract(t *testing.T) {
+	// The gateway is served under /wireguard
+	c := apispectest.New(t, openapi.WireGuardGatewaySpec, func(path string) (string, bool) {
+		rest, ok := strings.CutPrefix(path, "/wireguard/v1")
+		return rest, ok
+	}, fake.New(fake.Options{GatewayToken: "gateway-token"}))
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	ctx := context.Background()
+	gateway := wireguard.NewGateway(config.WireGuardConfig{GatewayURL: srv.URL + "/wireguard", Token: "gateway-token"})
+	key := func() string {
+		k, err := wireguard.GeneratePrivateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k.PublicKey().String()
+	}
+
+	laptop := wireguard.GatewayPeer{PublicKey: key(), Address: "10.96.0.128", Subnet: "10.96.0.0/24", VLAN: 100}
+	if err := gateway.PutPeer(ctx, "peer-1", laptop); err != nil {
+		t.Fatal(err)
+	}
+	// Repeating is safe
+	if err := gateway.PutPeer(ctx, "peer-1", laptop); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.PutPeer(ctx, "peer-2", wireguard.GatewayPeer{PublicKey: key(), Address: "10.96.1.128", Subnet: "10.96.1.0/24", VLAN: 101}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		peer wireguard.GatewayPeer
+		want int
+	}{
+		{"same address", wireguard.GatewayPeer{PublicKey: key(), Address: "10.96.0.128", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusConflict},
+		{"same key", wireguard.GatewayPeer{PublicKey: laptop.PublicKey, Address: "10.96.0.129", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusConflict},
+		{"invalid key", wireguard.GatewayPeer{PublicKey: "AAAA", Address: "10.96.0.129", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusBadRequest},
+		{"address outside the subnet", wireguard.GatewayPeer{PublicKey: key(), Address: "10.96.1.129", Subnet: "10.96.0.0/24", VLAN: 100}, http.StatusBadRequest},
+		{"subnet with host bits", wireguard.GatewayPeer{PublicKey: key(), Address: "10.96.0.129", Subnet: "10.96.0.1/24", VLAN: 100}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		err := gateway.PutPeer(ctx, "peer-3", tt.peer)
+		if e, ok := err.(*wireguard.APIError); !ok || e.Status != tt.want {
+			t.Errorf("%s: PutPeer = %v, want status %d", tt.name, err, tt.want)
+		}
+	}
+
+	peers := listPeers(t, srv.URL+"/wireguard/v1/peers")
+	if len(peers) != 2 || peers[0].ID != "peer-1" || peers[0].Address != laptop.Address || peers[1].ID != "peer-2" {
+		t.Errorf("peers = %+v", peers)
+	}
+
+	if err := gateway.DeletePeer(ctx, "peer-1"); err != nil {
+		t.Fatal(err)
+	}
+	// A peer that is already gone is not an error
+	if err := gateway.DeletePeer(ctx, "peer-1"); err != nil {
+		t.Fatal(err)
+	}
+	if peers := listPeers(t, srv.URL+"/wireguard/v1/peers"); len(peers) != 1 {
+		t.Errorf("peers after delete = %+v", peers)
+	}
+
+	bad := wireguard.NewGateway(config.WireGuardConfig{GatewayURL: srv.URL + "/wireguard", Token: "other"})
+	if err := bad.PutPeer(ctx, "peer-1", laptop); err == nil {
+		t.Error("gateway accepted an invalid token")
+	}
+
+	c.CheckCalled()
+}
+
+type listedPeer struct {
+	ID string `json:"id"`
+	wireguard.GatewayPeer
+}
+
+func listPeers(t *testing.T, url string) []listedPeer {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer gateway-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Peers []listedPeer `json:"peers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Peers
+}
@@ -0,0 +1,126 @@
+// Package wireguard mints WireGuard keys and renders wg-quick
+// configurations in pure Go, so neither needs kernel WireGuard or the wg
+// tool, and is a client for the gateway that terminates the tunnels of the
+// peers of private networks.
+package wireguard
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// KeyLen is the length of WireGuard keys, which are Curve25519 keys.
+const KeyLen = 32
+
+// Key is a WireGuard private or public key.
+type Key [KeyLen]byte
+
+// GeneratePrivateKey returns a private key read from rand, clamped as
+// `wg genkey` clamps them. Pass crypto/rand.Reader unless the key has to
+// be reproducible.
+func GeneratePrivateKey(rand io.Reader) (Key, error) {
+	var k Key
+	if _, err := io.ReadFull(rand, k[:]); err != nil {
+		return Key{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	k[0] &= 248
+	k[31] = k[31]&127 | 64
+	return k, nil
+}
+
+// ParseKey parses a key in base64, as wg prints them.
+func ParseKey(s string) (Key, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) != KeyLen {
+		return Key{}, fmt.Errorf("invalid WireGuard key %q", s)
+	}
+	var k Key
+	copy(k[:], data)
+	return k, nil
+}
+
+// PublicKey returns the public key of the private key k, as `wg pubkey`
+// does.
+func (k Key) PublicKey() Key {
+	private, err := ecdh.X25519().NewPrivateKey(k[:])
+	if err != nil {
+		// Only keys of the wrong length are refused
+		panic(err)
+	}
+	var public Key
+	copy(public[:], private.PublicKey().Bytes())
+	return public
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// Config is the configuration of a wg-quick interface and its peers.
+type Config struct {
+	// Comment is written at the top, a "#" before each line.
+	Comment    string
+	PrivateKey Key
+	// Address is the address of the interface, with the prefix length of
+	// the route wg-quick adds for it.
+	Address []netip.Prefix
+	DNS     []netip.Addr
+	Peers   []Peer
+}
+
+// Peer is a peer of a Config.
+type Peer struct {
+	PublicKey Key
+	// Endpoint is the host:port of the peer; empty waits for it to connect.
+	Endpoint string
+	// AllowedIPs are routed to the peer, and accepted from it.
+	AllowedIPs []netip.Prefix
+	// PersistentKeepalive is how often, in seconds, to send a keepalive
+	// to keep NAT mappings open; 0 sends none.
+	PersistentKeepalive int
+}
+
+// String renders c in the format wg-quick reads from
+// /etc/wireguard/<interface>.conf.
+func (c Config) String() string {
+	var b strings.Builder
+	if c.Comment != "" {
+		for _, line := range strings.Split(c.Comment, "\n") {
+			b.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("[Interface]\n")
+	b.WriteString("PrivateKey = " + c.PrivateKey.String() + "\n")
+	if len(c.Address) > 0 {
+		b.WriteString("Address = " + join(c.Address) + "\n")
+	}
+	if len(c.DNS) > 0 {
+		b.WriteString("DNS = " + join(c.DNS) + "\n")
+	}
+	for _, p := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		b.WriteString("PublicKey = " + p.PublicKey.String() + "\n")
+		if p.Endpoint != "" {
+			b.WriteString("Endpoint = " + p.Endpoint + "\n")
+		}
+		b.WriteString("AllowedIPs = " + join(p.AllowedIPs) + "\n")
+		if p.PersistentKeepalive > 0 {
+			b.WriteString("PersistentKeepalive = " + strconv.Itoa(p.PersistentKeepalive) + "\n")
+		}
+	}
+	return b.String()
+}
+
+func join[T fmt.Stringer](items []T) string {
+	s := make([]string, len(items))
+	for i, item := range items {
+		s[i] = item.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,142 @@
+package wireguard_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/zallarak/db/api/internal/wireguard"
+)
+
+func hexKey(t *testing.T, s string) wireguard.Key {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != wireguard.KeyLen {
+		t.Fatalf("invalid key %s", s)
+	}
+	var k wireguard.Key
+	copy(k[:], data)
+	return k
+}
+
+func TestGeneratePrivateKeyClamps(t *testing.T) {
+	for _, fill := range []byte{0x00, 0xff} {
+		k, err := wireguard.GeneratePrivateKey(bytes.NewReader(bytes.Repeat([]byte{fill}, wireguard.KeyLen)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k[0]&7 != 0 {
+			t.Errorf("key from %#x bytes: low bits of the first byte set: %08b", fill, k[0])
+		}
+		if k[31]&0x80 != 0 || k[31]&0x40 == 0 {
+			t.Errorf("key from %#x bytes: last byte %08b, want 01xxxxxx", fill, k[31])
+		}
+		if k[1] != fill || k[30] != fill {
+			t.Errorf("key from %#x bytes: middle bytes changed", fill)
+		}
+	}
+
+	if _, err := wireguard.GeneratePrivateKey(bytes.NewReader(make([]byte, wireguard.KeyLen-1))); err == nil {
+		t.Error("GeneratePrivateKey accepted a short read")
+	}
+
+	a, _ := wireguard.GeneratePrivateKey(rand.Reader)
+	b, _ := wireguard.GeneratePrivateKey(rand.Reader)
+	if a == b {
+		t.Error("GeneratePrivateKey returned the same key twice")
+	}
+}
+
+// TestPublicKey derives public keys from the private keys of the
+// Diffie-Hellman example of RFC 7748, section 6.1.
+func TestPublicKey(t *testing.T) {
+	tests := []struct {
+		private, public string
+	}{
+		{"77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a", "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"},
+		{"5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb", "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"},
+	}
+	for _, tt := range tests {
+		if got, want := hexKey(t, tt.private).PublicKey(), hexKey(t, tt.public); got != want {
+			t.Errorf("PublicKey of %s = %x, want %x", tt.private, got, want)
+		}
+	}
+}
+
+// TestWGKeys checks a key pair printed by `wg genkey | tee private | wg
+// pubkey`.
+func TestWGKeys(t *testing.T) {
+	private, err := wireguard.ParseKey("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := private.PublicKey().String(), "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="; got != want {
+		t.Errorf("PublicKey = %s, want %s", got, want)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	k, err := wireguard.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := wireguard.ParseKey(k.String())
+	if err != nil || parsed != k {
+		t.Errorf("ParseKey(%s) = %s, %v", k, parsed, err)
+	}
+	for _, s := range []string{"", "not base64!", "AAAA", k.String() + "AAAA"} {
+		if _, err := wireguard.ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) accepted an invalid key", s)
+		}
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	private := hexKey(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	gateway := hexKey(t, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+	config := wireguard.Config{
+		Comment:    "WireGuard peer \"laptop\".\n\nKeep this file safe.",
+		PrivateKey: private,
+		Address:    []netip.Prefix{netip.MustParsePrefix("10.96.0.128/24")},
+		DNS:        []netip.Addr{netip.MustParseAddr("10.96.0.1")},
+		Peers: []wireguard.Peer{{
+			PublicKey:           gateway,
+			Endpoint:            "vpn.example.com:51820",
+			AllowedIPs:          []netip.Prefix{netip.MustParsePrefix("10.96.0.0/24"), netip.MustParsePrefix("fd00::/64")},
+			PersistentKeepalive: 25,
+		}},
+	}
+	want := strings.Join([]string{
+		`# WireGuard peer "laptop".`,
+		`#`,
+		`# Keep this file safe.`,
+		``,
+		`[Interface]`,
+		`PrivateKey = dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=`,
+		`Address = 10.96.0.128/24`,
+		`DNS = 10.96.0.1`,
+		``,
+		`[Peer]`,
+		`PublicKey = 3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08=`,
+		`Endpoint = vpn.example.com:51820`,
+		`AllowedIPs = 10.96.0.0/24, fd00::/64`,
+		`PersistentKeepalive = 25`,
+		``,
+	}, "\n")
+	if got := config.String(); got != want {
+		t.Errorf("String() =\n%s\nwant\n%s", got, want)
+	}
+
+	// A peer without an endpoint waits for the other side to connect
+	config = wireguard.Config{
+		PrivateKey: private,
+		Peers:      []wireguard.Peer{{PublicKey: gateway, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.96.0.128/32")}}},
+	}
+	want = "[Interface]\nPrivateKey = dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=\n\n[Peer]\nPublicKey = 3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08=\nAllowedIPs = 10.96.0.128/32\n"
+	if got := config.String(); got != want {
+		t.Errorf("String() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,206 @@
+// Package worker runs queued jobs. A worker runs embedded in the API server
+// or on its own via `server worker`, and records a heartbeat that readiness
+// probes use to tell whether jobs are being processed.
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zallarak/db/api/internal/config"
+	"github.com/zallarak/db/api/internal/jobs"
+	"github.com/zallarak/db/api/internal/logging"
+	"github.com/zallarak/db/api/internal/metrics"
+	"github.com/zallarak/db/api/internal/models"
+	"github.com/zallarak/db/api/internal/store"
+	"github.com/zallarak/db/api/internal/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HandlerFunc runs a job. A returned error marks the job failed.
+type HandlerFunc func(ctx context.Context, job *models.Job) error
+
+type Worker struct {
+	workers  store.Workers
+	queue    *jobs.Queue
+	cfg      config.WorkerConfig
+	id       string
+	hostname string
+	handlers map[string]HandlerFunc
+	logger   *slog.Logger
+}
+
+func New(workers store.Workers, queue *jobs.Queue, cfg config.WorkerConfig) *Worker {
+	hostname, _ := os.Hostname()
+	id := hostname + "-" + uuid.NewString()[:8]
+	return &Worker{
+		workers:  workers,
+		queue:    queue,
+		cfg:      cfg,
+		id:       id,
+		hostname: hostname,
+		handlers: make(map[string]HandlerFunc),
+		logger:   slog.Default().With("worker_id", id),
+	}
+}
+
+// Handle registers fn for jobs of jobType. Jobs without a handler fail.
+func (w *Worker) Handle(jobType string, fn HandlerFunc) {
+	w.handlers[jobType] = fn
+}
+
+// Run processes jobs until ctx is cancelled. In-flight jobs are given
+// cfg.ShutdownTimeout to finish before their context is cancelled too.
+func (w *Worker) Run(ctx context.Context) error {
+	if err := w.heartbeat(ctx); err != nil {
+		return err
+	}
+	w.logger.Info("worker started", "concurrency", w.cfg.Concurrency)
+
+	// Jobs get their own context so a shutdown signal doesn't abort them
+	// halfway through.
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(w.cfg.ShutdownTimeout, cancelJobs)
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.poll(ctx, jobCtx)
+		}()
+	}
+
+	ticker := time.NewTicker(w.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			w.deregister()
+			w.logger.Info("worker stopped")
+			return nil
+		case <-ticker.C:
+			if err := w.heartbeat(ctx); err != nil {
+				w.logger.Error("worker heartbeat failed", "error", err)
+				continue
+			}
+			if n, err := w.queue.Release(ctx, w.cfg.HeartbeatTimeout); err != nil {
+				w.logger.Error("failed to release jobs of stale workers", "error", err)
+			} else if n > 0 {
+				w.logger.Warn("released jobs held by stale workers", "count", n)
+			}
+		}
+	}
+}
+
+// poll claims and runs jobs until ctx is cancelled, sleeping for
+// cfg.PollInterval whenever the queue is empty.
+func (w *Worker) poll(ctx, jobCtx context.Context) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, err := w.queue.Claim(ctx, w.id)
+		if err != nil && ctx.Err() == nil {
+			w.logger.Error("failed to claim job", "error", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.cfg.PollInterval):
+			}
+			continue
+		}
+
+		w.process(jobCtx, job)
+	}
+}
+
+// process runs job with a logger carrying the job and the ID of the request
+// that enqueued it, and records the outcome.
+func (w *Worker) process(ctx context.Context, job *models.Job) {
+	meta := jobs.ParseMeta(job.PayloadJSON)
+
+	ctx = logging.WithLogger(ctx, w.logger)
+	if meta.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, meta.RequestID)
+	}
+	ctx = logging.With(ctx, "job_id", job.ID, "job_type", job.Type)
+
+	// Join the enqueueing request's trace, showing the time spent waiting in
+	// the queue as its own span before the job's.
+	ctx = tracing.Extract(ctx, meta.TraceContext())
+	attrs := trace.WithAttributes(
+		attribute.String("job.id", job.ID),
+		attribute.String("job.type", job.Type),
+	)
+	if job.StartedAt != nil {
+		_, wait := tracing.Tracer().Start(ctx, "queued "+job.Type, attrs, trace.WithTimestamp(job.CreatedAt))
+		wait.End(trace.WithTimestamp(*job.StartedAt))
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "job "+job.Type, attrs, trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	if sc := span.SpanContext(); sc.IsValid() {
+		ctx = logging.With(ctx, "trace_id", sc.TraceID().String())
+	}
+	logger := logging.FromContext(ctx)
+
+	logger.Info("job started")
+	start := time.Now()
+	jobErr := w.run(ctx, job)
+	elapsed := time.Since(start)
+	duration := slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000)
+	if jobErr != nil {
+		span.SetStatus(codes.Error, jobErr.Error())
+		logger.Error("job failed", duration, "error", jobErr)
+		metrics.JobFailures.WithLabelValues(job.Type).Inc()
+		metrics.JobDuration.WithLabelValues(job.Type, jobs.StatusFailed).Observe(elapsed.Seconds())
+	} else {
+		logger.Info("job completed", duration)
+		metrics.JobDuration.WithLabelValues(job.Type, jobs.StatusCompleted).Observe(elapsed.Seconds())
+	}
+
+	if err := w.queue.Finish(ctx, job.ID, jobErr); err != nil {
+		logger.Error("failed to record job result", "error", err)
+	}
+}
+
+func (w *Worker) run(ctx context.Context, job *models.Job) (err error) {
+	fn, ok := w.handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("no handler for job type %q", job.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return fn(ctx, job)
+}
+
+func (w *Worker) heartbeat(ctx context.Context) error {
+	return w.workers.Heartbeat(ctx, w.id, w.hostname)
+}
+
+func (w *Worker) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.workers.Deregister(ctx, w.id); err != nil {
+		w.logger.Error("failed to remove worker heartbeat", "error", err)
+	}
+}
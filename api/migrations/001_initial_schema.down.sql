@@ -0,0 +1,19 @@
+-- Drops everything created by 001_initial_schema.up.sql
+
+DROP TABLE IF EXISTS backups;
+DROP TABLE IF EXISTS backup_policies;
+DROP TABLE IF EXISTS network_policies;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS audit_logs;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS instances;
+DROP TABLE IF EXISTS projects;
+DROP TABLE IF EXISTS memberships;
+DROP TABLE IF EXISTS orgs;
+DROP TABLE IF EXISTS users;
+
+DROP FUNCTION IF EXISTS update_updated_at_column();
+
+DROP TYPE IF EXISTS job_status;
+DROP TYPE IF EXISTS instance_status;
+DROP TYPE IF EXISTS user_role;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS sso_login_states;
+DROP TABLE IF EXISTS org_sso_connections;
+DROP TABLE IF EXISTS user_identities;
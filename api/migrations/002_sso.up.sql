@@ -0,0 +1,41 @@
+-- OpenID Connect single sign-on
+-- External identities linked to users, per-org SSO connections and
+-- short-lived login state for the authorization code + PKCE flow.
+
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_login_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE(issuer, subject)
+);
+
+CREATE TABLE org_sso_connections (
+    org_id UUID PRIMARY KEY REFERENCES orgs(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    client_secret TEXT NOT NULL DEFAULT '', -- empty for public clients (PKCE only)
+    enforced BOOLEAN NOT NULL DEFAULT FALSE, -- members must sign in through this connection
+    auto_join_domains TEXT[] NOT NULL DEFAULT '{}', -- verified emails on these domains join the org
+    auto_join_role user_role NOT NULL DEFAULT 'member',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE sso_login_states (
+    state TEXT PRIMARY KEY,
+    org_id UUID NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+CREATE INDEX idx_org_sso_connections_domains ON org_sso_connections USING GIN (auto_join_domains);
+CREATE INDEX idx_sso_login_states_expires_at ON sso_login_states(expires_at);
+
+CREATE TRIGGER update_org_sso_connections_updated_at BEFORE UPDATE ON org_sso_connections
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS device_authorizations;
+DROP TYPE IF EXISTS device_authorization_status;
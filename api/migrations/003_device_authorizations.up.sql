@@ -0,0 +1,20 @@
+-- OAuth 2.0 device authorization grant (RFC 8628)
+-- Pending `dbx auth login --web` sessions waiting for approval in the console.
+
+CREATE TYPE device_authorization_status AS ENUM ('pending', 'approved', 'denied');
+
+CREATE TABLE device_authorizations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_code_hash TEXT UNIQUE NOT NULL, -- SHA-256 of the device code; the code itself is never stored
+    user_code VARCHAR(16) UNIQUE NOT NULL, -- short code the user types into the console
+    client_id VARCHAR(100) NOT NULL,
+    status device_authorization_status NOT NULL DEFAULT 'pending',
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- set on approval
+    sso_org_id UUID REFERENCES orgs(id) ON DELETE SET NULL, -- SSO scope of the approving session
+    poll_interval INTEGER NOT NULL DEFAULT 5, -- seconds, raised on slow_down
+    last_polled_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_device_authorizations_expires_at ON device_authorizations(expires_at);
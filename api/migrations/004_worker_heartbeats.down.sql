@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_jobs_pending;
+ALTER TABLE jobs DROP COLUMN IF EXISTS worker_id;
+DROP TABLE IF EXISTS worker_heartbeats;
@@ -0,0 +1,16 @@
+-- Background workers
+-- Each worker process records a heartbeat so readiness probes can tell
+-- whether jobs are being processed, and so jobs held by a dead worker can be
+-- handed to another one.
+
+CREATE TABLE worker_heartbeats (
+    worker_id TEXT PRIMARY KEY,
+    hostname VARCHAR(255) NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE jobs ADD COLUMN worker_id TEXT; -- worker running the job, NULL unless status = 'running'
+
+CREATE INDEX idx_worker_heartbeats_last_seen_at ON worker_heartbeats(last_seen_at);
+CREATE INDEX idx_jobs_pending ON jobs(created_at) WHERE status = 'pending';
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS project_quotas;
+DROP TABLE IF EXISTS org_quotas;
+
+ALTER TABLE instances DROP COLUMN IF EXISTS disk_gib;
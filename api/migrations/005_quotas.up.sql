@@ -0,0 +1,26 @@
+-- Quotas
+-- Orgs and projects are limited by the quotas section of the server config.
+-- A row here overrides those limits for one org or project; NULL columns
+-- keep the configured value and 0 lifts the limit.
+
+ALTER TABLE instances ADD COLUMN disk_gib INTEGER; -- NULL uses the plan's disk size
+
+CREATE TABLE org_quotas (
+    org_id UUID PRIMARY KEY REFERENCES orgs(id) ON DELETE CASCADE,
+    max_instances INTEGER CHECK (max_instances >= 0),
+    max_vcpus INTEGER CHECK (max_vcpus >= 0),
+    max_memory_mb INTEGER CHECK (max_memory_mb >= 0),
+    max_disk_gib INTEGER CHECK (max_disk_gib >= 0),
+    allowed_plans TEXT[],
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE project_quotas (
+    project_id UUID PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+    max_instances INTEGER CHECK (max_instances >= 0),
+    max_vcpus INTEGER CHECK (max_vcpus >= 0),
+    max_memory_mb INTEGER CHECK (max_memory_mb >= 0),
+    max_disk_gib INTEGER CHECK (max_disk_gib >= 0),
+    allowed_plans TEXT[],
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
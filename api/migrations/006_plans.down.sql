@@ -0,0 +1,5 @@
+ALTER TABLE instances ALTER COLUMN disk_gib DROP NOT NULL;
+ALTER TABLE instances DROP CONSTRAINT IF EXISTS instances_plan_fkey;
+ALTER TABLE instances ADD CONSTRAINT instances_plan_check CHECK (plan IN ('nano', 'lite', 'pro', 'pro-heavy'));
+
+DROP TABLE IF EXISTS plans;
@@ -0,0 +1,31 @@
+-- Plan catalog
+-- Plans used to be a CHECK constraint on instances.plan, with their sizes
+-- compiled into the server. They are rows now: add plans here, and mark old
+-- ones deprecated rather than deleting them while instances use them.
+
+CREATE TABLE plans (
+    name VARCHAR(50) PRIMARY KEY,
+    vcpus INTEGER NOT NULL CHECK (vcpus > 0),
+    memory_mb INTEGER NOT NULL CHECK (memory_mb > 0),
+    disk_gib INTEGER NOT NULL, -- disk of instances that don't choose one
+    min_disk_gib INTEGER NOT NULL,
+    max_disk_gib INTEGER NOT NULL,
+    max_connections INTEGER NOT NULL CHECK (max_connections > 0),
+    pg_versions INTEGER[] NOT NULL CHECK (cardinality(pg_versions) > 0),
+    deprecated BOOLEAN NOT NULL DEFAULT FALSE, -- listed, but takes no new instances
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    CHECK (0 < min_disk_gib AND min_disk_gib <= disk_gib AND disk_gib <= max_disk_gib)
+);
+
+INSERT INTO plans (name, vcpus, memory_mb, disk_gib, min_disk_gib, max_disk_gib, max_connections, pg_versions) VALUES
+    ('nano', 1, 2048, 20, 10, 2048, 100, '{14,15,16,17}'),
+    ('lite', 2, 4096, 80, 10, 2048, 200, '{14,15,16,17}'),
+    ('pro', 4, 8192, 150, 10, 2048, 400, '{14,15,16,17}'),
+    ('pro-heavy', 8, 16384, 300, 10, 2048, 800, '{14,15,16,17}');
+
+ALTER TABLE instances DROP CONSTRAINT IF EXISTS instances_plan_check;
+ALTER TABLE instances ADD CONSTRAINT instances_plan_fkey FOREIGN KEY (plan) REFERENCES plans(name);
+
+-- Instances record their disk size rather than inheriting the plan's
+UPDATE instances SET disk_gib = plans.disk_gib FROM plans WHERE instances.plan = plans.name AND instances.disk_gib IS NULL;
+ALTER TABLE instances ALTER COLUMN disk_gib SET NOT NULL;
@@ -0,0 +1,11 @@
+-- Enum values can't be dropped, so the type is recreated without 'resizing'.
+-- Instances still resizing are taken to be running.
+
+UPDATE instances SET status = 'running' WHERE status = 'resizing';
+
+ALTER TYPE instance_status RENAME TO instance_status_old;
+CREATE TYPE instance_status AS ENUM ('pending', 'provisioning', 'running', 'stopped', 'deleting', 'failed');
+ALTER TABLE instances ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE instances ALTER COLUMN status TYPE instance_status USING status::text::instance_status;
+ALTER TABLE instances ALTER COLUMN status SET DEFAULT 'pending';
+DROP TYPE instance_status_old;
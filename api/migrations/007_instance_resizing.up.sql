@@ -0,0 +1,5 @@
+-- Instance resizing
+-- An instance is resizing while a resize_instance job moves it to another
+-- plan or grows its disk.
+
+ALTER TYPE instance_status ADD VALUE IF NOT EXISTS 'resizing' AFTER 'stopped';
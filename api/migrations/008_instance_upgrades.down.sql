@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS instance_upgrades;
+DROP TYPE IF EXISTS upgrade_status;
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS progress;
+ALTER TABLE jobs DROP COLUMN IF EXISTS run_after;
+
+-- Enum values can't be dropped, so the type is recreated without
+-- 'upgrading'. Instances still upgrading run on their blue container.
+UPDATE instances SET status = 'running' WHERE status = 'upgrading';
+
+ALTER TYPE instance_status RENAME TO instance_status_old;
+CREATE TYPE instance_status AS ENUM ('pending', 'provisioning', 'running', 'stopped', 'resizing', 'deleting', 'failed');
+ALTER TABLE instances ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE instances ALTER COLUMN status TYPE instance_status USING status::text::instance_status;
+ALTER TABLE instances ALTER COLUMN status SET DEFAULT 'pending';
+DROP TYPE instance_status_old;
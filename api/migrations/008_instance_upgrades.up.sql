@@ -0,0 +1,34 @@
+-- Blue/green major version upgrades
+-- An upgrade provisions a green container running the new Postgres
+-- version, copies the data from the instance's blue container and cuts
+-- over to green. Blue is kept, stopped, until rollback_until. Jobs can be
+-- delayed with run_after, which closes the rollback window, and report
+-- their progress.
+
+ALTER TYPE instance_status ADD VALUE IF NOT EXISTS 'upgrading' AFTER 'resizing';
+
+ALTER TABLE jobs ADD COLUMN run_after TIMESTAMP WITH TIME ZONE;
+ALTER TABLE jobs ADD COLUMN progress JSONB;
+
+CREATE TYPE upgrade_status AS ENUM ('running', 'cut_over', 'finished', 'rolling_back', 'rolled_back', 'failed');
+
+CREATE TABLE instance_upgrades (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    instance_id UUID NOT NULL REFERENCES instances(id) ON DELETE CASCADE,
+    from_version INTEGER NOT NULL,
+    to_version INTEGER NOT NULL CHECK (to_version > from_version),
+    status upgrade_status NOT NULL DEFAULT 'running',
+    blue_node VARCHAR(255) NOT NULL,
+    blue_ctid INTEGER NOT NULL,
+    green_node VARCHAR(255),
+    green_ctid INTEGER,
+    cut_over_at TIMESTAMP WITH TIME ZONE,
+    rollback_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_instance_upgrades_instance_id ON instance_upgrades(instance_id, created_at);
+
+CREATE TRIGGER update_instance_upgrades_updated_at BEFORE UPDATE ON instance_upgrades
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,20 @@
+DROP INDEX IF EXISTS idx_backups_expires_at;
+DROP INDEX IF EXISTS idx_backups_instance_id;
+
+ALTER TABLE backups DROP CONSTRAINT IF EXISTS backups_status_check;
+ALTER TABLE backups ALTER COLUMN status DROP NOT NULL;
+UPDATE backups SET started_at = created_at WHERE started_at IS NULL;
+ALTER TABLE backups ALTER COLUMN started_at SET DEFAULT NOW();
+ALTER TABLE backups DROP COLUMN IF EXISTS created_at;
+ALTER TABLE backups DROP COLUMN IF EXISTS error_message;
+ALTER TABLE backups DROP COLUMN IF EXISTS pg_version;
+ALTER TABLE backups DROP COLUMN IF EXISTS kind;
+
+DROP INDEX IF EXISTS idx_backup_policies_next_run_at;
+
+ALTER TABLE backup_policies ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE backup_policies ALTER COLUMN created_at DROP NOT NULL;
+ALTER TABLE backup_policies DROP COLUMN IF EXISTS next_run_at;
+ALTER TABLE backup_policies DROP CONSTRAINT IF EXISTS backup_policies_retention_days_check;
+ALTER TABLE backup_policies ALTER COLUMN retention_days DROP NOT NULL;
+ALTER TABLE backup_policies DROP CONSTRAINT IF EXISTS backup_policies_instance_id_key;
@@ -0,0 +1,29 @@
+-- Scheduled backups
+-- The backup_policies and backups tables of the initial schema go into
+-- use. An instance has at most one policy, whose cron schedule the
+-- scheduler evaluates into next_run_at. Backups are base backups written to
+-- an object store at repo_url, taken on schedule or on demand, and pruned
+-- once expires_at passes.
+
+ALTER TABLE backup_policies ADD CONSTRAINT backup_policies_instance_id_key UNIQUE (instance_id);
+ALTER TABLE backup_policies ALTER COLUMN retention_days SET NOT NULL;
+ALTER TABLE backup_policies ADD CONSTRAINT backup_policies_retention_days_check CHECK (retention_days > 0);
+ALTER TABLE backup_policies ADD COLUMN next_run_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE backup_policies ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE backup_policies ALTER COLUMN updated_at SET NOT NULL;
+
+CREATE INDEX idx_backup_policies_next_run_at ON backup_policies(next_run_at);
+
+ALTER TABLE backups ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'manual' CHECK (kind IN ('scheduled', 'manual'));
+ALTER TABLE backups ADD COLUMN pg_version INTEGER;
+ALTER TABLE backups ADD COLUMN error_message TEXT;
+ALTER TABLE backups ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+-- started_at defaulted to the insert time; it is now set when the job runs
+UPDATE backups SET created_at = started_at WHERE started_at IS NOT NULL;
+ALTER TABLE backups ALTER COLUMN started_at DROP DEFAULT;
+ALTER TABLE backups ALTER COLUMN status SET NOT NULL;
+ALTER TABLE backups ADD CONSTRAINT backups_status_check
+    CHECK (status IN ('pending', 'running', 'completed', 'failed', 'deleting'));
+
+CREATE INDEX idx_backups_instance_id ON backups(instance_id, created_at);
+CREATE INDEX idx_backups_expires_at ON backups(expires_at) WHERE status IN ('completed', 'failed');
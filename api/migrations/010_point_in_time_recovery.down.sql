@@ -0,0 +1,11 @@
+ALTER TABLE instances DROP COLUMN IF EXISTS restored_from;
+
+DROP TABLE IF EXISTS wal_segments;
+
+ALTER TABLE backups DROP COLUMN IF EXISTS end_lsn;
+ALTER TABLE backups DROP COLUMN IF EXISTS start_lsn;
+
+DROP INDEX IF EXISTS idx_backup_policies_next_wal_archive_at;
+
+ALTER TABLE backup_policies DROP COLUMN IF EXISTS next_wal_archive_at;
+ALTER TABLE backup_policies DROP COLUMN IF EXISTS wal_archiving;
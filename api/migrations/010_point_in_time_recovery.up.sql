@@ -0,0 +1,29 @@
+-- Point-in-time recovery
+-- Instances with a backup policy that archives WAL have their WAL segments
+-- shipped to the object store every backups.wal_archive_interval. A backup
+-- records the LSNs replay from it starts and becomes consistent at, so a
+-- restore knows which segments to replay. Restored instances record where
+-- they came from in restored_from.
+
+ALTER TABLE backup_policies ADD COLUMN wal_archiving BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE backup_policies ADD COLUMN next_wal_archive_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+CREATE INDEX idx_backup_policies_next_wal_archive_at ON backup_policies(next_wal_archive_at) WHERE wal_archiving;
+
+ALTER TABLE backups ADD COLUMN start_lsn PG_LSN;
+ALTER TABLE backups ADD COLUMN end_lsn PG_LSN;
+
+CREATE TABLE wal_segments (
+    instance_id UUID NOT NULL REFERENCES instances(id) ON DELETE CASCADE,
+    name VARCHAR(24) NOT NULL,
+    start_lsn PG_LSN NOT NULL,
+    end_lsn PG_LSN NOT NULL,
+    end_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (instance_id, name)
+);
+
+CREATE INDEX idx_wal_segments_end_lsn ON wal_segments(instance_id, end_lsn);
+
+ALTER TABLE instances ADD COLUMN restored_from JSONB;
@@ -0,0 +1,6 @@
+ALTER TABLE network_policies ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE network_policies ALTER COLUMN created_at DROP NOT NULL;
+ALTER TABLE network_policies ALTER COLUMN allowed_cidrs DROP NOT NULL;
+ALTER TABLE network_policies ALTER COLUMN allowed_cidrs DROP DEFAULT;
+ALTER TABLE network_policies ALTER COLUMN exposure DROP NOT NULL;
+ALTER TABLE network_policies DROP CONSTRAINT IF EXISTS network_policies_instance_id_key;
@@ -0,0 +1,15 @@
+-- IP allow-lists
+-- The network_policies table of the initial schema goes into use. An
+-- instance has at most one policy; instances without one are public to any
+-- address, as before.
+
+DELETE FROM network_policies a USING network_policies b
+    WHERE a.instance_id = b.instance_id AND a.updated_at < b.updated_at;
+ALTER TABLE network_policies ADD CONSTRAINT network_policies_instance_id_key UNIQUE (instance_id);
+UPDATE network_policies SET exposure = 'public' WHERE exposure IS NULL;
+ALTER TABLE network_policies ALTER COLUMN exposure SET NOT NULL;
+UPDATE network_policies SET allowed_cidrs = '{}' WHERE allowed_cidrs IS NULL;
+ALTER TABLE network_policies ALTER COLUMN allowed_cidrs SET DEFAULT '{}';
+ALTER TABLE network_policies ALTER COLUMN allowed_cidrs SET NOT NULL;
+ALTER TABLE network_policies ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE network_policies ALTER COLUMN updated_at SET NOT NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE instances DROP COLUMN IF EXISTS private_address;
+DROP TABLE IF EXISTS wireguard_peers;
+DROP TABLE IF EXISTS private_networks;
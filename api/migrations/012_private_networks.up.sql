@@ -0,0 +1,31 @@
+-- Private networks
+-- An org can have a private network: a subnet, carved from
+-- network.private_networks.pool, on a VLAN of its own. Its instances are
+-- attached to the VLAN with private_address, and WireGuard peers reach it
+-- through the gateway. Subnets never overlap and each address is used once.
+
+CREATE TABLE private_networks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    org_id UUID NOT NULL UNIQUE REFERENCES orgs(id) ON DELETE CASCADE,
+    subnet CIDR NOT NULL,
+    vlan INTEGER NOT NULL UNIQUE CHECK (vlan BETWEEN 1 AND 4094),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    EXCLUDE USING gist (subnet inet_ops WITH &&)
+);
+
+CREATE TRIGGER update_private_networks_updated_at BEFORE UPDATE ON private_networks
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE wireguard_peers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    network_id UUID NOT NULL REFERENCES private_networks(id) ON DELETE CASCADE,
+    name VARCHAR(63) NOT NULL,
+    public_key VARCHAR(44) NOT NULL UNIQUE,
+    address INET NOT NULL UNIQUE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (network_id, name)
+);
+
+ALTER TABLE instances ADD COLUMN private_address INET UNIQUE;
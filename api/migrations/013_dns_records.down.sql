@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS dns_zone;
+DROP TABLE IF EXISTS dns_records;
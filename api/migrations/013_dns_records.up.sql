@@ -0,0 +1,23 @@
+-- Instance DNS records
+-- Instances are named pg-<first 8 characters of their ID> in the instance
+-- zone, and fqdn goes into use. dns_records is what the control plane
+-- publishes there: the address of each instance's container. Records go
+-- with their instance. dns_zone holds when the records are next reconciled
+-- with the DNS provider.
+
+CREATE TABLE dns_records (
+    name VARCHAR(255) PRIMARY KEY,
+    type VARCHAR(10) NOT NULL CHECK (type IN ('A', 'AAAA')),
+    value INET NOT NULL,
+    ttl INTEGER NOT NULL CHECK (ttl > 0),
+    instance_id UUID NOT NULL UNIQUE REFERENCES instances(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE dns_zone (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    next_reconcile_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO dns_zone DEFAULT VALUES;
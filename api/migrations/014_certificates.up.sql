@@ -0,0 +1,20 @@
+-- Instance certificates
+-- The certificate each instance serves for its FQDN, once one is issued by
+-- the configured tls.issuer in place of the template's self-signed one. The
+-- private key stays in the container. renew_at is when the scheduler next
+-- renews it. Certificates go with their instance.
+
+CREATE TABLE certificates (
+    instance_id UUID PRIMARY KEY REFERENCES instances(id) ON DELETE CASCADE,
+    issuer VARCHAR(20) NOT NULL CHECK (issuer IN ('internal', 'acme')),
+    serial VARCHAR(64) NOT NULL,
+    dns_names TEXT[] NOT NULL,
+    not_before TIMESTAMP WITH TIME ZONE NOT NULL,
+    not_after TIMESTAMP WITH TIME ZONE NOT NULL,
+    renew_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    certificate TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_certificates_renew_at ON certificates(renew_at);
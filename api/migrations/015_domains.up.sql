@@ -0,0 +1,30 @@
+-- Custom domains
+-- Domains an org points at one of its instances, such as
+-- db.internal.ourco.com. A domain stays pending until the TXT record at
+-- verification_name holds verification_value, which is looked up again at
+-- next_check_at, and fails if that doesn't happen by expires_at. Verified
+-- domains are added to the certificate of their instance; a name is
+-- verified for one instance at a time. Domains go with their instance.
+
+CREATE TABLE domains (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    instance_id UUID NOT NULL REFERENCES instances(id) ON DELETE CASCADE,
+    name VARCHAR(253) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'verified', 'failed')),
+    verification_name VARCHAR(253) NOT NULL,
+    verification_value VARCHAR(255) NOT NULL,
+    error_message TEXT,
+    next_check_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    verified_at TIMESTAMP WITH TIME ZONE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (instance_id, name)
+);
+
+CREATE UNIQUE INDEX idx_domains_verified_name ON domains(name) WHERE status = 'verified';
+CREATE INDEX idx_domains_next_check_at ON domains(next_check_at) WHERE status = 'pending';
+
+CREATE TRIGGER update_domains_updated_at BEFORE UPDATE ON domains
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,2 @@
+ALTER TABLE sso_login_states DROP COLUMN IF EXISTS link_user_id;
+DROP TABLE IF EXISTS sso_domains;
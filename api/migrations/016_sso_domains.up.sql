@@ -0,0 +1,35 @@
+-- Verified SSO domains
+-- The auto-join domains of an SSO connection only route logins to it and
+-- let users join the org once the org proves it controls them, with a TXT
+-- record at verification_name holding verification_value, like custom
+-- domains. Several orgs may claim a name, but it is verified for one.
+-- Domains already configured start out pending.
+--
+-- A login started by a signed-in user links the identity it returns to
+-- that user (link_user_id) rather than to whoever has the same email.
+
+CREATE TABLE sso_domains (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    org_id UUID NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+    name VARCHAR(253) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'verified')),
+    verification_name VARCHAR(253) NOT NULL,
+    verification_value VARCHAR(255) NOT NULL,
+    error_message TEXT,
+    verified_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (org_id, name)
+);
+
+CREATE UNIQUE INDEX idx_sso_domains_verified_name ON sso_domains(name) WHERE status = 'verified';
+
+CREATE TRIGGER update_sso_domains_updated_at BEFORE UPDATE ON sso_domains
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO sso_domains (org_id, name, verification_name, verification_value)
+SELECT c.org_id, d.name, '_dbx-challenge.' || d.name,
+       'dbx-verification=' || replace(gen_random_uuid()::text, '-', '')
+FROM org_sso_connections c, unnest(c.auto_join_domains) AS d(name);
+
+ALTER TABLE sso_login_states ADD COLUMN link_user_id UUID REFERENCES users(id) ON DELETE CASCADE;
@@ -0,0 +1,3 @@
+-- SSO logins started from the /device page approve that device login
+-- instead of opening a session.
+ALTER TABLE sso_login_states ADD COLUMN device_user_code VARCHAR(16);
@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL schema migrations so the server binary
+// can apply them itself. Each version NNN has an NNN_name.up.sql script and
+// an optional NNN_name.down.sql script that reverts it.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
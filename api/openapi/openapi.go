@@ -0,0 +1,23 @@
+// Package openapi embeds the API specification, so the server can serve it
+// and validate traffic against it without the file being deployed
+// alongside the binary. It also holds the contracts of the guest agent and
+// the WireGuard gateway.
+package openapi
+
+import _ "embed"
+
+//go:embed openapi.yaml
+var Spec []byte
+
+// GuestAgentSpec is the contract of the agent instance templates run next
+// to Postgres; see package guest and cmd/guest-agent.
+//
+//go:embed guest-agent.yaml
+var GuestAgentSpec []byte
+
+// WireGuardGatewaySpec is the contract of the gateway that terminates the
+// tunnels of WireGuard peers; see package wireguard and
+// cmd/wireguard-gateway.
+//
+//go:embed wireguard-gateway.yaml
+var WireGuardGatewaySpec []byte
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultClientID identifies device logins started by dbx.
+const DefaultClientID = "dbx-cli"
+
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Register creates an account. Accounts sign in with Login afterwards.
+func (c *Client) Register(ctx context.Context, email, password string) (*User, error) {
+	var resp struct {
+		User User `json:"user"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/auth/register",
+		body:   map[string]string{"email": email, "password": password},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.User, nil
+}
+
+// Login signs in with a password. Pass the returned token to WithToken.
+func (c *Client) Login(ctx context.Context, email, password string) (*LoginResponse, error) {
+	var resp LoginResponse
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/auth/login",
+		body:   map[string]string{"email": email, "password": password},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/auth/logout"})
+}
+
+// SSOLoginURL returns the URL that starts an SSO login in a browser. The
+// org is chosen by orgID, or by the domain of email when orgID is empty.
+func (c *Client) SSOLoginURL(orgID, email string) string {
+	q := url.Values{}
+	if orgID != "" {
+		q.Set("org_id", orgID)
+	}
+	if email != "" {
+		q.Set("email", email)
+	}
+	u := c.baseURL + "/v1/auth/sso/start"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// SSOCallback finishes an SSO login with the code and state the identity
+// provider redirected back with.
+func (c *Client) SSOCallback(ctx context.Context, code, state string) (*LoginResponse, error) {
+	var resp LoginResponse
+	err := c.do(ctx, request{
+		method: http.MethodGet,
+		path:   "/auth/sso/callback",
+		query:  url.Values{"code": {code}, "state": {state}},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SSOLinkURL returns the URL of an org's identity provider for the caller
+// to sign in at in a browser, linking that identity to their account. The
+// callback then returns a session token as for SSOLoginURL.
+func (c *Client) SSOLinkURL(ctx context.Context, orgID string) (string, error) {
+	if err := checkID(orgID); err != nil {
+		return "", err
+	}
+	var resp struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/auth/sso/link",
+		body:   map[string]string{"org_id": orgID},
+		out:    &resp,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.AuthorizationURL, nil
+}
+
+// StartDeviceLogin starts an RFC 8628 device login for clientID, or
+// DefaultClientID when empty.
+func (c *Client) StartDeviceLogin(ctx context.Context, clientID string) (*DeviceAuthorization, error) {
+	if clientID == "" {
+		clientID = DefaultClientID
+	}
+	var resp DeviceAuthorization
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/auth/device/code",
+		form:   url.Values{"client_id": {clientID}},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeviceToken polls once for the token of a device login. Until the user
+// decides, it fails with an *APIError with code CodeAuthorizationPending.
+func (c *Client) DeviceToken(ctx context.Context, deviceCode, clientID string) (*DeviceToken, error) {
+	if clientID == "" {
+		clientID = DefaultClientID
+	}
+	var resp DeviceToken
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/auth/device/token",
+		form: url.Values{
+			"grant_type":  {deviceGrantType},
+			"device_code": {deviceCode},
+			"client_id":   {clientID},
+		},
+		out: &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// WaitForDeviceToken polls at the interval the server asked for until the
+// user approves or denies the login. A denied login fails with code
+// CodeAccessDenied and one that was left too long with CodeExpiredToken.
+func (c *Client) WaitForDeviceToken(ctx context.Context, authz *DeviceAuthorization, clientID string) (*DeviceToken, error) {
+	interval := time.Duration(authz.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(authz.ExpiresIn)*time.Second)
+	defer cancel()
+
+	for {
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, &APIError{
+					StatusCode: http.StatusBadRequest,
+					Code:       CodeExpiredToken,
+					Message:    "device code expired",
+				}
+			}
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+
+		token, err := c.DeviceToken(ctx, authz.DeviceCode, clientID)
+		switch ErrorCode(err) {
+		case CodeAuthorizationPending:
+			continue
+		case CodeSlowDown:
+			interval += 5 * time.Second
+			continue
+		}
+		return token, err
+	}
+}
+
+// GetDeviceRequest looks up a pending device login by the code the user
+// entered, so they can check it before approving.
+func (c *Client) GetDeviceRequest(ctx context.Context, userCode string) (*DeviceRequest, error) {
+	if err := checkID(userCode); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Device DeviceRequest `json:"device"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodGet,
+		path:   "/auth/device/" + url.PathEscape(userCode),
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Device, nil
+}
+
+// ApproveDevice grants the device login with userCode a token for the
+// calling user; DenyDevice refuses it.
+func (c *Client) ApproveDevice(ctx context.Context, userCode string) error {
+	return c.decideDevice(ctx, userCode, "approve")
+}
+
+func (c *Client) DenyDevice(ctx context.Context, userCode string) error {
+	return c.decideDevice(ctx, userCode, "deny")
+}
+
+func (c *Client) decideDevice(ctx context.Context, userCode, action string) error {
+	return c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/auth/device/decision",
+		body:   map[string]string{"user_code": userCode, "action": action},
+	})
+}
+
+// CurrentUser returns the user the token belongs to.
+func (c *Client) CurrentUser(ctx context.Context) (*User, error) {
+	var resp struct {
+		User User `json:"user"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/users/me", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.User, nil
+}
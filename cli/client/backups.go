@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// ListBackups returns the backups of an instance, newest first.
+func (c *Client) ListBackups(ctx context.Context, instanceID string) ([]Backup, error) {
+	resp, err := c.listBackups(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Backups, nil
+}
+
+// GetRecoveryWindow returns the span an instance can be restored to any
+// point of with RestoreInstance, or nil if it has no archived WAL that
+// follows on from a completed backup.
+func (c *Client) GetRecoveryWindow(ctx context.Context, instanceID string) (*RecoveryWindow, error) {
+	resp, err := c.listBackups(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return resp.RecoveryWindow, nil
+}
+
+type backupList struct {
+	Backups        []Backup        `json:"backups"`
+	RecoveryWindow *RecoveryWindow `json:"recovery_window"`
+}
+
+func (c *Client) listBackups(ctx context.Context, instanceID string) (*backupList, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp backupList
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID) + "/backups", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateBackup queues a backup of a running instance and returns it, still
+// pending, with the ID of the job taking it.
+func (c *Client) CreateBackup(ctx context.Context, instanceID string, req CreateBackupRequest) (*Backup, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Backup Backup `json:"backup"`
+		JobID  string `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   instancePath(instanceID) + "/backups",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &resp.Backup, resp.JobID, nil
+}
+
+// GetBackupPolicy returns the backup schedule of an instance. It fails with
+// a not found error if the instance has none.
+func (c *Client) GetBackupPolicy(ctx context.Context, instanceID string) (*BackupPolicy, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Policy BackupPolicy `json:"policy"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID) + "/backup-policy", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Policy, nil
+}
+
+// SetBackupPolicy creates or replaces the backup schedule of an instance.
+func (c *Client) SetBackupPolicy(ctx context.Context, instanceID string, req BackupPolicyRequest) (*BackupPolicy, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Policy BackupPolicy `json:"policy"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   instancePath(instanceID) + "/backup-policy",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Policy, nil
+}
+
+// DeleteBackupPolicy stops scheduled backups and WAL archiving of an
+// instance. Existing backups and archived WAL are kept until the backups
+// expire.
+func (c *Client) DeleteBackupPolicy(ctx context.Context, instanceID string) error {
+	if err := checkID(instanceID); err != nil {
+		return err
+	}
+	return c.do(ctx, request{method: http.MethodDelete, path: instancePath(instanceID) + "/backup-policy"})
+}
+
+// RestoreInstance queues the creation of an instance, in the project of
+// instanceID, from one of its completed backups. The new instance is
+// returned pending, along with the ID of the job, whose Progress shows
+// the step it is at. It fails with CodeValidationFailed if a target is
+// outside the backup's recovery window, and with CodeQuotaExceeded if the
+// instance doesn't fit.
+func (c *Client) RestoreInstance(ctx context.Context, instanceID string, req RestoreInstanceRequest) (*Instance, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Instance Instance `json:"instance"`
+		JobID    string   `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   instancePath(instanceID) + ":restore",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &resp.Instance, resp.JobID, nil
+}
@@ -0,0 +1,275 @@
+// Package client is a Go client for the db.xyz v1 API. It is the SDK the
+// dbx CLI is built on:
+//
+//	c := client.New("https://api.db.xyz", client.WithToken(token))
+//	orgs, err := c.ListOrgs(ctx)
+//
+// Every method takes a context. Failed calls return an *APIError carrying
+// the stable error code of the API, and transient failures are retried with
+// exponential backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is sent in the User-Agent header.
+const Version = "0.1.0"
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 3
+	defaultMinBackoff = 250 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// Client calls the API at one base URL. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	userAgent  string
+	httpClient *http.Client
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken authenticates requests with a bearer token, as returned by
+// Login or WaitForDeviceToken.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient replaces the HTTP client, e.g. to change the timeout or
+// transport.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithUserAgent prefixes the User-Agent header with the name of the
+// program using the client, such as "dbx/1.2.0".
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua + " " + c.userAgent }
+}
+
+// WithRetries sets how many times a failed request is retried and the
+// bounds of the backoff between attempts. Zero retries disables retrying.
+func WithRetries(max int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New returns a client for the API at baseURL, e.g. http://127.0.0.1:8081.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		userAgent:  "dbx-go/" + Version,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		maxRetries: defaultMaxRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token returns the bearer token the client authenticates with.
+func (c *Client) Token() string {
+	return c.token
+}
+
+// request describes one API call. body is encoded as JSON, or form when
+// set instead; out, when non-nil, receives the decoded response, or raw
+// the response as is, for endpoints not answering in JSON.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	form   url.Values
+	out    interface{}
+	raw    *[]byte
+}
+
+// do sends req, retrying transient failures, and decodes the response.
+func (c *Client) do(ctx context.Context, req request) error {
+	var (
+		payload     []byte
+		contentType string
+		err         error
+	)
+	switch {
+	case req.form != nil:
+		payload = []byte(req.form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case req.body != nil:
+		payload, err = json.Marshal(req.body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		contentType = "application/json"
+	}
+
+	accept := "application/json"
+	if req.raw != nil {
+		accept = "*/*"
+	}
+
+	u := c.baseURL + "/v1" + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req.method, u, payload, contentType, accept)
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.maxRetries || !idempotent(req.method) {
+				return err
+			}
+			if err := c.sleep(ctx, attempt, 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if req.raw != nil {
+				*req.raw = body
+				return nil
+			}
+			if req.out == nil || len(body) == 0 {
+				return nil
+			}
+			if err := json.Unmarshal(body, req.out); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			return nil
+		}
+
+		if attempt < c.maxRetries && retryable(req.method, resp.StatusCode) {
+			if err := c.sleep(ctx, attempt, retryAfter(resp)); err != nil {
+				return err
+			}
+			continue
+		}
+		return newAPIError(resp, body)
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, u string, payload []byte, contentType, accept string) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Accept", accept)
+	httpReq.Header.Set("User-Agent", c.userAgent)
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// sleep waits before retry attempt+1: wait when the server asked for it,
+// otherwise exponential backoff with full jitter.
+func (c *Client) sleep(ctx context.Context, attempt int, wait time.Duration) error {
+	if wait <= 0 {
+		backoff := c.minBackoff << attempt
+		if backoff > c.maxBackoff || backoff <= 0 {
+			backoff = c.maxBackoff
+		}
+		wait = time.Duration(rand.Int63n(int64(backoff) + 1))
+	}
+	if wait > c.maxBackoff {
+		wait = c.maxBackoff
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// idempotent reports whether repeating a request with method is harmless.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a response status is worth another attempt.
+// 429 means the request was turned away before being handled, so even a
+// POST is safe to repeat; gateway errors only for idempotent requests.
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(method)
+	}
+	return false
+}
+
+// retryAfter returns the delay asked for by a Retry-After header in
+// seconds, or 0.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+var errEmptyID = errors.New("client: empty ID")
+
+// checkID guards against building paths such as /orgs//projects.
+func checkID(ids ...string) error {
+	for _, id := range ids {
+		if id == "" {
+			return errEmptyID
+		}
+	}
+	return nil
+}
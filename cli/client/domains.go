@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// ListDomains returns the custom domains of an instance, by name.
+func (c *Client) ListDomains(ctx context.Context, instanceID string) ([]Domain, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Domains []Domain `json:"domains"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID) + "/domains", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Domains, nil
+}
+
+// AddDomain adds a custom domain to an instance and returns it, pending,
+// with the ID of the job first checking its ownership record. It fails
+// with CodeValidationFailed for a name that can't be a custom domain and
+// with CodeConflict if the instance already has it.
+func (c *Client) AddDomain(ctx context.Context, instanceID, name string) (*Domain, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Domain Domain `json:"domain"`
+		JobID  string `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   instancePath(instanceID) + "/domains",
+		body:   map[string]string{"name": name},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &resp.Domain, resp.JobID, nil
+}
+
+// GetDomain returns a custom domain of an instance.
+func (c *Client) GetDomain(ctx context.Context, instanceID, domainID string) (*Domain, error) {
+	if err := checkID(instanceID, domainID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Domain Domain `json:"domain"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: domainPath(instanceID, domainID), out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Domain, nil
+}
+
+// VerifyDomain queues a check of the ownership record of a custom domain
+// now and returns the domain, pending, with the ID of the job. It fails
+// with CodeConflict if the domain is already verified.
+func (c *Client) VerifyDomain(ctx context.Context, instanceID, domainID string) (*Domain, string, error) {
+	if err := checkID(instanceID, domainID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Domain Domain `json:"domain"`
+		JobID  string `json:"job_id"`
+	}
+	if err := c.do(ctx, request{method: http.MethodPost, path: domainPath(instanceID, domainID) + ":verify", out: &resp}); err != nil {
+		return nil, "", err
+	}
+	return &resp.Domain, resp.JobID, nil
+}
+
+// RemoveDomain removes a custom domain from an instance. For a verified
+// domain it returns the ID of the job reissuing the instance's certificate
+// without it, and otherwise an empty one.
+func (c *Client) RemoveDomain(ctx context.Context, instanceID, domainID string) (string, error) {
+	if err := checkID(instanceID, domainID); err != nil {
+		return "", err
+	}
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	if err := c.do(ctx, request{method: http.MethodDelete, path: domainPath(instanceID, domainID), out: &resp}); err != nil {
+		return "", err
+	}
+	return resp.JobID, nil
+}
+
+func domainPath(instanceID, domainID string) string {
+	return instancePath(instanceID) + "/domains/" + url.PathEscape(domainID)
+}
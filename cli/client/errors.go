@@ -0,0 +1,142 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned by the API. Code is stable; Message is for people
+// and may change.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeForbidden          = "forbidden"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeSSORequired        = "sso_required"
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict"
+	CodeUpstreamFailed     = "upstream_failed"
+	CodeNotSupported       = "not_supported"
+	CodeInternal           = "internal_error"
+)
+
+// Error codes of the device token endpoint, which follows RFC 8628 rather
+// than the usual error body.
+const (
+	CodeAuthorizationPending = "authorization_pending"
+	CodeSlowDown             = "slow_down"
+	CodeAccessDenied         = "access_denied"
+	CodeExpiredToken         = "expired_token"
+)
+
+// APIError is returned for every response with a non-success status.
+type APIError struct {
+	StatusCode int          `json:"-"`
+	Code       string       `json:"code"`
+	Message    string       `json:"message"`
+	Details    []FieldError `json:"details,omitempty"`
+	RequestID  string       `json:"request_id,omitempty"`
+}
+
+// FieldError describes a problem with one field of the request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s, status %d)", e.Message, e.Code, e.StatusCode)
+	for _, d := range e.Details {
+		fmt.Fprintf(&b, "; %s %s", d.Field, d.Message)
+	}
+	return b.String()
+}
+
+// newAPIError parses an error response. Besides the documented envelope it
+// accepts the RFC 8628 {"error": "code"} form and bodies that aren't JSON,
+// such as those of a proxy in front of the API.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	e := &APIError{StatusCode: resp.StatusCode}
+
+	var envelope struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && len(envelope.Error) > 0 {
+		var code string
+		if json.Unmarshal(envelope.Error, &code) == nil {
+			e.Code = code
+			e.Message = envelope.ErrorDescription
+		} else {
+			json.Unmarshal(envelope.Error, e)
+		}
+	}
+
+	if e.Code == "" {
+		e.Code = statusCode(resp.StatusCode)
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.ReplaceAll(e.Code, "_", " ")
+	}
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return e
+}
+
+// statusCode guesses an error code for a response without one.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusNotImplemented:
+		return CodeNotSupported
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUpstreamFailed
+	}
+	return CodeInternal
+}
+
+// ErrorCode returns the API error code of err, or "" if err isn't an
+// *APIError.
+func ErrorCode(err error) string {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// IsNotFound reports whether err is a not_found API error.
+func IsNotFound(err error) bool {
+	return ErrorCode(err) == CodeNotFound
+}
+
+// IsUnauthorized reports whether err means the token is missing, invalid
+// or expired.
+func IsUnauthorized(err error) bool {
+	return ErrorCode(err) == CodeUnauthorized
+}
+
+// IsConflict reports whether err is a conflict API error.
+func IsConflict(err error) bool {
+	return ErrorCode(err) == CodeConflict
+}
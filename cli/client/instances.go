@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+func (c *Client) ListInstances(ctx context.Context, projectID string) ([]Instance, error) {
+	if err := checkID(projectID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Instances []Instance `json:"instances"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: projectPath(projectID) + "/instances", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Instances, nil
+}
+
+func (c *Client) IterateInstances(ctx context.Context, projectID string) *Iterator[Instance] {
+	return newIterator(ctx, singlePage(func(ctx context.Context) ([]Instance, error) {
+		return c.ListInstances(ctx, projectID)
+	}))
+}
+
+// CreateInstance records a new instance and queues a job to provision it.
+// The instance is returned pending, along with the ID of the job; follow
+// progress with WaitForJob or GetInstance.
+func (c *Client) CreateInstance(ctx context.Context, projectID string, req CreateInstanceRequest) (*Instance, string, error) {
+	if err := checkID(projectID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Instance Instance `json:"instance"`
+		JobID    string   `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   projectPath(projectID) + "/instances",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &resp.Instance, resp.JobID, nil
+}
+
+func (c *Client) GetInstance(ctx context.Context, instanceID string) (*Instance, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Instance Instance `json:"instance"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID), out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Instance, nil
+}
+
+// DeleteInstance queues a job that tears an instance down and returns its
+// ID. It fails with CodeConflict if the instance is already being deleted.
+func (c *Client) DeleteInstance(ctx context.Context, instanceID string) (string, error) {
+	if err := checkID(instanceID); err != nil {
+		return "", err
+	}
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	if err := c.do(ctx, request{method: http.MethodDelete, path: instancePath(instanceID), out: &resp}); err != nil {
+		return "", err
+	}
+	return resp.JobID, nil
+}
+
+// ResizeInstance queues a job that moves an instance to another plan or
+// grows its disk. The instance is returned resizing, along with the ID of
+// the job. It fails with CodeConflict unless the instance is running or
+// stopped, and with CodeQuotaExceeded if the new size doesn't fit.
+func (c *Client) ResizeInstance(ctx context.Context, instanceID string, req ResizeInstanceRequest) (*Instance, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Instance Instance `json:"instance"`
+		JobID    string   `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   instancePath(instanceID) + ":resize",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &resp.Instance, resp.JobID, nil
+}
+
+// UpgradeInstance queues a blue/green upgrade of an instance to a newer
+// PostgreSQL major version. The instance is returned upgrading, along with
+// the upgrade and the ID of the job, whose Progress shows the step it is
+// at. It fails with CodeConflict unless the instance is running.
+func (c *Client) UpgradeInstance(ctx context.Context, instanceID string, req UpgradeInstanceRequest) (*Instance, *Upgrade, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, nil, "", err
+	}
+	var resp struct {
+		Instance Instance `json:"instance"`
+		Upgrade  Upgrade  `json:"upgrade"`
+		JobID    string   `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   instancePath(instanceID) + ":upgrade",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return &resp.Instance, &resp.Upgrade, resp.JobID, nil
+}
+
+// RollbackUpgrade queues a job that moves an instance back to the container
+// and version it had before its latest upgrade, losing writes made since.
+// It fails with CodeConflict once the rollback window has closed.
+func (c *Client) RollbackUpgrade(ctx context.Context, instanceID string) (*Instance, *Upgrade, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, nil, "", err
+	}
+	var resp struct {
+		Instance Instance `json:"instance"`
+		Upgrade  Upgrade  `json:"upgrade"`
+		JobID    string   `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   instancePath(instanceID) + ":rollback",
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return &resp.Instance, &resp.Upgrade, resp.JobID, nil
+}
+
+// ListUpgrades returns the upgrades of an instance, newest first.
+func (c *Client) ListUpgrades(ctx context.Context, instanceID string) ([]Upgrade, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Upgrades []Upgrade `json:"upgrades"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID) + "/upgrades", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Upgrades, nil
+}
+
+func instancePath(instanceID string) string {
+	return "/instances/" + url.PathEscape(instanceID)
+}
@@ -0,0 +1,84 @@
+package client
+
+import "context"
+
+// Iterator walks the items of a list endpoint page by page:
+//
+//	it := c.IterateProjects(ctx, orgID)
+//	for it.Next() {
+//		p := it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// The API currently returns every item in one page, so an iterator makes a
+// single request; code written against it keeps working once list
+// endpoints are paginated.
+type Iterator[T any] struct {
+	ctx   context.Context
+	fetch pageFunc[T]
+
+	items  []T
+	cursor string
+	cur    T
+	done   bool
+	err    error
+}
+
+// pageFunc fetches the page starting at cursor, "" for the first, and
+// returns the cursor of the next page, "" after the last.
+type pageFunc[T any] func(ctx context.Context, cursor string) (items []T, next string, err error)
+
+func newIterator[T any](ctx context.Context, fetch pageFunc[T]) *Iterator[T] {
+	return &Iterator[T]{ctx: ctx, fetch: fetch}
+}
+
+// Next advances to the next item, fetching another page when needed. It
+// returns false when there are no more items or a request failed.
+func (it *Iterator[T]) Next() bool {
+	for len(it.items) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		items, next, err := it.fetch(it.ctx, it.cursor)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.items = items
+		it.cursor = next
+		it.done = next == ""
+	}
+	it.cur = it.items[0]
+	it.items = it.items[1:]
+	return true
+}
+
+// Value returns the current item.
+func (it *Iterator[T]) Value() T {
+	return it.cur
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// All collects the remaining items.
+func (it *Iterator[T]) All() ([]T, error) {
+	var all []T
+	for it.Next() {
+		all = append(all, it.Value())
+	}
+	return all, it.Err()
+}
+
+// singlePage adapts a list call to a pageFunc for unpaginated endpoints.
+func singlePage[T any](list func(ctx context.Context) ([]T, error)) pageFunc[T] {
+	return func(ctx context.Context, _ string) ([]T, string, error) {
+		items, err := list(ctx)
+		return items, "", err
+	}
+}
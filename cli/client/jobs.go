@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func (c *Client) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	if err := checkID(jobID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Job Job `json:"job"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/jobs/" + url.PathEscape(jobID), out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Job, nil
+}
+
+// WaitForJob polls a job every interval until it is done and returns it in
+// its final state. A failed job is not an error; check its Status. Bound
+// the wait with ctx.
+func (c *Client) WaitForJob(ctx context.Context, jobID string, interval time.Duration) (*Job, error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		job, err := c.GetJob(ctx, jobID)
+		if err != nil || job.Done() {
+			return job, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
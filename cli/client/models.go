@@ -0,0 +1,476 @@
+package client
+
+import "time"
+
+// Roles a member can have in an org, from least to most privileged.
+const (
+	RoleViewer = "viewer"
+	RoleMember = "member"
+	RoleAdmin  = "admin"
+	RoleOwner  = "owner"
+)
+
+// Instance statuses.
+const (
+	InstanceStatusPending      = "pending"
+	InstanceStatusProvisioning = "provisioning"
+	InstanceStatusRunning      = "running"
+	InstanceStatusStopped      = "stopped"
+	InstanceStatusResizing     = "resizing"
+	InstanceStatusUpgrading    = "upgrading"
+	InstanceStatusDeleting     = "deleting"
+	InstanceStatusFailed       = "failed"
+)
+
+// Upgrade statuses.
+const (
+	UpgradeStatusRunning     = "running"
+	UpgradeStatusCutOver     = "cut_over"
+	UpgradeStatusFinished    = "finished"
+	UpgradeStatusRollingBack = "rolling_back"
+	UpgradeStatusRolledBack  = "rolled_back"
+	UpgradeStatusFailed      = "failed"
+)
+
+// Backup statuses.
+const (
+	BackupStatusPending   = "pending"
+	BackupStatusRunning   = "running"
+	BackupStatusCompleted = "completed"
+	BackupStatusFailed    = "failed"
+	BackupStatusDeleting  = "deleting"
+)
+
+// Domain statuses.
+const (
+	DomainStatusPending  = "pending"
+	DomainStatusVerified = "verified"
+	DomainStatusFailed   = "failed"
+)
+
+// Job statuses.
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+type User struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Org is an organization. Role is the caller's role in it, set when listing.
+type Org struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// LoginResponse is returned by Login and SSOCallback.
+type LoginResponse struct {
+	Token string `json:"token"`
+	User  User   `json:"user"`
+}
+
+type SSOConnection struct {
+	OrgID           string      `json:"org_id"`
+	Issuer          string      `json:"issuer"`
+	ClientID        string      `json:"client_id"`
+	Enforced        bool        `json:"enforced"`
+	AutoJoinDomains []string    `json:"auto_join_domains"`
+	AutoJoinRole    string      `json:"auto_join_role"`
+	Domains         []SSODomain `json:"domains"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// SSODomain is an auto-join domain of an SSO connection. It routes logins
+// and lets users join only once verified, by a TXT record named
+// VerificationName holding VerificationValue.
+type SSODomain struct {
+	ID                string     `json:"id"`
+	OrgID             string     `json:"org_id"`
+	Name              string     `json:"name"`
+	Status            string     `json:"status"`
+	VerificationName  string     `json:"verification_name"`
+	VerificationValue string     `json:"verification_value"`
+	ErrorMessage      string     `json:"error_message,omitempty"`
+	VerifiedAt        *time.Time `json:"verified_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// SSOConnectionRequest configures the SSO connection of an org. A nil
+// ClientSecret keeps the stored secret; an empty one clears it, for public
+// clients.
+type SSOConnectionRequest struct {
+	Issuer          string   `json:"issuer"`
+	ClientID        string   `json:"client_id"`
+	ClientSecret    *string  `json:"client_secret,omitempty"`
+	Enforced        bool     `json:"enforced"`
+	AutoJoinDomains []string `json:"auto_join_domains,omitempty"`
+	AutoJoinRole    string   `json:"auto_join_role,omitempty"`
+}
+
+// DeviceAuthorization is the start of a device login: show UserCode to the
+// user and pass the authorization to WaitForDeviceToken.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type DeviceToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	User        User   `json:"user"`
+}
+
+// DeviceRequest is a pending device login, as shown to the approving user.
+type DeviceRequest struct {
+	UserCode  string    `json:"user_code"`
+	ClientID  string    `json:"client_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Project struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Plan is an entry of the plan catalog.
+type Plan struct {
+	Name     string `json:"name"`
+	VCPUs    int    `json:"vcpus"`
+	MemoryMB int    `json:"memory_mb"`
+	// DiskGiB is the disk of instances that don't choose a size between
+	// MinDiskGiB and MaxDiskGiB.
+	DiskGiB        int   `json:"disk_gib"`
+	MinDiskGiB     int   `json:"min_disk_gib"`
+	MaxDiskGiB     int   `json:"max_disk_gib"`
+	MaxConnections int   `json:"max_connections"`
+	PgVersions     []int `json:"pg_versions"`
+	// Deprecated plans keep their instances but take no new ones.
+	Deprecated bool      `json:"deprecated"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Instance struct {
+	ID        string    `json:"id"`
+	ProjectID string    `json:"project_id"`
+	Name      string    `json:"name"`
+	Plan      string    `json:"plan"`
+	PgVersion int       `json:"pg_version"`
+	Node      string    `json:"node,omitempty"`
+	CTID      int       `json:"ctid,omitempty"`
+	FQDN      string    `json:"fqdn,omitempty"`
+	DiskGiB   int       `json:"disk_gib"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// RestoredFrom is set on instances created by RestoreInstance.
+	RestoredFrom *RestoreSource `json:"restored_from,omitempty"`
+	// PrivateAddress is the address of the instance on the private
+	// network of its org, once attached to it.
+	PrivateAddress string `json:"private_address,omitempty"`
+}
+
+// RestoreSource is where a restored instance came from: the backup, the
+// target it was restored to, if any, and where recovery stopped once the
+// restore has run.
+type RestoreSource struct {
+	InstanceID    string     `json:"instance_id"`
+	BackupID      string     `json:"backup_id"`
+	PgVersion     int        `json:"pg_version"`
+	TargetTime    *time.Time `json:"target_time,omitempty"`
+	TargetLSN     string     `json:"target_lsn,omitempty"`
+	RecoveredLSN  string     `json:"recovered_lsn,omitempty"`
+	RecoveredTime *time.Time `json:"recovered_time,omitempty"`
+}
+
+// RestoreInstanceRequest describes an instance to create from a completed
+// backup. At most one of TargetTime and TargetLSN may be set; without
+// either the instance is as of the end of the backup. Empty Plan and zero
+// DiskGiB keep those of the source instance.
+type RestoreInstanceRequest struct {
+	Name       string     `json:"name"`
+	BackupID   string     `json:"backup_id"`
+	TargetTime *time.Time `json:"target_time,omitempty"`
+	TargetLSN  string     `json:"target_lsn,omitempty"`
+	Plan       string     `json:"plan,omitempty"`
+	DiskGiB    int        `json:"disk_gib,omitempty"`
+}
+
+// CreateInstanceRequest describes a new instance. Plan names a plan from
+// ListPlans. Zero PgVersion and DiskGiB leave the plan's defaults.
+type CreateInstanceRequest struct {
+	Name      string `json:"name"`
+	Plan      string `json:"plan"`
+	PgVersion int    `json:"pg_version,omitempty"`
+	DiskGiB   int    `json:"disk_gib,omitempty"`
+}
+
+// ResizeInstanceRequest names the plan and disk size to move an instance
+// to. Leave either zero to keep the current one; disks only grow.
+type ResizeInstanceRequest struct {
+	Plan    string `json:"plan,omitempty"`
+	DiskGiB int    `json:"disk_gib,omitempty"`
+}
+
+// UpgradeInstanceRequest names the PostgreSQL major version to upgrade an
+// instance to, newer than its own and supported by its plan.
+type UpgradeInstanceRequest struct {
+	PgVersion int `json:"pg_version"`
+}
+
+// Upgrade is a blue/green major version upgrade of an instance. Blue is the
+// container the instance ran on before, kept stopped until RollbackUntil.
+type Upgrade struct {
+	ID            string     `json:"id"`
+	InstanceID    string     `json:"instance_id"`
+	FromVersion   int        `json:"from_version"`
+	ToVersion     int        `json:"to_version"`
+	Status        string     `json:"status"`
+	BlueNode      string     `json:"blue_node"`
+	BlueCTID      int        `json:"blue_ctid"`
+	GreenNode     string     `json:"green_node,omitempty"`
+	GreenCTID     int        `json:"green_ctid,omitempty"`
+	CutOverAt     *time.Time `json:"cut_over_at,omitempty"`
+	RollbackUntil *time.Time `json:"rollback_until,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// CreateBackupRequest is the optional body of an on-demand backup. A zero
+// RetentionDays keeps the backup as long as the instance's backup policy
+// says, or the server default.
+type CreateBackupRequest struct {
+	RetentionDays int `json:"retention_days,omitempty"`
+}
+
+// BackupPolicyRequest sets the backup schedule of an instance. Schedule is
+// a five-field cron expression, evaluated in UTC. A nil WALArchiving
+// archives WAL, the server default.
+type BackupPolicyRequest struct {
+	Schedule      string `json:"schedule"`
+	RetentionDays int    `json:"retention_days,omitempty"`
+	WALArchiving  *bool  `json:"wal_archiving,omitempty"`
+}
+
+// BackupPolicy is the backup schedule of an instance.
+type BackupPolicy struct {
+	ID            string    `json:"id"`
+	InstanceID    string    `json:"instance_id"`
+	Schedule      string    `json:"schedule"`
+	RetentionDays int       `json:"retention_days"`
+	NextRunAt     time.Time `json:"next_run_at"`
+	WALArchiving  bool      `json:"wal_archiving"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Backup is a base backup of an instance in the object store.
+type Backup struct {
+	ID           string     `json:"id"`
+	InstanceID   string     `json:"instance_id"`
+	Kind         string     `json:"kind"`
+	Status       string     `json:"status"`
+	PgVersion    int        `json:"pg_version,omitempty"`
+	RepoURL      string     `json:"repo_url"`
+	SizeBytes    int64      `json:"size_bytes,omitempty"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	StartLSN     string     `json:"start_lsn,omitempty"`
+	EndLSN       string     `json:"end_lsn,omitempty"`
+}
+
+// RecoveryWindow is the span an instance can be restored to any point of,
+// from the end of its oldest usable backup to the end of its archived WAL.
+type RecoveryWindow struct {
+	FromTime time.Time `json:"from_time"`
+	FromLSN  string    `json:"from_lsn"`
+	ToTime   time.Time `json:"to_time"`
+	ToLSN    string    `json:"to_lsn"`
+}
+
+// Network policy exposures
+const (
+	ExposurePublic  = "public"
+	ExposurePrivate = "private"
+)
+
+// NetworkPolicyRequest replaces the network policy of an instance.
+type NetworkPolicyRequest struct {
+	// Exposure defaults to public.
+	Exposure string `json:"exposure,omitempty"`
+	// AllowedCIDRs are CIDR blocks or single addresses. Empty allows any
+	// address, or every private network for private exposure.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+// NetworkPolicy decides who can connect to an instance. ID is empty while
+// the instance has the default policy, public to any address.
+type NetworkPolicy struct {
+	ID           string    `json:"id,omitempty"`
+	InstanceID   string    `json:"instance_id"`
+	Exposure     string    `json:"exposure"`
+	AllowedCIDRs []string  `json:"allowed_cidrs"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// PrivateNetwork is the private network of an org: a subnet on a VLAN of
+// its own that the org's instances are attached to and its WireGuard
+// peers reach.
+type PrivateNetwork struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	Subnet    string    `json:"subnet"`
+	VLAN      int       `json:"vlan"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WireGuardPeer is a client of a private network connecting through the
+// WireGuard gateway from Address.
+type WireGuardPeer struct {
+	ID        string    `json:"id"`
+	NetworkID string    `json:"network_id"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	Address   string    `json:"address"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreatedPeer is a new WireGuard peer with its wg-quick config and the ID
+// of the job adding it to the gateway.
+type CreatedPeer struct {
+	Peer   WireGuardPeer `json:"peer"`
+	Config string        `json:"config"`
+	JobID  string        `json:"job_id"`
+}
+
+// Certificate is the TLS certificate an instance serves, renewed at
+// RenewAt. PEM holds it followed by the intermediates it chains to.
+type Certificate struct {
+	InstanceID string    `json:"instance_id"`
+	Issuer     string    `json:"issuer"`
+	Serial     string    `json:"serial"`
+	DNSNames   []string  `json:"dns_names"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+	RenewAt    time.Time `json:"renew_at"`
+	PEM        string    `json:"certificate"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Domain is a custom domain of an instance. It is verified once the TXT
+// record at VerificationName holds VerificationValue; clients reach the
+// instance through it by a CNAME record to the instance's FQDN.
+type Domain struct {
+	ID                string     `json:"id"`
+	InstanceID        string     `json:"instance_id"`
+	Name              string     `json:"name"`
+	Status            string     `json:"status"`
+	VerificationName  string     `json:"verification_name"`
+	VerificationValue string     `json:"verification_value"`
+	ErrorMessage      string     `json:"error_message,omitempty"`
+	NextCheckAt       *time.Time `json:"next_check_at,omitempty"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	VerifiedAt        *time.Time `json:"verified_at,omitempty"`
+	CreatedBy         string     `json:"created_by,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	// CNAMETarget is the name to point the domain at: the domain proxy, or
+	// the instance's FQDN.
+	CNAMETarget string `json:"cname_target,omitempty"`
+}
+
+// QuotaLimits are the limits of an org or project. Nil limits are
+// unlimited and an empty Plans allows every plan.
+type QuotaLimits struct {
+	Instances *int     `json:"instances"`
+	VCPUs     *int     `json:"vcpus"`
+	MemoryMB  *int     `json:"memory_mb"`
+	DiskGiB   *int     `json:"disk_gib"`
+	Plans     []string `json:"plans"`
+}
+
+// QuotaUsage adds up every instance until it is deleted, including failed
+// ones.
+type QuotaUsage struct {
+	Instances int `json:"instances"`
+	VCPUs     int `json:"vcpus"`
+	MemoryMB  int `json:"memory_mb"`
+	DiskGiB   int `json:"disk_gib"`
+}
+
+type QuotaStatus struct {
+	Limits QuotaLimits `json:"limits"`
+	Usage  QuotaUsage  `json:"usage"`
+}
+
+type ProjectQuota struct {
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	QuotaStatus
+}
+
+// Quotas is the usage of an org and each of its projects against their
+// limits. Creating an instance fails with CodeQuotaExceeded when it would go
+// over either.
+type Quotas struct {
+	Org      QuotaStatus    `json:"org"`
+	Projects []ProjectQuota `json:"projects"`
+}
+
+// Job is a background operation, such as provisioning an instance.
+type Job struct {
+	ID           string     `json:"id"`
+	Type         string     `json:"type"`
+	PayloadJSON  string     `json:"payload_json,omitempty"`
+	Status       string     `json:"status"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	// RunAfter delays a job until then.
+	RunAfter *time.Time   `json:"run_after,omitempty"`
+	Progress *JobProgress `json:"progress,omitempty"`
+}
+
+// JobProgress is reported by jobs that take a while, such as upgrades.
+type JobProgress struct {
+	Step    string `json:"step"`
+	Percent int    `json:"percent"`
+	Message string `json:"message,omitempty"`
+}
+
+// Done reports whether the job has finished, successfully or not.
+func (j *Job) Done() bool {
+	switch j.Status {
+	case JobStatusCompleted, JobStatusFailed, JobStatusCancelled:
+		return true
+	}
+	return false
+}
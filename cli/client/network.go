@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// GetNetworkPolicy returns who can connect to an instance.
+func (c *Client) GetNetworkPolicy(ctx context.Context, instanceID string) (*NetworkPolicy, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Policy NetworkPolicy `json:"policy"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID) + "/network-policy", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Policy, nil
+}
+
+// SetNetworkPolicy replaces the network policy of a running instance and
+// returns it, with its CIDR blocks normalized, along with the ID of the job
+// applying it. It fails with CodeValidationFailed for an unusable CIDR
+// block and with a conflict if the instance isn't running.
+func (c *Client) SetNetworkPolicy(ctx context.Context, instanceID string, req NetworkPolicyRequest) (*NetworkPolicy, string, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, "", err
+	}
+	if req.AllowedCIDRs == nil {
+		req.AllowedCIDRs = []string{}
+	}
+	var resp struct {
+		Policy NetworkPolicy `json:"policy"`
+		JobID  string        `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   instancePath(instanceID) + "/network-policy",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &resp.Policy, resp.JobID, nil
+}
+
+// CreatePrivateNetwork allocates the private network of an org and returns
+// it with the ID of the job attaching the org's instances to it. It fails
+// with CodeConflict if the org already has one.
+func (c *Client) CreatePrivateNetwork(ctx context.Context, orgID string) (*PrivateNetwork, string, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, "", err
+	}
+	var resp struct {
+		Network PrivateNetwork `json:"network"`
+		JobID   string         `json:"job_id"`
+	}
+	if err := c.do(ctx, request{method: http.MethodPost, path: orgPath(orgID) + "/network", out: &resp}); err != nil {
+		return nil, "", err
+	}
+	return &resp.Network, resp.JobID, nil
+}
+
+// GetPrivateNetwork returns the private network of an org. It fails with
+// CodeNotFound when the org has none.
+func (c *Client) GetPrivateNetwork(ctx context.Context, orgID string) (*PrivateNetwork, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Network PrivateNetwork `json:"network"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: orgPath(orgID) + "/network", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Network, nil
+}
+
+// ListPeers returns the WireGuard peers of the private network of an org,
+// oldest first.
+func (c *Client) ListPeers(ctx context.Context, orgID string) ([]WireGuardPeer, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Peers []WireGuardPeer `json:"peers"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: orgPath(orgID) + "/network/peers", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
+
+// CreatePeer creates a WireGuard peer of the private network of an org. The
+// result holds its wg-quick config, the only copy of its private key. It
+// fails with CodeNotSupported when the server has no WireGuard gateway.
+func (c *Client) CreatePeer(ctx context.Context, orgID, name string) (*CreatedPeer, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp CreatedPeer
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   orgPath(orgID) + "/network/peers",
+		body:   map[string]string{"name": name},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeletePeer deletes a WireGuard peer and returns the ID of the job closing
+// its tunnel.
+func (c *Client) DeletePeer(ctx context.Context, orgID, peerID string) (string, error) {
+	if err := checkID(orgID, peerID); err != nil {
+		return "", err
+	}
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodDelete,
+		path:   orgPath(orgID) + "/network/peers/" + url.PathEscape(peerID),
+		out:    &resp,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.JobID, nil
+}
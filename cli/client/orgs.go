@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// ListOrgs returns the orgs the caller is a member of, with their role.
+func (c *Client) ListOrgs(ctx context.Context) ([]Org, error) {
+	var resp struct {
+		Orgs []Org `json:"orgs"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/orgs", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Orgs, nil
+}
+
+func (c *Client) IterateOrgs(ctx context.Context) *Iterator[Org] {
+	return newIterator(ctx, singlePage(c.ListOrgs))
+}
+
+// CreateOrg creates an org owned by the caller.
+func (c *Client) CreateOrg(ctx context.Context, name string) (*Org, error) {
+	var resp struct {
+		Org Org `json:"org"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/orgs",
+		body:   map[string]string{"name": name},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Org, nil
+}
+
+// GetOrg returns an org with the caller's role in it.
+func (c *Client) GetOrg(ctx context.Context, orgID string) (*Org, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Org  Org    `json:"org"`
+		Role string `json:"role"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: orgPath(orgID), out: &resp}); err != nil {
+		return nil, err
+	}
+	resp.Org.Role = resp.Role
+	return &resp.Org, nil
+}
+
+// RenameOrg changes the name of an org. It needs the admin role.
+func (c *Client) RenameOrg(ctx context.Context, orgID, name string) error {
+	if err := checkID(orgID); err != nil {
+		return err
+	}
+	return c.do(ctx, request{
+		method: http.MethodPatch,
+		path:   orgPath(orgID),
+		body:   map[string]string{"name": name},
+	})
+}
+
+// DeleteOrg queues a job that deletes an org and returns its ID. It needs
+// the owner role. An org with instances fails with CodeConflict unless
+// cascade is set, which deletes the instances first.
+func (c *Client) DeleteOrg(ctx context.Context, orgID string, cascade bool) (string, error) {
+	if err := checkID(orgID); err != nil {
+		return "", err
+	}
+	var query url.Values
+	if cascade {
+		query = url.Values{"cascade": {"true"}}
+	}
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodDelete,
+		path:   orgPath(orgID),
+		query:  query,
+		out:    &resp,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.JobID, nil
+}
+
+// OrgQuotas returns the quotas of an org and its projects with their usage.
+func (c *Client) OrgQuotas(ctx context.Context, orgID string) (*Quotas, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Quotas Quotas `json:"quotas"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: orgPath(orgID) + "/quotas", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Quotas, nil
+}
+
+// GetSSOConnection returns the SSO connection of an org. It fails with
+// CodeNotFound when none is configured.
+func (c *Client) GetSSOConnection(ctx context.Context, orgID string) (*SSOConnection, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SSO SSOConnection `json:"sso"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: orgPath(orgID) + "/sso", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.SSO, nil
+}
+
+// SetSSOConnection creates or replaces the SSO connection of an org. The
+// server checks the issuer's discovery document before saving it.
+func (c *Client) SetSSOConnection(ctx context.Context, orgID string, req SSOConnectionRequest) (*SSOConnection, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SSO SSOConnection `json:"sso"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   orgPath(orgID) + "/sso",
+		body:   req,
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.SSO, nil
+}
+
+func (c *Client) DeleteSSOConnection(ctx context.Context, orgID string) error {
+	if err := checkID(orgID); err != nil {
+		return err
+	}
+	return c.do(ctx, request{method: http.MethodDelete, path: orgPath(orgID) + "/sso"})
+}
+
+func orgPath(orgID string) string {
+	return "/orgs/" + url.PathEscape(orgID)
+}
+
+// VerifySSODomain checks the ownership record of an auto-join domain of an
+// org's SSO connection. The domain comes back verified, or pending with an
+// error message.
+func (c *Client) VerifySSODomain(ctx context.Context, orgID, domain string) (*SSODomain, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Domain SSODomain `json:"domain"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   orgPath(orgID) + "/sso/domains/" + url.PathEscape(domain) + ":verify",
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Domain, nil
+}
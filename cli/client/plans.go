@@ -0,0 +1,18 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// ListPlans returns the plan catalog, smallest first, including deprecated
+// plans. It needs no token.
+func (c *Client) ListPlans(ctx context.Context) ([]Plan, error) {
+	var resp struct {
+		Plans []Plan `json:"plans"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/plans", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Plans, nil
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+func (c *Client) ListProjects(ctx context.Context, orgID string) ([]Project, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Projects []Project `json:"projects"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: orgPath(orgID) + "/projects", out: &resp}); err != nil {
+		return nil, err
+	}
+	return resp.Projects, nil
+}
+
+func (c *Client) IterateProjects(ctx context.Context, orgID string) *Iterator[Project] {
+	return newIterator(ctx, singlePage(func(ctx context.Context) ([]Project, error) {
+		return c.ListProjects(ctx, orgID)
+	}))
+}
+
+// CreateProject creates a project in an org. Names are unique within the
+// org; a taken name fails with CodeConflict.
+func (c *Client) CreateProject(ctx context.Context, orgID, name string) (*Project, error) {
+	if err := checkID(orgID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Project Project `json:"project"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   orgPath(orgID) + "/projects",
+		body:   map[string]string{"name": name},
+		out:    &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Project, nil
+}
+
+func (c *Client) GetProject(ctx context.Context, projectID string) (*Project, error) {
+	if err := checkID(projectID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Project Project `json:"project"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: projectPath(projectID), out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Project, nil
+}
+
+// DeleteProject deletes an empty project. It fails with CodeConflict while
+// the project still has instances.
+func (c *Client) DeleteProject(ctx context.Context, projectID string) error {
+	if err := checkID(projectID); err != nil {
+		return err
+	}
+	return c.do(ctx, request{method: http.MethodDelete, path: projectPath(projectID)})
+}
+
+func projectPath(projectID string) string {
+	return "/projects/" + url.PathEscape(projectID)
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// GetCABundle returns the CA certificates, in PEM, that instance
+// certificates chain to. It fails with CodeNotFound when the server issues
+// none, in which case instances serve self-signed certificates.
+func (c *Client) GetCABundle(ctx context.Context) ([]byte, error) {
+	var bundle []byte
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/ca.pem", raw: &bundle}); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// GetCertificate returns the certificate an instance serves. It fails with
+// CodeNotFound until one has been issued.
+func (c *Client) GetCertificate(ctx context.Context, instanceID string) (*Certificate, error) {
+	if err := checkID(instanceID); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Certificate Certificate `json:"certificate"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: instancePath(instanceID) + "/certificate", out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp.Certificate, nil
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+var instanceAllowlistCmd = &cobra.Command{
+	Use:   "allowlist",
+	Short: "Commands for the addresses that can connect to an instance",
+	Long: `Commands for the addresses that can connect to a database instance.
+
+An instance with an empty allow-list accepts connections from any address
+if it's public, or from any private network if it's private. Once a block
+is added, only the listed blocks can reach Postgres.`,
+}
+
+var instanceAllowlistListCmd = &cobra.Command{
+	Use:   "list [instance-id]",
+	Short: "List the addresses that can connect to a database instance",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runInstanceAllowlistList,
+}
+
+var instanceAllowlistAddCmd = &cobra.Command{
+	Use:   "add [instance-id] [cidr...]",
+	Short: "Let CIDR blocks connect to a database instance",
+	Long: `Add CIDR blocks, such as 203.0.113.0/24, or single addresses to the
+allow-list of a running database instance. Private instances only accept
+blocks within private networks.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runInstanceAllowlistAdd,
+}
+
+var instanceAllowlistRemoveCmd = &cobra.Command{
+	Use:   "remove [instance-id] [cidr...]",
+	Short: "Stop CIDR blocks from connecting to a database instance",
+	Long: `Remove CIDR blocks or single addresses from the allow-list of a running
+database instance. Removing the last one opens the instance to any address,
+or to any private network if it's private.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runInstanceAllowlistRemove,
+}
+
+func init() {
+	instanceCmd.AddCommand(instanceAllowlistCmd)
+	instanceAllowlistCmd.AddCommand(instanceAllowlistListCmd)
+	instanceAllowlistCmd.AddCommand(instanceAllowlistAddCmd)
+	instanceAllowlistCmd.AddCommand(instanceAllowlistRemoveCmd)
+
+	// Silence usage on errors for clean error messages
+	instanceAllowlistCmd.SilenceUsage = true
+	instanceAllowlistListCmd.SilenceUsage = true
+	instanceAllowlistAddCmd.SilenceUsage = true
+	instanceAllowlistRemoveCmd.SilenceUsage = true
+
+	// Allowlist add flags
+	instanceAllowlistAddCmd.Flags().String("exposure", "", "Also make the instance public or private (default: unchanged)")
+	instanceAllowlistAddCmd.Flags().Bool("wait", false, "Wait for the allow-list to be applied")
+
+	// Allowlist remove flags
+	instanceAllowlistRemoveCmd.Flags().Bool("wait", false, "Wait for the allow-list to be applied")
+}
+
+func runInstanceAllowlistList(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	policy, err := c.GetNetworkPolicy(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(policy)
+	}
+	printNetworkPolicy(policy)
+	return nil
+}
+
+func runInstanceAllowlistAdd(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID, cidrs := args[0], args[1:]
+	exposure, _ := cmd.Flags().GetString("exposure")
+	if exposure != "" && exposure != client.ExposurePublic && exposure != client.ExposurePrivate {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Exposure must be ") + colors.Cyan("public") + colors.White(" or ") + colors.Cyan("private"))
+	}
+
+	policy, err := c.GetNetworkPolicy(cmd.Context(), instanceID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if exposure == "" {
+		exposure = policy.Exposure
+	}
+
+	// The server drops the blocks already listed
+	policy, jobID, err := c.SetNetworkPolicy(cmd.Context(), instanceID, client.NetworkPolicyRequest{
+		Exposure:     exposure,
+		AllowedCIDRs: append(policy.AllowedCIDRs, cidrs...),
+	})
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	return finishAllowlist(cmd, c, instanceID, policy, jobID, "Added "+strings.Join(cidrs, ", ")+" to")
+}
+
+func runInstanceAllowlistRemove(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	policy, err := c.GetNetworkPolicy(cmd.Context(), instanceID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	remove := make(map[string]bool, len(args)-1)
+	for _, cidr := range args[1:] {
+		remove[canonicalCIDR(cidr)] = true
+	}
+	kept := make([]string, 0, len(policy.AllowedCIDRs))
+	for _, cidr := range policy.AllowedCIDRs {
+		if remove[cidr] {
+			delete(remove, cidr)
+			continue
+		}
+		kept = append(kept, cidr)
+	}
+	if len(remove) > 0 {
+		missing := make([]string, 0, len(remove))
+		for _, cidr := range args[1:] {
+			if remove[canonicalCIDR(cidr)] {
+				missing = append(missing, cidr)
+			}
+		}
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not in the allow-list: ") + colors.Cyan(strings.Join(missing, ", ")))
+	}
+
+	policy, jobID, err := c.SetNetworkPolicy(cmd.Context(), instanceID, client.NetworkPolicyRequest{
+		Exposure:     policy.Exposure,
+		AllowedCIDRs: kept,
+	})
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	return finishAllowlist(cmd, c, instanceID, policy, jobID, "Removed "+strings.Join(args[1:], ", ")+" from")
+}
+
+// finishAllowlist reports a changed allow-list, waiting for the job
+// applying it if --wait was given.
+func finishAllowlist(cmd *cobra.Command, c *client.Client, instanceID string, policy *client.NetworkPolicy, jobID, change string) error {
+	wait, _ := cmd.Flags().GetBool("wait")
+	if !wait {
+		fmt.Printf("%s the allow-list of instance %s\n", change, instanceID)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
+	}
+
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Applying the allow-list failed: ") + job.ErrorMessage)
+	}
+	fmt.Printf("%s %s the allow-list of instance %s\n", colors.Green("✓"), change, instanceID)
+	printNetworkPolicy(policy)
+	return nil
+}
+
+func printNetworkPolicy(policy *client.NetworkPolicy) {
+	fmt.Printf("%s   %s\n", colors.TableHeader("exposure"), colors.White(policy.Exposure))
+	if len(policy.AllowedCIDRs) == 0 {
+		allowed := "any address"
+		if policy.Exposure == client.ExposurePrivate {
+			allowed = "any private network"
+		}
+		fmt.Printf("%s   %s\n", colors.TableHeader("allowed "), colors.Gray(allowed))
+		return
+	}
+	for i, cidr := range policy.AllowedCIDRs {
+		header := "        "
+		if i == 0 {
+			header = "allowed "
+		}
+		fmt.Printf("%s   %s\n", colors.TableHeader(header), colors.Cyan(cidr))
+	}
+}
+
+// canonicalCIDR returns cidr the way the server stores it, a single address
+// as a block of one, or cidr itself if it doesn't parse.
+func canonicalCIDR(cidr string) string {
+	if addr, err := netip.ParseAddr(cidr); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	if prefix, err := netip.ParsePrefix(cidr); err == nil {
+		return prefix.Masked().String()
+	}
+	return cidr
+}
@@ -2,17 +2,14 @@ package cmd
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/term"
+	"github.com/zallarak/db/cli/client"
 	"github.com/zallarak/db/cli/internal/colors"
 )
 
@@ -35,6 +32,29 @@ var logoutCmd = &cobra.Command{
 	RunE:  runLogout,
 }
 
+var deviceCmd = &cobra.Command{
+	Use:   "device",
+	Short: colors.Gray("Approve or deny device logins"),
+	Long: colors.Gray("Approve or deny a ") + colors.Cyan("dbx auth login --web") + colors.Gray(` started elsewhere, such as on a
+server without a browser, from this signed-in CLI`),
+}
+
+var deviceApproveCmd = &cobra.Command{
+	Use:   "approve [code]",
+	Short: colors.Gray("Approve a device login"),
+	Long: colors.Gray(`Approve the device login showing code, signing it in as you. The device
+gets the SSO scope of this session.`),
+	Args: cobra.ExactArgs(1),
+	RunE: runDeviceApprove,
+}
+
+var deviceDenyCmd = &cobra.Command{
+	Use:   "deny [code]",
+	Short: colors.Gray("Deny a device login"),
+	Args:  cobra.ExactArgs(1),
+	RunE:  runDeviceDeny,
+}
+
 var registerCmd = &cobra.Command{
 	Use:   "register",
 	Short: colors.Gray("Register a new account"),
@@ -47,15 +67,30 @@ func init() {
 	authCmd.AddCommand(loginCmd)
 	authCmd.AddCommand(logoutCmd)
 	authCmd.AddCommand(registerCmd)
+	authCmd.AddCommand(deviceCmd)
+	deviceCmd.AddCommand(deviceApproveCmd)
+	deviceCmd.AddCommand(deviceDenyCmd)
+
+	loginCmd.Flags().Bool("web", false, "Log in from a browser with a one-time code (required for SSO accounts)")
 	
 	// Silence usage on errors for clean error messages
 	authCmd.SilenceUsage = true
 	loginCmd.SilenceUsage = true
 	logoutCmd.SilenceUsage = true
 	registerCmd.SilenceUsage = true
+	deviceCmd.SilenceUsage = true
+	deviceApproveCmd.SilenceUsage = true
+	deviceDenyCmd.SilenceUsage = true
+
+	// Device approve flags
+	deviceApproveCmd.Flags().Bool("force", false, "Approve without confirmation")
 }
 
 func runLogin(cmd *cobra.Command, args []string) error {
+	if web, _ := cmd.Flags().GetBool("web"); web {
+		return runWebLogin(cmd)
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Print(colors.Gray("Email: "))
@@ -74,54 +109,96 @@ func runLogin(cmd *cobra.Command, args []string) error {
 
 	password := string(passwordBytes)
 
-	// Login request
-	loginReq := map[string]string{
-		"email":    email,
-		"password": password,
+	resp, err := newAnonymousClient().Login(cmd.Context(), email, password)
+	if err != nil {
+		return apiError(err, "Login failed")
 	}
 
-	reqBody, err := json.Marshal(loginReq)
+	return saveLogin(resp.Token, resp.User.ID, resp.User.Email)
+}
+
+// runWebLogin signs in with the OAuth device authorization flow: the user
+// approves a short code in a browser, or with "dbx auth device approve",
+// while the CLI polls for a token.
+func runWebLogin(cmd *cobra.Command) error {
+	c := newAnonymousClient()
+
+	authz, err := c.StartDeviceLogin(cmd.Context(), client.DefaultClientID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return apiError(err, "Login failed")
 	}
 
-	apiURL := viper.GetString("api-url")
-	resp, err := http.Post(apiURL+"/v1/auth/login", "application/json", bytes.NewReader(reqBody))
-	if err != nil {
-		return fmt.Errorf("login request failed: %w", err)
+	fmt.Printf(colors.Gray("Open ") + colors.Cyan(authz.VerificationURI) + colors.Gray(" and enter the code:") + "\n\n")
+	fmt.Printf("    " + colors.BoldWhite(authz.UserCode) + "\n\n")
+	fmt.Printf(colors.Gray("Or go directly to ") + colors.Cyan(authz.VerificationURIComplete) + "\n")
+	fmt.Printf(colors.Gray("Or run ") + colors.Cyan("dbx auth device approve "+authz.UserCode) + colors.Gray(" where you are logged in") + "\n")
+	fmt.Printf(colors.Gray("Waiting for approval...") + "\n")
+
+	token, err := c.WaitForDeviceToken(cmd.Context(), authz, client.DefaultClientID)
+	switch client.ErrorCode(err) {
+	case "":
+		if err != nil {
+			return apiError(err, "Login failed")
+		}
+		return saveLogin(token.AccessToken, token.User.ID, token.User.Email)
+	case client.CodeAccessDenied:
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Login was denied"))
+	case client.CodeExpiredToken:
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Code expired. Run ") + colors.Cyan("dbx auth login --web") + colors.White(" again"))
+	default:
+		return apiError(err, "Login failed")
 	}
-	defer resp.Body.Close()
+}
 
-	body, err := io.ReadAll(resp.Body)
+func runDeviceApprove(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		var errorResp map[string]interface{}
-		json.Unmarshal(body, &errorResp)
-		if msg, ok := errorResp["error"].(string); ok {
-			return fmt.Errorf(colors.Red("✗") + " " + colors.White("Login failed: ") + msg)
+	// Show what is being approved, since a code can be phished
+	req, err := c.GetDeviceRequest(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	if !force {
+		fmt.Printf("Only approve a login you started yourself.\n")
+		fmt.Printf("Approve %s started at %s with code %s? (y/N): ",
+			req.ClientID, req.CreatedAt.Local().Format("15:04:05"), req.UserCode)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Approval cancelled")
+			return nil
 		}
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Login failed with status %d"), resp.StatusCode)
 	}
 
-	var loginResp struct {
-		Token string `json:"token"`
-		User  struct {
-			ID    string `json:"id"`
-			Email string `json:"email"`
-		} `json:"user"`
+	if err := c.ApproveDevice(cmd.Context(), req.UserCode); err != nil {
+		return apiError(err, "Request failed")
 	}
+	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Approved ") + colors.Cyan(req.UserCode) + "\n")
+	return nil
+}
 
-	if err := json.Unmarshal(body, &loginResp); err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+func runDeviceDeny(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
 	}
 
-	// Save token to config
-	viper.Set("token", loginResp.Token)
-	viper.Set("user.id", loginResp.User.ID)
-	viper.Set("user.email", loginResp.User.Email)
+	if err := c.DenyDevice(cmd.Context(), args[0]); err != nil {
+		return apiError(err, "Request failed")
+	}
+	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Denied ") + colors.Cyan(args[0]) + "\n")
+	return nil
+}
+
+// saveLogin stores the session token and user in the config file.
+func saveLogin(token, userID, email string) error {
+	viper.Set("token", token)
+	viper.Set("user.id", userID)
+	viper.Set("user.email", email)
 
 	configPath := viper.ConfigFileUsed()
 	if configPath == "" {
@@ -133,11 +210,16 @@ func runLogin(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to save config: %w", err)
 	}
 
-	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Logged in as ") + colors.Cyan(loginResp.User.Email) + "\n")
+	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Logged in as ") + colors.Cyan(email) + "\n")
 	return nil
 }
 
 func runLogout(cmd *cobra.Command, args []string) error {
+	// Tell the API too; the token is forgotten locally even if it's unreachable
+	if c, err := newClient(); err == nil {
+		c.Logout(cmd.Context())
+	}
+
 	viper.Set("token", "")
 	viper.Set("user.id", "")
 	viper.Set("user.email", "")
@@ -175,50 +257,12 @@ func runRegister(cmd *cobra.Command, args []string) error {
 
 	password := string(passwordBytes)
 
-	// Registration request
-	registerReq := map[string]string{
-		"email":    email,
-		"password": password,
-	}
-
-	reqBody, err := json.Marshal(registerReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	apiURL := viper.GetString("api-url")
-	resp, err := http.Post(apiURL+"/v1/auth/register", "application/json", bytes.NewReader(reqBody))
+	user, err := newAnonymousClient().Register(cmd.Context(), email, password)
 	if err != nil {
-		return fmt.Errorf("registration request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusCreated {
-		var errorResp map[string]interface{}
-		json.Unmarshal(body, &errorResp)
-		if msg, ok := errorResp["error"].(string); ok {
-			return fmt.Errorf(colors.Red("✗") + " " + colors.White("Registration failed: ") + msg)
-		}
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Registration failed with status %d"), resp.StatusCode)
-	}
-
-	var registerResp struct {
-		User struct {
-			ID    string `json:"id"`
-			Email string `json:"email"`
-		} `json:"user"`
-	}
-
-	if err := json.Unmarshal(body, &registerResp); err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+		return apiError(err, "Registration failed")
 	}
 
-	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Account created for ") + colors.Cyan(registerResp.User.Email) + "\n")
+	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Account created for ") + colors.Cyan(user.Email) + "\n")
 	fmt.Printf(colors.Gray("Run ") + colors.Cyan("dbx auth login") + colors.Gray(" to sign in") + "\n")
 	return nil
 }
\ No newline at end of file
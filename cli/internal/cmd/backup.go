@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Database instance backup commands",
+}
+
+var backupListCmd = &cobra.Command{
+	Use:   "list [instance-id]",
+	Short: "List the backups of a database instance",
+	Long: `List the backups of a database instance, and the window it can be
+restored to any point of with 'dbx instance restore --to-time'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackupList,
+}
+
+var backupCreateCmd = &cobra.Command{
+	Use:   "create [instance-id]",
+	Short: "Back up a database instance now",
+	Long: `Take a base backup of a running database instance and store it in the
+object store. Only one backup of an instance runs at a time.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackupCreate,
+}
+
+var backupPolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Backup schedule commands",
+}
+
+var backupPolicyShowCmd = &cobra.Command{
+	Use:   "show [instance-id]",
+	Short: "Show the backup schedule of a database instance",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runBackupPolicyShow,
+}
+
+var backupPolicySetCmd = &cobra.Command{
+	Use:   "set [instance-id]",
+	Short: "Back up a database instance on a schedule",
+	Long: `Back up a database instance on a schedule, replacing its current one.
+
+The schedule is a five-field cron expression evaluated in UTC, such as
+"0 3 * * *" for every day at 03:00, or one of @hourly, @daily, @weekly
+and @monthly. Scheduled backups are skipped while the instance isn't
+running or is still being backed up.
+
+Unless --wal-archiving=false, the instance's WAL is also archived between
+backups, so it can be restored to any point in time since its oldest
+backup.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackupPolicySet,
+}
+
+var backupPolicyDeleteCmd = &cobra.Command{
+	Use:   "delete [instance-id]",
+	Short: "Stop scheduled backups of a database instance",
+	Long: `Stop scheduled backups and WAL archiving of a database instance. Its
+backups and archived WAL are kept until the backups expire.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackupPolicyDelete,
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	backupCmd.AddCommand(backupListCmd)
+	backupCmd.AddCommand(backupCreateCmd)
+	backupCmd.AddCommand(backupPolicyCmd)
+	backupPolicyCmd.AddCommand(backupPolicyShowCmd)
+	backupPolicyCmd.AddCommand(backupPolicySetCmd)
+	backupPolicyCmd.AddCommand(backupPolicyDeleteCmd)
+
+	// Silence usage on errors for clean error messages
+	backupCmd.SilenceUsage = true
+	backupListCmd.SilenceUsage = true
+	backupCreateCmd.SilenceUsage = true
+	backupPolicyCmd.SilenceUsage = true
+	backupPolicyShowCmd.SilenceUsage = true
+	backupPolicySetCmd.SilenceUsage = true
+	backupPolicyDeleteCmd.SilenceUsage = true
+
+	// Backup create flags
+	backupCreateCmd.Flags().Int("retention-days", 0, "Days to keep the backup (default: the instance's backup policy, or the server default)")
+	backupCreateCmd.Flags().Bool("wait", false, "Wait for the backup to finish")
+
+	// Backup policy set flags
+	backupPolicySetCmd.Flags().String("schedule", "", "Cron expression in UTC, e.g. \"0 3 * * *\" (required)")
+	backupPolicySetCmd.Flags().Int("retention-days", 0, "Days to keep each backup (default 7)")
+	backupPolicySetCmd.Flags().Bool("wal-archiving", true, "Archive WAL between backups for point-in-time restores")
+	backupPolicySetCmd.MarkFlagRequired("schedule")
+}
+
+func runBackupList(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	backups, err := c.ListBackups(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(backups)
+	}
+	if len(backups) == 0 {
+		fmt.Println(colors.Gray("No backups found"))
+		return nil
+	}
+	window, err := c.GetRecoveryWindow(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	fmt.Printf("%s   %s   %s   %s   %s   %s\n",
+		colors.TableHeader("id"),
+		colors.TableHeader("kind"),
+		colors.TableHeader("status"),
+		colors.TableHeader("size"),
+		colors.TableHeader("created"),
+		colors.TableHeader("expires"))
+	for _, b := range backups {
+		size, expires := "-", "-"
+		if b.Status == client.BackupStatusCompleted {
+			size = formatBytes(b.SizeBytes)
+		}
+		if b.ExpiresAt != nil {
+			expires = b.ExpiresAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%s   %s   %s   %s   %s   %s\n",
+			colors.Cyan(b.ID[:8]),
+			colors.White(b.Kind),
+			colors.Gray(b.Status),
+			colors.Gray(size),
+			colors.Gray(b.CreatedAt.Local().Format("2006-01-02 15:04")),
+			colors.Gray(expires))
+	}
+
+	fmt.Println()
+	if window == nil {
+		fmt.Println(colors.Gray("No point-in-time recovery: no WAL is archived since a completed backup"))
+		return nil
+	}
+	fmt.Printf("%s   %s\n", colors.TableHeader("recovery window"), colors.White(fmt.Sprintf("%s to %s",
+		window.FromTime.Local().Format("2006-01-02 15:04:05"), window.ToTime.Local().Format("2006-01-02 15:04:05"))))
+	fmt.Printf("%s   %s\n", colors.TableHeader("wal range      "), colors.Gray(window.FromLSN+" to "+window.ToLSN))
+	return nil
+}
+
+func runBackupCreate(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	retention, _ := cmd.Flags().GetInt("retention-days")
+	wait, _ := cmd.Flags().GetBool("wait")
+
+	backup, jobID, err := c.CreateBackup(cmd.Context(), instanceID, client.CreateBackupRequest{RetentionDays: retention})
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if !wait {
+		fmt.Printf("Backup %s of instance %s initiated\n", backup.ID, instanceID)
+		fmt.Printf("Job ID: %s\n", jobID)
+		fmt.Printf("Use 'dbx backup list %s' to track progress\n", instanceID)
+		return nil
+	}
+
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Backup failed: ") + job.ErrorMessage)
+	}
+
+	backups, err := c.ListBackups(cmd.Context(), instanceID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	for _, b := range backups {
+		if b.ID == backup.ID {
+			backup = &b
+			break
+		}
+	}
+	fmt.Printf("%s Backup %s completed (%s)\n", colors.Green("✓"), backup.ID, formatBytes(backup.SizeBytes))
+	fmt.Println(colors.Gray("Stored at " + backup.RepoURL))
+	return nil
+}
+
+func runBackupPolicyShow(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	policy, err := c.GetBackupPolicy(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(policy)
+	}
+	printBackupPolicy(policy)
+	return nil
+}
+
+func runBackupPolicySet(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	schedule, _ := cmd.Flags().GetString("schedule")
+	retention, _ := cmd.Flags().GetInt("retention-days")
+	walArchiving, _ := cmd.Flags().GetBool("wal-archiving")
+
+	policy, err := c.SetBackupPolicy(cmd.Context(), args[0], client.BackupPolicyRequest{
+		Schedule:      schedule,
+		RetentionDays: retention,
+		WALArchiving:  &walArchiving,
+	})
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(policy)
+	}
+	fmt.Printf("%s Backup policy set for instance %s\n", colors.Green("✓"), args[0])
+	printBackupPolicy(policy)
+	return nil
+}
+
+func runBackupPolicyDelete(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if err := c.DeleteBackupPolicy(cmd.Context(), args[0]); err != nil {
+		return apiError(err, "Request failed")
+	}
+	fmt.Printf("%s Scheduled backups and WAL archiving of instance %s stopped\n", colors.Green("✓"), args[0])
+	return nil
+}
+
+func printBackupPolicy(policy *client.BackupPolicy) {
+	fmt.Printf("%s   %s\n", colors.TableHeader("schedule "), colors.White(policy.Schedule+" (UTC)"))
+	fmt.Printf("%s   %s\n", colors.TableHeader("retention"), colors.Gray(fmt.Sprintf("%d days", policy.RetentionDays)))
+	fmt.Printf("%s   %s\n", colors.TableHeader("next run "), colors.Gray(policy.NextRunAt.Local().Format("2006-01-02 15:04")))
+	wal := "off"
+	if policy.WALArchiving {
+		wal = "on"
+	}
+	fmt.Printf("%s   %s\n", colors.TableHeader("WAL      "), colors.Gray("archiving "+wal))
+}
+
+// formatBytes formats n bytes in the largest binary unit that keeps it at
+// least 1, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+var instanceDomainCmd = &cobra.Command{
+	Use:   "domain",
+	Short: "Commands for the custom domains of an instance",
+	Long: `Commands for the custom domains of a database instance.
+
+A custom domain is verified once a TXT record proves the organization
+controls it, and is then added to the instance's certificate. Clients
+reach the instance through it by a CNAME record from the domain to the
+domain proxy, which routes connections by TLS server name, or to the
+instance's FQDN where there is no proxy. You publish the record yourself.`,
+}
+
+var instanceDomainListCmd = &cobra.Command{
+	Use:   "list [instance-id]",
+	Short: "List the custom domains of a database instance",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runInstanceDomainList,
+}
+
+var instanceDomainAddCmd = &cobra.Command{
+	Use:   "add [instance-id] [domain]",
+	Short: "Point a custom domain at a database instance",
+	Long: `Add a custom domain to a database instance and print the DNS records to
+publish for it. The domain is checked right away and then periodically
+until its TXT record shows up; run "dbx instance domain verify" to check
+again sooner.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runInstanceDomainAdd,
+}
+
+var instanceDomainVerifyCmd = &cobra.Command{
+	Use:   "verify [instance-id] [domain]",
+	Short: "Check the ownership record of a custom domain now",
+	Long: `Check the TXT record of a custom domain now rather than at its next
+scheduled check. A domain that failed is checked again for another
+verification period. The domain can be given by name or ID.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runInstanceDomainVerify,
+}
+
+var instanceDomainRemoveCmd = &cobra.Command{
+	Use:   "remove [instance-id] [domain]",
+	Short: "Remove a custom domain from a database instance",
+	Long: `Remove a custom domain from a database instance. A verified domain is
+dropped from the instance's certificate. Your DNS records for it are left
+alone. The domain can be given by name or ID.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runInstanceDomainRemove,
+}
+
+func init() {
+	instanceCmd.AddCommand(instanceDomainCmd)
+	instanceDomainCmd.AddCommand(instanceDomainListCmd)
+	instanceDomainCmd.AddCommand(instanceDomainAddCmd)
+	instanceDomainCmd.AddCommand(instanceDomainVerifyCmd)
+	instanceDomainCmd.AddCommand(instanceDomainRemoveCmd)
+
+	// Silence usage on errors for clean error messages
+	instanceDomainCmd.SilenceUsage = true
+	instanceDomainListCmd.SilenceUsage = true
+	instanceDomainAddCmd.SilenceUsage = true
+	instanceDomainVerifyCmd.SilenceUsage = true
+	instanceDomainRemoveCmd.SilenceUsage = true
+
+	// Domain verify flags
+	instanceDomainVerifyCmd.Flags().Bool("wait", false, "Wait for the check and show its result")
+
+	// Domain remove flags
+	instanceDomainRemoveCmd.Flags().Bool("wait", false, "Wait for the certificate to be reissued")
+}
+
+func runInstanceDomainList(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	domains, err := c.ListDomains(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(domains)
+	}
+	if len(domains) == 0 {
+		fmt.Println(colors.Gray("No custom domains found"))
+		return nil
+	}
+
+	fmt.Printf("%s   %s   %s   %s\n",
+		colors.TableHeader("id"),
+		colors.TableHeader("name"),
+		colors.TableHeader("status"),
+		colors.TableHeader("details"))
+	for _, d := range domains {
+		fmt.Printf("%s   %s   %s   %s\n",
+			colors.Cyan(d.ID[:8]),
+			colors.White(d.Name),
+			colors.Gray(d.Status),
+			colors.Gray(domainDetails(&d)))
+	}
+	return nil
+}
+
+// domainDetails says what a domain is waiting for, or since when it is
+// verified.
+func domainDetails(d *client.Domain) string {
+	switch {
+	case d.Status == client.DomainStatusVerified && d.VerifiedAt != nil:
+		return "since " + d.VerifiedAt.Local().Format("2006-01-02")
+	case d.ErrorMessage != "":
+		return d.ErrorMessage
+	case d.Status == client.DomainStatusPending:
+		return "until " + d.ExpiresAt.Local().Format("2006-01-02 15:04")
+	}
+	return ""
+}
+
+func runInstanceDomainAdd(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	instance, err := c.GetInstance(cmd.Context(), instanceID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	domain, _, err := c.AddDomain(cmd.Context(), instanceID, args[1])
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(domain)
+	}
+	fmt.Printf("%s Added %s to instance %s\n", colors.Green("✓"), colors.Cyan(domain.Name), instanceID)
+	fmt.Println()
+	fmt.Println("Publish these records to verify the domain and route it to the instance:")
+	fmt.Println()
+	fmt.Printf("  %s TXT   %s\n", colors.Cyan(domain.VerificationName+"."), colors.White(`"`+domain.VerificationValue+`"`))
+	target, fqdn := domain.CNAMETarget, instance.FQDN
+	if fqdn == "" {
+		fqdn = "<the instance's FQDN, once it has one>"
+	}
+	if target == "" {
+		target = fqdn
+	}
+	fmt.Printf("  %s CNAME %s\n", colors.Cyan(domain.Name+"."), colors.White(target+"."))
+	// Certificates from an ACME CA need its challenges delegated too, to
+	// the instance's own challenge record
+	if cert, err := c.GetCertificate(cmd.Context(), instanceID); err == nil && cert.Issuer == "acme" {
+		fmt.Printf("  %s CNAME %s\n", colors.Cyan("_acme-challenge."+domain.Name+"."), colors.White("_acme-challenge."+fqdn+"."))
+	}
+	fmt.Println()
+	fmt.Printf("The domain is checked until %s.\n", domain.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	return nil
+}
+
+func runInstanceDomainVerify(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	domain, err := findDomain(cmd.Context(), c, instanceID, args[1])
+	if err != nil {
+		return err
+	}
+	domain, jobID, err := c.VerifyDomain(cmd.Context(), instanceID, domain.ID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	wait, _ := cmd.Flags().GetBool("wait")
+	if !wait {
+		if viper.GetString("output") == "json" {
+			return printJSON(domain)
+		}
+		fmt.Printf("Checking %s\n", domain.Name)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
+	}
+
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Checking the domain failed: ") + job.ErrorMessage)
+	}
+	domain, err = c.GetDomain(cmd.Context(), instanceID, domain.ID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if viper.GetString("output") == "json" {
+		return printJSON(domain)
+	}
+	if domain.Status != client.DomainStatusVerified {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White(domain.Name+" is "+domain.Status+": ") + domain.ErrorMessage)
+	}
+	fmt.Printf("%s Verified %s\n", colors.Green("✓"), colors.Cyan(domain.Name))
+	return nil
+}
+
+func runInstanceDomainRemove(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	domain, err := findDomain(cmd.Context(), c, instanceID, args[1])
+	if err != nil {
+		return err
+	}
+	jobID, err := c.RemoveDomain(cmd.Context(), instanceID, domain.ID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	wait, _ := cmd.Flags().GetBool("wait")
+	if jobID == "" || !wait {
+		fmt.Printf("Removed %s from instance %s\n", domain.Name, instanceID)
+		if jobID != "" {
+			fmt.Printf("Job ID: %s\n", jobID)
+		}
+		return nil
+	}
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Reissuing the certificate failed: ") + job.ErrorMessage)
+	}
+	fmt.Printf("%s Removed %s from instance %s and its certificate\n", colors.Green("✓"), colors.Cyan(domain.Name), instanceID)
+	return nil
+}
+
+// findDomain returns the custom domain of an instance named or with the ID
+// arg.
+func findDomain(ctx context.Context, c *client.Client, instanceID, arg string) (*client.Domain, error) {
+	domains, err := c.ListDomains(ctx, instanceID)
+	if err != nil {
+		return nil, apiError(err, "Request failed")
+	}
+	name := strings.TrimSuffix(strings.ToLower(arg), ".")
+	for i := range domains {
+		if domains[i].ID == arg || domains[i].Name == name {
+			return &domains[i], nil
+		}
+	}
+	return nil, fmt.Errorf(colors.Red("✗") + " " + colors.White("Instance "+instanceID+" has no domain ") + colors.Cyan(arg))
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zallarak/db/cli/client"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+// apiError builds the error shown when a call to the API fails. action
+// prefixes the message, e.g. "Login failed". Errors that never reached the
+// API, such as connection failures, are shown as they are.
+func apiError(err error, action string) error {
+	var e *client.APIError
+	if !errors.As(err, &e) {
+		return fmt.Errorf(colors.Red("✗")+" "+colors.White(action+": ")+"%v", err)
+	}
+
+	var b strings.Builder
+	b.WriteString(colors.Red("✗") + " " + colors.White(action+": ") + e.Message)
+	b.WriteString(colors.Gray(" (" + e.Code + ")"))
+	for _, d := range e.Details {
+		b.WriteString("\n  " + colors.Cyan(d.Field) + " " + d.Message)
+	}
+	if e.RequestID != "" {
+		b.WriteString("\n" + colors.Gray("Request ID: "+e.RequestID))
+	}
+	return fmt.Errorf("%s", b.String())
+}
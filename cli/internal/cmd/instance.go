@@ -1,14 +1,12 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
 	"github.com/zallarak/db/cli/internal/colors"
 )
 
@@ -29,6 +27,64 @@ var instanceCreateCmd = &cobra.Command{
 	RunE:  runInstanceCreate,
 }
 
+var instanceResizeCmd = &cobra.Command{
+	Use:   "resize [instance-id]",
+	Short: "Move a database instance to another plan or grow its disk",
+	Long: `Move a database instance to another plan, grow its disk, or both.
+
+CPU, memory and disk change while the instance runs. It is restarted only
+when the new plan has a different amount of memory or connection limit.
+Disks can grow but not shrink.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInstanceResize,
+}
+
+var instanceUpgradeCmd = &cobra.Command{
+	Use:   "upgrade [instance-id]",
+	Short: "Upgrade a database instance to a newer PostgreSQL major version",
+	Long: `Upgrade a database instance to a newer PostgreSQL major version.
+
+The upgrade is blue/green: a new container running the new version is
+provisioned and the data copied to it while the instance keeps serving.
+The instance is read-only for a moment while the last changes are applied
+and the copy is verified, then it moves to the new container. The old one
+is kept, stopped, so the upgrade can be rolled back with
+'dbx instance rollback' until the rollback window closes.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInstanceUpgrade,
+}
+
+var instanceRollbackCmd = &cobra.Command{
+	Use:   "rollback [instance-id]",
+	Short: "Roll back the latest upgrade of a database instance",
+	Long: `Move a database instance back to the container and PostgreSQL version it
+had before its latest upgrade. This is possible until the rollback window
+of the upgrade closes. Writes made since the upgrade are lost.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInstanceRollback,
+}
+
+var instanceUpgradesCmd = &cobra.Command{
+	Use:   "upgrades [instance-id]",
+	Short: "List the upgrades of a database instance",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runInstanceUpgrades,
+}
+
+var instanceRestoreCmd = &cobra.Command{
+	Use:   "restore [instance-id]",
+	Short: "Restore a backup of a database instance into a new instance",
+	Long: `Create a database instance from a backup of another, in the same project
+and on the PostgreSQL version of the backup.
+
+With --to-time or --to-lsn the WAL archived since the backup is replayed up
+to that point, which must be within the instance's recovery window (see
+'dbx backup list'). Without either, the new instance is as of the end of
+the backup.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInstanceRestore,
+}
+
 var instanceDeleteCmd = &cobra.Command{
 	Use:   "delete [instance-id]",
 	Short: "Delete a database instance",
@@ -40,32 +96,72 @@ func init() {
 	rootCmd.AddCommand(instanceCmd)
 	instanceCmd.AddCommand(instanceListCmd)
 	instanceCmd.AddCommand(instanceCreateCmd)
+	instanceCmd.AddCommand(instanceResizeCmd)
+	instanceCmd.AddCommand(instanceUpgradeCmd)
+	instanceCmd.AddCommand(instanceRollbackCmd)
+	instanceCmd.AddCommand(instanceUpgradesCmd)
+	instanceCmd.AddCommand(instanceRestoreCmd)
 	instanceCmd.AddCommand(instanceDeleteCmd)
 
 	// Silence usage on errors for clean error messages
 	instanceCmd.SilenceUsage = true
 	instanceListCmd.SilenceUsage = true
 	instanceCreateCmd.SilenceUsage = true
+	instanceResizeCmd.SilenceUsage = true
+	instanceUpgradeCmd.SilenceUsage = true
+	instanceRollbackCmd.SilenceUsage = true
+	instanceUpgradesCmd.SilenceUsage = true
+	instanceRestoreCmd.SilenceUsage = true
 	instanceDeleteCmd.SilenceUsage = true
 
+	// Instance list flags
+	instanceListCmd.Flags().String("project", "", "Project ID (required)")
+	instanceListCmd.MarkFlagRequired("project")
+
 	// Instance create flags
 	instanceCreateCmd.Flags().String("project", "", "Project ID (required)")
 	instanceCreateCmd.Flags().String("name", "", "Instance name (required)")
-	instanceCreateCmd.Flags().String("plan", "nano", "Instance plan (nano, lite, pro, pro-heavy)")
-	instanceCreateCmd.Flags().Int("pg-version", 16, "PostgreSQL version")
-	instanceCreateCmd.Flags().Int("disk", 0, "Disk size in GiB (optional)")
+	instanceCreateCmd.Flags().String("plan", "nano", "Instance plan (see dbx plans list)")
+	instanceCreateCmd.Flags().Int("pg-version", 0, "PostgreSQL version (default: the plan's default)")
+	instanceCreateCmd.Flags().Int("disk", 0, "Disk size in GiB (default: the plan's disk size)")
 
 	instanceCreateCmd.MarkFlagRequired("project")
 	instanceCreateCmd.MarkFlagRequired("name")
 
+	// Instance resize flags
+	instanceResizeCmd.Flags().String("plan", "", "New plan (see dbx plans list; default: the current plan)")
+	instanceResizeCmd.Flags().Int("disk", 0, "New disk size in GiB (default: the current size)")
+	instanceResizeCmd.Flags().Bool("wait", false, "Wait for the resize to finish")
+
+	// Instance upgrade flags
+	instanceUpgradeCmd.Flags().Int("version", 0, "PostgreSQL major version to upgrade to (required)")
+	instanceUpgradeCmd.Flags().Bool("wait", false, "Wait for the upgrade to finish, showing its progress")
+	instanceUpgradeCmd.MarkFlagRequired("version")
+
+	// Instance rollback flags
+	instanceRollbackCmd.Flags().Bool("force", false, "Roll back without confirmation")
+	instanceRollbackCmd.Flags().Bool("wait", false, "Wait for the rollback to finish")
+
+	// Instance restore flags
+	instanceRestoreCmd.Flags().String("from-backup", "", "ID of the backup to restore (required; see dbx backup list)")
+	instanceRestoreCmd.Flags().String("name", "", "Name of the new instance (required)")
+	instanceRestoreCmd.Flags().String("to-time", "", "Recover to this time, RFC 3339, e.g. 2024-05-01T12:30:00Z")
+	instanceRestoreCmd.Flags().String("to-lsn", "", "Recover to this WAL position, e.g. 16/B374D848")
+	instanceRestoreCmd.Flags().String("plan", "", "Plan of the new instance (default: the source instance's)")
+	instanceRestoreCmd.Flags().Int("disk", 0, "Disk size in GiB (default: the source instance's)")
+	instanceRestoreCmd.Flags().Bool("wait", false, "Wait for the restore to finish, showing its progress")
+	instanceRestoreCmd.MarkFlagRequired("from-backup")
+	instanceRestoreCmd.MarkFlagRequired("name")
+	instanceRestoreCmd.MarkFlagsMutuallyExclusive("to-time", "to-lsn")
+
 	// Instance delete flags
 	instanceDeleteCmd.Flags().Bool("force", false, "Force deletion without confirmation")
 }
 
 func runInstanceList(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
+	c, err := newClient()
+	if err != nil {
+		return err
 	}
 
 	projectID, _ := cmd.Flags().GetString("project")
@@ -73,53 +169,18 @@ func runInstanceList(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("project flag is required")
 	}
 
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/projects/%s/instances", apiURL, projectID)
-	
-	req, err := http.NewRequest("GET", url, nil)
+	instances, err := c.ListInstances(cmd.Context(), projectID)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
-	}
-
-	var response struct {
-		Instances []struct {
-			ID        string `json:"id"`
-			Name      string `json:"name"`
-			Plan      string `json:"plan"`
-			PgVersion int    `json:"pg_version"`
-			Status    string `json:"status"`
-			FQDN      string `json:"fqdn"`
-			CreatedAt string `json:"created_at"`
-		} `json:"instances"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		return apiError(err, "Request failed")
 	}
 
 	outputFormat := viper.GetString("output")
 	if outputFormat == "json" {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(response.Instances)
+		return printJSON(instances)
 	}
 
 	// Clean table output
-	if len(response.Instances) == 0 {
+	if len(instances) == 0 {
 		fmt.Println(colors.Gray("No instances found"))
 		return nil
 	}
@@ -133,7 +194,7 @@ func runInstanceList(cmd *cobra.Command, args []string) error {
 		colors.TableHeader("fqdn"),
 		colors.TableHeader("created"))
 	
-	for _, instance := range response.Instances {
+	for _, instance := range instances {
 		fqdn := instance.FQDN
 		if fqdn == "" {
 			fqdn = "-"
@@ -145,15 +206,15 @@ func runInstanceList(cmd *cobra.Command, args []string) error {
 			colors.Gray(fmt.Sprintf("%d", instance.PgVersion)),
 			colors.Gray(instance.Status),
 			colors.Gray(fqdn),
-			colors.Gray(instance.CreatedAt[:10]))
+			colors.Gray(instance.CreatedAt.Format("2006-01-02")))
 	}
 	return nil
 }
 
 func runInstanceCreate(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
+	c, err := newClient()
+	if err != nil {
+		return err
 	}
 
 	projectID, _ := cmd.Flags().GetString("project")
@@ -162,97 +223,298 @@ func runInstanceCreate(cmd *cobra.Command, args []string) error {
 	pgVersion, _ := cmd.Flags().GetInt("pg-version")
 	diskSize, _ := cmd.Flags().GetInt("disk")
 
-	createReq := map[string]interface{}{
-		"name":       name,
-		"plan":       plan,
-		"pg_version": pgVersion,
+	_, jobID, err := c.CreateInstance(cmd.Context(), projectID, client.CreateInstanceRequest{
+		Name:      name,
+		Plan:      plan,
+		PgVersion: pgVersion,
+		DiskGiB:   diskSize,
+	})
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	fmt.Printf("Instance creation initiated: %s\n", name)
+	fmt.Printf("Job ID: %s\n", jobID)
+	fmt.Printf("Use 'dbx instance list --project %s' to track progress\n", projectID)
+	return nil
+}
+
+func runInstanceResize(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	plan, _ := cmd.Flags().GetString("plan")
+	diskSize, _ := cmd.Flags().GetInt("disk")
+	wait, _ := cmd.Flags().GetBool("wait")
+	if plan == "" && diskSize == 0 {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Give a new plan with ") + colors.Cyan("--plan") + colors.White(", a disk size with ") + colors.Cyan("--disk") + colors.White(", or both"))
+	}
+
+	instance, jobID, err := c.ResizeInstance(cmd.Context(), instanceID, client.ResizeInstanceRequest{
+		Plan:    plan,
+		DiskGiB: diskSize,
+	})
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if !wait {
+		fmt.Printf("Instance %s resize initiated\n", instance.Name)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
 	}
 
-	if diskSize > 0 {
-		createReq["disk_gib"] = diskSize
+	fmt.Println(colors.Gray("Waiting for the resize to finish..."))
+	job, err := c.WaitForJob(cmd.Context(), jobID, 2*time.Second)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Resize failed: ") + job.ErrorMessage)
 	}
 
-	reqBody, err := json.Marshal(createReq)
+	instance, err = c.GetInstance(cmd.Context(), instanceID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return apiError(err, "Request failed")
 	}
+	fmt.Printf("%s Instance %s is now %s with %d GiB of disk\n", colors.Green("✓"), instance.Name, instance.Plan, instance.DiskGiB)
+	return nil
+}
 
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/projects/%s/instances", apiURL, projectID)
-	
-	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+func runInstanceUpgrade(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	instanceID := args[0]
+	version, _ := cmd.Flags().GetInt("version")
+	wait, _ := cmd.Flags().GetBool("wait")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	instance, upgrade, jobID, err := c.UpgradeInstance(cmd.Context(), instanceID, client.UpgradeInstanceRequest{PgVersion: version})
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return apiError(err, "Request failed")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	if !wait {
+		fmt.Printf("Instance %s upgrade from PostgreSQL %d to %d initiated\n", instance.Name, upgrade.FromVersion, upgrade.ToVersion)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
 	}
 
-	var response map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Upgrade failed: ") + job.ErrorMessage)
 	}
 
-	fmt.Printf("Instance creation initiated: %s\n", name)
-	if jobID, ok := response["job_id"].(string); ok {
+	upgrades, err := c.ListUpgrades(cmd.Context(), instanceID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	fmt.Printf("%s Instance %s now runs PostgreSQL %d\n", colors.Green("✓"), instance.Name, upgrade.ToVersion)
+	if len(upgrades) > 0 && upgrades[0].RollbackUntil != nil {
+		fmt.Println(colors.Gray("Roll back with 'dbx instance rollback " + instanceID + "' until " + upgrades[0].RollbackUntil.Local().Format(time.RFC1123)))
+	}
+	return nil
+}
+
+func runInstanceRestore(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	backupID, _ := cmd.Flags().GetString("from-backup")
+	name, _ := cmd.Flags().GetString("name")
+	toTime, _ := cmd.Flags().GetString("to-time")
+	toLSN, _ := cmd.Flags().GetString("to-lsn")
+	plan, _ := cmd.Flags().GetString("plan")
+	diskSize, _ := cmd.Flags().GetInt("disk")
+	wait, _ := cmd.Flags().GetBool("wait")
+
+	req := client.RestoreInstanceRequest{
+		Name:      name,
+		BackupID:  backupID,
+		TargetLSN: toLSN,
+		Plan:      plan,
+		DiskGiB:   diskSize,
+	}
+	if toTime != "" {
+		t, err := time.Parse(time.RFC3339, toTime)
+		if err != nil {
+			return fmt.Errorf(colors.Red("✗") + " " + colors.White("Invalid ") + colors.Cyan("--to-time") + colors.White(": give a time such as 2024-05-01T12:30:00Z"))
+		}
+		req.TargetTime = &t
+	}
+
+	instance, jobID, err := c.RestoreInstance(cmd.Context(), args[0], req)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if !wait {
+		fmt.Printf("Instance %s (%s) restore initiated\n", instance.Name, instance.ID)
 		fmt.Printf("Job ID: %s\n", jobID)
-		fmt.Println("Use 'dbx instance list --project', createReq[projectID] to track progress")
+		return nil
+	}
+
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Restore failed: ") + job.ErrorMessage)
+	}
+
+	instance, err = c.GetInstance(cmd.Context(), instance.ID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	fmt.Printf("%s Instance %s (%s) restored from backup %s\n", colors.Green("✓"), instance.Name, instance.ID, backupID)
+	if src := instance.RestoredFrom; src != nil && src.RecoveredLSN != "" {
+		recovered := "Recovered to LSN " + src.RecoveredLSN
+		if src.RecoveredTime != nil {
+			recovered += ", last transaction at " + src.RecoveredTime.Local().Format(time.RFC1123)
+		}
+		fmt.Println(colors.Gray(recovered))
 	}
 	return nil
 }
 
-func runInstanceDelete(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
+// waitWithProgress waits for a job, printing its progress as it changes.
+func waitWithProgress(cmd *cobra.Command, c *client.Client, jobID string) (*client.Job, error) {
+	var last string
+	for {
+		job, err := c.GetJob(cmd.Context(), jobID)
+		if err != nil {
+			return nil, err
+		}
+		if p := job.Progress; p != nil && p.Message != last {
+			fmt.Println(colors.Gray(fmt.Sprintf("[%3d%%] %s", p.Percent, p.Message)))
+			last = p.Message
+		}
+		if job.Done() {
+			return job, nil
+		}
+		select {
+		case <-cmd.Context().Done():
+			return nil, cmd.Context().Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func runInstanceRollback(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
 	}
 
 	instanceID := args[0]
 	force, _ := cmd.Flags().GetBool("force")
+	wait, _ := cmd.Flags().GetBool("wait")
 
 	if !force {
-		fmt.Printf("Are you sure you want to delete instance %s? (y/N): ", instanceID)
+		fmt.Printf("Writes made to instance %s since its upgrade will be lost. Roll back? (y/N): ", instanceID)
 		var response string
 		fmt.Scanln(&response)
 		if response != "y" && response != "Y" {
-			fmt.Println("Deletion cancelled")
+			fmt.Println("Rollback cancelled")
 			return nil
 		}
 	}
 
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/instances/%s", apiURL, instanceID)
-	
-	req, err := http.NewRequest("DELETE", url, nil)
+	instance, upgrade, jobID, err := c.RollbackUpgrade(cmd.Context(), instanceID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if !wait {
+		fmt.Printf("Instance %s rollback to PostgreSQL %d initiated\n", instance.Name, upgrade.FromVersion)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
+	}
+
+	job, err := waitWithProgress(cmd, c, jobID)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Rollback failed: ") + job.ErrorMessage)
 	}
+	fmt.Printf("%s Instance %s is back on PostgreSQL %d\n", colors.Green("✓"), instance.Name, upgrade.FromVersion)
+	return nil
+}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+func runInstanceUpgrades(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	upgrades, err := c.ListUpgrades(cmd.Context(), args[0])
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(upgrades)
+	}
+	if len(upgrades) == 0 {
+		fmt.Println(colors.Gray("No upgrades found"))
+		return nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	fmt.Printf("%s   %s   %s   %s   %s\n",
+		colors.TableHeader("id"),
+		colors.TableHeader("versions"),
+		colors.TableHeader("status"),
+		colors.TableHeader("rollback until"),
+		colors.TableHeader("started"))
+	for _, u := range upgrades {
+		until := "-"
+		if u.RollbackUntil != nil && u.Status == client.UpgradeStatusCutOver {
+			until = u.RollbackUntil.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%s   %s   %s   %s   %s\n",
+			colors.Cyan(u.ID[:8]),
+			colors.White(fmt.Sprintf("%d → %d", u.FromVersion, u.ToVersion)),
+			colors.Gray(u.Status),
+			colors.Gray(until),
+			colors.Gray(u.CreatedAt.Local().Format("2006-01-02 15:04")))
+	}
+	return nil
+}
+
+func runInstanceDelete(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	instanceID := args[0]
+	force, _ := cmd.Flags().GetBool("force")
+
+	if !force {
+		fmt.Printf("Are you sure you want to delete instance %s? (y/N): ", instanceID)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Deletion cancelled")
+			return nil
+		}
+	}
+
+	if _, err := c.DeleteInstance(cmd.Context(), instanceID); err != nil {
+		return apiError(err, "Request failed")
 	}
 
 	fmt.Printf("Instance %s deletion initiated\n", instanceID)
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,323 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+var networkCmd = &cobra.Command{
+	Use:   "network",
+	Short: colors.Gray("Private network commands"),
+	Long: `Commands for the private network of the selected organization.
+
+The private network is a subnet on a VLAN of its own that every instance of
+the organization is attached to, at its private address. WireGuard peers,
+such as laptops or servers elsewhere, reach it through a gateway. Instances
+always accept connections from the private network, whatever their
+allow-list.`,
+}
+
+var networkCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: colors.Gray("Create the private network of the organization"),
+	Args:  cobra.NoArgs,
+	RunE:  runNetworkCreate,
+}
+
+var networkShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: colors.Gray("Show the private network of the organization"),
+	Args:  cobra.NoArgs,
+	RunE:  runNetworkShow,
+}
+
+var networkPeerCmd = &cobra.Command{
+	Use:   "peer",
+	Short: colors.Gray("WireGuard peer commands"),
+}
+
+var networkPeerCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: colors.Gray("Create a WireGuard peer and write its config"),
+	Long: `Create a WireGuard peer of the private network and write its wg-quick
+config, by default to NAME.conf, readable only by you. The config holds the
+only copy of the peer's private key. Bring the tunnel up with
+
+  sudo wg-quick up ./NAME.conf
+
+wg-quick names the interface after the file, which must be at most 15
+characters before .conf.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runNetworkPeerCreate,
+}
+
+var networkPeerListCmd = &cobra.Command{
+	Use:   "list",
+	Short: colors.Gray("List the WireGuard peers of the private network"),
+	Args:  cobra.NoArgs,
+	RunE:  runNetworkPeerList,
+}
+
+var networkPeerDeleteCmd = &cobra.Command{
+	Use:   "delete [peer-id]",
+	Short: colors.Gray("Delete a WireGuard peer, closing its tunnel"),
+	Args:  cobra.ExactArgs(1),
+	RunE:  runNetworkPeerDelete,
+}
+
+func init() {
+	rootCmd.AddCommand(networkCmd)
+	networkCmd.AddCommand(networkCreateCmd)
+	networkCmd.AddCommand(networkShowCmd)
+	networkCmd.AddCommand(networkPeerCmd)
+	networkPeerCmd.AddCommand(networkPeerCreateCmd)
+	networkPeerCmd.AddCommand(networkPeerListCmd)
+	networkPeerCmd.AddCommand(networkPeerDeleteCmd)
+
+	// Silence usage on errors for clean error messages
+	networkCmd.SilenceUsage = true
+	networkCreateCmd.SilenceUsage = true
+	networkShowCmd.SilenceUsage = true
+	networkPeerCmd.SilenceUsage = true
+	networkPeerCreateCmd.SilenceUsage = true
+	networkPeerListCmd.SilenceUsage = true
+	networkPeerDeleteCmd.SilenceUsage = true
+
+	// Network create flags
+	networkCreateCmd.Flags().Bool("wait", false, "Wait for the instances to be attached")
+
+	// Peer create flags
+	networkPeerCreateCmd.Flags().StringP("file", "f", "", "Where to write the config, - for stdout (default: NAME.conf)")
+	networkPeerCreateCmd.Flags().Bool("force", false, "Overwrite the file if it exists")
+
+	// Peer delete flags
+	networkPeerDeleteCmd.Flags().Bool("wait", false, "Wait for the tunnel to be closed")
+}
+
+func runNetworkCreate(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	orgID, err := defaultOrg()
+	if err != nil {
+		return err
+	}
+
+	network, jobID, err := c.CreatePrivateNetwork(cmd.Context(), orgID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(network)
+	}
+	wait, _ := cmd.Flags().GetBool("wait")
+	if !wait {
+		fmt.Printf("%s Created private network %s\n", colors.Green("✓"), network.Subnet)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
+	}
+
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Attaching the instances failed: ") + job.ErrorMessage)
+	}
+	fmt.Printf("%s Created private network %s and attached the instances\n", colors.Green("✓"), network.Subnet)
+	printPrivateNetwork(network)
+	return nil
+}
+
+func runNetworkShow(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	orgID, err := defaultOrg()
+	if err != nil {
+		return err
+	}
+
+	network, err := c.GetPrivateNetwork(cmd.Context(), orgID)
+	if client.IsNotFound(err) {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("The organization has no private network. Run ") + colors.Cyan("dbx network create") + colors.White(" first"))
+	}
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(network)
+	}
+	printPrivateNetwork(network)
+	return nil
+}
+
+func printPrivateNetwork(network *client.PrivateNetwork) {
+	fmt.Printf("%s   %s\n", colors.TableHeader("subnet "), colors.Cyan(network.Subnet))
+	fmt.Printf("%s   %s\n", colors.TableHeader("vlan   "), colors.White(fmt.Sprint(network.VLAN)))
+	fmt.Printf("%s   %s\n", colors.TableHeader("created"), colors.Gray(network.CreatedAt.Format("2006-01-02")))
+}
+
+func runNetworkPeerCreate(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	orgID, err := defaultOrg()
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	path, _ := cmd.Flags().GetString("file")
+	if path == "" {
+		path = name + ".conf"
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	// Refuse before minting keys that would be thrown away
+	if path != "-" && !force {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf(colors.Red("✗") + " " + colors.Cyan(path) + colors.White(" exists; pass ") + colors.Cyan("--force") + colors.White(" to overwrite it"))
+		}
+	}
+
+	created, err := c.CreatePeer(cmd.Context(), orgID, name)
+	if client.IsNotFound(err) {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("The organization has no private network. Run ") + colors.Cyan("dbx network create") + colors.White(" first"))
+	}
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if path == "-" {
+		fmt.Print(created.Config)
+		return nil
+	}
+	if err := writeSecretFile(path, created.Config, force); err != nil {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Created peer "+created.Peer.ID+", but failed to write its config: ") + err.Error())
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(created.Peer)
+	}
+	fmt.Printf("%s Created peer %s at %s\n", colors.Green("✓"), colors.Cyan(created.Peer.Name), created.Peer.Address)
+	// wg-quick takes an argument without a slash for an interface name
+	upPath := path
+	if !filepath.IsAbs(path) {
+		upPath = "./" + filepath.Clean(path)
+	}
+	fmt.Printf("Wrote %s; bring the tunnel up with %s\n", colors.Cyan(path), colors.Cyan("sudo wg-quick up "+upPath))
+	return nil
+}
+
+// writeSecretFile writes data to path readable only by the user, refusing
+// to replace an existing file unless force is set.
+func writeSecretFile(path, data string, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s exists", path)
+	}
+	if err != nil {
+		return err
+	}
+	// An overwritten file keeps its mode otherwise
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runNetworkPeerList(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	orgID, err := defaultOrg()
+	if err != nil {
+		return err
+	}
+
+	peers, err := c.ListPeers(cmd.Context(), orgID)
+	if client.IsNotFound(err) {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("The organization has no private network. Run ") + colors.Cyan("dbx network create") + colors.White(" first"))
+	}
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if viper.GetString("output") == "json" {
+		return printJSON(peers)
+	}
+	if len(peers) == 0 {
+		fmt.Println(colors.Gray("No peers found"))
+		return nil
+	}
+
+	fmt.Printf("%s   %s   %s   %s\n",
+		colors.TableHeader("id"),
+		colors.TableHeader("name"),
+		colors.TableHeader("address"),
+		colors.TableHeader("created"))
+	for _, peer := range peers {
+		fmt.Printf("%s   %s   %s   %s\n",
+			colors.Cyan(peer.ID[:8]),
+			colors.White(peer.Name),
+			colors.White(peer.Address),
+			colors.Gray(peer.CreatedAt.Format("2006-01-02")))
+	}
+	return nil
+}
+
+func runNetworkPeerDelete(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	orgID, err := defaultOrg()
+	if err != nil {
+		return err
+	}
+
+	peerID := args[0]
+	jobID, err := c.DeletePeer(cmd.Context(), orgID, peerID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	wait, _ := cmd.Flags().GetBool("wait")
+	if !wait {
+		fmt.Printf("Deleted peer %s\n", peerID)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
+	}
+	job, err := waitWithProgress(cmd, c, jobID)
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Closing the tunnel failed: ") + job.ErrorMessage)
+	}
+	fmt.Printf("%s Deleted peer %s and closed its tunnel\n", colors.Green("✓"), peerID)
+	return nil
+}
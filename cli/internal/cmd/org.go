@@ -1,14 +1,14 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
 	"github.com/zallarak/db/cli/internal/colors"
 )
 
@@ -37,67 +37,64 @@ var orgCreateCmd = &cobra.Command{
 	RunE:  runOrgCreate,
 }
 
+var orgDeleteCmd = &cobra.Command{
+	Use:   "delete [org-id]",
+	Short: colors.Gray("Delete an organization"),
+	Long: colors.Gray("Delete an organization with its projects. Organizations with instances are refused unless ") +
+		colors.Cyan("--cascade") + colors.Gray(" is given, which deletes the instances first."),
+	Args: cobra.ExactArgs(1),
+	RunE: runOrgDelete,
+}
+
+var orgQuotasCmd = &cobra.Command{
+	Use:   "quotas [org-id]",
+	Short: colors.Gray("Show quota usage of an organization and its projects"),
+	Long: colors.Gray("Show how much of its quotas an organization and each of its projects use. ") +
+		colors.Gray("Defaults to the selected organization."),
+	Args: cobra.MaximumNArgs(1),
+	RunE: runOrgQuotas,
+}
+
 func init() {
 	rootCmd.AddCommand(orgCmd)
 	orgCmd.AddCommand(orgListCmd)
 	orgCmd.AddCommand(orgSelectCmd)
 	orgCmd.AddCommand(orgCreateCmd)
+	orgCmd.AddCommand(orgDeleteCmd)
+	orgCmd.AddCommand(orgQuotasCmd)
 	
 	// Silence usage on errors for clean error messages
 	orgCmd.SilenceUsage = true
 	orgListCmd.SilenceUsage = true
 	orgSelectCmd.SilenceUsage = true
 	orgCreateCmd.SilenceUsage = true
+	orgDeleteCmd.SilenceUsage = true
+	orgQuotasCmd.SilenceUsage = true
+
+	// Org delete flags
+	orgDeleteCmd.Flags().Bool("cascade", false, "Also delete every instance in the organization")
+	orgDeleteCmd.Flags().Bool("force", false, "Force deletion without confirmation")
+	orgDeleteCmd.Flags().Bool("wait", false, "Wait for the deletion to finish")
 }
 
 func runOrgList(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
-	}
-
-	apiURL := viper.GetString("api-url")
-	req, err := http.NewRequest("GET", apiURL+"/v1/orgs", nil)
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	orgs, err := c.ListOrgs(cmd.Context())
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Request failed with status %d"), resp.StatusCode)
-	}
-
-	var response struct {
-		Orgs []struct {
-			ID        string `json:"id"`
-			Name      string `json:"name"`
-			Role      string `json:"role"`
-			CreatedAt string `json:"created_at"`
-		} `json:"orgs"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		return apiError(err, "Request failed")
 	}
 
 	outputFormat := viper.GetString("output")
 	if outputFormat == "json" {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(response.Orgs)
+		return printJSON(orgs)
 	}
 
 	// Clean table output
-	if len(response.Orgs) == 0 {
+	if len(orgs) == 0 {
 		fmt.Println(colors.Gray("No organizations found"))
 		return nil
 	}
@@ -108,12 +105,12 @@ func runOrgList(cmd *cobra.Command, args []string) error {
 		colors.TableHeader("role"),
 		colors.TableHeader("created"))
 	
-	for _, org := range response.Orgs {
+	for _, org := range orgs {
 		fmt.Printf("%s   %s   %s   %s\n",
 			colors.Cyan(org.ID[:8]),
 			colors.White(org.Name),
 			colors.Gray(org.Role),
-			colors.Gray(org.CreatedAt[:10]))
+			colors.Gray(org.CreatedAt.Format("2006-01-02")))
 	}
 	return nil
 }
@@ -138,55 +135,151 @@ func runOrgSelect(cmd *cobra.Command, args []string) error {
 }
 
 func runOrgCreate(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	org, err := c.CreateOrg(cmd.Context(), args[0])
+	if err != nil {
+		return apiError(err, "Request failed")
 	}
 
-	orgName := args[0]
+	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Created organization: ") + colors.Cyan(org.Name) + colors.Gray(" (") + colors.Cyan(org.ID[:8]) + colors.Gray(")") + "\n")
+	return nil
+}
 
-	createReq := map[string]string{
-		"name": orgName,
+func runOrgDelete(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
 	}
 
-	reqBody, err := json.Marshal(createReq)
+	orgID := args[0]
+	cascade, _ := cmd.Flags().GetBool("cascade")
+	force, _ := cmd.Flags().GetBool("force")
+	wait, _ := cmd.Flags().GetBool("wait")
+
+	org, err := c.GetOrg(cmd.Context(), orgID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return apiError(err, "Request failed")
 	}
 
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/orgs", apiURL)
-	
-	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	if !force {
+		if cascade {
+			fmt.Printf("Are you sure you want to delete organization %s and all of its instances? (y/N): ", org.Name)
+		} else {
+			fmt.Printf("Are you sure you want to delete organization %s? (y/N): ", org.Name)
+		}
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Deletion cancelled")
+			return nil
+		}
+	}
+
+	jobID, err := c.DeleteOrg(cmd.Context(), orgID, cascade)
+	if client.IsConflict(err) {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Organization has instances. Delete them first or run with ") + colors.Cyan("--cascade"))
+	}
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if !wait {
+		fmt.Printf("Organization %s deletion initiated\n", org.Name)
+		fmt.Printf("Job ID: %s\n", jobID)
+		return nil
+	}
+
+	fmt.Println(colors.Gray("Waiting for deletion to finish..."))
+	job, err := c.WaitForJob(cmd.Context(), jobID, 2*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return apiError(err, "Request failed")
+	}
+	if job.Status != client.JobStatusCompleted {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Deletion failed: ") + job.ErrorMessage)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	// Forget the organization if it was the default
+	if viper.GetString("default-org") == orgID {
+		viper.Set("default-org", "")
+		configPath := viper.ConfigFileUsed()
+		if configPath == "" {
+			home, _ := os.UserHomeDir()
+			configPath = home + "/.dbx.yaml"
+		}
+		if err := viper.WriteConfigAs(configPath); err != nil {
+			return fmt.Errorf("failed to save config: %w", err)
+		}
+	}
+
+	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Deleted organization: ") + colors.Cyan(org.Name) + "\n")
+	return nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func runOrgQuotas(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	var orgID string
+	if len(args) > 0 {
+		orgID = args[0]
+	} else if orgID, err = defaultOrg(); err != nil {
+		return err
 	}
 
-	var response struct {
-		Org struct {
-			ID   string `json:"id"`
-			Name string `json:"name"`
-		} `json:"org"`
+	quotas, err := c.OrgQuotas(cmd.Context(), orgID)
+	if err != nil {
+		return apiError(err, "Request failed")
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+	outputFormat := viper.GetString("output")
+	if outputFormat == "json" {
+		return printJSON(quotas)
 	}
 
-	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Created organization: ") + colors.Cyan(response.Org.Name) + colors.Gray(" (") + colors.Cyan(response.Org.ID[:8]) + colors.Gray(")") + "\n")
+	fmt.Printf("%s   %s   %s   %s   %s   %s\n",
+		colors.TableHeader("scope"),
+		colors.TableHeader("instances"),
+		colors.TableHeader("vcpus"),
+		colors.TableHeader("memory (MB)"),
+		colors.TableHeader("disk (GiB)"),
+		colors.TableHeader("plans"))
+
+	printQuotaRow(colors.White("organization"), quotas.Org)
+	for _, p := range quotas.Projects {
+		printQuotaRow(colors.Cyan(p.Name), p.QuotaStatus)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// printQuotaRow prints usage against limits as used/limit, with an
+// exhausted limit in red.
+func printQuotaRow(scope string, q client.QuotaStatus) {
+	usage := func(used int, limit *int) string {
+		if limit == nil {
+			return colors.Gray(fmt.Sprintf("%d/∞", used))
+		}
+		s := fmt.Sprintf("%d/%d", used, *limit)
+		if used >= *limit {
+			return colors.Red(s)
+		}
+		return colors.White(s)
+	}
+	plans := "all"
+	if len(q.Limits.Plans) > 0 {
+		plans = strings.Join(q.Limits.Plans, ",")
+	}
+
+	fmt.Printf("%s   %s   %s   %s   %s   %s\n",
+		scope,
+		usage(q.Usage.Instances, q.Limits.Instances),
+		usage(q.Usage.VCPUs, q.Limits.VCPUs),
+		usage(q.Usage.MemoryMB, q.Limits.MemoryMB),
+		usage(q.Usage.DiskGiB, q.Limits.DiskGiB),
+		colors.Gray(plans))
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+var plansCmd = &cobra.Command{
+	Use:   "plans",
+	Short: colors.Gray("Instance plan commands"),
+}
+
+var plansListCmd = &cobra.Command{
+	Use:   "list",
+	Short: colors.Gray("List the plans instances can be created with"),
+	RunE:  runPlansList,
+}
+
+func init() {
+	rootCmd.AddCommand(plansCmd)
+	plansCmd.AddCommand(plansListCmd)
+
+	// Silence usage on errors for clean error messages
+	plansCmd.SilenceUsage = true
+	plansListCmd.SilenceUsage = true
+
+	plansListCmd.Flags().Bool("all", false, "Include deprecated plans")
+}
+
+func runPlansList(cmd *cobra.Command, args []string) error {
+	all, _ := cmd.Flags().GetBool("all")
+
+	plans, err := newAnonymousClient().ListPlans(cmd.Context())
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+	if !all {
+		n := 0
+		for _, p := range plans {
+			if !p.Deprecated {
+				plans[n] = p
+				n++
+			}
+		}
+		plans = plans[:n]
+	}
+
+	outputFormat := viper.GetString("output")
+	if outputFormat == "json" {
+		return printJSON(plans)
+	}
+
+	if len(plans) == 0 {
+		fmt.Println(colors.Gray("No plans found"))
+		return nil
+	}
+
+	fmt.Printf("%s   %s   %s   %s   %s   %s\n",
+		colors.TableHeader("name"),
+		colors.TableHeader("vcpus"),
+		colors.TableHeader("memory"),
+		colors.TableHeader("disk (GiB)"),
+		colors.TableHeader("connections"),
+		colors.TableHeader("postgres"))
+
+	for _, p := range plans {
+		versions := make([]string, len(p.PgVersions))
+		for i, v := range p.PgVersions {
+			versions[i] = strconv.Itoa(v)
+		}
+		name := colors.White(p.Name)
+		if p.Deprecated {
+			name = colors.Gray(p.Name + " (deprecated)")
+		}
+		fmt.Printf("%s   %s   %s   %s   %s   %s\n",
+			name,
+			colors.White(strconv.Itoa(p.VCPUs)),
+			colors.White(fmt.Sprintf("%d GiB", p.MemoryMB/1024)),
+			colors.White(fmt.Sprintf("%d", p.DiskGiB))+colors.Gray(fmt.Sprintf(" (%d-%d)", p.MinDiskGiB, p.MaxDiskGiB)),
+			colors.Gray(strconv.Itoa(p.MaxConnections)),
+			colors.Gray(strings.Join(versions, ", ")))
+	}
+	return nil
+}
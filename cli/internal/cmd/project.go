@@ -1,11 +1,7 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -42,59 +38,28 @@ func init() {
 }
 
 func runProjectList(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
-	}
-
-	orgID := viper.GetString("default-org")
-	if orgID == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("No default organization selected. Run ") + colors.Cyan("dbx org select <org-id>") + colors.White(" first"))
-	}
-
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/orgs/%s/projects", apiURL, orgID)
-	
-	req, err := http.NewRequest("GET", url, nil)
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	orgID, err := defaultOrg()
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
-	}
-
-	var response struct {
-		Projects []struct {
-			ID        string `json:"id"`
-			Name      string `json:"name"`
-			CreatedAt string `json:"created_at"`
-		} `json:"projects"`
+		return err
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+	projects, err := c.ListProjects(cmd.Context(), orgID)
+	if err != nil {
+		return apiError(err, "Request failed")
 	}
 
 	outputFormat := viper.GetString("output")
 	if outputFormat == "json" {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(response.Projects)
+		return printJSON(projects)
 	}
 
 	// Clean table output
-	if len(response.Projects) == 0 {
+	if len(projects) == 0 {
 		fmt.Println(colors.Gray("No projects found"))
 		return nil
 	}
@@ -104,68 +69,31 @@ func runProjectList(cmd *cobra.Command, args []string) error {
 		colors.TableHeader("name"), 
 		colors.TableHeader("created"))
 	
-	for _, project := range response.Projects {
+	for _, project := range projects {
 		fmt.Printf("%s   %s   %s\n",
 			colors.Cyan(project.ID[:8]),
 			colors.White(project.Name),
-			colors.Gray(project.CreatedAt[:10]))
+			colors.Gray(project.CreatedAt.Format("2006-01-02")))
 	}
 	return nil
 }
 
 func runProjectCreate(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
-	}
-
-	orgID := viper.GetString("default-org")
-	if orgID == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("No default organization selected. Run ") + colors.Cyan("dbx org select <org-id>") + colors.White(" first"))
-	}
-
-	projectName := args[0]
-
-	createReq := map[string]string{
-		"name": projectName,
-	}
-
-	reqBody, err := json.Marshal(createReq)
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return err
 	}
 
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/orgs/%s/projects", apiURL, orgID)
-	
-	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	orgID, err := defaultOrg()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	project, err := c.CreateProject(cmd.Context(), orgID, args[0])
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
-	}
-
-	var project struct {
-		ID   string `json:"id"`
-		Name string `json:"name"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&project); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		return apiError(err, "Request failed")
 	}
 
 	fmt.Printf(colors.SuccessIcon() + " " + colors.White("Created project: ") + colors.Cyan(project.Name) + colors.Gray(" (") + colors.Cyan(project.ID[:8]) + colors.Gray(")") + "\n")
 	return nil
-}
\ No newline at end of file
+}
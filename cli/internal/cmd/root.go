@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
 	"github.com/zallarak/db/cli/internal/colors"
 )
 
@@ -60,4 +62,35 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		// Silent config loading for minimal output
 	}
-}
\ No newline at end of file
+}
+
+// newClient returns an API client authenticated with the saved token.
+func newClient() (*client.Client, error) {
+	token := viper.GetString("token")
+	if token == "" {
+		return nil, fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
+	}
+	return client.New(viper.GetString("api-url"), client.WithToken(token), client.WithUserAgent("dbx")), nil
+}
+
+// newAnonymousClient returns an API client for the login and registration
+// endpoints, which take no token.
+func newAnonymousClient() *client.Client {
+	return client.New(viper.GetString("api-url"), client.WithUserAgent("dbx"))
+}
+
+// defaultOrg returns the organization chosen with `dbx org select`.
+func defaultOrg() (string, error) {
+	orgID := viper.GetString("default-org")
+	if orgID == "" {
+		return "", fmt.Errorf(colors.Red("✗") + " " + colors.White("No default organization selected. Run ") + colors.Cyan("dbx org select <org-id>") + colors.White(" first"))
+	}
+	return orgID, nil
+}
+
+// printJSON writes v indented, for --output json.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zallarak/db/cli/client"
+	"github.com/zallarak/db/cli/internal/colors"
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: colors.Gray("Print the CA certificates instances are verified with"),
+	Long: `Print the CA certificates that instance certificates chain to, or write
+them to a file with --file. Point Postgres clients at the file to verify
+the instance they connect to:
+
+  dbx ca -f ca.pem
+  psql "host=pg-4b5f17a4.cust.db.xyz sslmode=verify-full sslrootcert=ca.pem ..."
+
+Certificates issued by a public ACME CA need no bundle; clients verify
+them with the roots of the system.`,
+	Args: cobra.NoArgs,
+	RunE: runCA,
+}
+
+var instanceCertificateCmd = &cobra.Command{
+	Use:   "certificate [instance-id]",
+	Short: "Show the TLS certificate a database instance serves",
+	Long: `Show the TLS certificate a database instance serves: the names it is valid
+for, its validity and when it is renewed. With --pem the certificate is
+printed in PEM instead, followed by the intermediates it chains to.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInstanceCertificate,
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	instanceCmd.AddCommand(instanceCertificateCmd)
+
+	// Silence usage on errors for clean error messages
+	caCmd.SilenceUsage = true
+	instanceCertificateCmd.SilenceUsage = true
+
+	// CA flags
+	caCmd.Flags().StringP("file", "f", "", "Write the certificates to a file instead of stdout")
+	caCmd.Flags().Bool("force", false, "Overwrite the file if it exists")
+
+	// Certificate flags
+	instanceCertificateCmd.Flags().Bool("pem", false, "Print the certificate in PEM")
+}
+
+func runCA(cmd *cobra.Command, args []string) error {
+	// The bundle is public, so clients can fetch it before logging in
+	c := newAnonymousClient()
+
+	bundle, err := c.GetCABundle(cmd.Context())
+	if client.IsNotFound(err) {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.White("The server issues no certificates; instances serve self-signed ones"))
+	}
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	path, _ := cmd.Flags().GetString("file")
+	if path == "" || path == "-" {
+		_, err := os.Stdout.Write(bundle)
+		return err
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if os.IsExist(err) {
+		return fmt.Errorf(colors.Red("✗") + " " + colors.Cyan(path) + colors.White(" exists; pass ") + colors.Cyan("--force") + colors.White(" to overwrite it"))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bundle); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("%s Wrote the CA certificates to %s\n", colors.Green("✓"), colors.Cyan(path))
+	return nil
+}
+
+func runInstanceCertificate(cmd *cobra.Command, args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	cert, err := c.GetCertificate(cmd.Context(), args[0])
+	if client.IsNotFound(err) {
+		if _, ierr := c.GetInstance(cmd.Context(), args[0]); ierr == nil {
+			return fmt.Errorf(colors.Red("✗") + " " + colors.White("No certificate has been issued to the instance yet"))
+		}
+	}
+	if err != nil {
+		return apiError(err, "Request failed")
+	}
+
+	if pem, _ := cmd.Flags().GetBool("pem"); pem {
+		fmt.Print(cert.PEM)
+		return nil
+	}
+	if viper.GetString("output") == "json" {
+		return printJSON(cert)
+	}
+	fmt.Printf("%s   %s\n", colors.TableHeader("names     "), colors.Cyan(strings.Join(cert.DNSNames, ", ")))
+	fmt.Printf("%s   %s\n", colors.TableHeader("issuer    "), colors.White(cert.Issuer))
+	fmt.Printf("%s   %s\n", colors.TableHeader("serial    "), colors.Gray(cert.Serial))
+	fmt.Printf("%s   %s\n", colors.TableHeader("valid from"), colors.White(cert.NotBefore.Local().Format("2006-01-02 15:04")))
+	fmt.Printf("%s   %s\n", colors.TableHeader("expires   "), colors.White(cert.NotAfter.Local().Format("2006-01-02 15:04")))
+	fmt.Printf("%s   %s\n", colors.TableHeader("renews    "), colors.Gray(cert.RenewAt.Local().Format("2006-01-02 15:04")))
+	return nil
+}
@@ -1,10 +1,7 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -32,56 +29,25 @@ func init() {
 }
 
 func runUserMe(cmd *cobra.Command, args []string) error {
-	token := viper.GetString("token")
-	if token == "" {
-		return fmt.Errorf(colors.Red("✗") + " " + colors.White("Not logged in. Run ") + colors.Cyan("dbx auth login") + colors.White(" first"))
-	}
-
-	apiURL := viper.GetString("api-url")
-	url := fmt.Sprintf("%s/v1/users/me", apiURL)
-
-	req, err := http.NewRequest("GET", url, nil)
+	c, err := newClient()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	user, err := c.CurrentUser(cmd.Context())
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed with status %d", resp.StatusCode)
-	}
-
-	var response struct {
-		User struct {
-			ID        string `json:"id"`
-			Email     string `json:"email"`
-			CreatedAt string `json:"created_at"`
-		} `json:"user"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		return apiError(err, "Request failed")
 	}
 
 	outputFormat := viper.GetString("output")
 	if outputFormat == "json" {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(response.User)
+		return printJSON(user)
 	}
 
 	// Clean field output
-	fmt.Printf("%s %s\n", colors.FieldLabel("ID"), colors.Cyan(response.User.ID[:8]))
-	fmt.Printf("%s %s\n", colors.FieldLabel("Email"), colors.White(response.User.Email))
-	fmt.Printf("%s %s\n", colors.FieldLabel("Created"), colors.Gray(response.User.CreatedAt[:10]))
+	fmt.Printf("%s %s\n", colors.FieldLabel("ID"), colors.Cyan(user.ID[:8]))
+	fmt.Printf("%s %s\n", colors.FieldLabel("Email"), colors.White(user.Email))
+	fmt.Printf("%s %s\n", colors.FieldLabel("Created"), colors.Gray(user.CreatedAt.Format("2006-01-02")))
 
 	return nil
-}
\ No newline at end of file
+}